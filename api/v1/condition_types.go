@@ -21,10 +21,54 @@ const (
 	// health assessment result.
 	HealthyCondition string = "Healthy"
 
+	// DriftDetectedCondition represents the fact that some of
+	// the reconciled resources drifted from their desired state,
+	// and were not corrected according to the drift detection mode.
+	DriftDetectedCondition string = "DriftDetected"
+
+	// InsufficientPermissionsCondition represents the fact that the
+	// identity of the controller is not allowed to apply some of
+	// the reconciled resources.
+	InsufficientPermissionsCondition string = "InsufficientPermissions"
+
+	// UnsupportedAPIsCondition represents the fact that the API versions
+	// of some of the reconciled resources are not served by the cluster.
+	UnsupportedAPIsCondition string = "UnsupportedAPIs"
+
+	// DecryptionFailedCondition represents the fact that some of
+	// the reconciled resources failed to be decrypted, and were
+	// not applied according to the report-only decryption mode.
+	DecryptionFailedCondition string = "DecryptionFailed"
+
+	// DecryptionKeyExpiringCondition represents the fact that some of
+	// the keys used to decrypt the reconciled resources expire soon.
+	DecryptionKeyExpiringCondition string = "DecryptionKeyExpiring"
+
+	// DriftDetectedReason represents the fact that the
+	// drift of the reconciled resources was detected.
+	DriftDetectedReason string = "DriftDetected"
+
+	// FieldConflictReason represents the fact that the apply of the
+	// resources conflicts with other managers of their fields.
+	FieldConflictReason string = "FieldConflict"
+
+	// InsufficientPermissionsReason represents the fact that the
+	// permission check of the reconciled resources failed.
+	InsufficientPermissionsReason string = "InsufficientPermissions"
+
+	// UnsupportedAPIsReason represents the fact that the API check
+	// of the reconciled resources failed.
+	UnsupportedAPIsReason string = "UnsupportedAPIs"
+
 	// PruneFailedReason represents the fact that the
 	// pruning of the Kustomization failed.
 	PruneFailedReason string = "PruneFailed"
 
+	// PruneWaitFailedReason represents the fact that the
+	// pruned resources were not deleted within the timeout,
+	// e.g. because of pending finalizers.
+	PruneWaitFailedReason string = "PruneWaitFailed"
+
 	// ArtifactFailedReason represents the fact that the
 	// source artifact download failed.
 	ArtifactFailedReason string = "ArtifactFailed"
@@ -33,10 +77,70 @@ const (
 	// kustomize build failed.
 	BuildFailedReason string = "BuildFailed"
 
+	// DecryptionFailedReason represents the fact that the
+	// decryption of some of the reconciled resources failed.
+	DecryptionFailedReason string = "DecryptionFailed"
+
+	// DecryptionForbiddenReason represents the fact that the
+	// decryption failed because the credentials are not authorized
+	// to use the key.
+	DecryptionForbiddenReason string = "Forbidden"
+
+	// DecryptionKeyNotFoundReason represents the fact that the
+	// decryption failed because the key does not exist.
+	DecryptionKeyNotFoundReason string = "KeyNotFound"
+
+	// DecryptionKeyDisabledReason represents the fact that the
+	// decryption failed because the key is disabled.
+	DecryptionKeyDisabledReason string = "KeyDisabled"
+
+	// DecryptionKeyDeletedReason represents the fact that the
+	// decryption failed because the key is deleted, but can be
+	// recovered.
+	DecryptionKeyDeletedReason string = "KeyDeleted"
+
+	// DecryptionThrottledReason represents the fact that the
+	// decryption failed because the key service throttled the requests.
+	DecryptionThrottledReason string = "Throttled"
+
+	// DecryptionVaultUnavailableReason represents the fact that the
+	// decryption failed because the key service failed repeatedly, and
+	// its requests are failed fast for a cooldown.
+	DecryptionVaultUnavailableReason string = "VaultUnavailable"
+
+	// DecryptionSecretInvalidReason represents the fact that some of the
+	// entries of the decryption Secret are invalid, e.g. malformed age
+	// identities or Azure authentication files.
+	DecryptionSecretInvalidReason string = "DecryptionSecretInvalid"
+
+	// DecryptionKeyExpiringReason represents the fact that some of
+	// the keys used for decryption expire within the warning window.
+	DecryptionKeyExpiringReason string = "KeyExpiring"
+
+	// FrozenReason represents the fact that the reconciliation
+	// is frozen, the drift of the reconciled resources is
+	// reported without applying or pruning them.
+	FrozenReason string = "Frozen"
+
+	// SubstitutionPreviewReason represents the fact that the post build
+	// variable substitution of the revision is previewed, without
+	// applying or pruning the reconciled resources.
+	SubstitutionPreviewReason string = "SubstitutionPreview"
+
 	// HealthCheckFailedReason represents the fact that
 	// one of the health checks failed.
 	HealthCheckFailedReason string = "HealthCheckFailed"
 
+	// HealthCheckDegradedReason represents the fact that
+	// the health checks timed out, and the Kustomization is
+	// degraded according to the health check timeout mode.
+	HealthCheckDegradedReason string = "HealthCheckDegraded"
+
+	// PostApplyWebhookFailedReason represents the fact that
+	// the post-apply webhook rejected the applied revision,
+	// or could not be called.
+	PostApplyWebhookFailedReason string = "PostApplyWebhookFailed"
+
 	// DependencyNotReadyReason represents the fact that
 	// one of the dependencies is not ready.
 	DependencyNotReadyReason string = "DependencyNotReady"
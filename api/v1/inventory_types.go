@@ -31,4 +31,45 @@ type ResourceRef struct {
 
 	// Version is the API version of the Kubernetes resource object's kind.
 	Version string `json:"v"`
+
+	// Checksum is the HMAC-SHA256 checksum of the content of the Kubernetes
+	// resource object when it was last applied, keyed by the controller, and
+	// recorded when the Kustomization skips the apply of the unchanged
+	// objects.
+	// +optional
+	Checksum string `json:"c,omitempty"`
+}
+
+// ManagedObjectList contains a readable list of the Kubernetes objects
+// managed by a Kustomization, derived from the ResourceInventory.
+type ManagedObjectList struct {
+	// Entries of Kubernetes objects, capped to a maximum number of items.
+	// +optional
+	Entries []ManagedObject `json:"entries,omitempty"`
+
+	// Total is the number of objects in the inventory.
+	Total int `json:"total"`
+
+	// Truncated is true when the number of objects exceeds the maximum number
+	// of entries, in which case the complete list of objects can be found
+	// in '.status.inventory'.
+	// +optional
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ManagedObject contains the information necessary to identify a Kubernetes
+// object managed by a Kustomization.
+type ManagedObject struct {
+	// APIVersion of the Kubernetes object.
+	APIVersion string `json:"apiVersion"`
+
+	// Kind of the Kubernetes object.
+	Kind string `json:"kind"`
+
+	// Name of the Kubernetes object.
+	Name string `json:"name"`
+
+	// Namespace of the Kubernetes object, empty for cluster-scoped objects.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
 }
@@ -31,8 +31,61 @@ const (
 	EnabledValue              = "enabled"
 	DisabledValue             = "disabled"
 	MergeValue                = "merge"
+	WarnValue                 = "warn"
+	FailValue                 = "fail"
+	DegradeValue              = "degrade"
+	ForceTakeOwnershipValue   = "forceTakeOwnership"
+	IgnoreValue               = "ignore"
+	ErrorValue                = "error"
+	KeepValue                 = "keep"
+	EmptyValue                = "empty"
+	SecretsValue              = "secrets"
+	WorkloadsValue            = "workloads"
 )
 
+// BuildDumpAnnotation is the annotation which, when set to EnabledValue on a
+// Kustomization, dumps the objects built for each reconciliation to a
+// ConfigMap for debugging, with the Secret data redacted.
+const BuildDumpAnnotation = "kustomize.toolkit.fluxcd.io/dump-build"
+
+// SubstitutionPreviewAnnotation is the annotation which, when set to
+// EnabledValue on a Kustomization, renders the post build variable
+// substitution of each revision to a ConfigMap, with the values from Secrets
+// redacted, without applying or pruning any object.
+const SubstitutionPreviewAnnotation = "kustomize.toolkit.fluxcd.io/preview-substitution"
+
+// SecretProjectionAnnotation is the annotation of a SOPS encrypted Secret
+// which lists the namespaces, separated by commas, to which the decrypted
+// Secret is projected, in addition to its own namespace. The namespaces
+// must be allowed by the Decryption.ProjectionNamespaces of the
+// Kustomization.
+const SecretProjectionAnnotation = "kustomize.toolkit.fluxcd.io/project-to"
+
+// SecretProjectionKeysAnnotation is the annotation of a SOPS encrypted Secret
+// which lists the keys, separated by commas, of the data and stringData
+// which are projected. When not set, all the keys are projected.
+const SecretProjectionKeysAnnotation = "kustomize.toolkit.fluxcd.io/project-keys"
+
+// SecretChecksumAnnotation is the annotation of a decrypted Secret which
+// holds the checksum of its content, and of the pod templates of the
+// workloads referencing decrypted Secrets which holds the checksum of their
+// checksums, as stamped according to the Decryption.SecretChecksums of the
+// Kustomization. A change of the content of a Secret changes the annotation
+// of the pod templates, which triggers the rollout of the workloads.
+const SecretChecksumAnnotation = "kustomize.toolkit.fluxcd.io/secret-checksum"
+
+// ApplyStageAnnotation is the annotation of a reconciled resource which
+// assigns it to the stage of the Kustomization ApplyOrder with the given
+// name, regardless of its kind.
+const ApplyStageAnnotation = "kustomize.toolkit.fluxcd.io/apply-stage"
+
+// ForceApplyAnnotation is the annotation which requests the next
+// reconciliation to apply all the objects, including the ones which have
+// not drifted from their in-cluster state. The request is handled once per
+// annotation value, e.g. a timestamp, which is recorded in the status as
+// LastHandledForceApplyAt.
+const ForceApplyAnnotation = "reconcile.fluxcd.io/forceApplyAt"
+
 // KustomizationSpec defines the configuration to calculate the desired state
 // from a Source using Kustomize.
 type KustomizationSpec struct {
@@ -52,6 +105,10 @@ type KustomizationSpec struct {
 	// +optional
 	Decryption *Decryption `json:"decryption,omitempty"`
 
+	// BuildOptions holds the options of the Kustomize build.
+	// +optional
+	BuildOptions *BuildOptions `json:"buildOptions,omitempty"`
+
 	// The interval at which to reconcile the Kustomization.
 	// +kubebuilder:validation:Type=string
 	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
@@ -91,10 +148,35 @@ type KustomizationSpec struct {
 	// +required
 	Prune bool `json:"prune"`
 
+	// PruneWait instructs the controller to wait for the pruned resources to
+	// be fully deleted from the cluster, e.g. after their finalizers have
+	// run, before marking the reconciliation as done. The wait is bounded
+	// by the Timeout. Defaults to false.
+	// +optional
+	PruneWait bool `json:"pruneWait,omitempty"`
+
 	// A list of resources to be included in the health assessment.
 	// +optional
 	HealthChecks []meta.NamespacedObjectKindReference `json:"healthChecks,omitempty"`
 
+	// A list of Secrets to be included in the health assessment, e.g. the
+	// Secrets decrypted with SOPS. The health assessment only passes once
+	// every Secret exists with non-empty data. When the namespace is not
+	// specified, it defaults to the target namespace, or to the namespace
+	// of the Kustomization.
+	// +optional
+	HealthCheckSecrets []meta.NamespacedObjectReference `json:"healthCheckSecrets,omitempty"`
+
+	// HealthCheckTimeoutMode defines how a timeout of the health assessment
+	// is handled. With 'fail', the reconciliation fails with the
+	// HealthCheckFailed reason, and is retried with the failure backoff.
+	// With 'degrade', the Kustomization is marked as degraded with the
+	// HealthCheckDegraded reason while it remains progressing, and is
+	// reconciled again at the interval. Defaults to 'fail'.
+	// +kubebuilder:validation:Enum=fail;degrade
+	// +optional
+	HealthCheckTimeoutMode string `json:"healthCheckTimeoutMode,omitempty"`
+
 	// Strategic merge and JSON patches, defined as inline YAML objects,
 	// capable of targeting objects based on kind, label and annotation selectors.
 	// +optional
@@ -111,6 +193,16 @@ type KustomizationSpec struct {
 	// +optional
 	ServiceAccountName string `json:"serviceAccountName,omitempty"`
 
+	// The namespace of the Kubernetes service account to impersonate,
+	// defaults to the namespace of the Kustomization.
+	// Impersonating a service account from a different namespace requires
+	// the controller to be started with --allow-cross-namespace-impersonation,
+	// and it can't be used in combination with KustomizationSpec.KubeConfig.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=63
+	// +optional
+	ServiceAccountNamespace string `json:"serviceAccountNamespace,omitempty"`
+
 	// Reference of the source where the kustomization file is.
 	// +required
 	SourceRef CrossNamespaceSourceReference `json:"sourceRef"`
@@ -120,6 +212,13 @@ type KustomizationSpec struct {
 	// +optional
 	Suspend bool `json:"suspend,omitempty"`
 
+	// Freeze instructs the controller to stop applying and pruning the
+	// resources, while it keeps detecting their drift from the desired state
+	// of the latest revision, which is reported in the DriftDetected
+	// condition. Suspend takes precedence over Freeze. Defaults to false.
+	// +optional
+	Freeze bool `json:"freeze,omitempty"`
+
 	// TargetNamespace sets or overrides the namespace in the
 	// kustomization.yaml file.
 	// +kubebuilder:validation:MinLength=1
@@ -135,6 +234,37 @@ type KustomizationSpec struct {
 	// +optional
 	Timeout *metav1.Duration `json:"timeout,omitempty"`
 
+	// DriftDetection defines how the in-cluster drift of the reconciled
+	// resources is handled.
+	// +optional
+	DriftDetection *DriftDetection `json:"driftDetection,omitempty"`
+
+	// ConflictResolution defines how the conflicts with the other managers
+	// of the fields of the reconciled resources are resolved on apply.
+	// When not specified, the fields are taken over without being reported.
+	// +optional
+	ConflictResolution *ConflictResolution `json:"conflictResolution,omitempty"`
+
+	// SkipUnchanged instructs the controller to skip the apply of the
+	// resources whose content did not change since their last apply,
+	// according to the checksums recorded in the inventory. The skipped
+	// resources are not corrected when they drift from their desired state,
+	// unless a full apply is requested. Defaults to false.
+	// +optional
+	SkipUnchanged bool `json:"skipUnchanged,omitempty"`
+
+	// PermissionCheck instructs the controller to verify with a server-side
+	// apply dry-run that it is allowed to apply all the resources, before
+	// applying any of them. Defaults to false.
+	// +optional
+	PermissionCheck bool `json:"permissionCheck,omitempty"`
+
+	// APICheck instructs the controller to verify with the API discovery of
+	// the cluster that the API versions of all the resources are served,
+	// before applying any of them. Defaults to false.
+	// +optional
+	APICheck bool `json:"apiCheck,omitempty"`
+
 	// Force instructs the controller to recreate resources
 	// when patching fails due to an immutable field change.
 	// +kubebuilder:default:=false
@@ -146,9 +276,113 @@ type KustomizationSpec struct {
 	// +optional
 	Wait bool `json:"wait,omitempty"`
 
+	// ApplyOrder defines the stages in which the resources are applied,
+	// after the CRDs, Namespaces and Class types. The resources of a stage
+	// are applied once the resources of the previous stages are ready.
+	// The resources which are not selected by any stage are applied last.
+	// +optional
+	ApplyOrder []ApplyStage `json:"applyOrder,omitempty"`
+
 	// Components specifies relative paths to specifications of other Components.
 	// +optional
 	Components []string `json:"components,omitempty"`
+
+	// PostApplyWebhook defines an external endpoint which validates the
+	// applied resources after the health checks have passed. The
+	// Kustomization is marked as ready only if the endpoint accepts
+	// the applied revision.
+	// +optional
+	PostApplyWebhook *PostApplyWebhook `json:"postApplyWebhook,omitempty"`
+}
+
+// ApplyStage defines a stage of the apply of the reconciled resources.
+type ApplyStage struct {
+	// Name of the stage, which the resources can be assigned to with the
+	// ApplyStageAnnotation.
+	// +kubebuilder:validation:MinLength=1
+	// +required
+	Name string `json:"name"`
+
+	// Kinds of the resources applied in the stage, unless they are assigned
+	// to another stage with the ApplyStageAnnotation.
+	// +optional
+	Kinds []ApplyStageKind `json:"kinds,omitempty"`
+}
+
+// ApplyStageKind selects the resources of a kind.
+type ApplyStageKind struct {
+	// Group of the kind, matching any group when not specified.
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	// Version of the kind, matching any version when not specified.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// Kind of the resources.
+	// +required
+	Kind string `json:"kind"`
+}
+
+// DriftDetection defines the strategy for handling the drift of the
+// reconciled resources from their desired state.
+type DriftDetection struct {
+	// Mode defines how the drift is handled when neither the source revision
+	// nor the Kustomization spec changed since the last apply.
+	// With 'enabled', the drifted resources are corrected by applying them.
+	// With 'warn', the drifted resources are reported in the DriftDetected
+	// condition and with a warning event, but they are not corrected.
+	// With 'disabled', the drifted resources are neither reported nor
+	// corrected. Defaults to 'enabled'.
+	// +kubebuilder:validation:Enum=enabled;warn;disabled
+	// +optional
+	Mode string `json:"mode,omitempty"`
+}
+
+// ConflictResolution defines the strategy for resolving the server-side
+// apply conflicts with the other managers of the fields of the reconciled
+// resources.
+type ConflictResolution struct {
+	// Mode defines how the conflicting fields are handled.
+	// With 'forceTakeOwnership', the conflicting fields are taken over and
+	// reported with an event.
+	// With 'fail', the reconciliation fails on any conflict, without
+	// applying the resources.
+	// With 'ignore', the fields of the Managers are taken over without being
+	// reported, and the reconciliation fails on the conflicts with any other
+	// manager.
+	// Defaults to 'forceTakeOwnership'.
+	// +kubebuilder:validation:Enum=forceTakeOwnership;fail;ignore
+	// +optional
+	Mode string `json:"mode,omitempty"`
+
+	// Managers is the list of the field managers whose conflicts are
+	// ignored with the 'ignore' mode.
+	// +optional
+	Managers []string `json:"managers,omitempty"`
+}
+
+// PostApplyWebhook defines an HTTP endpoint which is called with a summary
+// of the applied inventory after a successful apply and health assessment.
+type PostApplyWebhook struct {
+	// URL of the endpoint the summary is posted to.
+	// +kubebuilder:validation:Pattern="^(http|https)://.*$"
+	// +required
+	URL string `json:"url"`
+
+	// Timeout of the request to the endpoint.
+	// Defaults to the Kustomization 'Timeout'.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// SecretRef holds the name of a Secret containing the credentials used
+	// to authenticate to the endpoint. The Secret must contain either a
+	// 'token' key, sent as a bearer token, or 'username' and 'password' keys,
+	// used for basic authentication.
+	// +optional
+	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
 }
 
 // CommonMetadata defines the common labels and annotations.
@@ -172,6 +406,114 @@ type Decryption struct {
 	// The secret name containing the private OpenPGP keys used for decryption.
 	// +optional
 	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// Include is a list of glob patterns matched against the paths of the
+	// files, relative to the root of the source, that should be decrypted.
+	// A '**' path element matches any number of directories.
+	// When empty, all files are inspected for SOPS encrypted data.
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Exclude is a list of glob patterns matched against the paths of the
+	// files, relative to the root of the source, that should not be decrypted.
+	// Exclude takes precedence over Include.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+
+	// ValidateSecrets verifies the structure of the decrypted Secrets, e.g.
+	// that the values of data are base64 encoded, before they are applied.
+	// +optional
+	ValidateSecrets bool `json:"validateSecrets,omitempty"`
+
+	// ReportOnly reports the resources which fail to be decrypted in the
+	// DecryptionFailed condition and events, instead of failing the
+	// reconciliation. The resources originating from the same files as the
+	// failed resources are not applied, and are not garbage collected.
+	// +optional
+	ReportOnly bool `json:"reportOnly,omitempty"`
+
+	// KeyProviderPriority is the list of key providers, named after their
+	// SOPS metadata field ('age', 'azure_kv', 'gcp_kms', 'hc_vault', 'kms'
+	// and 'pgp'), of which the master keys are attempted first, in the
+	// listed order, when decrypting the data key of a SOPS file. The master
+	// keys of the providers which are not listed are attempted next, the
+	// offline ones ('age' and 'pgp') first. When a master key fails to
+	// decrypt, the next one is attempted.
+	// +optional
+	KeyProviderPriority []string `json:"keyProviderPriority,omitempty"`
+
+	// AzureVaultPreference is the list of substrings of Azure Key Vault URLs,
+	// e.g. the name of a vault or the region in the names of the vaults, of
+	// which the 'azure_kv' master keys are attempted first, in the listed
+	// order, when a SOPS file lists the keys of multiple vaults. The
+	// substrings are matched case-insensitively. The keys of the vaults which
+	// do not match are attempted next, in the order of the SOPS metadata.
+	// +optional
+	AzureVaultPreference []string `json:"azureVaultPreference,omitempty"`
+
+	// ProjectionNamespaces is the list of the namespaces to which the
+	// decrypted Secrets can be projected, as requested by their
+	// SecretProjectionAnnotation. The projection to a namespace which is
+	// not listed fails the build. When empty, no Secret is projected.
+	// +optional
+	ProjectionNamespaces []string `json:"projectionNamespaces,omitempty"`
+
+	// AzureAuthFile is the absolute path of an Azure authentication file
+	// mounted in the controller Pod, e.g. from a projected volume, which is
+	// used to authenticate to Azure Key Vault instead of the 'sops.azure-kv'
+	// value of the SecretRef, which takes precedence. The path must be in
+	// the directory allowed by the controller for Azure authentication
+	// files.
+	// +optional
+	AzureAuthFile string `json:"azureAuthFile,omitempty"`
+
+	// SecretChecksums stamps the checksum of the content of each decrypted
+	// Secret as the SecretChecksumAnnotation on the Secret ('secrets'), and
+	// in addition on the pod templates of the workloads of the Kustomization
+	// which reference it ('workloads'), to trigger their rollout when the
+	// content changes. When empty, no checksum is stamped.
+	// +kubebuilder:validation:Enum=secrets;workloads
+	// +optional
+	SecretChecksums string `json:"secretChecksums,omitempty"`
+}
+
+const (
+	// LoadRestrictionsRootOnly restricts the files loaded by a Kustomization
+	// file to its directory and the directories below it.
+	LoadRestrictionsRootOnly string = "LoadRestrictionsRootOnly"
+
+	// LoadRestrictionsNone allows the files loaded by a Kustomization file
+	// to be anywhere in the source artifact.
+	LoadRestrictionsNone string = "LoadRestrictionsNone"
+
+	// ExecBuildPlugin is the type of the plugins and KRM functions which
+	// are run as executables.
+	ExecBuildPlugin string = "Exec"
+
+	// ContainerBuildPlugin is the type of the KRM functions which are
+	// downloaded and run as containers.
+	ContainerBuildPlugin string = "Container"
+)
+
+// BuildOptions holds the options of the Kustomize build.
+type BuildOptions struct {
+	// LoadRestrictor restricts the files which can be loaded by the
+	// Kustomization files. With 'LoadRestrictionsRootOnly', files can only be
+	// loaded from the directory of the Kustomization file referencing them,
+	// or the directories below it. Regardless of this setting, files outside
+	// of the source artifact can never be loaded.
+	// Defaults to 'LoadRestrictionsNone'.
+	// +kubebuilder:validation:Enum=LoadRestrictionsRootOnly;LoadRestrictionsNone
+	// +optional
+	LoadRestrictor string `json:"loadRestrictor,omitempty"`
+
+	// Plugins is the list of the types of non-builtin plugins which are
+	// enabled for the build, 'Exec' and/or 'Container'.
+	// The plugin types must be allowed by the controller with the
+	// --allowed-build-plugins flag. Defaults to builtin plugins only.
+	// +kubebuilder:validation:items:Enum=Exec;Container
+	// +optional
+	Plugins []string `json:"plugins,omitempty"`
 }
 
 // PostBuild describes which actions to perform on the YAML manifest
@@ -192,6 +534,29 @@ type PostBuild struct {
 	// happen.
 	// +optional
 	SubstituteFrom []SubstituteReference `json:"substituteFrom,omitempty"`
+
+	// SubstituteDecryptedData enables the variable substitution in the
+	// base64 encoded data values of the Secrets decrypted with the
+	// KustomizationSpec.Decryption provider. The substitution runs after
+	// the decryption, on the decoded values, which are encoded again
+	// afterwards.
+	// Note that this allows anyone with write access to the Kustomization,
+	// or to the ConfigMaps and Secrets referenced in SubstituteFrom, to alter
+	// the content of the decrypted Secrets. Values which contain a literal
+	// '${' sequence must be escaped using '$${'. Defaults to false.
+	// +optional
+	SubstituteDecryptedData bool `json:"substituteDecryptedData,omitempty"`
+
+	// SubstituteMissing is the policy for the variables which are referenced
+	// in the manifests without a default value, but are defined neither in
+	// Substitute nor in SubstituteFrom. Valid values are 'error', which
+	// fails the build, 'keep', which leaves the '${var}' references as is,
+	// and 'empty', which substitutes them with an empty string. When not
+	// specified, the references are substituted with an empty string, or
+	// left as is if no variable is defined at all.
+	// +kubebuilder:validation:Enum=error;keep;empty
+	// +optional
+	SubstituteMissing string `json:"substituteMissing,omitempty"`
 }
 
 // SubstituteReference contains a reference to a resource containing
@@ -237,10 +602,37 @@ type KustomizationStatus struct {
 	// +optional
 	LastAttemptedRevision string `json:"lastAttemptedRevision,omitempty"`
 
+	// LastHandledForceApplyAt holds the value of the most recent force apply
+	// request, set with the ForceApplyAnnotation, that was handled.
+	// +optional
+	LastHandledForceApplyAt string `json:"lastHandledForceApplyAt,omitempty"`
+
 	// Inventory contains the list of Kubernetes resource object references that
 	// have been successfully applied.
 	// +optional
 	Inventory *ResourceInventory `json:"inventory,omitempty"`
+
+	// ManagedObjects contains a readable list of the Kubernetes objects
+	// that have been successfully applied, derived from the Inventory.
+	// +optional
+	ManagedObjects *ManagedObjectList `json:"managedObjects,omitempty"`
+
+	// LastPhaseDurations contains the time spent in each phase (fetch, build,
+	// decrypt, apply, prune, healthcheck) of the last reconciliation attempt.
+	// +optional
+	LastPhaseDurations map[string]metav1.Duration `json:"lastPhaseDurations,omitempty"`
+
+	// LastKeyDecryptions contains the time of the last successful decryption
+	// of a data key with each of the Azure Key Vault keys of the decrypted
+	// data, keyed by key URL.
+	// +optional
+	LastKeyDecryptions map[string]metav1.Time `json:"lastKeyDecryptions,omitempty"`
+
+	// DecryptionProviders contains the sorted names of the SOPS key providers
+	// (e.g. 'age', 'azure_kv') of the master keys which decrypted the data
+	// keys of the files decrypted in the last build.
+	// +optional
+	DecryptionProviders []string `json:"decryptionProviders,omitempty"`
 }
 
 // GetTimeout returns the timeout with default.
@@ -255,6 +647,34 @@ func (in Kustomization) GetTimeout() time.Duration {
 	return duration
 }
 
+// GetDriftDetectionMode returns the drift detection mode with default.
+func (in Kustomization) GetDriftDetectionMode() string {
+	if in.Spec.DriftDetection != nil && in.Spec.DriftDetection.Mode != "" {
+		return in.Spec.DriftDetection.Mode
+	}
+	return EnabledValue
+}
+
+// GetConflictResolutionMode returns the conflict resolution mode with
+// default, or an empty string if the conflicts are not detected.
+func (in Kustomization) GetConflictResolutionMode() string {
+	if in.Spec.ConflictResolution == nil {
+		return ""
+	}
+	if in.Spec.ConflictResolution.Mode != "" {
+		return in.Spec.ConflictResolution.Mode
+	}
+	return ForceTakeOwnershipValue
+}
+
+// GetHealthCheckTimeoutMode returns the health check timeout mode with default.
+func (in Kustomization) GetHealthCheckTimeoutMode() string {
+	if in.Spec.HealthCheckTimeoutMode != "" {
+		return in.Spec.HealthCheckTimeoutMode
+	}
+	return FailValue
+}
+
 // GetRetryInterval returns the retry interval
 func (in Kustomization) GetRetryInterval() time.Duration {
 	if in.Spec.RetryInterval != nil {
@@ -269,6 +689,16 @@ func (in Kustomization) GetRequeueAfter() time.Duration {
 	return in.Spec.Interval.Duration
 }
 
+// ForceApplyRequested returns the value of the ForceApplyAnnotation, and
+// whether it requests a force apply which was not handled yet.
+func (in Kustomization) ForceApplyRequested() (string, bool) {
+	v, ok := in.GetAnnotations()[ForceApplyAnnotation]
+	if !ok || v == "" {
+		return "", false
+	}
+	return v, v != in.Status.LastHandledForceApplyAt
+}
+
 // GetDependsOn returns the list of dependencies across-namespaces.
 func (in Kustomization) GetDependsOn() []meta.NamespacedObjectReference {
 	return in.Spec.DependsOn
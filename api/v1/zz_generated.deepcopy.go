@@ -28,6 +28,61 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ApplyStage) DeepCopyInto(out *ApplyStage) {
+	*out = *in
+	if in.Kinds != nil {
+		in, out := &in.Kinds, &out.Kinds
+		*out = make([]ApplyStageKind, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ApplyStage.
+func (in *ApplyStage) DeepCopy() *ApplyStage {
+	if in == nil {
+		return nil
+	}
+	out := new(ApplyStage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ApplyStageKind) DeepCopyInto(out *ApplyStageKind) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ApplyStageKind.
+func (in *ApplyStageKind) DeepCopy() *ApplyStageKind {
+	if in == nil {
+		return nil
+	}
+	out := new(ApplyStageKind)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildOptions) DeepCopyInto(out *BuildOptions) {
+	*out = *in
+	if in.Plugins != nil {
+		in, out := &in.Plugins, &out.Plugins
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildOptions.
+func (in *BuildOptions) DeepCopy() *BuildOptions {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildOptions)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CommonMetadata) DeepCopyInto(out *CommonMetadata) {
 	*out = *in
@@ -57,6 +112,26 @@ func (in *CommonMetadata) DeepCopy() *CommonMetadata {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConflictResolution) DeepCopyInto(out *ConflictResolution) {
+	*out = *in
+	if in.Managers != nil {
+		in, out := &in.Managers, &out.Managers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConflictResolution.
+func (in *ConflictResolution) DeepCopy() *ConflictResolution {
+	if in == nil {
+		return nil
+	}
+	out := new(ConflictResolution)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CrossNamespaceSourceReference) DeepCopyInto(out *CrossNamespaceSourceReference) {
 	*out = *in
@@ -80,6 +155,31 @@ func (in *Decryption) DeepCopyInto(out *Decryption) {
 		*out = new(meta.LocalObjectReference)
 		**out = **in
 	}
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.KeyProviderPriority != nil {
+		in, out := &in.KeyProviderPriority, &out.KeyProviderPriority
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AzureVaultPreference != nil {
+		in, out := &in.AzureVaultPreference, &out.AzureVaultPreference
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ProjectionNamespaces != nil {
+		in, out := &in.ProjectionNamespaces, &out.ProjectionNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Decryption.
@@ -92,6 +192,21 @@ func (in *Decryption) DeepCopy() *Decryption {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DriftDetection) DeepCopyInto(out *DriftDetection) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DriftDetection.
+func (in *DriftDetection) DeepCopy() *DriftDetection {
+	if in == nil {
+		return nil
+	}
+	out := new(DriftDetection)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Kustomization) DeepCopyInto(out *Kustomization) {
 	*out = *in
@@ -169,6 +284,11 @@ func (in *KustomizationSpec) DeepCopyInto(out *KustomizationSpec) {
 		*out = new(Decryption)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.BuildOptions != nil {
+		in, out := &in.BuildOptions, &out.BuildOptions
+		*out = new(BuildOptions)
+		(*in).DeepCopyInto(*out)
+	}
 	out.Interval = in.Interval
 	if in.RetryInterval != nil {
 		in, out := &in.RetryInterval, &out.RetryInterval
@@ -190,6 +310,11 @@ func (in *KustomizationSpec) DeepCopyInto(out *KustomizationSpec) {
 		*out = make([]meta.NamespacedObjectKindReference, len(*in))
 		copy(*out, *in)
 	}
+	if in.HealthCheckSecrets != nil {
+		in, out := &in.HealthCheckSecrets, &out.HealthCheckSecrets
+		*out = make([]meta.NamespacedObjectReference, len(*in))
+		copy(*out, *in)
+	}
 	if in.Patches != nil {
 		in, out := &in.Patches, &out.Patches
 		*out = make([]kustomize.Patch, len(*in))
@@ -208,11 +333,33 @@ func (in *KustomizationSpec) DeepCopyInto(out *KustomizationSpec) {
 		*out = new(metav1.Duration)
 		**out = **in
 	}
+	if in.DriftDetection != nil {
+		in, out := &in.DriftDetection, &out.DriftDetection
+		*out = new(DriftDetection)
+		**out = **in
+	}
+	if in.ConflictResolution != nil {
+		in, out := &in.ConflictResolution, &out.ConflictResolution
+		*out = new(ConflictResolution)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ApplyOrder != nil {
+		in, out := &in.ApplyOrder, &out.ApplyOrder
+		*out = make([]ApplyStage, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.Components != nil {
 		in, out := &in.Components, &out.Components
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.PostApplyWebhook != nil {
+		in, out := &in.PostApplyWebhook, &out.PostApplyWebhook
+		*out = new(PostApplyWebhook)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KustomizationSpec.
@@ -241,6 +388,30 @@ func (in *KustomizationStatus) DeepCopyInto(out *KustomizationStatus) {
 		*out = new(ResourceInventory)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.ManagedObjects != nil {
+		in, out := &in.ManagedObjects, &out.ManagedObjects
+		*out = new(ManagedObjectList)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastPhaseDurations != nil {
+		in, out := &in.LastPhaseDurations, &out.LastPhaseDurations
+		*out = make(map[string]metav1.Duration, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.LastKeyDecryptions != nil {
+		in, out := &in.LastKeyDecryptions, &out.LastKeyDecryptions
+		*out = make(map[string]metav1.Time, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.DecryptionProviders != nil {
+		in, out := &in.DecryptionProviders, &out.DecryptionProviders
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KustomizationStatus.
@@ -253,6 +424,66 @@ func (in *KustomizationStatus) DeepCopy() *KustomizationStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedObject) DeepCopyInto(out *ManagedObject) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedObject.
+func (in *ManagedObject) DeepCopy() *ManagedObject {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedObject)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedObjectList) DeepCopyInto(out *ManagedObjectList) {
+	*out = *in
+	if in.Entries != nil {
+		in, out := &in.Entries, &out.Entries
+		*out = make([]ManagedObject, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedObjectList.
+func (in *ManagedObjectList) DeepCopy() *ManagedObjectList {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedObjectList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostApplyWebhook) DeepCopyInto(out *PostApplyWebhook) {
+	*out = *in
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(meta.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostApplyWebhook.
+func (in *PostApplyWebhook) DeepCopy() *PostApplyWebhook {
+	if in == nil {
+		return nil
+	}
+	out := new(PostApplyWebhook)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostBuild) DeepCopyInto(out *PostBuild) {
 	*out = *in
@@ -0,0 +1,128 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backoff
+
+import (
+	"sync"
+	"time"
+)
+
+// Class is the class of a failure, which determines how fast the failing
+// operation is retried.
+type Class int
+
+const (
+	// DefaultClass failures are retried at the given retry interval.
+	DefaultClass Class = iota
+	// TransientClass failures, e.g. throttling or network errors, are retried
+	// fast, starting at TransientBase and backing off up to the given retry
+	// interval.
+	TransientClass
+	// PersistentClass failures, e.g. authorization errors, are retried slowly,
+	// starting at the given retry interval and backing off up to
+	// PersistentMax.
+	PersistentClass
+)
+
+const (
+	// TransientBase is the delay before the first retry of a transient
+	// failure.
+	TransientBase = 5 * time.Second
+	// PersistentMax is the maximum delay between the retries of a persistent
+	// failure, unless the retry interval is longer.
+	PersistentMax = time.Hour
+)
+
+// Backoff tracks the consecutive failures of operations per key, e.g. the
+// reconciliations of a Kustomization, to compute the delay before the next
+// retry of the operation.
+type Backoff struct {
+	mu       sync.Mutex
+	failures map[string]failure
+}
+
+// failure holds the class of the last failure of a key, and the number of
+// consecutive failures of that class.
+type failure struct {
+	class Class
+	count int
+}
+
+// New returns a Backoff without recorded failures.
+func New() *Backoff {
+	return &Backoff{
+		failures: make(map[string]failure),
+	}
+}
+
+// Next records a failure of the given class for the key, and returns the
+// delay before the next retry. The delay grows exponentially with the number
+// of consecutive failures of the same class, a failure of another class starts
+// over. DefaultClass failures are always retried at the retry interval.
+func (b *Backoff) Next(key string, class Class, retryInterval time.Duration) time.Duration {
+	if b == nil || class == DefaultClass {
+		b.Reset(key)
+		return retryInterval
+	}
+
+	b.mu.Lock()
+	f := b.failures[key]
+	if f.class != class {
+		f = failure{class: class}
+	}
+	f.count++
+	b.failures[key] = f
+	b.mu.Unlock()
+
+	switch class {
+	case TransientClass:
+		return exponential(TransientBase, f.count, retryInterval)
+	default:
+		max := PersistentMax
+		if retryInterval > max {
+			max = retryInterval
+		}
+		return exponential(retryInterval, f.count, max)
+	}
+}
+
+// Reset forgets the failures of the key, e.g. once the operation succeeded.
+func (b *Backoff) Reset(key string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, key)
+}
+
+// exponential returns base doubled for every failure after the first one,
+// capped at max.
+func exponential(base time.Duration, count int, max time.Duration) time.Duration {
+	if base <= 0 || base >= max {
+		return max
+	}
+	d := base
+	for i := 1; i < count; i++ {
+		d *= 2
+		if d >= max {
+			return max
+		}
+	}
+	return d
+}
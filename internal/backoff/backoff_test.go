@@ -0,0 +1,126 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestBackoff_Next(t *testing.T) {
+	retryInterval := 2 * time.Minute
+
+	tests := []struct {
+		name  string
+		class Class
+		want  []time.Duration
+	}{
+		{
+			name:  "default failures",
+			class: DefaultClass,
+			want:  []time.Duration{retryInterval, retryInterval, retryInterval},
+		},
+		{
+			name:  "transient failures",
+			class: TransientClass,
+			want: []time.Duration{
+				5 * time.Second,
+				10 * time.Second,
+				20 * time.Second,
+				40 * time.Second,
+				80 * time.Second,
+				retryInterval,
+				retryInterval,
+			},
+		},
+		{
+			name:  "persistent failures",
+			class: PersistentClass,
+			want: []time.Duration{
+				retryInterval,
+				4 * time.Minute,
+				8 * time.Minute,
+				16 * time.Minute,
+				32 * time.Minute,
+				PersistentMax,
+				PersistentMax,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			b := New()
+			var got []time.Duration
+			for range tt.want {
+				got = append(got, b.Next("key", tt.class, retryInterval))
+			}
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestBackoff_Reset(t *testing.T) {
+	g := NewWithT(t)
+
+	retryInterval := time.Minute
+	b := New()
+
+	g.Expect(b.Next("key", PersistentClass, retryInterval)).To(Equal(time.Minute))
+	g.Expect(b.Next("key", PersistentClass, retryInterval)).To(Equal(2 * time.Minute))
+	g.Expect(b.Next("other", PersistentClass, retryInterval)).To(Equal(time.Minute))
+
+	b.Reset("key")
+	g.Expect(b.Next("key", PersistentClass, retryInterval)).To(Equal(time.Minute))
+	g.Expect(b.Next("other", PersistentClass, retryInterval)).To(Equal(2 * time.Minute))
+}
+
+func TestBackoff_Next_ClassChange(t *testing.T) {
+	g := NewWithT(t)
+
+	retryInterval := time.Minute
+	b := New()
+
+	g.Expect(b.Next("key", PersistentClass, retryInterval)).To(Equal(time.Minute))
+	g.Expect(b.Next("key", PersistentClass, retryInterval)).To(Equal(2 * time.Minute))
+	g.Expect(b.Next("key", TransientClass, retryInterval)).To(Equal(TransientBase))
+	g.Expect(b.Next("key", PersistentClass, retryInterval)).To(Equal(time.Minute))
+	g.Expect(b.Next("key", DefaultClass, retryInterval)).To(Equal(retryInterval))
+	g.Expect(b.Next("key", PersistentClass, retryInterval)).To(Equal(time.Minute))
+}
+
+func TestBackoff_Nil(t *testing.T) {
+	g := NewWithT(t)
+
+	var b *Backoff
+	g.Expect(b.Next("key", PersistentClass, time.Minute)).To(Equal(time.Minute))
+	b.Reset("key")
+}
+
+func TestBackoff_LongRetryInterval(t *testing.T) {
+	g := NewWithT(t)
+
+	retryInterval := 2 * time.Hour
+	b := New()
+
+	g.Expect(b.Next("key", TransientClass, retryInterval)).To(Equal(TransientBase))
+	g.Expect(b.Next("other", PersistentClass, retryInterval)).To(Equal(retryInterval))
+	g.Expect(b.Next("other", PersistentClass, retryInterval)).To(Equal(retryInterval))
+}
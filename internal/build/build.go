@@ -0,0 +1,133 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package build runs Kustomize builds confined to the root of a source
+// artifact, with configurable load restrictions and plugins.
+package build
+
+import (
+	"fmt"
+	"sync"
+
+	generator "github.com/fluxcd/pkg/kustomize"
+	securefs "github.com/fluxcd/pkg/kustomize/filesys"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// buildMutex serializes the builds, including the ones run with the
+// generator, as a workaround for a concurrent map read and map write bug in
+// Kustomize. The builds with non-default options cannot be run with the
+// generator, of which the load restrictions and plugins are fixed, and would
+// otherwise not be serialized with the ones which are.
+// https://github.com/kubernetes-sigs/kustomize/issues/3659
+var buildMutex sync.Mutex
+
+// Options holds the options of a SecureBuild.
+type Options struct {
+	// AllowRemoteBases allows the Kustomization files to refer to remote
+	// bases. Remote bases are not allowed when only EnableExecPlugins is
+	// set, as the functions they declare cannot be checked before the build.
+	AllowRemoteBases bool
+
+	// LoadRestrictions restricts the files which can be loaded by the
+	// Kustomization files. Files outside the root can never be loaded.
+	// Defaults to kustypes.LoadRestrictionsNone.
+	LoadRestrictions kustypes.LoadRestrictions
+
+	// EnableExecPlugins enables the plugins and KRM functions which are run
+	// as executables. When EnableContainerPlugins is not set, the build
+	// fails if any of the files below the root may declare a container
+	// function.
+	EnableExecPlugins bool
+
+	// EnableContainerPlugins enables the KRM functions which are run as
+	// containers.
+	EnableContainerPlugins bool
+}
+
+// isDefault returns whether the options are the ones of the generator.
+func (o Options) isDefault() bool {
+	return !o.EnableExecPlugins && !o.EnableContainerPlugins &&
+		(o.LoadRestrictions == kustypes.LoadRestrictionsUnknown || o.LoadRestrictions == kustypes.LoadRestrictionsNone)
+}
+
+// SecureBuild builds the Kustomization in dirPath with the given options,
+// using an on-disk file system which denies operations outside root.
+// Plugins other than the builtin ones are disabled, unless enabled by the
+// options. With the default options, the build is run with the generator.
+func SecureBuild(root, dirPath string, opts Options) (res resmap.ResMap, err error) {
+	buildMutex.Lock()
+	defer buildMutex.Unlock()
+
+	if opts.isDefault() {
+		return generator.SecureBuild(root, dirPath, opts.AllowRemoteBases)
+	}
+
+	execOnly := opts.EnableExecPlugins && !opts.EnableContainerPlugins
+	if execOnly {
+		if err := checkContainerFunctions(root); err != nil {
+			return nil, err
+		}
+	}
+
+	var fs filesys.FileSystem
+	if opts.AllowRemoteBases && !execOnly {
+		fs, err = securefs.MakeFsOnDiskSecureBuild(root)
+	} else {
+		fs, err = securefs.MakeFsOnDiskSecure(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Kustomize tends to panic in unpredicted ways due to (accidental)
+	// invalid object data; recover when this happens to ensure continuity of
+	// operations.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered from kustomize build panic: %v", r)
+		}
+	}()
+
+	loadRestrictions := opts.LoadRestrictions
+	if loadRestrictions == kustypes.LoadRestrictionsUnknown {
+		loadRestrictions = kustypes.LoadRestrictionsNone
+	}
+
+	k := krusty.MakeKustomizer(&krusty.Options{
+		LoadRestrictions: loadRestrictions,
+		PluginConfig:     pluginConfig(opts),
+	})
+	return k.Run(fs, dirPath)
+}
+
+// pluginConfig returns the Kustomize plugin configuration for the options.
+// Kustomize cannot enable the exec and container plugins separately: with
+// exec plugins only, the container functions are rejected before the build
+// by checkContainerFunctions, and with container plugins only, the exec
+// functions are not enabled.
+func pluginConfig(opts Options) *kustypes.PluginConfig {
+	pc := kustypes.DisabledPluginConfig()
+	if !opts.EnableExecPlugins && !opts.EnableContainerPlugins {
+		return pc
+	}
+	pc.PluginRestrictions = kustypes.PluginRestrictionsNone
+	pc.FnpLoadingOptions.EnableExec = opts.EnableExecPlugins
+	return pc
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+)
+
+const configMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: value
+`
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, data := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestSecureBuild_LoadRestrictions(t *testing.T) {
+	// The overlay refers to a file outside its directory.
+	root := writeFiles(t, map[string]string{
+		"base/config.yaml": configMap,
+		"app/kustomization.yaml": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- ../base/config.yaml
+`,
+	})
+	dirPath := filepath.Join(root, "app")
+
+	t.Run("succeeds without restrictions", func(t *testing.T) {
+		g := NewWithT(t)
+
+		for _, lr := range []kustypes.LoadRestrictions{kustypes.LoadRestrictionsUnknown, kustypes.LoadRestrictionsNone} {
+			m, err := SecureBuild(root, dirPath, Options{LoadRestrictions: lr})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(m.Size()).To(Equal(1))
+		}
+	})
+
+	t.Run("fails when restricted to the kustomization root", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := SecureBuild(root, dirPath, Options{LoadRestrictions: kustypes.LoadRestrictionsRootOnly})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("is not in or below"))
+	})
+
+	t.Run("fails outside of the root", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := SecureBuild(dirPath, dirPath, Options{})
+		g.Expect(err).To(HaveOccurred())
+	})
+}
+
+func TestSecureBuild_Plugins(t *testing.T) {
+	if _, err := exec.LookPath("sed"); err != nil {
+		t.Skip("sed executable not found")
+	}
+
+	// The exec function sets the value of the ConfigMap in the ResourceList
+	// it is given.
+	root := writeFiles(t, map[string]string{
+		"config.yaml": configMap,
+		"fn.sh":       "#!/bin/sh\nexec sed 's/key: value/key: patched/'\n",
+		"kustomization.yaml": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- config.yaml
+transformers:
+- fn.yaml
+`,
+	})
+	fnPath := filepath.Join(root, "fn.sh")
+	if err := os.Chmod(fnPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fn := `apiVersion: example.com/v1
+kind: Patch
+metadata:
+  name: patch
+  annotations:
+    config.kubernetes.io/function: |
+      exec:
+        path: ` + fnPath + `
+`
+	if err := os.WriteFile(filepath.Join(root, "fn.yaml"), []byte(fn), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	getValue := func(g *WithT, opts Options) string {
+		m, err := SecureBuild(root, root, opts)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(m.Size()).To(Equal(1))
+		return m.Resources()[0].GetDataMap()["key"]
+	}
+
+	t.Run("disables plugins by default", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := SecureBuild(root, root, Options{})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("external plugins disabled"))
+	})
+
+	t.Run("does not run exec plugins with container plugins enabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Expect(getValue(g, Options{EnableContainerPlugins: true})).To(Equal("value"))
+	})
+
+	t.Run("runs exec plugins when enabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Expect(getValue(g, Options{EnableExecPlugins: true})).To(Equal("patched"))
+	})
+}
+
+func TestSecureBuild_ContainerFunctions(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"config.yaml": configMap,
+		"fn.yaml": `apiVersion: example.com/v1
+kind: Patch
+metadata:
+  name: patch
+  annotations:
+    config.kubernetes.io/function: |
+      container:
+        image: example.com/fn:v1
+`,
+		"kustomization.yaml": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- config.yaml
+transformers:
+- fn.yaml
+`,
+	})
+
+	t.Run("fails with exec plugins only", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := SecureBuild(root, root, Options{EnableExecPlugins: true})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(Equal("container functions are not enabled for the build, but may be declared in: fn.yaml"))
+	})
+
+}
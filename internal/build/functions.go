@@ -0,0 +1,251 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/fn/runtime/runtimeutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	// legacyContainerAnnotation is the annotation with which Kustomize
+	// configures a KRM function run as the container image of its value.
+	legacyContainerAnnotation = "config.kubernetes.io/container"
+
+	// configFnField is the metadata field with which Kustomize configures a
+	// KRM function, when it has no function annotation.
+	configFnField = "configFn"
+
+	// maxFunctionCheckDepth is the max depth of the YAML nodes, and of the
+	// YAML documents held by them, checked for KRM functions, above which
+	// a file is assumed to declare a container function.
+	maxFunctionCheckDepth = 100
+)
+
+// functionAnnotations are the annotations with which Kustomize configures
+// a KRM function.
+var functionAnnotations = []string{
+	"config.kubernetes.io/function",
+	"config.k8s.io/function",
+	legacyContainerAnnotation,
+}
+
+// checkContainerFunctions returns an error naming the files below root which
+// may declare a KRM function run as a container.
+//
+// Kustomize runs both the exec and the container functions once plugins are
+// enabled, it is therefore checked before a build with exec plugins only.
+// As a plugin configuration may be produced by the build itself, e.g. by a
+// patch, a file is assumed to declare a container function when any of its
+// YAML documents, or of the YAML documents held by their strings, refers to
+// the configuration of a function other than by the exec function it is
+// annotated with.
+func checkContainerFunctions(root string) error {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if mayDeclareContainerFunction(data, 0) {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check the build for container functions: %w", err)
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("container functions are not enabled for the build, but may be declared in: %s",
+			strings.Join(files, ", "))
+	}
+	return nil
+}
+
+// mayDeclareContainerFunction returns whether any of the YAML documents in
+// the data may declare a container function. Data which is not YAML can not
+// be loaded by Kustomize as a document, and declares none.
+func mayDeclareContainerFunction(data []byte, depth int) bool {
+	if depth > maxFunctionCheckDepth {
+		return true
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			return false
+		}
+		for _, n := range doc.Content {
+			if documentMayDeclareContainerFunction(n, depth) {
+				return true
+			}
+		}
+	}
+}
+
+// documentMayDeclareContainerFunction returns whether the document node may
+// declare a container function. The function annotations and configFn field
+// of its metadata are allowed to configure exec functions, any other
+// reference to the configuration of a function is not.
+func documentMayDeclareContainerFunction(n *yaml.Node, depth int) bool {
+	allowed := make(map[*yaml.Node]bool)
+	if _, metadata := mappingEntry(n, "metadata"); metadata != nil {
+		if key, fn := mappingEntry(metadata, configFnField); fn != nil {
+			var spec runtimeutil.FunctionSpec
+			if err := fn.Decode(&spec); err != nil || spec.Container.Image != "" {
+				return true
+			}
+			allowed[key] = true
+			allowed[fn] = true
+		}
+		if _, annotations := mappingEntry(metadata, "annotations"); annotations != nil && annotations.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(annotations.Content); i += 2 {
+				key, value := annotations.Content[i], annotations.Content[i+1]
+				if !isFunctionAnnotation(key.Value) {
+					continue
+				}
+				if key.Value == legacyContainerAnnotation || !isExecFunctionSpec(value) {
+					return true
+				}
+				allowed[key] = true
+				allowed[value] = true
+			}
+		}
+	}
+	return nodeMayDeclareContainerFunction(n, allowed, depth)
+}
+
+// nodeMayDeclareContainerFunction returns whether the node, or any of the
+// nodes below it which are not allowed, refers to the configuration of a
+// function.
+func nodeMayDeclareContainerFunction(n *yaml.Node, allowed map[*yaml.Node]bool, depth int) bool {
+	if depth > maxFunctionCheckDepth {
+		return true
+	}
+	if allowed[n] {
+		return false
+	}
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if !refersToFunction(n.Value) {
+			return false
+		}
+		// The string may hold inline documents, e.g. of a patch, which are
+		// checked as documents of their own.
+		if !holdsDocuments(n.Value) {
+			return true
+		}
+		return mayDeclareContainerFunction([]byte(n.Value), depth+1)
+	case yaml.AliasNode:
+		return n.Alias != nil && nodeMayDeclareContainerFunction(n.Alias, nil, depth+1)
+	default:
+		for _, c := range n.Content {
+			if nodeMayDeclareContainerFunction(c, allowed, depth+1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// holdsDocuments returns whether the string holds YAML mapping documents
+// only, which are checked as documents of their own.
+func holdsDocuments(s string) bool {
+	dec := yaml.NewDecoder(strings.NewReader(s))
+	found := false
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			return found
+		}
+		for _, n := range doc.Content {
+			if n.Kind != yaml.MappingNode {
+				return false
+			}
+			found = true
+		}
+	}
+}
+
+// mappingEntry returns the key and value nodes of the key in the mapping
+// node, or nil.
+func mappingEntry(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// isExecFunctionSpec returns whether the node is a string holding the spec
+// of a function which is not run as a container.
+func isExecFunctionSpec(n *yaml.Node) bool {
+	if n.Kind != yaml.ScalarNode {
+		return false
+	}
+	var spec runtimeutil.FunctionSpec
+	if err := yaml.Unmarshal([]byte(n.Value), &spec); err != nil {
+		return false
+	}
+	return spec.Container.Image == ""
+}
+
+// isFunctionAnnotation returns whether the key is a function annotation.
+func isFunctionAnnotation(key string) bool {
+	for _, a := range functionAnnotations {
+		if key == a {
+			return true
+		}
+	}
+	return false
+}
+
+// refersToFunction returns whether the string refers to a function
+// annotation, including in the escaped form of a JSON patch path, or to the
+// configFn field.
+func refersToFunction(s string) bool {
+	if strings.Contains(s, configFnField) {
+		return true
+	}
+	for _, a := range functionAnnotations {
+		if strings.Contains(s, a) || strings.Contains(s, strings.ReplaceAll(a, "/", "~1")) {
+			return true
+		}
+	}
+	return false
+}
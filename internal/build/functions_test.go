@@ -0,0 +1,221 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestMayDeclareContainerFunction(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{
+			name: "resource",
+			data: configMap,
+		},
+		{
+			name: "not YAML",
+			data: "config.kubernetes.io/function: [",
+		},
+		{
+			name: "exec function",
+			data: `apiVersion: example.com/v1
+kind: Patch
+metadata:
+  name: patch
+  annotations:
+    config.kubernetes.io/function: |
+      exec:
+        path: ./fn.sh
+`,
+		},
+		{
+			name: "container function",
+			data: `apiVersion: example.com/v1
+kind: Patch
+metadata:
+  name: patch
+  annotations:
+    config.k8s.io/function: |
+      container:
+        image: example.com/fn:v1
+`,
+			want: true,
+		},
+		{
+			name: "legacy container function",
+			data: `apiVersion: example.com/v1
+kind: Patch
+metadata:
+  name: patch
+  annotations:
+    config.kubernetes.io/container: example.com/fn:v1
+`,
+			want: true,
+		},
+		{
+			name: "configFn container function",
+			data: `apiVersion: example.com/v1
+kind: Patch
+metadata:
+  name: patch
+  configFn:
+    container:
+      image: example.com/fn:v1
+`,
+			want: true,
+		},
+		{
+			name: "configFn exec function",
+			data: `apiVersion: example.com/v1
+kind: Patch
+metadata:
+  name: patch
+  configFn:
+    exec:
+      path: ./fn.sh
+`,
+		},
+		{
+			name: "container function in a later document",
+			data: configMap + `---
+apiVersion: example.com/v1
+kind: Patch
+metadata:
+  name: patch
+  annotations:
+    config.kubernetes.io/function: "container: {image: example.com/fn:v1}"
+`,
+			want: true,
+		},
+		{
+			name: "inline exec function",
+			data: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+transformers:
+- |
+  apiVersion: example.com/v1
+  kind: Patch
+  metadata:
+    name: patch
+    annotations:
+      config.kubernetes.io/function: |
+        exec:
+          path: ./fn.sh
+`,
+		},
+		{
+			name: "inline container function",
+			data: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+transformers:
+- |
+  apiVersion: example.com/v1
+  kind: Patch
+  metadata:
+    name: patch
+    annotations:
+      config.kubernetes.io/function: |
+        container:
+          image: example.com/fn:v1
+`,
+			want: true,
+		},
+		{
+			name: "common annotation",
+			data: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+commonAnnotations:
+  config.kubernetes.io/function: |
+    exec:
+      path: ./fn.sh
+`,
+			want: true,
+		},
+		{
+			name: "JSON patch of the annotation",
+			data: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+patches:
+- target:
+    kind: Patch
+  patch: |
+    - op: replace
+      path: /metadata/annotations/config.kubernetes.io~1function
+      value: "container: {image: example.com/fn:v1}"
+`,
+			want: true,
+		},
+		{
+			name: "escaped annotation",
+			data: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+commonAnnotations:
+  "config.kubernetes.io\x2Ffunction": "container: {image: example.com/fn:v1}"
+`,
+			want: true,
+		},
+		{
+			name: "annotation of a list item",
+			data: `apiVersion: v1
+kind: List
+items:
+- apiVersion: example.com/v1
+  kind: Patch
+  metadata:
+    name: patch
+    annotations:
+      config.kubernetes.io/function: |
+        exec:
+          path: ./fn.sh
+`,
+			want: true,
+		},
+		{
+			name: "alias of the annotation",
+			data: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+metadata:
+  annotations:
+    config.kubernetes.io/function: &fn |
+      exec:
+        path: ./fn.sh
+commonAnnotations:
+  key: *fn
+replacements:
+- source:
+    kind: ConfigMap
+  targets:
+  - fieldPaths:
+    - metadata.annotations.[config.kubernetes.io/function]
+`,
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			g.Expect(mayDeclareContainerFunction([]byte(tt.data), 0)).To(Equal(tt.want))
+		})
+	}
+}
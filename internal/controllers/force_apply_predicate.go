@@ -0,0 +1,43 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// ForceApplyRequestedPredicate triggers the reconciliation of a Kustomization
+// when the value of its ForceApplyAnnotation changes.
+type ForceApplyRequestedPredicate struct {
+	predicate.Funcs
+}
+
+func (ForceApplyRequestedPredicate) Update(e event.UpdateEvent) bool {
+	if e.ObjectOld == nil || e.ObjectNew == nil {
+		return false
+	}
+
+	newValue, ok := e.ObjectNew.GetAnnotations()[kustomizev1.ForceApplyAnnotation]
+	if !ok || newValue == "" {
+		return false
+	}
+
+	return newValue != e.ObjectOld.GetAnnotations()[kustomizev1.ForceApplyAnnotation]
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fluxcd/pkg/runtime/conditions"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// checkAPIs verifies that the API versions of the objects are served by the
+// cluster, according to the RESTMapper of the client, which is built from the
+// API discovery of the cluster with the identity of the client. The kinds
+// defined by the CRDs which are part of the objects are not checked, as they
+// are only served once the CRDs are applied. When some of the API versions
+// are not served, e.g. because they were removed in an upgrade of the
+// cluster, the UnsupportedAPIs condition lists their kinds and an error is
+// returned. Other errors of the RESTMapper are left to fail the apply.
+func checkAPIs(kubeClient client.Client, obj *kustomizev1.Kustomization, objects []*unstructured.Unstructured) error {
+	definedKinds := customResourceKinds(objects, objects)
+	unsupported := make(map[string]struct{})
+	checked := make(map[schema.GroupVersionKind]struct{})
+	for _, u := range objects {
+		gvk := u.GroupVersionKind()
+		if _, ok := checked[gvk]; ok {
+			continue
+		}
+		checked[gvk] = struct{}{}
+		if isDefinedKind(definedKinds, gvk) {
+			continue
+		}
+		if _, err := kubeClient.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); apimeta.IsNoMatchError(err) {
+			unsupported[fmt.Sprintf("%s/%s", gvk.GroupVersion().String(), gvk.Kind)] = struct{}{}
+		}
+	}
+
+	if len(unsupported) == 0 {
+		conditions.Delete(obj, kustomizev1.UnsupportedAPIsCondition)
+		return nil
+	}
+
+	kinds := make([]string, 0, len(unsupported))
+	for kind := range unsupported {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	msg := fmt.Sprintf("API check failed, not served by the cluster: %s", strings.Join(kinds, ", "))
+	conditions.MarkTrue(obj, kustomizev1.UnsupportedAPIsCondition, kustomizev1.UnsupportedAPIsReason, msg)
+	return errors.New(msg)
+}
+
+// isDefinedKind returns if the version of the kind is in the kinds, as
+// returned by customResourceKinds.
+func isDefinedKind(kinds map[schema.GroupKind][]string, gvk schema.GroupVersionKind) bool {
+	for _, v := range kinds[gvk.GroupKind()] {
+		if v == gvk.Version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/ssa"
+	. "github.com/onsi/gomega"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestCheckAPIs(t *testing.T) {
+	manifests := `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: default
+---
+apiVersion: policy/v1beta1
+kind: PodSecurityPolicy
+metadata:
+  name: restricted
+---
+apiVersion: autoscaling/v2beta2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: app
+  namespace: default
+---
+apiVersion: policy/v1beta1
+kind: PodSecurityPolicy
+metadata:
+  name: privileged
+` + crdManifest("example.com", "Widget") + `---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+  namespace: default
+`
+	objects, err := ssa.ReadObjects(bytes.NewReader([]byte(manifests)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newClient := func(gvks ...schema.GroupVersionKind) *fake.ClientBuilder {
+		mapper := apimeta.NewDefaultRESTMapper(nil)
+		for _, gvk := range gvks {
+			mapper.Add(gvk, apimeta.RESTScopeNamespace)
+		}
+		return fake.NewClientBuilder().WithRESTMapper(mapper)
+	}
+	served := []schema.GroupVersionKind{
+		{Version: "v1", Kind: "ConfigMap"},
+		{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"},
+	}
+
+	t.Run("flags the APIs not served by the cluster", func(t *testing.T) {
+		g := NewWithT(t)
+
+		obj := &kustomizev1.Kustomization{}
+		err := checkAPIs(newClient(served...).Build(), obj, objects)
+		g.Expect(err).To(HaveOccurred())
+		msg := "API check failed, not served by the cluster: autoscaling/v2beta2/HorizontalPodAutoscaler, policy/v1beta1/PodSecurityPolicy"
+		g.Expect(err.Error()).To(Equal(msg))
+		g.Expect(conditions.IsTrue(obj, kustomizev1.UnsupportedAPIsCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(obj, kustomizev1.UnsupportedAPIsCondition)).To(Equal(kustomizev1.UnsupportedAPIsReason))
+		g.Expect(conditions.GetMessage(obj, kustomizev1.UnsupportedAPIsCondition)).To(Equal(msg))
+	})
+
+	t.Run("succeeds when all the APIs are served", func(t *testing.T) {
+		g := NewWithT(t)
+
+		obj := &kustomizev1.Kustomization{}
+		conditions.MarkTrue(obj, kustomizev1.UnsupportedAPIsCondition, kustomizev1.UnsupportedAPIsReason, "previous failure")
+		c := newClient(append(served,
+			schema.GroupVersionKind{Group: "policy", Version: "v1beta1", Kind: "PodSecurityPolicy"},
+			schema.GroupVersionKind{Group: "autoscaling", Version: "v2beta2", Kind: "HorizontalPodAutoscaler"},
+		)...).Build()
+
+		g.Expect(checkAPIs(c, obj, objects)).To(Succeed())
+		g.Expect(conditions.Has(obj, kustomizev1.UnsupportedAPIsCondition)).To(BeFalse())
+	})
+
+	t.Run("flags the versions not defined by the CRDs", func(t *testing.T) {
+		g := NewWithT(t)
+
+		alpha, err := ssa.ReadObjects(bytes.NewReader([]byte(crdManifest("example.com", "Widget") + `---
+apiVersion: example.com/v1alpha1
+kind: Widget
+metadata:
+  name: widget
+  namespace: default
+`)))
+		g.Expect(err).ToNot(HaveOccurred())
+
+		obj := &kustomizev1.Kustomization{}
+		err = checkAPIs(newClient(served...).Build(), obj, alpha)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(HaveSuffix(": example.com/v1alpha1/Widget"))
+	})
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fluxcd/pkg/ssa"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// applyStage holds the objects applied in a stage of the ApplyOrder.
+type applyStage struct {
+	// name is the name of the stage, empty for the objects which are not
+	// selected by any stage.
+	name    string
+	objects []*unstructured.Unstructured
+}
+
+// orderStages splits the objects into the stages of the ApplyOrder, in
+// order, followed by a stage of the objects which are not selected by any
+// of them. An object is assigned to the stage of its ApplyStageAnnotation,
+// or else to the first stage which selects its kind. The objects of each
+// stage are sorted by kind. The stages without objects are omitted.
+func orderStages(order []kustomizev1.ApplyStage, objects []*unstructured.Unstructured) ([]applyStage, error) {
+	index := make(map[string]int, len(order))
+	for i, stage := range order {
+		if _, ok := index[stage.Name]; ok {
+			return nil, fmt.Errorf("invalid apply order: duplicate stage '%s'", stage.Name)
+		}
+		index[stage.Name] = i
+	}
+
+	stages := make([]applyStage, len(order)+1)
+	for i, stage := range order {
+		stages[i].name = stage.Name
+	}
+	for _, u := range objects {
+		i := len(order)
+		if name, ok := u.GetAnnotations()[kustomizev1.ApplyStageAnnotation]; ok {
+			if i, ok = index[name]; !ok {
+				return nil, fmt.Errorf("%s is assigned to the apply stage '%s', which is not defined in the apply order",
+					ssa.FmtUnstructured(u), name)
+			}
+		} else {
+			for j, stage := range order {
+				if stageSelects(stage, u) {
+					i = j
+					break
+				}
+			}
+		}
+		stages[i].objects = append(stages[i].objects, u)
+	}
+
+	var result []applyStage
+	for _, stage := range stages {
+		if len(stage.objects) == 0 {
+			continue
+		}
+		sort.Sort(ssa.SortableUnstructureds(stage.objects))
+		result = append(result, stage)
+	}
+	return result, nil
+}
+
+// stageSelects returns whether any kind of the stage matches the object.
+func stageSelects(stage kustomizev1.ApplyStage, u *unstructured.Unstructured) bool {
+	gvk := u.GroupVersionKind()
+	for _, k := range stage.Kinds {
+		if k.Kind == gvk.Kind &&
+			(k.Group == "" || k.Group == gvk.Group) &&
+			(k.Version == "" || k.Version == gvk.Version) {
+			return true
+		}
+	}
+	return false
+}
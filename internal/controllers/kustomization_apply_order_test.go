@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestOrderStages(t *testing.T) {
+	newObject := func(apiVersion, kind, name string, annotations map[string]string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion(apiVersion)
+		u.SetKind(kind)
+		u.SetName(name)
+		u.SetNamespace("default")
+		u.SetAnnotations(annotations)
+		return u
+	}
+	stageNames := func(stages []applyStage) []string {
+		var names []string
+		for _, s := range stages {
+			names = append(names, s.name)
+		}
+		return names
+	}
+	objectNames := func(stage applyStage) []string {
+		var names []string
+		for _, o := range stage.objects {
+			names = append(names, o.GetName())
+		}
+		return names
+	}
+
+	order := []kustomizev1.ApplyStage{
+		{
+			Name: "config",
+			Kinds: []kustomizev1.ApplyStageKind{
+				{Kind: "ConfigMap"},
+				{Kind: "Secret", Version: "v1"},
+			},
+		},
+		{
+			Name:  "workloads",
+			Kinds: []kustomizev1.ApplyStageKind{{Group: "apps", Kind: "Deployment"}},
+		},
+		{
+			Name:  "ingress",
+			Kinds: []kustomizev1.ApplyStageKind{{Group: "networking.k8s.io", Kind: "Ingress"}},
+		},
+	}
+
+	t.Run("splits out-of-order objects into the declared stages", func(t *testing.T) {
+		g := NewWithT(t)
+
+		objects := []*unstructured.Unstructured{
+			newObject("networking.k8s.io/v1", "Ingress", "web", nil),
+			newObject("apps/v1", "Deployment", "web", nil),
+			newObject("v1", "Service", "web", nil),
+			newObject("v1", "Secret", "credentials", nil),
+			newObject("v1", "ConfigMap", "settings", nil),
+			newObject("batch/v1", "Job", "migrate", map[string]string{kustomizev1.ApplyStageAnnotation: "config"}),
+			newObject("example.com/v1", "Deployment", "custom", nil),
+		}
+		stages, err := orderStages(order, objects)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(stageNames(stages)).To(Equal([]string{"config", "workloads", "ingress", ""}))
+		g.Expect(objectNames(stages[0])).To(Equal([]string{"settings", "credentials", "migrate"}))
+		g.Expect(objectNames(stages[1])).To(Equal([]string{"web"}))
+		g.Expect(objectNames(stages[2])).To(Equal([]string{"web"}))
+		g.Expect(objectNames(stages[3])).To(ConsistOf("web", "custom"))
+	})
+
+	t.Run("omits the stages without objects", func(t *testing.T) {
+		g := NewWithT(t)
+
+		stages, err := orderStages(order, []*unstructured.Unstructured{
+			newObject("networking.k8s.io/v1", "Ingress", "web", nil),
+			newObject("v1", "ConfigMap", "settings", nil),
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(stageNames(stages)).To(Equal([]string{"config", "ingress"}))
+	})
+
+	t.Run("applies all objects in a single stage without apply order", func(t *testing.T) {
+		g := NewWithT(t)
+
+		stages, err := orderStages(nil, []*unstructured.Unstructured{
+			newObject("apps/v1", "Deployment", "web", nil),
+			newObject("v1", "ConfigMap", "settings", nil),
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(stageNames(stages)).To(Equal([]string{""}))
+		g.Expect(objectNames(stages[0])).To(Equal([]string{"settings", "web"}))
+	})
+
+	t.Run("fails on an undefined stage annotation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := orderStages(order, []*unstructured.Unstructured{
+			newObject("v1", "ConfigMap", "settings", map[string]string{kustomizev1.ApplyStageAnnotation: "database"}),
+		})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("ConfigMap/default/settings is assigned to the apply stage 'database'"))
+	})
+
+	t.Run("fails on duplicate stages", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := orderStages(append(order, kustomizev1.ApplyStage{Name: "config"}), nil)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("duplicate stage 'config'"))
+	})
+}
+
+func TestApplyWaitOptions(t *testing.T) {
+	g := NewWithT(t)
+
+	obj := &kustomizev1.Kustomization{
+		Spec: kustomizev1.KustomizationSpec{
+			Timeout: &metav1.Duration{Duration: time.Minute},
+		},
+	}
+
+	opts, err := applyWaitOptions(obj, time.Now().Add(-20*time.Second))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(opts.Interval).To(Equal(2 * time.Second))
+	g.Expect(opts.Timeout).To(BeNumerically("~", 40*time.Second, time.Second))
+
+	// The stages share the timeout, without the waits never expiring
+	// once it is exhausted.
+	_, err = applyWaitOptions(obj, time.Now().Add(-time.Minute))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("timeout of 1m0s exceeded while applying"))
+}
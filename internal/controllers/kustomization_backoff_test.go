@@ -0,0 +1,136 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/backoff"
+	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+)
+
+func TestKustomizationReconciler_failureClass(t *testing.T) {
+	tests := []struct {
+		name   string
+		reason string
+		err    error
+		want   backoff.Class
+	}{
+		{
+			name:   "throttled decryption",
+			reason: kustomizev1.DecryptionThrottledReason,
+			err:    errors.New("throttled"),
+			want:   backoff.TransientClass,
+		},
+		{
+			name:   "unavailable vault",
+			reason: kustomizev1.DecryptionVaultUnavailableReason,
+			err:    errors.New("unavailable"),
+			want:   backoff.TransientClass,
+		},
+		{
+			name:   "forbidden decryption",
+			reason: kustomizev1.DecryptionForbiddenReason,
+			err:    errors.New("forbidden"),
+			want:   backoff.PersistentClass,
+		},
+		{
+			name:   "decryption key not found",
+			reason: kustomizev1.DecryptionKeyNotFoundReason,
+			err:    errors.New("not found"),
+			want:   backoff.PersistentClass,
+		},
+		{
+			name:   "decryption key disabled",
+			reason: kustomizev1.DecryptionKeyDisabledReason,
+			err:    errors.New("disabled"),
+			want:   backoff.PersistentClass,
+		},
+		{
+			name:   "invalid decryption Secret",
+			reason: kustomizev1.DecryptionSecretInvalidReason,
+			err:    errors.New("invalid"),
+			want:   backoff.PersistentClass,
+		},
+		{
+			name:   "decryption key deleted",
+			reason: kustomizev1.DecryptionKeyDeletedReason,
+			err:    fmt.Errorf("decryption failed: %w", &azkv.KeyDeletedError{Name: "sops", Err: errors.New("not found")}),
+			want:   backoff.PersistentClass,
+		},
+		{
+			name:   "decryption key being recovered",
+			reason: kustomizev1.DecryptionKeyDeletedReason,
+			err:    fmt.Errorf("decryption failed: %w", &azkv.KeyDeletedError{Name: "sops", Recovering: true, Err: errors.New("not found")}),
+			want:   backoff.TransientClass,
+		},
+		{
+			name:   "network error",
+			reason: kustomizev1.ReconciliationFailedReason,
+			err:    fmt.Errorf("apply failed: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+			want:   backoff.TransientClass,
+		},
+		{
+			name:   "build failure",
+			reason: kustomizev1.BuildFailedReason,
+			err:    errors.New("kustomize build failed"),
+			want:   backoff.DefaultClass,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			obj := &kustomizev1.Kustomization{}
+			conditions.MarkFalse(obj, meta.ReadyCondition, tt.reason, tt.err.Error())
+			g.Expect(failureClass(obj, tt.err)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestKustomizationReconciler_failureBackoff(t *testing.T) {
+	g := NewWithT(t)
+
+	obj := &kustomizev1.Kustomization{
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 10 * time.Minute},
+		},
+	}
+	conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.DecryptionForbiddenReason, "forbidden")
+	err := errors.New("forbidden")
+
+	b := backoff.New()
+	var last time.Duration
+	for i := 0; i < 3; i++ {
+		d := b.Next("default/app", failureClass(obj, err), obj.GetRetryInterval())
+		g.Expect(d).To(BeNumerically(">", last))
+		last = d
+	}
+
+	b.Reset("default/app")
+	g.Expect(b.Next("default/app", failureClass(obj, err), obj.GetRetryInterval())).To(Equal(obj.GetRetryInterval()))
+}
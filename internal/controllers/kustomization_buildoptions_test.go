@@ -0,0 +1,152 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_BuildOptions(t *testing.T) {
+	g := NewWithT(t)
+	id := "build-opts-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	// The overlay refers to a file outside its directory.
+	manifests := []testserver.File{
+		{
+			Name: "base/config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+data:
+  key: value
+`, id),
+		},
+		{
+			Name: "app/kustomization.yaml",
+			Body: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- ../base/config.yaml
+`,
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("build-opts-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	newKustomization := func(opts *kustomizev1.BuildOptions) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("build-opts-%s", randStringRunes(5)),
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Path:     "./app",
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{
+					Name:      repositoryName.Name,
+					Namespace: repositoryName.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+				BuildOptions: opts,
+			},
+		}
+	}
+
+	waitForNotReady := func(g *WithT, kustomization *kustomizev1.Kustomization) *kustomizev1.Kustomization {
+		resultK := &kustomizev1.Kustomization{}
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		return resultK
+	}
+
+	t.Run("fails when restricted to the kustomization root", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kustomization := newKustomization(&kustomizev1.BuildOptions{
+			LoadRestrictor: kustomizev1.LoadRestrictionsRootOnly,
+		})
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := waitForNotReady(g, kustomization)
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.BuildFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring("is not in or below"))
+	})
+
+	t.Run("builds when load restrictions are relaxed", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kustomization := newKustomization(&kustomizev1.BuildOptions{
+			LoadRestrictor: kustomizev1.LoadRestrictionsNone,
+		})
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := &kustomizev1.Kustomization{}
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: id, Namespace: id}, &cm)).To(Succeed())
+	})
+
+	t.Run("fails when plugins are not allowed by the controller", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kustomization := newKustomization(&kustomizev1.BuildOptions{
+			Plugins: []string{kustomizev1.ExecBuildPlugin},
+		})
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := waitForNotReady(g, kustomization)
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.BuildFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(Equal(
+			"build plugins of type 'Exec' are not allowed by the controller"))
+	})
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/resource"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// podTemplatePaths are the fields of the pod templates of the workload kinds
+// of which the checksums of the referenced decrypted Secrets are stamped.
+var podTemplatePaths = map[string][]string{
+	"DaemonSet":   {"spec", "template"},
+	"Deployment":  {"spec", "template"},
+	"ReplicaSet":  {"spec", "template"},
+	"StatefulSet": {"spec", "template"},
+	"Job":         {"spec", "template"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template"},
+}
+
+// secretChecksum returns the SHA-256 checksum of the content of the Secret,
+// i.e. of its data as decoded from base64 merged with its stringData, which
+// takes precedence as for the API server. The content is never part of the
+// returned error.
+func secretChecksum(res *resource.Resource) (string, error) {
+	m, err := res.Map()
+	if err != nil {
+		return "", err
+	}
+	content := make(map[string][]byte)
+	data, _, _ := unstructured.NestedMap(m, "data")
+	for k, v := range data {
+		s, _ := v.(string)
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("failed to compute the checksum of Secret '%s/%s': the value of data key '%s' is not base64 encoded",
+				res.GetNamespace(), res.GetName(), k)
+		}
+		content[k] = b
+	}
+	stringData, _, _ := unstructured.NestedMap(m, "stringData")
+	for k, v := range stringData {
+		s, _ := v.(string)
+		content[k] = []byte(s)
+	}
+
+	keys := make([]string, 0, len(content))
+	for k := range content {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		// Prefix the length of the keys and values to avoid ambiguous
+		// concatenations.
+		h.Write([]byte(strconv.Itoa(len(k)) + ":" + k))
+		h.Write([]byte(strconv.Itoa(len(content[k])) + ":"))
+		h.Write(content[k])
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stampSecretChecksum sets the SecretChecksumAnnotation of the decrypted
+// Secret to the checksum of its content, and returns the checksum.
+func stampSecretChecksum(res *resource.Resource) (string, error) {
+	sum, err := secretChecksum(res)
+	if err != nil {
+		return "", err
+	}
+	annotations := res.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[kustomizev1.SecretChecksumAnnotation] = sum
+	if err := res.SetAnnotations(annotations); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// stampWorkloadChecksum sets the SecretChecksumAnnotation of the pod template
+// of the workload to the checksum of the checksums of the Secrets in the
+// namespace of the workload which it references through volumes and
+// environment variables, as given by namespace and name. It returns whether
+// the workload references any of them.
+func stampWorkloadChecksum(res *resource.Resource, checksums map[string]string) (bool, error) {
+	path, ok := podTemplatePaths[res.GetKind()]
+	if !ok {
+		return false, nil
+	}
+	m, err := res.Map()
+	if err != nil {
+		return false, err
+	}
+	template, ok, _ := unstructured.NestedMap(m, path...)
+	if !ok {
+		return false, nil
+	}
+	podSpec, _, _ := unstructured.NestedMap(template, "spec")
+
+	var refs []string
+	for _, name := range referencedSecrets(podSpec) {
+		if sum, ok := checksums[fmt.Sprintf("%s/%s", res.GetNamespace(), name)]; ok {
+			refs = append(refs, name+"="+sum)
+		}
+	}
+	if len(refs) == 0 {
+		return false, nil
+	}
+	sort.Strings(refs)
+	h := sha256.New()
+	for _, ref := range refs {
+		h.Write([]byte(ref + "\n"))
+	}
+
+	annotations, _, _ := unstructured.NestedStringMap(template, "metadata", "annotations")
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[kustomizev1.SecretChecksumAnnotation] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if err := unstructured.SetNestedStringMap(m, annotations, append(path, "metadata", "annotations")...); err != nil {
+		return false, err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	return true, res.UnmarshalJSON(b)
+}
+
+// referencedSecrets returns the distinct names of the Secrets the pod spec
+// references through the volumes, including projected volumes, and through
+// the env and envFrom of the containers and init containers.
+func referencedSecrets(podSpec map[string]interface{}) []string {
+	seen := make(map[string]struct{})
+	var names []string
+	add := func(name string) {
+		if _, ok := seen[name]; !ok && name != "" {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+
+	volumes, _, _ := unstructured.NestedSlice(podSpec, "volumes")
+	for _, v := range volumes {
+		volume, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(volume, "secret", "secretName")
+		add(name)
+		sources, _, _ := unstructured.NestedSlice(volume, "projected", "sources")
+		for _, s := range sources {
+			if source, ok := s.(map[string]interface{}); ok {
+				name, _, _ := unstructured.NestedString(source, "secret", "name")
+				add(name)
+			}
+		}
+	}
+
+	for _, field := range []string{"initContainers", "containers"} {
+		containers, _, _ := unstructured.NestedSlice(podSpec, field)
+		for _, c := range containers {
+			container, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			envFrom, _, _ := unstructured.NestedSlice(container, "envFrom")
+			for _, e := range envFrom {
+				if source, ok := e.(map[string]interface{}); ok {
+					name, _, _ := unstructured.NestedString(source, "secretRef", "name")
+					add(name)
+				}
+			}
+			env, _, _ := unstructured.NestedSlice(container, "env")
+			for _, e := range env {
+				if envVar, ok := e.(map[string]interface{}); ok {
+					name, _, _ := unstructured.NestedString(envVar, "valueFrom", "secretKeyRef", "name")
+					add(name)
+				}
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/provider"
+	"sigs.k8s.io/kustomize/api/resource"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestStampSecretChecksum(t *testing.T) {
+	newResource := provider.NewDefaultDepProvider().GetResourceFactory().FromMap
+	newSecret := func(data, stringData map[string]interface{}) *resource.Resource {
+		return newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":        "credentials",
+				"namespace":   "apps",
+				"annotations": map[string]interface{}{"other": "value"},
+			},
+			"data":       data,
+			"stringData": stringData,
+		})
+	}
+
+	g := NewWithT(t)
+
+	res := newSecret(map[string]interface{}{"password": "czNjcjN0"}, nil)
+	sum, err := stampSecretChecksum(res)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(sum).To(HavePrefix("sha256:"))
+	g.Expect(sum).ToNot(ContainSubstring("s3cr3t"))
+	g.Expect(res.GetAnnotations()).To(Equal(map[string]string{
+		"other":                              "value",
+		kustomizev1.SecretChecksumAnnotation: sum,
+	}))
+
+	// An unchanged value produces the same checksum, regardless of whether
+	// it is set in data or stringData.
+	unchanged, err := stampSecretChecksum(newSecret(map[string]interface{}{"password": "czNjcjN0"}, nil))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(unchanged).To(Equal(sum))
+	fromStringData, err := stampSecretChecksum(newSecret(nil, map[string]interface{}{"password": "s3cr3t"}))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(fromStringData).To(Equal(sum))
+
+	// A changed value produces another checksum.
+	changed, err := stampSecretChecksum(newSecret(map[string]interface{}{"password": "bjN3"}, nil))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(changed).ToNot(Equal(sum))
+
+	// The stringData takes precedence over the data.
+	overridden, err := stampSecretChecksum(newSecret(map[string]interface{}{"password": "czNjcjN0"},
+		map[string]interface{}{"password": "n3w"}))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(overridden).To(Equal(changed))
+
+	// The values are not part of the errors.
+	_, err = stampSecretChecksum(newSecret(map[string]interface{}{"password": "not-base64-s3cr3t"}, nil))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).ToNot(ContainSubstring("s3cr3t"))
+	g.Expect(err.Error()).To(ContainSubstring("data key 'password'"))
+}
+
+func TestStampWorkloadChecksum(t *testing.T) {
+	newResource := provider.NewDefaultDepProvider().GetResourceFactory().FromMap
+	podSpec := map[string]interface{}{
+		"containers": []interface{}{
+			map[string]interface{}{
+				"name": "app",
+				"envFrom": []interface{}{
+					map[string]interface{}{"secretRef": map[string]interface{}{"name": "env"}},
+				},
+				"env": []interface{}{
+					map[string]interface{}{
+						"name": "TOKEN",
+						"valueFrom": map[string]interface{}{
+							"secretKeyRef": map[string]interface{}{"name": "token", "key": "token"},
+						},
+					},
+				},
+			},
+		},
+		"volumes": []interface{}{
+			map[string]interface{}{"name": "tls", "secret": map[string]interface{}{"secretName": "tls"}},
+			map[string]interface{}{"name": "projected", "projected": map[string]interface{}{
+				"sources": []interface{}{
+					map[string]interface{}{"secret": map[string]interface{}{"name": "projected"}},
+				},
+			}},
+		},
+	}
+	newDeployment := func(namespace string) *resource.Resource {
+		return newResource(map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "app", "namespace": namespace},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"annotations": map[string]interface{}{"other": "value"},
+					},
+					"spec": podSpec,
+				},
+			},
+		})
+	}
+	templateAnnotations := func(g *WithT, res *resource.Resource, path ...string) map[string]string {
+		m, err := res.Map()
+		g.Expect(err).ToNot(HaveOccurred())
+		annotations, _, err := unstructured.NestedStringMap(m, append(path, "metadata", "annotations")...)
+		g.Expect(err).ToNot(HaveOccurred())
+		return annotations
+	}
+	checksums := map[string]string{
+		"apps/env":       "sha256:env",
+		"apps/token":     "sha256:token",
+		"apps/tls":       "sha256:tls",
+		"apps/projected": "sha256:projected",
+		"other/env":      "sha256:other",
+	}
+
+	t.Run("stamps the checksum of the referenced Secrets", func(t *testing.T) {
+		g := NewWithT(t)
+
+		res := newDeployment("apps")
+		stamped, err := stampWorkloadChecksum(res, checksums)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(stamped).To(BeTrue())
+		annotations := templateAnnotations(g, res, "spec", "template")
+		g.Expect(annotations).To(HaveKeyWithValue("other", "value"))
+		sum := annotations[kustomizev1.SecretChecksumAnnotation]
+		g.Expect(sum).To(HavePrefix("sha256:"))
+
+		// An unchanged Secret produces the same checksum.
+		unchanged := newDeployment("apps")
+		_, err = stampWorkloadChecksum(unchanged, checksums)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(templateAnnotations(g, unchanged, "spec", "template")).
+			To(HaveKeyWithValue(kustomizev1.SecretChecksumAnnotation, sum))
+
+		// A changed Secret produces another checksum.
+		changedChecksums := make(map[string]string, len(checksums))
+		for k, v := range checksums {
+			changedChecksums[k] = v
+		}
+		changedChecksums["apps/tls"] = "sha256:rotated"
+		changed := newDeployment("apps")
+		_, err = stampWorkloadChecksum(changed, changedChecksums)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(templateAnnotations(g, changed, "spec", "template")[kustomizev1.SecretChecksumAnnotation]).
+			ToNot(Equal(sum))
+
+		// A Secret which is not referenced does not change the checksum.
+		changedChecksums["apps/tls"] = checksums["apps/tls"]
+		changedChecksums["apps/unreferenced"] = "sha256:unreferenced"
+		unreferenced := newDeployment("apps")
+		_, err = stampWorkloadChecksum(unreferenced, changedChecksums)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(templateAnnotations(g, unreferenced, "spec", "template")).
+			To(HaveKeyWithValue(kustomizev1.SecretChecksumAnnotation, sum))
+	})
+
+	t.Run("ignores the Secrets of other namespaces", func(t *testing.T) {
+		g := NewWithT(t)
+
+		res := newDeployment("team-a")
+		stamped, err := stampWorkloadChecksum(res, checksums)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(stamped).To(BeFalse())
+		g.Expect(templateAnnotations(g, res, "spec", "template")).ToNot(HaveKey(kustomizev1.SecretChecksumAnnotation))
+	})
+
+	t.Run("stamps the job template of CronJobs", func(t *testing.T) {
+		g := NewWithT(t)
+
+		res := newResource(map[string]interface{}{
+			"apiVersion": "batch/v1",
+			"kind":       "CronJob",
+			"metadata":   map[string]interface{}{"name": "backup", "namespace": "apps"},
+			"spec": map[string]interface{}{
+				"schedule": "@daily",
+				"jobTemplate": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"template": map[string]interface{}{"spec": podSpec},
+					},
+				},
+			},
+		})
+		stamped, err := stampWorkloadChecksum(res, checksums)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(stamped).To(BeTrue())
+		g.Expect(templateAnnotations(g, res, "spec", "jobTemplate", "spec", "template")).
+			To(HaveKey(kustomizev1.SecretChecksumAnnotation))
+	})
+
+	t.Run("ignores other kinds", func(t *testing.T) {
+		g := NewWithT(t)
+
+		res := newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "config", "namespace": "apps"},
+		})
+		stamped, err := stampWorkloadChecksum(res, checksums)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(stamped).To(BeFalse())
+	})
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fluxcd/pkg/ssa"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// conflictManagerRegexp matches the name of the field manager in the message
+// of a FieldManagerConflict cause returned by the API server, e.g.
+// 'conflict with "kubectl-edit" using v1'.
+var conflictManagerRegexp = regexp.MustCompile(`^conflict with "([^"]*)"`)
+
+// fieldConflict is a field of an object which is owned by another manager
+// than the controller.
+type fieldConflict struct {
+	Subject string
+	Manager string
+	Field   string
+}
+
+// String returns the object, field and manager of the conflict.
+func (c fieldConflict) String() string {
+	return fmt.Sprintf("%s %s (manager: %s)", c.Subject, c.Field, c.Manager)
+}
+
+// fieldConflictError is returned when the apply of the objects conflicts
+// with other managers of their fields, which is not resolved according to
+// the conflict resolution mode.
+type fieldConflictError struct {
+	conflicts []fieldConflict
+}
+
+// Error returns the list of the conflicting fields.
+func (e *fieldConflictError) Error() string {
+	return fmt.Sprintf("apply conflicts with the managers of %d field(s):\n%s",
+		len(e.conflicts), formatConflicts(e.conflicts))
+}
+
+// formatConflicts returns the conflicts, one per line.
+func formatConflicts(conflicts []fieldConflict) string {
+	var b strings.Builder
+	for _, c := range conflicts {
+		b.WriteString(c.String() + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// detectConflicts returns the fields of the objects owned by other managers
+// than the controller, by applying the objects with a server-side dry-run
+// without forcing the ownership of the fields. The objects excluded from
+// the apply are skipped, as are the conflicts with the managers removed by
+// the cleanup of the apply. Any error other than a conflict, e.g. for a kind
+// which is not yet registered, is left to the apply to report.
+func (r *KustomizationReconciler) detectConflicts(ctx context.Context,
+	manager *ssa.ResourceManager,
+	objects []*unstructured.Unstructured,
+	applyOpts ssa.ApplyOptions) ([]fieldConflict, error) {
+	cleanedUp := make(map[string]struct{})
+	for _, m := range applyOpts.Cleanup.FieldManagers {
+		cleanedUp[m.Name] = struct{}{}
+	}
+
+	var conflicts []fieldConflict
+	for _, u := range objects {
+		if ssa.AnyInMetadata(u, applyOpts.ExclusionSelector) {
+			continue
+		}
+
+		existing := &unstructured.Unstructured{}
+		existing.SetGroupVersionKind(u.GroupVersionKind())
+		err := manager.Client().Get(ctx, client.ObjectKeyFromObject(u), existing)
+		if err != nil || ssa.AnyInMetadata(existing, applyOpts.ExclusionSelector) {
+			continue
+		}
+		cleanup := !ssa.AnyInMetadata(u, applyOpts.Cleanup.Exclusions) &&
+			!ssa.AnyInMetadata(existing, applyOpts.Cleanup.Exclusions)
+
+		err = manager.Client().Patch(ctx, u.DeepCopy(), client.Apply,
+			client.DryRunAll, client.FieldOwner(r.ControllerName))
+		if err == nil || !apierrors.IsConflict(err) {
+			continue
+		}
+
+		status, ok := err.(apierrors.APIStatus)
+		if !ok || status.Status().Details == nil {
+			return nil, err
+		}
+		for _, cause := range status.Status().Details.Causes {
+			if cause.Type != metav1.CauseTypeFieldManagerConflict {
+				continue
+			}
+			c := fieldConflict{
+				Subject: ssa.FmtUnstructured(u),
+				Field:   cause.Field,
+			}
+			if m := conflictManagerRegexp.FindStringSubmatch(cause.Message); m != nil {
+				c.Manager = m[1]
+			}
+			if _, ok := cleanedUp[c.Manager]; ok && cleanup {
+				continue
+			}
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts, nil
+}
+
+// resolveConflicts returns the conflicts to report as taken over according
+// to the conflict resolution of the Kustomization, or a fieldConflictError
+// if some of them are not allowed to be taken over.
+func resolveConflicts(obj *kustomizev1.Kustomization, conflicts []fieldConflict) ([]fieldConflict, error) {
+	switch obj.GetConflictResolutionMode() {
+	case kustomizev1.FailValue:
+		if len(conflicts) > 0 {
+			return nil, &fieldConflictError{conflicts: conflicts}
+		}
+	case kustomizev1.IgnoreValue:
+		ignored := make(map[string]struct{})
+		for _, m := range obj.Spec.ConflictResolution.Managers {
+			ignored[m] = struct{}{}
+		}
+		var failed []fieldConflict
+		for _, c := range conflicts {
+			if _, ok := ignored[c.Manager]; !ok {
+				failed = append(failed, c)
+			}
+		}
+		if len(failed) > 0 {
+			return nil, &fieldConflictError{conflicts: failed}
+		}
+	case kustomizev1.ForceTakeOwnershipValue:
+		return conflicts, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestResolveConflicts(t *testing.T) {
+	conflicts := []fieldConflict{
+		{Subject: "ConfigMap/default/app", Manager: "kubectl-edit", Field: ".data.key"},
+		{Subject: "ConfigMap/default/app", Manager: "hpa", Field: ".data.replicas"},
+	}
+
+	tests := []struct {
+		name       string
+		resolution *kustomizev1.ConflictResolution
+		want       []fieldConflict
+		wantErr    string
+	}{
+		{
+			name: "not detected",
+		},
+		{
+			name:       "force take ownership by default",
+			resolution: &kustomizev1.ConflictResolution{},
+			want:       conflicts,
+		},
+		{
+			name:       "fail",
+			resolution: &kustomizev1.ConflictResolution{Mode: kustomizev1.FailValue},
+			wantErr:    "apply conflicts with the managers of 2 field(s):\nConfigMap/default/app .data.key (manager: kubectl-edit)\nConfigMap/default/app .data.replicas (manager: hpa)",
+		},
+		{
+			name: "ignore all managers",
+			resolution: &kustomizev1.ConflictResolution{
+				Mode:     kustomizev1.IgnoreValue,
+				Managers: []string{"hpa", "kubectl-edit"},
+			},
+		},
+		{
+			name: "ignore some managers",
+			resolution: &kustomizev1.ConflictResolution{
+				Mode:     kustomizev1.IgnoreValue,
+				Managers: []string{"hpa"},
+			},
+			wantErr: "apply conflicts with the managers of 1 field(s):\nConfigMap/default/app .data.key (manager: kubectl-edit)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			obj := &kustomizev1.Kustomization{
+				Spec: kustomizev1.KustomizationSpec{ConflictResolution: tt.resolution},
+			}
+			got, err := resolveConflicts(obj, conflicts)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestKustomizationReconciler_ConflictResolution(t *testing.T) {
+	g := NewWithT(t)
+	id := "conflict-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := []testserver.File{
+		{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+data:
+  key: value
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("conflict-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	configMapKey := types.NamespacedName{Name: id, Namespace: id}
+
+	// ownByOther sets the key of the ConfigMap with another field manager,
+	// which takes over the ownership of the field.
+	ownByOther := func(g *WithT) {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind("ConfigMap")
+		u.SetName(configMapKey.Name)
+		u.SetNamespace(configMapKey.Namespace)
+		g.Expect(unstructured.SetNestedField(u.Object, "other", "data", "key")).To(Succeed())
+		g.Expect(k8sClient.Patch(context.Background(), u, client.Apply,
+			client.FieldOwner("other"), client.ForceOwnership)).To(Succeed())
+	}
+
+	configMapValue := func(g *WithT) string {
+		var configMap corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), configMapKey, &configMap)).To(Succeed())
+		return configMap.Data["key"]
+	}
+
+	ownByOther(g)
+
+	kustomizationKey := types.NamespacedName{
+		Name:      fmt.Sprintf("conflict-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kustomizationKey.Name,
+			Namespace: kustomizationKey.Namespace,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			ConflictResolution: &kustomizev1.ConflictResolution{
+				Mode: kustomizev1.FailValue,
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	// setResolution updates the conflict resolution of the Kustomization.
+	setResolution := func(g *WithT, resolution *kustomizev1.ConflictResolution) {
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), kustomizationKey, resultK)
+			resultK.Spec.ConflictResolution = resolution
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+	}
+
+	t.Run("fails on conflict", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), kustomizationKey, resultK)
+			return isReconcileFailure(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.FieldConflictReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(
+			ContainSubstring(fmt.Sprintf("ConfigMap/%[1]s/%[1]s .data.key (manager: other)", id)))
+		g.Expect(configMapValue(g)).To(Equal("other"))
+	})
+
+	t.Run("fails on conflict with a manager not ignored", func(t *testing.T) {
+		g := NewWithT(t)
+
+		setResolution(g, &kustomizev1.ConflictResolution{
+			Mode:     kustomizev1.IgnoreValue,
+			Managers: []string{"kubectl-edit"},
+		})
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), kustomizationKey, resultK)
+			return isReconcileFailure(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.FieldConflictReason))
+		g.Expect(configMapValue(g)).To(Equal("other"))
+	})
+
+	t.Run("takes over the fields of an ignored manager", func(t *testing.T) {
+		g := NewWithT(t)
+
+		setResolution(g, &kustomizev1.ConflictResolution{
+			Mode:     kustomizev1.IgnoreValue,
+			Managers: []string{"other"},
+		})
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), kustomizationKey, resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(configMapValue(g)).To(Equal("value"))
+		for _, e := range getEvents(resultK.GetName(), nil) {
+			g.Expect(e.Message).ToNot(ContainSubstring("Took over the ownership"))
+		}
+	})
+
+	t.Run("takes over the fields and reports them", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ownByOther(g)
+		setResolution(g, &kustomizev1.ConflictResolution{
+			Mode: kustomizev1.ForceTakeOwnershipValue,
+		})
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), kustomizationKey, resultK)
+			return isReconcileSuccess(resultK) && configMapValue(g) == "value"
+		}, timeout, time.Second).Should(BeTrue())
+
+		var found bool
+		for _, e := range getEvents(resultK.GetName(), nil) {
+			if strings.Contains(e.Message, "Took over the ownership of 1 field(s)") &&
+				strings.Contains(e.Message, fmt.Sprintf("ConfigMap/%[1]s/%[1]s .data.key (manager: other)", id)) {
+				found = true
+			}
+		}
+		g.Expect(found).To(BeTrue())
+	})
+}
@@ -19,7 +19,13 @@ package controllers
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"sort"
 	"strings"
@@ -32,8 +38,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	kuberecorder "k8s.io/client-go/tools/record"
 	"sigs.k8s.io/cli-utils/pkg/kstatus/polling"
 	"sigs.k8s.io/cli-utils/pkg/object"
@@ -46,9 +55,14 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/ratelimiter"
 	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/resid"
 
 	apiacl "github.com/fluxcd/pkg/apis/acl"
 	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	"github.com/fluxcd/pkg/apis/kustomize"
 	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/fluxcd/pkg/http/fetch"
 	generator "github.com/fluxcd/pkg/kustomize"
@@ -64,8 +78,17 @@ import (
 	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/backoff"
+	"github.com/fluxcd/kustomize-controller/internal/build"
+	"github.com/fluxcd/kustomize-controller/internal/debounce"
 	"github.com/fluxcd/kustomize-controller/internal/decryptor"
 	"github.com/fluxcd/kustomize-controller/internal/inventory"
+	"github.com/fluxcd/kustomize-controller/internal/limiter"
+	intmetrics "github.com/fluxcd/kustomize-controller/internal/metrics"
+	"github.com/fluxcd/kustomize-controller/internal/resultcache"
+	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
+	"github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
 )
 
 // +kubebuilder:rbac:groups=kustomize.toolkit.fluxcd.io,resources=kustomizations,verbs=get;list;watch;create;update;patch;delete
@@ -74,7 +97,9 @@ import (
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=buckets;ocirepositories;gitrepositories,verbs=get;list;watch
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=buckets/status;ocirepositories/status;gitrepositories/status,verbs=get
 // +kubebuilder:rbac:groups="",resources=configmaps;secrets;serviceaccounts,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=create;update
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
 
 // KustomizationReconciler reconciles a Kustomization object
 type KustomizationReconciler struct {
@@ -82,7 +107,15 @@ type KustomizationReconciler struct {
 	kuberecorder.EventRecorder
 	runtimeCtrl.Metrics
 
+	// ExtendedMetrics records the kustomize-controller specific metrics,
+	// e.g. the duration of the reconciliation phases. It is optional.
+	ExtendedMetrics *intmetrics.Recorder
+
 	artifactFetcher       *fetch.ArchiveFetcher
+	maxArtifactSize       int
+	maxManifests          int
+	sourceLimiter         *limiter.Limiter
+	failureBackoff        *backoff.Backoff
 	requeueDependency     time.Duration
 	StatusPoller          *polling.StatusPoller
 	PollingOpts           polling.Options
@@ -92,14 +125,357 @@ type KustomizationReconciler struct {
 	NoRemoteBases         bool
 	DefaultServiceAccount string
 	KubeConfigOpts        runtimeClient.KubeConfigOptions
+
+	// DefaultDecryptionSecret is the name of the Secret holding the SOPS
+	// decryption keys inherited by the Kustomizations of its namespace which
+	// do not define spec.decryption. When empty, no decryption is inherited.
+	DefaultDecryptionSecret string
+
+	// AllowCrossNamespaceImpersonation allows Kustomizations to impersonate
+	// service accounts from other namespaces with spec.serviceAccountNamespace.
+	AllowCrossNamespaceImpersonation bool
+
+	// AllowUnsupportedSOPSKeyProviders logs a warning instead of failing the
+	// reconciliation when a SOPS file references unsupported key providers.
+	AllowUnsupportedSOPSKeyProviders bool
+
+	// FailOnUnmatchedPatches fails the build when the target of a patch in
+	// spec.patches does not match any of the objects.
+	FailOnUnmatchedPatches bool
+
+	// AllowBuildDumps allows Kustomizations to dump their build result to a
+	// ConfigMap with the BuildDumpAnnotation.
+	AllowBuildDumps bool
+
+	// AllowSubstitutionPreviews allows Kustomizations to preview their post
+	// build variable substitution in a ConfigMap with the
+	// SubstitutionPreviewAnnotation.
+	AllowSubstitutionPreviews bool
+
+	// AllowedBuildPlugins is the list of the types of non-builtin Kustomize
+	// plugins which can be enabled with spec.buildOptions.plugins.
+	AllowedBuildPlugins []string
+
+	// AzureKeyExpiryWindow is the window before the expiry of the Azure Key
+	// Vault keys used for decryption in which the DecryptionKeyExpiring
+	// condition is set. A value lower than or equal to zero disables the
+	// expiry checks.
+	AzureKeyExpiryWindow time.Duration
+
+	// WarnDataKeyRotation emits a warning event and records a metric for
+	// the decryption keys of which the SOPS data key of a decrypted file
+	// needs rotation, i.e. was encrypted longer ago than the rotation
+	// threshold of the key provider.
+	WarnDataKeyRotation bool
+
+	// azureKeyExpiries caches the expiry dates of the Azure Key Vault keys
+	// across reconciliations.
+	azureKeyExpiries *azkv.ExpiryCache
+
+	// azureConfigs caches the Azure credentials of the decryption Secrets
+	// across reconciliations.
+	azureConfigs *azkv.ConfigCache
+
+	// kmsClients caches the AWS KMS, GCP KMS and Hashicorp Vault clients of
+	// the decryption Secrets across reconciliations.
+	kmsClients *clientcache.Cache
+
+	// azureLimiter bounds the concurrent requests to each Azure Key Vault
+	// across reconciliations.
+	azureLimiter *azkv.VaultLimiter
+
+	// azureBreaker fails the decryption requests fast for the Azure Key
+	// Vaults which failed repeatedly, across reconciliations.
+	azureBreaker *azkv.VaultBreaker
+
+	// azureRetryPolicy configures the retries of the throttled and otherwise
+	// transiently failed Azure Key Vault requests.
+	azureRetryPolicy azkv.RetryPolicy
+
+	// azureTransport configures the proxy and minimum TLS version of the
+	// connections to Azure Key Vault.
+	azureTransport azkv.Transport
+
+	// azureTokens shares the Azure credentials of identical configurations
+	// across reconciliations, and probes the Azure Instance Metadata Service
+	// before constructing a managed identity credential unless disabled.
+	azureTokens *azkv.TokenCache
+
+	// azureRewriteVaultSuffix rewrites the DNS suffix of the Azure Key Vault
+	// URLs of another cloud than the one of the decryption credentials.
+	azureRewriteVaultSuffix bool
+
+	// azureRecoverDeleted recovers the Azure Key Vault keys which are
+	// deleted but recoverable when decrypting with them.
+	azureRecoverDeleted bool
+
+	// azureResolveLatest resolves the current version of the Azure Key
+	// Vault keys without a version when encrypting with them.
+	azureResolveLatest bool
+
+	// azureNoDefaultCredential fails the decryption with Azure Key Vault
+	// keys without Azure credentials in the decryption Secret, instead of
+	// authenticating with the default credential of the controller.
+	azureNoDefaultCredential bool
+
+	// azureAllowWorkloadIdentity allows the Azure authentication files to
+	// authenticate with the workload identity of the controller.
+	azureAllowWorkloadIdentity bool
+
+	// vaultTokens requests the service account tokens of the Kustomizations
+	// logged in with to the Vault Kubernetes auth method. When nil, the
+	// Vault Kubernetes auth method is not allowed.
+	vaultTokens hcvault.ServiceAccountTokenRequester
+
+	// azureDataKeys caches the data keys decrypted with Azure Key Vault
+	// keys across reconciliations and Kustomizations. When nil, the data
+	// keys are not cached.
+	azureDataKeys *azkv.DataKeyCache
+
+	// azureAllowedAlgorithms are the Azure Key Vault algorithms the data
+	// keys can be decrypted with. When empty, all the algorithms are allowed.
+	azureAllowedAlgorithms azkv.AllowedAlgorithms
+
+	// azureDefaultAlgorithm is the Azure Key Vault algorithm the data keys
+	// are decrypted with when the SOPS metadata does not record one.
+	azureDefaultAlgorithm azkv.DefaultAlgorithm
+
+	// azureAuthFileDir is the directory of the Azure authentication files
+	// which the Kustomizations can reference for decryption.
+	azureAuthFileDir string
+
+	// resultCache holds the results of the last successful reconciliations,
+	// of which the unchanged revisions are not built again. When nil, every
+	// reconciliation is a full one.
+	resultCache *resultcache.Cache
+
+	// minIntervals are the minimum intervals of the Kustomizations by the
+	// kind of their source.
+	minIntervals map[string]time.Duration
+
+	// checksumKey is the random key of the checksums of the applied objects
+	// recorded in the inventories, generated on setup.
+	checksumKey []byte
+
+	// keyFailures tracks the failures of the decryption keys across the
+	// reconciliations, to signal when they recover.
+	keyFailures keyFailureTracker
+
+	// reconcileTimeout is the deadline of a reconciliation since its start,
+	// which bounds the requests made by the reconciliation, e.g. to decrypt.
+	// When zero, the reconciliation has no deadline.
+	reconcileTimeout time.Duration
+
+	// postApplyWebhookHosts are the hosts the post-apply webhooks can be
+	// called at. When empty, the post-apply webhooks are disabled.
+	postApplyWebhookHosts map[string]struct{}
+
+	// postApplyWebhookClient is the HTTP client of the post-apply webhook
+	// requests.
+	postApplyWebhookClient *http.Client
 }
 
+const (
+	// azureKeyExpiryCacheTTL is the duration for which the expiry date of an
+	// Azure Key Vault key is cached.
+	azureKeyExpiryCacheTTL = 10 * time.Minute
+
+	// azureKeyExpiryCacheSize is the maximum number of expiry dates of the
+	// Azure Key Vault keys cached, counting a key once per credential.
+	azureKeyExpiryCacheSize = 1000
+)
+
+// maxLastKeyDecryptions is the maximum number of keys of which the last
+// decryption time is recorded in the status of a Kustomization.
+const maxLastKeyDecryptions = 10
+
 // KustomizationReconcilerOptions contains options for the KustomizationReconciler.
 type KustomizationReconcilerOptions struct {
 	MaxConcurrentReconciles   int
 	HTTPRetry                 int
 	DependencyRequeueInterval time.Duration
 	RateLimiter               ratelimiter.RateLimiter
+
+	// MaxConcurrentReconcilesPerSource limits the number of Kustomizations
+	// referring to the same source which are reconciled at the same time.
+	// A value lower than one disables the limit.
+	MaxConcurrentReconcilesPerSource int
+
+	// MaxArtifactSize limits the total size in bytes of the files extracted
+	// from an artifact, and the size of each file which is decrypted.
+	// A value lower than one disables the limit.
+	MaxArtifactSize int
+
+	// MaxManifests limits the number of objects produced by the build of a
+	// Kustomization, which are decrypted and applied.
+	// A value lower than one disables the limit.
+	MaxManifests int
+
+	// SourceDebounceInterval delays the reconciliations triggered by the
+	// revision changes of a source, merging the changes which happen during
+	// the interval into a single reconciliation of the latest revision.
+	// A value lower than or equal to zero disables the delay.
+	SourceDebounceInterval time.Duration
+
+	// AzureAuthCacheSize is the maximum number of decryption Secrets of which
+	// the Azure credential constructed from the Azure authentication file is
+	// reused across reconciliations, for as long as the Secret is unchanged.
+	// A value lower than one disables the cache.
+	AzureAuthCacheSize int
+
+	// AzureAuthCacheTTL is the maximum age of the cached Azure credentials,
+	// after which they are constructed again. A value of zero disables the
+	// expiry.
+	AzureAuthCacheTTL time.Duration
+
+	// KMSClientCacheSize is the maximum number of decryption Secrets of which
+	// the AWS KMS, GCP KMS and Hashicorp Vault clients constructed with the
+	// credentials of the Secret are reused across reconciliations, for as
+	// long as the Secret is unchanged. A value lower than one disables the
+	// cache.
+	KMSClientCacheSize int
+
+	// AzureMaxConcurrentRequests is the maximum number of concurrent
+	// encrypt and decrypt requests to an Azure Key Vault, shared by all
+	// reconciliations. A value lower than one disables the limit.
+	AzureMaxConcurrentRequests int
+
+	// AzureBreakerFailureThreshold is the number of consecutive failures of
+	// an Azure Key Vault after which its decrypt requests are failed without
+	// being sent for the AzureBreakerCooldown, shared by all
+	// reconciliations. A value lower than one disables the breaker.
+	AzureBreakerFailureThreshold int
+
+	// AzureBreakerCooldown is the duration for which the decrypt requests to
+	// an Azure Key Vault are failed once its breaker opened, after which a
+	// single request probes whether the vault recovered.
+	AzureBreakerCooldown time.Duration
+
+	// AzureMaxAttempts is the maximum number of attempts of an encrypt or
+	// decrypt request to an Azure Key Vault which is throttled or otherwise
+	// fails transiently, including the first one. One disables the retries,
+	// zero uses the default of the Azure SDK.
+	AzureMaxAttempts int
+
+	// AzureRetryDelay is the delay before the first retry of an Azure Key
+	// Vault request, which grows exponentially with every retry up to the
+	// AzureMaxRetryDelay. Zero uses the default of the Azure SDK.
+	AzureRetryDelay time.Duration
+
+	// AzureMaxRetryDelay is the maximum delay before a retry of an Azure Key
+	// Vault request. Zero uses the default of the Azure SDK.
+	AzureMaxRetryDelay time.Duration
+
+	// AzureProxyURL is the URL of the proxy of the requests to Azure Key
+	// Vault, e.g. of a corporate network. When empty, the proxy is read from
+	// the HTTPS_PROXY and NO_PROXY environment variables of the controller.
+	AzureProxyURL string
+
+	// AzureMinTLSVersion is the minimum TLS version of the connections to
+	// Azure Key Vault, either "1.2" or "1.3". When empty, TLS 1.2 is
+	// required.
+	AzureMinTLSVersion string
+
+	// AzureSkipIMDSProbe disables the probe of the Azure Instance Metadata
+	// Service before constructing a managed identity credential from a
+	// decryption Secret, e.g. where the IMDS is known to be reachable.
+	AzureSkipIMDSProbe bool
+
+	// AzureRewriteVaultDNSSuffix rewrites the DNS suffix of the Azure Key
+	// Vault URLs of another cloud than the one of the authority host of the
+	// decryption credentials, instead of failing the decryption.
+	AzureRewriteVaultDNSSuffix bool
+
+	// AzureRecoverDeletedKeys recovers the Azure Key Vault keys which are
+	// deleted but recoverable from the soft-deleted keys of their vault when
+	// the decryption fails because of their deletion.
+	AzureRecoverDeletedKeys bool
+
+	// AzureResolveLatestVersion resolves the current version of the Azure
+	// Key Vault keys without a version, or with the 'latest' version, when
+	// encrypting with them, instead of encrypting with the current version
+	// unresolved. This requires the 'get' permission on the keys.
+	AzureResolveLatestVersion bool
+
+	// AzureDisableDefaultCredential fails the decryption with Azure Key
+	// Vault keys when the decryption Secret of a Kustomization contains no
+	// Azure credentials, instead of authenticating with the default
+	// credential of the controller, i.e. its environment, workload identity
+	// or managed identity. The managed identities and workload identity
+	// configured by the decryption Secrets are rejected as well. This
+	// prevents the tenants of a cluster from using the ambient credentials
+	// of the controller.
+	AzureDisableDefaultCredential bool
+
+	// AzureAllowWorkloadIdentity allows the Azure authentication files of
+	// the decryption Secrets to authenticate with the federated service
+	// account token of the controller with `workloadIdentity`. It can not be
+	// combined with AzureDisableDefaultCredential.
+	AzureAllowWorkloadIdentity bool
+
+	// VaultAllowKubernetesAuth allows the decryption Secrets to log in to
+	// the Vault Kubernetes auth method with `sops.vault-kubernetes-auth`,
+	// with a token of the service account of the Kustomization requested
+	// with the TokenRequest API for the hcvault.KubernetesAuthAudience.
+	VaultAllowKubernetesAuth bool
+
+	// AzureDataKeyCacheSize is the maximum number of data keys decrypted with
+	// Azure Key Vault keys which are cached, to decrypt the identical SOPS
+	// files of multiple Kustomizations with the same credentials once. When
+	// zero, the data keys are not cached. The data keys expire with the
+	// AzureDataKeyCacheTTL.
+	AzureDataKeyCacheSize int
+
+	// AzureDataKeyCacheTTL is the maximum age of the cached data keys, after
+	// which they are decrypted with the vault again, for a permission
+	// revoked on the key to take effect. It must be positive when the data
+	// keys are cached.
+	AzureDataKeyCacheTTL time.Duration
+
+	// AzureAllowedAlgorithms are the Azure Key Vault encryption algorithms
+	// the data keys can be decrypted with, e.g. to only allow the algorithms
+	// approved by a compliance regime. The decryption with any other
+	// algorithm fails before the request is sent. When empty, all the
+	// algorithms are allowed.
+	AzureAllowedAlgorithms []string
+
+	// AzureDefaultAlgorithm is the Azure Key Vault encryption algorithm the
+	// data keys are decrypted with when the SOPS metadata of the file does
+	// not record one, e.g. RSA-OAEP for legacy files. It must be one of the
+	// AzureAllowedAlgorithms, if set. When empty, RSA-OAEP-256 is used.
+	AzureDefaultAlgorithm string
+
+	// AzureAuthFileDir is the directory of the Azure authentication files
+	// mounted in the controller Pod, e.g. from projected volumes, which the
+	// Kustomizations can reference for decryption. When empty, no file can
+	// be referenced.
+	AzureAuthFileDir string
+
+	// MinIntervalPerSourceKind is the minimum interval at which the
+	// Kustomizations are reconciled by the kind of their source, e.g. to
+	// reconcile the Kustomizations of OCIRepositories more often than the
+	// ones of GitRepositories. A shorter .spec.interval is raised to it.
+	MinIntervalPerSourceKind map[string]time.Duration
+
+	// ReconcileCacheTTL is the duration for which the result of a successful
+	// reconciliation is reused by the next reconciliations of the same source
+	// revision and configuration, which only check that the applied objects
+	// did not change instead of building, decrypting and applying the
+	// revision again. A value lower than or equal to zero disables the cache.
+	ReconcileCacheTTL time.Duration
+
+	// ReconcileTimeout is the maximum duration of a reconciliation, of which
+	// the remaining budget bounds the requests it makes, e.g. to the key
+	// services of the SOPS decryption, so that they fail fast instead of
+	// overrunning it. The status of the Kustomization is still updated once
+	// it expired. A value lower than or equal to zero disables the deadline.
+	ReconcileTimeout time.Duration
+
+	// PostApplyWebhookAllowedHosts are the hosts of the URLs which the
+	// Kustomizations can call with spec.postApplyWebhook, e.g. of an
+	// in-cluster policy service. The calls to any other host fail before
+	// the request is sent. When empty, the post-apply webhooks are disabled.
+	PostApplyWebhookAllowedHosts []string
 }
 
 func (r *KustomizationReconciler) SetupWithManager(mgr ctrl.Manager, opts KustomizationReconcilerOptions) error {
@@ -128,32 +504,139 @@ func (r *KustomizationReconciler) SetupWithManager(mgr ctrl.Manager, opts Kustom
 	}
 
 	r.requeueDependency = opts.DependencyRequeueInterval
+	r.sourceLimiter = limiter.New(opts.MaxConcurrentReconcilesPerSource)
+	r.failureBackoff = backoff.New()
+	r.azureKeyExpiries = azkv.NewExpiryCache(azureKeyExpiryCacheSize, azureKeyExpiryCacheTTL)
+	if opts.AzureAuthCacheSize > 0 {
+		r.azureConfigs = azkv.NewConfigCache(opts.AzureAuthCacheSize)
+		r.azureConfigs.SetTTL(opts.AzureAuthCacheTTL)
+	}
+	if opts.KMSClientCacheSize > 0 {
+		r.kmsClients = clientcache.New(opts.KMSClientCacheSize)
+	}
+	if opts.AzureMaxConcurrentRequests > 0 {
+		r.azureLimiter = azkv.NewVaultLimiter(opts.AzureMaxConcurrentRequests)
+	}
+	if opts.AzureBreakerFailureThreshold > 0 {
+		r.azureBreaker = azkv.NewVaultBreaker(opts.AzureBreakerFailureThreshold, opts.AzureBreakerCooldown)
+		if r.ExtendedMetrics != nil {
+			r.azureBreaker.SetStateObserver(func(_ string, from, to azkv.BreakerState) {
+				r.ExtendedMetrics.RecordAzureVaultBreakerTransition(from.String(), to.String())
+			})
+		}
+	}
+	r.azureRetryPolicy = azkv.RetryPolicy{
+		MaxAttempts:   opts.AzureMaxAttempts,
+		RetryDelay:    opts.AzureRetryDelay,
+		MaxRetryDelay: opts.AzureMaxRetryDelay,
+	}
+	if err := r.azureRetryPolicy.Validate(); err != nil {
+		return fmt.Errorf("invalid Azure Key Vault retry policy: %w", err)
+	}
+	azureTransport, err := azkv.ParseTransport(opts.AzureProxyURL, opts.AzureMinTLSVersion)
+	if err != nil {
+		return fmt.Errorf("invalid Azure Key Vault transport: %w", err)
+	}
+	r.azureTransport = azureTransport
+	r.azureRewriteVaultSuffix = opts.AzureRewriteVaultDNSSuffix
+	r.azureRecoverDeleted = opts.AzureRecoverDeletedKeys
+	r.azureResolveLatest = opts.AzureResolveLatestVersion
+	r.azureNoDefaultCredential = opts.AzureDisableDefaultCredential
+	if opts.AzureAllowWorkloadIdentity && opts.AzureDisableDefaultCredential {
+		return fmt.Errorf("the Azure workload identity can not be allowed with the default credential disabled")
+	}
+	r.azureAllowWorkloadIdentity = opts.AzureAllowWorkloadIdentity
+	if opts.VaultAllowKubernetesAuth {
+		clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			return fmt.Errorf("failed to create the clientset of the Vault Kubernetes auth: %w", err)
+		}
+		r.vaultTokens = serviceAccountTokenRequester(clientset)
+	}
+	if opts.AzureDataKeyCacheSize > 0 {
+		if opts.AzureDataKeyCacheTTL <= 0 {
+			return fmt.Errorf("the Azure Key Vault data key cache requires a positive TTL")
+		}
+		r.azureDataKeys = azkv.NewDataKeyCache(opts.AzureDataKeyCacheSize)
+		r.azureDataKeys.SetTTL(opts.AzureDataKeyCacheTTL)
+	}
+	azureAllowedAlgorithms, err := azkv.ParseAllowedAlgorithms(opts.AzureAllowedAlgorithms)
+	if err != nil {
+		return fmt.Errorf("invalid allowed Azure Key Vault algorithms: %w", err)
+	}
+	r.azureAllowedAlgorithms = azureAllowedAlgorithms
+	azureDefaultAlgorithm, err := azkv.ParseDefaultAlgorithm(opts.AzureDefaultAlgorithm, azureAllowedAlgorithms)
+	if err != nil {
+		return fmt.Errorf("invalid default Azure Key Vault algorithm: %w", err)
+	}
+	r.azureDefaultAlgorithm = azureDefaultAlgorithm
+	r.azureAuthFileDir = opts.AzureAuthFileDir
+	r.azureTokens = azkv.NewTokenCache(opts.AzureAuthCacheSize)
+	r.azureTokens.SetTTL(opts.AzureAuthCacheTTL)
+	r.azureTokens.SetDisableDefaultCredential(opts.AzureDisableDefaultCredential)
+	r.azureTokens.SetAllowWorkloadIdentity(opts.AzureAllowWorkloadIdentity)
+	if !opts.AzureSkipIMDSProbe {
+		r.azureTokens.ProbeIMDS(azkv.NewIMDSProbe(azkv.DefaultIMDSProbeTimeout))
+	}
+	if opts.ReconcileCacheTTL > 0 {
+		r.resultCache = resultcache.New(opts.ReconcileCacheTTL)
+	}
+	r.minIntervals = opts.MinIntervalPerSourceKind
+	r.checksumKey = make([]byte, 32)
+	if _, err := rand.Read(r.checksumKey); err != nil {
+		return fmt.Errorf("failed to generate the checksum key: %w", err)
+	}
+	r.reconcileTimeout = opts.ReconcileTimeout
+	if len(opts.PostApplyWebhookAllowedHosts) > 0 {
+		r.postApplyWebhookHosts = make(map[string]struct{}, len(opts.PostApplyWebhookAllowedHosts))
+		for _, host := range opts.PostApplyWebhookAllowedHosts {
+			r.postApplyWebhookHosts[strings.ToLower(host)] = struct{}{}
+		}
+		r.postApplyWebhookClient = &http.Client{
+			Timeout: postApplyWebhookMaxTimeout,
+			// A redirect could send the request to a host which is not
+			// allowed.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
 	r.statusManager = fmt.Sprintf("gotk-%s", r.ControllerName)
+	r.maxArtifactSize = opts.MaxArtifactSize
+	r.maxManifests = opts.MaxManifests
+	maxUntarSize := tar.UnlimitedUntarSize
+	if r.maxArtifactSize > 0 {
+		maxUntarSize = r.maxArtifactSize
+	}
 	r.artifactFetcher = fetch.NewArchiveFetcher(
 		opts.HTTPRetry,
 		tar.UnlimitedUntarSize,
-		tar.UnlimitedUntarSize,
+		maxUntarSize,
 		os.Getenv("SOURCE_CONTROLLER_LOCALHOST"),
 	)
 
 	recoverPanic := true
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&kustomizev1.Kustomization{}, builder.WithPredicates(
-			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}),
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{},
+				ForceApplyRequestedPredicate{}),
 		)).
 		Watches(
 			&source.Kind{Type: &sourcev1b2.OCIRepository{}},
-			handler.EnqueueRequestsFromMapFunc(r.requestsForRevisionChangeOf(ociRepositoryIndexKey)),
+			debounce.EventHandler(handler.EnqueueRequestsFromMapFunc(r.requestsForRevisionChangeOf(ociRepositoryIndexKey)),
+				opts.SourceDebounceInterval),
 			builder.WithPredicates(SourceRevisionChangePredicate{}),
 		).
 		Watches(
 			&source.Kind{Type: &sourcev1.GitRepository{}},
-			handler.EnqueueRequestsFromMapFunc(r.requestsForRevisionChangeOf(gitRepositoryIndexKey)),
+			debounce.EventHandler(handler.EnqueueRequestsFromMapFunc(r.requestsForRevisionChangeOf(gitRepositoryIndexKey)),
+				opts.SourceDebounceInterval),
 			builder.WithPredicates(SourceRevisionChangePredicate{}),
 		).
 		Watches(
 			&source.Kind{Type: &sourcev1b2.Bucket{}},
-			handler.EnqueueRequestsFromMapFunc(r.requestsForRevisionChangeOf(bucketIndexKey)),
+			debounce.EventHandler(handler.EnqueueRequestsFromMapFunc(r.requestsForRevisionChangeOf(bucketIndexKey)),
+				opts.SourceDebounceInterval),
 			builder.WithPredicates(SourceRevisionChangePredicate{}),
 		).
 		WithOptions(controller.Options{
@@ -167,6 +650,7 @@ func (r *KustomizationReconciler) SetupWithManager(mgr ctrl.Manager, opts Kustom
 func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, retErr error) {
 	log := ctrl.LoggerFrom(ctx)
 	reconcileStart := time.Now()
+	phaseTimer := intmetrics.NewPhaseTimer()
 
 	obj := &kustomizev1.Kustomization{}
 	if err := r.Get(ctx, req.NamespacedName, obj); err != nil {
@@ -174,10 +658,13 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	}
 
 	// Initialize the runtime patcher with the current version of the object.
-	patcher := patch.NewSerialPatcher(obj, r.Client)
+	patcher := newStatusPatcher(obj, r.Client)
 
 	// Finalise the reconciliation and report the results.
 	defer func() {
+		// Record the time spent in each phase of the reconciliation.
+		r.recordPhaseDurations(obj, phaseTimer)
+
 		// Patch finalizers, status and conditions.
 		if err := r.finalizeStatus(ctx, obj, patcher); err != nil {
 			retErr = kerrors.NewAggregate([]error{retErr, err})
@@ -192,7 +679,7 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		if conditions.IsReady(obj) {
 			msg := fmt.Sprintf("Reconciliation finished in %s, next run in %s",
 				time.Since(reconcileStart).String(),
-				obj.Spec.Interval.Duration.String())
+				r.getInterval(obj).String())
 			log.Info(msg, "revision", obj.Status.LastAttemptedRevision)
 			r.event(obj, obj.Status.LastAppliedRevision, eventv1.EventSeverityInfo, msg,
 				map[string]string{
@@ -210,6 +697,19 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 	// Prune managed resources if the object is under deletion.
 	if !obj.ObjectMeta.DeletionTimestamp.IsZero() {
+		r.failureBackoff.Reset(req.NamespacedName.String())
+		r.resultCache.Delete(req.NamespacedName.String())
+		r.keyFailures.delete(req.NamespacedName.String())
+		if r.ExtendedMetrics != nil {
+			ref := corev1.ObjectReference{
+				Kind:      kustomizev1.KustomizationKind,
+				Name:      obj.GetName(),
+				Namespace: obj.GetNamespace(),
+			}
+			r.ExtendedMetrics.DeleteKeyExpiry(ref)
+			r.ExtendedMetrics.DeleteKeyFailures(ref)
+			r.ExtendedMetrics.DeleteDataKeyRotations(ref)
+		}
 		return r.finalize(ctx, obj)
 	}
 
@@ -261,8 +761,19 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		log.Info("All dependencies are ready, proceeding with reconciliation")
 	}
 
-	// Reconcile the latest revision.
-	reconcileErr := r.reconcile(ctx, obj, artifactSource, patcher)
+	// Wait for the Kustomizations sharing the same source to release
+	// their slots if the per-source concurrency limit is reached.
+	release, err := r.sourceLimiter.Acquire(ctx, sourceKey(obj))
+	if err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// Reconcile the latest revision within the remaining budget of the
+	// reconciliation.
+	reconcileCtx, cancel := r.reconcileContext(ctx, reconcileStart)
+	reconcileErr := r.reconcile(reconcileCtx, obj, artifactSource, patcher, phaseTimer)
+	cancel()
+	release()
 
 	// Requeue at the specified retry interval if the artifact tarball is not found.
 	if reconcileErr == fetch.FileNotFoundError {
@@ -272,30 +783,131 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
 	}
 
-	// Broadcast the reconciliation failure and requeue at the specified retry interval.
+	// Requeue the reconciliation at the specified interval, without backoff,
+	// if the Kustomization is degraded after a health check timeout.
+	var degradedErr *healthCheckDegradedError
+	if errors.As(reconcileErr, &degradedErr) {
+		r.failureBackoff.Reset(req.NamespacedName.String())
+		log.Info(fmt.Sprintf("Reconciliation degraded after %s, next run in %s",
+			time.Since(reconcileStart).String(),
+			r.getInterval(obj).String()),
+			"revision",
+			artifactSource.GetArtifact().Revision)
+		r.event(obj, artifactSource.GetArtifact().Revision, eventv1.EventSeverityError,
+			reconcileErr.Error(), nil)
+		return ctrl.Result{RequeueAfter: r.getInterval(obj)}, nil
+	}
+
+	// Broadcast the reconciliation failure and requeue with a backoff based
+	// on the retry interval and the type of failure.
 	if reconcileErr != nil {
+		requeueAfter := r.failureBackoff.Next(req.NamespacedName.String(),
+			failureClass(obj, reconcileErr), obj.GetRetryInterval())
 		log.Error(reconcileErr, fmt.Sprintf("Reconciliation failed after %s, next try in %s",
 			time.Since(reconcileStart).String(),
-			obj.GetRetryInterval().String()),
+			requeueAfter.String()),
 			"revision",
 			artifactSource.GetArtifact().Revision)
 		r.event(obj, artifactSource.GetArtifact().Revision, eventv1.EventSeverityError,
 			reconcileErr.Error(), nil)
-		return ctrl.Result{RequeueAfter: obj.GetRetryInterval()}, nil
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
 	}
 
 	// Requeue the reconciliation at the specified interval.
-	return ctrl.Result{RequeueAfter: obj.Spec.Interval.Duration}, nil
+	r.failureBackoff.Reset(req.NamespacedName.String())
+	return ctrl.Result{RequeueAfter: r.getInterval(obj)}, nil
+}
+
+// remainingTimeout returns the part of the timeout of the Kustomization which
+// remains for the operations started at the given time, so that their
+// successive waits do not exceed the timeout in total.
+func remainingTimeout(obj *kustomizev1.Kustomization, start time.Time) time.Duration {
+	if remaining := obj.GetTimeout() - time.Since(start); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// applyWaitOptions returns the options of the waits of the apply started at
+// the given time, with the remaining part of the timeout of the Kustomization.
+// It returns an error once the timeout is exhausted, as the waits do not
+// expire without a timeout.
+func applyWaitOptions(obj *kustomizev1.Kustomization, start time.Time) (ssa.WaitOptions, error) {
+	remaining := remainingTimeout(obj, start)
+	if remaining <= 0 {
+		return ssa.WaitOptions{}, fmt.Errorf("timeout of %s exceeded while applying", obj.GetTimeout())
+	}
+	return ssa.WaitOptions{
+		Interval: 2 * time.Second,
+		Timeout:  remaining,
+	}, nil
+}
+
+// reconcileContext returns the context of the reconciliation started at the
+// given time, which expires at the end of the ReconcileTimeout if set.
+func (r *KustomizationReconciler) reconcileContext(ctx context.Context, start time.Time) (context.Context, context.CancelFunc) {
+	if r.reconcileTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, start.Add(r.reconcileTimeout))
+}
+
+// getInterval returns the interval at which the Kustomization is reconciled,
+// which is the .spec.interval raised to the minimum interval of the kind of
+// its source, if any.
+func (r *KustomizationReconciler) getInterval(obj *kustomizev1.Kustomization) time.Duration {
+	interval := obj.Spec.Interval.Duration
+	if minInterval, ok := r.minIntervals[obj.Spec.SourceRef.Kind]; ok && interval < minInterval {
+		return minInterval
+	}
+	return interval
+}
+
+// failureClass returns the backoff class of the reconciliation failure, based
+// on the reason of the Ready condition. Throttling and network errors are
+// transient, while authorization and key errors of the decryption persist
+// until the configuration is fixed.
+func failureClass(obj *kustomizev1.Kustomization, err error) backoff.Class {
+	switch conditions.GetReason(obj, meta.ReadyCondition) {
+	case kustomizev1.DecryptionThrottledReason,
+		kustomizev1.DecryptionVaultUnavailableReason:
+		return backoff.TransientClass
+	case kustomizev1.DecryptionForbiddenReason,
+		kustomizev1.DecryptionKeyNotFoundReason,
+		kustomizev1.DecryptionKeyDisabledReason,
+		kustomizev1.DecryptionSecretInvalidReason:
+		return backoff.PersistentClass
+	case kustomizev1.DecryptionKeyDeletedReason:
+		// A deleted key is retried fast while it is recovered.
+		var deletedErr *azkv.KeyDeletedError
+		if errors.As(err, &deletedErr) && deletedErr.Recovering {
+			return backoff.TransientClass
+		}
+		return backoff.PersistentClass
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return backoff.TransientClass
+	}
+	return backoff.DefaultClass
 }
 
 func (r *KustomizationReconciler) reconcile(
 	ctx context.Context,
 	obj *kustomizev1.Kustomization,
 	src sourcev1.Source,
-	patcher *patch.SerialPatcher) error {
+	patcher *statusPatcher,
+	phaseTimer *intmetrics.PhaseTimer) error {
 
-	// Update status with the reconciliation progress.
+	// Skip the build of an unchanged revision and configuration which was
+	// reconciled recently, if the applied objects did not change since.
 	revision := src.GetArtifact().Revision
+	if r.reconcileUnchanged(ctx, obj, revision) {
+		return nil
+	}
+
+	// Update status with the reconciliation progress.
 	progressingMsg := fmt.Sprintf("Fetching manifests for revision %s with a timeout of %s", revision, obj.GetTimeout().String())
 	conditions.MarkUnknown(obj, meta.ReadyCondition, meta.ProgressingReason, "Reconciliation in progress")
 	conditions.MarkReconciling(obj, meta.ProgressingReason, progressingMsg)
@@ -320,7 +932,9 @@ func (r *KustomizationReconciler) reconcile(
 	defer os.RemoveAll(tmpDir)
 
 	// Download artifact and extract files to the tmp dir.
+	stopPhase := phaseTimer.Start(intmetrics.FetchPhase)
 	err = r.artifactFetcher.Fetch(src.GetArtifact().URL, src.GetArtifact().Digest, tmpDir)
+	stopPhase()
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ArtifactFailedReason, err.Error())
 		return err
@@ -343,30 +957,63 @@ func (r *KustomizationReconciler) reconcile(
 	obj.Status.LastAttemptedRevision = revision
 	progressingMsg = fmt.Sprintf("Building manifests for revision %s with a timeout of %s", revision, obj.GetTimeout().String())
 	conditions.MarkReconciling(obj, meta.ProgressingReason, progressingMsg)
-	if err := r.patch(ctx, obj, patcher); err != nil {
+	if err := r.patchProgress(ctx, obj, patcher); err != nil {
 		return fmt.Errorf("failed to update status, error: %w", err)
 	}
 
+	// Resolve the decryption inherited from the namespace, if any.
+	decObj, err := r.withDefaultDecryption(ctx, obj)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+		return err
+	}
+
+	// Validate the entries of the decryption Secret before any build work,
+	// to report the invalid ones precisely. The errors to get the Secret are
+	// reported by the build.
+	validator := decryptor.NewDecryptor("", r.Client, decObj, 0, "")
+	validator.SetAzureDisableDefaultCredential(r.azureNoDefaultCredential)
+	validator.SetAzureAllowWorkloadIdentity(r.azureAllowWorkloadIdentity)
+	validator.SetVaultKubernetesAuth(r.vaultTokens, r.vaultServiceAccount(obj))
+	if err := validator.ValidateKeys(ctx); err != nil {
+		var invalidSecretErr *decryptor.InvalidSecretError
+		if errors.As(err, &invalidSecretErr) {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.DecryptionSecretInvalidReason, err.Error())
+			return err
+		}
+	}
+
+	// The decrypted values, of the kubeconfig Secret and of the build, are
+	// recorded to keep them out of the errors surfaced in events, logs and
+	// status conditions.
+	redactor := decryptor.NewRedactor()
+
 	// Configure the Kubernetes client for impersonation.
-	impersonation := runtimeClient.NewImpersonator(
-		r.Client,
-		r.StatusPoller,
-		r.PollingOpts,
-		obj.Spec.KubeConfig,
-		r.KubeConfigOpts,
-		r.DefaultServiceAccount,
-		obj.Spec.ServiceAccountName,
-		obj.GetNamespace(),
-	)
+	impersonation, err := r.getImpersonator(decObj, redactor)
+	if err != nil {
+		if acl.IsAccessDenied(err) {
+			conditions.MarkFalse(obj, meta.ReadyCondition, apiacl.AccessDeniedReason, err.Error())
+		} else {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+		}
+		return err
+	}
 
 	// Create the Kubernetes client that runs under impersonation.
 	kubeClient, statusPoller, err := impersonation.GetClient(ctx)
 	if err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+		err = redactor.RedactError(err)
+		reason := decryptor.FailureReason(err)
+		if reason == "" {
+			reason = kustomizev1.ReconciliationFailedReason
+		}
+		conditions.MarkFalse(obj, meta.ReadyCondition, reason, err.Error())
 		return fmt.Errorf("failed to build kube client: %w", err)
 	}
 
 	// Generate kustomization.yaml if needed.
+	stopPhase = phaseTimer.Start(intmetrics.BuildPhase)
+	defer stopPhase()
 	k, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.BuildFailedReason, err.Error())
@@ -379,19 +1026,56 @@ func (r *KustomizationReconciler) reconcile(
 	}
 
 	// Build the Kustomize overlay and decrypt secrets if needed.
-	resources, err := r.build(ctx, obj, unstructured.Unstructured{Object: k}, tmpDir, dirPath)
+	var preview *substitutionPreview
+	if obj.GetAnnotations()[kustomizev1.SubstitutionPreviewAnnotation] == kustomizev1.EnabledValue {
+		// The revision is not applied without the preview it is annotated
+		// for.
+		if !r.AllowSubstitutionPreviews {
+			err := fmt.Errorf("the substitution preview requested with the '%s' annotation is disabled by the controller",
+				kustomizev1.SubstitutionPreviewAnnotation)
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+			return err
+		}
+		preview, err = r.newSubstitutionPreview(ctx, obj, revision)
+		if err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.BuildFailedReason, err.Error())
+			return err
+		}
+	}
+	resources, decryptReport, err := r.build(ctx, obj, decObj, unstructured.Unstructured{Object: k}, tmpDir, dirPath, phaseTimer, redactor, preview)
 	if err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.BuildFailedReason, err.Error())
+		err = redactor.RedactError(err)
+		reason := kustomizev1.BuildFailedReason
+		if decryptReason := decryptor.FailureReason(err); decryptReason != "" {
+			reason = decryptReason
+		}
+		conditions.MarkFalse(obj, meta.ReadyCondition, reason, err.Error())
 		return err
 	}
 
+	// Report the resources which failed to be decrypted in report-only mode.
+	if decryptReport != nil {
+		msg := decryptReport.String()
+		ctrl.LoggerFrom(ctx).Info(msg, "revision", revision)
+		conditions.MarkTrue(obj, kustomizev1.DecryptionFailedCondition, kustomizev1.DecryptionFailedReason, msg)
+		r.event(obj, revision, eventv1.EventSeverityError, msg, nil)
+	} else {
+		conditions.Delete(obj, kustomizev1.DecryptionFailedCondition)
+	}
+
 	// Convert the build result into Kubernetes unstructured objects.
 	objects, err := ssa.ReadObjects(bytes.NewReader(resources))
+	stopPhase()
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.BuildFailedReason, err.Error())
 		return err
 	}
 
+	// Omit the target namespace for the cluster-scoped objects.
+	if obj.Spec.TargetNamespace != "" {
+		omitClusterScopedNamespaces(kubeClient.RESTMapper(), objects)
+	}
+
 	// Create the server-side apply manager.
 	resourceManager := ssa.NewResourceManager(kubeClient, statusPoller, ssa.Owner{
 		Field: r.ControllerName,
@@ -399,27 +1083,143 @@ func (r *KustomizationReconciler) reconcile(
 	})
 	resourceManager.SetOwnerLabels(objects, obj.GetName(), obj.GetNamespace())
 
+	// Dump the objects for debugging when requested, without failing the
+	// reconciliation if they can't be dumped.
+	if obj.GetAnnotations()[kustomizev1.BuildDumpAnnotation] == kustomizev1.EnabledValue {
+		err := fmt.Errorf("the build dump requested with the '%s' annotation is disabled by the controller",
+			kustomizev1.BuildDumpAnnotation)
+		if r.AllowBuildDumps {
+			err = r.writeBuildDump(ctx, kubeClient, obj, revision, objects, redactor)
+		}
+		if err != nil {
+			msg := redactor.RedactError(err).Error()
+			ctrl.LoggerFrom(ctx).Info(msg, "revision", revision)
+			r.event(obj, revision, eventv1.EventSeverityError, msg, nil)
+		}
+	}
+
+	// Report the preview of the variable substitution without applying or
+	// pruning if requested.
+	if preview != nil {
+		if err := r.reportSubstitutionPreview(ctx, kubeClient, obj, preview); err != nil {
+			err = redactor.RedactError(err)
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+			return err
+		}
+		return nil
+	}
+
+	// Verify that the APIs of the resources are served before changing the
+	// cluster.
+	if obj.Spec.APICheck {
+		if err := checkAPIs(kubeClient, obj, objects); err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.UnsupportedAPIsReason, err.Error())
+			return err
+		}
+	} else {
+		conditions.Delete(obj, kustomizev1.UnsupportedAPIsCondition)
+	}
+
+	// Verify the permissions to apply the resources before changing the cluster.
+	if obj.Spec.PermissionCheck {
+		if err := r.checkPermissions(ctx, kubeClient, obj, objects); err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.InsufficientPermissionsReason, err.Error())
+			return err
+		}
+	} else if projected := projectedObjects(objects); len(projected) > 0 {
+		// Verify the permissions to apply the projected Secrets in any
+		// case, as they are applied to the namespaces of other teams.
+		if err := r.checkPermissions(ctx, kubeClient, obj, projected); err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.InsufficientPermissionsReason, err.Error())
+			return err
+		}
+	} else {
+		conditions.Delete(obj, kustomizev1.InsufficientPermissionsCondition)
+	}
+
 	// Update status with the reconciliation progress.
 	progressingMsg = fmt.Sprintf("Detecting drift for revision %s with a timeout of %s", revision, obj.GetTimeout().String())
 	conditions.MarkReconciling(obj, meta.ProgressingReason, progressingMsg)
-	if err := r.patch(ctx, obj, patcher); err != nil {
+	if err := r.patchProgress(ctx, obj, patcher); err != nil {
 		return fmt.Errorf("failed to update status, error: %w", err)
 	}
 
-	// Validate and apply resources in stages.
-	drifted, changeSet, err := r.apply(ctx, resourceManager, obj, revision, objects)
+	// Report the drift without applying or pruning if frozen.
+	if obj.Spec.Freeze {
+		if err := r.reportFrozenDrift(ctx, resourceManager, obj, revision, objects); err != nil {
+			err = redactor.RedactError(err)
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+			return err
+		}
+		return nil
+	}
+
+	// Compute the checksums of the objects, and hold back the ones which
+	// did not change since their last apply, unless the spec changed or a
+	// full apply is requested.
+	var checksums map[string]string
+	unchangedSet := ssa.NewChangeSet()
+	applyObjects := objects
+	if obj.Spec.SkipUnchanged {
+		checksums, err = inventory.Checksums(r.checksumKey, objects)
+		if err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+			return err
+		}
+		if _, forceApply := obj.ForceApplyRequested(); !forceApply && obj.Status.ObservedGeneration == obj.Generation {
+			applyObjects, unchangedSet = inventory.SplitUnchanged(oldInventory, objects, checksums)
+		}
+	}
+
+	// Validate and apply resources in stages. The waits of the apply and
+	// of the garbage collection share the timeout of the Kustomization.
+	applyStart := time.Now()
+	stopPhase = phaseTimer.Start(intmetrics.ApplyPhase)
+	drifted, changeSet, err := r.apply(ctx, resourceManager, obj, revision, applyObjects, applyStart)
+	stopPhase()
 	if err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+		err = redactor.RedactError(err)
+		reason := kustomizev1.ReconciliationFailedReason
+		var conflictErr *fieldConflictError
+		if errors.As(err, &conflictErr) {
+			reason = kustomizev1.FieldConflictReason
+		}
+		conditions.MarkFalse(obj, meta.ReadyCondition, reason, err.Error())
 		return err
 	}
 
-	// Create an inventory from the reconciled resources.
+	// Audit the projected Secrets which were created or changed.
+	r.auditProjections(ctx, obj, revision, projectedObjects(applyObjects), changeSet)
+
+	// Record the handled force apply request, so that the next
+	// reconciliations apply only the drifted objects.
+	if v, ok := obj.ForceApplyRequested(); ok {
+		obj.Status.LastHandledForceApplyAt = v
+	}
+
+	// Create an inventory from the reconciled resources, including the
+	// unchanged ones which were not applied.
+	changeSet.Append(unchangedSet.Entries)
 	newInventory := inventory.New()
 	err = inventory.AddChangeSet(newInventory, changeSet)
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
 		return err
 	}
+	inventory.SetChecksums(newInventory, checksums)
+
+	// Keep the objects skipped because of decryption failures in the
+	// inventory, so that they are not garbage collected.
+	if decryptReport != nil {
+		for _, entry := range oldInventory.Entries {
+			for _, o := range decryptReport.skipped {
+				if entry.ID == o.String() {
+					newInventory.Entries = append(newInventory.Entries, entry)
+					break
+				}
+			}
+		}
+	}
 
 	// Set last applied inventory in status.
 	obj.Status.Inventory = newInventory
@@ -432,28 +1232,79 @@ func (r *KustomizationReconciler) reconcile(
 	}
 
 	// Run garbage collection for stale resources that do not have pruning disabled.
-	if _, err := r.prune(ctx, resourceManager, obj, revision, staleObjects); err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.PruneFailedReason, err.Error())
+	stopPhase = phaseTimer.Start(intmetrics.PrunePhase)
+	_, err = r.prune(ctx, resourceManager, patcher, obj, revision, staleObjects, applyStart)
+	stopPhase()
+	if err != nil {
+		reason := kustomizev1.PruneFailedReason
+		var terr *terminationTimeoutError
+		if errors.As(err, &terr) {
+			reason = kustomizev1.PruneWaitFailedReason
+			// Keep the objects stuck in termination in the inventory,
+			// so that the next reconciliation waits for them again.
+			pendingSet := ssa.NewChangeSet()
+			for _, o := range terr.objects {
+				pendingSet.Add(ssa.ChangeSetEntry{
+					ObjMetadata:  object.UnstructuredToObjMetadata(o),
+					GroupVersion: o.GroupVersionKind().GroupVersion().String(),
+					Subject:      ssa.FmtUnstructured(o),
+					Action:       ssa.DeletedAction,
+				})
+			}
+			_ = inventory.AddChangeSet(obj.Status.Inventory, pendingSet)
+		}
+		conditions.MarkFalse(obj, meta.ReadyCondition, reason, err.Error())
 		return err
 	}
 
 	// Run the health checks for the last applied resources.
 	isNewRevision := !src.GetArtifact().HasRevision(obj.Status.LastAppliedRevision)
-	if err := r.checkHealth(ctx,
+	stopPhase = phaseTimer.Start(intmetrics.HealthCheckPhase)
+	err = r.checkHealth(ctx,
 		resourceManager,
 		patcher,
 		obj,
 		revision,
 		isNewRevision,
 		drifted,
-		changeSet.ToObjMetadataSet()); err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.HealthCheckFailedReason, err.Error())
+		changeSet.ToObjMetadataSet(),
+		applyStart)
+	stopPhase()
+	if err != nil {
+		reason := kustomizev1.HealthCheckFailedReason
+		var degradedErr *healthCheckDegradedError
+		if errors.As(err, &degradedErr) {
+			reason = kustomizev1.HealthCheckDegradedReason
+		}
+		conditions.MarkFalse(obj, meta.ReadyCondition, reason, err.Error())
 		return err
 	}
 
+	// Call the post-apply webhook to validate the applied revision.
+	if obj.Spec.PostApplyWebhook != nil {
+		if err := r.callPostApplyWebhook(ctx, obj, revision, changeSet); err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.PostApplyWebhookFailedReason, err.Error())
+			return err
+		}
+	}
+
 	// Set last applied revision.
 	obj.Status.LastAppliedRevision = revision
 
+	// Set the readable list of managed objects from the last applied inventory.
+	managedObjects, err := inventory.ManagedObjects(obj.Status.Inventory, inventory.MaxManagedObjects)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.ReconciliationFailedReason, err.Error())
+		return err
+	}
+	obj.Status.ManagedObjects = managedObjects
+
+	// Record the result to skip the next reconciliations of the revision,
+	// unless objects were skipped because of decryption failures.
+	if decryptReport == nil {
+		r.recordResult(ctx, kubeClient, obj, revision)
+	}
+
 	// Mark the object as ready.
 	conditions.MarkTrue(obj,
 		meta.ReadyCondition,
@@ -555,86 +1406,674 @@ func (r *KustomizationReconciler) getSource(ctx context.Context,
 	return src, nil
 }
 
+// sourceKey returns the key identifying the source of the given Kustomization
+// in the per-source concurrency limiter.
+func sourceKey(obj *kustomizev1.Kustomization) string {
+	namespace := obj.GetNamespace()
+	if obj.Spec.SourceRef.Namespace != "" {
+		namespace = obj.Spec.SourceRef.Namespace
+	}
+	return fmt.Sprintf("%s/%s/%s", obj.Spec.SourceRef.Kind, namespace, obj.Spec.SourceRef.Name)
+}
+
 func (r *KustomizationReconciler) generate(obj unstructured.Unstructured,
 	workDir string, dirPath string) error {
 	_, err := generator.NewGenerator(workDir, obj).WriteFile(dirPath)
 	return err
 }
 
+// build runs the Kustomize build of the Kustomization, and decrypts the
+// resulting resources as defined by decObj, the Kustomization with its
+// inherited decryption.
 func (r *KustomizationReconciler) build(ctx context.Context,
-	obj *kustomizev1.Kustomization, u unstructured.Unstructured,
-	workDir, dirPath string) ([]byte, error) {
-	dec, cleanup, err := decryptor.NewTempDecryptor(workDir, r.Client, obj)
+	obj, decObj *kustomizev1.Kustomization, u unstructured.Unstructured,
+	workDir, dirPath string, phaseTimer *intmetrics.PhaseTimer, redactor *decryptor.Redactor,
+	preview *substitutionPreview) ([]byte, *decryptionReport, error) {
+	dec, cleanup, err := decryptor.NewTempDecryptor(workDir, r.Client, decObj)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer cleanup()
+	if decObj.Spec.Decryption != nil {
+		defer func() {
+			r.recordKeyFailures(ctx, obj, dec.AzureKeyFailures(), dec.AzureKeyDecryptions())
+		}()
+	}
+	r.configureDecryptor(ctx, decObj, dec, redactor)
 
 	// Import decryption keys
-	if err := dec.ImportKeys(ctx); err != nil {
-		return nil, err
+	stopDecrypt := phaseTimer.Start(intmetrics.DecryptPhase)
+	err = dec.ImportKeys(ctx)
+	stopDecrypt()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Decrypt Kustomize EnvSources files before build
-	if err = dec.DecryptEnvSources(dirPath); err != nil {
-		return nil, fmt.Errorf("error decrypting env sources: %w", err)
+	stopDecrypt = phaseTimer.Start(intmetrics.DecryptPhase)
+	err = dec.DecryptEnvSources(dirPath)
+	stopDecrypt()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decrypting env sources: %w", err)
+	}
+
+	// Track the origin of resources if decryption is restricted to some paths
+	if err = dec.TrackOrigins(dirPath); err != nil {
+		return nil, nil, fmt.Errorf("error tracking resource origins for decryption: %w", err)
+	}
+
+	buildOpts, err := r.buildOptions(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Track the origin of resources to report the ones which hardcode a
+	// namespace other than the target namespace, as it is overridden by the
+	// build, and to match the targets of the patches against the ids the
+	// resources are declared with.
+	checkPatches := r.FailOnUnmatchedPatches && len(obj.Spec.Patches) > 0
+	var stripOrigins bool
+	if obj.Spec.TargetNamespace != "" || checkPatches {
+		if stripOrigins, err = enableOriginAnnotations(dirPath); err != nil {
+			return nil, nil, fmt.Errorf("error tracking resource origins: %w", err)
+		}
+	}
+
+	m, err := build.SecureBuild(workDir, dirPath, buildOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kustomize build failed: %w", err)
+	}
+	declared := newOriginResolver(workDir, dirPath)
+
+	if obj.Spec.TargetNamespace != "" {
+		conflicts, err := namespaceConflicts(obj, m, declared)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The conflicts are only reported once per revision and generation
+		// of the Kustomization.
+		reported := obj.Status.LastAppliedRevision == obj.Status.LastAttemptedRevision &&
+			obj.Status.ObservedGeneration == obj.Generation
+		if len(conflicts) > 0 && !reported {
+			msg := fmt.Sprintf("Namespace of %d object(s) overridden by the target namespace '%s':\n%s",
+				len(conflicts), obj.Spec.TargetNamespace, strings.Join(conflicts, "\n"))
+			ctrl.LoggerFrom(ctx).Info(msg, "revision", obj.Status.LastAttemptedRevision)
+			r.event(obj, obj.Status.LastAttemptedRevision, eventv1.EventSeverityError, msg, nil)
+		}
+	}
+
+	if checkPatches {
+		if err := checkPatchTargets(m, obj.Spec.Patches, declared); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if stripOrigins {
+		if err := stripOriginAnnotations(m); err != nil {
+			return nil, nil, fmt.Errorf("error removing resource origins: %w", err)
+		}
+	}
+
+	// Enforce the max number of objects before decrypting any of them.
+	if n := m.Size(); r.maxManifests > 0 && n > r.maxManifests {
+		return nil, nil, fmt.Errorf("kustomize build produced %d objects, exceeding the max of %d objects", n, r.maxManifests)
 	}
 
-	m, err := generator.SecureBuild(workDir, dirPath, !r.NoRemoteBases)
+	// Load the variables once to handle the undefined ones with the policy
+	// of the Kustomization, if any.
+	substitution, err := r.newVariableSubstitution(ctx, obj)
 	if err != nil {
-		return nil, fmt.Errorf("kustomize build failed: %w", err)
+		return nil, nil, err
 	}
 
+	reportOnly := decObj.Spec.Decryption != nil && decObj.Spec.Decryption.ReportOnly
+	report := &decryptionReport{}
+	origins := make(map[*resource.Resource]string)
+	var secretChecksums map[string]string
+	if decObj.Spec.Decryption != nil && decObj.Spec.Decryption.SecretChecksums != "" {
+		secretChecksums = make(map[string]string)
+	}
 	for _, res := range m.Resources() {
 		// check if resources conform to the Kubernetes API conventions
 		if res.GetName() == "" || res.GetKind() == "" || res.GetApiVersion() == "" {
-			return nil, fmt.Errorf("failed to decode Kubernetes apiVersion, kind and name from: %v", res.String())
+			return nil, nil, fmt.Errorf("failed to decode Kubernetes apiVersion, kind and name from: %v", res.String())
 		}
 
 		// check if resources are encrypted and decrypt them before generating the final YAML
-		if obj.Spec.Decryption != nil {
+		var decrypted bool
+		if decObj.Spec.Decryption != nil {
+			if reportOnly {
+				// Record the origin before it is removed by the decryption.
+				if origins[res], err = dec.OriginPath(res); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			decrypted = decryptor.IsEncryptedResource(res)
+			stopDecrypt = phaseTimer.Start(intmetrics.DecryptPhase)
 			outRes, err := dec.DecryptResource(res)
+			stopDecrypt()
 			if err != nil {
-				return nil, fmt.Errorf("decryption failed for '%s': %w", res.GetName(), err)
+				err = fmt.Errorf("decryption failed for '%s': %w", res.GetName(), err)
+				if !reportOnly {
+					return nil, nil, err
+				}
+				report.addFailure(res, origins[res], redactor.RedactError(err))
+				continue
 			}
 
 			if outRes != nil {
 				_, err = m.Replace(res)
 				if err != nil {
-					return nil, err
+					return nil, nil, err
 				}
 			}
 		}
 
+		// render the preview of the variable substitutions if requested
+		if err := preview.add(ctx, res); err != nil {
+			return nil, nil, err
+		}
+
 		// run variable substitutions
 		if obj.Spec.PostBuild != nil {
-			outRes, err := generator.SubstituteVariables(ctx, r.Client, u, res, false)
+			outRes, err := r.substituteVariables(ctx, u, substitution, res)
 			if err != nil {
-				return nil, fmt.Errorf("var substitution failed for '%s': %w", res.GetName(), err)
+				return nil, nil, fmt.Errorf("var substitution failed for '%s': %w", res.GetName(), err)
 			}
 
 			if outRes != nil {
 				_, err = m.Replace(res)
 				if err != nil {
-					return nil, err
+					return nil, nil, err
+				}
+			}
+
+			// run variable substitutions on the decrypted Secret data if enabled
+			if decrypted && obj.Spec.PostBuild.SubstituteDecryptedData && res.GetKind() == "Secret" {
+				if err := r.substituteSecretData(ctx, u, substitution, res); err != nil {
+					return nil, nil, fmt.Errorf("var substitution failed for '%s' data: %w", res.GetName(), err)
+				}
+
+				_, err = m.Replace(res)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+
+		// stamp the checksum of the content of the decrypted Secrets if enabled
+		if decrypted && secretChecksums != nil && res.GetKind() == "Secret" {
+			sum, err := stampSecretChecksum(res)
+			if err != nil {
+				return nil, nil, err
+			}
+			secretChecksums[fmt.Sprintf("%s/%s", res.GetNamespace(), res.GetName())] = sum
+			if _, err = m.Replace(res); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		// project the decrypted Secrets to the allowed namespaces
+		if decrypted && res.GetKind() == "Secret" {
+			projections, err := projectSecret(res, decObj.Spec.Decryption.ProjectionNamespaces)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(projections) > 0 && r.NoCrossNamespaceRefs {
+				return nil, nil, fmt.Errorf("projection of Secret '%s/%s' to other namespaces is not allowed: cross-namespace references are disabled",
+					res.GetNamespace(), res.GetName())
+			}
+			for _, p := range projections {
+				if secretChecksums != nil {
+					sum, err := stampSecretChecksum(p)
+					if err != nil {
+						return nil, nil, err
+					}
+					secretChecksums[fmt.Sprintf("%s/%s", p.GetNamespace(), p.GetName())] = sum
 				}
+				if err := m.Append(p); err != nil {
+					return nil, nil, err
+				}
+				origins[p] = origins[res]
 			}
 		}
 	}
 
+	if decObj.Spec.Decryption != nil {
+		recordKeyDecryptions(obj, dec.AzureKeyDecryptions())
+		r.checkKeyExpiries(ctx, obj, dec)
+		r.checkDataKeyRotations(ctx, obj, dec)
+	}
+	obj.Status.DecryptionProviders = dec.KeyProviders()
+
+	// Stamp the checksums of the decrypted Secrets on the workloads
+	// referencing them, to trigger their rollout on a change.
+	if len(secretChecksums) > 0 && decObj.Spec.Decryption.SecretChecksums == kustomizev1.WorkloadsValue {
+		for _, res := range m.Resources() {
+			stamped, err := stampWorkloadChecksum(res, secretChecksums)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to stamp the Secret checksums of '%s': %w", res.GetName(), err)
+			}
+			if stamped {
+				if _, err = m.Replace(res); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	// Remove the failed resources, and all the other resources from the
+	// files they originate from, to never apply a partially decrypted file.
+	if len(report.failures) > 0 {
+		for _, res := range m.Resources() {
+			if !report.skips(res, origins[res]) {
+				continue
+			}
+			if err := m.Remove(res.CurId()); err != nil {
+				return nil, nil, err
+			}
+			report.addSkipped(res)
+		}
+	} else {
+		report = nil
+	}
+
+	if err := preview.finish(m.Resources(), redactor); err != nil {
+		return nil, nil, fmt.Errorf("failed to render the substitution preview: %w", err)
+	}
+
 	resources, err := m.AsYaml()
 	if err != nil {
-		return nil, fmt.Errorf("kustomize build failed: %w", err)
+		return nil, nil, fmt.Errorf("kustomize build failed: %w", err)
+	}
+
+	return resources, report, nil
+}
+
+// recordKeyDecryptions records the times of the last successful decryption
+// with the keys in the status of the Kustomization. The keys which did not
+// decrypt data in this reconciliation keep their last time, as long as no
+// more than maxLastKeyDecryptions keys are recorded, the oldest are removed
+// otherwise.
+func recordKeyDecryptions(obj *kustomizev1.Kustomization, decryptions map[string]time.Time) {
+	if len(decryptions) == 0 {
+		return
+	}
+	if obj.Status.LastKeyDecryptions == nil {
+		obj.Status.LastKeyDecryptions = make(map[string]metav1.Time, len(decryptions))
+	}
+	for key, t := range decryptions {
+		obj.Status.LastKeyDecryptions[key] = metav1.NewTime(t)
+	}
+
+	if n := len(obj.Status.LastKeyDecryptions) - maxLastKeyDecryptions; n > 0 {
+		keys := make([]string, 0, len(obj.Status.LastKeyDecryptions))
+		for key := range obj.Status.LastKeyDecryptions {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			ti, tj := obj.Status.LastKeyDecryptions[keys[i]], obj.Status.LastKeyDecryptions[keys[j]]
+			if ti.Equal(&tj) {
+				return keys[i] < keys[j]
+			}
+			return ti.Before(&tj)
+		})
+		for _, key := range keys[:n] {
+			delete(obj.Status.LastKeyDecryptions, key)
+		}
+	}
+}
+
+// checkKeyExpiries records the time until the expiry of the Azure Key Vault
+// keys which decrypted the data of the Kustomization, and marks the
+// DecryptionKeyExpiring condition when some of them expire within the
+// AzureKeyExpiryWindow. Failures to get the expiry dates are logged, and do
+// not fail the reconciliation.
+func (r *KustomizationReconciler) checkKeyExpiries(ctx context.Context,
+	obj *kustomizev1.Kustomization, dec *decryptor.Decryptor) {
+	if r.AzureKeyExpiryWindow <= 0 {
+		return
+	}
+
+	expiries, err := dec.AzureKeyExpiries(ctx)
+	if err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "failed to get the expiry of Azure Key Vault keys")
+	}
+
+	now := time.Now()
+	var earliest *time.Duration
+	var expiring []string
+	for _, e := range expiries {
+		d := e.Expires.Sub(now)
+		if earliest == nil || d < *earliest {
+			earliest = &d
+		}
+		switch {
+		case d <= 0:
+			expiring = append(expiring, fmt.Sprintf("'%s' expired at %s", e.Key, e.Expires.UTC().Format(time.RFC3339)))
+		case d < r.AzureKeyExpiryWindow:
+			expiring = append(expiring, fmt.Sprintf("'%s' expires at %s", e.Key, e.Expires.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	if r.ExtendedMetrics != nil {
+		ref := corev1.ObjectReference{
+			Kind:      kustomizev1.KustomizationKind,
+			Name:      obj.GetName(),
+			Namespace: obj.GetNamespace(),
+		}
+		if earliest != nil {
+			r.ExtendedMetrics.RecordKeyExpiry(ref, *earliest)
+		} else {
+			r.ExtendedMetrics.DeleteKeyExpiry(ref)
+		}
+	}
+
+	switch {
+	case len(expiring) > 0:
+		conditions.MarkTrue(obj, kustomizev1.DecryptionKeyExpiringCondition, kustomizev1.DecryptionKeyExpiringReason,
+			"Decryption key(s) expiring within %s: %s", r.AzureKeyExpiryWindow.String(), strings.Join(expiring, ", "))
+	case err == nil:
+		conditions.Delete(obj, kustomizev1.DecryptionKeyExpiringCondition)
+	}
+}
+
+// checkDataKeyRotations reports the decryption keys of which the SOPS data
+// key of a file of the Kustomization needs rotation, with a metric and a
+// warning event naming them. It does not re-encrypt the data keys, the
+// controller can not write to the source, the files have to be re-encrypted
+// where they are stored, e.g. with 'sops rotate'.
+func (r *KustomizationReconciler) checkDataKeyRotations(ctx context.Context,
+	obj *kustomizev1.Kustomization, dec *decryptor.Decryptor) {
+	if !r.WarnDataKeyRotation {
+		return
+	}
+
+	keys := dec.DataKeyRotations()
+	if r.ExtendedMetrics != nil {
+		r.ExtendedMetrics.RecordDataKeyRotations(corev1.ObjectReference{
+			Kind:      kustomizev1.KustomizationKind,
+			Name:      obj.GetName(),
+			Namespace: obj.GetNamespace(),
+		}, len(keys))
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("SOPS data key(s) encrypted longer ago than the rotation threshold of the key(s) '%s', "+
+		"re-encrypt the files to rotate them", strings.Join(keys, "', '"))
+	ctrl.LoggerFrom(ctx).Info(msg, "revision", obj.Status.LastAttemptedRevision)
+	r.event(obj, obj.Status.LastAttemptedRevision, eventv1.EventSeverityError, msg, nil)
+}
+
+// decryptionReport holds the resources which failed to be decrypted in the
+// report-only decryption mode, and the resources which were removed from the
+// build result because of them.
+type decryptionReport struct {
+	failures []string
+	failed   map[*resource.Resource]struct{}
+	paths    map[string]struct{}
+	skipped  object.ObjMetadataSet
+}
+
+// addFailure records the decryption error of the given resource, which
+// originates from the file at the given path.
+func (d *decryptionReport) addFailure(res *resource.Resource, path string, err error) {
+	if d.failed == nil {
+		d.failed = make(map[*resource.Resource]struct{})
+		d.paths = make(map[string]struct{})
+	}
+	d.failed[res] = struct{}{}
+	msg := err.Error()
+	if path != "" {
+		d.paths[path] = struct{}{}
+		msg = fmt.Sprintf("%s (from '%s')", msg, path)
+	}
+	d.failures = append(d.failures, msg)
+}
+
+// skips returns if the given resource, which originates from the file at the
+// given path, failed to be decrypted, or shares its file with a resource
+// which failed to be decrypted.
+func (d *decryptionReport) skips(res *resource.Resource, path string) bool {
+	if _, ok := d.failed[res]; ok {
+		return true
+	}
+	_, ok := d.paths[path]
+	return path != "" && ok
+}
+
+// addSkipped records the given resource as removed from the build result.
+func (d *decryptionReport) addSkipped(res *resource.Resource) {
+	d.skipped = append(d.skipped, object.ObjMetadata{
+		Namespace: res.GetNamespace(),
+		Name:      res.GetName(),
+		GroupKind: schema.GroupKind{Group: res.GetGvk().Group, Kind: res.GetKind()},
+	})
+}
+
+// String returns the message reported for the decryption failures.
+func (d *decryptionReport) String() string {
+	skipped := make([]string, 0, len(d.skipped))
+	for _, o := range d.skipped {
+		skipped = append(skipped, ssa.FmtObjMetadata(o))
+	}
+	return fmt.Sprintf("Decryption failed for %d object(s), skipped applying %s:\n%s",
+		len(d.failures), strings.Join(skipped, ", "), strings.Join(d.failures, "\n"))
+}
+
+// buildOptions returns the options of the Kustomize build of the
+// Kustomization. It returns an error if spec.buildOptions enables plugins
+// which are not allowed by the controller.
+func (r *KustomizationReconciler) buildOptions(obj *kustomizev1.Kustomization) (build.Options, error) {
+	opts := build.Options{AllowRemoteBases: !r.NoRemoteBases}
+	if obj.Spec.BuildOptions == nil {
+		return opts, nil
+	}
+
+	if obj.Spec.BuildOptions.LoadRestrictor == kustomizev1.LoadRestrictionsRootOnly {
+		opts.LoadRestrictions = kustypes.LoadRestrictionsRootOnly
+	}
+
+	for _, p := range obj.Spec.BuildOptions.Plugins {
+		allowed := false
+		for _, a := range r.AllowedBuildPlugins {
+			if a == p {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return opts, fmt.Errorf("build plugins of type '%s' are not allowed by the controller", p)
+		}
+
+		switch p {
+		case kustomizev1.ExecBuildPlugin:
+			opts.EnableExecPlugins = true
+		case kustomizev1.ContainerBuildPlugin:
+			opts.EnableContainerPlugins = true
+		default:
+			return opts, fmt.Errorf("unsupported build plugin type '%s'", p)
+		}
+	}
+	return opts, nil
+}
+
+// checkPatchTargets returns an error naming the patches of which the target
+// selects none of the objects in the build result. As the patches are applied
+// before the namespace and name transformations of the build, the targets
+// are matched like Kustomize does, against the namespace and name the objects
+// are declared with in their origin file as well as the current ones.
+func checkPatchTargets(m resmap.ResMap, patches []kustomize.Patch, origins *originResolver) error {
+	var unmatched []string
+	for i, p := range patches {
+		if p.Target == nil {
+			continue
+		}
+		selector := kustypes.Selector{
+			ResId: resid.NewResIdWithNamespace(
+				resid.NewGvk(p.Target.Group, p.Target.Version, p.Target.Kind), p.Target.Name, p.Target.Namespace),
+			AnnotationSelector: p.Target.AnnotationSelector,
+			LabelSelector:      p.Target.LabelSelector,
+		}
+		sr, err := kustypes.NewSelectorRegex(&selector)
+		if err != nil {
+			return fmt.Errorf("invalid target of patches[%d]: %w", i, err)
+		}
+		matched := false
+		for _, res := range m.Resources() {
+			if matched, err = matchesPatchTarget(res, selector, sr, origins); err != nil {
+				return fmt.Errorf("invalid target of patches[%d]: %w", i, err)
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, fmt.Sprintf("patches[%d] (%s)", i, describeSelector(p.Target)))
+		}
+	}
+	if len(unmatched) > 0 {
+		return fmt.Errorf("no objects matched by the target of %s", strings.Join(unmatched, ", "))
+	}
+	return nil
+}
+
+// matchesPatchTarget returns whether the resource is selected by the target
+// of a patch. The namespace and name are matched against the declared id of
+// the resource, if it has an origin file, and the current id.
+func matchesPatchTarget(res *resource.Resource, selector kustypes.Selector, sr *kustypes.SelectorRegex,
+	origins *originResolver) (bool, error) {
+	curId := res.CurId()
+	orgId := curId
+	doc, err := origins.document(res)
+	if err != nil {
+		return false, err
+	}
+	if doc != nil {
+		orgId = resid.NewResIdWithNamespace(res.GetGvk(), doc.GetName(), doc.GetNamespace())
 	}
 
-	return resources, nil
+	if !sr.MatchNamespace(orgId.EffectiveNamespace()) && !sr.MatchNamespace(curId.EffectiveNamespace()) {
+		return false, nil
+	}
+	if !sr.MatchName(orgId.Name) && !sr.MatchName(curId.Name) {
+		return false, nil
+	}
+	if !sr.MatchGvk(res.GetGvk()) {
+		return false, nil
+	}
+	if matched, err := res.MatchesLabelSelector(selector.LabelSelector); err != nil || !matched {
+		return false, err
+	}
+	return res.MatchesAnnotationSelector(selector.AnnotationSelector)
+}
+
+// describeSelector returns the non-empty fields of the selector.
+func describeSelector(s *kustomize.Selector) string {
+	var fields []string
+	for _, f := range []struct{ name, value string }{
+		{"group", s.Group},
+		{"version", s.Version},
+		{"kind", s.Kind},
+		{"namespace", s.Namespace},
+		{"name", s.Name},
+		{"labelSelector", s.LabelSelector},
+		{"annotationSelector", s.AnnotationSelector},
+	} {
+		if f.value != "" {
+			fields = append(fields, fmt.Sprintf("%s: %s", f.name, f.value))
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+// omitClusterScopedNamespaces removes the namespace from the cluster-scoped
+// objects, which Kustomize sets for the kinds it does not know to be
+// cluster-scoped, e.g. custom resources. Objects of kinds which are not
+// registered yet are left as is.
+func omitClusterScopedNamespaces(mapper apimeta.RESTMapper, objects []*unstructured.Unstructured) {
+	for _, u := range objects {
+		if u.GetNamespace() == "" {
+			continue
+		}
+		gvk := u.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			continue
+		}
+		if mapping.Scope.Name() == apimeta.RESTScopeNameRoot {
+			u.SetNamespace("")
+		}
+	}
+}
+
+// substituteSecretData runs the post build variable substitution on the
+// base64 decoded data values of the given Secret, and encodes the results
+// back into the Secret data.
+func (r *KustomizationReconciler) substituteSecretData(ctx context.Context,
+	u unstructured.Unstructured, substitution *variableSubstitution, res *resource.Resource) error {
+	dataMap := res.GetDataMap()
+	if len(dataMap) == 0 {
+		return nil
+	}
+
+	stringData := make(map[string]interface{}, len(dataMap))
+	for key, value := range dataMap {
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("failed to decode value of key '%s': %w", key, err)
+		}
+		stringData[key] = string(data)
+	}
+
+	// Substitute the decoded values in a copy of the Secret, which retains
+	// the metadata used to opt out of the substitution.
+	tmp := res.DeepCopy()
+	tmpMap, err := tmp.Map()
+	if err != nil {
+		return err
+	}
+	delete(tmpMap, "data")
+	tmpMap["stringData"] = stringData
+	tmpData, err := json.Marshal(tmpMap)
+	if err != nil {
+		return err
+	}
+	if err := tmp.UnmarshalJSON(tmpData); err != nil {
+		return err
+	}
+
+	outRes, err := r.substituteVariables(ctx, u, substitution, tmp)
+	if err != nil || outRes == nil {
+		return err
+	}
+	outMap, err := outRes.Map()
+	if err != nil {
+		return err
+	}
+	field, _, err := unstructured.NestedFieldNoCopy(outMap, "stringData")
+	if err != nil {
+		return err
+	}
+	substituted, _ := field.(map[string]interface{})
+	for key := range dataMap {
+		if value, ok := substituted[key]; ok {
+			dataMap[key] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(value)))
+		}
+	}
+	res.SetDataMap(dataMap)
+	return nil
 }
 
 func (r *KustomizationReconciler) apply(ctx context.Context,
 	manager *ssa.ResourceManager,
 	obj *kustomizev1.Kustomization,
 	revision string,
-	objects []*unstructured.Unstructured) (bool, *ssa.ChangeSet, error) {
+	objects []*unstructured.Unstructured,
+	start time.Time) (bool, *ssa.ChangeSet, error) {
 	log := ctrl.LoggerFrom(ctx)
 
 	if err := ssa.SetNativeKindsDefaults(objects); err != nil {
@@ -706,6 +2145,21 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 	// contains the objects' metadata after apply
 	resultSet := ssa.NewChangeSet()
 
+	// Detect the drifted objects and hold them back from the apply, if the
+	// drift correction is disabled and the current revision and spec were
+	// already applied.
+	// A force apply request applies all the objects, including the drifted
+	// ones held back and the ones which have not drifted.
+	_, forceApply := obj.ForceApplyRequested()
+	driftSet, objects, err := r.holdBackDrift(ctx, manager, obj, revision, objects, applyOpts.ExclusionSelector, forceApply)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, entry := range driftSet.Entries {
+		entry.Action = ssa.SkippedAction
+		resultSet.Add(entry)
+	}
+
 	for _, u := range objects {
 		if decryptor.IsEncryptedSecret(u) {
 			return false, nil,
@@ -724,11 +2178,28 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 
 	}
 
+	// Detect the conflicts with the other managers of the fields, and
+	// resolve them according to the conflict resolution mode before
+	// changing the cluster.
+	var takenOver []fieldConflict
+	if obj.GetConflictResolutionMode() != "" {
+		conflicts, err := r.detectConflicts(ctx, manager, objects, applyOpts)
+		if err != nil {
+			return false, nil, err
+		}
+		if takenOver, err = resolveConflicts(obj, conflicts); err != nil {
+			return false, nil, err
+		}
+	}
+
 	var changeSetLog strings.Builder
 
 	// validate, apply and wait for CRDs and Namespaces to register
 	if len(defStage) > 0 {
 		changeSet, err := manager.ApplyAll(ctx, defStage, applyOpts)
+		if err == nil && forceApply {
+			err = r.forceApplyUnchanged(ctx, manager, defStage, changeSet)
+		}
 		if err != nil {
 			return false, nil, err
 		}
@@ -742,18 +2213,31 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 				}
 			}
 
-			if err := manager.WaitForSet(changeSet.ToObjMetadataSet(), ssa.WaitOptions{
-				Interval: 2 * time.Second,
-				Timeout:  obj.GetTimeout(),
-			}); err != nil {
+			waitOpts, err := applyWaitOptions(obj, start)
+			if err != nil {
 				return false, nil, err
 			}
+			if err := manager.WaitForSet(changeSet.ToObjMetadataSet(), waitOpts); err != nil {
+				return false, nil, err
+			}
+		}
+
+		// wait for the kinds of the custom resources to be served
+		waitOpts, err := applyWaitOptions(obj, start)
+		if err != nil {
+			return false, nil, err
+		}
+		if err := waitForCustomResourceKinds(ctx, manager.Client(), defStage, objects, waitOpts); err != nil {
+			return false, nil, err
 		}
 	}
 
 	// validate, apply and wait for Class type objects to register
 	if len(classStage) > 0 {
 		changeSet, err := manager.ApplyAll(ctx, classStage, applyOpts)
+		if err == nil && forceApply {
+			err = r.forceApplyUnchanged(ctx, manager, classStage, changeSet)
+		}
 		if err != nil {
 			return false, nil, err
 		}
@@ -767,31 +2251,58 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 				}
 			}
 
-			if err := manager.WaitForSet(changeSet.ToObjMetadataSet(), ssa.WaitOptions{
-				Interval: 2 * time.Second,
-				Timeout:  obj.GetTimeout(),
-			}); err != nil {
+			waitOpts, err := applyWaitOptions(obj, start)
+			if err != nil {
+				return false, nil, err
+			}
+			if err := manager.WaitForSet(changeSet.ToObjMetadataSet(), waitOpts); err != nil {
 				return false, nil, err
 			}
 		}
 	}
 
-	// sort by kind, validate and apply all the others objects
-	sort.Sort(ssa.SortableUnstructureds(resStage))
-	if len(resStage) > 0 {
-		changeSet, err := manager.ApplyAll(ctx, resStage, applyOpts)
+	// split all the others objects into the stages of the apply order,
+	// sorted by kind, then validate and apply them stage by stage, waiting
+	// for the objects of a stage to be ready before applying the next one
+	stages, err := orderStages(obj.Spec.ApplyOrder, resStage)
+	if err != nil {
+		return false, nil, err
+	}
+	for i, stage := range stages {
+		changeSet, err := manager.ApplyAll(ctx, stage.objects, applyOpts)
+		if err == nil && forceApply {
+			err = r.forceApplyUnchanged(ctx, manager, stage.objects, changeSet)
+		}
 		if err != nil {
 			return false, nil, fmt.Errorf("%w\n%s", err, changeSetLog.String())
 		}
 		resultSet.Append(changeSet.Entries)
 
 		if changeSet != nil && len(changeSet.Entries) > 0 {
-			log.Info("server-side apply completed", "output", changeSet.ToMap(), "revision", revision)
+			if stage.name != "" {
+				log.Info("server-side apply completed", "output", changeSet.ToMap(), "revision", revision, "stage", stage.name)
+			} else {
+				log.Info("server-side apply completed", "output", changeSet.ToMap(), "revision", revision)
+			}
 			for _, change := range changeSet.Entries {
 				if change.Action != ssa.UnchangedAction {
 					changeSetLog.WriteString(change.String() + "\n")
 				}
 			}
+
+			// the objects of the last stage are checked by the health
+			// assessment
+			if i < len(stages)-1 {
+				waitOpts, err := applyWaitOptions(obj, start)
+				if err != nil {
+					return false, nil, fmt.Errorf("apply stage '%s' failed to become ready: %w\n%s",
+						stage.name, err, changeSetLog.String())
+				}
+				if err := manager.WaitForSet(changeSet.ToObjMetadataSet(), waitOpts); err != nil {
+					return false, nil, fmt.Errorf("apply stage '%s' failed to become ready: %w\n%s",
+						stage.name, err, changeSetLog.String())
+				}
+			}
 		}
 	}
 
@@ -801,18 +2312,58 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 		r.event(obj, revision, eventv1.EventSeverityInfo, applyLog, nil)
 	}
 
+	// report the fields taken over from other managers
+	if len(takenOver) > 0 {
+		msg := fmt.Sprintf("Took over the ownership of %d field(s) from other managers:\n%s",
+			len(takenOver), formatConflicts(takenOver))
+		log.Info(msg, "revision", revision)
+		r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
+	}
+
+	r.reportUncorrectedDrift(ctx, obj, revision, driftSet)
+
 	return applyLog != "", resultSet, nil
 }
 
+// forceApplyUnchanged applies the objects reported as unchanged in the change
+// set of their apply, to take over the ownership of their fields even though
+// they have not drifted. The objects were validated with a dry-run by the
+// apply, their entries are reported as configured.
+func (r *KustomizationReconciler) forceApplyUnchanged(ctx context.Context,
+	manager *ssa.ResourceManager,
+	objects []*unstructured.Unstructured,
+	changeSet *ssa.ChangeSet) error {
+	for i, entry := range changeSet.Entries {
+		if entry.Action != ssa.UnchangedAction {
+			continue
+		}
+		for _, u := range objects {
+			if object.UnstructuredToObjMetadata(u) != entry.ObjMetadata {
+				continue
+			}
+			if err := manager.Client().Patch(ctx, u.DeepCopy(), client.Apply,
+				client.ForceOwnership, client.FieldOwner(r.ControllerName)); err != nil {
+				return fmt.Errorf("%s force apply failed, error: %w", ssa.FmtUnstructured(u), err)
+			}
+			changeSet.Entries[i].Action = ssa.ConfiguredAction
+			break
+		}
+	}
+	return nil
+}
+
+// checkHealth runs the health checks of the apply started at start, within
+// the part of the timeout of the Kustomization left by the apply and prune.
 func (r *KustomizationReconciler) checkHealth(ctx context.Context,
 	manager *ssa.ResourceManager,
-	patcher *patch.SerialPatcher,
+	patcher *statusPatcher,
 	obj *kustomizev1.Kustomization,
 	revision string,
 	isNewRevision bool,
 	drifted bool,
-	objects object.ObjMetadataSet) error {
-	if len(obj.Spec.HealthChecks) == 0 && !obj.Spec.Wait {
+	objects object.ObjMetadataSet,
+	start time.Time) error {
+	if len(obj.Spec.HealthChecks) == 0 && len(obj.Spec.HealthCheckSecrets) == 0 && !obj.Spec.Wait {
 		conditions.Delete(obj, kustomizev1.HealthyCondition)
 		return nil
 	}
@@ -826,7 +2377,7 @@ func (r *KustomizationReconciler) checkHealth(ctx context.Context,
 		}
 	}
 
-	if len(objects) == 0 {
+	if len(objects) == 0 && len(obj.Spec.HealthCheckSecrets) == 0 {
 		conditions.Delete(obj, kustomizev1.HealthyCondition)
 		return nil
 	}
@@ -853,14 +2404,32 @@ func (r *KustomizationReconciler) checkHealth(ctx context.Context,
 		return fmt.Errorf("unable to update the healthy status to progressing, error: %w", err)
 	}
 
-	// Check the health with a default timeout of 30sec shorter than the reconciliation interval.
-	if err := manager.WaitForSet(toCheck, ssa.WaitOptions{
-		Interval: 5 * time.Second,
-		Timeout:  obj.GetTimeout(),
-	}); err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.HealthCheckFailedReason, err.Error())
-		conditions.MarkFalse(obj, kustomizev1.HealthyCondition, kustomizev1.HealthCheckFailedReason, err.Error())
-		return fmt.Errorf("Health check failed after %s: %w", time.Since(checkStart).String(), err)
+	// Check the health within the remaining timeout, the waits do not
+	// expire without a timeout.
+	if remainingTimeout(obj, start) <= 0 {
+		return healthCheckFailed(obj, checkStart, &healthCheckTimeoutError{
+			err: fmt.Errorf("timeout of %s exceeded before the health checks", obj.GetTimeout()),
+		})
+	}
+	if len(toCheck) > 0 {
+		if err := manager.WaitForSet(toCheck, ssa.WaitOptions{
+			Interval: 5 * time.Second,
+			Timeout:  remainingTimeout(obj, start),
+		}); err != nil {
+			// The error of the wait is not typed, it timed out if it did not
+			// return before the timeout.
+			if remainingTimeout(obj, start) <= 0 {
+				err = &healthCheckTimeoutError{err: err}
+			}
+			return healthCheckFailed(obj, checkStart, err)
+		}
+	}
+
+	// Wait for the Secrets to be populated within the remaining timeout.
+	if len(obj.Spec.HealthCheckSecrets) > 0 {
+		if err := waitForSecretData(ctx, manager.Client(), obj, remainingTimeout(obj, start)); err != nil {
+			return healthCheckFailed(obj, checkStart, err)
+		}
 	}
 
 	// Emit recovery event if the previous health check failed.
@@ -870,18 +2439,71 @@ func (r *KustomizationReconciler) checkHealth(ctx context.Context,
 	}
 
 	conditions.MarkTrue(obj, kustomizev1.HealthyCondition, meta.SucceededReason, msg)
-	if err := r.patch(ctx, obj, patcher); err != nil {
+	if err := r.patchProgress(ctx, obj, patcher); err != nil {
 		return fmt.Errorf("unable to update the healthy status to progressing, error: %w", err)
 	}
 
 	return nil
 }
 
+// healthCheckFailed marks the Ready and Healthy conditions after the health
+// checks started at checkStart failed with err. A healthCheckTimeoutError
+// results in a healthCheckDegradedError if the health check timeout mode of
+// the Kustomization is 'degrade'.
+func healthCheckFailed(obj *kustomizev1.Kustomization, checkStart time.Time, err error) error {
+	var timeoutErr *healthCheckTimeoutError
+	if errors.As(err, &timeoutErr) &&
+		obj.GetHealthCheckTimeoutMode() == kustomizev1.DegradeValue {
+		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.HealthCheckDegradedReason, err.Error())
+		conditions.MarkFalse(obj, kustomizev1.HealthyCondition, kustomizev1.HealthCheckDegradedReason, err.Error())
+		return &healthCheckDegradedError{
+			err: fmt.Errorf("Health check degraded after %s: %w", time.Since(checkStart).String(), err),
+		}
+	}
+	conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.HealthCheckFailedReason, err.Error())
+	conditions.MarkFalse(obj, kustomizev1.HealthyCondition, kustomizev1.HealthCheckFailedReason, err.Error())
+	return fmt.Errorf("Health check failed after %s: %w", time.Since(checkStart).String(), err)
+}
+
+// healthCheckTimeoutError is returned by the health checks when they did not
+// pass within the timeout of the Kustomization.
+type healthCheckTimeoutError struct {
+	err error
+}
+
+// Error returns the message of the timeout.
+func (e *healthCheckTimeoutError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error of the timeout.
+func (e *healthCheckTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// healthCheckDegradedError is returned by checkHealth when the health checks
+// timed out and the Kustomization is degraded instead of failed.
+type healthCheckDegradedError struct {
+	err error
+}
+
+// Error returns the message of the health check timeout.
+func (e *healthCheckDegradedError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the health check timeout error.
+func (e *healthCheckDegradedError) Unwrap() error {
+	return e.err
+}
+
 func (r *KustomizationReconciler) prune(ctx context.Context,
 	manager *ssa.ResourceManager,
+	patcher *statusPatcher,
 	obj *kustomizev1.Kustomization,
 	revision string,
-	objects []*unstructured.Unstructured) (bool, error) {
+	objects []*unstructured.Unstructured,
+	start time.Time) (bool, error) {
 	if !obj.Spec.Prune {
 		return false, nil
 	}
@@ -906,12 +2528,155 @@ func (r *KustomizationReconciler) prune(ctx context.Context,
 	if changeSet != nil && len(changeSet.Entries) > 0 {
 		log.Info(fmt.Sprintf("garbage collection completed: %s", changeSet.String()))
 		r.event(obj, revision, eventv1.EventSeverityInfo, changeSet.String(), nil)
+
+		if obj.Spec.PruneWait {
+			if err := r.waitForTermination(ctx, manager, patcher, obj, revision, deletedObjects(objects, changeSet),
+				remainingTimeout(obj, start)); err != nil {
+				return true, err
+			}
+		}
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// waitForTermination blocks until the given objects are deleted from the
+// cluster, or until the given timeout is reached. On timeout, it returns a
+// terminationTimeoutError listing the objects still present along with their
+// pending finalizers.
+func (r *KustomizationReconciler) waitForTermination(ctx context.Context,
+	manager *ssa.ResourceManager,
+	patcher *statusPatcher,
+	obj *kustomizev1.Kustomization,
+	revision string,
+	objects []*unstructured.Unstructured,
+	timeout time.Duration) error {
+	if len(objects) == 0 {
+		return nil
+	}
+
+	// Update status with the reconciliation progress.
+	message := fmt.Sprintf("Waiting for %d pruned resource(s) to be deleted for revision %s with a timeout of %s",
+		len(objects), revision, timeout.String())
+	conditions.MarkReconciling(obj, meta.ProgressingReason, message)
+	if err := r.patch(ctx, obj, patcher); err != nil {
+		return fmt.Errorf("failed to update status, error: %w", err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var pending []*unstructured.Unstructured
+	err := wait.PollImmediateUntilWithContext(timeoutCtx, 2*time.Second, func(ctx context.Context) (bool, error) {
+		pending = pending[:0]
+		for _, o := range objects {
+			existing := &unstructured.Unstructured{}
+			existing.SetGroupVersionKind(o.GroupVersionKind())
+			if err := manager.Client().Get(ctx, client.ObjectKeyFromObject(o), existing); err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return false, err
+			}
+			pending = append(pending, existing)
+		}
+		return len(pending) == 0, nil
+	})
+	if err != nil {
+		if len(pending) > 0 && timeoutCtx.Err() != nil {
+			return &terminationTimeoutError{timeout: timeout, objects: pending}
+		}
+		return fmt.Errorf("failed to wait for pruned resources to be deleted: %w", err)
+	}
+	return nil
+}
+
+// terminationTimeoutError is returned by waitForTermination when the pruned
+// objects are not deleted within the timeout.
+type terminationTimeoutError struct {
+	timeout time.Duration
+	objects []*unstructured.Unstructured
+}
+
+// Error returns the list of objects still present and their finalizers.
+func (e *terminationTimeoutError) Error() string {
+	var pending []string
+	for _, o := range e.objects {
+		entry := ssa.FmtUnstructured(o)
+		if finalizers := o.GetFinalizers(); len(finalizers) > 0 {
+			entry += fmt.Sprintf(" (finalizers: %s)", strings.Join(finalizers, ", "))
+		}
+		pending = append(pending, entry)
+	}
+	return fmt.Sprintf("timeout waiting %s for pruned resources to be deleted: [%s]",
+		e.timeout.String(), strings.Join(pending, ", "))
+}
+
+// deletedObjects returns the objects for which the changeSet contains a
+// deleted entry.
+func deletedObjects(objects []*unstructured.Unstructured, changeSet *ssa.ChangeSet) []*unstructured.Unstructured {
+	var result []*unstructured.Unstructured
+	for _, o := range objects {
+		id := object.UnstructuredToObjMetadata(o)
+		for _, entry := range changeSet.Entries {
+			if entry.Action == ssa.DeletedAction && entry.ObjMetadata == id {
+				result = append(result, o)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// getImpersonator returns the Impersonator used to build the Kubernetes
+// client for the apply, prune and health check operations.
+// Impersonating a service account from a different namespace than the one of
+// the Kustomization is denied unless enabled at the controller level.
+// The values decrypted from an encrypted kubeconfig Secret are recorded in
+// the redactor, if not nil.
+func (r *KustomizationReconciler) getImpersonator(obj *kustomizev1.Kustomization,
+	redactor *decryptor.Redactor) (*runtimeClient.Impersonator, error) {
+	namespace := obj.GetNamespace()
+	if saNamespace := obj.Spec.ServiceAccountNamespace; saNamespace != "" && saNamespace != namespace {
+		if obj.Spec.ServiceAccountName == "" {
+			return nil, fmt.Errorf("spec.serviceAccountNamespace can't be used without spec.serviceAccountName")
+		}
+		if !r.AllowCrossNamespaceImpersonation {
+			return nil, acl.AccessDeniedError(
+				fmt.Sprintf("can't impersonate service account '%s/%s', cross-namespace impersonation is disabled",
+					saNamespace, obj.Spec.ServiceAccountName))
+		}
+		// The impersonator looks up the kubeconfig Secret in the namespace
+		// of the service account.
+		if obj.Spec.KubeConfig != nil {
+			return nil, fmt.Errorf("spec.serviceAccountNamespace can't be used in combination with spec.kubeConfig")
+		}
+		namespace = saNamespace
+	}
+
+	// The kubeconfig Secret may be encrypted with the decryption keys of the
+	// Kustomization, in which case it is decrypted before the client of the
+	// remote cluster is built.
+	var kubeClient client.Client = r.Client
+	if obj.Spec.KubeConfig != nil && obj.Spec.Decryption != nil {
+		kubeClient = newKubeConfigDecryptingClient(r.Client, obj, namespace, func(ctx context.Context, dec *decryptor.Decryptor) {
+			r.configureDecryptor(ctx, obj, dec, redactor)
+		})
+	}
+
+	return runtimeClient.NewImpersonator(
+		kubeClient,
+		r.StatusPoller,
+		r.PollingOpts,
+		obj.Spec.KubeConfig,
+		r.KubeConfigOpts,
+		r.DefaultServiceAccount,
+		obj.Spec.ServiceAccountName,
+		namespace,
+	), nil
+}
+
 func (r *KustomizationReconciler) finalize(ctx context.Context,
 	obj *kustomizev1.Kustomization) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
@@ -921,17 +2686,13 @@ func (r *KustomizationReconciler) finalize(ctx context.Context,
 		obj.Status.Inventory.Entries != nil {
 		objects, _ := inventory.List(obj.Status.Inventory)
 
-		impersonation := runtimeClient.NewImpersonator(
-			r.Client,
-			r.StatusPoller,
-			r.PollingOpts,
-			obj.Spec.KubeConfig,
-			r.KubeConfigOpts,
-			r.DefaultServiceAccount,
-			obj.Spec.ServiceAccountName,
-			obj.GetNamespace(),
-		)
-		if impersonation.CanImpersonate(ctx) {
+		// The kubeconfig Secret may be encrypted with the inherited keys.
+		decObj, err := r.withDefaultDecryption(ctx, obj)
+		if err != nil {
+			decObj = obj
+		}
+		impersonation, err := r.getImpersonator(decObj, nil)
+		if err == nil && impersonation.CanImpersonate(ctx) {
 			kubeClient, _, err := impersonation.GetClient(ctx)
 			if err != nil {
 				return ctrl.Result{}, err
@@ -963,8 +2724,11 @@ func (r *KustomizationReconciler) finalize(ctx context.Context,
 			}
 		} else {
 			// when the account to impersonate is gone, log the stale objects and continue with the finalization
+			if err == nil {
+				err = fmt.Errorf("skiping pruning, failed to find account to impersonate")
+			}
 			msg := fmt.Sprintf("unable to prune objects: \n%s", ssa.FmtUnstructuredList(objects))
-			log.Error(fmt.Errorf("skiping pruning, failed to find account to impersonate"), msg)
+			log.Error(err, msg)
 			r.event(obj, obj.Status.LastAppliedRevision, eventv1.EventSeverityError, msg, nil)
 		}
 	}
@@ -999,9 +2763,34 @@ func (r *KustomizationReconciler) event(obj *kustomizev1.Kustomization,
 	r.EventRecorder.AnnotatedEventf(obj, metadata, eventtype, reason, msg)
 }
 
+// recordPhaseDurations sets the durations measured by the phaseTimer in the
+// object status and records them as metrics. It is a no-op if no phase was
+// started, e.g. because the object is suspended or its dependencies are not
+// ready.
+func (r *KustomizationReconciler) recordPhaseDurations(obj *kustomizev1.Kustomization,
+	phaseTimer *intmetrics.PhaseTimer) {
+	durations := phaseTimer.Durations()
+	if len(durations) == 0 {
+		return
+	}
+
+	ref := corev1.ObjectReference{
+		Kind:      kustomizev1.KustomizationKind,
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+	}
+	obj.Status.LastPhaseDurations = make(map[string]metav1.Duration, len(durations))
+	for phase, d := range durations {
+		obj.Status.LastPhaseDurations[phase] = metav1.Duration{Duration: d}
+		if r.ExtendedMetrics != nil {
+			r.ExtendedMetrics.RecordPhaseDuration(ref, phase, d)
+		}
+	}
+}
+
 func (r *KustomizationReconciler) finalizeStatus(ctx context.Context,
 	obj *kustomizev1.Kustomization,
-	patcher *patch.SerialPatcher) error {
+	patcher *statusPatcher) error {
 	// Set the value of the reconciliation request in status.
 	if v, ok := meta.ReconcileAnnotationValue(obj.GetAnnotations()); ok {
 		obj.Status.LastHandledReconcileAt = v
@@ -1015,8 +2804,10 @@ func (r *KustomizationReconciler) finalizeStatus(ctx context.Context,
 	}
 
 	// Set the Reconciling reason to ProgressingWithRetry if the
-	// reconciliation has failed.
+	// reconciliation has failed. A degraded Kustomization remains
+	// progressing, as it is not retried with backoff.
 	if conditions.IsFalse(obj, meta.ReadyCondition) &&
+		conditions.GetReason(obj, meta.ReadyCondition) != kustomizev1.HealthCheckDegradedReason &&
 		conditions.Has(obj, meta.ReconcilingCondition) {
 		rc := conditions.Get(obj, meta.ReconcilingCondition)
 		rc.Reason = meta.ProgressingWithRetryReason
@@ -1029,12 +2820,17 @@ func (r *KustomizationReconciler) finalizeStatus(ctx context.Context,
 
 func (r *KustomizationReconciler) patch(ctx context.Context,
 	obj *kustomizev1.Kustomization,
-	patcher *patch.SerialPatcher) (retErr error) {
+	patcher *statusPatcher) (retErr error) {
 
 	// Configure the runtime patcher.
 	patchOpts := []patch.Option{}
 	ownedConditions := []string{
+		kustomizev1.DecryptionFailedCondition,
+		kustomizev1.DecryptionKeyExpiringCondition,
+		kustomizev1.DriftDetectedCondition,
 		kustomizev1.HealthyCondition,
+		kustomizev1.InsufficientPermissionsCondition,
+		kustomizev1.UnsupportedAPIsCondition,
 		meta.ReadyCondition,
 		meta.ReconcilingCondition,
 		meta.StalledCondition,
@@ -1055,6 +2851,31 @@ func (r *KustomizationReconciler) patch(ctx context.Context,
 			return retErr
 		}
 	}
+	patcher.patched()
 
 	return nil
 }
+
+// patchProgress patches the progress of the reconciliation reported by the
+// conditions if the progress interval of the patcher elapsed since the last
+// patch. Otherwise, the progress is written with the next patch, e.g. at the
+// next checkpoint or once the reconciliation completed, to not write the
+// status of large Kustomizations repeatedly within short intervals.
+func (r *KustomizationReconciler) patchProgress(ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	patcher *statusPatcher) error {
+	if !patcher.progressDue() {
+		return nil
+	}
+	return r.patch(ctx, obj, patcher)
+}
+
+// decryptObserver returns the decryptor.DecryptObserver recording the
+// requests to decrypt the data keys in the ExtendedMetrics, or nil if the
+// ExtendedMetrics are not configured.
+func (r *KustomizationReconciler) decryptObserver() decryptor.DecryptObserver {
+	if r.ExtendedMetrics == nil {
+		return nil
+	}
+	return r.ExtendedMetrics.RecordDecryption
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/ssa"
+)
+
+// customResourceDefinitionKind is the kind of the CustomResourceDefinition
+// objects.
+const customResourceDefinitionKind = "CustomResourceDefinition"
+
+// customResourceKinds returns the kinds defined by the given CRDs of which
+// instances are part of the given objects, with the versions of the
+// instances. The versions which are not served according to the CRDs are
+// omitted, the apply of their instances is left to fail.
+func customResourceKinds(crds, objects []*unstructured.Unstructured) map[schema.GroupKind][]string {
+	served := make(map[schema.GroupVersionKind]struct{})
+	for _, crd := range crds {
+		if crd.GetKind() != customResourceDefinitionKind {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+		kind, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+		versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+		for _, v := range versions {
+			version, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _, _ := unstructured.NestedString(version, "name")
+			if ok, _, _ := unstructured.NestedBool(version, "served"); ok {
+				served[schema.GroupVersionKind{Group: group, Version: name, Kind: kind}] = struct{}{}
+			}
+		}
+	}
+	if len(served) == 0 {
+		return nil
+	}
+
+	kinds := make(map[schema.GroupKind][]string)
+	seen := make(map[schema.GroupVersionKind]struct{})
+	for _, u := range objects {
+		gvk := u.GroupVersionKind()
+		if _, ok := served[gvk]; !ok {
+			continue
+		}
+		if _, ok := seen[gvk]; ok {
+			continue
+		}
+		seen[gvk] = struct{}{}
+		kinds[gvk.GroupKind()] = append(kinds[gvk.GroupKind()], gvk.Version)
+	}
+	return kinds
+}
+
+// waitForCustomResourceKinds waits for the kinds defined by the CRDs to be
+// served, i.e. for the CRDs to be established and their kinds to be known to
+// the RESTMapper of the client, before the instances of these kinds which
+// are part of the objects are applied. Without this explicit stage, applying
+// a CRD and its instances in the same reconciliation would depend on the
+// discovery information of the client to be refreshed in time.
+func waitForCustomResourceKinds(ctx context.Context, c client.Client,
+	crds, objects []*unstructured.Unstructured, opts ssa.WaitOptions) error {
+	kinds := customResourceKinds(crds, objects)
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	pending := make([]string, 0, len(kinds))
+	err := wait.PollImmediate(opts.Interval, opts.Timeout, func() (bool, error) {
+		pending = pending[:0]
+		for gk, versions := range kinds {
+			if !isKindServed(c.RESTMapper(), gk, versions) {
+				pending = append(pending, gk.String())
+			}
+		}
+		return len(pending) == 0, ctx.Err()
+	})
+	if err != nil {
+		sort.Strings(pending)
+		return fmt.Errorf("the custom resource kind(s) %s are not served after their CustomResourceDefinition(s) were applied: %w",
+			strings.Join(pending, ", "), err)
+	}
+	return nil
+}
+
+// isKindServed returns if the RESTMapper has a mapping for all the versions
+// of the kind. The dynamic RESTMapper of the client reloads the discovery
+// information on a missing kind, within the limits of its rate limiter.
+func isKindServed(mapper apimeta.RESTMapper, gk schema.GroupKind, versions []string) bool {
+	for _, v := range versions {
+		if _, err := mapper.RESTMapping(gk, v); err != nil {
+			return false
+		}
+	}
+	return true
+}
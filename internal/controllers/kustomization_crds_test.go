@@ -0,0 +1,239 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/ssa"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// crdManifest returns a namespaced CRD for the kind in the group, with the
+// versions v1 (served) and v1alpha1 (not served).
+func crdManifest(group, kind string) string {
+	plural := strings.ToLower(kind) + "s"
+	return fmt.Sprintf(`---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: %[3]s.%[1]s
+spec:
+  group: %[1]s
+  names:
+    kind: %[2]s
+    listKind: %[2]sList
+    plural: %[3]s
+    singular: %[4]s
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        x-kubernetes-preserve-unknown-fields: true
+  - name: v1alpha1
+    served: false
+    storage: false
+    schema:
+      openAPIV3Schema:
+        type: object
+        x-kubernetes-preserve-unknown-fields: true
+`, group, kind, plural, strings.ToLower(kind))
+}
+
+func TestCustomResourceKinds(t *testing.T) {
+	g := NewWithT(t)
+
+	objects, err := ssa.ReadObjects(strings.NewReader(crdManifest("example.com", "Widget") + `---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: first
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: second
+---
+apiVersion: example.com/v1alpha1
+kind: Widget
+metadata:
+  name: unserved
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(customResourceKinds(objects[:1], objects)).To(Equal(map[schema.GroupKind][]string{
+		{Group: "example.com", Kind: "Widget"}: {"v1"},
+	}))
+	g.Expect(customResourceKinds(nil, objects)).To(BeEmpty())
+	g.Expect(customResourceKinds(objects[:1], objects[4:])).To(BeEmpty())
+}
+
+func TestWaitForCustomResourceKinds(t *testing.T) {
+	objects, err := ssa.ReadObjects(strings.NewReader(crdManifest("example.com", "Widget") + `---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ssa.WaitOptions{Interval: 10 * time.Millisecond, Timeout: 100 * time.Millisecond}
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+
+	t.Run("fails when the kind is not served", func(t *testing.T) {
+		g := NewWithT(t)
+
+		mapper := apimeta.NewDefaultRESTMapper(nil)
+		c := fake.NewClientBuilder().WithRESTMapper(mapper).Build()
+
+		err := waitForCustomResourceKinds(context.Background(), c, objects[:1], objects, opts)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(HavePrefix("the custom resource kind(s) Widget.example.com are not served"))
+	})
+
+	t.Run("succeeds when the kind is served", func(t *testing.T) {
+		g := NewWithT(t)
+
+		mapper := apimeta.NewDefaultRESTMapper(nil)
+		mapper.Add(gvk, apimeta.RESTScopeNamespace)
+		c := fake.NewClientBuilder().WithRESTMapper(mapper).Build()
+
+		g.Expect(waitForCustomResourceKinds(context.Background(), c, objects[:1], objects, opts)).To(Succeed())
+	})
+
+	t.Run("does not wait without instances", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := fake.NewClientBuilder().WithRESTMapper(apimeta.NewDefaultRESTMapper(nil)).Build()
+
+		g.Expect(waitForCustomResourceKinds(context.Background(), c, objects[:1], objects[:1], opts)).To(Succeed())
+	})
+}
+
+func TestKustomizationReconciler_CRDsBeforeInstances(t *testing.T) {
+	g := NewWithT(t)
+	id := "crds-" + randStringRunes(5)
+	revision := "v1.0.0"
+	group := id + ".example.com"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	// The instance sorts before the CRD by file name.
+	manifests := []testserver.File{
+		{
+			Name: "a-widget.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: %s/v1
+kind: Widget
+metadata:
+  name: widget
+  namespace: %s
+spec:
+  size: 1
+`, group, id),
+		},
+		{
+			Name: "b-crd.yaml",
+			Body: crdManifest(group, "Widget"),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("crds-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("crds-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			Prune:    true,
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	t.Run("applies the instance", func(t *testing.T) {
+		g := NewWithT(t)
+
+		widget := &unstructured.Unstructured{}
+		widget.SetGroupVersionKind(schema.GroupVersionKind{Group: group, Version: "v1", Kind: "Widget"})
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "widget", Namespace: id}, widget)).To(Succeed())
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(2))
+	})
+
+	t.Run("applies in a single reconciliation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		events := getEvents(resultK.GetName(), nil)
+		for _, e := range events {
+			g.Expect(e.Type).To(Equal(corev1.EventTypeNormal), e.Message)
+		}
+		var applied bytes.Buffer
+		for _, e := range events {
+			applied.WriteString(e.Message + "\n")
+		}
+		g.Expect(applied.String()).To(ContainSubstring(fmt.Sprintf("Widget/%s/widget created", id)))
+	})
+}
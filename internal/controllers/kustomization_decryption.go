@@ -0,0 +1,103 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+// withDefaultDecryption returns the Kustomization with the decryption it is
+// reconciled with. When the Kustomization does not define spec.decryption,
+// and its namespace contains the DefaultDecryptionSecret of the reconciler,
+// it inherits the SOPS decryption with the keys of this Secret. The returned
+// object is then a copy of the Kustomization, which must only be used to
+// decrypt, as changes to it are not persisted.
+func (r *KustomizationReconciler) withDefaultDecryption(ctx context.Context,
+	obj *kustomizev1.Kustomization) (*kustomizev1.Kustomization, error) {
+	if obj.Spec.Decryption != nil || r.DefaultDecryptionSecret == "" {
+		return obj, nil
+	}
+
+	log := ctrl.LoggerFrom(ctx)
+	secretName := types.NamespacedName{Namespace: obj.GetNamespace(), Name: r.DefaultDecryptionSecret}
+	var secret corev1.Secret
+	if err := r.Get(ctx, secretName, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.V(1).Info(fmt.Sprintf("No default decryption Secret '%s' found, decryption is disabled", secretName))
+			return obj, nil
+		}
+		return nil, fmt.Errorf("failed to get the default decryption Secret '%s': %w", secretName, err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Inheriting the decryption with the keys of the default decryption Secret '%s'", secretName))
+	inherited := obj.DeepCopy()
+	inherited.Spec.Decryption = &kustomizev1.Decryption{
+		Provider:  decryptor.DecryptionProviderSOPS,
+		SecretRef: &meta.LocalObjectReference{Name: r.DefaultDecryptionSecret},
+	}
+	return inherited, nil
+}
+
+// configureDecryptor configures the Decryptor of the Kustomization obj with
+// the decryption settings and caches of the reconciler, for the build and the
+// kubeconfig Secret to be decrypted alike. The decrypted values are recorded
+// in the redactor.
+func (r *KustomizationReconciler) configureDecryptor(ctx context.Context, obj *kustomizev1.Kustomization,
+	dec *decryptor.Decryptor, redactor *decryptor.Redactor) {
+	log := ctrl.LoggerFrom(ctx)
+	dec.SetRedactor(redactor)
+	dec.SetAzureConfigCache(r.azureConfigs)
+	dec.SetKMSClientCache(r.kmsClients)
+	dec.SetAzureLogger(log)
+	dec.SetAzureLimiter(r.azureLimiter)
+	dec.SetAzureBreaker(r.azureBreaker)
+	dec.SetAzureRetryPolicy(r.azureRetryPolicy)
+	dec.SetAzureTransport(r.azureTransport)
+	dec.SetAzureTokenCache(r.azureTokens)
+	dec.SetAzureRewriteVaultDNSSuffix(r.azureRewriteVaultSuffix)
+	dec.SetAzureRecoverDeletedKeys(r.azureRecoverDeleted)
+	dec.SetAzureResolveLatestVersion(r.azureResolveLatest)
+	dec.SetAzureDisableDefaultCredential(r.azureNoDefaultCredential)
+	dec.SetAzureAllowWorkloadIdentity(r.azureAllowWorkloadIdentity)
+	dec.SetVaultKubernetesAuth(r.vaultTokens, r.vaultServiceAccount(obj))
+	dec.SetAzureDataKeyCache(r.azureDataKeys)
+	dec.SetAzureAllowedAlgorithms(r.azureAllowedAlgorithms)
+	dec.SetAzureDefaultAlgorithm(r.azureDefaultAlgorithm)
+	dec.SetAzureAuthFileDir(r.azureAuthFileDir)
+	dec.SetDecryptObserver(r.decryptObserver())
+	dec.SetContext(ctx)
+	dec.LimitFileSize(int64(r.maxArtifactSize))
+
+	if r.AllowUnsupportedSOPSKeyProviders {
+		dec.AllowUnsupportedKeyProviders(func(msg string) {
+			log.Info(msg)
+		})
+	}
+	if r.AzureKeyExpiryWindow > 0 {
+		dec.TrackAzureKeyExpiry(r.azureKeyExpiries)
+	}
+}
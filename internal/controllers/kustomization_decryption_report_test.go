@@ -0,0 +1,178 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_DecryptionReportOnly(t *testing.T) {
+	g := NewWithT(t)
+	id := "sops-report-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	ageSecret, err := os.ReadFile("testdata/sops/secret.age.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+	// The PGP key is not provided, which makes the decryption fail.
+	pgpSecret, err := os.ReadFile("testdata/sops/secret.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	manifests := []testserver.File{
+		{
+			Name: "age.yaml",
+			Body: string(ageSecret),
+		},
+		{
+			Name: "pgp.yaml",
+			Body: string(pgpSecret) + `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: pgp-config
+data:
+  key: value
+`,
+		},
+		{
+			Name: "config.yaml",
+			Body: `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: plain-config
+data:
+  key: value
+`,
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("sops-report-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ageKey, err := os.ReadFile("testdata/sops/age.txt")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	sopsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-" + randStringRunes(5),
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"age.agekey": string(ageKey),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), sopsSecret)).To(Succeed())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sops-report-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval:        metav1.Duration{Duration: reconciliationInterval},
+			Path:            "./",
+			TargetNamespace: id,
+			Prune:           true,
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider: "sops",
+				SecretRef: &meta.LocalObjectReference{
+					Name: sopsSecret.Name,
+				},
+				ReportOnly: true,
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	t.Run("applies the resources of the other files", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var secret corev1.Secret
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "sops-age", Namespace: id}, &secret)).To(Succeed())
+		g.Expect(secret.Data["secret"]).To(Equal([]byte(`my-sops-age-secret`)))
+
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "plain-config", Namespace: id}, &cm)).To(Succeed())
+	})
+
+	t.Run("does not apply the resources of the failed file", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var secret corev1.Secret
+		err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "sops-pgp", Namespace: id}, &secret)
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		var cm corev1.ConfigMap
+		err = k8sClient.Get(context.Background(), types.NamespacedName{Name: "pgp-config", Namespace: id}, &cm)
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	t.Run("reports the failure", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Expect(conditions.IsTrue(resultK, kustomizev1.DecryptionFailedCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(resultK, kustomizev1.DecryptionFailedCondition)).To(Equal(kustomizev1.DecryptionFailedReason))
+		msg := conditions.GetMessage(resultK, kustomizev1.DecryptionFailedCondition)
+		g.Expect(msg).To(HavePrefix("Decryption failed for 1 object(s), skipped applying "))
+		g.Expect(msg).To(ContainSubstring(fmt.Sprintf("Secret/%s/sops-pgp", id)))
+		g.Expect(msg).To(ContainSubstring(fmt.Sprintf("ConfigMap/%s/pgp-config", id)))
+		g.Expect(msg).ToNot(ContainSubstring("plain-config"))
+		g.Expect(msg).To(ContainSubstring("decryption failed for 'sops-pgp': "))
+		g.Expect(msg).To(HaveSuffix("(from 'pgp.yaml')"))
+
+		events := getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision})
+		g.Expect(events).To(ContainElement(WithTransform(func(e corev1.Event) string { return e.Message }, Equal(msg))))
+	})
+}
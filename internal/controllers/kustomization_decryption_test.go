@@ -0,0 +1,133 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+func TestKustomizationReconciler_withDefaultDecryption(t *testing.T) {
+	defaultSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-default", Namespace: "apps"},
+		Data:       map[string][]byte{"sops.azure-kv": []byte("{}")},
+	}
+	c := fake.NewClientBuilder().WithObjects(defaultSecret).Build()
+
+	tests := []struct {
+		name          string
+		defaultSecret string
+		namespace     string
+		decryption    *kustomizev1.Decryption
+		want          *kustomizev1.Decryption
+	}{
+		{
+			name:          "inherits the default decryption of the namespace",
+			defaultSecret: "sops-default",
+			namespace:     "apps",
+			want: &kustomizev1.Decryption{
+				Provider:  decryptor.DecryptionProviderSOPS,
+				SecretRef: &meta.LocalObjectReference{Name: "sops-default"},
+			},
+		},
+		{
+			name:          "keeps the decryption of the Kustomization",
+			defaultSecret: "sops-default",
+			namespace:     "apps",
+			decryption: &kustomizev1.Decryption{
+				Provider:  decryptor.DecryptionProviderSOPS,
+				SecretRef: &meta.LocalObjectReference{Name: "sops-keys"},
+			},
+			want: &kustomizev1.Decryption{
+				Provider:  decryptor.DecryptionProviderSOPS,
+				SecretRef: &meta.LocalObjectReference{Name: "sops-keys"},
+			},
+		},
+		{
+			name:          "does not inherit without a Secret in the namespace",
+			defaultSecret: "sops-default",
+			namespace:     "other",
+		},
+		{
+			name:      "does not inherit without a default",
+			namespace: "apps",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := &KustomizationReconciler{
+				Client:                  c,
+				DefaultDecryptionSecret: tt.defaultSecret,
+			}
+			obj := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: tt.namespace},
+				Spec:       kustomizev1.KustomizationSpec{Decryption: tt.decryption},
+			}
+
+			got, err := r.withDefaultDecryption(context.Background(), obj)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got.Spec.Decryption).To(Equal(tt.want))
+			g.Expect(got.GetName()).To(Equal(obj.GetName()))
+			g.Expect(obj.Spec.Decryption).To(Equal(tt.decryption), "the Kustomization must not be modified")
+		})
+	}
+}
+
+func Test_recordKeyDecryptions(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now().Truncate(time.Second)
+	obj := &kustomizev1.Kustomization{}
+	obj.Status.LastKeyDecryptions = map[string]metav1.Time{
+		"https://example.vault.azure.net/keys/old/1234":     metav1.NewTime(now.Add(-time.Hour)),
+		"https://example.vault.azure.net/keys/current/1234": metav1.NewTime(now.Add(-time.Hour)),
+	}
+
+	recordKeyDecryptions(obj, nil)
+	g.Expect(obj.Status.LastKeyDecryptions).To(HaveLen(2))
+
+	recordKeyDecryptions(obj, map[string]time.Time{
+		"https://example.vault.azure.net/keys/current/1234": now,
+	})
+	g.Expect(obj.Status.LastKeyDecryptions).To(Equal(map[string]metav1.Time{
+		"https://example.vault.azure.net/keys/old/1234":     metav1.NewTime(now.Add(-time.Hour)),
+		"https://example.vault.azure.net/keys/current/1234": metav1.NewTime(now),
+	}))
+
+	// The oldest keys are removed above the maximum.
+	decryptions := make(map[string]time.Time)
+	for i := 0; i < maxLastKeyDecryptions-1; i++ {
+		decryptions[fmt.Sprintf("https://example.vault.azure.net/keys/key-%d/1234", i)] = now
+	}
+	recordKeyDecryptions(obj, decryptions)
+	g.Expect(obj.Status.LastKeyDecryptions).To(HaveLen(maxLastKeyDecryptions))
+	g.Expect(obj.Status.LastKeyDecryptions).ToNot(HaveKey("https://example.vault.azure.net/keys/old/1234"))
+	g.Expect(obj.Status.LastKeyDecryptions).To(HaveKey("https://example.vault.azure.net/keys/current/1234"))
+}
@@ -228,3 +228,96 @@ func TestKustomizationReconciler_Decryptor(t *testing.T) {
 		g.Expect(events[0].Message).ShouldNot(ContainSubstring("configured"))
 	})
 }
+
+func TestKustomizationReconciler_DecryptorSubstituteData(t *testing.T) {
+	g := NewWithT(t)
+	id := "sops-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	artifactName := "sops-" + randStringRunes(5)
+	artifactChecksum, err := testServer.ArtifactFromDir("testdata/sops-varsub", artifactName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("sops-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifactName, "main/"+artifactChecksum)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ageKey, err := os.ReadFile("testdata/sops/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	sopsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-" + randStringRunes(5),
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"age.agekey": string(ageKey),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), sopsSecret)).To(Succeed())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sops-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider: "sops",
+				SecretRef: &meta.LocalObjectReference{
+					Name: sopsSecret.Name,
+				},
+			},
+			PostBuild: &kustomizev1.PostBuild{
+				Substitute: map[string]string{"cluster_region": "eu-central-1"},
+			},
+			TargetNamespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	secretKey := types.NamespacedName{Name: "sops-varsub", Namespace: id}
+
+	t.Run("keeps vars in decrypted data when disabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() bool {
+			var obj kustomizev1.Kustomization
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), &obj)
+			return obj.Status.LastAppliedRevision == "main/"+artifactChecksum
+		}, timeout, time.Second).Should(BeTrue())
+
+		var secret corev1.Secret
+		g.Expect(k8sClient.Get(context.Background(), secretKey, &secret)).To(Succeed())
+		g.Expect(string(secret.Data["region"])).To(Equal("region-${cluster_region}"))
+	})
+
+	t.Run("substitutes vars in decrypted data when enabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var obj kustomizev1.Kustomization
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), &obj)).To(Succeed())
+		patch := client.MergeFrom(obj.DeepCopy())
+		obj.Spec.PostBuild.SubstituteDecryptedData = true
+		g.Expect(k8sClient.Patch(context.Background(), &obj, patch)).To(Succeed())
+
+		g.Eventually(func() string {
+			var secret corev1.Secret
+			_ = k8sClient.Get(context.Background(), secretKey, &secret)
+			return string(secret.Data["region"])
+		}, timeout, time.Second).Should(Equal("region-eu-central-1"))
+	})
+}
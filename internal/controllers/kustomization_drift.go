@@ -0,0 +1,149 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/ssa"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+// reportFrozenDrift detects the drift of the objects of a frozen
+// Kustomization from their in-cluster state, and reports it in the
+// DriftDetected condition and with a warning event, without applying or
+// pruning any object. The Ready condition is marked as unknown, as the
+// revision is not applied.
+func (r *KustomizationReconciler) reportFrozenDrift(ctx context.Context,
+	manager *ssa.ResourceManager,
+	obj *kustomizev1.Kustomization,
+	revision string,
+	objects []*unstructured.Unstructured) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	driftSet, _, err := r.detectDrift(ctx, manager, objects, map[string]string{
+		fmt.Sprintf("%s/reconcile", kustomizev1.GroupVersion.Group): kustomizev1.DisabledValue,
+	})
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Reconciliation is frozen, no drift detected for revision %s", revision)
+	if len(driftSet.Entries) > 0 {
+		driftMsg := fmt.Sprintf("Drift detected for %d object(s), reconciliation is frozen:\n%s",
+			len(driftSet.Entries), formatDrift(driftSet))
+		conditions.MarkTrue(obj, kustomizev1.DriftDetectedCondition, kustomizev1.DriftDetectedReason, driftMsg)
+		r.event(obj, revision, eventv1.EventSeverityError, driftMsg, nil)
+		msg = fmt.Sprintf("Reconciliation is frozen, drift detected for %d object(s) of revision %s",
+			len(driftSet.Entries), revision)
+	} else {
+		conditions.Delete(obj, kustomizev1.DriftDetectedCondition)
+	}
+
+	log.Info(msg)
+	conditions.MarkUnknown(obj, meta.ReadyCondition, kustomizev1.FrozenReason, msg)
+	conditions.Delete(obj, meta.ReconcilingCondition)
+	return nil
+}
+
+// holdBackDrift detects the objects which drifted from their in-cluster state
+// when the drift is not corrected, i.e. the drift correction is disabled, the
+// revision and the spec were already applied, and no force apply is
+// requested. It returns the change set of the drifted objects, which are held
+// back from the apply, and the remaining objects to apply.
+func (r *KustomizationReconciler) holdBackDrift(ctx context.Context,
+	manager *ssa.ResourceManager,
+	obj *kustomizev1.Kustomization,
+	revision string,
+	objects []*unstructured.Unstructured,
+	exclusions map[string]string,
+	forceApply bool) (*ssa.ChangeSet, []*unstructured.Unstructured, error) {
+	if forceApply || obj.GetDriftDetectionMode() == kustomizev1.EnabledValue ||
+		obj.Status.LastAppliedRevision != revision ||
+		obj.Status.ObservedGeneration != obj.Generation {
+		return ssa.NewChangeSet(), objects, nil
+	}
+	return r.detectDrift(ctx, manager, objects, exclusions)
+}
+
+// reportUncorrectedDrift reports the objects held back from the apply by
+// holdBackDrift in the DriftDetected condition and with a warning event when
+// the drift detection mode is warn, and removes the condition otherwise.
+func (r *KustomizationReconciler) reportUncorrectedDrift(ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	revision string,
+	driftSet *ssa.ChangeSet) {
+	if obj.GetDriftDetectionMode() != kustomizev1.WarnValue || len(driftSet.Entries) == 0 {
+		conditions.Delete(obj, kustomizev1.DriftDetectedCondition)
+		return
+	}
+
+	msg := fmt.Sprintf("Drift detected for %d object(s), correction is disabled:\n%s",
+		len(driftSet.Entries), formatDrift(driftSet))
+	ctrl.LoggerFrom(ctx).Info(msg, "revision", revision)
+	conditions.MarkTrue(obj, kustomizev1.DriftDetectedCondition, kustomizev1.DriftDetectedReason, msg)
+	r.event(obj, revision, eventv1.EventSeverityError, msg, nil)
+}
+
+// formatDrift returns the entries of the drifted objects, one per line.
+func formatDrift(driftSet *ssa.ChangeSet) string {
+	var driftLog strings.Builder
+	for _, entry := range driftSet.Entries {
+		driftLog.WriteString(entry.String() + "\n")
+	}
+	return strings.TrimSuffix(driftLog.String(), "\n")
+}
+
+// detectDrift compares the given objects with their in-cluster state using
+// server-side apply dry-runs. It returns the change set of the objects which
+// would be created or configured by an apply, and the remaining objects.
+func (r *KustomizationReconciler) detectDrift(ctx context.Context,
+	manager *ssa.ResourceManager,
+	objects []*unstructured.Unstructured,
+	exclusions map[string]string) (*ssa.ChangeSet, []*unstructured.Unstructured, error) {
+	driftSet := ssa.NewChangeSet()
+	var remaining []*unstructured.Unstructured
+	for _, u := range objects {
+		// encrypted secrets are rejected before the apply
+		if decryptor.IsEncryptedSecret(u) {
+			remaining = append(remaining, u)
+			continue
+		}
+
+		entry, _, _, err := manager.Diff(ctx, u, ssa.DiffOptions{Exclusions: exclusions})
+		if err != nil {
+			return nil, nil, err
+		}
+		switch entry.Action {
+		case ssa.CreatedAction, ssa.ConfiguredAction:
+			driftSet.Add(*entry)
+		default:
+			remaining = append(remaining, u)
+		}
+	}
+	return driftSet, remaining, nil
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_DriftDetectionWarn(t *testing.T) {
+	g := NewWithT(t)
+	id := "drift-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := []testserver.File{
+		{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+data:
+  key: value
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("drift-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("drift-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			DriftDetection: &kustomizev1.DriftDetection{
+				Mode: kustomizev1.WarnValue,
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	configMapKey := types.NamespacedName{Name: id, Namespace: id}
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+	g.Expect(conditions.Has(resultK, kustomizev1.DriftDetectedCondition)).To(BeFalse())
+
+	t.Run("reports drift without correcting it", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var configMap corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), configMapKey, &configMap)).To(Succeed())
+		configMap.Data["key"] = "drifted"
+		g.Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+
+		reconcileRequestAt := metav1.Now().String()
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.SetAnnotations(map[string]string{
+				meta.ReconcileRequestAnnotation: reconcileRequestAt,
+			})
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastHandledReconcileAt == reconcileRequestAt &&
+				conditions.IsTrue(resultK, kustomizev1.DriftDetectedCondition)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(isReconcileSuccess(resultK)).To(BeTrue())
+		g.Expect(conditions.GetReason(resultK, kustomizev1.DriftDetectedCondition)).To(Equal(kustomizev1.DriftDetectedReason))
+		g.Expect(conditions.GetMessage(resultK, kustomizev1.DriftDetectedCondition)).To(ContainSubstring(
+			fmt.Sprintf("ConfigMap/%[1]s/%[1]s configured", id)))
+
+		g.Expect(k8sClient.Get(context.Background(), configMapKey, &configMap)).To(Succeed())
+		g.Expect(configMap.Data["key"]).To(Equal("drifted"))
+
+		var found bool
+		for _, e := range getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision}) {
+			if e.Type == corev1.EventTypeWarning && strings.Contains(e.Message, "Drift detected") {
+				found = true
+			}
+		}
+		g.Expect(found).To(BeTrue(), "expected a drift warning event")
+
+		// The drifted object is kept in the inventory.
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(1))
+	})
+
+	t.Run("corrects drift when enabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.Spec.DriftDetection.Mode = kustomizev1.EnabledValue
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.ObservedGeneration == resultK.Generation &&
+				!conditions.Has(resultK, kustomizev1.DriftDetectedCondition)
+		}, timeout, time.Second).Should(BeTrue())
+
+		var configMap corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), configMapKey, &configMap)).To(Succeed())
+		g.Expect(configMap.Data["key"]).To(Equal("value"))
+	})
+}
+
+func TestKustomizationReconciler_Freeze(t *testing.T) {
+	g := NewWithT(t)
+	id := "freeze-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := func(objects ...string) []testserver.File {
+		var files []testserver.File
+		for _, name := range objects {
+			files = append(files, testserver.File{
+				Name: name + ".yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[2]s
+data:
+  key: value
+`, name, id),
+			})
+		}
+		return files
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests("first", "second"))
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("freeze-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("freeze-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			Prune:    true,
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	t.Run("reports no drift", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.Spec.Freeze = true
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == kustomizev1.FrozenReason
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.IsUnknown(resultK, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.IsReconciling(resultK)).To(BeFalse())
+		g.Expect(conditions.Has(resultK, kustomizev1.DriftDetectedCondition)).To(BeFalse())
+	})
+
+	t.Run("reports drift without mutating the cluster", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// Drift the first ConfigMap, and remove the second one from the
+		// new revision, which adds a third one.
+		var configMap corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "first", Namespace: id}, &configMap)).To(Succeed())
+		configMap.Data["key"] = "drifted"
+		g.Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+
+		newRevision := "v2.0.0"
+		artifact, err := testServer.ArtifactFromFiles(manifests("first", "third"))
+		g.Expect(err).NotTo(HaveOccurred())
+		err = applyGitRepository(repositoryName, artifact, newRevision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAttemptedRevision == newRevision &&
+				conditions.IsTrue(resultK, kustomizev1.DriftDetectedCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.FrozenReason))
+		g.Expect(conditions.GetMessage(resultK, kustomizev1.DriftDetectedCondition)).To(And(
+			ContainSubstring(fmt.Sprintf("ConfigMap/%s/first configured", id)),
+			ContainSubstring(fmt.Sprintf("ConfigMap/%s/third created", id)),
+		))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(revision))
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(2))
+
+		// The drift is not corrected, the new object is not created and
+		// the removed object is not pruned.
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "first", Namespace: id}, &configMap)).To(Succeed())
+		g.Expect(configMap.Data["key"]).To(Equal("drifted"))
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "second", Namespace: id}, &configMap)).To(Succeed())
+		err = k8sClient.Get(context.Background(), types.NamespacedName{Name: "third", Namespace: id}, &configMap)
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	t.Run("applies the revision once unfrozen", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.Spec.Freeze = false
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == "v2.0.0"
+		}, timeout, time.Second).Should(BeTrue())
+
+		var configMap corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "first", Namespace: id}, &configMap)).To(Succeed())
+		g.Expect(configMap.Data["key"]).To(Equal("value"))
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "third", Namespace: id}, &configMap)).To(Succeed())
+		g.Expect(conditions.Has(resultK, kustomizev1.DriftDetectedCondition)).To(BeFalse())
+	})
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+const (
+	// buildDumpSuffix is appended to the name of the Kustomization to name
+	// the ConfigMap its build is dumped to.
+	buildDumpSuffix = "-build"
+	// buildDumpKey is the key of the ConfigMap data holding the dump.
+	buildDumpKey = "build.json"
+	// buildDumpRevisionAnnotation records the source revision of the dump.
+	buildDumpRevisionAnnotation = "kustomize.toolkit.fluxcd.io/revision"
+	// maxBuildDumpSize is the size limit of the data of a ConfigMap.
+	maxBuildDumpSize = 1024 * 1024
+	// redactedSecretValue replaces the values of the Secret data in dumps.
+	redactedSecretValue = "[REDACTED]"
+)
+
+// dumpBuild returns the objects as a JSON list, with the values of the data
+// and stringData of the Secrets replaced by a placeholder, and the values
+// recorded by the redactor, e.g. the decrypted values of other kinds,
+// redacted from all the strings. The objects are not modified.
+func dumpBuild(objects []*unstructured.Unstructured, redactor *decryptor.Redactor) ([]byte, error) {
+	dump := make([]interface{}, 0, len(objects))
+	for _, o := range objects {
+		u := o.DeepCopy()
+		if u.GetAPIVersion() == "v1" && u.GetKind() == "Secret" {
+			for _, field := range []string{"data", "stringData"} {
+				data, ok := u.Object[field].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				for k := range data {
+					data[k] = redactedSecretValue
+				}
+			}
+		}
+		dump = append(dump, redactStrings(u.Object, redactor))
+	}
+	return json.MarshalIndent(dump, "", "  ")
+}
+
+// redactStrings redacts the values recorded by the redactor from the
+// strings in v, and returns the result. The values are redacted before the
+// JSON encoding, as the escaping of e.g. newlines would otherwise prevent
+// the values from being matched.
+func redactStrings(v interface{}, redactor *decryptor.Redactor) interface{} {
+	switch t := v.(type) {
+	case string:
+		return redactor.Redact(t)
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = redactStrings(e, redactor)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = redactStrings(e, redactor)
+		}
+	}
+	return v
+}
+
+// writeBuildDump writes the dump of the objects built for the revision to
+// the ConfigMap named after the Kustomization in its namespace with the
+// kubeClient, see writeOwnedConfigMap.
+func (r *KustomizationReconciler) writeBuildDump(ctx context.Context, kubeClient client.Client, obj *kustomizev1.Kustomization,
+	revision string, objects []*unstructured.Unstructured, redactor *decryptor.Redactor) error {
+	data, err := dumpBuild(objects, redactor)
+	if err != nil {
+		return fmt.Errorf("failed to encode the build result: %w", err)
+	}
+	if len(data) > maxBuildDumpSize {
+		return fmt.Errorf("the build result of %d bytes exceeds the ConfigMap size limit of %d bytes",
+			len(data), maxBuildDumpSize)
+	}
+
+	if err := r.writeOwnedConfigMap(ctx, kubeClient, obj, obj.GetName()+buildDumpSuffix, revision,
+		map[string]string{buildDumpKey: string(data)}); err != nil {
+		return fmt.Errorf("failed to write the build result: %w", err)
+	}
+	return nil
+}
+
+// writeOwnedConfigMap writes the data of the revision to the named ConfigMap
+// in the namespace of the Kustomization, which is owned by the Kustomization
+// and thereby garbage collected with it. A ConfigMap with this name which is
+// not owned by the Kustomization is not overwritten. The ConfigMap is written
+// with the kubeClient, which impersonates the service account of the
+// Kustomization, and not with the privileges of the controller.
+func (r *KustomizationReconciler) writeOwnedConfigMap(ctx context.Context, kubeClient client.Client, obj *kustomizev1.Kustomization,
+	name, revision string, data map[string]string) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: obj.GetNamespace(),
+		},
+	}
+	owner := metav1.OwnerReference{
+		APIVersion: kustomizev1.GroupVersion.String(),
+		Kind:       kustomizev1.KustomizationKind,
+		Name:       obj.GetName(),
+		UID:        obj.GetUID(),
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, kubeClient, cm, func() error {
+		if cm.GetResourceVersion() != "" && !isOwnedBy(cm, owner) {
+			return fmt.Errorf("ConfigMap '%s/%s' is not owned by the Kustomization", cm.GetNamespace(), cm.GetName())
+		}
+		cm.SetOwnerReferences([]metav1.OwnerReference{owner})
+		annotations := cm.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[buildDumpRevisionAnnotation] = revision
+		cm.SetAnnotations(annotations)
+		cm.Data = data
+		return nil
+	})
+	return err
+}
+
+// isOwnedBy returns if the object has an owner reference with the UID of
+// the owner.
+func isOwnedBy(o metav1.Object, owner metav1.OwnerReference) bool {
+	for _, ref := range o.GetOwnerReferences() {
+		if ref.UID == owner.UID {
+			return true
+		}
+	}
+	return false
+}
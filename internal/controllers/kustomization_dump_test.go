@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fluxcd/pkg/ssa"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+const dumpManifests = `---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: credentials
+  namespace: default
+data:
+  password: c3VwZXItc2VjcmV0
+stringData:
+  token: plain-token
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: default
+data:
+  endpoint: https://example.com
+  key: |-
+    decrypted
+    value
+`
+
+func TestDumpBuild(t *testing.T) {
+	g := NewWithT(t)
+
+	objects, err := ssa.ReadObjects(strings.NewReader(dumpManifests))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	redactor := decryptor.NewRedactor()
+	redactor.Record("decrypted\nvalue")
+
+	data, err := dumpBuild(objects, redactor)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	for _, v := range []string{"c3VwZXItc2VjcmV0", "super-secret", "plain-token", "decrypted"} {
+		g.Expect(string(data)).ToNot(ContainSubstring(v))
+	}
+
+	var dump []map[string]interface{}
+	g.Expect(json.Unmarshal(data, &dump)).To(Succeed())
+	g.Expect(dump).To(HaveLen(2))
+	g.Expect(dump[0]["data"]).To(Equal(map[string]interface{}{"password": redactedSecretValue}))
+	g.Expect(dump[0]["stringData"]).To(Equal(map[string]interface{}{"token": redactedSecretValue}))
+	g.Expect(dump[1]["data"]).To(Equal(map[string]interface{}{
+		"endpoint": "https://example.com",
+		"key":      "[REDACTED]",
+	}))
+
+	secretData, _, _ := unstructured.NestedString(objects[0].Object, "data", "password")
+	g.Expect(secretData).To(Equal("c3VwZXItc2VjcmV0"), "the objects must not be modified")
+}
+
+func TestKustomizationReconciler_writeBuildDump(t *testing.T) {
+	objects, err := ssa.ReadObjects(strings.NewReader(dumpManifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "app-uid"},
+	}
+	dumpName := types.NamespacedName{Name: "app-build", Namespace: "default"}
+
+	t.Run("creates and updates the ConfigMap", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r := &KustomizationReconciler{Client: fake.NewClientBuilder().Build()}
+		g.Expect(r.writeBuildDump(context.Background(), r.Client, obj, "v1", objects, nil)).To(Succeed())
+		g.Expect(r.writeBuildDump(context.Background(), r.Client, obj, "v2", objects[1:], nil)).To(Succeed())
+
+		var cm corev1.ConfigMap
+		g.Expect(r.Get(context.Background(), dumpName, &cm)).To(Succeed())
+		g.Expect(cm.GetAnnotations()).To(HaveKeyWithValue(buildDumpRevisionAnnotation, "v2"))
+		g.Expect(cm.GetOwnerReferences()).To(HaveLen(1))
+		g.Expect(cm.GetOwnerReferences()[0].UID).To(Equal(obj.GetUID()))
+		g.Expect(cm.Data[buildDumpKey]).To(ContainSubstring("https://example.com"))
+		g.Expect(cm.Data[buildDumpKey]).ToNot(ContainSubstring("Secret"))
+	})
+
+	t.Run("does not overwrite a ConfigMap of another owner", func(t *testing.T) {
+		g := NewWithT(t)
+
+		existing := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: dumpName.Name, Namespace: dumpName.Namespace},
+			Data:       map[string]string{"key": "value"},
+		}
+		r := &KustomizationReconciler{Client: fake.NewClientBuilder().WithObjects(existing).Build()}
+		err := r.writeBuildDump(context.Background(), r.Client, obj, "v1", objects, nil)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("is not owned by the Kustomization"))
+
+		var cm corev1.ConfigMap
+		g.Expect(r.Get(context.Background(), dumpName, &cm)).To(Succeed())
+		g.Expect(cm.Data).To(Equal(existing.Data))
+	})
+}
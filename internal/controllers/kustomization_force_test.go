@@ -172,3 +172,138 @@ stringData:
 		g.Expect(apimeta.IsStatusConditionTrue(resultK.Status.Conditions, kustomizev1.HealthyCondition)).To(BeTrue())
 	})
 }
+
+func TestKustomizationReconciler_ForceApply(t *testing.T) {
+	g := NewWithT(t)
+	id := "force-apply-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := []testserver.File{
+		{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+data:
+  key: value
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("force-apply-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("force-apply-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	configMapKey := types.NamespacedName{Name: id, Namespace: id}
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	// appliedByController returns whether the controller owns fields of the
+	// ConfigMap through server-side apply.
+	appliedByController := func(g *WithT) bool {
+		var configMap corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), configMapKey, &configMap)).To(Succeed())
+		for _, entry := range configMap.GetManagedFields() {
+			if entry.Manager == "kustomize-controller" && entry.Operation == metav1.ManagedFieldsOperationApply {
+				return true
+			}
+		}
+		return false
+	}
+	g.Expect(appliedByController(g)).To(BeTrue())
+
+	// Wedge the field ownership by handing over the fields of the ConfigMap
+	// to another manager, without changing its content.
+	var configMap corev1.ConfigMap
+	g.Expect(k8sClient.Get(context.Background(), configMapKey, &configMap)).To(Succeed())
+	configMap.SetManagedFields([]metav1.ManagedFieldsEntry{
+		{
+			Manager:    "wedged",
+			Operation:  metav1.ManagedFieldsOperationUpdate,
+			APIVersion: "v1",
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:key":{}}}`)},
+		},
+	})
+	g.Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+	g.Expect(appliedByController(g)).To(BeFalse())
+
+	t.Run("does not re-apply unchanged objects", func(t *testing.T) {
+		g := NewWithT(t)
+
+		reconcileRequestAt := metav1.Now().String()
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.SetAnnotations(map[string]string{
+				meta.ReconcileRequestAnnotation: reconcileRequestAt,
+			})
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastHandledReconcileAt == reconcileRequestAt
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(isReconcileSuccess(resultK)).To(BeTrue())
+		g.Expect(appliedByController(g)).To(BeFalse())
+	})
+
+	t.Run("re-applies unchanged objects on request", func(t *testing.T) {
+		g := NewWithT(t)
+
+		forceApplyAt := metav1.Now().String()
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			annotations := resultK.GetAnnotations()
+			annotations[kustomizev1.ForceApplyAnnotation] = forceApplyAt
+			resultK.SetAnnotations(annotations)
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastHandledForceApplyAt == forceApplyAt
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(isReconcileSuccess(resultK)).To(BeTrue())
+		g.Expect(appliedByController(g)).To(BeTrue())
+
+		_, requested := resultK.ForceApplyRequested()
+		g.Expect(requested).To(BeFalse())
+	})
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// waitForSecretData waits until the HealthCheckSecrets of the Kustomization
+// exist with non-empty data, or the timeout expires. It returns an error
+// listing the Secrets which are missing or without data on timeout.
+func waitForSecretData(ctx context.Context, kubeClient client.Client,
+	obj *kustomizev1.Kustomization, timeout time.Duration) error {
+	defaultNamespace := obj.GetNamespace()
+	if obj.Spec.TargetNamespace != "" {
+		defaultNamespace = obj.Spec.TargetNamespace
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var pending []string
+	err := wait.PollImmediateUntilWithContext(timeoutCtx, 2*time.Second, func(ctx context.Context) (bool, error) {
+		pending = pending[:0]
+		for _, ref := range obj.Spec.HealthCheckSecrets {
+			key := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+			if key.Namespace == "" {
+				key.Namespace = defaultNamespace
+			}
+			var secret corev1.Secret
+			if err := kubeClient.Get(ctx, key, &secret); err != nil {
+				if apierrors.IsNotFound(err) {
+					pending = append(pending, key.String())
+					continue
+				}
+				return false, err
+			}
+			if len(secret.Data) == 0 {
+				pending = append(pending, key.String())
+			}
+		}
+		return len(pending) == 0, nil
+	})
+	if err != nil {
+		if len(pending) > 0 && timeoutCtx.Err() != nil {
+			return &healthCheckTimeoutError{
+				err: fmt.Errorf("timeout waiting for Secret(s) to be populated: %s", strings.Join(pending, ", ")),
+			}
+		}
+		return fmt.Errorf("failed to check Secret data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_HealthCheckSecrets(t *testing.T) {
+	g := NewWithT(t)
+	id := "hc-secrets-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := []testserver.File{
+		{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+data:
+  key: value
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("hc-secrets-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	secretKey := types.NamespacedName{Name: id + "-decrypted", Namespace: id}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("hc-secrets-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			HealthCheckSecrets: []meta.NamespacedObjectReference{
+				{Name: secretKey.Name},
+			},
+			Timeout: &metav1.Duration{Duration: time.Minute},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("stays progressing while the Secret is missing", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsReconciling(resultK) &&
+				strings.Contains(conditions.GetMessage(resultK, meta.ReconcilingCondition), "Running health checks")
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.IsUnknown(resultK, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.IsUnknown(resultK, kustomizev1.HealthyCondition)).To(BeTrue())
+	})
+
+	t.Run("stays progressing while the Secret has no data", func(t *testing.T) {
+		g := NewWithT(t)
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretKey.Name,
+				Namespace: secretKey.Namespace,
+			},
+		}
+		g.Expect(k8sClient.Create(context.Background(), secret)).To(Succeed())
+
+		g.Consistently(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsReady(resultK)
+		}, 5*time.Second, time.Second).Should(BeFalse())
+	})
+
+	t.Run("becomes ready once the Secret is populated", func(t *testing.T) {
+		g := NewWithT(t)
+
+		secret := &corev1.Secret{}
+		g.Expect(k8sClient.Get(context.Background(), secretKey, secret)).To(Succeed())
+		secret.Data = map[string][]byte{"key": []byte("decrypted")}
+		g.Expect(k8sClient.Update(context.Background(), secret)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.IsTrue(resultK, kustomizev1.HealthyCondition)).To(BeTrue())
+	})
+}
+
+func TestWaitForSecretData(t *testing.T) {
+	populated := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "populated", Namespace: "apps"},
+		Data:       map[string][]byte{"key": []byte("value")},
+	}
+	c := fakeclient.NewClientBuilder().WithObjects(populated).Build()
+
+	t.Run("passes with populated Secrets", func(t *testing.T) {
+		g := NewWithT(t)
+
+		obj := &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+			Spec: kustomizev1.KustomizationSpec{
+				HealthCheckSecrets: []meta.NamespacedObjectReference{{Name: "populated"}},
+			},
+		}
+		g.Expect(waitForSecretData(context.TODO(), c, obj, time.Second)).To(Succeed())
+	})
+
+	t.Run("times out within the remaining timeout", func(t *testing.T) {
+		g := NewWithT(t)
+
+		obj := &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+			Spec: kustomizev1.KustomizationSpec{
+				Timeout:            &metav1.Duration{Duration: time.Minute},
+				HealthCheckSecrets: []meta.NamespacedObjectReference{{Name: "populated"}, {Name: "missing"}},
+			},
+		}
+		start := time.Now().Add(-time.Minute)
+		err := waitForSecretData(context.TODO(), c, obj, remainingTimeout(obj, start))
+		var timeoutErr *healthCheckTimeoutError
+		g.Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+		g.Expect(err.Error()).To(ContainSubstring("apps/missing"))
+	})
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestHealthCheckFailed(t *testing.T) {
+	timeoutErr := &healthCheckTimeoutError{
+		err: errors.New("timeout waiting for: [Deployment/default/app status: 'InProgress']"),
+	}
+
+	tests := []struct {
+		name       string
+		mode       string
+		err        error
+		wantReason string
+		degraded   bool
+	}{
+		{
+			name:       "fails on timeout by default",
+			err:        timeoutErr,
+			wantReason: kustomizev1.HealthCheckFailedReason,
+		},
+		{
+			name:       "fails on timeout in fail mode",
+			mode:       kustomizev1.FailValue,
+			err:        timeoutErr,
+			wantReason: kustomizev1.HealthCheckFailedReason,
+		},
+		{
+			name:       "degrades on timeout in degrade mode",
+			mode:       kustomizev1.DegradeValue,
+			err:        timeoutErr,
+			wantReason: kustomizev1.HealthCheckDegradedReason,
+			degraded:   true,
+		},
+		{
+			name:       "degrades on wrapped timeout in degrade mode",
+			mode:       kustomizev1.DegradeValue,
+			err:        fmt.Errorf("failed to wait: %w", timeoutErr),
+			wantReason: kustomizev1.HealthCheckDegradedReason,
+			degraded:   true,
+		},
+		{
+			name:       "fails on untyped timeout message in degrade mode",
+			mode:       kustomizev1.DegradeValue,
+			err:        errors.New("timeout waiting for: [Deployment/default/app status: 'InProgress']"),
+			wantReason: kustomizev1.HealthCheckFailedReason,
+		},
+		{
+			name:       "fails on other errors in degrade mode",
+			mode:       kustomizev1.DegradeValue,
+			err:        errors.New("failed to check Secret data: forbidden"),
+			wantReason: kustomizev1.HealthCheckFailedReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			obj := &kustomizev1.Kustomization{
+				Spec: kustomizev1.KustomizationSpec{HealthCheckTimeoutMode: tt.mode},
+			}
+			err := healthCheckFailed(obj, time.Now(), tt.err)
+			g.Expect(err).To(MatchError(tt.err))
+
+			var degradedErr *healthCheckDegradedError
+			g.Expect(errors.As(err, &degradedErr)).To(Equal(tt.degraded))
+			for _, c := range []string{meta.ReadyCondition, kustomizev1.HealthyCondition} {
+				g.Expect(conditions.IsFalse(obj, c)).To(BeTrue())
+				g.Expect(conditions.GetReason(obj, c)).To(Equal(tt.wantReason))
+			}
+		})
+	}
+}
+
+func TestKustomizationReconciler_HealthCheckTimeoutMode(t *testing.T) {
+	g := NewWithT(t)
+	id := "hc-timeout-" + randStringRunes(5)
+	revision := "v1.0.0"
+	timeout := 90 * time.Second
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	// The Deployment never becomes ready, as there is no controller
+	// managing its Pods in the test environment.
+	manifests := []testserver.File{
+		{
+			Name: "deployment.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: never-ready
+  namespace: %s
+spec:
+  selector:
+    matchLabels:
+      app: never-ready
+  template:
+    metadata:
+      labels:
+        app: never-ready
+    spec:
+      containers:
+      - name: app
+        image: ghcr.io/stefanprodan/podinfo:6.3.5
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("hc-timeout-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("hc-timeout-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			Prune:    true,
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Wait:                   true,
+			Timeout:                &metav1.Duration{Duration: 30 * time.Second},
+			HealthCheckTimeoutMode: kustomizev1.DegradeValue,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("reports degraded status", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		for _, c := range []string{meta.ReadyCondition, kustomizev1.HealthyCondition} {
+			g.Expect(conditions.GetReason(resultK, c)).To(Equal(kustomizev1.HealthCheckDegradedReason))
+			g.Expect(conditions.GetMessage(resultK, c)).To(ContainSubstring("Deployment/%s/never-ready", id))
+		}
+		g.Expect(conditions.IsReconciling(resultK)).To(BeTrue())
+		g.Expect(conditions.GetReason(resultK, meta.ReconcilingCondition)).To(Equal(meta.ProgressingReason))
+	})
+
+	t.Run("reports failed status in fail mode", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.Spec.HealthCheckTimeoutMode = kustomizev1.FailValue
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == kustomizev1.HealthCheckFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.GetReason(resultK, meta.ReconcilingCondition)).To(Equal(meta.ProgressingWithRetryReason))
+	})
+}
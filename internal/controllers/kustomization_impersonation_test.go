@@ -19,9 +19,11 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	apiacl "github.com/fluxcd/pkg/apis/acl"
 	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/fluxcd/pkg/testserver"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
@@ -137,6 +139,72 @@ data:
 		g.Expect(readyCondition.Message).To(ContainSubstring("system:serviceaccount:%s:default", id))
 	})
 
+	t.Run("fails to apply impersonating a service account without permissions", func(t *testing.T) {
+		sa := corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "no-rbac",
+				Namespace: id,
+			},
+		}
+		g.Expect(k8sClient.Create(context.Background(), &sa)).To(Succeed())
+
+		saK := &kustomizev1.Kustomization{}
+		err = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), saK)
+		g.Expect(err).NotTo(HaveOccurred())
+		saK.Spec.ServiceAccountName = sa.Name
+		err = k8sClient.Update(context.Background(), saK)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		user := fmt.Sprintf("system:serviceaccount:%s:%s", id, sa.Name)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			readyCondition = apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+			return readyCondition != nil && strings.Contains(readyCondition.Message, user)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(readyCondition.Status).To(Equal(metav1.ConditionFalse))
+		g.Expect(readyCondition.Reason).To(Equal(kustomizev1.ReconciliationFailedReason))
+		g.Expect(readyCondition.Message).To(ContainSubstring("forbidden"))
+	})
+
+	t.Run("denies cross-namespace impersonation", func(t *testing.T) {
+		saK := &kustomizev1.Kustomization{}
+		err = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), saK)
+		g.Expect(err).NotTo(HaveOccurred())
+		saK.Spec.ServiceAccountName = "test"
+		saK.Spec.ServiceAccountNamespace = "flux-system"
+		err = k8sClient.Update(context.Background(), saK)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			readyCondition = apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+			return readyCondition != nil && readyCondition.Reason == apiacl.AccessDeniedReason
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(readyCondition.Message).To(ContainSubstring("cross-namespace impersonation is disabled"))
+	})
+
+	t.Run("rejects cross-namespace impersonation with kubeconfig", func(t *testing.T) {
+		reconciler.AllowCrossNamespaceImpersonation = true
+		defer func() {
+			reconciler.AllowCrossNamespaceImpersonation = false
+		}()
+
+		revision = "v2.1.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			readyCondition = apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+			return resultK.Status.LastAttemptedRevision == revision &&
+				readyCondition.Reason == kustomizev1.ReconciliationFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(readyCondition.Message).To(ContainSubstring("spec.kubeConfig"))
+	})
+
 	t.Run("reconciles impersonating service account", func(t *testing.T) {
 		sa := corev1.ServiceAccount{
 			TypeMeta: metav1.TypeMeta{
@@ -174,6 +242,7 @@ data:
 		err = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), saK)
 		g.Expect(err).NotTo(HaveOccurred())
 		saK.Spec.ServiceAccountName = "test"
+		saK.Spec.ServiceAccountNamespace = ""
 		err = k8sClient.Update(context.Background(), saK)
 		g.Expect(err).NotTo(HaveOccurred())
 
@@ -0,0 +1,93 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_getInterval(t *testing.T) {
+	minIntervals := map[string]time.Duration{
+		sourcev1.GitRepositoryKind:   10 * time.Minute,
+		sourcev1b2.OCIRepositoryKind: time.Minute,
+	}
+
+	tests := []struct {
+		name         string
+		minIntervals map[string]time.Duration
+		kind         string
+		interval     time.Duration
+		want         time.Duration
+	}{
+		{
+			name:         "raises the interval of a GitRepository",
+			minIntervals: minIntervals,
+			kind:         sourcev1.GitRepositoryKind,
+			interval:     time.Minute,
+			want:         10 * time.Minute,
+		},
+		{
+			name:         "keeps the interval of an OCIRepository",
+			minIntervals: minIntervals,
+			kind:         sourcev1b2.OCIRepositoryKind,
+			interval:     time.Minute,
+			want:         time.Minute,
+		},
+		{
+			name:         "keeps an interval longer than the minimum",
+			minIntervals: minIntervals,
+			kind:         sourcev1.GitRepositoryKind,
+			interval:     time.Hour,
+			want:         time.Hour,
+		},
+		{
+			name:         "keeps the interval of a kind without minimum",
+			minIntervals: minIntervals,
+			kind:         sourcev1b2.BucketKind,
+			interval:     30 * time.Second,
+			want:         30 * time.Second,
+		},
+		{
+			name:     "keeps the interval without minimums",
+			kind:     sourcev1.GitRepositoryKind,
+			interval: time.Minute,
+			want:     time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := &KustomizationReconciler{minIntervals: tt.minIntervals}
+			obj := &kustomizev1.Kustomization{
+				Spec: kustomizev1.KustomizationSpec{
+					Interval:  metav1.Duration{Duration: tt.interval},
+					SourceRef: kustomizev1.CrossNamespaceSourceReference{Kind: tt.kind},
+				},
+			}
+			g.Expect(r.getInterval(obj)).To(Equal(tt.want))
+		})
+	}
+}
@@ -271,3 +271,102 @@ stringData:
 		g.Expect(configMap.Data["key"]).To(Equal(id))
 	})
 }
+
+func TestKustomizationReconciler_ManagedObjects(t *testing.T) {
+	g := NewWithT(t)
+	id := "managed-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	configMap := testserver.File{
+		Name: "configmap.yaml",
+		Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: "%[1]s"
+  namespace: "%[1]s"
+data:
+  key: value
+`, id),
+	}
+	serviceAccount := testserver.File{
+		Name: "serviceaccount.yaml",
+		Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: "%[1]s"
+  namespace: "%[1]s"
+`, id),
+	}
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{configMap, serviceAccount})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("managed-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("managed-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Prune: true,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("lists applied objects", func(t *testing.T) {
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(resultK.Status.ManagedObjects).ToNot(BeNil())
+		g.Expect(resultK.Status.ManagedObjects.Total).To(Equal(2))
+		g.Expect(resultK.Status.ManagedObjects.Truncated).To(BeFalse())
+		g.Expect(resultK.Status.ManagedObjects.Entries).To(ConsistOf([]kustomizev1.ManagedObject{
+			{APIVersion: "v1", Kind: "ConfigMap", Name: id, Namespace: id},
+			{APIVersion: "v1", Kind: "ServiceAccount", Name: id, Namespace: id},
+		}))
+	})
+
+	t.Run("removes pruned objects", func(t *testing.T) {
+		testRev := revision + "-1"
+
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{configMap})
+		g.Expect(err).NotTo(HaveOccurred())
+
+		err = applyGitRepository(repositoryName, artifact, testRev)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == testRev
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(resultK.Status.ManagedObjects.Total).To(Equal(1))
+		g.Expect(resultK.Status.ManagedObjects.Entries).To(ConsistOf([]kustomizev1.ManagedObject{
+			{APIVersion: "v1", Kind: "ConfigMap", Name: id, Namespace: id},
+		}))
+	})
+}
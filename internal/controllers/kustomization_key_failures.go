@@ -0,0 +1,143 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// keyFailureTracker tracks the number of consecutive reconciliations in which
+// the decryption with a key failed, by Kustomization and key ID, across the
+// reconciliations. The zero value is ready to use, and it is safe for
+// concurrent use.
+type keyFailureTracker struct {
+	mu       sync.Mutex
+	failures map[string]map[string]int
+}
+
+// record records the keys of which the decryption failed and succeeded in a
+// reconciliation of the Kustomization. It returns the consecutive failures of
+// the failed keys, and the failures prior to the reconciliation of the
+// succeeded keys which failed before, i.e. which recovered.
+func (t *keyFailureTracker) record(obj string, failed, succeeded []string) (failures, recovered map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := t.failures[obj]
+	for _, key := range succeeded {
+		if n, ok := keys[key]; ok {
+			if recovered == nil {
+				recovered = make(map[string]int)
+			}
+			recovered[key] = n
+			delete(keys, key)
+		}
+	}
+	for _, key := range failed {
+		if keys == nil {
+			keys = make(map[string]int)
+			if t.failures == nil {
+				t.failures = make(map[string]map[string]int)
+			}
+			t.failures[obj] = keys
+		}
+		keys[key]++
+		if failures == nil {
+			failures = make(map[string]int)
+		}
+		failures[key] = keys[key]
+	}
+	if len(keys) == 0 {
+		delete(t.failures, obj)
+	}
+	return failures, recovered
+}
+
+// maxFailures returns the highest number of consecutive failures of the keys
+// of the Kustomization which still fail, or zero.
+func (t *keyFailureTracker) maxFailures(obj string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	max := 0
+	for _, n := range t.failures[obj] {
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// delete deletes the failures of the keys of the Kustomization.
+func (t *keyFailureTracker) delete(obj string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, obj)
+}
+
+// recordKeyFailures records the keys of which the decryption failed and
+// succeeded in a reconciliation, as returned by the Decryptor for the Azure
+// Key Vault keys, in the keyFailures. The highest number of consecutive
+// failures of the keys is recorded as the decryption key failures metric,
+// as the number of keys is not bounded. When keys succeed to decrypt after
+// failing in the previous reconciliations, their failures are reset, and an
+// event listing them is recorded, e.g. to resolve the alerts of the failures.
+func (r *KustomizationReconciler) recordKeyFailures(ctx context.Context,
+	obj *kustomizev1.Kustomization, keyFailures map[string]error, keyDecryptions map[string]time.Time) {
+	var failed, succeeded []string
+	for key := range keyFailures {
+		failed = append(failed, key)
+	}
+	for key := range keyDecryptions {
+		succeeded = append(succeeded, key)
+	}
+	id := fmt.Sprintf("%s/%s", obj.GetNamespace(), obj.GetName())
+	failures, recovered := r.keyFailures.record(id, failed, succeeded)
+
+	if r.ExtendedMetrics != nil && (len(failures) > 0 || len(recovered) > 0) {
+		r.ExtendedMetrics.RecordKeyFailures(corev1.ObjectReference{
+			Kind:      kustomizev1.KustomizationKind,
+			Name:      obj.GetName(),
+			Namespace: obj.GetNamespace(),
+		}, r.keyFailures.maxFailures(id))
+	}
+
+	if len(recovered) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(recovered))
+	for key := range recovered {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var list strings.Builder
+	for _, key := range keys {
+		list.WriteString(fmt.Sprintf("\n'%s' after %d failed reconciliation(s)", key, recovered[key]))
+	}
+	msg := "Decryption key(s) recovered:" + list.String()
+	ctrl.LoggerFrom(ctx).Info(msg, "revision", obj.Status.LastAttemptedRevision)
+	r.event(obj, obj.Status.LastAttemptedRevision, eventv1.EventSeverityInfo, msg, nil)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	intmetrics "github.com/fluxcd/kustomize-controller/internal/metrics"
+)
+
+func TestKeyFailureTracker_record(t *testing.T) {
+	g := NewWithT(t)
+
+	var tracker keyFailureTracker
+	failures, recovered := tracker.record("default/app", []string{"key-1", "key-2"}, nil)
+	g.Expect(failures).To(Equal(map[string]int{"key-1": 1, "key-2": 1}))
+	g.Expect(recovered).To(BeEmpty())
+
+	failures, recovered = tracker.record("default/app", []string{"key-1"}, []string{"key-3"})
+	g.Expect(failures).To(Equal(map[string]int{"key-1": 2}))
+	g.Expect(recovered).To(BeEmpty())
+
+	// The failures of other Kustomizations are tracked separately.
+	failures, _ = tracker.record("default/other", []string{"key-1"}, nil)
+	g.Expect(failures).To(Equal(map[string]int{"key-1": 1}))
+
+	failures, recovered = tracker.record("default/app", nil, []string{"key-1", "key-2"})
+	g.Expect(failures).To(BeEmpty())
+	g.Expect(recovered).To(Equal(map[string]int{"key-1": 2, "key-2": 1}))
+
+	// A recovered key is only reported once.
+	_, recovered = tracker.record("default/app", nil, []string{"key-1"})
+	g.Expect(recovered).To(BeEmpty())
+
+	// The highest failures of the keys which still fail are reported.
+	tracker.record("default/app", []string{"key-1", "key-2"}, nil)
+	tracker.record("default/app", []string{"key-2"}, nil)
+	g.Expect(tracker.maxFailures("default/app")).To(Equal(2))
+	tracker.record("default/app", nil, []string{"key-2"})
+	g.Expect(tracker.maxFailures("default/app")).To(Equal(1))
+
+	tracker.delete("default/other")
+	_, recovered = tracker.record("default/other", nil, []string{"key-1"})
+	g.Expect(recovered).To(BeEmpty())
+}
+
+func TestKustomizationReconciler_recordKeyFailures(t *testing.T) {
+	g := NewWithT(t)
+
+	const key = "https://example.vault.azure.net/keys/sops/1234"
+	recorder := record.NewFakeRecorder(10)
+	r := &KustomizationReconciler{
+		EventRecorder:   recorder,
+		ExtendedMetrics: intmetrics.NewRecorder(),
+	}
+	obj := &kustomizev1.Kustomization{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	obj.Status.LastAttemptedRevision = "main@sha1:abc"
+
+	// Failing reconciliations do not signal a recovery.
+	for i := 0; i < 2; i++ {
+		r.recordKeyFailures(context.Background(), obj, map[string]error{key: fmt.Errorf("forbidden")}, nil)
+	}
+	g.Expect(recorder.Events).To(BeEmpty())
+
+	// The first successful decryption following the failures is signaled.
+	r.recordKeyFailures(context.Background(), obj, nil, map[string]time.Time{key: time.Now()})
+	g.Expect(recorder.Events).To(HaveLen(1))
+	event := <-recorder.Events
+	g.Expect(event).To(HavePrefix("Normal"))
+	g.Expect(event).To(ContainSubstring(fmt.Sprintf("Decryption key(s) recovered:\n'%s' after 2 failed reconciliation(s)", key)))
+
+	// The next ones are not.
+	r.recordKeyFailures(context.Background(), obj, nil, map[string]time.Time{key: time.Now()})
+	g.Expect(recorder.Events).To(BeEmpty())
+}
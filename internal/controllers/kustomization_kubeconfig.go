@@ -0,0 +1,91 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+// kubeConfigDecryptingClient is a client.Client which decrypts the SOPS
+// encrypted values of the kubeconfig Secret of a Kustomization with its
+// decryption keys when the Secret is read, which lets the Impersonator build
+// the client of the remote cluster from the decrypted kubeconfig.
+type kubeConfigDecryptingClient struct {
+	client.Client
+
+	secret types.NamespacedName
+	obj    *kustomizev1.Kustomization
+	// configure configures the Decryptor of the Secret as the one of the
+	// build, e.g. with KustomizationReconciler.configureDecryptor.
+	configure func(ctx context.Context, dec *decryptor.Decryptor)
+}
+
+// newKubeConfigDecryptingClient returns a kubeConfigDecryptingClient for the
+// kubeconfig Secret of the given Kustomization, which is looked up in the
+// given namespace and decrypted with a Decryptor configured by configure.
+func newKubeConfigDecryptingClient(c client.Client, obj *kustomizev1.Kustomization, namespace string,
+	configure func(ctx context.Context, dec *decryptor.Decryptor)) *kubeConfigDecryptingClient {
+	return &kubeConfigDecryptingClient{
+		Client: c,
+		secret: types.NamespacedName{
+			Name:      obj.Spec.KubeConfig.SecretRef.Name,
+			Namespace: namespace,
+		},
+		obj:       obj,
+		configure: configure,
+	}
+}
+
+// Get reads the object with the embedded client, and decrypts it if it is the
+// kubeconfig Secret.
+func (c *kubeConfigDecryptingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if err := c.Client.Get(ctx, key, obj, opts...); err != nil {
+		return err
+	}
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || key != c.secret {
+		return nil
+	}
+	if err := c.decrypt(ctx, secret); err != nil {
+		return fmt.Errorf("failed to decrypt KubeConfig secret '%s': %w", key, err)
+	}
+	return nil
+}
+
+func (c *kubeConfigDecryptingClient) decrypt(ctx context.Context, secret *corev1.Secret) error {
+	dec, cleanup, err := decryptor.NewTempDecryptor("", c.Client, c.obj)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if c.configure != nil {
+		c.configure(ctx, dec)
+	}
+
+	if err := dec.ImportKeys(ctx); err != nil {
+		return err
+	}
+	return dec.DecryptSecret(secret)
+}
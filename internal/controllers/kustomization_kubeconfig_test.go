@@ -0,0 +1,226 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+func TestKustomizationReconciler_EncryptedKubeConfig(t *testing.T) {
+	g := NewWithT(t)
+	id := "kubeconfig-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	ageKey, err := os.ReadFile("testdata/sops/age.txt")
+	g.Expect(err).NotTo(HaveOccurred())
+	identities, err := age.ParseIdentities(bytes.NewReader(ageKey))
+	g.Expect(err).NotTo(HaveOccurred())
+	recipient := identities[0].(*age.X25519Identity).Recipient().String()
+
+	// encrypt the kubeconfig of the test cluster
+	kubeConfigPath := filepath.Join(t.TempDir(), "kubeconfig.yaml")
+	g.Expect(os.WriteFile(kubeConfigPath, kubeConfig, 0o600)).To(Succeed())
+	encKubeConfig, err := exec.Command("sops", "--age", recipient, "--encrypt", kubeConfigPath).Output()
+	g.Expect(err).NotTo(HaveOccurred(), "failed to encrypt kubeconfig")
+
+	kubeConfigSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubeconfig",
+			Namespace: id,
+		},
+		Data: map[string][]byte{
+			"value.yaml": encKubeConfig,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kubeConfigSecret)).To(Succeed())
+
+	sopsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-" + randStringRunes(5),
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"age.agekey": string(ageKey),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), sopsSecret)).To(Succeed())
+
+	manifests := []testserver.File{
+		{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+data:
+  key: value
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("kubeconfig-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	newKustomization := func(decryption *kustomizev1.Decryption) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("kubeconfig-%s", randStringRunes(5)),
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Path:     "./",
+				KubeConfig: &meta.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{
+						Name: kubeConfigSecret.Name,
+					},
+				},
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{
+					Name:      repositoryName.Name,
+					Namespace: repositoryName.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+				Decryption: decryption,
+			},
+		}
+	}
+
+	t.Run("applies with the decrypted kubeconfig", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kustomization := newKustomization(&kustomizev1.Decryption{
+			Provider: "sops",
+			SecretRef: &meta.LocalObjectReference{
+				Name: sopsSecret.Name,
+			},
+		})
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := &kustomizev1.Kustomization{}
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: id, Namespace: id}, &cm)).To(Succeed())
+	})
+
+	t.Run("fails without the decryption key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kustomization := newKustomization(&kustomizev1.Decryption{
+			Provider: "sops",
+		})
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := &kustomizev1.Kustomization{}
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.ReconciliationFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(
+			fmt.Sprintf("failed to decrypt KubeConfig secret '%s/kubeconfig'", id)))
+	})
+}
+
+func TestKubeConfigDecryptingClient_Get(t *testing.T) {
+	g := NewWithT(t)
+
+	ageKey, err := os.ReadFile("testdata/sops/age.txt")
+	g.Expect(err).NotTo(HaveOccurred())
+	encrypted, err := os.ReadFile("testdata/sops/secret.age.yaml")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	c := fakeclient.NewClientBuilder().WithObjects(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "sops-age", Namespace: "tenant"},
+			Data:       map[string][]byte{"age.agekey": ageKey},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubeconfig", Namespace: "tenant"},
+			Data:       map[string][]byte{"value.yaml": encrypted},
+		},
+	).Build()
+	obj := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "tenant"},
+		Spec: kustomizev1.KustomizationSpec{
+			KubeConfig: &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{Name: "kubeconfig"},
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider:  decryptor.DecryptionProviderSOPS,
+				SecretRef: &meta.LocalObjectReference{Name: "sops-age"},
+			},
+		},
+	}
+
+	r := &KustomizationReconciler{}
+	redactor := decryptor.NewRedactor()
+	configured := 0
+	kubeClient := newKubeConfigDecryptingClient(c, obj, "tenant", func(ctx context.Context, dec *decryptor.Decryptor) {
+		configured++
+		r.configureDecryptor(ctx, obj, dec, redactor)
+	})
+
+	var secret corev1.Secret
+	g.Expect(kubeClient.Get(context.TODO(), types.NamespacedName{Name: "kubeconfig", Namespace: "tenant"}, &secret)).To(Succeed())
+	g.Expect(configured).To(Equal(1))
+	value := string(secret.Data["value.yaml"])
+	g.Expect(value).ToNot(ContainSubstring("ENC["))
+	g.Expect(redactor.Redact(value)).ToNot(Equal(value))
+
+	// Other Secrets are not decrypted.
+	g.Expect(kubeClient.Get(context.TODO(), types.NamespacedName{Name: "sops-age", Namespace: "tenant"}, &secret)).To(Succeed())
+	g.Expect(configured).To(Equal(1))
+}
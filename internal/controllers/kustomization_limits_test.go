@@ -0,0 +1,145 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_BuildLimits(t *testing.T) {
+	g := NewWithT(t)
+	id := "limits-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	newKustomization := func(manifests []testserver.File, decryption *kustomizev1.Decryption) *kustomizev1.Kustomization {
+		g := NewWithT(t)
+
+		artifact, err := testServer.ArtifactFromFiles(manifests)
+		g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+		repositoryName := types.NamespacedName{
+			Name:      fmt.Sprintf("limits-%s", randStringRunes(5)),
+			Namespace: id,
+		}
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("limits-%s", randStringRunes(5)),
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Path:     "./",
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{
+					Name:      repositoryName.Name,
+					Namespace: repositoryName.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+				Decryption: decryption,
+			},
+		}
+	}
+
+	waitForNotReady := func(g *WithT, kustomization *kustomizev1.Kustomization) *kustomizev1.Kustomization {
+		resultK := &kustomizev1.Kustomization{}
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		return resultK
+	}
+
+	t.Run("rejects an oversized artifact before decryption", func(t *testing.T) {
+		g := NewWithT(t)
+
+		manifests := []testserver.File{
+			{
+				Name: "config.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+data:
+  key: %[2]s
+`, id, strings.Repeat("a", testMaxArtifactSize)),
+			},
+		}
+
+		// The decryption keys do not exist, decrypting would fail with a
+		// different error.
+		kustomization := newKustomization(manifests, &kustomizev1.Decryption{
+			Provider:  "sops",
+			SecretRef: &meta.LocalObjectReference{Name: "missing-keys"},
+		})
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := waitForNotReady(g, kustomization)
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.ArtifactFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(
+			ContainSubstring(fmt.Sprintf("is bigger than max archive size of %d bytes", testMaxArtifactSize)))
+		g.Expect(resultK.Status.LastAttemptedRevision).To(BeEmpty())
+	})
+
+	t.Run("rejects a build exceeding the max number of objects", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var body strings.Builder
+		for i := 0; i <= testMaxManifests; i++ {
+			fmt.Fprintf(&body, `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s-%[2]d
+  namespace: %[1]s
+data:
+  key: value
+`, id, i)
+		}
+		manifests := []testserver.File{{Name: "configs.yaml", Body: body.String()}}
+
+		kustomization := newKustomization(manifests, nil)
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := waitForNotReady(g, kustomization)
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.BuildFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(Equal(fmt.Sprintf(
+			"kustomize build produced %d objects, exceeding the max of %d objects", testMaxManifests+1, testMaxManifests)))
+		g.Expect(resultK.Status.Inventory).To(BeNil())
+	})
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/resmap"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// namespaceConflicts returns the namespaced resources of the build result
+// which are declared with a namespace other than the target namespace of the
+// Kustomization in the file they originate from. Resources of remote bases or
+// generators, and namespaces referencing post build variables, are ignored.
+func namespaceConflicts(obj *kustomizev1.Kustomization, m resmap.ResMap, origins *originResolver) ([]string, error) {
+	var conflicts []string
+	for _, res := range m.Resources() {
+		if res.GetGvk().IsClusterScoped() {
+			continue
+		}
+		doc, err := origins.document(res)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			continue
+		}
+
+		ns := doc.GetNamespace()
+		if ns == "" || ns == obj.Spec.TargetNamespace {
+			continue
+		}
+		if obj.Spec.PostBuild != nil && strings.Contains(ns, "${") {
+			continue
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%s/%s/%s", res.GetKind(), ns, res.GetName()))
+	}
+	sort.Strings(conflicts)
+	return conflicts, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_TargetNamespace(t *testing.T) {
+	g := NewWithT(t)
+	id := "target-ns-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := []testserver.File{
+		{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s-unset
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s-hardcoded
+  namespace: other
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s-substituted
+  namespace: ${namespace}
+data:
+  key: value
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: %[1]s
+rules:
+- apiGroups: [""]
+  resources: ["configmaps"]
+  verbs: ["get"]
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("target-ns-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("target-ns-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			PostBuild: &kustomizev1.PostBuild{
+				Substitute: map[string]string{"namespace": id},
+			},
+			Prune: true,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	t.Run("sets the target namespace on namespaced resources", func(t *testing.T) {
+		g := NewWithT(t)
+
+		for _, name := range []string{"unset", "hardcoded", "substituted"} {
+			key := types.NamespacedName{Name: fmt.Sprintf("%s-%s", id, name), Namespace: id}
+			g.Expect(k8sClient.Get(context.Background(), key, &corev1.ConfigMap{})).To(Succeed())
+		}
+	})
+
+	t.Run("omits the namespace for cluster-scoped resources", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clusterRole rbacv1.ClusterRole
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: id}, &clusterRole)).To(Succeed())
+		g.Expect(clusterRole.GetNamespace()).To(BeEmpty())
+
+		g.Expect(resultK.Status.Inventory.Entries).To(ContainElement(
+			kustomizev1.ResourceRef{ID: fmt.Sprintf("_%s_rbac.authorization.k8s.io_ClusterRole", id), Version: "v1"}))
+	})
+
+	t.Run("reports the overridden namespaces", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var messages []string
+		for _, e := range getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision}) {
+			if e.Type == corev1.EventTypeWarning && strings.HasPrefix(e.Message, "Namespace of") {
+				messages = append(messages, e.Message)
+			}
+		}
+		g.Expect(messages).ToNot(BeEmpty(), "expected a namespace override warning event")
+		g.Expect(messages[0]).To(Equal(fmt.Sprintf(
+			"Namespace of 1 object(s) overridden by the target namespace '%[1]s':\nConfigMap/other/%[1]s-hardcoded", id)))
+	})
+}
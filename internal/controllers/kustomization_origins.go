@@ -0,0 +1,173 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// enableOriginAnnotations enables the origin annotations in the build
+// metadata of the kustomization file in the directory, for the build to
+// record the file each resource originates from. It returns whether the
+// annotations were enabled by it, in which case they have to be removed from
+// the build result with stripOriginAnnotations.
+func enableOriginAnnotations(dirPath string) (bool, error) {
+	var kfile string
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		p := filepath.Join(dirPath, name)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			kfile = p
+			break
+		}
+	}
+	if kfile == "" {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(kfile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read kustomization file: %w", err)
+	}
+	var kus kustypes.Kustomization
+	if err := yaml.Unmarshal(data, &kus); err != nil {
+		return false, fmt.Errorf("failed to unmarshal kustomization file: %w", err)
+	}
+	for _, m := range kus.BuildMetadata {
+		if m == kustypes.OriginAnnotations {
+			return false, nil
+		}
+	}
+
+	kus.BuildMetadata = append(kus.BuildMetadata, kustypes.OriginAnnotations)
+	data, err = yaml.Marshal(kus)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal kustomization file: %w", err)
+	}
+	if err := os.WriteFile(kfile, data, 0o644); err != nil {
+		return false, fmt.Errorf("failed to write kustomization file: %w", err)
+	}
+	return true, nil
+}
+
+// stripOriginAnnotations removes the origin annotations from the resources.
+func stripOriginAnnotations(m resmap.ResMap) error {
+	for _, res := range m.Resources() {
+		if err := res.SetOrigin(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// originResolver looks up the documents the resources of a build result are
+// declared with, in the files recorded by their origin annotation.
+type originResolver struct {
+	workDir string
+	dirPath string
+
+	// files holds the documents of the origin files, by their path.
+	files map[string][]*kyaml.RNode
+}
+
+// newOriginResolver returns an originResolver for the build of the
+// Kustomize overlay in dirPath, confined to the workDir.
+func newOriginResolver(workDir, dirPath string) *originResolver {
+	return &originResolver{
+		workDir: workDir,
+		dirPath: dirPath,
+		files:   make(map[string][]*kyaml.RNode),
+	}
+}
+
+// document returns the document the resource is declared with in its origin
+// file, or nil if the resource has no origin file, e.g. because it is part of
+// a remote base or generated.
+func (o *originResolver) document(res *resource.Resource) (*kyaml.RNode, error) {
+	origin, err := res.GetOrigin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get origin of '%s/%s' %s: %w",
+			res.GetNamespace(), res.GetName(), res.GetKind(), err)
+	}
+	if origin == nil || origin.Repo != "" || origin.Path == "" {
+		return nil, nil
+	}
+
+	docs, ok := o.files[origin.Path]
+	if !ok {
+		if docs, err = o.readFile(origin.Path); err != nil {
+			return nil, err
+		}
+		o.files[origin.Path] = docs
+	}
+	return declaredDocument(docs, res.GetKind(), res.GetName()), nil
+}
+
+// readFile returns the documents of the file at the origin path, which is
+// relative to the directory of the build.
+func (o *originResolver) readFile(originPath string) ([]*kyaml.RNode, error) {
+	relPath, err := filepath.Rel(o.workDir, filepath.Join(o.dirPath, originPath))
+	if err != nil {
+		return nil, err
+	}
+	path, err := securejoin.SecureJoin(o.workDir, relPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read origin file '%s': %w", relPath, err)
+	}
+	docs, err := kio.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse origin file '%s': %w", relPath, err)
+	}
+	return docs, nil
+}
+
+// declaredDocument returns the document of the given kind and name. As the
+// build may add a prefix or suffix to the name, the document of which the
+// name is the longest part of the given name is returned when none has the
+// name.
+func declaredDocument(docs []*kyaml.RNode, kind, name string) *kyaml.RNode {
+	var match *kyaml.RNode
+	for _, doc := range docs {
+		if doc.GetKind() != kind {
+			continue
+		}
+		docName := doc.GetName()
+		if docName == name {
+			return doc
+		}
+		if docName != "" && strings.Contains(name, docName) &&
+			(match == nil || len(docName) > len(match.GetName())) {
+			match = doc
+		}
+	}
+	return match
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+)
+
+func TestDeclaredDocument(t *testing.T) {
+	g := NewWithT(t)
+
+	docs, err := kio.FromBytes([]byte(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: other
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+  namespace: config
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+`))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	for _, tt := range []struct {
+		kind, name, wantName string
+	}{
+		{kind: "ConfigMap", name: "app", wantName: "app"},
+		{kind: "ConfigMap", name: "prefix-app-config-suffix", wantName: "app-config"},
+		{kind: "ConfigMap", name: "prefix-app", wantName: "app"},
+		{kind: "ConfigMap", name: "unrelated"},
+		{kind: "Secret", name: "app", wantName: "app"},
+		{kind: "Deployment", name: "app"},
+	} {
+		doc := declaredDocument(docs, tt.kind, tt.name)
+		if tt.wantName == "" {
+			g.Expect(doc).To(BeNil(), tt.name)
+			continue
+		}
+		g.Expect(doc).ToNot(BeNil(), tt.name)
+		g.Expect(doc.GetKind()).To(Equal(tt.kind))
+		g.Expect(doc.GetName()).To(Equal(tt.wantName))
+	}
+}
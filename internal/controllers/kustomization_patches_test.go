@@ -0,0 +1,253 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/kustomize"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/build"
+)
+
+func TestKustomizationReconciler_PatchSelectors(t *testing.T) {
+	g := NewWithT(t)
+	id := "patch-sel-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := []testserver.File{
+		{
+			Name: "configs.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s-frontend
+  namespace: %[1]s
+  labels:
+    tier: web
+  annotations:
+    example.com/owner: team-a
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s-backend
+  namespace: %[1]s
+  labels:
+    tier: web
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s-db
+  namespace: %[1]s
+  labels:
+    tier: data
+  annotations:
+    example.com/owner: team-a
+data:
+  key: value
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("patch-sel-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("patch-sel-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Patches: []kustomize.Patch{
+				{
+					Patch: `
+- op: add
+  path: /data/tier
+  value: web`,
+					Target: &kustomize.Selector{
+						Kind:          "ConfigMap",
+						LabelSelector: "tier=web",
+					},
+				},
+				{
+					Patch: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+data:
+  owner: team-a`,
+					Target: &kustomize.Selector{
+						Kind:               "ConfigMap",
+						AnnotationSelector: "example.com/owner=team-a",
+					},
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	getData := func(g *WithT, name string) map[string]string {
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+			Name:      fmt.Sprintf("%s-%s", id, name),
+			Namespace: id,
+		}, &cm)).To(Succeed())
+		return cm.Data
+	}
+
+	t.Run("patches all objects selected by label", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Expect(getData(g, "frontend")).To(HaveKeyWithValue("tier", "web"))
+		g.Expect(getData(g, "backend")).To(HaveKeyWithValue("tier", "web"))
+		g.Expect(getData(g, "db")).ToNot(HaveKey("tier"))
+	})
+
+	t.Run("patches all objects selected by annotation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Expect(getData(g, "frontend")).To(HaveKeyWithValue("owner", "team-a"))
+		g.Expect(getData(g, "db")).To(HaveKeyWithValue("owner", "team-a"))
+		g.Expect(getData(g, "backend")).ToNot(HaveKey("owner"))
+	})
+
+	t.Run("fails on a target matching no objects", func(t *testing.T) {
+		g := NewWithT(t)
+
+		reconciler.FailOnUnmatchedPatches = true
+		defer func() {
+			reconciler.FailOnUnmatchedPatches = false
+		}()
+
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)).To(Succeed())
+		resultK.Spec.Patches = append(resultK.Spec.Patches, kustomize.Patch{
+			Patch: `
+- op: add
+  path: /data/tier
+  value: cache`,
+			Target: &kustomize.Selector{
+				Kind:          "ConfigMap",
+				LabelSelector: "tier=cache",
+			},
+		})
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.BuildFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(Equal(
+			"no objects matched by the target of patches[2] (kind: ConfigMap, labelSelector: tier=cache)"))
+	})
+}
+
+func TestCheckPatchTargets(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	g.Expect(os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namespace: apps
+namePrefix: p-
+resources:
+- configmap.yaml
+`), 0o644)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(dir, "configmap.yaml"), []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: default
+  labels:
+    tier: web
+`), 0o644)).To(Succeed())
+
+	stripOrigins, err := enableOriginAnnotations(dir)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stripOrigins).To(BeTrue())
+	m, err := build.SecureBuild(dir, dir, build.Options{})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	patches := []kustomize.Patch{
+		{Target: &kustomize.Selector{Kind: "ConfigMap", Name: "app", Namespace: "default"}},
+		{Target: &kustomize.Selector{Kind: "ConfigMap", Name: "p-app", Namespace: "apps"}},
+		{Target: &kustomize.Selector{Kind: "ConfigMap", LabelSelector: "tier=web"}},
+		{Patch: "[]"},
+		{Target: &kustomize.Selector{Kind: "ConfigMap", Name: "other"}},
+		{Target: &kustomize.Selector{Kind: "Secret", Name: "app"}},
+	}
+	err = checkPatchTargets(m, patches, newOriginResolver(dir, dir))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(Equal("no objects matched by the target of " +
+		"patches[4] (kind: ConfigMap, name: other), patches[5] (kind: Secret, name: app)"))
+
+	g.Expect(checkPatchTargets(m, patches[:4], newOriginResolver(dir, dir))).To(Succeed())
+
+	g.Expect(stripOriginAnnotations(m)).To(Succeed())
+	for _, res := range m.Resources() {
+		g.Expect(res.GetAnnotations()).ToNot(HaveKey("config.kubernetes.io/origin"))
+	}
+}
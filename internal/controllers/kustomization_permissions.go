@@ -0,0 +1,70 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/runtime/conditions"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// checkPermissions runs a server-side apply dry-run for each of the given
+// objects, and reports the kinds which the client is forbidden to apply in
+// the InsufficientPermissions condition. Other dry-run errors, e.g. for
+// objects in namespaces which do not exist yet, are left for the apply to
+// report.
+func (r *KustomizationReconciler) checkPermissions(ctx context.Context,
+	kubeClient client.Client,
+	obj *kustomizev1.Kustomization,
+	objects []*unstructured.Unstructured) error {
+	forbidden := make(map[string]struct{})
+	for _, u := range objects {
+		dryRunObject := u.DeepCopy()
+		err := kubeClient.Patch(ctx, dryRunObject, client.Apply,
+			client.DryRunAll,
+			client.ForceOwnership,
+			client.FieldOwner(r.ControllerName))
+		if apierrors.IsForbidden(err) {
+			gvk := u.GroupVersionKind()
+			forbidden[fmt.Sprintf("%s/%s", gvk.GroupVersion().String(), gvk.Kind)] = struct{}{}
+		}
+	}
+
+	if len(forbidden) == 0 {
+		conditions.Delete(obj, kustomizev1.InsufficientPermissionsCondition)
+		return nil
+	}
+
+	kinds := make([]string, 0, len(forbidden))
+	for kind := range forbidden {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	msg := fmt.Sprintf("Permission check failed, not allowed to apply: %s", strings.Join(kinds, ", "))
+	conditions.MarkTrue(obj, kustomizev1.InsufficientPermissionsCondition, kustomizev1.InsufficientPermissionsReason, msg)
+	return errors.New(msg)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+const (
+	// substitutionPreviewSuffix is appended to the name of the Kustomization
+	// to name the ConfigMap its substitution preview is written to.
+	substitutionPreviewSuffix = "-substitution-preview"
+	// substitutionPreviewKey is the key of the ConfigMap data holding the
+	// preview.
+	substitutionPreviewKey = "preview.json"
+	// inlineSubstitutionSource is the source of the variables set in
+	// spec.postBuild.substitute.
+	inlineSubstitutionSource = "inline"
+	// redactedVariableValue replaces the values of the variables loaded from
+	// Secrets. Unlike redactedSecretValue, it is substituted as a plain YAML
+	// scalar, instead of a flow sequence.
+	redactedVariableValue = "REDACTED"
+)
+
+// substitutionVariable is a variable referenced by the built objects.
+type substitutionVariable struct {
+	// Name is the name of the variable.
+	Name string `json:"name"`
+	// Source is 'inline' or the kind and name of the substituteFrom
+	// reference the value is loaded from, and is empty if the variable is
+	// not defined.
+	Source string `json:"source,omitempty"`
+	// Value is the substituted value, which is redacted if it is loaded
+	// from a Secret.
+	Value string `json:"value,omitempty"`
+}
+
+// substitutionPreview is the result of the post build variable substitution
+// of a revision, with the values loaded from Secrets redacted. It is
+// rendered by the substitution engine of the build, with redacted values in
+// place of the ones loaded from Secrets, and therefore does not hold any
+// value of a Secret.
+type substitutionPreview struct {
+	// Revision is the source revision of the preview.
+	Revision string `json:"revision"`
+	// Variables are the variables referenced by the objects, sorted by name.
+	Variables []substitutionVariable `json:"variables"`
+	// Unresolved are the names of the variables which are referenced
+	// without a default value, but are not defined.
+	Unresolved []string `json:"unresolved,omitempty"`
+	// Objects are the substituted objects.
+	Objects json.RawMessage `json:"objects"`
+
+	// substitution runs the substitution with the values loaded from
+	// Secrets redacted.
+	substitution *variableSubstitution
+	// substitute is true if the post build substitution is configured.
+	substitute bool
+	vars       map[string]substitutionVariable
+	// refs records the names of the referenced variables, and whether they
+	// are referenced without a default value.
+	refs     map[string]bool
+	rendered map[resid.ResId]*unstructured.Unstructured
+}
+
+// newSubstitutionPreview loads the variables of the post build substitution
+// of the Kustomization, and returns an empty preview of the revision.
+func (r *KustomizationReconciler) newSubstitutionPreview(ctx context.Context,
+	obj *kustomizev1.Kustomization, revision string) (*substitutionPreview, error) {
+	vars, err := r.loadSubstitutionVars(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	p := &substitutionPreview{
+		Revision: revision,
+		substitution: &variableSubstitution{
+			vars: make(map[string]string, len(vars)),
+		},
+		substitute: obj.Spec.PostBuild != nil,
+		vars:       vars,
+		refs:       make(map[string]bool),
+		rendered:   make(map[resid.ResId]*unstructured.Unstructured),
+	}
+	// The unresolved variables are reported instead of failing the preview.
+	if p.substitute {
+		p.substitution.policy = obj.Spec.PostBuild.SubstituteMissing
+		if p.substitution.policy == kustomizev1.ErrorValue {
+			p.substitution.policy = kustomizev1.EmptyValue
+		}
+	}
+	// The Secret values are redacted before being handed to the substitution
+	// engine.
+	for k, v := range vars {
+		if strings.HasPrefix(v.Source, "Secret/") {
+			v.Value = redactedVariableValue
+			p.vars[k] = v
+		}
+		p.substitution.vars[k] = v.Value
+	}
+	return p, nil
+}
+
+// add renders the substitution of a copy of the resource with the redacted
+// variables, and records the variables it references. The resource is not
+// modified. A nil preview renders nothing.
+func (p *substitutionPreview) add(ctx context.Context, res *resource.Resource) error {
+	if p == nil {
+		return nil
+	}
+	tmp := res.DeepCopy()
+	if p.substitute {
+		data, err := tmp.AsYAML()
+		if err != nil {
+			return err
+		}
+		out, err := p.substitution.substitute(ctx, tmp)
+		if err != nil {
+			return fmt.Errorf("var substitution failed for '%s': %w", res.GetName(), err)
+		}
+		// The engine returns nil for the resources which opt out of the
+		// substitution.
+		if out != nil {
+			refs, err := variableRefs(string(data))
+			if err != nil {
+				return fmt.Errorf("var substitution failed for '%s': %w", res.GetName(), err)
+			}
+			for name, required := range refs {
+				p.refs[name] = p.refs[name] || required
+			}
+		}
+	}
+	// Convert the resource through JSON, as its map holds the YAML types
+	// of the values, e.g. int instead of int64.
+	data, err := tmp.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	p.rendered[res.CurId()] = u
+	return nil
+}
+
+// finish orders the rendered objects as the given resources of the build,
+// which omits the ones removed from the build e.g. as they failed to be
+// decrypted, and resolves the referenced variables. The values recorded by
+// the redactor, and the Secret data, are redacted from the objects.
+func (p *substitutionPreview) finish(resources []*resource.Resource, redactor *decryptor.Redactor) error {
+	if p == nil {
+		return nil
+	}
+	objects := make([]*unstructured.Unstructured, 0, len(resources))
+	for _, res := range resources {
+		if u, ok := p.rendered[res.CurId()]; ok {
+			objects = append(objects, u)
+		}
+	}
+	data, err := dumpBuild(objects, redactor)
+	if err != nil {
+		return err
+	}
+	p.Objects = data
+
+	p.Variables = make([]substitutionVariable, 0, len(p.refs))
+	p.Unresolved = nil
+	for name, required := range p.refs {
+		v, ok := p.vars[name]
+		if !ok {
+			v = substitutionVariable{Name: name}
+			if required {
+				p.Unresolved = append(p.Unresolved, name)
+			}
+		}
+		v.Value = redactor.Redact(v.Value)
+		p.Variables = append(p.Variables, v)
+	}
+	sort.Slice(p.Variables, func(i, j int) bool {
+		return p.Variables[i].Name < p.Variables[j].Name
+	})
+	sort.Strings(p.Unresolved)
+	return nil
+}
+
+// reportSubstitutionPreview writes the preview to the ConfigMap named after
+// the Kustomization in its namespace with the kubeClient, see
+// writeOwnedConfigMap, and reports
+// the unresolved variables with a warning event, without applying or pruning
+// any object. The Ready condition is marked as unknown, as the revision is
+// not applied.
+func (r *KustomizationReconciler) reportSubstitutionPreview(ctx context.Context, kubeClient client.Client,
+	obj *kustomizev1.Kustomization, preview *substitutionPreview) error {
+	data, err := json.MarshalIndent(preview, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the substitution preview: %w", err)
+	}
+	if len(data) > maxBuildDumpSize {
+		return fmt.Errorf("the substitution preview of %d bytes exceeds the ConfigMap size limit of %d bytes",
+			len(data), maxBuildDumpSize)
+	}
+	name := obj.GetName() + substitutionPreviewSuffix
+	if err := r.writeOwnedConfigMap(ctx, kubeClient, obj, name, preview.Revision,
+		map[string]string{substitutionPreviewKey: string(data)}); err != nil {
+		return fmt.Errorf("failed to write the substitution preview: %w", err)
+	}
+
+	msg := fmt.Sprintf("Substitution of revision %s previewed in ConfigMap '%s', all %d variable(s) resolved",
+		preview.Revision, name, len(preview.Variables))
+	if len(preview.Unresolved) > 0 {
+		msg = fmt.Sprintf("Substitution of revision %s previewed in ConfigMap '%s', %d variable(s) unresolved: %s",
+			preview.Revision, name, len(preview.Unresolved), strings.Join(preview.Unresolved, ", "))
+		r.event(obj, preview.Revision, eventv1.EventSeverityError, msg, nil)
+	}
+
+	ctrl.LoggerFrom(ctx).Info(msg)
+	conditions.MarkUnknown(obj, meta.ReadyCondition, kustomizev1.SubstitutionPreviewReason, msg)
+	conditions.Delete(obj, meta.ReconcilingCondition)
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/kustomize/api/provider"
+	"sigs.k8s.io/kustomize/api/resource"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+)
+
+func TestSubstitutionPreview(t *testing.T) {
+	newResource := provider.NewDefaultDepProvider().GetResourceFactory().FromMap
+
+	vars := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vars", Namespace: "default"},
+		Data:       map[string]string{"region": "eu-west-1", "replicas": "2"},
+	}
+	secretVars := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret-vars", Namespace: "default"},
+		Data:       map[string][]byte{"password": []byte("super-secret"), "pin": []byte("42")},
+	}
+	obj := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "app-uid"},
+		Spec: kustomizev1.KustomizationSpec{
+			PostBuild: &kustomizev1.PostBuild{
+				Substitute: map[string]string{"replicas": "3", "env": "staging"},
+				SubstituteFrom: []kustomizev1.SubstituteReference{
+					{Kind: "ConfigMap", Name: "vars"},
+					{Kind: "Secret", Name: "secret-vars"},
+					{Kind: "ConfigMap", Name: "missing", Optional: true},
+				},
+			},
+		},
+	}
+	newPreview := func(g *WithT, r *KustomizationReconciler, obj *kustomizev1.Kustomization) *substitutionPreview {
+		preview, err := r.newSubstitutionPreview(context.Background(), obj, "v1")
+		g.Expect(err).ToNot(HaveOccurred())
+		return preview
+	}
+	newReconciler := func() *KustomizationReconciler {
+		return &KustomizationReconciler{
+			Client:        fake.NewClientBuilder().WithObjects(vars, secretVars).Build(),
+			EventRecorder: record.NewFakeRecorder(10),
+		}
+	}
+
+	t.Run("reports unresolved variables and redacts secrets", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r := newReconciler()
+		preview := newPreview(g, r, obj)
+
+		config := newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "config-${env}", "namespace": "default"},
+			"data": map[string]interface{}{
+				"region":   "${region}",
+				"replicas": "${replicas}",
+				"password": "${password}",
+				"pin":      "${pin}",
+				"zone":     "${zone}",
+				"tier":     "${tier:=free}",
+				"nested":   "${owner:-${team}}",
+			},
+		})
+		credentials := newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]interface{}{"name": "credentials", "namespace": "default"},
+			"stringData": map[string]interface{}{"token": "${password}"},
+		})
+		disabled := newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":        "disabled",
+				"namespace":   "default",
+				"annotations": map[string]interface{}{"kustomize.toolkit.fluxcd.io/substitute": "disabled"},
+			},
+			"data": map[string]interface{}{"key": "${disabled}"},
+		})
+		for _, res := range []*resource.Resource{config, credentials, disabled} {
+			g.Expect(preview.add(context.Background(), res)).To(Succeed())
+		}
+		g.Expect(preview.finish([]*resource.Resource{config, credentials, disabled}, decryptor.NewRedactor())).To(Succeed())
+
+		g.Expect(preview.Unresolved).To(Equal([]string{"team", "zone"}))
+		g.Expect(preview.Variables).To(Equal([]substitutionVariable{
+			{Name: "env", Source: "inline", Value: "staging"},
+			{Name: "owner"},
+			{Name: "password", Source: "Secret/secret-vars", Value: redactedVariableValue},
+			{Name: "pin", Source: "Secret/secret-vars", Value: redactedVariableValue},
+			{Name: "region", Source: "ConfigMap/vars", Value: "eu-west-1"},
+			{Name: "replicas", Source: "inline", Value: "3"},
+			{Name: "team"},
+			{Name: "tier"},
+			{Name: "zone"},
+		}))
+
+		data, err := json.Marshal(preview)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(string(data)).ToNot(ContainSubstring("super-secret"))
+
+		var objects []map[string]interface{}
+		g.Expect(json.Unmarshal(preview.Objects, &objects)).To(Succeed())
+		g.Expect(objects).To(HaveLen(3))
+		g.Expect(objects[0]["metadata"]).To(HaveKeyWithValue("name", "config-staging"))
+		g.Expect(objects[0]["data"]).To(Equal(map[string]interface{}{
+			"region":   "eu-west-1",
+			"replicas": float64(3),
+			"password": redactedVariableValue,
+			"pin":      redactedVariableValue,
+			"zone":     nil,
+			"tier":     "free",
+			"nested":   nil,
+		}))
+		g.Expect(objects[1]["stringData"]).To(Equal(map[string]interface{}{"token": redactedSecretValue}))
+		g.Expect(objects[2]["data"]).To(Equal(map[string]interface{}{"key": "${disabled}"}))
+
+		// The resources of the build are not modified.
+		g.Expect(config.GetName()).To(Equal("config-${env}"))
+	})
+
+	t.Run("omits the resources removed from the build", func(t *testing.T) {
+		g := NewWithT(t)
+
+		preview := newPreview(g, newReconciler(), obj)
+		kept := newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "kept", "namespace": "default"},
+		})
+		removed := newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "removed", "namespace": "default"},
+		})
+		g.Expect(preview.add(context.Background(), kept)).To(Succeed())
+		g.Expect(preview.add(context.Background(), removed)).To(Succeed())
+		g.Expect(preview.finish([]*resource.Resource{kept}, nil)).To(Succeed())
+
+		var objects []map[string]interface{}
+		g.Expect(json.Unmarshal(preview.Objects, &objects)).To(Succeed())
+		g.Expect(objects).To(HaveLen(1))
+		g.Expect(objects[0]["metadata"]).To(HaveKeyWithValue("name", "kept"))
+	})
+
+	t.Run("fails on a missing substituteFrom reference", func(t *testing.T) {
+		g := NewWithT(t)
+
+		missing := obj.DeepCopy()
+		missing.Spec.PostBuild.SubstituteFrom = []kustomizev1.SubstituteReference{{Kind: "Secret", Name: "missing"}}
+		_, err := newReconciler().newSubstitutionPreview(context.Background(), missing, "v1")
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("substitute from 'Secret/missing' error"))
+	})
+
+	t.Run("writes the preview and reports the unresolved variables", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r := newReconciler()
+		o := obj.DeepCopy()
+		preview := newPreview(g, r, o)
+		res := newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "config", "namespace": "default"},
+			"data":       map[string]interface{}{"zone": "${zone}", "password": "${password}"},
+		})
+		g.Expect(preview.add(context.Background(), res)).To(Succeed())
+		g.Expect(preview.finish([]*resource.Resource{res}, nil)).To(Succeed())
+		g.Expect(r.reportSubstitutionPreview(context.Background(), r.Client, o, preview)).To(Succeed())
+
+		var cm corev1.ConfigMap
+		g.Expect(r.Get(context.Background(), types.NamespacedName{Name: "app-substitution-preview", Namespace: "default"}, &cm)).To(Succeed())
+		g.Expect(cm.GetOwnerReferences()).To(HaveLen(1))
+		g.Expect(cm.GetAnnotations()).To(HaveKeyWithValue(buildDumpRevisionAnnotation, "v1"))
+		g.Expect(cm.Data[substitutionPreviewKey]).To(ContainSubstring(`"unresolved": [`))
+		g.Expect(cm.Data[substitutionPreviewKey]).ToNot(ContainSubstring("super-secret"))
+
+		g.Expect(conditions.IsUnknown(o, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(o, meta.ReadyCondition)).To(Equal(kustomizev1.SubstitutionPreviewReason))
+		g.Expect(conditions.GetMessage(o, meta.ReadyCondition)).To(ContainSubstring("1 variable(s) unresolved: zone"))
+		g.Expect(r.EventRecorder.(*record.FakeRecorder).Events).To(HaveLen(1))
+	})
+}
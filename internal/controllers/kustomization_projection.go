@@ -0,0 +1,179 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	"github.com/fluxcd/pkg/ssa"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/kustomize/api/resource"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// projectedFromAnnotation records the namespace and name of the Secret a
+// projected Secret is projected from.
+const projectedFromAnnotation = "kustomize.toolkit.fluxcd.io/projected-from"
+
+// splitList returns the trimmed, non-empty elements of the comma separated
+// list.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// projectSecret returns the projections of the decrypted Secret to the
+// namespaces of its SecretProjectionAnnotation, other than its own, which
+// must be in the allowed namespaces. The projections hold the keys of the
+// data and stringData of the SecretProjectionKeysAnnotation, or all of them,
+// and are annotated with the Secret they are projected from. The Secret is
+// not modified.
+func projectSecret(res *resource.Resource, allowed []string) ([]*resource.Resource, error) {
+	annotations := res.GetAnnotations()
+	namespaces := splitList(annotations[kustomizev1.SecretProjectionAnnotation])
+	if len(namespaces) == 0 {
+		return nil, nil
+	}
+	source := fmt.Sprintf("%s/%s", res.GetNamespace(), res.GetName())
+
+	allowedSet := make(map[string]struct{}, len(allowed))
+	for _, ns := range allowed {
+		allowedSet[ns] = struct{}{}
+	}
+	var forbidden []string
+	for _, ns := range namespaces {
+		if _, ok := allowedSet[ns]; !ok && ns != res.GetNamespace() {
+			forbidden = append(forbidden, ns)
+		}
+	}
+	if len(forbidden) > 0 {
+		sort.Strings(forbidden)
+		return nil, fmt.Errorf("projection of Secret '%s' to namespace(s) '%s' is not allowed by the projection namespaces of the decryption",
+			source, strings.Join(forbidden, "', '"))
+	}
+
+	var keys map[string]struct{}
+	if v, ok := annotations[kustomizev1.SecretProjectionKeysAnnotation]; ok {
+		keys = make(map[string]struct{})
+		for _, k := range splitList(v) {
+			keys[k] = struct{}{}
+		}
+	}
+
+	var projections []*resource.Resource
+	seen := make(map[string]struct{}, len(namespaces))
+	for _, ns := range namespaces {
+		if _, ok := seen[ns]; ok || ns == res.GetNamespace() {
+			continue
+		}
+		seen[ns] = struct{}{}
+
+		p := res.DeepCopy()
+		pm, err := p.Map()
+		if err != nil {
+			return nil, err
+		}
+		if keys != nil {
+			for _, field := range []string{"data", "stringData"} {
+				data, ok := pm[field].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				for k := range data {
+					if _, ok := keys[k]; !ok {
+						delete(data, k)
+					}
+				}
+			}
+		}
+		u := unstructured.Unstructured{Object: pm}
+		u.SetNamespace(ns)
+		a := u.GetAnnotations()
+		delete(a, kustomizev1.SecretProjectionAnnotation)
+		delete(a, kustomizev1.SecretProjectionKeysAnnotation)
+		a[projectedFromAnnotation] = source
+		u.SetAnnotations(a)
+
+		data, err := json.Marshal(u.Object)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.UnmarshalJSON(data); err != nil {
+			return nil, err
+		}
+		projections = append(projections, p)
+	}
+	return projections, nil
+}
+
+// projectedObjects returns the objects which are projected from another
+// Secret.
+func projectedObjects(objects []*unstructured.Unstructured) []*unstructured.Unstructured {
+	var projected []*unstructured.Unstructured
+	for _, o := range objects {
+		if _, ok := o.GetAnnotations()[projectedFromAnnotation]; ok {
+			projected = append(projected, o)
+		}
+	}
+	return projected
+}
+
+// auditProjections logs and records an event of the projected Secrets which
+// were created or configured by the apply, with the Secrets they are
+// projected from.
+func (r *KustomizationReconciler) auditProjections(ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	revision string,
+	projected []*unstructured.Unstructured,
+	changeSet *ssa.ChangeSet) {
+	if len(projected) == 0 || changeSet == nil {
+		return
+	}
+	actions := make(map[string]ssa.Action, len(changeSet.Entries))
+	for _, entry := range changeSet.Entries {
+		actions[entry.Subject] = entry.Action
+	}
+
+	var audit strings.Builder
+	for _, o := range projected {
+		subject := ssa.FmtUnstructured(o)
+		action, ok := actions[subject]
+		if !ok || (action != ssa.CreatedAction && action != ssa.ConfiguredAction) {
+			continue
+		}
+		audit.WriteString(fmt.Sprintf("%s %s, projected from '%s'\n",
+			subject, action, o.GetAnnotations()[projectedFromAnnotation]))
+	}
+	if audit.Len() == 0 {
+		return
+	}
+	msg := "Projected decrypted Secrets:\n" + strings.TrimSuffix(audit.String(), "\n")
+	ctrl.LoggerFrom(ctx).Info(msg, "revision", revision)
+	r.event(obj, revision, eventv1.EventSeverityInfo, msg, nil)
+}
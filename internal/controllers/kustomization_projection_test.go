@@ -0,0 +1,157 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fluxcd/pkg/ssa"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/kustomize/api/provider"
+	"sigs.k8s.io/kustomize/api/resource"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestProjectSecret(t *testing.T) {
+	newResource := provider.NewDefaultDepProvider().GetResourceFactory().FromMap
+	newSecret := func(annotations map[string]interface{}) *resource.Resource {
+		return newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":        "credentials",
+				"namespace":   "central",
+				"annotations": annotations,
+			},
+			"data":       map[string]interface{}{"username": "YWRtaW4=", "password": "czNjcjN0"},
+			"stringData": map[string]interface{}{"token": "t0k3n"},
+		})
+	}
+
+	t.Run("projects to the permitted namespaces only", func(t *testing.T) {
+		g := NewWithT(t)
+
+		res := newSecret(map[string]interface{}{
+			kustomizev1.SecretProjectionAnnotation: "team-a, team-b,central,team-a",
+			"other":                                "value",
+		})
+		projections, err := projectSecret(res, []string{"team-a", "team-b", "team-c"})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(projections).To(HaveLen(2))
+
+		var namespaces []string
+		for _, p := range projections {
+			namespaces = append(namespaces, p.GetNamespace())
+			g.Expect(p.GetName()).To(Equal("credentials"))
+			g.Expect(p.GetAnnotations()).To(Equal(map[string]string{
+				projectedFromAnnotation: "central/credentials",
+				"other":                 "value",
+			}))
+			g.Expect(p.GetDataMap()).To(Equal(res.GetDataMap()))
+		}
+		g.Expect(namespaces).To(Equal([]string{"team-a", "team-b"}))
+
+		// The source Secret is not modified.
+		g.Expect(res.GetNamespace()).To(Equal("central"))
+		g.Expect(res.GetAnnotations()).To(HaveKey(kustomizev1.SecretProjectionAnnotation))
+	})
+
+	t.Run("fails for namespaces which are not permitted", func(t *testing.T) {
+		g := NewWithT(t)
+
+		res := newSecret(map[string]interface{}{
+			kustomizev1.SecretProjectionAnnotation: "team-a,team-z,kube-system",
+		})
+		projections, err := projectSecret(res, []string{"team-a"})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("projection of Secret 'central/credentials' to namespace(s) 'kube-system', 'team-z' is not allowed"))
+		g.Expect(projections).To(BeEmpty())
+
+		_, err = projectSecret(res, nil)
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("projects the selected keys", func(t *testing.T) {
+		g := NewWithT(t)
+
+		res := newSecret(map[string]interface{}{
+			kustomizev1.SecretProjectionAnnotation:     "team-a",
+			kustomizev1.SecretProjectionKeysAnnotation: "password, token",
+		})
+		projections, err := projectSecret(res, []string{"team-a"})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(projections).To(HaveLen(1))
+		g.Expect(projections[0].GetDataMap()).To(Equal(map[string]string{"password": "czNjcjN0"}))
+		m, err := projections[0].Map()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(m["stringData"]).To(Equal(map[string]interface{}{"token": "t0k3n"}))
+		g.Expect(projections[0].GetAnnotations()).ToNot(HaveKey(kustomizev1.SecretProjectionKeysAnnotation))
+		g.Expect(res.GetDataMap()).To(HaveLen(2))
+	})
+
+	t.Run("does not project without annotation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		projections, err := projectSecret(newSecret(nil), []string{"team-a"})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(projections).To(BeEmpty())
+	})
+}
+
+func TestKustomizationReconciler_auditProjections(t *testing.T) {
+	g := NewWithT(t)
+
+	newObject := func(namespace string, annotations map[string]string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind("Secret")
+		u.SetName("credentials")
+		u.SetNamespace(namespace)
+		u.SetAnnotations(annotations)
+		return u
+	}
+	objects := []*unstructured.Unstructured{
+		newObject("central", nil),
+		newObject("team-a", map[string]string{projectedFromAnnotation: "central/credentials"}),
+		newObject("team-b", map[string]string{projectedFromAnnotation: "central/credentials"}),
+	}
+	projected := projectedObjects(objects)
+	g.Expect(projected).To(Equal(objects[1:]))
+
+	changeSet := ssa.NewChangeSet()
+	changeSet.Add(ssa.ChangeSetEntry{Subject: ssa.FmtUnstructured(objects[0]), Action: ssa.CreatedAction})
+	changeSet.Add(ssa.ChangeSetEntry{Subject: ssa.FmtUnstructured(objects[1]), Action: ssa.CreatedAction})
+	changeSet.Add(ssa.ChangeSetEntry{Subject: ssa.FmtUnstructured(objects[2]), Action: ssa.UnchangedAction})
+
+	recorder := record.NewFakeRecorder(10)
+	r := &KustomizationReconciler{EventRecorder: recorder}
+	obj := &kustomizev1.Kustomization{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "central"}}
+	r.auditProjections(context.Background(), obj, "v1", projected, changeSet)
+	g.Expect(recorder.Events).To(HaveLen(1))
+	event := <-recorder.Events
+	g.Expect(event).To(ContainSubstring("Secret/team-a/credentials created, projected from 'central/credentials'"))
+	g.Expect(event).ToNot(ContainSubstring("team-b"))
+
+	// Nothing is audited if no projection changed.
+	r.auditProjections(context.Background(), obj, "v2", projected[1:], changeSet)
+	g.Expect(recorder.Events).To(BeEmpty())
+}
@@ -19,10 +19,12 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
 	"github.com/fluxcd/pkg/testserver"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	. "github.com/onsi/gomega"
@@ -441,3 +443,136 @@ data:
 	})
 
 }
+
+func TestKustomizationReconciler_PruneWait(t *testing.T) {
+	g := NewWithT(t)
+	id := "gc-wait-" + randStringRunes(5)
+	revision := "v1.0.0"
+	finalizer := "test.fluxcd.io/linger"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := func(withFinalized bool) []testserver.File {
+		files := []testserver.File{
+			{
+				Name: "secret.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: %[1]s
+stringData:
+  key: "%[1]s"
+`, id),
+			},
+		}
+		if withFinalized {
+			files = append(files, testserver.File{
+				Name: "config.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  finalizers:
+    - %[2]s
+data:
+  key: "%[1]s"
+`, id, finalizer),
+			})
+		}
+		return files
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests(true))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("gc-wait-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("gc-wait-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Timeout:  &metav1.Duration{Duration: 30 * time.Second},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+			PruneWait:       true,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	resultConfig := &corev1.ConfigMap{}
+	configKey := types.NamespacedName{Name: id, Namespace: id}
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+	g.Expect(k8sClient.Get(context.Background(), configKey, resultConfig)).To(Succeed())
+
+	revision = "v2.0.0"
+	artifact, err = testServer.ArtifactFromFiles(manifests(false))
+	g.Expect(err).NotTo(HaveOccurred())
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	t.Run("reports progress while waiting for deletion", func(t *testing.T) {
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileRunning(resultK) &&
+				strings.Contains(conditions.GetMessage(resultK, meta.ReconcilingCondition), "to be deleted")
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(k8sClient.Get(context.Background(), configKey, resultConfig)).To(Succeed())
+		g.Expect(resultConfig.GetDeletionTimestamp().IsZero()).To(BeFalse())
+		g.Expect(resultK.Status.LastAppliedRevision).ToNot(Equal(revision))
+	})
+
+	t.Run("reports deletion stuck on finalizers", func(t *testing.T) {
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileFailure(resultK)
+		}, 2*timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.PruneWaitFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(finalizer))
+		g.Expect(resultK.Status.LastAppliedRevision).ToNot(Equal(revision))
+	})
+
+	t.Run("finishes after the finalizer is removed", func(t *testing.T) {
+		g.Eventually(func() error {
+			if err := k8sClient.Get(context.Background(), configKey, resultConfig); err != nil {
+				return err
+			}
+			resultConfig.SetFinalizers(nil)
+			return k8sClient.Update(context.Background(), resultConfig)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		err := k8sClient.Get(context.Background(), configKey, resultConfig)
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fluxcd/pkg/runtime/conditions"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/cli-utils/pkg/object"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/inventory"
+	"github.com/fluxcd/kustomize-controller/internal/resultcache"
+)
+
+// configDigest returns the digest of the configuration the revision of the
+// Kustomization is built with: its spec and annotations, and the resource
+// versions of its decryption Secret, including an inherited default one, and
+// of the ConfigMaps and Secrets of spec.postBuild.substituteFrom.
+// A reconciliation or force apply request changes the annotations, and
+// with them the digest.
+func (r *KustomizationReconciler) configDigest(ctx context.Context,
+	obj *kustomizev1.Kustomization) (string, error) {
+	config := struct {
+		Spec        kustomizev1.KustomizationSpec `json:"spec"`
+		Annotations map[string]string             `json:"annotations,omitempty"`
+		Decryption  string                        `json:"decryption,omitempty"`
+		Substitutes []string                      `json:"substitutes,omitempty"`
+	}{
+		Spec:        obj.Spec,
+		Annotations: obj.GetAnnotations(),
+	}
+
+	decObj, err := r.withDefaultDecryption(ctx, obj)
+	if err != nil {
+		return "", err
+	}
+	if decObj.Spec.Decryption != nil && decObj.Spec.Decryption.SecretRef != nil {
+		key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: decObj.Spec.Decryption.SecretRef.Name}
+		version := ""
+		var secret corev1.Secret
+		if err := r.Get(ctx, key, &secret); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return "", fmt.Errorf("failed to get decryption Secret '%s': %w", key, err)
+			}
+		} else {
+			version = secret.GetResourceVersion()
+		}
+		config.Decryption = fmt.Sprintf("%s@%s", key.Name, version)
+	}
+
+	if obj.Spec.PostBuild != nil {
+		for _, ref := range obj.Spec.PostBuild.SubstituteFrom {
+			key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: ref.Name}
+			var o client.Object
+			switch ref.Kind {
+			case "ConfigMap":
+				o = &corev1.ConfigMap{}
+			case "Secret":
+				o = &corev1.Secret{}
+			default:
+				return "", fmt.Errorf("unsupported substitution kind '%s'", ref.Kind)
+			}
+			version := ""
+			if err := r.Get(ctx, key, o); err != nil {
+				if !apierrors.IsNotFound(err) {
+					return "", fmt.Errorf("failed to get %s '%s': %w", ref.Kind, key, err)
+				}
+			} else {
+				version = o.GetResourceVersion()
+			}
+			config.Substitutes = append(config.Substitutes, fmt.Sprintf("%s/%s@%s", ref.Kind, ref.Name, version))
+		}
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// objectVersions returns the resource versions of the objects of the
+// inventory of the Kustomization by the ID of their entry, which change with
+// any change of an object, including of its metadata. The objects are listed
+// by kind and namespace with the owner labels of the Kustomization, instead
+// of being read one by one. The objects which are not found, no longer carry
+// the owner labels, or are being deleted are omitted.
+func objectVersions(ctx context.Context, kubeClient client.Client,
+	obj *kustomizev1.Kustomization) (map[string]string, error) {
+	objects, err := inventory.List(obj.Status.Inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	type listKey struct {
+		gvk       schema.GroupVersionKind
+		namespace string
+	}
+	ids := make(map[string]struct{}, len(objects))
+	var keys []listKey
+	seen := make(map[listKey]struct{})
+	for _, o := range objects {
+		ids[object.UnstructuredToObjMetadata(o).String()] = struct{}{}
+		k := listKey{gvk: o.GroupVersionKind(), namespace: o.GetNamespace()}
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			keys = append(keys, k)
+		}
+	}
+
+	ownerLabels := client.MatchingLabels{
+		kustomizev1.GroupVersion.Group + "/name":      obj.GetName(),
+		kustomizev1.GroupVersion.Group + "/namespace": obj.GetNamespace(),
+	}
+	versions := make(map[string]string, len(objects))
+	for _, k := range keys {
+		// List the objects as unstructured, which are read directly from
+		// the API server instead of starting an informer per kind.
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(k.gvk.GroupVersion().WithKind(k.gvk.Kind + "List"))
+		if err := kubeClient.List(ctx, list, client.InNamespace(k.namespace), ownerLabels); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		for i := range list.Items {
+			u := &list.Items[i]
+			if !u.GetDeletionTimestamp().IsZero() {
+				continue
+			}
+			id := object.UnstructuredToObjMetadata(u).String()
+			if _, ok := ids[id]; ok {
+				versions[id] = u.GetResourceVersion()
+			}
+		}
+	}
+	return versions, nil
+}
+
+// reconcileUnchanged returns whether the reconciliation of the revision can
+// be skipped, because the same revision and configuration were reconciled
+// successfully within the TTL of the result cache, and the objects of the
+// inventory did not change since. Any error falls back to a full
+// reconciliation.
+func (r *KustomizationReconciler) reconcileUnchanged(ctx context.Context,
+	obj *kustomizev1.Kustomization, revision string) bool {
+	if r.resultCache == nil {
+		return false
+	}
+	log := ctrl.LoggerFrom(ctx)
+	key := client.ObjectKeyFromObject(obj).String()
+
+	// Frozen Kustomizations are built to report their drift, and the
+	// previous reconciliation must have succeeded for the spec in status.
+	if obj.Spec.Freeze ||
+		!conditions.IsReady(obj) ||
+		obj.Status.Inventory == nil ||
+		obj.Status.LastAppliedRevision != revision ||
+		obj.Status.ObservedGeneration != obj.Generation {
+		r.resultCache.Delete(key)
+		return false
+	}
+
+	digest, err := r.configDigest(ctx, obj)
+	if err != nil {
+		log.V(1).Info(fmt.Sprintf("Running a full reconciliation: %s", err.Error()))
+		return false
+	}
+	entry, ok := r.resultCache.Get(key, revision, digest)
+	if !ok {
+		return false
+	}
+
+	// Check for drift with the impersonated client, as the apply would.
+	decObj, err := r.withDefaultDecryption(ctx, obj)
+	if err != nil {
+		log.V(1).Info(fmt.Sprintf("Running a full reconciliation: %s", err.Error()))
+		return false
+	}
+	impersonation, err := r.getImpersonator(decObj, nil)
+	if err != nil {
+		log.V(1).Info(fmt.Sprintf("Running a full reconciliation: %s", err.Error()))
+		return false
+	}
+	kubeClient, _, err := impersonation.GetClient(ctx)
+	if err != nil {
+		log.V(1).Info(fmt.Sprintf("Running a full reconciliation: %s", err.Error()))
+		return false
+	}
+	versions, err := objectVersions(ctx, kubeClient, obj)
+	if err != nil {
+		log.V(1).Info(fmt.Sprintf("Running a full reconciliation: %s", err.Error()))
+		return false
+	}
+	if !equalVersions(versions, entry.Objects) {
+		log.Info("Drift detected since the last reconciliation, running a full reconciliation",
+			"revision", revision)
+		r.resultCache.Delete(key)
+		return false
+	}
+
+	log.Info(fmt.Sprintf("Skipping the build of the unchanged revision, last applied at %s",
+		entry.Time.Format(time.RFC3339)), "revision", revision)
+	return true
+}
+
+// recordResult records the result of the successful full reconciliation of
+// the revision in the result cache.
+func (r *KustomizationReconciler) recordResult(ctx context.Context,
+	kubeClient client.Client, obj *kustomizev1.Kustomization, revision string) {
+	if r.resultCache == nil {
+		return
+	}
+	key := client.ObjectKeyFromObject(obj).String()
+
+	digest, err := r.configDigest(ctx, obj)
+	if err != nil {
+		r.resultCache.Delete(key)
+		return
+	}
+	versions, err := objectVersions(ctx, kubeClient, obj)
+	if err != nil {
+		r.resultCache.Delete(key)
+		return
+	}
+	r.resultCache.Set(key, resultcache.Entry{
+		Revision:     revision,
+		ConfigDigest: digest,
+		Objects:      versions,
+		Time:         time.Now(),
+		TTL:          alignedResultTTL(r.resultCache.TTL(), r.getInterval(obj)),
+	})
+}
+
+// alignedResultTTL returns the TTL of the result cache rounded up to a whole
+// number of the intervals of a Kustomization. As the reconciliations on the
+// interval run shortly after a multiple of it, every n-th of them is a full
+// one, instead of the first one after the TTL, which runs up to an interval
+// later.
+func alignedResultTTL(ttl, interval time.Duration) time.Duration {
+	if interval <= 0 || ttl%interval == 0 {
+		return ttl
+	}
+	return (ttl/interval + 1) * interval
+}
+
+// equalVersions returns whether the object versions are the same.
+func equalVersions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
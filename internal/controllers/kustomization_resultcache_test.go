@@ -0,0 +1,331 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/http/fetch"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/tar"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	intmetrics "github.com/fluxcd/kustomize-controller/internal/metrics"
+	"github.com/fluxcd/kustomize-controller/internal/resultcache"
+)
+
+// resultCacheTest is a Kustomization which applied a ConfigMap from the
+// revision of its source, and of which the result is recorded.
+type resultCacheTest struct {
+	r        *KustomizationReconciler
+	c        client.Client
+	obj      *kustomizev1.Kustomization
+	src      *sourcev1.GitRepository
+	revision string
+	// fetches counts the requests for the artifact of the source, which
+	// are made by the full reconciliations only.
+	fetches *int32
+}
+
+func newResultCacheTest(t *testing.T) *resultCacheTest {
+	g := NewWithT(t)
+
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+
+	revision := "main@sha1:1234"
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "default",
+			Labels: map[string]string{
+				"kustomize.toolkit.fluxcd.io/name":      "app",
+				"kustomize.toolkit.fluxcd.io/namespace": "default",
+			},
+		},
+		Data: map[string]string{"key": "value"},
+	}
+	unrelated := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "default"},
+	}
+	keys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "default"},
+		Data:       map[string][]byte{"identity.agekey": []byte("key")},
+	}
+	values := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "values", Namespace: "default"},
+		Data:       map[string]string{"var": "value"},
+	}
+	obj := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Generation: 1},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: time.Minute},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Kind: sourcev1.GitRepositoryKind,
+				Name: "app",
+			},
+			PostBuild: &kustomizev1.PostBuild{
+				SubstituteFrom: []kustomizev1.SubstituteReference{{Kind: "ConfigMap", Name: "values"}},
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider:  "sops",
+				SecretRef: &meta.LocalObjectReference{Name: "sops-keys"},
+			},
+		},
+		Status: kustomizev1.KustomizationStatus{
+			ObservedGeneration:  1,
+			LastAppliedRevision: revision,
+			Inventory: &kustomizev1.ResourceInventory{
+				Entries: []kustomizev1.ResourceRef{{ID: "default_app__ConfigMap", Version: "v1"}},
+			},
+		},
+	}
+	conditions.MarkTrue(obj, meta.ReadyCondition, kustomizev1.ReconciliationSucceededReason, "Applied revision: "+revision)
+	src := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Status: sourcev1.GitRepositoryStatus{
+			Artifact: &sourcev1.Artifact{
+				URL:      server.URL + "/artifact.tar.gz",
+				Revision: revision,
+				Digest:   "sha256:1234",
+			},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithObjects(configMap, unrelated, keys, values, obj).Build()
+	g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(obj), obj)).To(Succeed())
+	r := &KustomizationReconciler{
+		Client:          c,
+		EventRecorder:   record.NewFakeRecorder(32),
+		resultCache:     resultcache.New(time.Hour),
+		artifactFetcher: fetch.NewArchiveFetcher(1, tar.UnlimitedUntarSize, tar.UnlimitedUntarSize, ""),
+	}
+	r.recordResult(context.Background(), c, obj, revision)
+
+	return &resultCacheTest{r: r, c: c, obj: obj, src: src, revision: revision, fetches: &fetches}
+}
+
+// reconcile runs the reconciliation of the latest revision of the source.
+func (rt *resultCacheTest) reconcile() error {
+	patcher := newStatusPatcher(rt.obj, rt.c)
+	return rt.r.reconcile(context.Background(), rt.obj, rt.src, patcher, intmetrics.NewPhaseTimer())
+}
+
+func TestKustomizationReconciler_reconcile_ResultCache(t *testing.T) {
+	t.Run("skips the build of an unchanged revision", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rt := newResultCacheTest(t)
+		g.Expect(rt.reconcile()).To(Succeed())
+		// The artifact is not fetched, and thus not built or decrypted.
+		g.Expect(atomic.LoadInt32(rt.fetches)).To(BeZero())
+		g.Expect(conditions.IsReady(rt.obj)).To(BeTrue())
+	})
+
+	t.Run("runs a full reconciliation on spec change", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rt := newResultCacheTest(t)
+		rt.obj.Spec.Path = "./other"
+		rt.obj.Generation = 2
+		g.Expect(rt.reconcile()).ToNot(Succeed())
+		g.Expect(atomic.LoadInt32(rt.fetches)).ToNot(BeZero())
+	})
+
+	t.Run("runs a full reconciliation on revision change", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rt := newResultCacheTest(t)
+		rt.src.Status.Artifact.Revision = "main@sha1:5678"
+		g.Expect(rt.reconcile()).ToNot(Succeed())
+		g.Expect(atomic.LoadInt32(rt.fetches)).ToNot(BeZero())
+	})
+}
+
+func TestKustomizationReconciler_reconcileUnchanged(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(g *WithT, rt *resultCacheTest)
+		want   bool
+	}{
+		{
+			name: "unchanged",
+			want: true,
+		},
+		{
+			name: "status update of the Kustomization",
+			change: func(g *WithT, rt *resultCacheTest) {
+				rt.obj.Status.LastHandledReconcileAt = "earlier"
+			},
+			want: true,
+		},
+		{
+			name: "spec changed in the same generation",
+			change: func(g *WithT, rt *resultCacheTest) {
+				rt.obj.Spec.Prune = true
+			},
+		},
+		{
+			name: "spec changed",
+			change: func(g *WithT, rt *resultCacheTest) {
+				rt.obj.Spec.Prune = true
+				rt.obj.Generation = 2
+			},
+		},
+		{
+			name: "reconciliation requested",
+			change: func(g *WithT, rt *resultCacheTest) {
+				rt.obj.SetAnnotations(map[string]string{meta.ReconcileRequestAnnotation: "now"})
+			},
+		},
+		{
+			name: "revision changed",
+			change: func(g *WithT, rt *resultCacheTest) {
+				rt.revision = "main@sha1:5678"
+			},
+		},
+		{
+			name: "substitution values changed",
+			change: func(g *WithT, rt *resultCacheTest) {
+				values := &corev1.ConfigMap{}
+				g.Expect(rt.c.Get(context.Background(), client.ObjectKey{Name: "values", Namespace: "default"}, values)).To(Succeed())
+				values.Data["var"] = "changed"
+				g.Expect(rt.c.Update(context.Background(), values)).To(Succeed())
+			},
+		},
+		{
+			name: "applied object drifted",
+			change: func(g *WithT, rt *resultCacheTest) {
+				configMap := &corev1.ConfigMap{}
+				g.Expect(rt.c.Get(context.Background(), client.ObjectKey{Name: "app", Namespace: "default"}, configMap)).To(Succeed())
+				configMap.Data["key"] = "drifted"
+				g.Expect(rt.c.Update(context.Background(), configMap)).To(Succeed())
+			},
+		},
+		{
+			name: "applied object metadata changed",
+			change: func(g *WithT, rt *resultCacheTest) {
+				configMap := &corev1.ConfigMap{}
+				g.Expect(rt.c.Get(context.Background(), client.ObjectKey{Name: "app", Namespace: "default"}, configMap)).To(Succeed())
+				configMap.SetAnnotations(map[string]string{"drifted": "true"})
+				g.Expect(rt.c.Update(context.Background(), configMap)).To(Succeed())
+			},
+		},
+		{
+			name: "applied object no longer labeled",
+			change: func(g *WithT, rt *resultCacheTest) {
+				configMap := &corev1.ConfigMap{}
+				g.Expect(rt.c.Get(context.Background(), client.ObjectKey{Name: "app", Namespace: "default"}, configMap)).To(Succeed())
+				configMap.SetLabels(nil)
+				g.Expect(rt.c.Update(context.Background(), configMap)).To(Succeed())
+			},
+		},
+		{
+			name: "other object changed",
+			change: func(g *WithT, rt *resultCacheTest) {
+				configMap := &corev1.ConfigMap{}
+				g.Expect(rt.c.Get(context.Background(), client.ObjectKey{Name: "unrelated", Namespace: "default"}, configMap)).To(Succeed())
+				configMap.Data = map[string]string{"key": "changed"}
+				g.Expect(rt.c.Update(context.Background(), configMap)).To(Succeed())
+			},
+			want: true,
+		},
+		{
+			name: "decryption Secret changed",
+			change: func(g *WithT, rt *resultCacheTest) {
+				secret := &corev1.Secret{}
+				g.Expect(rt.c.Get(context.Background(), client.ObjectKey{Name: "sops-keys", Namespace: "default"}, secret)).To(Succeed())
+				secret.Data["identity.agekey"] = []byte("rotated")
+				g.Expect(rt.c.Update(context.Background(), secret)).To(Succeed())
+			},
+		},
+		{
+			name: "applied object deleted",
+			change: func(g *WithT, rt *resultCacheTest) {
+				configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+				g.Expect(rt.c.Delete(context.Background(), configMap)).To(Succeed())
+			},
+		},
+		{
+			name: "last reconciliation failed",
+			change: func(g *WithT, rt *resultCacheTest) {
+				conditions.MarkFalse(rt.obj, meta.ReadyCondition, kustomizev1.BuildFailedReason, "failed")
+			},
+		},
+		{
+			name: "frozen",
+			change: func(g *WithT, rt *resultCacheTest) {
+				rt.obj.Spec.Freeze = true
+			},
+		},
+		{
+			name: "cache disabled",
+			change: func(g *WithT, rt *resultCacheTest) {
+				rt.r.resultCache = nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			rt := newResultCacheTest(t)
+			if tt.change != nil {
+				tt.change(g, rt)
+			}
+			g.Expect(rt.r.reconcileUnchanged(context.Background(), rt.obj, rt.revision)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestAlignedResultTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		interval time.Duration
+		want     time.Duration
+	}{
+		{name: "multiple of the interval", ttl: time.Hour, interval: 10 * time.Minute, want: time.Hour},
+		{name: "rounded up to the interval", ttl: time.Hour, interval: 7 * time.Minute, want: 63 * time.Minute},
+		{name: "shorter than the interval", ttl: time.Hour, interval: 2 * time.Hour, want: 2 * time.Hour},
+		{name: "without interval", ttl: time.Hour, want: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(alignedResultTTL(tt.ttl, tt.interval)).To(Equal(tt.want))
+		})
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_SkipUnchanged(t *testing.T) {
+	g := NewWithT(t)
+	id := "skip-unchanged-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := func(value string) []testserver.File {
+		return []testserver.File{
+			{
+				Name: "config.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unchanged
+  namespace: %[1]s
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: changed
+  namespace: %[1]s
+data:
+  key: %[2]s
+`, id, value),
+			},
+		}
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests("v1"))
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("skip-unchanged-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("skip-unchanged-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			Prune:    true,
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			SkipUnchanged: true,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	configMapValue := func(g *WithT, name string) string {
+		var configMap corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: name, Namespace: id}, &configMap)).To(Succeed())
+		return configMap.Data["key"]
+	}
+
+	t.Run("records the checksums in the inventory", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(2))
+		for _, entry := range resultK.Status.Inventory.Entries {
+			g.Expect(entry.Checksum).To(HaveLen(64))
+		}
+	})
+
+	// Drift the ConfigMap which does not change in the next revision.
+	var configMap corev1.ConfigMap
+	g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "unchanged", Namespace: id}, &configMap)).To(Succeed())
+	configMap.Data["key"] = "drifted"
+	g.Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+
+	t.Run("applies only the changed objects", func(t *testing.T) {
+		g := NewWithT(t)
+
+		artifact, err := testServer.ArtifactFromFiles(manifests("v2"))
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v2.0.0"
+		g.Expect(applyGitRepository(repositoryName, artifact, revision)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(configMapValue(g, "changed")).To(Equal("v2"))
+		g.Expect(configMapValue(g, "unchanged")).To(Equal("drifted"))
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(2))
+	})
+
+	t.Run("applies all the objects on request", func(t *testing.T) {
+		g := NewWithT(t)
+
+		forceApplyAt := metav1.Now().String()
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.SetAnnotations(map[string]string{
+				kustomizev1.ForceApplyAnnotation: forceApplyAt,
+			})
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastHandledForceApplyAt == forceApplyAt
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(isReconcileSuccess(resultK)).To(BeTrue())
+		g.Expect(configMapValue(g, "unchanged")).To(Equal("value"))
+	})
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/fluxcd/pkg/runtime/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// progressPatchInterval is the minimum interval between the status patches
+// which only report the progress of a reconciliation. A progress update in
+// a shorter interval after the last patch is written with the next one.
+const progressPatchInterval = 10 * time.Second
+
+// statusPatcher is the patch.SerialPatcher of the status of a Kustomization
+// during a reconciliation, which records the time of the last patch to batch
+// the progress updates of the reconciliation.
+type statusPatcher struct {
+	*patch.SerialPatcher
+
+	// interval is the minimum interval between progress patches.
+	interval time.Duration
+	// lastPatch is the time of the last patch. It is zero if there is none,
+	// so that the first progress update is always written.
+	lastPatch time.Time
+	// now returns the current time. Defaults to time.Now.
+	now func() time.Time
+}
+
+// newStatusPatcher returns a statusPatcher for the given object, which
+// batches the progress patches within progressPatchInterval.
+func newStatusPatcher(obj *kustomizev1.Kustomization, c client.Client) *statusPatcher {
+	return &statusPatcher{
+		SerialPatcher: patch.NewSerialPatcher(obj, c),
+		interval:      progressPatchInterval,
+		now:           time.Now,
+	}
+}
+
+// patched records a patch at the current time.
+func (p *statusPatcher) patched() {
+	p.lastPatch = p.now()
+}
+
+// progressDue returns whether a progress update is to be patched, i.e.
+// whether the interval elapsed since the last patch.
+func (p *statusPatcher) progressDue() bool {
+	return p.now().Sub(p.lastPatch) >= p.interval
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// statusWriteCounter is a client.Client which counts the status patches.
+type statusWriteCounter struct {
+	client.Client
+	writes int
+}
+
+func (c *statusWriteCounter) Status() client.SubResourceWriter {
+	return &countingStatusWriter{SubResourceWriter: c.Client.Status(), counter: c}
+}
+
+type countingStatusWriter struct {
+	client.SubResourceWriter
+	counter *statusWriteCounter
+}
+
+func (w *countingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch,
+	opts ...client.SubResourcePatchOption) error {
+	w.counter.writes++
+	return w.SubResourceWriter.Patch(ctx, obj, patch, opts...)
+}
+
+func TestKustomizationReconciler_patchProgress(t *testing.T) {
+	// reconcile reports the progress of a reconciliation applying the given
+	// number of objects as the reconcile func does, with the clock advanced
+	// by step before each progress update, and returns the status writes.
+	reconcile := func(g *WithT, objects int, step time.Duration) (int, *kustomizev1.Kustomization) {
+		obj := &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Generation: 1},
+		}
+		c := &statusWriteCounter{Client: fake.NewClientBuilder().WithObjects(obj).Build()}
+		g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(obj), obj)).To(Succeed())
+		r := &KustomizationReconciler{Client: c}
+		ctx := context.Background()
+
+		now := time.Now()
+		patcher := newStatusPatcher(obj, c)
+		patcher.now = func() time.Time { return now }
+		progress := func(msg string) {
+			now = now.Add(step)
+			conditions.MarkReconciling(obj, meta.ProgressingReason, msg)
+			g.Expect(r.patchProgress(ctx, obj, patcher)).To(Succeed())
+		}
+
+		// The start of the reconciliation is a checkpoint.
+		conditions.MarkUnknown(obj, meta.ReadyCondition, meta.ProgressingReason, "Reconciliation in progress")
+		conditions.MarkReconciling(obj, meta.ProgressingReason, "Fetching manifests")
+		g.Expect(r.patch(ctx, obj, patcher)).To(Succeed())
+
+		obj.Status.LastAttemptedRevision = "main@sha1:1234"
+		progress("Building manifests")
+		progress("Detecting drift")
+
+		obj.Status.Inventory = &kustomizev1.ResourceInventory{}
+		for i := 0; i < objects; i++ {
+			obj.Status.Inventory.Entries = append(obj.Status.Inventory.Entries, kustomizev1.ResourceRef{
+				ID:      fmt.Sprintf("default_app-%d__ConfigMap", i),
+				Version: "v1",
+			})
+		}
+
+		// The health checks are a checkpoint, as they wait for the objects.
+		conditions.MarkReconciling(obj, meta.ProgressingReason, "Running health checks")
+		conditions.MarkUnknown(obj, kustomizev1.HealthyCondition, meta.ProgressingReason, "Running health checks")
+		g.Expect(r.patch(ctx, obj, patcher)).To(Succeed())
+		now = now.Add(step)
+		conditions.MarkTrue(obj, kustomizev1.HealthyCondition, meta.SucceededReason, "Health check passed")
+		g.Expect(r.patchProgress(ctx, obj, patcher)).To(Succeed())
+
+		conditions.MarkTrue(obj, meta.ReadyCondition, kustomizev1.ReconciliationSucceededReason, "Applied revision")
+		g.Expect(r.finalizeStatus(ctx, obj, patcher)).To(Succeed())
+
+		result := &kustomizev1.Kustomization{}
+		g.Expect(c.Get(ctx, client.ObjectKeyFromObject(obj), result)).To(Succeed())
+		return c.writes, result
+	}
+
+	t.Run("batches the progress updates of a multi-object reconciliation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		writes, result := reconcile(g, 500, time.Second)
+		// The start, the health checks and the result are written, each
+		// with a patch of the status and one of the conditions.
+		g.Expect(writes).To(Equal(3 * 2))
+		g.Expect(result.Status.Inventory.Entries).To(HaveLen(500))
+		g.Expect(result.Status.LastAttemptedRevision).To(Equal("main@sha1:1234"))
+		g.Expect(conditions.IsReady(result)).To(BeTrue())
+		g.Expect(conditions.IsTrue(result, kustomizev1.HealthyCondition)).To(BeTrue())
+		g.Expect(conditions.Has(result, meta.ReconcilingCondition)).To(BeFalse())
+	})
+
+	t.Run("bounds the writes regardless of the number of objects", func(t *testing.T) {
+		g := NewWithT(t)
+
+		few, _ := reconcile(g, 1, time.Second)
+		many, _ := reconcile(g, 5000, time.Second)
+		g.Expect(many).To(Equal(few))
+	})
+
+	t.Run("writes the first progress update", func(t *testing.T) {
+		g := NewWithT(t)
+
+		obj := &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Generation: 1},
+		}
+		c := &statusWriteCounter{Client: fake.NewClientBuilder().WithObjects(obj).Build()}
+		g.Expect(c.Get(context.Background(), client.ObjectKeyFromObject(obj), obj)).To(Succeed())
+		r := &KustomizationReconciler{Client: c}
+
+		patcher := newStatusPatcher(obj, c)
+		g.Expect(patcher.progressDue()).To(BeTrue())
+		conditions.MarkReconciling(obj, meta.ProgressingReason, "Building manifests")
+		g.Expect(r.patchProgress(context.Background(), obj, patcher)).To(Succeed())
+		g.Expect(c.writes).ToNot(BeZero())
+		g.Expect(patcher.progressDue()).To(BeFalse())
+	})
+
+	t.Run("writes the progress updates at coarse checkpoints", func(t *testing.T) {
+		g := NewWithT(t)
+
+		writes, _ := reconcile(g, 500, progressPatchInterval)
+		// Each progress update is written once the interval elapsed.
+		g.Expect(writes).To(Equal(6 * 2))
+	})
+}
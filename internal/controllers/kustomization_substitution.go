@@ -0,0 +1,223 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/drone/envsubst/parse"
+	generator "github.com/fluxcd/pkg/kustomize"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kustomize/api/resource"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// varNameRegex matches the valid variable names, as validated by the
+// substitution engine.
+var varNameRegex = regexp.MustCompile(`^[_[:alpha:]][_[:alpha:][:digit:]]*$`)
+
+// loadSubstitutionVars loads the variables of the post build substitution of
+// the Kustomization from the data of the SubstituteFrom references, which
+// are overridden by the Substitute ones, as the substitution engine does.
+func (r *KustomizationReconciler) loadSubstitutionVars(ctx context.Context,
+	obj *kustomizev1.Kustomization) (map[string]substitutionVariable, error) {
+	vars := make(map[string]substitutionVariable)
+	if obj.Spec.PostBuild == nil {
+		return vars, nil
+	}
+	for _, reference := range obj.Spec.PostBuild.SubstituteFrom {
+		namespacedName := types.NamespacedName{Namespace: obj.GetNamespace(), Name: reference.Name}
+		source := fmt.Sprintf("%s/%s", reference.Kind, reference.Name)
+		switch reference.Kind {
+		case "ConfigMap":
+			resource := &corev1.ConfigMap{}
+			if err := r.Get(ctx, namespacedName, resource); err != nil {
+				if reference.Optional && apierrors.IsNotFound(err) {
+					continue
+				}
+				return nil, fmt.Errorf("substitute from '%s' error: %w", source, err)
+			}
+			for k, v := range resource.Data {
+				vars[k] = substitutionVariable{Name: k, Source: source, Value: strings.ReplaceAll(v, "\n", "")}
+			}
+		case "Secret":
+			resource := &corev1.Secret{}
+			if err := r.Get(ctx, namespacedName, resource); err != nil {
+				if reference.Optional && apierrors.IsNotFound(err) {
+					continue
+				}
+				return nil, fmt.Errorf("substitute from '%s' error: %w", source, err)
+			}
+			for k, v := range resource.Data {
+				vars[k] = substitutionVariable{Name: k, Source: source, Value: strings.ReplaceAll(string(v), "\n", "")}
+			}
+		}
+	}
+	for k, v := range obj.Spec.PostBuild.Substitute {
+		vars[k] = substitutionVariable{Name: k, Source: inlineSubstitutionSource, Value: strings.ReplaceAll(v, "\n", "")}
+	}
+	return vars, nil
+}
+
+// variableRefs returns the names of the variables referenced in the data,
+// and whether they are referenced at least once without a default value.
+func variableRefs(data string) (map[string]bool, error) {
+	tree, err := parse.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]bool)
+	addVariableRefs(refs, tree.Root)
+	return refs, nil
+}
+
+func addVariableRefs(refs map[string]bool, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		for _, c := range n.Nodes {
+			addVariableRefs(refs, c)
+		}
+	case *parse.FuncNode:
+		for _, c := range n.Args {
+			addVariableRefs(refs, c)
+		}
+		refs[n.Param] = refs[n.Param] || !hasDefaultValue(n)
+	}
+}
+
+// hasDefaultValue returns whether the function substitutes a value when the
+// variable is not defined, e.g. '${var:=default}'.
+func hasDefaultValue(n *parse.FuncNode) bool {
+	if len(n.Args) == 0 {
+		return false
+	}
+	switch n.Name {
+	case "-", "=", ":-", ":=", "+", ":+", ":?":
+		return true
+	}
+	return false
+}
+
+// variableSubstitution runs the post build variable substitution with the
+// given variables, and handles the references of the variables which are
+// not defined according to the SubstituteMissing policy.
+type variableSubstitution struct {
+	vars   map[string]string
+	policy string
+}
+
+// newVariableSubstitution loads the variables of the Kustomization, and
+// returns a variableSubstitution of them if a SubstituteMissing policy is
+// set. It returns nil otherwise, in which case the substitution engine loads
+// the variables for each resource.
+func (r *KustomizationReconciler) newVariableSubstitution(ctx context.Context,
+	obj *kustomizev1.Kustomization) (*variableSubstitution, error) {
+	if obj.Spec.PostBuild == nil || obj.Spec.PostBuild.SubstituteMissing == "" {
+		return nil, nil
+	}
+	vars, err := r.loadSubstitutionVars(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	s := &variableSubstitution{
+		vars:   make(map[string]string, len(vars)),
+		policy: obj.Spec.PostBuild.SubstituteMissing,
+	}
+	for k, v := range vars {
+		s.vars[k] = v.Value
+	}
+	return s, nil
+}
+
+// substituteVariables runs the post build variable substitution on the
+// resource, with the variableSubstitution if not nil, and with the
+// substitution engine otherwise.
+func (r *KustomizationReconciler) substituteVariables(ctx context.Context,
+	u unstructured.Unstructured, s *variableSubstitution, res *resource.Resource) (*resource.Resource, error) {
+	if s == nil {
+		return generator.SubstituteVariables(ctx, r.Client, u, res, false)
+	}
+	return s.substitute(ctx, res)
+}
+
+// substitute runs the substitution engine on the resource with the
+// variables, without reading the cluster. The variables referenced in the
+// resource which are not defined are defined for the engine according to
+// the policy: with an empty value, as the engine substitutes them when at
+// least one variable is defined, or with their own reference to keep them.
+// The ones only referenced with a default value are defined as empty, for
+// the default value to be substituted.
+// It returns nil for the resources which opt out of the substitution, as
+// the engine does.
+func (s *variableSubstitution) substitute(ctx context.Context, res *resource.Resource) (*resource.Resource, error) {
+	vars := make(map[string]interface{}, len(s.vars))
+	for k, v := range s.vars {
+		vars[k] = v
+	}
+
+	if s.policy != "" {
+		data, err := res.AsYAML()
+		if err != nil {
+			return nil, err
+		}
+		refs, err := variableRefs(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("variable substitution failed: %w", err)
+		}
+		var undefined []string
+		for name, required := range refs {
+			if _, ok := vars[name]; ok || !varNameRegex.MatchString(name) {
+				continue
+			}
+			vars[name] = ""
+			if required {
+				undefined = append(undefined, name)
+				if s.policy == kustomizev1.KeepValue {
+					vars[name] = "${" + name + "}"
+				}
+			}
+		}
+		if s.policy == kustomizev1.ErrorValue && len(undefined) > 0 && !substitutionDisabled(res) {
+			sort.Strings(undefined)
+			return nil, fmt.Errorf("undefined variable(s) without a default value: %s", strings.Join(undefined, ", "))
+		}
+	}
+
+	// The engine only reads the Substitute variables of the Kustomization
+	// in dry-run mode.
+	u := unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"postBuild": map[string]interface{}{"substitute": vars},
+		},
+	}}
+	return generator.SubstituteVariables(ctx, nil, u, res, true)
+}
+
+// substitutionDisabled returns whether the resource opts out of the
+// substitution with a label or an annotation.
+func substitutionDisabled(res *resource.Resource) bool {
+	key := fmt.Sprintf("%s/substitute", kustomizev1.GroupVersion.Group)
+	return res.GetLabels()[key] == kustomizev1.DisabledValue || res.GetAnnotations()[key] == kustomizev1.DisabledValue
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/kustomize/api/provider"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestVariableSubstitution_substitute(t *testing.T) {
+	newResource := provider.NewDefaultDepProvider().GetResourceFactory().FromMap
+	data := map[string]interface{}{
+		"defined":   "${region}",
+		"undefined": "${zone}",
+		"default":   "${tier:=free}",
+		"escaped":   "$${zone}",
+	}
+
+	tests := []struct {
+		name    string
+		policy  string
+		vars    map[string]string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:    "error",
+			policy:  kustomizev1.ErrorValue,
+			vars:    map[string]string{"region": "eu-west-1"},
+			wantErr: "undefined variable(s) without a default value: zone",
+		},
+		{
+			name:   "keep",
+			policy: kustomizev1.KeepValue,
+			vars:   map[string]string{"region": "eu-west-1"},
+			want: map[string]interface{}{
+				"defined":   "eu-west-1",
+				"undefined": "${zone}",
+				"default":   "free",
+				"escaped":   "${zone}",
+			},
+		},
+		{
+			name:   "empty",
+			policy: kustomizev1.EmptyValue,
+			vars:   map[string]string{"region": "eu-west-1"},
+			want: map[string]interface{}{
+				"defined":   "eu-west-1",
+				"undefined": "",
+				"default":   "free",
+				"escaped":   "${zone}",
+			},
+		},
+		{
+			name:   "keep without defined variables",
+			policy: kustomizev1.KeepValue,
+			want: map[string]interface{}{
+				"defined":   "${region}",
+				"undefined": "${zone}",
+				"default":   "free",
+				"escaped":   "${zone}",
+			},
+		},
+		{
+			name:   "empty without defined variables",
+			policy: kustomizev1.EmptyValue,
+			want: map[string]interface{}{
+				"defined":   "",
+				"undefined": "",
+				"default":   "free",
+				"escaped":   "${zone}",
+			},
+		},
+		{
+			name:    "error without defined variables",
+			policy:  kustomizev1.ErrorValue,
+			wantErr: "undefined variable(s) without a default value: region, zone",
+		},
+		{
+			name:   "error with all variables defined",
+			policy: kustomizev1.ErrorValue,
+			vars:   map[string]string{"region": "eu-west-1", "zone": "a"},
+			want: map[string]interface{}{
+				"defined":   "eu-west-1",
+				"undefined": "a",
+				"default":   "free",
+				"escaped":   "${zone}",
+			},
+		},
+		{
+			name: "no policy",
+			vars: map[string]string{"region": "eu-west-1"},
+			want: map[string]interface{}{
+				"defined":   "eu-west-1",
+				"undefined": "",
+				"default":   "free",
+				"escaped":   "${zone}",
+			},
+		},
+		{
+			name: "no policy without defined variables",
+			want: data,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			res := newResource(map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"name": "config", "namespace": "default"},
+				"data":       data,
+			})
+			s := &variableSubstitution{vars: tt.vars, policy: tt.policy}
+			out, err := s.substitute(context.Background(), res)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(out).ToNot(BeNil())
+			g.Expect(out.GetDataMap()).To(Equal(toStringMap(tt.want)))
+		})
+	}
+
+	t.Run("skips the resources which opt out", func(t *testing.T) {
+		g := NewWithT(t)
+
+		res := newResource(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      "config",
+				"namespace": "default",
+				"labels":    map[string]interface{}{"kustomize.toolkit.fluxcd.io/substitute": "disabled"},
+			},
+			"data": data,
+		})
+		s := &variableSubstitution{policy: kustomizev1.ErrorValue}
+		out, err := s.substitute(context.Background(), res)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(out).To(BeNil())
+		g.Expect(res.GetDataMap()).To(Equal(toStringMap(data)))
+	})
+}
+
+func TestKustomizationReconciler_newVariableSubstitution(t *testing.T) {
+	vars := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vars", Namespace: "default"},
+		Data:       map[string]string{"region": "eu-west-1", "zone": "a\n"},
+	}
+	secretVars := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret-vars", Namespace: "default"},
+		Data:       map[string][]byte{"region": []byte("eu-central-1"), "password": []byte("secret")},
+	}
+	r := &KustomizationReconciler{Client: fake.NewClientBuilder().WithObjects(vars, secretVars).Build()}
+	obj := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: kustomizev1.KustomizationSpec{
+			PostBuild: &kustomizev1.PostBuild{
+				Substitute: map[string]string{"password": "inline"},
+				SubstituteFrom: []kustomizev1.SubstituteReference{
+					{Kind: "ConfigMap", Name: "vars"},
+					{Kind: "Secret", Name: "secret-vars"},
+					{Kind: "Secret", Name: "missing", Optional: true},
+				},
+				SubstituteMissing: kustomizev1.KeepValue,
+			},
+		},
+	}
+
+	t.Run("loads the variables by precedence", func(t *testing.T) {
+		g := NewWithT(t)
+
+		s, err := r.newVariableSubstitution(context.Background(), obj)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(s.policy).To(Equal(kustomizev1.KeepValue))
+		g.Expect(s.vars).To(Equal(map[string]string{
+			"region":   "eu-central-1",
+			"zone":     "a",
+			"password": "inline",
+		}))
+	})
+
+	t.Run("returns nil without a policy", func(t *testing.T) {
+		g := NewWithT(t)
+
+		o := obj.DeepCopy()
+		o.Spec.PostBuild.SubstituteMissing = ""
+		s, err := r.newVariableSubstitution(context.Background(), o)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(s).To(BeNil())
+	})
+
+	t.Run("fails on a missing reference", func(t *testing.T) {
+		g := NewWithT(t)
+
+		o := obj.DeepCopy()
+		o.Spec.PostBuild.SubstituteFrom = append(o.Spec.PostBuild.SubstituteFrom,
+			kustomizev1.SubstituteReference{Kind: "ConfigMap", Name: "missing"})
+		_, err := r.newVariableSubstitution(context.Background(), o)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("substitute from 'ConfigMap/missing' error"))
+	})
+}
+
+func toStringMap(m map[string]interface{}) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v.(string)
+	}
+	return out
+}
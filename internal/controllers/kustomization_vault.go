@@ -0,0 +1,76 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
+)
+
+// vaultTokenExpirationSeconds is the expiry of the service account tokens
+// logged in with to the Vault Kubernetes auth method, the minimum of the
+// TokenRequest API, as they are only used for a single login.
+const vaultTokenExpirationSeconds = 600
+
+// serviceAccountTokenRequester returns a hcvault.ServiceAccountTokenRequester
+// which requests the tokens with the TokenRequest API of the clientset.
+func serviceAccountTokenRequester(clientset kubernetes.Interface) hcvault.ServiceAccountTokenRequester {
+	return func(ctx context.Context, namespace, name, audience string) (string, error) {
+		expiration := int64(vaultTokenExpirationSeconds)
+		tr, err := clientset.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, name, &authenticationv1.TokenRequest{
+			Spec: authenticationv1.TokenRequestSpec{
+				Audiences:         []string{audience},
+				ExpirationSeconds: &expiration,
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return "", err
+		}
+		if tr.Status.Token == "" {
+			return "", fmt.Errorf("no token in TokenRequest status")
+		}
+		return tr.Status.Token, nil
+	}
+}
+
+// vaultServiceAccount returns the service account of the Kustomization which
+// logs in to the Vault Kubernetes auth method, i.e. the one it impersonates
+// or else the default service account. It has no name when the Kustomization
+// has no service account, or one of another namespace which can not be
+// impersonated.
+func (r *KustomizationReconciler) vaultServiceAccount(obj *kustomizev1.Kustomization) types.NamespacedName {
+	sa := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.Spec.ServiceAccountName}
+	if sa.Name == "" {
+		sa.Name = r.DefaultServiceAccount
+		return sa
+	}
+	if ns := obj.Spec.ServiceAccountNamespace; ns != "" && ns != sa.Namespace {
+		if !r.AllowCrossNamespaceImpersonation || obj.Spec.KubeConfig != nil {
+			return types.NamespacedName{}
+		}
+		sa.Namespace = ns
+	}
+	return sa
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+	"github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
+)
+
+func TestServiceAccountTokenRequester(t *testing.T) {
+	g := NewWithT(t)
+
+	clientset := fake.NewSimpleClientset()
+	var requests []*authenticationv1.TokenRequest
+	clientset.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		create := action.(k8stesting.CreateAction)
+		if create.GetSubresource() != "token" || create.GetNamespace() != "tenant" {
+			return false, nil, nil
+		}
+		tr := create.GetObject().(*authenticationv1.TokenRequest).DeepCopy()
+		requests = append(requests, tr)
+		tr.Status.Token = "service-account-jwt"
+		return true, tr, nil
+	})
+
+	token, err := serviceAccountTokenRequester(clientset)(context.TODO(), "tenant", "app", hcvault.KubernetesAuthAudience)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("service-account-jwt"))
+	g.Expect(requests).To(HaveLen(1))
+	g.Expect(requests[0].Spec.Audiences).To(Equal([]string{hcvault.KubernetesAuthAudience}))
+	g.Expect(*requests[0].Spec.ExpirationSeconds).To(Equal(int64(vaultTokenExpirationSeconds)))
+}
+
+func TestKustomizationReconciler_vaultServiceAccount(t *testing.T) {
+	tests := []struct {
+		name           string
+		spec           kustomizev1.KustomizationSpec
+		defaultSA      string
+		allowCrossNS   bool
+		serviceAccount types.NamespacedName
+	}{
+		{
+			name:           "service account",
+			spec:           kustomizev1.KustomizationSpec{ServiceAccountName: "app"},
+			serviceAccount: types.NamespacedName{Namespace: "tenant", Name: "app"},
+		},
+		{
+			name:           "default service account",
+			defaultSA:      "default",
+			serviceAccount: types.NamespacedName{Namespace: "tenant", Name: "default"},
+		},
+		{
+			name:           "without service account",
+			serviceAccount: types.NamespacedName{Namespace: "tenant"},
+		},
+		{
+			name:           "cross-namespace service account",
+			spec:           kustomizev1.KustomizationSpec{ServiceAccountName: "app", ServiceAccountNamespace: "other"},
+			allowCrossNS:   true,
+			serviceAccount: types.NamespacedName{Namespace: "other", Name: "app"},
+		},
+		{
+			name: "cross-namespace service account without impersonation",
+			spec: kustomizev1.KustomizationSpec{ServiceAccountName: "app", ServiceAccountNamespace: "other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := &KustomizationReconciler{
+				DefaultServiceAccount:            tt.defaultSA,
+				AllowCrossNamespaceImpersonation: tt.allowCrossNS,
+			}
+			obj := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "tenant"},
+				Spec:       tt.spec,
+			}
+			g.Expect(r.vaultServiceAccount(obj)).To(Equal(tt.serviceAccount))
+		})
+	}
+}
+
+// recordingTokenRequester is a hcvault.ServiceAccountTokenRequester which
+// records the requested service accounts, as 'namespace/name:audience', and
+// denies all the requests.
+type recordingTokenRequester struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (r *recordingTokenRequester) RequestToken(_ context.Context, namespace, name, audience string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, namespace+"/"+name+":"+audience)
+	return "", errors.New("token request denied")
+}
+
+func TestKustomizationReconciler_configureDecryptor_VaultKubernetesAuth(t *testing.T) {
+	// vaultEncrypted is a SOPS document of which the data key is encrypted
+	// with a Vault Transit key, so that decrypting it logs in to Vault.
+	vaultEncrypted := []byte(`data: ENC[AES256_GCM,data:AAAA,iv:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=,tag:AAAAAAAAAAAAAAAAAAAAAA==,type:str]
+sops:
+    hc_vault:
+        - vault_address: http://127.0.0.1:0
+          engine_path: sops
+          key_name: app
+          created_at: "2023-01-01T00:00:00Z"
+          enc: vault:v1:encrypted
+    lastmodified: "2023-01-01T00:00:00Z"
+    mac: ENC[AES256_GCM,data:AAAA,iv:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=,tag:AAAAAAAAAAAAAAAAAAAAAA==,type:str]
+    version: 3.7.3
+`)
+
+	tests := []struct {
+		name     string
+		spec     kustomizev1.KustomizationSpec
+		auth     string
+		wantErr  string
+		requests []string
+	}{
+		{
+			name:     "requests the token of the service account of the Kustomization",
+			spec:     kustomizev1.KustomizationSpec{ServiceAccountName: "app"},
+			auth:     "role: sops\n",
+			requests: []string{"tenant/app:" + hcvault.KubernetesAuthAudience},
+		},
+		{
+			name:     "requests the token of the default service account",
+			auth:     "role: sops\n",
+			requests: []string{"tenant/default:" + hcvault.KubernetesAuthAudience},
+		},
+		{
+			name:    "can not select the service account in the decryption Secret",
+			spec:    kustomizev1.KustomizationSpec{ServiceAccountName: "app"},
+			auth:    "role: sops\nserviceAccountName: admin\n",
+			wantErr: "failed to unmarshal Vault Kubernetes auth file",
+		},
+		{
+			name:    "can not select the service account namespace in the decryption Secret",
+			spec:    kustomizev1.KustomizationSpec{ServiceAccountName: "app"},
+			auth:    "role: sops\nserviceAccountNamespace: kube-system\n",
+			wantErr: "failed to unmarshal Vault Kubernetes auth file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "tenant"},
+				Data: map[string][]byte{
+					decryptor.DecryptionVaultKubernetesAuthFile: []byte(tt.auth),
+				},
+			}
+			obj := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "tenant"},
+				Spec:       tt.spec,
+			}
+			obj.Spec.Decryption = &kustomizev1.Decryption{
+				Provider:  decryptor.DecryptionProviderSOPS,
+				SecretRef: &meta.LocalObjectReference{Name: secret.Name},
+			}
+
+			tokens := &recordingTokenRequester{}
+			r := &KustomizationReconciler{
+				DefaultServiceAccount: "default",
+				vaultTokens:           tokens.RequestToken,
+			}
+			dec, cleanup, err := decryptor.NewTempDecryptor("", fakeclient.NewClientBuilder().WithObjects(secret).Build(), obj)
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+			r.configureDecryptor(context.TODO(), obj, dec, nil)
+
+			err = dec.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				g.Expect(tokens.requests).To(BeEmpty())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+
+			_, err = dec.SopsDecryptWithFormat(vaultEncrypted, formats.Yaml, formats.Yaml)
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(fmt.Sprint(err)).To(ContainSubstring("token request denied"))
+			g.Expect(tokens.requests).To(Equal(tt.requests))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fluxcd/pkg/ssa"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// postApplyWebhookMaxTimeout is the maximum duration of a post-apply webhook
+// request, whatever the timeout of the webhook or of the Kustomization.
+const postApplyWebhookMaxTimeout = 5 * time.Minute
+
+// postApplyWebhookRequest is the payload sent to the post-apply webhook.
+type postApplyWebhookRequest struct {
+	Name      string                   `json:"name"`
+	Namespace string                   `json:"namespace"`
+	Revision  string                   `json:"revision"`
+	Inventory []postApplyWebhookObject `json:"inventory"`
+}
+
+// postApplyWebhookObject summarizes an applied object.
+type postApplyWebhookObject struct {
+	Subject string `json:"subject"`
+	Action  string `json:"action"`
+}
+
+// checkPostApplyWebhookURL returns an error if the post-apply webhooks are
+// disabled, or if the URL is not an HTTP(S) URL of one of the allowed hosts.
+func (r *KustomizationReconciler) checkPostApplyWebhookURL(webhookURL string) error {
+	if len(r.postApplyWebhookHosts) == 0 {
+		return fmt.Errorf("post-apply webhooks are disabled, the controller must be started with --post-apply-webhook-allowed-hosts")
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return fmt.Errorf("invalid post-apply webhook URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid post-apply webhook URL: unsupported scheme '%s'", u.Scheme)
+	}
+	if _, ok := r.postApplyWebhookHosts[strings.ToLower(u.Hostname())]; !ok {
+		return fmt.Errorf("post-apply webhook host '%s' is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// callPostApplyWebhook posts the summary of the applied objects to the
+// post-apply webhook, and returns an error if the webhook URL is not allowed,
+// or if the request fails or results in a non-2xx response.
+func (r *KustomizationReconciler) callPostApplyWebhook(ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	revision string,
+	changeSet *ssa.ChangeSet) error {
+	webhook := obj.Spec.PostApplyWebhook
+	if err := r.checkPostApplyWebhookURL(webhook.URL); err != nil {
+		return err
+	}
+
+	payload := postApplyWebhookRequest{
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+		Revision:  revision,
+		Inventory: []postApplyWebhookObject{},
+	}
+	if changeSet != nil {
+		for _, entry := range changeSet.Entries {
+			payload.Inventory = append(payload.Inventory, postApplyWebhookObject{
+				Subject: entry.Subject,
+				Action:  entry.Action.String(),
+			})
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal post-apply webhook payload: %w", err)
+	}
+
+	timeout := obj.GetTimeout()
+	if webhook.Timeout != nil {
+		timeout = webhook.Timeout.Duration
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create post-apply webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if webhook.SecretRef != nil {
+		secretName := types.NamespacedName{
+			Namespace: obj.GetNamespace(),
+			Name:      webhook.SecretRef.Name,
+		}
+		var secret corev1.Secret
+		if err := r.Get(ctx, secretName, &secret); err != nil {
+			return fmt.Errorf("failed to read post-apply webhook secret '%s': %w", secretName.String(), err)
+		}
+		switch {
+		case len(secret.Data["token"]) > 0:
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(secret.Data["token"])))
+		case len(secret.Data["username"]) > 0 && len(secret.Data["password"]) > 0:
+			req.SetBasicAuth(string(secret.Data["username"]), string(secret.Data["password"]))
+		default:
+			return fmt.Errorf("post-apply webhook secret '%s' must contain a 'token' or 'username' and 'password'", secretName.String())
+		}
+	}
+
+	resp, err := r.postApplyWebhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post-apply webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Include the start of the response in the error, which most likely
+		// explains why the revision was rejected.
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("post-apply webhook rejected revision %s with status %d: %s",
+			revision, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_PostApplyWebhook(t *testing.T) {
+	g := NewWithT(t)
+	id := "webhook-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	manifests := []testserver.File{
+		{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+data:
+  key: value
+`, id),
+		},
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("webhook-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "webhook-token",
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"token": "secret-token",
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), secret)).To(Succeed())
+
+	var (
+		mu       sync.Mutex
+		status   = http.StatusOK
+		delay    time.Duration
+		received []postApplyWebhookRequest
+		auth     string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		code, d := status, delay
+		var payload postApplyWebhookRequest
+		if err := json.NewDecoder(req.Body).Decode(&payload); err == nil {
+			received = append(received, payload)
+		}
+		auth = req.Header.Get("Authorization")
+		mu.Unlock()
+
+		time.Sleep(d)
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte("policy check failed"))
+	}))
+	defer server.Close()
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("webhook-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			PostApplyWebhook: &kustomizev1.PostApplyWebhook{
+				URL:     server.URL,
+				Timeout: &metav1.Duration{Duration: time.Second},
+				SecretRef: &meta.LocalObjectReference{
+					Name: secret.Name,
+				},
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("marks ready when accepted", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		mu.Lock()
+		defer mu.Unlock()
+		g.Expect(auth).To(Equal("Bearer secret-token"))
+		g.Expect(received).ToNot(BeEmpty())
+		payload := received[len(received)-1]
+		g.Expect(payload.Name).To(Equal(kustomization.Name))
+		g.Expect(payload.Namespace).To(Equal(id))
+		g.Expect(payload.Revision).To(Equal(revision))
+		g.Expect(payload.Inventory).To(ContainElement(postApplyWebhookObject{
+			Subject: fmt.Sprintf("ConfigMap/%[1]s/%[1]s", id),
+			Action:  "created",
+		}))
+	})
+
+	reconcile := func(g *WithT, revision string) {
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	t.Run("fails when rejected", func(t *testing.T) {
+		g := NewWithT(t)
+
+		mu.Lock()
+		status = http.StatusForbidden
+		mu.Unlock()
+		reconcile(g, "v2.0.0")
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsFalse(resultK, meta.ReadyCondition) &&
+				conditions.GetReason(resultK, meta.ReadyCondition) == kustomizev1.PostApplyWebhookFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+
+		msg := conditions.GetMessage(resultK, meta.ReadyCondition)
+		g.Expect(msg).To(ContainSubstring("status 403"))
+		g.Expect(msg).To(ContainSubstring("policy check failed"))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(revision))
+	})
+
+	t.Run("fails on timeout", func(t *testing.T) {
+		g := NewWithT(t)
+
+		mu.Lock()
+		status = http.StatusOK
+		delay = 3 * time.Second
+		mu.Unlock()
+		reconcile(g, "v3.0.0")
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAttemptedRevision == "v3.0.0" &&
+				conditions.IsFalse(resultK, meta.ReadyCondition) &&
+				conditions.GetReason(resultK, meta.ReadyCondition) == kustomizev1.PostApplyWebhookFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring("context deadline exceeded"))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(revision))
+	})
+}
+
+func TestKustomizationReconciler_checkPostApplyWebhookURL(t *testing.T) {
+	r := &KustomizationReconciler{
+		postApplyWebhookHosts: map[string]struct{}{"policy.policy-system.svc": {}},
+	}
+	tests := []struct {
+		name    string
+		url     string
+		wantErr string
+	}{
+		{name: "allowed host", url: "http://policy.policy-system.svc:8080/validate"},
+		{name: "allowed host in upper case", url: "https://POLICY.policy-system.svc/validate"},
+		{name: "other host", url: "http://169.254.169.254/latest/meta-data", wantErr: "post-apply webhook host '169.254.169.254' is not allowed"},
+		{name: "allowed host as user info", url: "http://policy.policy-system.svc@10.0.0.1/", wantErr: "post-apply webhook host '10.0.0.1' is not allowed"},
+		{name: "unsupported scheme", url: "file:///etc/passwd", wantErr: "unsupported scheme 'file'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := r.checkPostApplyWebhookURL(tt.url)
+			if tt.wantErr == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		err := (&KustomizationReconciler{}).checkPostApplyWebhookURL("http://policy.policy-system.svc/validate")
+		g.Expect(err).To(MatchError(ContainSubstring("post-apply webhooks are disabled")))
+	})
+}
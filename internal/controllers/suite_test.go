@@ -49,6 +49,7 @@ import (
 	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	intmetrics "github.com/fluxcd/kustomize-controller/internal/metrics"
 )
 
 func init() {
@@ -59,6 +60,10 @@ const (
 	timeout                = time.Second * 30
 	interval               = time.Second * 1
 	reconciliationInterval = time.Second * 5
+
+	// The build limits of the reconciler, exceeded on purpose by some tests.
+	testMaxArtifactSize = 10 << 20
+	testMaxManifests    = 500
 )
 
 const vaultVersion = "1.2.2"
@@ -176,14 +181,19 @@ func TestMain(m *testing.M) {
 		kstatusInProgressCheck = kcheck.NewInProgressChecker(testEnv.Client)
 		kstatusInProgressCheck.DisableFetch = true
 		reconciler = &KustomizationReconciler{
-			ControllerName: controllerName,
-			Client:         testEnv,
-			EventRecorder:  testEnv.GetEventRecorderFor(controllerName),
-			Metrics:        testMetricsH,
+			ControllerName:  controllerName,
+			Client:          testEnv,
+			EventRecorder:   testEnv.GetEventRecorderFor(controllerName),
+			Metrics:         testMetricsH,
+			ExtendedMetrics: intmetrics.NewRecorder(),
 		}
 		if err := (reconciler).SetupWithManager(testEnv, KustomizationReconcilerOptions{
 			MaxConcurrentReconciles:   4,
 			DependencyRequeueInterval: 2 * time.Second,
+			MaxArtifactSize:           testMaxArtifactSize,
+			MaxManifests:              testMaxManifests,
+			// The post-apply webhooks of the tests are served by httptest.
+			PostApplyWebhookAllowedHosts: []string{"127.0.0.1"},
 		}); err != nil {
 			panic(fmt.Sprintf("Failed to start KustomizationReconciler: %v", err))
 		}
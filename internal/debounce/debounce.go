@@ -0,0 +1,79 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package debounce coalesces the reconcile requests enqueued in response to
+// events which happen in quick succession, e.g. the revisions of a source.
+package debounce
+
+import (
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// EventHandler returns a handler.EventHandler which delays the requests
+// enqueued by the given handler by the interval. The requests for the same
+// object enqueued during the interval are merged into the first one, which
+// means the object is reconciled once, at most one interval after the first
+// event, against the state of the world at that time. Requests are never
+// dropped, as an object which is being reconciled when the delayed request is
+// ready is queued again by the workqueue. An interval lower than or equal to
+// zero disables the delay.
+func EventHandler(h handler.EventHandler, interval time.Duration) handler.EventHandler {
+	if interval <= 0 {
+		return h
+	}
+	return &eventHandler{handler: h, interval: interval}
+}
+
+type eventHandler struct {
+	handler  handler.EventHandler
+	interval time.Duration
+}
+
+func (e *eventHandler) Create(evt event.CreateEvent, q workqueue.RateLimitingInterface) {
+	e.handler.Create(evt, e.queue(q))
+}
+
+func (e *eventHandler) Update(evt event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	e.handler.Update(evt, e.queue(q))
+}
+
+func (e *eventHandler) Delete(evt event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	e.handler.Delete(evt, e.queue(q))
+}
+
+func (e *eventHandler) Generic(evt event.GenericEvent, q workqueue.RateLimitingInterface) {
+	e.handler.Generic(evt, e.queue(q))
+}
+
+func (e *eventHandler) queue(q workqueue.RateLimitingInterface) workqueue.RateLimitingInterface {
+	return &delayingQueue{RateLimitingInterface: q, interval: e.interval}
+}
+
+// delayingQueue adds the items to the underlying queue after the interval.
+// The delaying queue keeps a single entry per item, with the earliest ready
+// time, which merges the items added while it is waiting.
+type delayingQueue struct {
+	workqueue.RateLimitingInterface
+	interval time.Duration
+}
+
+func (q *delayingQueue) Add(item interface{}) {
+	q.RateLimitingInterface.AddAfter(item, q.interval)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package debounce
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const interval = 200 * time.Millisecond
+
+// fakeSource is a source whose revision changes, and which maps its events
+// to a request for the object referring to it.
+type fakeSource struct {
+	mu       sync.Mutex
+	revision string
+}
+
+var request = reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+
+func (s *fakeSource) setRevision(h handler.EventHandler, q workqueue.RateLimitingInterface, revision string) {
+	s.mu.Lock()
+	old := s.revision
+	s.revision = revision
+	s.mu.Unlock()
+
+	h.Update(event.UpdateEvent{
+		ObjectOld: &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "source", Annotations: map[string]string{"revision": old}}},
+		ObjectNew: &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "source", Annotations: map[string]string{"revision": revision}}},
+	}, q)
+}
+
+func (s *fakeSource) getRevision() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revision
+}
+
+func newHandler(d time.Duration) handler.EventHandler {
+	return EventHandler(handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+		return []reconcile.Request{request}
+	}), d)
+}
+
+func newQueue(t *testing.T) workqueue.RateLimitingInterface {
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	t.Cleanup(q.ShutDown)
+	return q
+}
+
+// reconcileNext waits for the next request in the queue, and returns the
+// revision of the source it is reconciled against.
+func reconcileNext(g *WithT, q workqueue.RateLimitingInterface, s *fakeSource) string {
+	g.Eventually(q.Len, 2*interval, 10*time.Millisecond).Should(Equal(1))
+	item, shutdown := q.Get()
+	g.Expect(shutdown).To(BeFalse())
+	g.Expect(item).To(Equal(request))
+	defer q.Done(item)
+	return s.getRevision()
+}
+
+func TestEventHandler(t *testing.T) {
+	t.Run("reconciles the newest of rapid revisions once", func(t *testing.T) {
+		g := NewWithT(t)
+
+		q := newQueue(t)
+		h := newHandler(interval)
+		s := &fakeSource{revision: "v0"}
+
+		for _, rev := range []string{"v1", "v2", "v3"} {
+			s.setRevision(h, q, rev)
+		}
+		g.Expect(q.Len()).To(Equal(0))
+
+		g.Expect(reconcileNext(g, q, s)).To(Equal("v3"))
+		g.Consistently(q.Len, 2*interval, 10*time.Millisecond).Should(Equal(0))
+	})
+
+	t.Run("does not drop a revision received during a reconcile", func(t *testing.T) {
+		g := NewWithT(t)
+
+		q := newQueue(t)
+		h := newHandler(interval)
+		s := &fakeSource{revision: "v0"}
+
+		s.setRevision(h, q, "v1")
+		g.Eventually(q.Len, 2*interval, 10*time.Millisecond).Should(Equal(1))
+		item, _ := q.Get()
+
+		// The newer revisions are received while v1 is reconciled.
+		s.setRevision(h, q, "v2")
+		s.setRevision(h, q, "v3")
+		time.Sleep(2 * interval)
+		g.Expect(q.Len()).To(Equal(0))
+		q.Done(item)
+
+		g.Expect(reconcileNext(g, q, s)).To(Equal("v3"))
+		g.Consistently(q.Len, 2*interval, 10*time.Millisecond).Should(Equal(0))
+	})
+
+	t.Run("does not delay the requests without an interval", func(t *testing.T) {
+		g := NewWithT(t)
+
+		q := newQueue(t)
+		h := newHandler(0)
+		s := &fakeSource{revision: "v0"}
+
+		s.setRevision(h, q, "v1")
+		g.Expect(q.Len()).To(Equal(1))
+	})
+}
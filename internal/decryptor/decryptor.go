@@ -20,10 +20,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -31,15 +33,23 @@ import (
 	"time"
 
 	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/go-logr/logr"
 	"go.mozilla.org/sops/v3"
 	"go.mozilla.org/sops/v3/aes"
+	sopsazkv "go.mozilla.org/sops/v3/azkv"
 	"go.mozilla.org/sops/v3/cmd/sops/common"
 	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/keys"
 	"go.mozilla.org/sops/v3/keyservice"
+	"go.mozilla.org/sops/v3/shamir"
+	"go.mozilla.org/sops/v3/stores"
+	"google.golang.org/grpc"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/kustomize/api/konfig"
 	"sigs.k8s.io/kustomize/api/resource"
@@ -50,6 +60,8 @@ import (
 	"github.com/fluxcd/kustomize-controller/internal/sops/age"
 	"github.com/fluxcd/kustomize-controller/internal/sops/awskms"
 	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
+	"github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
 	intkeyservice "github.com/fluxcd/kustomize-controller/internal/sops/keyservice"
 	"github.com/fluxcd/kustomize-controller/internal/sops/pgp"
 )
@@ -66,12 +78,24 @@ const (
 	// DecryptionVaultTokenFileName is the name of the file containing the
 	// Hashicorp Vault token.
 	DecryptionVaultTokenFileName = "sops.vault-token"
+	// DecryptionVaultKubernetesAuthFile is the name of the file containing
+	// the role and mount path of the Hashicorp Vault Kubernetes auth method.
+	DecryptionVaultKubernetesAuthFile = "sops.vault-kubernetes-auth"
+	// DecryptionVaultNamespaceFile is the name of the file containing the
+	// Hashicorp Vault Enterprise namespace of the Transit keys.
+	DecryptionVaultNamespaceFile = "sops.vault-namespace"
 	// DecryptionAWSKmsFile is the name of the file containing the AWS KMS
 	// credentials.
 	DecryptionAWSKmsFile = "sops.aws-kms"
 	// DecryptionAzureAuthFile is the name of the file containing the Azure
 	// credentials.
 	DecryptionAzureAuthFile = "sops.azure-kv"
+	// DecryptionAzureCAFile is the name of the file containing the PEM
+	// encoded CA bundle trusted when connecting to Azure Key Vault.
+	DecryptionAzureCAFile = "sops.azure-kv-ca.pem"
+	// DecryptionAzureAPIVersionFile is the name of the file containing the
+	// Azure Key Vault API version requested instead of the SDK default.
+	DecryptionAzureAPIVersionFile = "sops.azure-kv-api-version"
 	// DecryptionGCPCredsFile is the name of the file containing the GCP
 	// credentials.
 	DecryptionGCPCredsFile = "sops.gcp-kms"
@@ -81,6 +105,15 @@ const (
 	// unsupportedFormat is used to signal no sopsFormatToMarkerBytes format was
 	// detected by detectFormatFromMarkerBytes.
 	unsupportedFormat = formats.Format(-1)
+	// sopsMetadataKeyGroups is the SOPS metadata field containing the key
+	// groups.
+	sopsMetadataKeyGroups = "key_groups"
+	// sopsAzureKeyVaultField is the SOPS metadata field containing the Azure
+	// Key Vault master keys.
+	sopsAzureKeyVaultField = "azure_kv"
+	// sopsDotenvPrefix is the prefix of the SOPS metadata entries in a dotenv
+	// file.
+	sopsDotenvPrefix = "sops_"
 )
 
 var (
@@ -103,6 +136,16 @@ var (
 		formats.Json:   []byte("\"mac\": \"ENC["),
 		formats.Yaml:   []byte("mac: ENC["),
 	}
+	// sopsKeyProviders contains the SOPS metadata fields of the master key
+	// providers supported by the decryptor.
+	sopsKeyProviders = map[string]struct{}{
+		"age":      {},
+		"azure_kv": {},
+		"gcp_kms":  {},
+		"hc_vault": {},
+		"kms":      {},
+		"pgp":      {},
+	}
 )
 
 // Decryptor performs decryption operations for a v1.Kustomization.
@@ -121,9 +164,11 @@ type Decryptor struct {
 	// decrypted. Defaults to maxEncryptedFileSize.
 	maxFileSize int64
 	// checkSopsMac instructs the decryptor to perform the SOPS data integrity
-	// check using the MAC. Not enabled by default, as arbitrary data gets
-	// injected into most resources, causing the integrity check to fail.
-	// Mostly kept around for feature completeness and documentation purposes.
+	// check using the MAC for resources decrypted as a whole. Not enabled by
+	// default, as arbitrary data gets injected into most resources, causing
+	// the integrity check to fail. The data of files, and of the data entries
+	// of Secrets, is not modified by Kustomize, and always has its MAC
+	// verified.
 	checkSopsMac bool
 
 	// gnuPGHome is the absolute path of the GnuPG home directory used to
@@ -135,15 +180,148 @@ type Decryptor struct {
 	// vaultToken is the Hashicorp Vault token used to authenticate towards
 	// any Vault server.
 	vaultToken string
+	// vaultKubernetesAuth is the Hashicorp Vault Kubernetes auth method
+	// logged in with towards any Vault server when no vaultToken is
+	// imported.
+	vaultKubernetesAuth *hcvault.KubernetesAuth
+	// vaultTokens requests the tokens of the vaultServiceAccount logged in
+	// with to the Vault Kubernetes auth method. Without it, the Vault
+	// Kubernetes auth file of the decryption Secret is rejected.
+	vaultTokens hcvault.ServiceAccountTokenRequester
+	// vaultServiceAccount is the service account of the Kustomization,
+	// logged in with to the Vault Kubernetes auth method.
+	vaultServiceAccount types.NamespacedName
+	// vaultNamespace is the Hashicorp Vault Enterprise namespace of the
+	// requests towards any Vault server.
+	vaultNamespace string
 	// awsCredsProvider is the AWS credentials provider object used to authenticate
 	// towards any AWS KMS.
 	awsCredsProvider *awskms.CredsProvider
 	// azureToken is the Azure credential token used to authenticate towards
 	// any Azure Key Vault.
 	azureToken *azkv.Token
+	// azureConfigs caches the Azure credential tokens constructed from the
+	// Azure authentication files across Decryptors. When nil, the files are
+	// parsed on every import.
+	azureConfigs *azkv.ConfigCache
+	// azureTokens shares the Azure credential tokens constructed from
+	// identical configurations across Decryptors. When nil, a credential
+	// token is constructed for every configuration.
+	azureTokens *azkv.TokenCache
+	// azureAuthFileDir is the directory of the Azure authentication files
+	// which can be referenced by the AzureAuthFile of the Decryption. When
+	// empty, no file can be referenced.
+	azureAuthFileDir string
+	// azureCABundle is the PEM encoded CA bundle trusted, in addition to the
+	// system roots, when connecting to any Azure Key Vault.
+	azureCABundle []byte
+	// azureAPIVersion is the API version requested from any Azure Key Vault,
+	// instead of the default version of the SDK.
+	azureAPIVersion string
+	// azureLogger logs the client request IDs of the requests to any Azure
+	// Key Vault. When nil, the request IDs are not logged.
+	azureLogger *logr.Logger
+	// azureLimiter bounds the concurrent requests to each Azure Key Vault,
+	// shared with the Decryptors of the other Kustomizations. When nil, the
+	// requests are not limited.
+	azureLimiter *azkv.VaultLimiter
+
+	// azureBreaker fails the Azure Key Vault Decrypt requests fast for the
+	// vaults which failed repeatedly, across Decryptors.
+	azureBreaker *azkv.VaultBreaker
+	// azureRetryPolicy configures the retries of the throttled and otherwise
+	// transiently failed Azure Key Vault requests.
+	azureRetryPolicy azkv.RetryPolicy
+	// azureTransport configures the proxy and minimum TLS version of the
+	// connections to any Azure Key Vault.
+	azureTransport azkv.Transport
+	// azureRewriteVaultSuffix rewrites the DNS suffix of the vault URLs of
+	// another cloud than the one of the Azure credentials, instead of
+	// failing the requests.
+	azureRewriteVaultSuffix bool
+	// azureRecoverDeleted recovers the Azure Key Vault keys which are
+	// deleted but recoverable, instead of only failing the decryption.
+	azureRecoverDeleted bool
+	// azureResolveLatest resolves the current version of the Azure Key
+	// Vault keys without a version when encrypting with them.
+	azureResolveLatest bool
+	// azureNoDefaultCredential fails the Azure Key Vault requests when no
+	// Azure credentials are configured, instead of authenticating with the
+	// default credential of the controller.
+	azureNoDefaultCredential bool
+	// azureAllowWorkloadIdentity allows the Azure authentication files to
+	// authenticate with the workload identity of the controller.
+	azureAllowWorkloadIdentity bool
+	// azureDataKeys caches the data keys decrypted with Azure Key Vault
+	// keys, shared with the Decryptors of the other Kustomizations. When
+	// nil, the data keys are not cached.
+	azureDataKeys *azkv.DataKeyCache
+	// azureAllowedAlgorithms are the algorithms the data keys can be
+	// decrypted with by Azure Key Vault keys. When empty, all the
+	// algorithms are allowed.
+	azureAllowedAlgorithms azkv.AllowedAlgorithms
+	// azureDefaultAlgorithm is the algorithm the data keys are decrypted
+	// with by Azure Key Vault keys when the SOPS metadata does not record
+	// one. When empty, RSA-OAEP-256 is used.
+	azureDefaultAlgorithm azkv.DefaultAlgorithm
+	// ctx is the context of the requests of the key services, e.g. of the
+	// reconciliation the Decryptor decrypts for. When nil,
+	// context.Background() is used.
+	ctx context.Context
+	// decryptObserver is called with the result of every request to decrypt
+	// a data key with a key service. When nil, the requests are not
+	// observed.
+	decryptObserver DecryptObserver
 	// gcpCredsJSON is the JSON credential file of the service account used to
 	// authenticate towards any GCP KMS.
 	gcpCredsJSON []byte
+	// kmsClients caches the AWS KMS, GCP KMS and Hashicorp Vault clients
+	// constructed with the credentials of the decryption Secrets, across
+	// Decryptors. When nil, the clients are constructed for every request.
+	kmsClients *clientcache.Cache
+	// kmsClientScope is the Scope of the clients of the imported decryption
+	// Secret, released by releaseKMSClients.
+	kmsClientScope *clientcache.Scope
+
+	// originBase is the path, relative to root, of the Kustomization file
+	// for which TrackOrigins enabled the origin annotations. The paths
+	// of the resource origins are relative to this path.
+	originBase string
+	// stripOrigins instructs DecryptResource to remove the origin annotation
+	// from the resources, as it was enabled by TrackOrigins and not by the
+	// Kustomization file itself.
+	stripOrigins bool
+
+	// unsupportedKeyProvidersWarn is called with a warning message when the
+	// SOPS metadata references key providers which are not supported by the
+	// decryptor. When nil, an error is returned instead.
+	unsupportedKeyProvidersWarn func(msg string)
+
+	// redactor records the decrypted values, and redacts them from the
+	// errors returned by the decryptor. When nil, errors are not redacted.
+	redactor *Redactor
+
+	// azureKeyExpiry gets the expiry dates of the Azure Key Vault keys
+	// recorded in azureKeys. When nil, the expiry dates are not retrieved.
+	azureKeyExpiry AzureKeyExpiryGetter
+	// azureKeys are the Azure Key Vault keys which decrypted the data key of
+	// at least one file, by key ID.
+	azureKeys map[string]*keyservice.AzureKeyVaultKey
+	// azureKeyDecryptions are the times of the last successful decryption
+	// of a data key with the azureKeys, by key ID.
+	azureKeyDecryptions map[string]time.Time
+	// azureKeyFailures are the errors of the Azure Key Vault keys of which
+	// the last decryption of a data key failed, by key ID.
+	azureKeyFailures map[string]error
+	azureKeysMu      sync.Mutex
+
+	// keyProviders are the SOPS key providers of the master keys which
+	// decrypted the data key of at least one file.
+	keyProviders map[string]struct{}
+	// dataKeyRotations are the IDs of the master keys of the decrypted
+	// files of which the data key needs rotation.
+	dataKeyRotations map[string]struct{}
+	keyProvidersMu   sync.Mutex
 
 	// keyServices are the SOPS keyservice.KeyServiceClient's available to the
 	// decryptor.
@@ -170,8 +348,395 @@ func NewTempDecryptor(root string, client client.Client, kustomization *kustomiz
 	if err != nil {
 		return nil, nil, fmt.Errorf("cannot create decryptor: %w", err)
 	}
-	cleanup := func() { _ = os.RemoveAll(gnuPGHome.String()) }
-	return NewDecryptor(root, client, kustomization, maxEncryptedFileSize, gnuPGHome.String()), cleanup, nil
+	d := NewDecryptor(root, client, kustomization, maxEncryptedFileSize, gnuPGHome.String())
+	cleanup := func() {
+		d.releaseKMSClients()
+		_ = os.RemoveAll(gnuPGHome.String())
+	}
+	return d, cleanup, nil
+}
+
+// LimitFileSize lowers the max size in bytes a file is allowed to have to be
+// decrypted to the given size, if it is lower than the current limit.
+func (d *Decryptor) LimitFileSize(max int64) {
+	if max > 0 && (d.maxFileSize <= 0 || max < d.maxFileSize) {
+		d.maxFileSize = max
+	}
+}
+
+// SetRedactor configures the Decryptor to record the decrypted values with
+// the given Redactor, and to redact them from the returned errors.
+func (d *Decryptor) SetRedactor(r *Redactor) {
+	d.redactor = r
+}
+
+// SetAzureLogger configures the Decryptor to log the client request ID of
+// every Azure Key Vault request with the given logger, e.g. the logger of
+// the reconciliation of the Kustomization, to correlate the decryption
+// failures with the Azure Key Vault audit logs.
+func (d *Decryptor) SetAzureLogger(log logr.Logger) {
+	d.azureLogger = &log
+}
+
+// SetAzureLimiter configures the Decryptor to wait for a request slot of the
+// given VaultLimiter before every Azure Key Vault request. The wait is
+// bounded by the context configured with SetContext.
+func (d *Decryptor) SetAzureLimiter(l *azkv.VaultLimiter) {
+	d.azureLimiter = l
+}
+
+// SetAzureBreaker configures the Decryptor to fail the Azure Key Vault
+// Decrypt requests without sending them while the given VaultBreaker is open
+// for their vault.
+func (d *Decryptor) SetAzureBreaker(b *azkv.VaultBreaker) {
+	d.azureBreaker = b
+}
+
+// SetAzureRetryPolicy configures the Decryptor to retry the throttled and
+// otherwise transiently failed Azure Key Vault requests with the given
+// RetryPolicy. The retries are bounded by the context configured with
+// SetContext.
+func (d *Decryptor) SetAzureRetryPolicy(p azkv.RetryPolicy) {
+	d.azureRetryPolicy = p
+}
+
+// SetAzureTransport configures the Decryptor to connect to Azure Key Vault
+// with the proxy and minimum TLS version of the given Transport. The CA
+// bundle of the decryption Secret is trusted in addition to the system roots.
+func (d *Decryptor) SetAzureTransport(t azkv.Transport) {
+	d.azureTransport = t
+}
+
+// SetAzureRewriteVaultDNSSuffix configures the Decryptor to rewrite the DNS
+// suffix of the vault URL of an Azure Key Vault key to the one of the cloud
+// of the Azure credentials (e.g. 'vault.azure.cn' for the China cloud) when
+// it is the suffix of another cloud, instead of failing the request.
+func (d *Decryptor) SetAzureRewriteVaultDNSSuffix(rewrite bool) {
+	d.azureRewriteVaultSuffix = rewrite
+}
+
+// SetAzureRecoverDeletedKeys configures the Decryptor to recover an Azure Key
+// Vault key which is deleted but recoverable from the soft-deleted keys of
+// its vault when decrypting with it. The recovery completes asynchronously,
+// the decryption is retried once after requesting it.
+func (d *Decryptor) SetAzureRecoverDeletedKeys(enabled bool) {
+	d.azureRecoverDeleted = enabled
+}
+
+// SetAzureResolveLatestVersion configures the Decryptor to resolve the
+// current version of an Azure Key Vault key without a version, or with the
+// 'latest' version, when encrypting with it, which requires the 'get'
+// permission on the key.
+func (d *Decryptor) SetAzureResolveLatestVersion(enabled bool) {
+	d.azureResolveLatest = enabled
+}
+
+// SetAzureDisableDefaultCredential configures the Decryptor to fail the
+// decryption with Azure Key Vault keys when the decryption Secret contains no
+// Azure credentials, instead of authenticating with the default credential of
+// the controller, e.g. its workload identity or managed identity.
+func (d *Decryptor) SetAzureDisableDefaultCredential(disable bool) {
+	d.azureNoDefaultCredential = disable
+}
+
+// SetAzureAllowWorkloadIdentity configures the Decryptor to validate the
+// Azure authentication files which authenticate with the workload identity
+// of the controller, as the TokenCache allowing it constructs them.
+func (d *Decryptor) SetAzureAllowWorkloadIdentity(allow bool) {
+	d.azureAllowWorkloadIdentity = allow
+}
+
+// SetVaultKubernetesAuth configures the Decryptor to log in to the Vault
+// Kubernetes auth method of the decryption Secret with the tokens of the
+// service account requested with tokens. Without tokens, the Vault Kubernetes
+// auth file of the decryption Secret is rejected.
+func (d *Decryptor) SetVaultKubernetesAuth(tokens hcvault.ServiceAccountTokenRequester, serviceAccount types.NamespacedName) {
+	d.vaultTokens = tokens
+	d.vaultServiceAccount = serviceAccount
+}
+
+// SetAzureDataKeyCache configures the Decryptor to cache the data keys it
+// decrypts with Azure Key Vault keys in the given DataKeyCache, and to reuse
+// the data keys decrypted with the same credentials from identical
+// ciphertexts, e.g. by the Decryptors of other Kustomizations, instead of
+// sending the requests again.
+func (d *Decryptor) SetAzureDataKeyCache(c *azkv.DataKeyCache) {
+	d.azureDataKeys = c
+}
+
+// SetAzureAllowedAlgorithms configures the Decryptor to only decrypt the data
+// keys encrypted with the given Azure Key Vault algorithms, and to fail the
+// decryption with any other algorithm before sending the request.
+func (d *Decryptor) SetAzureAllowedAlgorithms(algorithms azkv.AllowedAlgorithms) {
+	d.azureAllowedAlgorithms = algorithms
+}
+
+// SetAzureDefaultAlgorithm configures the Decryptor to decrypt the data keys
+// with the given Azure Key Vault algorithm when the SOPS metadata of the file
+// does not record one.
+func (d *Decryptor) SetAzureDefaultAlgorithm(algorithm azkv.DefaultAlgorithm) {
+	d.azureDefaultAlgorithm = algorithm
+}
+
+// SetAzureTokenCache configures the Decryptor to share the Azure credential
+// tokens in the given TokenCache across the identical configurations of the
+// Azure authentication files, which also probes the Azure Instance Metadata
+// Service before constructing a managed identity credential if configured
+// to. When nil, a credential token is constructed for every configuration.
+func (d *Decryptor) SetAzureTokenCache(c *azkv.TokenCache) {
+	d.azureTokens = c
+}
+
+// DecryptObserver is called with the key provider, e.g. "azure_kv", the
+// duration and the error of a request to decrypt a SOPS data key with a key
+// service, e.g. to record them as metrics.
+type DecryptObserver func(provider string, duration time.Duration, err error)
+
+// SetDecryptObserver configures the Decryptor to call the DecryptObserver
+// with the result of every request to decrypt a data key, including the
+// failed attempts of the keys which are followed by another key.
+func (d *Decryptor) SetDecryptObserver(fn DecryptObserver) {
+	d.decryptObserver = fn
+}
+
+// SetContext configures the context of the requests the Decryptor makes to
+// decrypt the data keys, e.g. the context of the reconciliation, so that the
+// pending requests are cancelled with it.
+func (d *Decryptor) SetContext(ctx context.Context) {
+	d.ctx = ctx
+}
+
+// SetAzureAuthFileDir configures the Decryptor to allow the AzureAuthFile of
+// the Decryption to reference the Azure authentication files in the given
+// directory, e.g. the mount path of a projected volume.
+func (d *Decryptor) SetAzureAuthFileDir(dir string) {
+	d.azureAuthFileDir = dir
+}
+
+// SetAzureConfigCache configures the Decryptor to reuse the Azure credential
+// tokens cached in the given ConfigCache for the Azure authentication files
+// of unchanged decryption Secrets, and for the default credential.
+func (d *Decryptor) SetAzureConfigCache(c *azkv.ConfigCache) {
+	d.azureConfigs = c
+}
+
+// SetKMSClientCache configures the Decryptor to reuse the AWS KMS, GCP KMS
+// and Hashicorp Vault clients cached in the given Cache for the credentials
+// of unchanged decryption Secrets. The clients are never shared with the
+// Decryptors of the Kustomizations referencing other Secrets.
+func (d *Decryptor) SetKMSClientCache(c *clientcache.Cache) {
+	d.kmsClients = c
+}
+
+// releaseKMSClients releases the Scope of the clients of the imported
+// decryption Secret, if any.
+func (d *Decryptor) releaseKMSClients() {
+	d.kmsClientScope.Release()
+	d.kmsClientScope = nil
+}
+
+// AzureKeyExpiryGetter gets the expiry date of an Azure Key Vault key, or
+// nil if the key does not expire, e.g. an azkv.ExpiryCache.
+type AzureKeyExpiryGetter interface {
+	Expiry(ctx context.Context, key *azkv.MasterKey) (*time.Time, error)
+}
+
+// KeyExpiry holds the expiry date of a key used for decryption.
+type KeyExpiry struct {
+	// Key is the ID of the key, e.g. the URL of an Azure Key Vault key.
+	Key string
+	// Expires is the date after which the key can not be used anymore.
+	Expires time.Time
+}
+
+// TrackAzureKeyExpiry configures the Decryptor to get the expiry dates of the
+// Azure Key Vault keys it decrypts data keys with, for AzureKeyExpiries, with
+// the given getter.
+func (d *Decryptor) TrackAzureKeyExpiry(getter AzureKeyExpiryGetter) {
+	d.azureKeyExpiry = getter
+}
+
+// AzureKeyExpiries returns the expiry dates of the Azure Key Vault keys
+// which decrypted data keys, if TrackAzureKeyExpiry was called, sorted by
+// key, leaving out
+// the keys which do not expire. The keys of which the expiry date can not be
+// retrieved are left out as well, with their errors aggregated in the
+// returned error.
+func (d *Decryptor) AzureKeyExpiries(ctx context.Context) ([]KeyExpiry, error) {
+	if d.azureKeyExpiry == nil {
+		return nil, nil
+	}
+
+	d.azureKeysMu.Lock()
+	recorded := make(map[string]*keyservice.AzureKeyVaultKey, len(d.azureKeys))
+	ids := make([]string, 0, len(d.azureKeys))
+	for id, k := range d.azureKeys {
+		recorded[id] = k
+		ids = append(ids, id)
+	}
+	d.azureKeysMu.Unlock()
+	sort.Strings(ids)
+
+	var expiries []KeyExpiry
+	var errs []error
+	for _, id := range ids {
+		k := recorded[id]
+		key := azkv.MasterKeyFromURL(k.VaultUrl, k.Name, k.Version)
+		if d.azureToken != nil {
+			d.azureToken.ApplyToMasterKey(key)
+		}
+		if len(d.azureCABundle) > 0 {
+			azkv.CABundle(d.azureCABundle).ApplyToMasterKey(key)
+		}
+		d.azureTransport.ApplyToMasterKey(key)
+		if d.azureAPIVersion != "" {
+			azkv.APIVersion(d.azureAPIVersion).ApplyToMasterKey(key)
+		}
+		azkv.DisableDefaultCredential(d.azureNoDefaultCredential).ApplyToMasterKey(key)
+		expires, err := d.azureKeyExpiry.Expiry(ctx, key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if expires != nil {
+			expiries = append(expiries, KeyExpiry{Key: id, Expires: *expires})
+		}
+	}
+	return expiries, kerrors.NewAggregate(errs)
+}
+
+// AzureKeyDecryptions returns the times of the last successful decryption of
+// a data key with each Azure Key Vault key, by key ID (as returned by
+// azkv.MasterKey.ToString). Only the identifiers of the keys are recorded.
+func (d *Decryptor) AzureKeyDecryptions() map[string]time.Time {
+	d.azureKeysMu.Lock()
+	defer d.azureKeysMu.Unlock()
+	if len(d.azureKeyDecryptions) == 0 {
+		return nil
+	}
+	decryptions := make(map[string]time.Time, len(d.azureKeyDecryptions))
+	for id, t := range d.azureKeyDecryptions {
+		decryptions[id] = t
+	}
+	return decryptions
+}
+
+// AzureKeyFailures returns the errors of the Azure Key Vault keys of which
+// the last decryption of a data key failed, by key ID (as returned by
+// azkv.MasterKey.ToString). The decryptions which were cancelled, e.g. on
+// the deadline of the reconciliation, are not recorded.
+func (d *Decryptor) AzureKeyFailures() map[string]error {
+	d.azureKeysMu.Lock()
+	defer d.azureKeysMu.Unlock()
+	if len(d.azureKeyFailures) == 0 {
+		return nil
+	}
+	failures := make(map[string]error, len(d.azureKeyFailures))
+	for id, err := range d.azureKeyFailures {
+		failures[id] = err
+	}
+	return failures
+}
+
+// KeyProviders returns the sorted names of the SOPS key providers (e.g.
+// "age", "azure_kv") of the master keys which decrypted the data keys of the
+// files the Decryptor decrypted successfully, as returned by the key services.
+func (d *Decryptor) KeyProviders() []string {
+	d.keyProvidersMu.Lock()
+	defer d.keyProvidersMu.Unlock()
+	if len(d.keyProviders) == 0 {
+		return nil
+	}
+	providers := make([]string, 0, len(d.keyProviders))
+	for p := range d.keyProviders {
+		providers = append(providers, p)
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// recordKeyProviders records the key providers which decrypted the data key
+// of a file for KeyProviders.
+func (d *Decryptor) recordKeyProviders(providers []string) {
+	d.keyProvidersMu.Lock()
+	defer d.keyProvidersMu.Unlock()
+	for _, p := range providers {
+		if d.keyProviders == nil {
+			d.keyProviders = make(map[string]struct{})
+		}
+		d.keyProviders[p] = struct{}{}
+	}
+}
+
+// DataKeyRotations returns the sorted IDs of the master keys of the files the
+// Decryptor decrypted successfully, of which the data key needs rotation
+// according to their NeedsRotation, e.g. an Azure Key Vault key which
+// encrypted the data key longer ago than its rotation threshold.
+func (d *Decryptor) DataKeyRotations() []string {
+	d.keyProvidersMu.Lock()
+	defer d.keyProvidersMu.Unlock()
+	if len(d.dataKeyRotations) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(d.dataKeyRotations))
+	for k := range d.dataKeyRotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// recordDataKeyRotations records the master keys of the metadata of a
+// decrypted file of which the data key needs rotation for DataKeyRotations.
+func (d *Decryptor) recordDataKeyRotations(metadata sops.Metadata) {
+	d.keyProvidersMu.Lock()
+	defer d.keyProvidersMu.Unlock()
+	for _, group := range metadata.KeyGroups {
+		for _, key := range group {
+			if !key.NeedsRotation() {
+				continue
+			}
+			if d.dataKeyRotations == nil {
+				d.dataKeyRotations = make(map[string]struct{})
+			}
+			d.dataKeyRotations[key.ToString()] = struct{}{}
+		}
+	}
+}
+
+// recordAzureKey records the result of the decryption of a data key with
+// the Azure Key Vault key. On success, it records the key for
+// AzureKeyExpiries and the time of the decryption for AzureKeyDecryptions,
+// and on failure the error for AzureKeyFailures.
+func (d *Decryptor) recordAzureKey(key *keyservice.AzureKeyVaultKey, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	d.azureKeysMu.Lock()
+	defer d.azureKeysMu.Unlock()
+	id := azkv.MasterKeyFromURL(key.VaultUrl, key.Name, key.Version).ToString()
+	if err != nil {
+		if d.azureKeyFailures == nil {
+			d.azureKeyFailures = make(map[string]error)
+		}
+		d.azureKeyFailures[id] = err
+		return
+	}
+	if d.azureKeys == nil {
+		d.azureKeys = make(map[string]*keyservice.AzureKeyVaultKey)
+		d.azureKeyDecryptions = make(map[string]time.Time)
+	}
+	d.azureKeys[id] = key
+	d.azureKeyDecryptions[id] = time.Now()
+	delete(d.azureKeyFailures, id)
+}
+
+// AllowUnsupportedKeyProviders configures the Decryptor to call warn with a
+// message naming the providers, instead of returning an error, when the SOPS
+// metadata of a file references key providers which are not supported.
+// Decryption is then attempted with the remaining master keys.
+func (d *Decryptor) AllowUnsupportedKeyProviders(warn func(msg string)) {
+	d.unsupportedKeyProvidersWarn = warn
 }
 
 // IsEncryptedSecret checks if the given object is a Kubernetes Secret encrypted
@@ -185,36 +750,102 @@ func IsEncryptedSecret(object *unstructured.Unstructured) bool {
 	return false
 }
 
+// IsEncryptedResource checks if the given resource is encrypted with Mozilla
+// SOPS, or is a Kubernetes Secret with SOPS encrypted data entries.
+func IsEncryptedResource(res *resource.Resource) bool {
+	if isSOPSEncryptedResource(res) {
+		return true
+	}
+	if res == nil || res.GetKind() != "Secret" {
+		return false
+	}
+	for _, value := range res.GetDataMap() {
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err == nil && detectFormatFromMarkerBytes(data) != unsupportedFormat {
+			return true
+		}
+	}
+	return false
+}
+
+// FailureReason returns the Kustomization condition reason matching the
+// cause of the given decryption error, e.g. a key which was not found in
+// Azure Key Vault. It returns an empty string if the cause is unknown.
+func FailureReason(err error) string {
+	var invalidSecretErr *InvalidSecretError
+	if errors.As(err, &invalidSecretErr) {
+		return kustomizev1.DecryptionSecretInvalidReason
+	}
+	for err != nil {
+		switch azkv.ErrorReason(err) {
+		case azkv.ForbiddenReason:
+			return kustomizev1.DecryptionForbiddenReason
+		case azkv.KeyNotFoundReason:
+			return kustomizev1.DecryptionKeyNotFoundReason
+		case azkv.KeyDisabledReason:
+			return kustomizev1.DecryptionKeyDisabledReason
+		case azkv.KeyDeletedReason:
+			return kustomizev1.DecryptionKeyDeletedReason
+		case azkv.ThrottledReason:
+			return kustomizev1.DecryptionThrottledReason
+		case azkv.VaultUnavailableReason:
+			return kustomizev1.DecryptionVaultUnavailableReason
+		}
+		// The errors of the master keys are aggregated, which can't be
+		// unwrapped.
+		if agg, ok := err.(kerrors.Aggregate); ok {
+			for _, e := range agg.Errors() {
+				if reason := FailureReason(e); reason != "" {
+					return reason
+				}
+			}
+			return ""
+		}
+		err = errors.Unwrap(err)
+	}
+	return ""
+}
+
 // ImportKeys imports the DecryptionProviderSOPS keys from the data values of
 // the Secret referenced in the Kustomization's v1.Decryption spec.
-// It returns an error if the Secret cannot be retrieved, or if one of the
-// imports fails.
+// It returns an error if the Secret cannot be retrieved, if one of the
+// imports fails, or if the key provider priority names an unsupported
+// provider.
 // Imports do not have an effect after the first call to SopsDecryptWithFormat(),
 // which initializes and caches SOPS' (local) key service server.
 // For the import of PGP keys, the Decryptor must be configured with
 // an absolute GnuPG home directory path.
 func (d *Decryptor) ImportKeys(ctx context.Context) error {
-	if d.kustomization.Spec.Decryption == nil || d.kustomization.Spec.Decryption.SecretRef == nil {
+	if d.kustomization.Spec.Decryption == nil {
+		return nil
+	}
+	for _, p := range d.kustomization.Spec.Decryption.KeyProviderPriority {
+		if _, ok := sopsKeyProviders[p]; !ok {
+			return fmt.Errorf("unsupported key provider '%s' in decryption key provider priority", p)
+		}
+	}
+	if path := d.kustomization.Spec.Decryption.AzureAuthFile; path != "" {
+		if err := d.importAzureAuthFile(path); err != nil {
+			return err
+		}
+	}
+	if d.kustomization.Spec.Decryption.SecretRef == nil {
 		return nil
 	}
 
 	provider := d.kustomization.Spec.Decryption.Provider
 	switch provider {
 	case DecryptionProviderSOPS:
-		secretName := types.NamespacedName{
-			Namespace: d.kustomization.GetNamespace(),
-			Name:      d.kustomization.Spec.Decryption.SecretRef.Name,
+		secret, err := d.decryptionSecret(ctx)
+		if err != nil {
+			return err
 		}
-
-		var secret corev1.Secret
-		if err := d.client.Get(ctx, secretName, &secret); err != nil {
-			if apierrors.IsNotFound(err) {
-				return err
-			}
-			return fmt.Errorf("cannot get %s decryption Secret '%s': %w", provider, secretName, err)
+		secretName := client.ObjectKeyFromObject(secret)
+		if d.kmsClients != nil {
+			d.releaseKMSClients()
+			d.kmsClientScope = d.kmsClients.Acquire(secret.Namespace, secret.Name, secret.ResourceVersion)
 		}
 
-		var err error
 		for name, value := range secret.Data {
 			switch filepath.Ext(name) {
 			case DecryptionPGPExt:
@@ -232,6 +863,16 @@ func (d *Decryptor) ImportKeys(ctx context.Context) error {
 					token = strings.Trim(strings.TrimSpace(token), "\n")
 					d.vaultToken = token
 				}
+			case filepath.Ext(DecryptionVaultKubernetesAuthFile):
+				if name == DecryptionVaultKubernetesAuthFile {
+					if d.vaultKubernetesAuth, err = d.loadVaultKubernetesAuth(value); err != nil {
+						return fmt.Errorf("failed to import '%s' data from %s decryption Secret '%s': %w", name, provider, secretName, err)
+					}
+				}
+			case filepath.Ext(DecryptionVaultNamespaceFile):
+				if name == DecryptionVaultNamespaceFile {
+					d.vaultNamespace = strings.TrimSpace(string(value))
+				}
 			case filepath.Ext(DecryptionAWSKmsFile):
 				if name == DecryptionAWSKmsFile {
 					if d.awsCredsProvider, err = awskms.LoadCredsProviderFromYaml(value); err != nil {
@@ -241,14 +882,18 @@ func (d *Decryptor) ImportKeys(ctx context.Context) error {
 			case filepath.Ext(DecryptionAzureAuthFile):
 				// Make sure we have the absolute name
 				if name == DecryptionAzureAuthFile {
-					conf := azkv.AADConfig{}
-					if err = azkv.LoadAADConfigFromBytes(value, &conf); err != nil {
-						return fmt.Errorf("failed to import '%s' data from %s decryption Secret '%s': %w", name, provider, secretName, err)
-					}
-					if d.azureToken, err = azkv.TokenFromAADConfig(conf); err != nil {
+					if d.azureToken, err = d.azureConfigs.TokenFromAuthFile(secretName.String(), secret.ResourceVersion, value, d.azureTokens); err != nil {
 						return fmt.Errorf("failed to import '%s' data from %s decryption Secret '%s': %w", name, provider, secretName, err)
 					}
 				}
+			case filepath.Ext(DecryptionAzureCAFile):
+				if name == DecryptionAzureCAFile {
+					d.azureCABundle = value
+				}
+			case filepath.Ext(DecryptionAzureAPIVersionFile):
+				if name == DecryptionAzureAPIVersionFile {
+					d.azureAPIVersion = strings.TrimSpace(string(value))
+				}
 			case filepath.Ext(DecryptionGCPCredsFile):
 				if name == DecryptionGCPCredsFile {
 					d.gcpCredsJSON = bytes.Trim(value, "\n")
@@ -259,11 +904,125 @@ func (d *Decryptor) ImportKeys(ctx context.Context) error {
 	return nil
 }
 
+// decryptionSecret returns the decryption Secret referenced by the
+// Decryption of the Kustomization. It returns the error of the client as is
+// if the Secret does not exist.
+func (d *Decryptor) decryptionSecret(ctx context.Context) (*corev1.Secret, error) {
+	secretName := types.NamespacedName{
+		Namespace: d.kustomization.GetNamespace(),
+		Name:      d.kustomization.Spec.Decryption.SecretRef.Name,
+	}
+	var secret corev1.Secret
+	if err := d.client.Get(ctx, secretName, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("cannot get %s decryption Secret '%s': %w", d.kustomization.Spec.Decryption.Provider, secretName, err)
+	}
+	return &secret, nil
+}
+
+// importAzureAuthFile imports the Azure authentication file at the given
+// path, which must be in the azureAuthFileDir. The import of the Azure
+// authentication file of the decryption Secret takes precedence.
+func (d *Decryptor) importAzureAuthFile(path string) error {
+	if d.azureAuthFileDir == "" {
+		return fmt.Errorf("cannot import Azure authentication file '%s': reading Azure authentication files is not enabled", path)
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("cannot import Azure authentication file '%s': path must be absolute", path)
+	}
+	// The path is checked before and after resolving the symlinks, which a
+	// projected volume uses for its files.
+	path = filepath.Clean(path)
+	inDir := isPathInDir(d.azureAuthFileDir, path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		dir, err := filepath.EvalSymlinks(d.azureAuthFileDir)
+		inDir = inDir && err == nil && isPathInDir(dir, resolved)
+	}
+	if !inDir {
+		return fmt.Errorf("cannot import Azure authentication file '%s': path is not in the allowed directory '%s'",
+			path, d.azureAuthFileDir)
+	}
+	token, err := d.azureConfigs.TokenFromAuthFilePath(path, d.azureTokens)
+	if err != nil {
+		return fmt.Errorf("failed to import Azure authentication file: %w", err)
+	}
+	d.azureToken = token
+	return nil
+}
+
+// isPathInDir returns whether the absolute path is in the directory or one
+// of its subdirectories.
+func isPathInDir(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// sortMasterKeys sorts the master keys of the group in the order in which
+// they are attempted: the keys of the providers in the KeyProviderPriority of
+// the Decryption in the listed order, followed by the keys of offline
+// providers, and finally the keys of the other providers. The Azure Key Vault
+// keys are in turn sorted by the first AzureVaultPreference of the Decryption
+// matching their vault URL, followed by the keys of the other vaults.
+func (d *Decryptor) sortMasterKeys(group sops.KeyGroup) {
+	var priority, vaults []string
+	if d.kustomization != nil && d.kustomization.Spec.Decryption != nil {
+		priority = d.kustomization.Spec.Decryption.KeyProviderPriority
+		vaults = d.kustomization.Spec.Decryption.AzureVaultPreference
+	}
+	rank := func(key keys.MasterKey) int {
+		provider := intkeyservice.KeyProvider(key)
+		for i, p := range priority {
+			if p == provider {
+				return i
+			}
+		}
+		if intkeyservice.IsOfflineMethod(key) {
+			return len(priority)
+		}
+		return len(priority) + 1
+	}
+	vaultRank := func(key keys.MasterKey) int {
+		k, ok := key.(*sopsazkv.MasterKey)
+		if !ok {
+			return 0
+		}
+		url := strings.ToLower(k.VaultURL)
+		for i, v := range vaults {
+			if v != "" && strings.Contains(url, strings.ToLower(v)) {
+				return i
+			}
+		}
+		return len(vaults)
+	}
+	sort.SliceStable(group, func(i, j int) bool {
+		if ri, rj := rank(group[i]), rank(group[j]); ri != rj {
+			return ri < rj
+		}
+		return vaultRank(group[i]) < vaultRank(group[j])
+	})
+}
+
 // SopsDecryptWithFormat attempts to load a SOPS encrypted file using the store
 // for the input format, gathers the data key for it from the key service,
 // and then decrypts the file data with the retrieved data key.
 // It returns the decrypted bytes in the provided output format, or an error.
-func (d *Decryptor) SopsDecryptWithFormat(data []byte, inputFormat, outputFormat formats.Format) (_ []byte, err error) {
+// The MAC of the data is only verified when checkSopsMac is enabled.
+func (d *Decryptor) SopsDecryptWithFormat(data []byte, inputFormat, outputFormat formats.Format) ([]byte, error) {
+	return d.sopsDecryptWithFormat(data, inputFormat, outputFormat, d.checkSopsMac)
+}
+
+// sopsDecryptWithFormat decrypts the data as SopsDecryptWithFormat, and
+// verifies the MAC of the decrypted data when verifyMAC is true. A MAC
+// mismatch means the data was modified after it was encrypted, e.g. a value
+// of which the encryption was disabled with an unencrypted suffix or regex.
+func (d *Decryptor) sopsDecryptWithFormat(data []byte, inputFormat, outputFormat formats.Format, verifyMAC bool) (_ []byte, err error) {
+	// Decrypted values may be part of the errors returned by SOPS (e.g. when
+	// they can not be emitted in the output format), redact them.
+	defer func() {
+		err = d.redactor.RedactError(err)
+	}()
 	defer func() {
 		// It was discovered that malicious input and/or output instructions can
 		// make SOPS panic. Recover from this panic and return as an error.
@@ -273,6 +1032,15 @@ func (d *Decryptor) SopsDecryptWithFormat(data []byte, inputFormat, outputFormat
 		}
 	}()
 
+	rawMetadata := sopsMetadata(data, inputFormat)
+	if providers := unsupportedKeyProviders(rawMetadata); len(providers) > 0 {
+		msg := fmt.Sprintf("SOPS metadata references unsupported key provider(s): '%s'", strings.Join(providers, "', '"))
+		if d.unsupportedKeyProvidersWarn == nil {
+			return nil, errors.New(msg)
+		}
+		d.unsupportedKeyProvidersWarn(msg)
+	}
+
 	store := common.StoreForFormat(inputFormat)
 
 	tree, err := store.LoadEncryptedFile(data)
@@ -281,24 +1049,51 @@ func (d *Decryptor) SopsDecryptWithFormat(data []byte, inputFormat, outputFormat
 	}
 
 	for _, group := range tree.Metadata.KeyGroups {
-		// Sort MasterKeys in the group so offline ones are tried first
-		sort.SliceStable(group, func(i, j int) bool {
-			return intkeyservice.IsOfflineMethod(group[i]) && !intkeyservice.IsOfflineMethod(group[j])
-		})
+		d.sortMasterKeys(group)
 	}
 
-	metadataKey, err := tree.Metadata.GetDataKeyWithKeyServices(d.keyServiceServer())
+	// The providers which decrypted the data key are only recorded once the
+	// file is decrypted.
+	var providersMu sync.Mutex
+	var providers []string
+	svcs := recordKeys(d.keyServiceServer(), func(key *keyservice.Key, duration time.Duration, err error) {
+		if k, ok := key.KeyType.(*keyservice.Key_AzureKeyvaultKey); ok {
+			d.recordAzureKey(k.AzureKeyvaultKey, err)
+		}
+		p := intkeyservice.KeyTypeProvider(key)
+		if d.decryptObserver != nil && p != "" {
+			d.decryptObserver(p, duration, err)
+		}
+		if err == nil && p != "" {
+			providersMu.Lock()
+			providers = append(providers, p)
+			providersMu.Unlock()
+		}
+	})
+	ctx := d.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if algorithms := azureKeyAlgorithms(rawMetadata); len(algorithms) > 0 {
+		ctx = intkeyservice.ContextWithAzureAlgorithms(ctx, algorithms)
+	}
+	if err := checkDecryptDeadline(ctx); err != nil {
+		return nil, sopsUserErr("cannot get sops data key", err)
+	}
+	metadataKey, err := getDataKeyWithKeyServices(ctx, tree.Metadata, svcs)
 	if err != nil {
 		return nil, sopsUserErr("cannot get sops data key", err)
 	}
 
+	encrypted := encryptedLeaves(tree.Branches)
 	cipher := aes.NewCipher()
 	mac, err := tree.Decrypt(metadataKey, cipher)
 	if err != nil {
 		return nil, sopsUserErr("error decrypting sops tree", err)
 	}
+	d.redactor.recordDecryptedLeaves(tree.Branches, encrypted)
 
-	if d.checkSopsMac {
+	if verifyMAC {
 		// Compute the hash of the cleartext tree and compare it with
 		// the one that was stored in the document. If they match,
 		// integrity was preserved
@@ -316,7 +1111,8 @@ func (d *Decryptor) SopsDecryptWithFormat(data []byte, inputFormat, outputFormat
 			if originalMac == "" {
 				originalMac = "no MAC"
 			}
-			return nil, fmt.Errorf("failed to verify sops data integrity: expected mac '%s', got '%s'", originalMac, mac)
+			return nil, fmt.Errorf("failed to verify sops data integrity: MAC mismatch, possible tampering: expected mac '%s', got '%s'",
+				originalMac, mac)
 		}
 	}
 
@@ -326,6 +1122,10 @@ func (d *Decryptor) SopsDecryptWithFormat(data []byte, inputFormat, outputFormat
 		return nil, sopsUserErr(fmt.Sprintf("failed to emit encrypted %s file as decrypted %s",
 			sopsFormatToString[inputFormat], sopsFormatToString[outputFormat]), err)
 	}
+	providersMu.Lock()
+	d.recordKeyProviders(providers)
+	providersMu.Unlock()
+	d.recordDataKeyRotations(tree.Metadata)
 	return out, err
 }
 
@@ -342,6 +1142,20 @@ func (d *Decryptor) DecryptResource(res *resource.Resource) (*resource.Resource,
 
 	switch d.kustomization.Spec.Decryption.Provider {
 	case DecryptionProviderSOPS:
+		included, untracked, originPath, err := d.filterResource(res)
+		if err != nil {
+			return nil, err
+		}
+		// Resources which do not require decryption are still returned
+		// when their origin annotation has been removed.
+		var modified *resource.Resource
+		if untracked {
+			modified = res
+		}
+		if !included {
+			return modified, nil
+		}
+
 		switch {
 		case isSOPSEncryptedResource(res):
 			// As we are expecting to decrypt right before applying, we do not
@@ -362,7 +1176,22 @@ func (d *Decryptor) DecryptResource(res *resource.Resource) (*resource.Resource,
 			err = res.UnmarshalJSON(data)
 			if err != nil {
 				return nil, fmt.Errorf("failed to unmarshal decrypted '%s/%s' %s to JSON: %w",
-					res.GetNamespace(), res.GetName(), res.GetKind(), err)
+					res.GetNamespace(), res.GetName(), res.GetKind(), d.redactor.RedactError(err))
+			}
+
+			if d.validatesSecrets() && res.GetKind() == "Secret" {
+				obj, err := res.Map()
+				if err != nil {
+					return nil, fmt.Errorf("failed to read decrypted '%s/%s' Secret: %w",
+						res.GetNamespace(), res.GetName(), d.redactor.RedactError(err))
+				}
+				if err := validateSecret(obj); err != nil {
+					msg := fmt.Sprintf("invalid decrypted Secret '%s/%s'", res.GetNamespace(), res.GetName())
+					if originPath != "" {
+						msg += fmt.Sprintf(" from '%s'", originPath)
+					}
+					return nil, fmt.Errorf("%s: %w", msg, d.redactor.RedactError(err))
+				}
 			}
 			return res, nil
 		case res.GetKind() == "Secret":
@@ -376,21 +1205,220 @@ func (d *Decryptor) DecryptResource(res *resource.Resource) (*resource.Resource,
 					continue
 				}
 
-				if inF := detectFormatFromMarkerBytes(data); inF != unsupportedFormat {
-					outF := formatForPath(key)
-					out, err := d.SopsDecryptWithFormat(data, inF, outF)
-					if err != nil {
-						return nil, fmt.Errorf("failed to decrypt and format '%s/%s' Secret field '%s': %w",
-							res.GetNamespace(), res.GetName(), key, err)
-					}
-					dataMap[key] = base64.StdEncoding.EncodeToString(out)
-				}
-			}
-			res.SetDataMap(dataMap)
-			return res, nil
+				if inF, outF := formatsForData(key, data); inF != unsupportedFormat {
+					out, err := d.sopsDecryptWithFormat(data, inF, outF, true)
+					if err != nil {
+						return nil, fmt.Errorf("failed to decrypt and format '%s/%s' Secret field '%s': %w",
+							res.GetNamespace(), res.GetName(), key, err)
+					}
+					d.redactor.Record(string(out))
+					dataMap[key] = base64.StdEncoding.EncodeToString(out)
+				}
+			}
+			res.SetDataMap(dataMap)
+			return res, nil
+		}
+		return modified, nil
+	}
+	return nil, nil
+}
+
+// DecryptSecret decrypts the SOPS encrypted values of the data of the given
+// Secret in place, e.g. of the Secret holding the kubeconfig of a remote
+// cluster. The formats of the values are detected as for the data entries of
+// the Secrets decrypted by DecryptResource, and the values without a SOPS
+// marker are left as is.
+func (d *Decryptor) DecryptSecret(secret *corev1.Secret) error {
+	for key, value := range secret.Data {
+		inF, outF := formatsForData(key, value)
+		if inF == unsupportedFormat {
+			continue
+		}
+		out, err := d.sopsDecryptWithFormat(value, inF, outF, true)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt and format '%s/%s' Secret field '%s': %w",
+				secret.GetNamespace(), secret.GetName(), key, err)
+		}
+		d.redactor.Record(string(out))
+		secret.Data[key] = out
+	}
+	return nil
+}
+
+// TrackOrigins enables the Kustomize origin annotations in the Kustomization
+// file in the directory at the provided path, when the v1.Decryption of the
+// Kustomization has Include or Exclude globs, validates the decrypted Secrets,
+// or only reports failures. This allows DecryptResource to match the resources
+// against the paths of the files they originate from, and to report these
+// paths. Unless they were already enabled by the Kustomization file, the
+// origin annotations are removed again by DecryptResource.
+func (d *Decryptor) TrackOrigins(path string) error {
+	if !d.tracksOrigins() {
+		return nil
+	}
+
+	_, relPath, err := securePaths(d.root, path)
+	if err != nil {
+		return err
+	}
+	d.originBase = relPath
+
+	kusPath, err := secureKustomizationFilePath(d.root, relPath)
+	if err != nil {
+		return err
+	}
+	kus, err := secureLoadKustomizationFile(d.root, relPath)
+	if err != nil {
+		return err
+	}
+	for _, m := range kus.BuildMetadata {
+		if m == kustypes.OriginAnnotations {
+			return nil
+		}
+	}
+
+	kus.BuildMetadata = append(kus.BuildMetadata, kustypes.OriginAnnotations)
+	data, err := yaml.Marshal(kus)
+	if err != nil {
+		return fmt.Errorf("failed to marshal kustomization file: %w", err)
+	}
+	if err = os.WriteFile(kusPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write kustomization file: %w", securePathErr(d.root, err))
+	}
+	d.stripOrigins = true
+	return nil
+}
+
+// filterResource returns if the provided resource originates from a file
+// matching the v1.Decryption path globs, and if its origin annotation has been
+// removed. Resources of which the origin is unknown are only included when
+// there are no Include globs.
+func (d *Decryptor) filterResource(res *resource.Resource) (included bool, untracked bool, originPath string, err error) {
+	if !d.tracksOrigins() {
+		return true, false, "", nil
+	}
+
+	origin, err := res.GetOrigin()
+	if err != nil {
+		return false, false, "", fmt.Errorf("failed to get origin of '%s/%s' %s: %w",
+			res.GetNamespace(), res.GetName(), res.GetKind(), err)
+	}
+	if origin != nil && d.stripOrigins {
+		if err = res.SetOrigin(nil); err != nil {
+			return false, false, "", fmt.Errorf("failed to remove origin of '%s/%s' %s: %w",
+				res.GetNamespace(), res.GetName(), res.GetKind(), err)
+		}
+		untracked = true
+	}
+
+	originPath = d.originPath(origin)
+	if !d.hasPathGlobs() {
+		return true, untracked, originPath, nil
+	}
+	if originPath == "" {
+		return len(d.kustomization.Spec.Decryption.Include) == 0, untracked, "", nil
+	}
+
+	included, err = d.isIncludedPath(originPath)
+	return included, untracked, originPath, err
+}
+
+// OriginPath returns the path of the file the provided resource originates
+// from, relative to the root of the source. It returns an empty string if the
+// origin of the resource is unknown, or is not tracked by TrackOrigins.
+// It must be called before DecryptResource, which removes the origin
+// annotations.
+func (d *Decryptor) OriginPath(res *resource.Resource) (string, error) {
+	if !d.tracksOrigins() {
+		return "", nil
+	}
+	origin, err := res.GetOrigin()
+	if err != nil {
+		return "", fmt.Errorf("failed to get origin of '%s/%s' %s: %w",
+			res.GetNamespace(), res.GetName(), res.GetKind(), err)
+	}
+	return d.originPath(origin), nil
+}
+
+// originPath returns the path of the file of the provided origin, relative to
+// the root of the source. Generated resources have no path, but are attributed
+// to the Kustomization file they are configured in.
+func (d *Decryptor) originPath(origin *resource.Origin) string {
+	if origin == nil || origin.Repo != "" {
+		return ""
+	}
+	p := origin.Path
+	if p == "" {
+		p = origin.ConfiguredIn
+	}
+	if p == "" {
+		return ""
+	}
+	return filepath.Join(d.originBase, p)
+}
+
+// tracksOrigins returns if the v1.Decryption of the Kustomization requires
+// the origins of the resources to be tracked.
+func (d *Decryptor) tracksOrigins() bool {
+	return d.hasPathGlobs() || d.validatesSecrets() || d.reportsOnly()
+}
+
+// reportsOnly returns if the v1.Decryption of the Kustomization only
+// reports the resources which fail to be decrypted.
+func (d *Decryptor) reportsOnly() bool {
+	return d.kustomization != nil && d.kustomization.Spec.Decryption != nil &&
+		d.kustomization.Spec.Decryption.ReportOnly
+}
+
+// validatesSecrets returns if the v1.Decryption of the Kustomization
+// requires the decrypted Secrets to be validated.
+func (d *Decryptor) validatesSecrets() bool {
+	return d.kustomization != nil && d.kustomization.Spec.Decryption != nil &&
+		d.kustomization.Spec.Decryption.ValidateSecrets
+}
+
+// hasPathGlobs returns if the v1.Decryption of the Kustomization restricts
+// the files to decrypt with Include or Exclude globs.
+func (d *Decryptor) hasPathGlobs() bool {
+	if d.kustomization == nil || d.kustomization.Spec.Decryption == nil {
+		return false
+	}
+	dec := d.kustomization.Spec.Decryption
+	return len(dec.Include) > 0 || len(dec.Exclude) > 0
+}
+
+// isIncludedPath returns if the provided path, relative to root, matches any
+// of the v1.Decryption Include globs, and none of the Exclude globs.
+func (d *Decryptor) isIncludedPath(p string) (bool, error) {
+	if !d.hasPathGlobs() {
+		return true, nil
+	}
+
+	dec := d.kustomization.Spec.Decryption
+	p = filepath.ToSlash(filepath.Clean(p))
+	for _, pattern := range dec.Exclude {
+		ok, err := matchGlob(pattern, p)
+		if err != nil {
+			return false, fmt.Errorf("invalid decryption exclude glob '%s': %w", pattern, err)
+		}
+		if ok {
+			return false, nil
 		}
 	}
-	return nil, nil
+
+	if len(dec.Include) == 0 {
+		return true, nil
+	}
+	for _, pattern := range dec.Include {
+		ok, err := matchGlob(pattern, p)
+		if err != nil {
+			return false, fmt.Errorf("invalid decryption include glob '%s': %w", pattern, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 // DecryptEnvSources attempts to decrypt all types.SecretArgs FileSources and
@@ -416,7 +1444,7 @@ func (d *Decryptor) DecryptEnvSources(path string) error {
 // given map.
 func (d *Decryptor) decryptKustomizationEnvSources(visited map[string]struct{}) visitKustomization {
 	return func(root, path string, kus *kustypes.Kustomization) error {
-		visitRef := func(sourcePath string, format formats.Format) error {
+		visitRef := func(sourcePath string, decrypt func(absRef string) error) error {
 			if !filepath.IsAbs(sourcePath) {
 				sourcePath = filepath.Join(path, sourcePath)
 			}
@@ -428,7 +1456,13 @@ func (d *Decryptor) decryptKustomizationEnvSources(visited map[string]struct{})
 				return nil
 			}
 
-			if err := d.sopsDecryptFile(absRef, format, format); err != nil {
+			// Short-circuit files not targeted by the path globs,
+			// before the file is read to detect SOPS metadata.
+			if included, err := d.isIncludedPath(stripRoot(root, absRef)); err != nil || !included {
+				return err
+			}
+
+			if err := decrypt(absRef); err != nil {
 				return securePathErr(root, err)
 			}
 
@@ -448,7 +1482,11 @@ func (d *Decryptor) decryptKustomizationEnvSources(visited map[string]struct{})
 				} else {
 					filePath = key
 				}
-				if err := visitRef(filePath, formatForPath(key)); err != nil {
+				// The key determines the format of the decrypted data,
+				// while the input format is detected from the file.
+				if err := visitRef(filePath, func(absRef string) error {
+					return d.sopsDecryptFileSource(absRef, key)
+				}); err != nil {
 					return err
 				}
 			}
@@ -458,7 +1496,9 @@ func (d *Decryptor) decryptKustomizationEnvSources(visited map[string]struct{})
 					// Default to dotenv
 					format = formats.Dotenv
 				}
-				if err := visitRef(envFile, format); err != nil {
+				if err := visitRef(envFile, func(absRef string) error {
+					return d.sopsDecryptFile(absRef, format, format)
+				}); err != nil {
 					return err
 				}
 			}
@@ -467,6 +1507,53 @@ func (d *Decryptor) decryptKustomizationEnvSources(visited map[string]struct{})
 	}
 }
 
+// DecryptFile decrypts the SOPS encrypted data of a file in the provided
+// input format, and returns it in the output format.
+// When both formats are YAML and the data mixes encrypted and plain
+// documents, the data is decrypted per document: the SOPS encrypted documents
+// are decrypted, while the other documents and the document separators are
+// returned byte-for-byte, in their original order.
+// The MAC of the data is verified, and a mismatch is returned as an error.
+// Data without a SOPS marker is returned as is.
+func (d *Decryptor) DecryptFile(data []byte, inputFormat, outputFormat formats.Format) ([]byte, error) {
+	marker := sopsFormatToMarkerBytes[inputFormat]
+	if !bytes.Contains(data, marker) {
+		return data, nil
+	}
+
+	var docs [][]byte
+	if inputFormat == formats.Yaml && outputFormat == formats.Yaml {
+		docs = splitYAMLDocuments(data)
+	}
+	var encrypted int
+	for _, doc := range docs {
+		if bytes.Contains(doc, marker) {
+			encrypted++
+		}
+	}
+	// Documents encrypted together by SOPS share the same metadata, and have
+	// to be decrypted at once for the MAC to match.
+	if encrypted == len(docs) {
+		return d.sopsDecryptWithFormat(data, inputFormat, outputFormat, true)
+	}
+
+	var out bytes.Buffer
+	for i, doc := range docs {
+		if !bytes.Contains(doc, marker) {
+			out.Write(doc)
+			continue
+		}
+		separator, body := cutYAMLDocumentSeparator(doc)
+		plain, err := d.sopsDecryptWithFormat(body, formats.Yaml, formats.Yaml, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt YAML document %d: %w", i, err)
+		}
+		out.Write(separator)
+		out.Write(plain)
+	}
+	return out.Bytes(), nil
+}
+
 // sopsDecryptFile attempts to decrypt the file at the given path using SOPS'
 // store for the provided input format, and writes it back to the path using
 // the store for the output format.
@@ -477,28 +1564,56 @@ func (d *Decryptor) decryptKustomizationEnvSources(visited map[string]struct{})
 // verify whether the path provided is inside the working directory. Boundary
 // enforcement is expected to have been done by the caller.
 func (d *Decryptor) sopsDecryptFile(path string, inputFormat, outputFormat formats.Format) error {
-	fi, err := os.Lstat(path)
+	data, err := d.readEncryptedFile(path)
 	if err != nil {
 		return err
 	}
 
-	if !fi.Mode().IsRegular() {
-		return fmt.Errorf("cannot decrypt irregular file as it has file mode type bits set")
-	}
-	if fileSize := fi.Size(); d.maxFileSize > 0 && fileSize > d.maxFileSize {
-		return fmt.Errorf("cannot decrypt file with size (%d bytes) exceeding limit (%d)", fileSize, d.maxFileSize)
+	if !bytes.Contains(data, sopsFormatToMarkerBytes[inputFormat]) {
+		return nil
 	}
+	return d.writeDecryptedFile(path, data, inputFormat, outputFormat)
+}
 
-	data, err := os.ReadFile(path)
+// sopsDecryptFileSource attempts to decrypt the file at the given path, which
+// is referenced by a SecretGenerator file source with the given key. The input
+// format is detected from the data of the file, and the output format is
+// determined by formatsForData.
+// The same path requirements as for sopsDecryptFile apply.
+func (d *Decryptor) sopsDecryptFileSource(path, key string) error {
+	data, err := d.readEncryptedFile(path)
 	if err != nil {
 		return err
 	}
 
-	if !bytes.Contains(data, sopsFormatToMarkerBytes[inputFormat]) {
+	inputFormat, outputFormat := formatsForData(key, data)
+	if inputFormat == unsupportedFormat {
 		return nil
 	}
+	return d.writeDecryptedFile(path, data, inputFormat, outputFormat)
+}
+
+// readEncryptedFile reads the file at the given path, after confirming it is
+// a regular file which does not exceed the maxFileSize.
+func (d *Decryptor) readEncryptedFile(path string) ([]byte, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("cannot decrypt irregular file as it has file mode type bits set")
+	}
+	if fileSize := fi.Size(); d.maxFileSize > 0 && fileSize > d.maxFileSize {
+		return nil, fmt.Errorf("cannot decrypt file with size (%d bytes) exceeding limit (%d)", fileSize, d.maxFileSize)
+	}
+	return os.ReadFile(path)
+}
 
-	out, err := d.SopsDecryptWithFormat(data, inputFormat, outputFormat)
+// writeDecryptedFile decrypts the data using DecryptFile, and writes the
+// result to the given path.
+func (d *Decryptor) writeDecryptedFile(path string, data []byte, inputFormat, outputFormat formats.Format) error {
+	out, err := d.DecryptFile(data, inputFormat, outputFormat)
 	if err != nil {
 		return err
 	}
@@ -567,12 +1682,65 @@ func (d *Decryptor) loadKeyServiceServers() {
 	serverOpts := []intkeyservice.ServerOption{
 		intkeyservice.WithGnuPGHome(d.gnuPGHome),
 		intkeyservice.WithVaultToken(d.vaultToken),
+		intkeyservice.WithVaultKubernetesAuth{Auth: d.vaultKubernetesAuth},
+		intkeyservice.WithVaultNamespace(d.vaultNamespace),
 		intkeyservice.WithAgeIdentities(d.ageIdentities),
 		intkeyservice.WithGCPCredsJSON(d.gcpCredsJSON),
 	}
+	if d.azureToken == nil && !d.azureNoDefaultCredential {
+		// Without an Azure authentication file, the Token of the default
+		// credential is shared across reconciliations. On failure, the
+		// requests construct the default credential and return the error.
+		d.azureToken, _ = d.azureConfigs.DefaultToken()
+	}
 	if d.azureToken != nil {
 		serverOpts = append(serverOpts, intkeyservice.WithAzureToken{Token: d.azureToken})
 	}
+	if len(d.azureCABundle) > 0 {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureCABundle(d.azureCABundle))
+	}
+	if d.azureTransport != (azkv.Transport{}) {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureTransport(d.azureTransport))
+	}
+	if d.azureAPIVersion != "" {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureAPIVersion(d.azureAPIVersion))
+	}
+	if d.azureLogger != nil {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureLogger{Logger: azkv.Logger(*d.azureLogger)})
+	}
+	if d.azureLimiter != nil {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureLimiter{Limiter: d.azureLimiter})
+	}
+	if d.azureBreaker != nil {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureBreaker{Breaker: d.azureBreaker})
+	}
+	if d.azureRetryPolicy != (azkv.RetryPolicy{}) {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureRetryPolicy(d.azureRetryPolicy))
+	}
+	if d.azureRewriteVaultSuffix {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureRewriteVaultDNSSuffix(true))
+	}
+	if d.azureRecoverDeleted {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureRecoverDeletedKeys(true))
+	}
+	if d.azureResolveLatest {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureResolveLatestVersion(true))
+	}
+	if d.azureNoDefaultCredential {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureDisableDefaultCredential(true))
+	}
+	if d.azureDataKeys != nil {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureDataKeyCache{Cache: d.azureDataKeys})
+	}
+	if len(d.azureAllowedAlgorithms) > 0 {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureAllowedAlgorithms(d.azureAllowedAlgorithms))
+	}
+	if d.azureDefaultAlgorithm != "" {
+		serverOpts = append(serverOpts, intkeyservice.WithAzureDefaultAlgorithm(d.azureDefaultAlgorithm))
+	}
+	if d.kmsClientScope != nil {
+		serverOpts = append(serverOpts, intkeyservice.WithClientScope{Scope: d.kmsClientScope})
+	}
 	serverOpts = append(serverOpts, intkeyservice.WithAWSKeys{CredsProvider: d.awsCredsProvider})
 	server := intkeyservice.NewServer(serverOpts...)
 	d.keyServices = append(make([]keyservice.KeyServiceClient, 0), keyservice.NewCustomLocalClient(server))
@@ -583,54 +1751,66 @@ func (d *Decryptor) loadKeyServiceServers() {
 // If multiple Kustomization files are found, or the request is ambiguous, an
 // error is returned.
 func secureLoadKustomizationFile(root, path string) (*kustypes.Kustomization, error) {
+	loadPath, err := secureKustomizationFilePath(root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(loadPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kustomization file: %w", securePathErr(root, err))
+	}
+
+	kus := kustypes.Kustomization{
+		TypeMeta: kustypes.TypeMeta{
+			APIVersion: kustypes.KustomizationVersion,
+			Kind:       kustypes.KustomizationKind,
+		},
+	}
+	if err := yaml.Unmarshal(data, &kus); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kustomization file from '%s': %w", loadPath, err)
+	}
+	return &kus, nil
+}
+
+// secureKustomizationFilePath returns the absolute path of the Kustomization
+// file in the given directory path.
+// If multiple Kustomization files are found, or the request is ambiguous, an
+// error is returned.
+func secureKustomizationFilePath(root, path string) (string, error) {
 	if !filepath.IsAbs(root) {
-		return nil, fmt.Errorf("root '%s' must be absolute", root)
+		return "", fmt.Errorf("root '%s' must be absolute", root)
 	}
 	if filepath.IsAbs(path) {
-		return nil, fmt.Errorf("path '%s' must be relative", path)
+		return "", fmt.Errorf("path '%s' must be relative", path)
 	}
 
 	var loadPath string
 	for _, fName := range konfig.RecognizedKustomizationFileNames() {
 		fPath, err := securejoin.SecureJoin(root, filepath.Join(path, fName))
 		if err != nil {
-			return nil, fmt.Errorf("failed to secure join %s: %w", fName, err)
+			return "", fmt.Errorf("failed to secure join %s: %w", fName, err)
 		}
 		fi, err := os.Lstat(fPath)
 		if err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
 				continue
 			}
-			return nil, fmt.Errorf("failed to lstat %s: %w", fName, securePathErr(root, err))
+			return "", fmt.Errorf("failed to lstat %s: %w", fName, securePathErr(root, err))
 		}
 
 		if !fi.Mode().IsRegular() {
-			return nil, fmt.Errorf("expected %s to be a regular file", fName)
+			return "", fmt.Errorf("expected %s to be a regular file", fName)
 		}
 		if loadPath != "" {
-			return nil, fmt.Errorf("found multiple kustomization files")
+			return "", fmt.Errorf("found multiple kustomization files")
 		}
 		loadPath = fPath
 	}
 	if loadPath == "" {
-		return nil, fmt.Errorf("no kustomization file found")
-	}
-
-	data, err := os.ReadFile(loadPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read kustomization file: %w", securePathErr(root, err))
-	}
-
-	kus := kustypes.Kustomization{
-		TypeMeta: kustypes.TypeMeta{
-			APIVersion: kustypes.KustomizationVersion,
-			Kind:       kustypes.KustomizationKind,
-		},
-	}
-	if err := yaml.Unmarshal(data, &kus); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal kustomization file from '%s': %w", loadPath, err)
+		return "", fmt.Errorf("no kustomization file found")
 	}
-	return &kus, nil
+	return loadPath, nil
 }
 
 // visitKustomization is called by recurseKustomizationFiles after every
@@ -719,6 +1899,320 @@ func recurseKustomizationFiles(root, path string, visit visitKustomization, visi
 	return nil
 }
 
+// getDataKeyWithKeyServices retrieves the data key of the SOPS metadata by
+// decrypting the parts of it in the key groups with the provided key services.
+// A key group is decrypted as soon as one of its master keys succeeds, and
+// the remaining key groups are skipped once enough parts have been decrypted
+// to meet the Shamir threshold. An error is only returned when the threshold
+// can't be met, aggregating the errors of the master keys that failed.
+func getDataKeyWithKeyServices(ctx context.Context, metadata sops.Metadata, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	if metadata.DataKey != nil {
+		return metadata.DataKey, nil
+	}
+
+	groups := metadata.KeyGroups
+	threshold := 1
+	if len(groups) > 1 {
+		threshold = metadata.ShamirThreshold
+		if threshold == 0 {
+			// Mirrors the default of SOPS when encrypting.
+			threshold = len(groups)
+		}
+	}
+
+	var parts [][]byte
+	var errs []error
+	for i, group := range groups {
+		if len(parts) >= threshold {
+			break
+		}
+		part, err := decryptKeyGroup(ctx, group, svcs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("key group %d: %w", i, err))
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) < threshold {
+		return nil, fmt.Errorf("%d successful key group(s) required, got %d: %w",
+			threshold, len(parts), kerrors.NewAggregate(errs))
+	}
+
+	if len(groups) == 1 {
+		return parts[0], nil
+	}
+	dataKey, err := shamir.Combine(parts)
+	if err != nil {
+		return nil, fmt.Errorf("could not get data key from shamir parts: %w", err)
+	}
+	return dataKey, nil
+}
+
+// checkDecryptDeadline returns an error if no time remains until the deadline
+// of the given context, e.g. of the reconciliation, as the requests to
+// decrypt the data key of a SOPS file could not complete.
+func checkDecryptDeadline(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= 0 {
+		return fmt.Errorf("no time remaining before the deadline to decrypt: %w", context.DeadlineExceeded)
+	}
+	return nil
+}
+
+// decryptKeyGroup attempts to decrypt the data key part of the key group with
+// the master keys in order, returning as soon as one of them succeeds. The
+// remaining master keys are not attempted once the context is done.
+func decryptKeyGroup(ctx context.Context, group sops.KeyGroup, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	if len(group) == 0 {
+		return nil, fmt.Errorf("no master keys")
+	}
+
+	var errs []error
+	for _, key := range group {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("remaining master keys not attempted: %w", err))
+			break
+		}
+		part, err := decryptMasterKey(ctx, key, svcs)
+		if err == nil {
+			return part, nil
+		}
+		errs = append(errs, fmt.Errorf("failed to decrypt with '%s': %w", key.ToString(), err))
+	}
+	return nil, kerrors.NewAggregate(errs)
+}
+
+// decryptMasterKey attempts to decrypt the encrypted data key of the master
+// key with the key services in order, returning as soon as one of them
+// succeeds.
+func decryptMasterKey(ctx context.Context, key keys.MasterKey, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	if len(svcs) == 0 {
+		return nil, fmt.Errorf("no key services provided")
+	}
+
+	svcKey := keyservice.KeyFromMasterKey(key)
+	var errs []error
+	for _, svc := range svcs {
+		rsp, err := decryptWithContext(ctx, svc, &keyservice.DecryptRequest{
+			Ciphertext: key.EncryptedDataKey(),
+			Key:        &svcKey,
+		})
+		if err == nil {
+			return rsp.Plaintext, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, kerrors.NewAggregate(errs)
+}
+
+// maxPendingDecrypts is the maximum number of decrypt requests sent by
+// decryptWithContext which may be pending at once, including the aborted
+// ones of which the key service has not returned yet.
+const maxPendingDecrypts = 64
+
+// pendingDecrypts holds a slot for each of the pending decrypt requests sent
+// by decryptWithContext.
+var pendingDecrypts = make(chan struct{}, maxPendingDecrypts)
+
+// decryptWithContext sends the decrypt request to the key service, and
+// returns the error of the context as soon as it is done, without waiting for
+// the response of the key services which do not honor the context, e.g.
+// the SOPS key sources which are not context-aware. Their response is
+// discarded. The requests wait for one of the maxPendingDecrypts slots
+// before they are sent, so that the aborted requests of a key service which
+// does not return can't pile up.
+func decryptWithContext(ctx context.Context, svc keyservice.KeyServiceClient, req *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
+	if ctx.Done() == nil {
+		return svc.Decrypt(ctx, req)
+	}
+	select {
+	case pendingDecrypts <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("decrypt request aborted: %w", ctx.Err())
+	}
+	type result struct {
+		rsp *keyservice.DecryptResponse
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		defer func() { <-pendingDecrypts }()
+		rsp, err := svc.Decrypt(ctx, req)
+		ch <- result{rsp: rsp, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.rsp, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("decrypt request aborted: %w", ctx.Err())
+	}
+}
+
+// keyRecorder is a keyservice.KeyServiceClient which records the results and
+// durations of the decryptions of the underlying client with their keys.
+type keyRecorder struct {
+	keyservice.KeyServiceClient
+	record func(key *keyservice.Key, duration time.Duration, err error)
+}
+
+// recordKeys wraps the key services with keyRecorders calling record.
+func recordKeys(svcs []keyservice.KeyServiceClient, record func(key *keyservice.Key, duration time.Duration, err error)) []keyservice.KeyServiceClient {
+	recorders := make([]keyservice.KeyServiceClient, len(svcs))
+	for i, svc := range svcs {
+		recorders[i] = keyRecorder{KeyServiceClient: svc, record: record}
+	}
+	return recorders
+}
+
+func (r keyRecorder) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	start := time.Now()
+	rsp, err := r.KeyServiceClient.Decrypt(ctx, req, opts...)
+	if req.Key != nil {
+		r.record(req.Key, time.Since(start), err)
+	}
+	return rsp, err
+}
+
+// splitYAMLDocuments splits the data into YAML documents, each starting with
+// its document separator line if any, so that concatenating them returns the
+// original data.
+func splitYAMLDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	start := 0
+	for i := 0; i < len(data); {
+		end := len(data)
+		if n := bytes.IndexByte(data[i:], '\n'); n >= 0 {
+			end = i + n + 1
+		}
+		if i > start && isYAMLDocumentSeparator(data[i:end]) {
+			docs = append(docs, data[start:i])
+			start = i
+		}
+		i = end
+	}
+	return append(docs, data[start:])
+}
+
+// cutYAMLDocumentSeparator returns the document separator line of the YAML
+// document, and the remaining document body.
+func cutYAMLDocumentSeparator(doc []byte) ([]byte, []byte) {
+	end := len(doc)
+	if n := bytes.IndexByte(doc, '\n'); n >= 0 {
+		end = n + 1
+	}
+	if !isYAMLDocumentSeparator(doc[:end]) {
+		return nil, doc
+	}
+	return doc[:end], doc[end:]
+}
+
+// isYAMLDocumentSeparator returns if the line is a YAML document separator.
+func isYAMLDocumentSeparator(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	if !bytes.HasPrefix(line, []byte("---")) {
+		return false
+	}
+	rest := line[3:]
+	return len(rest) == 0 || rest[0] == ' ' || rest[0] == '\t'
+}
+
+// unsupportedKeyProviders returns the sorted names of the key providers
+// referenced in the raw SOPS metadata, as returned by sopsMetadata, which
+// are not supported by the decryptor. Key providers are detected as metadata
+// fields holding a list of master keys, to not mistake other metadata fields
+// for providers.
+func unsupportedKeyProviders(metadata map[string]interface{}) []string {
+	found := make(map[string]struct{})
+	collect := func(fields map[string]interface{}) {
+		for name, value := range fields {
+			if _, ok := value.([]interface{}); !ok || name == sopsMetadataKeyGroups {
+				continue
+			}
+			if _, ok := sopsKeyProviders[name]; !ok {
+				found[name] = struct{}{}
+			}
+		}
+	}
+	collect(metadata)
+	if groups, ok := metadata[sopsMetadataKeyGroups].([]interface{}); ok {
+		for _, group := range groups {
+			if fields, ok := group.(map[string]interface{}); ok {
+				collect(fields)
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return nil
+	}
+	providers := make([]string, 0, len(found))
+	for name := range found {
+		providers = append(providers, name)
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// sopsMetadata returns the raw SOPS metadata of the data, including the
+// fields which are not known to SOPS, or nil for INI data and invalid data.
+func sopsMetadata(data []byte, format formats.Format) map[string]interface{} {
+	switch format {
+	case formats.Binary, formats.Json, formats.Yaml:
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil
+		}
+		metadata, _ := doc["sops"].(map[string]interface{})
+		return metadata
+	case formats.Dotenv:
+		flat := make(map[string]interface{})
+		for _, line := range strings.Split(string(data), "\n") {
+			if !strings.HasPrefix(line, sopsDotenvPrefix) {
+				continue
+			}
+			if kv := strings.SplitN(line[len(sopsDotenvPrefix):], "=", 2); len(kv) == 2 {
+				flat[kv[0]] = kv[1]
+			}
+		}
+		return stores.Unflatten(flat)
+	}
+	return nil
+}
+
+// azureKeyAlgorithms returns the algorithms recorded in the 'algorithm'
+// field of the Azure Key Vault master keys in the raw SOPS metadata, as
+// returned by sopsMetadata, by key ID. SOPS does not parse this field, the
+// master keys without it are omitted.
+func azureKeyAlgorithms(metadata map[string]interface{}) map[string]string {
+	algorithms := make(map[string]string)
+	collect := func(fields map[string]interface{}) {
+		keys, _ := fields[sopsAzureKeyVaultField].([]interface{})
+		for _, k := range keys {
+			key, ok := k.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			algorithm, _ := key["algorithm"].(string)
+			if algorithm == "" {
+				continue
+			}
+			id := fmt.Sprintf("%v/keys/%v/%v", key["vault_url"], key["name"], key["version"])
+			algorithms[id] = algorithm
+		}
+	}
+	collect(metadata)
+	if groups, ok := metadata[sopsMetadataKeyGroups].([]interface{}); ok {
+		for _, group := range groups {
+			if fields, ok := group.(map[string]interface{}); ok {
+				collect(fields)
+			}
+		}
+	}
+	return algorithms
+}
+
 // isSOPSEncryptedResource detects if the given resource is a SOPS' encrypted
 // resource by looking for ".sops" and ".sops.mac" fields.
 func isSOPSEncryptedResource(res *resource.Resource) bool {
@@ -762,6 +2256,91 @@ func stripRoot(root, path string) string {
 	return filepath.Clean(filepath.Join("."+sepStr, path))
 }
 
+// secretTypeRequiredKeys contains the data keys required by the built-in
+// Secret types.
+var secretTypeRequiredKeys = map[corev1.SecretType][]string{
+	corev1.SecretTypeOpaque:              nil,
+	corev1.SecretTypeServiceAccountToken: nil,
+	corev1.SecretTypeBasicAuth:           nil,
+	corev1.SecretTypeBootstrapToken:      nil,
+	corev1.SecretTypeDockercfg:           {corev1.DockerConfigKey},
+	corev1.SecretTypeDockerConfigJson:    {corev1.DockerConfigJsonKey},
+	corev1.SecretTypeSSHAuth:             {corev1.SSHAuthPrivateKey},
+	corev1.SecretTypeTLS:                 {corev1.TLSCertKey, corev1.TLSPrivateKeyKey},
+}
+
+// validateSecret validates the structure of the Secret object, returning
+// an error describing all the problems found. The values of the Secret are
+// never part of the error.
+func validateSecret(obj map[string]interface{}) error {
+	var errs []error
+	keys := make(map[string]struct{})
+
+	validateKeys := func(field string, v interface{}, decode bool) {
+		if v == nil {
+			return
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: must be a map of strings", field))
+			return
+		}
+		for k, value := range m {
+			for _, msg := range validation.IsConfigMapKey(k) {
+				errs = append(errs, fmt.Errorf("%s[%s]: invalid key: %s", field, k, msg))
+			}
+			s, ok := value.(string)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s[%s]: must be a string", field, k))
+				continue
+			}
+			if decode {
+				if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+					errs = append(errs, fmt.Errorf("%s[%s]: must be base64 encoded", field, k))
+					continue
+				}
+			}
+			keys[k] = struct{}{}
+		}
+	}
+	validateKeys("data", obj["data"], true)
+	validateKeys("stringData", obj["stringData"], false)
+
+	secretType := corev1.SecretTypeOpaque
+	if v, ok := obj["type"]; ok && v != nil {
+		s, ok := v.(string)
+		if !ok {
+			errs = append(errs, fmt.Errorf("type: must be a string"))
+		} else if s != "" {
+			secretType = corev1.SecretType(s)
+		}
+	}
+	// Custom types are not validated, like the Kubernetes API does.
+	required, known := secretTypeRequiredKeys[secretType]
+	if !known && strings.HasPrefix(string(secretType), "kubernetes.io/") {
+		errs = append(errs, fmt.Errorf("type: unknown built-in type '%s'", secretType))
+	}
+	for _, k := range required {
+		if _, ok := keys[k]; !ok {
+			errs = append(errs, fmt.Errorf("data[%s]: required for type '%s'", k, secretType))
+		}
+	}
+	if secretType == corev1.SecretTypeBasicAuth {
+		_, hasUsername := keys[corev1.BasicAuthUsernameKey]
+		_, hasPassword := keys[corev1.BasicAuthPasswordKey]
+		if !hasUsername && !hasPassword {
+			errs = append(errs, fmt.Errorf("data: one of '%s' or '%s' is required for type '%s'",
+				corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey, secretType))
+		}
+	}
+
+	// Sort the errors, as the order of the map iteration is random.
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+	return kerrors.NewAggregate(errs)
+}
+
 func sopsUserErr(msg string, err error) error {
 	if userErr, ok := err.(sops.UserError); ok {
 		err = fmt.Errorf(userErr.UserError())
@@ -785,11 +2364,85 @@ func formatForPath(path string) formats.Format {
 	}
 }
 
+// detectFormatFromMarkerBytes returns the SOPS format of the given data,
+// based on the sopsFormatToMarkerBytes it contains. As the binary format is
+// stored in a JSON envelope, data with the JSON marker is only detected as
+// binary when it has the shape of the envelope.
 func detectFormatFromMarkerBytes(b []byte) formats.Format {
-	for k, v := range sopsFormatToMarkerBytes {
-		if bytes.Contains(b, v) {
-			return k
+	for _, f := range []formats.Format{formats.Dotenv, formats.Ini, formats.Yaml, formats.Json} {
+		if bytes.Contains(b, sopsFormatToMarkerBytes[f]) {
+			if f == formats.Json && isSOPSBinaryEnvelope(b) {
+				return formats.Binary
+			}
+			return f
 		}
 	}
 	return unsupportedFormat
 }
+
+// isSOPSBinaryEnvelope returns true if the data is a JSON object with only
+// the "data" and "sops" fields, as written by SOPS for the binary format.
+func isSOPSBinaryEnvelope(b []byte) bool {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(b, &envelope); err != nil || len(envelope) != 2 {
+		return false
+	}
+	var data string
+	if err := json.Unmarshal(envelope["data"], &data); err != nil {
+		return false
+	}
+	_, ok := envelope["sops"]
+	return ok
+}
+
+// formatsForData returns the input and output formats for decrypting the
+// SOPS encrypted data stored under the given key in a Secret, or a
+// SecretGenerator file source. The input format is detected from the data,
+// and the output format from the extension of the key.
+// Binary data is always returned as is, unless the key requests JSON. When
+// the key has no known extension, the data is returned in its input format.
+func formatsForData(key string, data []byte) (inputFormat, outputFormat formats.Format) {
+	inputFormat = detectFormatFromMarkerBytes(data)
+	if inputFormat == unsupportedFormat {
+		return inputFormat, inputFormat
+	}
+	outputFormat = formatForPath(key)
+	switch {
+	case inputFormat == formats.Binary && outputFormat == formats.Json:
+		inputFormat = formats.Json
+	case inputFormat == formats.Binary, outputFormat == formats.Binary:
+		outputFormat = inputFormat
+	}
+	return inputFormat, outputFormat
+}
+
+// matchGlob reports whether the slash separated path matches the pattern.
+// Each element of the pattern is matched using path.Match, except for '**'
+// which matches zero or more path elements.
+func matchGlob(pattern, p string) (bool, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return false, err
+	}
+	return matchGlobElements(strings.Split(path.Clean(pattern), "/"), strings.Split(p, "/"))
+}
+
+func matchGlobElements(pattern, elems []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if ok, err := matchGlobElements(pattern[1:], elems[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(elems) == 0 {
+			return false, nil
+		}
+		if ok, err := path.Match(pattern[0], elems[0]); !ok || err != nil {
+			return false, err
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0, nil
+}
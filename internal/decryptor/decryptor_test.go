@@ -20,24 +20,35 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	extage "filippo.io/age"
+	azruntime "github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	. "github.com/onsi/gomega"
 	gt "github.com/onsi/gomega/types"
 	"go.mozilla.org/sops/v3"
 	sopsage "go.mozilla.org/sops/v3/age"
+	sopsazkv "go.mozilla.org/sops/v3/azkv"
 	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/keys"
+	"go.mozilla.org/sops/v3/keyservice"
+	"google.golang.org/grpc"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/kustomize/api/konfig"
 	"sigs.k8s.io/kustomize/api/provider"
@@ -46,9 +57,13 @@ import (
 	"sigs.k8s.io/yaml"
 
 	"github.com/fluxcd/pkg/apis/meta"
+	generator "github.com/fluxcd/pkg/kustomize"
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
 	"github.com/fluxcd/kustomize-controller/internal/sops/age"
+	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
+	intkeyservice "github.com/fluxcd/kustomize-controller/internal/sops/keyservice"
 )
 
 func TestIsEncryptedSecret(t *testing.T) {
@@ -190,6 +205,79 @@ func TestDecryptor_ImportKeys(t *testing.T) {
 				g.Expect(decryptor.vaultToken).To(Equal("some-hcvault-token"))
 			},
 		},
+		{
+			name: "Hashicorp Vault Kubernetes auth",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.LocalObjectReference{
+					Name: "hcvault-kubernetes-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "hcvault-kubernetes-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionVaultKubernetesAuthFile: []byte("role: sops\nmountPath: k8s\n"),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.vaultToken).To(BeEmpty())
+				auth := decryptor.vaultKubernetesAuth
+				g.Expect(auth).ToNot(BeNil())
+				g.Expect(auth.Role).To(Equal("sops"))
+				g.Expect(auth.MountPath).To(Equal("k8s"))
+				g.Expect(auth.ServiceAccountNamespace).To(Equal(provider))
+				g.Expect(auth.ServiceAccountName).To(Equal("app"))
+				g.Expect(auth.RequestToken).ToNot(BeNil())
+			},
+		},
+		{
+			name: "Hashicorp Vault namespace",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.LocalObjectReference{
+					Name: "hcvault-namespace-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "hcvault-namespace-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionVaultTokenFileName: []byte("some-hcvault-token"),
+					DecryptionVaultNamespaceFile: []byte("admin/tenant-a\n"),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.vaultToken).To(Equal("some-hcvault-token"))
+				g.Expect(decryptor.vaultNamespace).To(Equal("admin/tenant-a"))
+			},
+		},
+		{
+			name: "Hashicorp Vault Kubernetes auth with unknown field",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.LocalObjectReference{
+					Name: "hcvault-kubernetes-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "hcvault-kubernetes-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionVaultKubernetesAuthFile: []byte("role: sops\nmount: k8s\n"),
+				},
+			},
+			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.vaultKubernetesAuth).To(BeNil())
+			},
+		},
 		{
 			name: "AWS KMS credentials",
 			decryption: &kustomizev1.Decryption{
@@ -303,6 +391,48 @@ clientSecret: some-client-secret`),
 				g.Expect(decryptor.azureToken).To(BeNil())
 			},
 		},
+		{
+			name: "Azure Key Vault CA bundle",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.LocalObjectReference{
+					Name: "azkv-ca-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-ca-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureCAFile: []byte("-----BEGIN CERTIFICATE-----\n"),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureCABundle).To(Equal([]byte("-----BEGIN CERTIFICATE-----\n")))
+			},
+		},
+		{
+			name: "Azure Key Vault API version",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.LocalObjectReference{
+					Name: "azkv-api-version-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-api-version-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAPIVersionFile: []byte("7.2\n"),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureAPIVersion).To(Equal("7.2"))
+			},
+		},
 		{
 			name: "multiple Secret data entries",
 			decryption: &kustomizev1.Decryption{
@@ -355,6 +485,22 @@ clientSecret: some-client-secret`),
 			},
 			wantErr: false,
 		},
+		{
+			name: "key provider priority",
+			decryption: &kustomizev1.Decryption{
+				Provider:            DecryptionProviderSOPS,
+				KeyProviderPriority: []string{"azure_kv", "age"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "unsupported key provider in priority",
+			decryption: &kustomizev1.Decryption{
+				Provider:            DecryptionProviderSOPS,
+				KeyProviderPriority: []string{"azure_kv", "vault"},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -379,6 +525,7 @@ clientSecret: some-client-secret`),
 			d, cleanup, err := NewTempDecryptor("", cb.Build(), &kustomization)
 			g.Expect(err).ToNot(HaveOccurred())
 			t.Cleanup(cleanup)
+			d.SetVaultKubernetesAuth(fakeServiceAccountTokens, types.NamespacedName{Namespace: provider, Name: "app"})
 
 			match := Succeed()
 			if tt.wantErr {
@@ -393,143 +540,1629 @@ clientSecret: some-client-secret`),
 	}
 }
 
-func TestDecryptor_SopsDecryptWithFormat(t *testing.T) {
-	t.Run("decrypt INI to INI", func(t *testing.T) {
-		g := NewWithT(t)
-
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
+// fakeServiceAccountTokens is a hcvault.ServiceAccountTokenRequester which
+// returns the same token for any service account.
+func fakeServiceAccountTokens(_ context.Context, _, _, _ string) (string, error) {
+	return "service-account-jwt", nil
+}
 
-		kd := &Decryptor{
-			checkSopsMac:  true,
-			ageIdentities: age.ParsedIdentities{ageID},
+func TestDecryptor_ImportKeys_VaultKubernetesAuth(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "tenant"},
+		Data: map[string][]byte{
+			DecryptionVaultKubernetesAuthFile: []byte("role: sops\n"),
+		},
+	}
+	newDecryptor := func(t *testing.T) *Decryptor {
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().WithObjects(secret.DeepCopy()).Build(), &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "decrypt", Namespace: secret.Namespace},
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider:  DecryptionProviderSOPS,
+					SecretRef: &meta.LocalObjectReference{Name: secret.Name},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
 		}
+		t.Cleanup(cleanup)
+		return d
+	}
 
-		format := formats.Ini
-		data := []byte("[config]\nkey = value\n\n")
-		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
-			},
-		}, data, format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
-		g.Expect(encData).ToNot(Equal(data))
+	t.Run("not allowed by the controller", func(t *testing.T) {
+		g := NewWithT(t)
 
-		out, err := kd.SopsDecryptWithFormat(encData, format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(out).To(Equal(data))
+		d := newDecryptor(t)
+		err := d.ImportKeys(context.TODO())
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("the Kubernetes auth method is not allowed by the controller"))
+		g.Expect(d.vaultKubernetesAuth).To(BeNil())
 	})
 
-	t.Run("decrypt JSON to YAML", func(t *testing.T) {
+	t.Run("without service account", func(t *testing.T) {
 		g := NewWithT(t)
 
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
+		d := newDecryptor(t)
+		d.SetVaultKubernetesAuth(fakeServiceAccountTokens, types.NamespacedName{Namespace: secret.Namespace})
+		err := d.ImportKeys(context.TODO())
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("the Kustomization has no service account to log in with"))
+	})
+}
 
-		kd := &Decryptor{
-			checkSopsMac:  true,
-			ageIdentities: age.ParsedIdentities{ageID},
-		}
+func TestDecryptor_ImportKeys_AzureConfigCache(t *testing.T) {
+	g := NewWithT(t)
 
-		inputFormat, outputFormat := formats.Json, formats.Yaml
-		data := []byte("{\"key\": \"value\"}\n")
-		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "azure-secret",
+			Namespace: "sops",
+		},
+		Data: map[string][]byte{
+			DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id
+clientSecret: some-client-secret`),
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(secret).Build()
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "decrypt",
+			Namespace: secret.Namespace,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.LocalObjectReference{
+					Name: secret.Name,
+				},
 			},
-		}, data, inputFormat, inputFormat)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[inputFormat])).To(BeTrue())
+		},
+	}
 
-		out, err := kd.SopsDecryptWithFormat(encData, inputFormat, outputFormat)
+	cache := azkv.NewConfigCache(10)
+	importToken := func(g *WithT) *azkv.Token {
+		d, cleanup, err := NewTempDecryptor("", c, kustomization)
 		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(out).To(Equal([]byte("key: value\n")))
-	})
-
-	t.Run("invalid JSON data", func(t *testing.T) {
-		g := NewWithT(t)
+		t.Cleanup(cleanup)
+		d.SetAzureConfigCache(cache)
+		g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+		g.Expect(d.azureToken).ToNot(BeNil())
+		return d.azureToken
+	}
 
-		format := formats.Json
-		data, err := (&Decryptor{}).SopsDecryptWithFormat([]byte("invalid json"), format, format)
-		g.Expect(err).To(HaveOccurred())
-		g.Expect(err.Error()).To(ContainSubstring("failed to load encrypted JSON data"))
-		g.Expect(data).To(BeNil())
-	})
+	first := importToken(g)
+	g.Expect(importToken(g)).To(BeIdenticalTo(first), "unchanged Secret reuses the cached token")
 
-	t.Run("no data key", func(t *testing.T) {
-		g := NewWithT(t)
+	g.Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(secret), secret)).To(Succeed())
+	secret.Data[DecryptionAzureAuthFile] = []byte(`tenantId: some-tenant-id
+clientId: some-client-id
+clientSecret: other-client-secret`)
+	g.Expect(c.Update(context.TODO(), secret)).To(Succeed())
 
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
+	changed := importToken(g)
+	g.Expect(changed).ToNot(BeIdenticalTo(first), "changed Secret constructs a new token")
+	g.Expect(importToken(g)).To(BeIdenticalTo(changed))
+}
 
-		kd := &Decryptor{}
+func TestDecryptor_ImportKeys_KMSClientCache(t *testing.T) {
+	g := NewWithT(t)
 
-		format := formats.Binary
-		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+	newSecret := func(name string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "sops",
 			},
-		}, []byte("foo bar"), format, format)
+			Data: map[string][]byte{
+				DecryptionVaultTokenFileName: []byte("some-token"),
+			},
+		}
+	}
+	secret, other := newSecret("vault-secret"), newSecret("other-secret")
+	c := fake.NewClientBuilder().WithObjects(secret, other).Build()
+	newKustomization := func(secretName string) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "decrypt",
+				Namespace: secret.Namespace,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider: DecryptionProviderSOPS,
+					SecretRef: &meta.LocalObjectReference{
+						Name: secretName,
+					},
+				},
+			},
+		}
+	}
+
+	cache := clientcache.New(10)
+	importScope := func(g *WithT, secretName string) *clientcache.Scope {
+		d, cleanup, err := NewTempDecryptor("", c, newKustomization(secretName))
 		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+		t.Cleanup(cleanup)
+		d.SetKMSClientCache(cache)
+		g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+		g.Expect(d.kmsClientScope).ToNot(BeNil())
+		return d.kmsClientScope
+	}
 
-		data, err := kd.SopsDecryptWithFormat(encData, format, format)
-		g.Expect(err).To(HaveOccurred())
-		g.Expect(err.Error()).To(ContainSubstring("cannot get sops data key"))
-		g.Expect(data).To(BeNil())
-	})
+	first := importScope(g, secret.Name)
+	g.Expect(importScope(g, secret.Name)).To(BeIdenticalTo(first), "unchanged Secret reuses the cached clients")
+	g.Expect(importScope(g, other.Name)).ToNot(BeIdenticalTo(first), "other Secret does not share the clients")
 
-	t.Run("with mac check", func(t *testing.T) {
-		g := NewWithT(t)
+	g.Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(secret), secret)).To(Succeed())
+	secret.Data[DecryptionVaultTokenFileName] = []byte("other-token")
+	g.Expect(c.Update(context.TODO(), secret)).To(Succeed())
 
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
+	changed := importScope(g, secret.Name)
+	g.Expect(changed).ToNot(BeIdenticalTo(first), "changed Secret constructs new clients")
+	g.Expect(importScope(g, secret.Name)).To(BeIdenticalTo(changed))
+	g.Expect(cache.Len()).To(Equal(2))
+}
 
-		kd := &Decryptor{
-			checkSopsMac:  true,
-			ageIdentities: age.ParsedIdentities{ageID},
-		}
+func TestDecryptor_SetAzureDisableDefaultCredential(t *testing.T) {
+	g := NewWithT(t)
 
-		format := formats.Dotenv
-		data := []byte("key=value\n")
-		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+	d := &Decryptor{
+		kustomization: &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider: DecryptionProviderSOPS,
+				},
 			},
-		}, data, format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
-
-		out, err := kd.SopsDecryptWithFormat(encData, format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(out).To(Equal(data))
-
-		badMAC := regexp.MustCompile("(?m)[\r\n]+^.*sops_mac=.*$")
-		badMACData := badMAC.ReplaceAll(encData, []byte("\nsops_mac=\n"))
-		out, err = kd.SopsDecryptWithFormat(badMACData, format, format)
-		g.Expect(err).To(HaveOccurred())
-		g.Expect(err.Error()).To(ContainSubstring("failed to verify sops data integrity: expected mac 'no MAC'"))
-		g.Expect(out).To(BeNil())
-	})
+		},
+	}
+	d.SetAzureConfigCache(azkv.NewConfigCache(10))
+	d.SetAzureDisableDefaultCredential(true)
+
+	format := formats.Yaml
+	_, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{{
+			sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234"),
+		}},
+	}, []byte("key: value\n"), format, format)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring(azkv.ErrDefaultCredentialDisabled.Error()))
+	g.Expect(d.azureToken).To(BeNil(), "the default credential is not shared")
 }
 
-func TestDecryptor_DecryptResource(t *testing.T) {
-	var (
-		resourceFactory = provider.NewDefaultDepProvider().GetResourceFactory()
-		emptyResource   = resourceFactory.FromMap(map[string]interface{}{})
-	)
+func TestDecryptor_ImportKeys_AzureAuthFile(t *testing.T) {
+	authFile := []byte(`tenantId: some-tenant-id
+clientId: some-client-id
+clientSecret: some-client-secret`)
 
-	newSecretResource := func(namespace, name string, data map[string]interface{}) *resource.Resource {
-		return resourceFactory.FromMap(map[string]interface{}{
-			"apiVersion": "v1",
-			"kind":       "Secret",
-			"metadata": map[string]interface{}{
-				"name":      name,
-				"namespace": namespace,
-			},
-			"data": data,
-		})
+	dir := t.TempDir()
+	path := filepath.Join(dir, "azure-kv.yaml")
+	if err := os.WriteFile(path, authFile, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// A projected volume links its files to the current data directory.
+	dataDir := filepath.Join(dir, "..data")
+	if err := os.Mkdir(dataDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "azure-kv.yaml"), authFile, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	linked := filepath.Join(dir, "linked.yaml")
+	if err := os.Symlink(filepath.Join(dataDir, "azure-kv.yaml"), linked); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "azure-kv.yaml")
+	if err := os.WriteFile(outside, authFile, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	escaping := filepath.Join(dir, "escaping.yaml")
+	if err := os.Symlink(outside, escaping); err != nil {
+		t.Fatal(err)
+	}
+
+	newKustomization := func(path string) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "decrypt", Namespace: "sops"},
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider:      DecryptionProviderSOPS,
+					AzureAuthFile: path,
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		path    string
+		wantErr string
+	}{
+		{
+			name: "file in the allowed directory",
+			dir:  dir,
+			path: path,
+		},
+		{
+			name: "linked file in the allowed directory",
+			dir:  dir,
+			path: linked,
+		},
+		{
+			name:    "missing file",
+			dir:     dir,
+			path:    filepath.Join(dir, "missing.yaml"),
+			wantErr: fmt.Sprintf("failed to import Azure authentication file: Azure authentication file '%s' does not exist", filepath.Join(dir, "missing.yaml")),
+		},
+		{
+			name:    "unreadable file",
+			dir:     dir,
+			path:    dataDir,
+			wantErr: fmt.Sprintf("failed to read Azure authentication file '%s': not a regular file", dataDir),
+		},
+		{
+			name:    "file outside of the allowed directory",
+			dir:     dir,
+			path:    outside,
+			wantErr: "path is not in the allowed directory",
+		},
+		{
+			name:    "relative path escaping the allowed directory",
+			dir:     dir,
+			path:    filepath.Join(dir, "..", filepath.Base(outside)),
+			wantErr: "path is not in the allowed directory",
+		},
+		{
+			name:    "link escaping the allowed directory",
+			dir:     dir,
+			path:    escaping,
+			wantErr: "path is not in the allowed directory",
+		},
+		{
+			name:    "relative path",
+			dir:     dir,
+			path:    "azure-kv.yaml",
+			wantErr: "path must be absolute",
+		},
+		{
+			name:    "no allowed directory",
+			path:    path,
+			wantErr: "reading Azure authentication files is not enabled",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), newKustomization(tt.path))
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+			d.SetAzureAuthFileDir(tt.dir)
+
+			err = d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				g.Expect(d.azureToken).To(BeNil())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.azureToken).ToNot(BeNil())
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_MultipleAgeIdentities(t *testing.T) {
+	g := NewWithT(t)
+
+	oldID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	newID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	otherID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		name string
+		data map[string][]byte
+	}{
+		{
+			name: "newline separated identities",
+			data: map[string][]byte{
+				"identities" + DecryptionAgeExt: []byte(oldID.String() + "\n" + newID.String() + "\n"),
+			},
+		},
+		{
+			name: "multiple keys",
+			data: map[string][]byte{
+				"old" + DecryptionAgeExt: []byte(oldID.String()),
+				"new" + DecryptionAgeExt: []byte(newID.String()),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "age-identities",
+					Namespace: "sops",
+				},
+				Data: tt.data,
+			}
+			kustomization := kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "age-identities",
+					Namespace: secret.Namespace,
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval: metav1.Duration{Duration: 2 * time.Minute},
+					Path:     "./",
+					Decryption: &kustomizev1.Decryption{
+						Provider: DecryptionProviderSOPS,
+						SecretRef: &meta.LocalObjectReference{
+							Name: secret.Name,
+						},
+					},
+				},
+			}
+
+			d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().WithObjects(secret).Build(), &kustomization)
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+			g.Expect(d.ageIdentities).To(HaveLen(2))
+
+			format := formats.Yaml
+			data := []byte("key: value\n")
+
+			// Only the second identity can decrypt the data.
+			encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{
+					{&sopsage.MasterKey{Recipient: newID.Recipient().String()}},
+				},
+			}, data, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			out, err := d.SopsDecryptWithFormat(encData, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(out).To(Equal(data))
+
+			// None of the identities can decrypt the data.
+			encData, err = d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{
+					{&sopsage.MasterKey{Recipient: otherID.Recipient().String()}},
+				},
+			}, data, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			_, err = d.SopsDecryptWithFormat(encData, format, format)
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(ContainSubstring("tried 2 identities"))
+			g.Expect(err.Error()).To(ContainSubstring(oldID.Recipient().String()))
+			g.Expect(err.Error()).To(ContainSubstring(newID.Recipient().String()))
+		})
+	}
+}
+
+func TestDecryptor_SopsDecryptWithFormat(t *testing.T) {
+	t.Run("decrypt INI to INI", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		kd := &Decryptor{
+			checkSopsMac:  true,
+			ageIdentities: age.ParsedIdentities{ageID},
+		}
+
+		format := formats.Ini
+		data := []byte("[config]\nkey = value\n\n")
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, data, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+		g.Expect(encData).ToNot(Equal(data))
+
+		out, err := kd.SopsDecryptWithFormat(encData, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(out).To(Equal(data))
+	})
+
+	t.Run("decrypt JSON to YAML", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		kd := &Decryptor{
+			checkSopsMac:  true,
+			ageIdentities: age.ParsedIdentities{ageID},
+		}
+
+		inputFormat, outputFormat := formats.Json, formats.Yaml
+		data := []byte("{\"key\": \"value\"}\n")
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, data, inputFormat, inputFormat)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[inputFormat])).To(BeTrue())
+
+		out, err := kd.SopsDecryptWithFormat(encData, inputFormat, outputFormat)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(out).To(Equal([]byte("key: value\n")))
+	})
+
+	t.Run("invalid JSON data", func(t *testing.T) {
+		g := NewWithT(t)
+
+		format := formats.Json
+		data, err := (&Decryptor{}).SopsDecryptWithFormat([]byte("invalid json"), format, format)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("failed to load encrypted JSON data"))
+		g.Expect(data).To(BeNil())
+	})
+
+	t.Run("no data key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		kd := &Decryptor{}
+
+		format := formats.Binary
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, []byte("foo bar"), format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+
+		data, err := kd.SopsDecryptWithFormat(encData, format, format)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("cannot get sops data key"))
+		g.Expect(data).To(BeNil())
+	})
+
+	t.Run("with mac check", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		kd := &Decryptor{
+			checkSopsMac:  true,
+			ageIdentities: age.ParsedIdentities{ageID},
+		}
+
+		format := formats.Dotenv
+		data := []byte("key=value\n")
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, data, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+
+		out, err := kd.SopsDecryptWithFormat(encData, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(out).To(Equal(data))
+
+		badMAC := regexp.MustCompile("(?m)[\r\n]+^.*sops_mac=.*$")
+		badMACData := badMAC.ReplaceAll(encData, []byte("\nsops_mac=\n"))
+		out, err = kd.SopsDecryptWithFormat(badMACData, format, format)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("failed to verify sops data integrity: MAC mismatch, possible tampering: expected mac 'no MAC'"))
+		g.Expect(out).To(BeNil())
+	})
+}
+
+func TestDecryptor_SopsDecryptWithFormat_KeyGroups(t *testing.T) {
+	azureKey := sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234")
+	azureKeyName := azureKey.ToString()
+
+	tests := []struct {
+		name      string
+		groups    func(ageKey func() keys.MasterKey) []sops.KeyGroup
+		threshold int
+		wantErr   []string
+	}{
+		{
+			name: "failing Azure key group with threshold met by other group",
+			groups: func(ageKey func() keys.MasterKey) []sops.KeyGroup {
+				return []sops.KeyGroup{{azureKey}, {ageKey()}, {ageKey()}}
+			},
+			threshold: 2,
+		},
+		{
+			name: "failing Azure key with other key in same group",
+			groups: func(ageKey func() keys.MasterKey) []sops.KeyGroup {
+				return []sops.KeyGroup{{azureKey, ageKey()}}
+			},
+		},
+		{
+			name: "failing Azure key group with threshold not met",
+			groups: func(ageKey func() keys.MasterKey) []sops.KeyGroup {
+				return []sops.KeyGroup{{azureKey}, {ageKey()}}
+			},
+			threshold: 2,
+			wantErr: []string{
+				"2 successful key group(s) required, got 1",
+				"key group 0: failed to decrypt with '" + azureKeyName + "'",
+				"vault unavailable",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ageID, err := extage.GenerateX25519Identity()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			d := &Decryptor{}
+			// Replace the key services with one that fails for Azure keys.
+			d.localServiceOnce.Do(func() {})
+			d.keyServices = []keyservice.KeyServiceClient{
+				failingAzureKeyService{
+					KeyServiceClient: keyservice.NewCustomLocalClient(
+						intkeyservice.NewServer(intkeyservice.WithAgeIdentities{ageID}),
+					),
+				},
+			}
+
+			ageKey := func() keys.MasterKey {
+				return &sopsage.MasterKey{Recipient: ageID.Recipient().String()}
+			}
+
+			format := formats.Yaml
+			data := []byte("key: value\n")
+			encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups:       tt.groups(ageKey),
+				ShamirThreshold: tt.threshold,
+			}, data, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			out, err := d.SopsDecryptWithFormat(encData, format, format)
+			if len(tt.wantErr) > 0 {
+				g.Expect(err).To(HaveOccurred())
+				for _, e := range tt.wantErr {
+					g.Expect(err.Error()).To(ContainSubstring(e))
+				}
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(out).To(Equal(data))
+		})
+	}
+}
+
+// failingAzureKeyService is a keyservice.KeyServiceClient which fails to
+// decrypt with any Azure Key Vault key, while encrypting them with a
+// placeholder. The decryption fails with err if set.
+type failingAzureKeyService struct {
+	keyservice.KeyServiceClient
+	err error
+}
+
+func (s failingAzureKeyService) Encrypt(ctx context.Context, req *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	if _, ok := req.Key.KeyType.(*keyservice.Key_AzureKeyvaultKey); ok {
+		return &keyservice.EncryptResponse{Ciphertext: []byte("placeholder")}, nil
+	}
+	return s.KeyServiceClient.Encrypt(ctx, req, opts...)
+}
+
+func (s failingAzureKeyService) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	if _, ok := req.Key.KeyType.(*keyservice.Key_AzureKeyvaultKey); ok {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, fmt.Errorf("vault unavailable")
+	}
+	return s.KeyServiceClient.Decrypt(ctx, req, opts...)
+}
+
+// blockingAzureKeyService is a keyservice.KeyServiceClient which counts the
+// decryption attempts with Azure Key Vault keys. Azure Key Vault keys are
+// handled in memory, with the plaintext as ciphertext. If block is set, the
+// decryption with them waits for release, regardless of the context.
+type blockingAzureKeyService struct {
+	keyservice.KeyServiceClient
+	block    bool
+	release  chan struct{}
+	attempts int32
+}
+
+func (s *blockingAzureKeyService) Encrypt(ctx context.Context, req *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	if _, ok := req.Key.KeyType.(*keyservice.Key_AzureKeyvaultKey); ok {
+		return &keyservice.EncryptResponse{Ciphertext: req.Plaintext}, nil
+	}
+	return s.KeyServiceClient.Encrypt(ctx, req, opts...)
+}
+
+func (s *blockingAzureKeyService) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	if _, ok := req.Key.KeyType.(*keyservice.Key_AzureKeyvaultKey); ok {
+		atomic.AddInt32(&s.attempts, 1)
+		if s.block {
+			<-s.release
+			return nil, fmt.Errorf("released")
+		}
+		return &keyservice.DecryptResponse{Plaintext: req.Ciphertext}, nil
+	}
+	return s.KeyServiceClient.Decrypt(ctx, req, opts...)
+}
+
+// recordingAzureKeyService is a keyservice.KeyServiceClient which records the
+// types of the keys it is requested to decrypt with, and the vault URLs and
+// algorithms of the Azure Key Vault keys on the request context. Azure Key Vault keys
+// are handled in memory, with the plaintext as ciphertext. The decryption
+// with them fails with err if set.
+type recordingAzureKeyService struct {
+	keyservice.KeyServiceClient
+	err        error
+	decrypts   []string
+	vaults     []string
+	algorithms []string
+}
+
+func (s *recordingAzureKeyService) Encrypt(ctx context.Context, req *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	if _, ok := req.Key.KeyType.(*keyservice.Key_AzureKeyvaultKey); ok {
+		return &keyservice.EncryptResponse{Ciphertext: req.Plaintext}, nil
+	}
+	return s.KeyServiceClient.Encrypt(ctx, req, opts...)
+}
+
+func (s *recordingAzureKeyService) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	s.decrypts = append(s.decrypts, fmt.Sprintf("%T", req.Key.KeyType))
+	if k, ok := req.Key.KeyType.(*keyservice.Key_AzureKeyvaultKey); ok {
+		s.vaults = append(s.vaults, k.AzureKeyvaultKey.VaultUrl)
+		s.algorithms = append(s.algorithms, intkeyservice.AzureAlgorithmFromContext(ctx, k.AzureKeyvaultKey))
+		if s.err != nil {
+			return nil, s.err
+		}
+		return &keyservice.DecryptResponse{Plaintext: req.Ciphertext}, nil
+	}
+	return s.KeyServiceClient.Decrypt(ctx, req, opts...)
+}
+
+func TestDecryptor_SopsDecryptWithFormat_KeyProviderPriority(t *testing.T) {
+	const (
+		ageKeyType   = "*keyservice.Key_AgeKey"
+		azureKeyType = "*keyservice.Key_AzureKeyvaultKey"
+	)
+
+	tests := []struct {
+		name     string
+		priority []string
+		azureErr error
+		want     []string
+	}{
+		{
+			name: "offline keys first by default",
+			want: []string{ageKeyType},
+		},
+		{
+			name:     "Azure key first when prioritized",
+			priority: []string{"azure_kv"},
+			want:     []string{azureKeyType},
+		},
+		{
+			name:     "falls through on failure of prioritized key",
+			priority: []string{"azure_kv", "age"},
+			azureErr: fmt.Errorf("vault unavailable"),
+			want:     []string{azureKeyType, ageKeyType},
+		},
+		{
+			name:     "listed order takes precedence",
+			priority: []string{"gcp_kms", "age", "azure_kv"},
+			want:     []string{ageKeyType},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ageID, err := extage.GenerateX25519Identity()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			d := &Decryptor{
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider:            DecryptionProviderSOPS,
+							KeyProviderPriority: tt.priority,
+						},
+					},
+				},
+			}
+			// Replace the key services with one that records the decryption
+			// attempts, while the age identity is available.
+			svc := &recordingAzureKeyService{
+				KeyServiceClient: keyservice.NewCustomLocalClient(
+					intkeyservice.NewServer(intkeyservice.WithAgeIdentities{ageID}),
+				),
+				err: tt.azureErr,
+			}
+			d.localServiceOnce.Do(func() {})
+			d.keyServices = []keyservice.KeyServiceClient{svc}
+
+			format := formats.Yaml
+			data := []byte("key: value\n")
+			encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{{
+					&sopsage.MasterKey{Recipient: ageID.Recipient().String()},
+					sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234"),
+				}},
+			}, data, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			out, err := d.SopsDecryptWithFormat(encData, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(out).To(Equal(data))
+			g.Expect(svc.decrypts).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestDecryptor_SetDecryptObserver(t *testing.T) {
+	g := NewWithT(t)
+
+	ageID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	d := &Decryptor{
+		kustomization: &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider:            DecryptionProviderSOPS,
+					KeyProviderPriority: []string{"azure_kv", "age"},
+				},
+			},
+		},
+	}
+	type observation struct {
+		provider string
+		failed   bool
+	}
+	var observed []observation
+	d.SetDecryptObserver(func(provider string, duration time.Duration, err error) {
+		g.Expect(duration).To(BeNumerically(">=", 0))
+		observed = append(observed, observation{provider: provider, failed: err != nil})
+	})
+	d.localServiceOnce.Do(func() {})
+	d.keyServices = []keyservice.KeyServiceClient{&recordingAzureKeyService{
+		KeyServiceClient: keyservice.NewCustomLocalClient(
+			intkeyservice.NewServer(intkeyservice.WithAgeIdentities{ageID}),
+		),
+		err: fmt.Errorf("vault unavailable"),
+	}}
+
+	format := formats.Yaml
+	encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{{
+			&sopsage.MasterKey{Recipient: ageID.Recipient().String()},
+			sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234"),
+		}},
+	}, []byte("key: value\n"), format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(observed).To(BeEmpty(), "encryption is not observed")
+
+	_, err = d.SopsDecryptWithFormat(encData, format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(observed).To(Equal([]observation{
+		{provider: "azure_kv", failed: true},
+		{provider: "age"},
+	}))
+}
+
+func TestDecryptor_SopsDecryptWithFormat_AzureVaultPreference(t *testing.T) {
+	const (
+		westVault  = "https://sops-westeurope.vault.azure.net"
+		northVault = "https://sops-northeurope.vault.azure.net"
+		eastVault  = "https://sops-eastus.vault.azure.net"
+	)
+
+	tests := []struct {
+		name       string
+		preference []string
+		azureErr   error
+		want       []string
+	}{
+		{
+			name: "metadata order by default",
+			want: []string{westVault},
+		},
+		{
+			name:       "selects the vault by region",
+			preference: []string{"NorthEurope"},
+			want:       []string{northVault},
+		},
+		{
+			name:       "listed order takes precedence",
+			preference: []string{"eastus", "northeurope"},
+			want:       []string{eastVault},
+		},
+		{
+			name:       "selects the vault by URL",
+			preference: []string{"unknown", "sops-eastus.vault.azure.net"},
+			want:       []string{eastVault},
+		},
+		{
+			name:       "falls back to all vaults",
+			preference: []string{"eastus"},
+			azureErr:   fmt.Errorf("vault unavailable"),
+			want:       []string{eastVault, westVault, northVault},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := &Decryptor{
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider:             DecryptionProviderSOPS,
+							KeyProviderPriority:  []string{"azure_kv"},
+							AzureVaultPreference: tt.preference,
+						},
+					},
+				},
+			}
+			svc := &recordingAzureKeyService{
+				KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer()),
+			}
+			d.localServiceOnce.Do(func() {})
+			d.keyServices = []keyservice.KeyServiceClient{svc}
+
+			format := formats.Yaml
+			data := []byte("key: value\n")
+			encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{{
+					sopsazkv.NewMasterKey(westVault, "sops", "1234"),
+					sopsazkv.NewMasterKey(northVault, "sops", "1234"),
+					sopsazkv.NewMasterKey(eastVault, "sops", "1234"),
+				}},
+			}, data, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			svc.err = tt.azureErr
+			out, err := d.SopsDecryptWithFormat(encData, format, format)
+			if tt.azureErr != nil {
+				g.Expect(err).To(HaveOccurred())
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(out).To(Equal(data))
+			}
+			g.Expect(svc.vaults).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestDecryptor_SopsDecryptWithFormat_Deadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		wantErr  bool
+		attempts int
+	}{
+		{
+			name:     "no deadline",
+			attempts: 1,
+		},
+		{
+			name:     "cancels the pending decrypt near the deadline",
+			timeout:  50 * time.Millisecond,
+			wantErr:  true,
+			attempts: 1,
+		},
+		{
+			name:     "fails without decrypt after the deadline",
+			timeout:  -time.Second,
+			wantErr:  true,
+			attempts: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := &Decryptor{
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider: DecryptionProviderSOPS,
+						},
+					},
+				},
+			}
+			svc := &blockingAzureKeyService{
+				KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer()),
+				block:            tt.wantErr,
+				release:          make(chan struct{}),
+			}
+			defer close(svc.release)
+			d.localServiceOnce.Do(func() {})
+			d.keyServices = []keyservice.KeyServiceClient{svc}
+
+			format := formats.Yaml
+			data := []byte("key: value\n")
+			encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{{
+					sopsazkv.NewMasterKey("https://west.vault.azure.net", "sops", "1234"),
+					sopsazkv.NewMasterKey("https://north.vault.azure.net", "sops", "1234"),
+				}},
+			}, data, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			d.SetContext(ctx)
+
+			start := time.Now()
+			out, err := d.SopsDecryptWithFormat(encData, format, format)
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue(), err.Error())
+				g.Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(out).To(Equal(data))
+			}
+			g.Expect(atomic.LoadInt32(&svc.attempts)).To(BeEquivalentTo(tt.attempts))
+		})
+	}
+}
+
+func TestDecryptWithContext(t *testing.T) {
+	g := NewWithT(t)
+
+	svc := &blockingAzureKeyService{block: true, release: make(chan struct{})}
+	req := &keyservice.DecryptRequest{
+		Key: &keyservice.Key{KeyType: &keyservice.Key_AzureKeyvaultKey{AzureKeyvaultKey: &keyservice.AzureKeyVaultKey{}}},
+	}
+
+	// The aborted requests hold their slot until the key service returned.
+	for i := 0; i < maxPendingDecrypts; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := decryptWithContext(ctx, svc, req)
+		cancel()
+		g.Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	}
+	g.Eventually(func() int32 { return atomic.LoadInt32(&svc.attempts) }).Should(BeEquivalentTo(maxPendingDecrypts))
+
+	// Once all the slots are held, the requests are not sent.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := decryptWithContext(ctx, svc, req)
+	g.Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	g.Expect(atomic.LoadInt32(&svc.attempts)).To(BeEquivalentTo(maxPendingDecrypts))
+
+	close(svc.release)
+	g.Eventually(func() int { return len(pendingDecrypts) }).Should(BeZero())
+}
+
+func TestDecryptor_SopsDecryptWithFormat_AzureKeyAlgorithm(t *testing.T) {
+	tests := []struct {
+		name   string
+		format formats.Format
+		inject func(data []byte) []byte
+		want   string
+	}{
+		{
+			name:   "YAML with algorithm",
+			format: formats.Yaml,
+			inject: func(data []byte) []byte {
+				return bytes.Replace(data, []byte("vault_url:"), []byte("algorithm: RSA-OAEP\n          vault_url:"), 1)
+			},
+			want: "RSA-OAEP",
+		},
+		{
+			name:   "without algorithm",
+			inject: func(data []byte) []byte { return data },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := &Decryptor{}
+			svc := &recordingAzureKeyService{KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer())}
+			d.localServiceOnce.Do(func() {})
+			d.keyServices = []keyservice.KeyServiceClient{svc}
+
+			format := formats.Yaml
+			data := []byte("key: value\n")
+			encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{{
+					sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234"),
+				}},
+			}, data, format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			out, err := d.SopsDecryptWithFormat(tt.inject(encData), format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(out).To(Equal(data))
+			g.Expect(svc.algorithms).To(Equal([]string{tt.want}))
+		})
+	}
+}
+
+func Test_azureKeyAlgorithms(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		format formats.Format
+		want   map[string]string
+	}{
+		{
+			name:   "YAML key groups",
+			format: formats.Yaml,
+			data: `key: ENC[AES256_GCM,data:abc]
+sops:
+  key_groups:
+  - azure_kv:
+    - vault_url: https://example.vault.azure.net
+      name: sops
+      version: "1234"
+      algorithm: RSA-OAEP
+    - vault_url: https://example.vault.azure.net
+      name: other
+      version: "5678"
+`,
+			want: map[string]string{"https://example.vault.azure.net/keys/sops/1234": "RSA-OAEP"},
+		},
+		{
+			name:   "JSON master keys",
+			format: formats.Json,
+			data:   `{"key":"ENC[AES256_GCM,data:abc]","sops":{"azure_kv":[{"vault_url":"https://example.vault.azure.net","name":"sops","version":"1234","algorithm":"RSA1_5"}]}}`,
+			want:   map[string]string{"https://example.vault.azure.net/keys/sops/1234": "RSA1_5"},
+		},
+		{
+			name:   "dotenv master keys",
+			format: formats.Dotenv,
+			data: `key=ENC[AES256_GCM,data:abc]
+sops_azure_kv__list_0__map_vault_url=https://example.vault.azure.net
+sops_azure_kv__list_0__map_name=sops
+sops_azure_kv__list_0__map_version=1234
+sops_azure_kv__list_0__map_algorithm=RSA-OAEP-256
+`,
+			want: map[string]string{"https://example.vault.azure.net/keys/sops/1234": "RSA-OAEP-256"},
+		},
+		{
+			name:   "invalid data",
+			format: formats.Yaml,
+			data:   "{",
+			want:   map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(azureKeyAlgorithms(sopsMetadata([]byte(tt.data), tt.format))).To(Equal(tt.want))
+		})
+	}
+}
+
+// fakeAzureKeyExpiry is an AzureKeyExpiryGetter returning the expiry dates
+// by key name.
+type fakeAzureKeyExpiry map[string]*time.Time
+
+func (f fakeAzureKeyExpiry) Expiry(_ context.Context, key *azkv.MasterKey) (*time.Time, error) {
+	if key.VaultURL != "https://example.vault.azure.net" || key.Version != "1234" {
+		return nil, fmt.Errorf("unexpected key '%s'", key.ToString())
+	}
+	expires, ok := f[key.Name]
+	if !ok {
+		return nil, fmt.Errorf("key '%s' not found", key.Name)
+	}
+	return expires, nil
+}
+
+func TestDecryptor_AzureKeyExpiries(t *testing.T) {
+	expires := time.Now().Add(24 * time.Hour).UTC()
+	expiry := fakeAzureKeyExpiry{
+		"expiring":  &expires,
+		"no-expiry": nil,
+	}
+
+	tests := []struct {
+		name     string
+		keyNames []string
+		track    bool
+		want     []KeyExpiry
+		wantErr  string
+	}{
+		{
+			name:     "expiring key",
+			keyNames: []string{"expiring"},
+			track:    true,
+			want: []KeyExpiry{
+				{Key: "https://example.vault.azure.net/keys/expiring/1234", Expires: expires},
+			},
+		},
+		{
+			name:     "key without expiry",
+			keyNames: []string{"no-expiry"},
+			track:    true,
+		},
+		{
+			name:     "expiring and failing keys",
+			keyNames: []string{"expiring", "unknown"},
+			track:    true,
+			want: []KeyExpiry{
+				{Key: "https://example.vault.azure.net/keys/expiring/1234", Expires: expires},
+			},
+			wantErr: "key 'unknown' not found",
+		},
+		{
+			name:     "not tracked",
+			keyNames: []string{"expiring"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := &Decryptor{}
+			if tt.track {
+				d.TrackAzureKeyExpiry(expiry)
+			}
+			d.localServiceOnce.Do(func() {})
+			d.keyServices = []keyservice.KeyServiceClient{
+				&recordingAzureKeyService{KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer())},
+			}
+
+			format := formats.Yaml
+			data := []byte("key: value\n")
+			for _, name := range tt.keyNames {
+				encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+					KeyGroups: []sops.KeyGroup{{
+						sopsazkv.NewMasterKey("https://example.vault.azure.net", name, "1234"),
+					}},
+				}, data, format, format)
+				g.Expect(err).ToNot(HaveOccurred())
+
+				_, err = d.SopsDecryptWithFormat(encData, format, format)
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+
+			got, err := d.AzureKeyExpiries(context.Background())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestDecryptor_AzureKeyDecryptions(t *testing.T) {
+	g := NewWithT(t)
+
+	svc := &recordingAzureKeyService{KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer())}
+	d := &Decryptor{}
+	d.localServiceOnce.Do(func() {})
+	d.keyServices = []keyservice.KeyServiceClient{svc}
+	g.Expect(d.AzureKeyDecryptions()).To(BeNil())
+
+	format := formats.Yaml
+	data := []byte("key: value\n")
+	encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{{
+			sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234"),
+		}},
+	}, data, format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	const keyID = "https://example.vault.azure.net/keys/sops/1234"
+
+	// A failed decryption is not recorded.
+	svc.err = fmt.Errorf("vault unavailable")
+	_, err = d.SopsDecryptWithFormat(encData, format, format)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(d.AzureKeyDecryptions()).To(BeNil())
+	svc.err = nil
+
+	before := time.Now()
+	_, err = d.SopsDecryptWithFormat(encData, format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	first := d.AzureKeyDecryptions()
+	g.Expect(first).To(HaveLen(1))
+	g.Expect(first).To(HaveKey(keyID))
+	g.Expect(first[keyID]).To(BeTemporally(">=", before))
+
+	_, err = d.SopsDecryptWithFormat(encData, format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	second := d.AzureKeyDecryptions()
+	g.Expect(second[keyID]).To(BeTemporally(">=", first[keyID]))
+	g.Expect(second[keyID]).ToNot(Equal(first[keyID]))
+}
+
+func TestDecryptor_AzureKeyFailures(t *testing.T) {
+	g := NewWithT(t)
+
+	svc := &recordingAzureKeyService{KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer())}
+	d := &Decryptor{}
+	d.localServiceOnce.Do(func() {})
+	d.keyServices = []keyservice.KeyServiceClient{svc}
+	g.Expect(d.AzureKeyFailures()).To(BeNil())
+
+	format := formats.Yaml
+	data := []byte("key: value\n")
+	encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{{
+			sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234"),
+		}},
+	}, data, format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	const keyID = "https://example.vault.azure.net/keys/sops/1234"
+
+	// A cancelled decryption is not recorded.
+	svc.err = context.Canceled
+	_, err = d.SopsDecryptWithFormat(encData, format, format)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(d.AzureKeyFailures()).To(BeNil())
+
+	svc.err = fmt.Errorf("forbidden")
+	_, err = d.SopsDecryptWithFormat(encData, format, format)
+	g.Expect(err).To(HaveOccurred())
+	failures := d.AzureKeyFailures()
+	g.Expect(failures).To(HaveLen(1))
+	g.Expect(failures[keyID]).To(MatchError("forbidden"))
+	g.Expect(d.AzureKeyDecryptions()).To(BeNil())
+
+	// A successful decryption clears the failure.
+	svc.err = nil
+	_, err = d.SopsDecryptWithFormat(encData, format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(d.AzureKeyFailures()).To(BeNil())
+	g.Expect(d.AzureKeyDecryptions()).To(HaveKey(keyID))
+}
+
+func TestDecryptor_KeyProviders(t *testing.T) {
+	g := NewWithT(t)
+
+	ageID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	d := &Decryptor{
+		kustomization: &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider:            DecryptionProviderSOPS,
+					KeyProviderPriority: []string{"azure_kv"},
+				},
+			},
+		},
+	}
+	svc := &recordingAzureKeyService{
+		KeyServiceClient: keyservice.NewCustomLocalClient(
+			intkeyservice.NewServer(intkeyservice.WithAgeIdentities{ageID}),
+		),
+	}
+	d.localServiceOnce.Do(func() {})
+	d.keyServices = []keyservice.KeyServiceClient{svc}
+	g.Expect(d.KeyProviders()).To(BeNil())
+
+	format := formats.Yaml
+	data := []byte("key: value\n")
+	encrypt := func(keys ...keys.MasterKey) []byte {
+		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{keys},
+		}, data, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		return encData
+	}
+	ageKey := &sopsage.MasterKey{Recipient: ageID.Recipient().String()}
+	azureKey := sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234")
+
+	// A file of which the decryption fails is not recorded.
+	svc.err = fmt.Errorf("vault unavailable")
+	_, err = d.SopsDecryptWithFormat(encrypt(azureKey), format, format)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(d.KeyProviders()).To(BeNil())
+
+	// Only the key which decrypted the data key is recorded, not the one of
+	// which the decryption failed.
+	_, err = d.SopsDecryptWithFormat(encrypt(ageKey, azureKey), format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(d.KeyProviders()).To(Equal([]string{"age"}))
+	svc.err = nil
+
+	// The prioritized Azure Key Vault key decrypts the data key, the age key
+	// is not attempted.
+	_, err = d.SopsDecryptWithFormat(encrypt(ageKey, azureKey), format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(d.KeyProviders()).To(Equal([]string{"age", "azure_kv"}))
+}
+
+func TestDecryptor_DataKeyRotations(t *testing.T) {
+	g := NewWithT(t)
+
+	ageID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	d := &Decryptor{}
+	svc := &recordingAzureKeyService{
+		KeyServiceClient: keyservice.NewCustomLocalClient(
+			intkeyservice.NewServer(intkeyservice.WithAgeIdentities{ageID}),
+		),
+	}
+	d.localServiceOnce.Do(func() {})
+	d.keyServices = []keyservice.KeyServiceClient{svc}
+	g.Expect(d.DataKeyRotations()).To(BeNil())
+
+	format := formats.Yaml
+	data := []byte("key: value\n")
+	encrypt := func(keys ...keys.MasterKey) []byte {
+		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{keys},
+		}, data, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		return encData
+	}
+	ageKey := &sopsage.MasterKey{Recipient: ageID.Recipient().String()}
+	recentKey := sopsazkv.NewMasterKey("https://example.vault.azure.net", "recent", "1234")
+	staleKey := sopsazkv.NewMasterKey("https://example.vault.azure.net", "stale", "1234")
+	staleKey.CreationDate = time.Now().Add(-365 * 24 * time.Hour).UTC()
+
+	_, err = d.SopsDecryptWithFormat(encrypt(ageKey, recentKey), format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(d.DataKeyRotations()).To(BeNil())
+
+	// A file of which the decryption fails is not recorded.
+	svc.err = fmt.Errorf("vault unavailable")
+	_, err = d.SopsDecryptWithFormat(encrypt(staleKey), format, format)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(d.DataKeyRotations()).To(BeNil())
+	svc.err = nil
+
+	_, err = d.SopsDecryptWithFormat(encrypt(ageKey, staleKey), format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(d.DataKeyRotations()).To(Equal([]string{"https://example.vault.azure.net/keys/stale/1234"}))
+}
+
+func TestDecryptor_SopsDecryptWithFormat_UnsupportedKeyProviders(t *testing.T) {
+	encrypt := func(g *WithT, kd *Decryptor, ageID *extage.X25519Identity, format formats.Format, data []byte) []byte {
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, data, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		return encData
+	}
+
+	withYAMLProvider := func(g *WithT, encData []byte) []byte {
+		var doc map[string]interface{}
+		g.Expect(yaml.Unmarshal(encData, &doc)).To(Succeed())
+		doc["sops"].(map[string]interface{})["foo_kms"] = []interface{}{
+			map[string]interface{}{"arn": "foo", "enc": "bar"},
+		}
+		out, err := yaml.Marshal(doc)
+		g.Expect(err).ToNot(HaveOccurred())
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		format    formats.Format
+		data      []byte
+		mutate    func(g *WithT, encData []byte) []byte
+		allow     bool
+		wantErr   string
+		wantWarns []string
+	}{
+		{
+			name:   "supported key providers",
+			format: formats.Yaml,
+			data:   []byte("key: value\n"),
+		},
+		{
+			name:    "unsupported YAML key provider",
+			format:  formats.Yaml,
+			data:    []byte("key: value\n"),
+			mutate:  withYAMLProvider,
+			wantErr: "SOPS metadata references unsupported key provider(s): 'foo_kms'",
+		},
+		{
+			name:      "unsupported YAML key provider allowed",
+			format:    formats.Yaml,
+			data:      []byte("key: value\n"),
+			mutate:    withYAMLProvider,
+			allow:     true,
+			wantWarns: []string{"SOPS metadata references unsupported key provider(s): 'foo_kms'"},
+		},
+		{
+			name:   "unsupported key provider in key group",
+			format: formats.Json,
+			data:   []byte("{\"key\": \"value\"}\n"),
+			mutate: func(g *WithT, encData []byte) []byte {
+				var doc map[string]interface{}
+				g.Expect(yaml.Unmarshal(encData, &doc)).To(Succeed())
+				doc["sops"].(map[string]interface{})["key_groups"] = []interface{}{
+					map[string]interface{}{
+						"bar_vault": []interface{}{
+							map[string]interface{}{"url": "foo"},
+						},
+					},
+				}
+				out, err := yaml.Marshal(doc)
+				g.Expect(err).ToNot(HaveOccurred())
+				out, err = yaml.YAMLToJSON(out)
+				g.Expect(err).ToNot(HaveOccurred())
+				return out
+			},
+			wantErr: "SOPS metadata references unsupported key provider(s): 'bar_vault'",
+		},
+		{
+			name:   "unsupported dotenv key provider",
+			format: formats.Dotenv,
+			data:   []byte("key=value\n"),
+			mutate: func(g *WithT, encData []byte) []byte {
+				return append(encData, []byte("sops_foo_kms__list_0__map_arn=foo\n")...)
+			},
+			wantErr: "SOPS metadata references unsupported key provider(s): 'foo_kms'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ageID, err := extage.GenerateX25519Identity()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			kd := &Decryptor{
+				ageIdentities: age.ParsedIdentities{ageID},
+			}
+			var warns []string
+			if tt.allow {
+				kd.AllowUnsupportedKeyProviders(func(msg string) {
+					warns = append(warns, msg)
+				})
+			}
+
+			encData := encrypt(g, kd, ageID, tt.format, tt.data)
+			if tt.mutate != nil {
+				encData = tt.mutate(g, encData)
+			}
+
+			out, err := kd.SopsDecryptWithFormat(encData, tt.format, tt.format)
+			g.Expect(warns).To(Equal(tt.wantWarns))
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(Equal(tt.wantErr))
+				g.Expect(out).To(BeNil())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(out).ToNot(BeEmpty())
+		})
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	azureErr := func(status int, body string) error {
+		req, _ := http.NewRequest(http.MethodPost, "https://example.vault.azure.net/keys/sops/1234/decrypt", nil)
+		return fmt.Errorf("failed to decrypt sops data key with Azure Key Vault key: %w", azruntime.NewResponseError(&http.Response{
+			Status:     http.StatusText(status),
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}))
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "forbidden",
+			err:  azureErr(http.StatusForbidden, `{"error":{"code":"Forbidden"}}`),
+			want: kustomizev1.DecryptionForbiddenReason,
+		},
+		{
+			name: "key not found",
+			err:  azureErr(http.StatusNotFound, `{"error":{"code":"KeyNotFound"}}`),
+			want: kustomizev1.DecryptionKeyNotFoundReason,
+		},
+		{
+			name: "key disabled",
+			err:  azureErr(http.StatusForbidden, `{"error":{"code":"Forbidden","innererror":{"code":"KeyDisabled"}}}`),
+			want: kustomizev1.DecryptionKeyDisabledReason,
+		},
+		{
+			name: "key deleted",
+			err: fmt.Errorf("failed to decrypt sops data key with Azure Key Vault key: %w", &azkv.KeyDeletedError{
+				Name: "sops",
+				Err:  azureErr(http.StatusNotFound, `{"error":{"code":"KeyNotFound"}}`),
+			}),
+			want: kustomizev1.DecryptionKeyDeletedReason,
+		},
+		{
+			name: "throttled",
+			err:  azureErr(http.StatusTooManyRequests, `{"error":{"code":"Throttled"}}`),
+			want: kustomizev1.DecryptionThrottledReason,
+		},
+		{
+			name: "vault unavailable",
+			err: fmt.Errorf("failed to decrypt sops data key with Azure Key Vault key: %w", &azkv.VaultUnavailableError{
+				VaultURL: "https://example.vault.azure.net",
+				Failures: 3,
+			}),
+			want: kustomizev1.DecryptionVaultUnavailableReason,
+		},
+		{
+			name: "unknown",
+			err:  fmt.Errorf("vault unavailable"),
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := &Decryptor{}
+			d.localServiceOnce.Do(func() {})
+			d.keyServices = []keyservice.KeyServiceClient{
+				failingAzureKeyService{
+					KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer()),
+					err:              tt.err,
+				},
+			}
+
+			format := formats.Yaml
+			encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{
+					{sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234")},
+				},
+			}, []byte("key: value\n"), format, format)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			// The error of the master key is wrapped and aggregated
+			// before being returned.
+			_, err = d.SopsDecryptWithFormat(encData, format, format)
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(FailureReason(fmt.Errorf("decryption failed for 'secret': %w", err))).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestDecryptor_DecryptResource(t *testing.T) {
+	var (
+		resourceFactory = provider.NewDefaultDepProvider().GetResourceFactory()
+		emptyResource   = resourceFactory.FromMap(map[string]interface{}{})
+	)
+
+	newSecretResource := func(namespace, name string, data map[string]interface{}) *resource.Resource {
+		return resourceFactory.FromMap(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"data": data,
+		})
 	}
 
 	kustomization := kustomizev1.Kustomization{
@@ -543,7 +2176,83 @@ func TestDecryptor_DecryptResource(t *testing.T) {
 		},
 	}
 
-	t.Run("SOPS-encrypted Secret resource", func(t *testing.T) {
+	t.Run("SOPS-encrypted Secret resource", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kus := kustomization.DeepCopy()
+		kus.Spec.Decryption = &kustomizev1.Decryption{
+			Provider: DecryptionProviderSOPS,
+		}
+
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kus)
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+		d.ageIdentities = append(d.ageIdentities, ageID)
+
+		secret := newSecretResource("test", "secret", map[string]interface{}{
+			"key": "value",
+		})
+		g.Expect(isSOPSEncryptedResource(secret)).To(BeFalse())
+
+		secretData, err := secret.MarshalJSON()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+			EncryptedRegex: "^(data|stringData)$",
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, secretData, formats.Json, formats.Json)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		g.Expect(secret.UnmarshalJSON(encData)).To(Succeed())
+		g.Expect(isSOPSEncryptedResource(secret)).To(BeTrue())
+
+		got, err := d.DecryptResource(secret)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).ToNot(BeNil())
+		g.Expect(got.MarshalJSON()).To(Equal(secretData))
+	})
+
+	t.Run("SOPS-encrypted binary-format Secret data field", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kus := kustomization.DeepCopy()
+		kus.Spec.Decryption = &kustomizev1.Decryption{
+			Provider: DecryptionProviderSOPS,
+		}
+
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kus)
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+		d.ageIdentities = append(d.ageIdentities, ageID)
+
+		plainData := []byte("[config]\napp = secret\n\n")
+		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, plainData, formats.Ini, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		secret := newSecretResource("test", "secret-data", map[string]interface{}{
+			"file.ini": base64.StdEncoding.EncodeToString(encData),
+		})
+		g.Expect(isSOPSEncryptedResource(secret)).To(BeFalse())
+
+		got, err := d.DecryptResource(secret)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).ToNot(BeNil())
+		g.Expect(got.GetDataMap()).To(HaveKeyWithValue("file.ini", base64.StdEncoding.EncodeToString(plainData)))
+	})
+
+	t.Run("SOPS-encrypted YAML-format Secret data field", func(t *testing.T) {
 		g := NewWithT(t)
 
 		kus := kustomization.DeepCopy()
@@ -559,32 +2268,63 @@ func TestDecryptor_DecryptResource(t *testing.T) {
 		g.Expect(err).ToNot(HaveOccurred())
 		d.ageIdentities = append(d.ageIdentities, ageID)
 
-		secret := newSecretResource("test", "secret", map[string]interface{}{
-			"key": "value",
+		plainData := []byte("structured:\n    data:\n        key: value\n")
+		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, plainData, formats.Yaml, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		secret := newSecretResource("test", "secret-data", map[string]interface{}{
+			"key.yaml": base64.StdEncoding.EncodeToString(encData),
 		})
 		g.Expect(isSOPSEncryptedResource(secret)).To(BeFalse())
 
-		secretData, err := secret.MarshalJSON()
+		got, err := d.DecryptResource(secret)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).ToNot(BeNil())
+		g.Expect(got.GetDataMap()).To(HaveKeyWithValue("key.yaml", base64.StdEncoding.EncodeToString(plainData)))
+	})
+
+	t.Run("SOPS-encrypted dotenv-format Secret data fields", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kus := kustomization.DeepCopy()
+		kus.Spec.Decryption = &kustomizev1.Decryption{
+			Provider: DecryptionProviderSOPS,
+		}
+
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kus)
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+
+		ageID, err := extage.GenerateX25519Identity()
 		g.Expect(err).ToNot(HaveOccurred())
+		d.ageIdentities = append(d.ageIdentities, ageID)
 
+		plainData := []byte("DATABASE_URL=postgres://db\nAPI_KEY=secret\n")
 		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
-			EncryptedRegex: "^(data|stringData)$",
 			KeyGroups: []sops.KeyGroup{
 				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
 			},
-		}, secretData, formats.Json, formats.Json)
+		}, plainData, formats.Dotenv, formats.Dotenv)
 		g.Expect(err).ToNot(HaveOccurred())
 
-		g.Expect(secret.UnmarshalJSON(encData)).To(Succeed())
-		g.Expect(isSOPSEncryptedResource(secret)).To(BeTrue())
+		secret := newSecretResource("test", "secret-data", map[string]interface{}{
+			"app.env": base64.StdEncoding.EncodeToString(encData),
+			"env":     base64.StdEncoding.EncodeToString(encData),
+		})
+		g.Expect(isSOPSEncryptedResource(secret)).To(BeFalse())
 
 		got, err := d.DecryptResource(secret)
 		g.Expect(err).ToNot(HaveOccurred())
 		g.Expect(got).ToNot(BeNil())
-		g.Expect(got.MarshalJSON()).To(Equal(secretData))
+		g.Expect(got.GetDataMap()).To(HaveKeyWithValue("app.env", base64.StdEncoding.EncodeToString(plainData)))
+		g.Expect(got.GetDataMap()).To(HaveKeyWithValue("env", base64.StdEncoding.EncodeToString(plainData)))
 	})
 
-	t.Run("SOPS-encrypted binary-format Secret data field", func(t *testing.T) {
+	t.Run("SOPS-encrypted binary Secret data fields", func(t *testing.T) {
 		g := NewWithT(t)
 
 		kus := kustomization.DeepCopy()
@@ -600,26 +2340,28 @@ func TestDecryptor_DecryptResource(t *testing.T) {
 		g.Expect(err).ToNot(HaveOccurred())
 		d.ageIdentities = append(d.ageIdentities, ageID)
 
-		plainData := []byte("[config]\napp = secret\n\n")
+		plainData := []byte("key: not parsed as YAML\n\x00\x01\x02")
 		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
 			KeyGroups: []sops.KeyGroup{
 				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
 			},
-		}, plainData, formats.Ini, formats.Yaml)
+		}, plainData, formats.Binary, formats.Binary)
 		g.Expect(err).ToNot(HaveOccurred())
 
 		secret := newSecretResource("test", "secret-data", map[string]interface{}{
-			"file.ini": base64.StdEncoding.EncodeToString(encData),
+			"blob":      base64.StdEncoding.EncodeToString(encData),
+			"blob.yaml": base64.StdEncoding.EncodeToString(encData),
 		})
 		g.Expect(isSOPSEncryptedResource(secret)).To(BeFalse())
 
 		got, err := d.DecryptResource(secret)
 		g.Expect(err).ToNot(HaveOccurred())
 		g.Expect(got).ToNot(BeNil())
-		g.Expect(got.GetDataMap()).To(HaveKeyWithValue("file.ini", base64.StdEncoding.EncodeToString(plainData)))
+		g.Expect(got.GetDataMap()).To(HaveKeyWithValue("blob", base64.StdEncoding.EncodeToString(plainData)))
+		g.Expect(got.GetDataMap()).To(HaveKeyWithValue("blob.yaml", base64.StdEncoding.EncodeToString(plainData)))
 	})
 
-	t.Run("SOPS-encrypted YAML-format Secret data field", func(t *testing.T) {
+	t.Run("SOPS-encrypted Docker config Secret", func(t *testing.T) {
 		g := NewWithT(t)
 
 		kus := kustomization.DeepCopy()
@@ -635,117 +2377,495 @@ func TestDecryptor_DecryptResource(t *testing.T) {
 		g.Expect(err).ToNot(HaveOccurred())
 		d.ageIdentities = append(d.ageIdentities, ageID)
 
-		plainData := []byte("structured:\n    data:\n        key: value\n")
+		plainData := []byte(`{
+	"auths": {
+		"my-registry.example:5000": {
+			"username": "tiger",
+			"password": "pass1234",
+			"email": "tiger@acme.example",
+			"auth": "dGlnZXI6cGFzczEyMzQ="
+		}
+	}
+}`)
 		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
 			KeyGroups: []sops.KeyGroup{
 				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
 			},
-		}, plainData, formats.Yaml, formats.Yaml)
+		}, plainData, formats.Json, formats.Yaml)
 		g.Expect(err).ToNot(HaveOccurred())
 
-		secret := newSecretResource("test", "secret-data", map[string]interface{}{
-			"key.yaml": base64.StdEncoding.EncodeToString(encData),
+		secret := resourceFactory.FromMap(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":      "secret",
+				"namespace": "test",
+			},
+			"type": corev1.SecretTypeDockerConfigJson,
+			"data": map[string]interface{}{
+				corev1.DockerConfigJsonKey: base64.StdEncoding.EncodeToString(encData),
+			},
 		})
 		g.Expect(isSOPSEncryptedResource(secret)).To(BeFalse())
 
 		got, err := d.DecryptResource(secret)
 		g.Expect(err).ToNot(HaveOccurred())
 		g.Expect(got).ToNot(BeNil())
-		g.Expect(got.GetDataMap()).To(HaveKeyWithValue("key.yaml", base64.StdEncoding.EncodeToString(plainData)))
+		g.Expect(got.GetDataMap()).To(HaveKeyWithValue(corev1.DockerConfigJsonKey, base64.StdEncoding.EncodeToString(plainData)))
 	})
 
-	t.Run("SOPS-encrypted Docker config Secret", func(t *testing.T) {
+	t.Run("SOPS-encrypted Secret resource with invalid structure", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kus := kustomization.DeepCopy()
+		kus.Spec.Decryption = &kustomizev1.Decryption{
+			Provider:        DecryptionProviderSOPS,
+			ValidateSecrets: true,
+		}
+
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kus)
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+		d.originBase = "apps"
+		d.stripOrigins = true
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+		d.ageIdentities = append(d.ageIdentities, ageID)
+
+		secret := resourceFactory.FromMap(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":      "secret",
+				"namespace": "test",
+			},
+			"type": "kubernetes.io/tls",
+			"data": map[string]interface{}{
+				corev1.TLSCertKey: "not base64 encoded",
+			},
+		})
+		secretData, err := secret.MarshalJSON()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+			EncryptedRegex: "^(data|stringData)$",
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, secretData, formats.Json, formats.Json)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(secret.UnmarshalJSON(encData)).To(Succeed())
+		g.Expect(secret.SetOrigin(&resource.Origin{Path: "secrets/tls.yaml"})).To(Succeed())
+
+		got, err := d.DecryptResource(secret)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(got).To(BeNil())
+		g.Expect(err.Error()).To(Equal("invalid decrypted Secret 'test/secret' from 'apps/secrets/tls.yaml': " +
+			"[data[tls.crt]: must be base64 encoded, data[tls.crt]: required for type 'kubernetes.io/tls', " +
+			"data[tls.key]: required for type 'kubernetes.io/tls']"))
+		g.Expect(err.Error()).ToNot(ContainSubstring("not base64 encoded"))
+	})
+
+	t.Run("nil resource", func(t *testing.T) {
+		g := NewWithT(t)
+
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kustomization.DeepCopy())
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+
+		got, err := d.DecryptResource(nil)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(BeNil())
+	})
+
+	t.Run("no decryption spec", func(t *testing.T) {
+		g := NewWithT(t)
+
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kustomization.DeepCopy())
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+
+		got, err := d.DecryptResource(emptyResource.DeepCopy())
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(BeNil())
+	})
+
+	t.Run("unimplemented decryption provider", func(t *testing.T) {
+		g := NewWithT(t)
+
+		kus := kustomization.DeepCopy()
+		kus.Spec.Decryption = &kustomizev1.Decryption{
+			Provider: "not-supported",
+		}
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kus)
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+
+		got, err := d.DecryptResource(emptyResource.DeepCopy())
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(BeNil())
+	})
+}
+
+func TestDecryptor_DecryptSecret(t *testing.T) {
+	const kubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: https://remote.example.com
+  name: remote
+users:
+- name: remote
+  user:
+    token: secret-token
+`
+
+	newDecryptor := func(azureErr error) *Decryptor {
+		d := &Decryptor{
+			kustomization: &kustomizev1.Kustomization{
+				Spec: kustomizev1.KustomizationSpec{
+					Decryption: &kustomizev1.Decryption{
+						Provider: DecryptionProviderSOPS,
+					},
+				},
+			},
+			redactor: NewRedactor(),
+		}
+		d.localServiceOnce.Do(func() {})
+		d.keyServices = []keyservice.KeyServiceClient{
+			&recordingAzureKeyService{
+				KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer()),
+				err:              azureErr,
+			},
+		}
+		return d
+	}
+
+	encrypt := func(g *WithT, d *Decryptor) []byte {
+		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{{
+				sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234"),
+			}},
+		}, []byte(kubeConfig), formats.Yaml, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+		return encData
+	}
+
+	t.Run("decrypts the encrypted values", func(t *testing.T) {
+		g := NewWithT(t)
+
+		d := newDecryptor(nil)
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubeconfig", Namespace: "test"},
+			Data: map[string][]byte{
+				"value.yaml": encrypt(g, d),
+				"plain":      []byte("value"),
+			},
+		}
+		g.Expect(d.DecryptSecret(secret)).To(Succeed())
+		g.Expect(string(secret.Data["value.yaml"])).To(MatchYAML(kubeConfig))
+		g.Expect(secret.Data["plain"]).To(Equal([]byte("value")))
+		g.Expect(d.redactor.Redact("token: secret-token")).To(Equal("token: [REDACTED]"))
+	})
+
+	t.Run("attributes the failure to the Secret field", func(t *testing.T) {
 		g := NewWithT(t)
 
-		kus := kustomization.DeepCopy()
-		kus.Spec.Decryption = &kustomizev1.Decryption{
-			Provider: DecryptionProviderSOPS,
-		}
+		d := newDecryptor(fmt.Errorf("vault unavailable"))
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubeconfig", Namespace: "test"},
+			Data: map[string][]byte{
+				"value.yaml": encrypt(g, d),
+			},
+		}
+		err := d.DecryptSecret(secret)
+		g.Expect(err).To(MatchError(ContainSubstring("failed to decrypt and format 'test/kubeconfig' Secret field 'value.yaml'")))
+		g.Expect(err).To(MatchError(ContainSubstring("vault unavailable")))
+	})
+}
+
+func Test_validateSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  map[string]interface{}
+		wantErr string
+	}{
+		{
+			name: "valid Opaque Secret",
+			secret: map[string]interface{}{
+				"data":       map[string]interface{}{"key": base64.StdEncoding.EncodeToString([]byte("value"))},
+				"stringData": map[string]interface{}{"other": "value"},
+			},
+		},
+		{
+			name: "valid custom type",
+			secret: map[string]interface{}{
+				"type":       "example.com/custom",
+				"stringData": map[string]interface{}{"key": "value"},
+			},
+		},
+		{
+			name: "valid TLS Secret",
+			secret: map[string]interface{}{
+				"type": "kubernetes.io/tls",
+				"stringData": map[string]interface{}{
+					corev1.TLSCertKey:       "cert",
+					corev1.TLSPrivateKeyKey: "key",
+				},
+			},
+		},
+		{
+			name: "data not base64 encoded",
+			secret: map[string]interface{}{
+				"data": map[string]interface{}{"key": "value!"},
+			},
+			wantErr: "data[key]: must be base64 encoded",
+		},
+		{
+			name: "data not a map",
+			secret: map[string]interface{}{
+				"data": "value",
+			},
+			wantErr: "data: must be a map of strings",
+		},
+		{
+			name: "stringData with non-string value",
+			secret: map[string]interface{}{
+				"stringData": map[string]interface{}{"key": int64(1)},
+			},
+			wantErr: "stringData[key]: must be a string",
+		},
+		{
+			name: "invalid key",
+			secret: map[string]interface{}{
+				"stringData": map[string]interface{}{"in valid": "value"},
+			},
+			wantErr: "stringData[in valid]: invalid key: a valid config key must consist of alphanumeric characters, '-', '_' or '.' (e.g. 'key.name',  or 'KEY_NAME',  or 'key-name', regex used for validation is '[-._a-zA-Z0-9]+')",
+		},
+		{
+			name: "unknown built-in type",
+			secret: map[string]interface{}{
+				"type": "kubernetes.io/unknown",
+			},
+			wantErr: "type: unknown built-in type 'kubernetes.io/unknown'",
+		},
+		{
+			name: "basic-auth without username or password",
+			secret: map[string]interface{}{
+				"type":       "kubernetes.io/basic-auth",
+				"stringData": map[string]interface{}{"token": "value"},
+			},
+			wantErr: "data: one of 'username' or 'password' is required for type 'kubernetes.io/basic-auth'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := validateSecret(tt.secret)
+			if tt.wantErr == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(Equal(tt.wantErr))
+		})
+	}
+}
+
+func TestDecryptor_DecryptResource_PathGlobs(t *testing.T) {
+	tests := []struct {
+		name          string
+		include       []string
+		exclude       []string
+		wantDecrypted []string
+	}{
+		{
+			name:          "include only",
+			include:       []string{"apps/**"},
+			wantDecrypted: []string{"backend", "frontend"},
+		},
+		{
+			name:          "exclude only",
+			exclude:       []string{"**/frontend.yaml"},
+			wantDecrypted: []string{"backend", "infra"},
+		},
+		{
+			name:          "include and exclude",
+			include:       []string{"apps/*.yaml", "infra/**"},
+			exclude:       []string{"apps/backend.yaml"},
+			wantDecrypted: []string{"frontend", "infra"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			tmpDir := t.TempDir()
+			kus := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "decrypt",
+					Namespace: "decrypt",
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Decryption: &kustomizev1.Decryption{
+						Provider: DecryptionProviderSOPS,
+						Include:  tt.include,
+						Exclude:  tt.exclude,
+					},
+				},
+			}
 
-		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kus)
-		g.Expect(err).ToNot(HaveOccurred())
-		t.Cleanup(cleanup)
+			d, cleanup, err := NewTempDecryptor(tmpDir, fake.NewClientBuilder().Build(), kus)
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
 
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
-		d.ageIdentities = append(d.ageIdentities, ageID)
+			ageID, err := extage.GenerateX25519Identity()
+			g.Expect(err).ToNot(HaveOccurred())
+			d.ageIdentities = append(d.ageIdentities, ageID)
 
-		plainData := []byte(`{
-	"auths": {
-		"my-registry.example:5000": {
-			"username": "tiger",
-			"password": "pass1234",
-			"email": "tiger@acme.example",
-			"auth": "dGlnZXI6cGFzczEyMzQ="
-		}
-	}
-}`)
-		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
-			},
-		}, plainData, formats.Json, formats.Yaml)
-		g.Expect(err).ToNot(HaveOccurred())
+			files := map[string]string{
+				"apps/backend.yaml":  "backend",
+				"apps/frontend.yaml": "frontend",
+				"infra/db/db.yaml":   "infra",
+			}
+			var resources []string
+			for file, name := range files {
+				secret, err := yaml.Marshal(map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"metadata":   map[string]interface{}{"name": name},
+					"stringData": map[string]interface{}{"key": "value"},
+				})
+				g.Expect(err).ToNot(HaveOccurred())
+				encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+					EncryptedRegex: "^(data|stringData)$",
+					KeyGroups: []sops.KeyGroup{
+						{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+					},
+				}, secret, formats.Yaml, formats.Yaml)
+				g.Expect(err).ToNot(HaveOccurred())
 
-		secret := resourceFactory.FromMap(map[string]interface{}{
-			"apiVersion": "v1",
-			"kind":       "Secret",
-			"metadata": map[string]interface{}{
-				"name":      "secret",
-				"namespace": "test",
-			},
-			"type": corev1.SecretTypeDockerConfigJson,
-			"data": map[string]interface{}{
-				corev1.DockerConfigJsonKey: base64.StdEncoding.EncodeToString(encData),
-			},
-		})
-		g.Expect(isSOPSEncryptedResource(secret)).To(BeFalse())
+				fPath := filepath.Join(tmpDir, file)
+				g.Expect(os.MkdirAll(filepath.Dir(fPath), 0o700)).To(Succeed())
+				g.Expect(os.WriteFile(fPath, encData, 0o644)).To(Succeed())
+				resources = append(resources, file)
+			}
+			kusData, err := yaml.Marshal(kustypes.Kustomization{Resources: resources})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(os.WriteFile(filepath.Join(tmpDir, konfig.DefaultKustomizationFileName()), kusData, 0o644)).To(Succeed())
 
-		got, err := d.DecryptResource(secret)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(got).ToNot(BeNil())
-		g.Expect(got.GetDataMap()).To(HaveKeyWithValue(corev1.DockerConfigJsonKey, base64.StdEncoding.EncodeToString(plainData)))
-	})
+			g.Expect(d.TrackOrigins(tmpDir)).To(Succeed())
+			m, err := generator.SecureBuild(tmpDir, tmpDir, false)
+			g.Expect(err).ToNot(HaveOccurred())
 
-	t.Run("nil resource", func(t *testing.T) {
-		g := NewWithT(t)
+			var decrypted []string
+			for _, res := range m.Resources() {
+				got, err := d.DecryptResource(res)
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(got).ToNot(BeNil())
+				g.Expect(got.GetAnnotations()).ToNot(HaveKey(konfig.ConfigAnnoDomain + "/origin"))
+				if !isSOPSEncryptedResource(got) {
+					decrypted = append(decrypted, got.GetName())
+				}
+			}
+			g.Expect(decrypted).To(ConsistOf(tt.wantDecrypted))
+		})
+	}
+}
 
-		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kustomization.DeepCopy())
-		g.Expect(err).ToNot(HaveOccurred())
-		t.Cleanup(cleanup)
+func TestDecryptor_OriginPath(t *testing.T) {
+	resourceFactory := provider.NewDefaultDepProvider().GetResourceFactory()
 
-		got, err := d.DecryptResource(nil)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(got).To(BeNil())
-	})
+	tests := []struct {
+		name       string
+		reportOnly bool
+		origin     *resource.Origin
+		want       string
+	}{
+		{name: "file", reportOnly: true, origin: &resource.Origin{Path: "secret.yaml"}, want: "apps/secret.yaml"},
+		{name: "generated", reportOnly: true, origin: &resource.Origin{ConfiguredIn: "kustomization.yaml"}, want: "apps/kustomization.yaml"},
+		{name: "remote", reportOnly: true, origin: &resource.Origin{Repo: "https://example.com/repo", Path: "secret.yaml"}},
+		{name: "unknown", reportOnly: true},
+		{name: "untracked", origin: &resource.Origin{Path: "secret.yaml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
 
-	t.Run("no decryption spec", func(t *testing.T) {
-		g := NewWithT(t)
+			d := &Decryptor{
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider:   DecryptionProviderSOPS,
+							ReportOnly: tt.reportOnly,
+						},
+					},
+				},
+				originBase: "apps",
+			}
 
-		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kustomization.DeepCopy())
-		g.Expect(err).ToNot(HaveOccurred())
-		t.Cleanup(cleanup)
+			res := resourceFactory.FromMap(map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata":   map[string]interface{}{"name": "secret"},
+			})
+			if tt.origin != nil {
+				g.Expect(res.SetOrigin(tt.origin)).To(Succeed())
+			}
 
-		got, err := d.DecryptResource(emptyResource.DeepCopy())
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(got).To(BeNil())
-	})
+			got, err := d.OriginPath(res)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
 
-	t.Run("unimplemented decryption provider", func(t *testing.T) {
-		g := NewWithT(t)
+func TestDecryptor_isIncludedPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		path    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "no globs", path: "./apps/secret.yaml", want: true},
+		{name: "include match", include: []string{"apps/*"}, path: "./apps/secret.yaml", want: true},
+		{name: "include no match", include: []string{"apps/*"}, path: "apps/sub/secret.yaml", want: false},
+		{name: "include double star", include: []string{"**/*.enc.yaml"}, path: "apps/sub/secret.enc.yaml", want: true},
+		{name: "include double star root", include: []string{"**/*.enc.yaml"}, path: "secret.enc.yaml", want: true},
+		{name: "exclude match", exclude: []string{"apps/**"}, path: "apps/sub/secret.yaml", want: false},
+		{name: "exclude no match", exclude: []string{"apps/**"}, path: "infra/secret.yaml", want: true},
+		{name: "exclude precedence", include: []string{"**"}, exclude: []string{"apps/*"}, path: "apps/secret.yaml", want: false},
+		{name: "invalid glob", include: []string{"apps/["}, path: "apps/secret.yaml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
 
-		kus := kustomization.DeepCopy()
-		kus.Spec.Decryption = &kustomizev1.Decryption{
-			Provider: "not-supported",
-		}
-		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kus)
-		g.Expect(err).ToNot(HaveOccurred())
-		t.Cleanup(cleanup)
+			d := &Decryptor{
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider: DecryptionProviderSOPS,
+							Include:  tt.include,
+							Exclude:  tt.exclude,
+						},
+					},
+				},
+			}
 
-		got, err := d.DecryptResource(emptyResource.DeepCopy())
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(got).To(BeNil())
-	})
+			got, err := d.isIncludedPath(tt.path)
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
 }
 
 func TestDecryptor_decryptKustomizationEnvSources(t *testing.T) {
@@ -777,19 +2897,20 @@ func TestDecryptor_decryptKustomizationEnvSources(t *testing.T) {
 				{name: "subdir/combination.json", data: []byte("The safe combination is ..."), originalFormat: &binaryFormat, encrypt: true, expectData: true},
 				{name: "subdir/file.txt", data: []byte("file"), encrypt: true, expectData: true},
 				{name: "secret.env", data: []byte("var2=value2\n"), encrypt: true, expectData: true},
+				{name: "subdir/dotenv.env", data: []byte("var3=value3\n"), encrypt: true, expectData: true},
 			},
 			secretGenerator: []kustypes.SecretArgs{
 				{
 					GeneratorArgs: kustypes.GeneratorArgs{
 						Name: "envSecret",
 						KvPairSources: kustypes.KvPairSources{
-							FileSources: []string{"file.txt", "combo=combination.json"},
+							FileSources: []string{"file.txt", "combo=combination.json", "dotenv=dotenv.env"},
 							EnvSources:  []string{"app.env", "../secret.env"},
 						},
 					},
 				},
 			},
-			expectVisited: []string{"subdir/app.env", "subdir/combination.json", "subdir/file.txt", "secret.env"},
+			expectVisited: []string{"subdir/app.env", "subdir/combination.json", "subdir/file.txt", "secret.env", "subdir/dotenv.env"},
 		},
 		{
 			name:  "decryption error",
@@ -1076,6 +3197,160 @@ func TestDecryptor_decryptSopsFile(t *testing.T) {
 	}
 }
 
+func TestDecryptor_LimitFileSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		current int64
+		max     int64
+		want    int64
+	}{
+		{name: "lowers the limit", current: maxEncryptedFileSize, max: 1024, want: 1024},
+		{name: "keeps a lower limit", current: 1024, max: maxEncryptedFileSize, want: 1024},
+		{name: "sets a limit when unlimited", max: 1024, want: 1024},
+		{name: "ignores a disabled limit", current: maxEncryptedFileSize, max: 0, want: maxEncryptedFileSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := &Decryptor{maxFileSize: tt.current}
+			d.LimitFileSize(tt.max)
+			g.Expect(d.maxFileSize).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestDecryptor_DecryptFile(t *testing.T) {
+	g := NewWithT(t)
+
+	id, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	kd := &Decryptor{
+		checkSopsMac:  true,
+		ageIdentities: age.ParsedIdentities{id},
+	}
+	encrypt := func(data string) string {
+		out, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: id.Recipient().String()}},
+			},
+		}, []byte(data), formats.Yaml, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+		return string(out)
+	}
+
+	plain1 := "# leading comment\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name:   first # odd spacing\n"
+	plain2 := "apiVersion: v1\nkind: ConfigMap\nmetadata: {name: last}\n"
+
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "plain documents",
+			data: plain1 + "---\n" + plain2,
+			want: plain1 + "---\n" + plain2,
+		},
+		{
+			name: "mixed encrypted and plain documents",
+			data: plain1 + "--- # separator comment\n" + encrypt("secret: value\n") + "---\n" + plain2,
+			want: plain1 + "--- # separator comment\n" + "secret: value\n" + "---\n" + plain2,
+		},
+		{
+			name: "multiple encrypted documents",
+			data: "---\n" + encrypt("first: secret\n") + "---\n" + plain1 + "---\n" + encrypt("second: secret\n"),
+			want: "---\n" + "first: secret\n" + "---\n" + plain1 + "---\n" + "second: secret\n",
+		},
+		{
+			name: "single encrypted document",
+			data: encrypt("secret: value\n"),
+			want: "secret: value\n",
+		},
+		{
+			name:    "invalid encrypted document",
+			data:    plain1 + "---\nsops:\n  mac: ENC[invalid]\n",
+			wantErr: "failed to decrypt YAML document 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			out, err := kd.DecryptFile([]byte(tt.data), formats.Yaml, formats.Yaml)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				g.Expect(out).To(BeNil())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(string(out)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestDecryptor_DecryptFile_MAC(t *testing.T) {
+	g := NewWithT(t)
+
+	id, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The MAC of files is verified without checkSopsMac.
+	kd := &Decryptor{
+		ageIdentities: age.ParsedIdentities{id},
+	}
+	encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{
+			{&sopsage.MasterKey{Recipient: id.Recipient().String()}},
+		},
+		UnencryptedSuffix: "_unencrypted",
+	}, []byte("secret: value\nreplicas_unencrypted: 1\n"), formats.Yaml, formats.Yaml)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	out, err := kd.DecryptFile(encData, formats.Yaml, formats.Yaml)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(out)).To(Equal("secret: value\nreplicas_unencrypted: 1\n"))
+
+	// Flip a byte of the value which is not encrypted, but covered by the MAC.
+	idx := bytes.Index(encData, []byte("replicas_unencrypted: 1"))
+	g.Expect(idx).ToNot(Equal(-1))
+	tampered := append([]byte(nil), encData...)
+	tampered[idx+len("replicas_unencrypted: ")] = '2'
+
+	t.Run("file", func(t *testing.T) {
+		g := NewWithT(t)
+
+		out, err := kd.DecryptFile(tampered, formats.Yaml, formats.Yaml)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("MAC mismatch, possible tampering"))
+		g.Expect(out).To(BeNil())
+	})
+
+	t.Run("Secret data entry", func(t *testing.T) {
+		g := NewWithT(t)
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"},
+			Data:       map[string][]byte{"file.yaml": tampered},
+		}
+		err := kd.DecryptSecret(secret)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("MAC mismatch, possible tampering"))
+		g.Expect(secret.Data["file.yaml"]).To(Equal(tampered))
+	})
+
+	t.Run("resource without checkSopsMac", func(t *testing.T) {
+		g := NewWithT(t)
+
+		out, err := kd.SopsDecryptWithFormat(tampered, formats.Yaml, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(string(out)).To(Equal("secret: value\nreplicas_unencrypted: 2\n"))
+	})
+}
+
 func TestDecryptor_secureLoadKustomizationFile(t *testing.T) {
 	kusType := kustypes.TypeMeta{
 		APIVersion: kustypes.KustomizationVersion,
@@ -1585,6 +3860,21 @@ func TestDecryptor_detectFormatFromMarkerBytes(t *testing.T) {
 			b:    bytes.Join([][]byte{[]byte("random other bytes"), sopsFormatToMarkerBytes[formats.Yaml], []byte("more random bytes")}, []byte(" ")),
 			want: formats.Yaml,
 		},
+		{
+			name: "detects dotenv format",
+			b:    []byte("key=ENC[AES256_GCM,data:...]\nsops_mac=ENC[AES256_GCM,data:...]\n"),
+			want: formats.Dotenv,
+		},
+		{
+			name: "detects JSON format",
+			b:    []byte(`{"key": "ENC[...]", "sops": {"mac": "ENC[AES256_GCM,data:...]"}}`),
+			want: formats.Json,
+		},
+		{
+			name: "detects binary format",
+			b:    []byte(`{"data": "ENC[...]", "sops": {"mac": "ENC[AES256_GCM,data:...]"}}`),
+			want: formats.Binary,
+		},
 		{
 			name: "returns unsupported format",
 			b:    []byte("no marker bytes present"),
@@ -1599,3 +3889,77 @@ func TestDecryptor_detectFormatFromMarkerBytes(t *testing.T) {
 		})
 	}
 }
+
+func TestDecryptor_formatsForData(t *testing.T) {
+	var (
+		dotenvData = []byte("key=ENC[AES256_GCM,data:...]\nsops_mac=ENC[AES256_GCM,data:...]\n")
+		yamlData   = []byte("key: ENC[...]\nsops:\n    mac: ENC[AES256_GCM,data:...]\n")
+		binaryData = []byte(`{"data": "ENC[...]", "sops": {"mac": "ENC[AES256_GCM,data:...]"}}`)
+	)
+	tests := []struct {
+		name    string
+		key     string
+		data    []byte
+		wantIn  formats.Format
+		wantOut formats.Format
+	}{
+		{
+			name:    "dotenv key",
+			key:     "app.env",
+			data:    dotenvData,
+			wantIn:  formats.Dotenv,
+			wantOut: formats.Dotenv,
+		},
+		{
+			name:    "dotenv without key extension",
+			key:     "app",
+			data:    dotenvData,
+			wantIn:  formats.Dotenv,
+			wantOut: formats.Dotenv,
+		},
+		{
+			name:    "YAML to JSON key",
+			key:     "config.json",
+			data:    yamlData,
+			wantIn:  formats.Yaml,
+			wantOut: formats.Json,
+		},
+		{
+			name:    "binary without key extension",
+			key:     "blob",
+			data:    binaryData,
+			wantIn:  formats.Binary,
+			wantOut: formats.Binary,
+		},
+		{
+			name:    "binary with YAML key",
+			key:     "blob.yaml",
+			data:    binaryData,
+			wantIn:  formats.Binary,
+			wantOut: formats.Binary,
+		},
+		{
+			name:    "binary with JSON key",
+			key:     "blob.json",
+			data:    binaryData,
+			wantIn:  formats.Json,
+			wantOut: formats.Json,
+		},
+		{
+			name:    "not encrypted",
+			key:     "app.env",
+			data:    []byte("key=value\n"),
+			wantIn:  unsupportedFormat,
+			wantOut: unsupportedFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			gotIn, gotOut := formatsForData(tt.key, tt.data)
+			g.Expect(gotIn).To(Equal(tt.wantIn))
+			g.Expect(gotOut).To(Equal(tt.wantOut))
+		})
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/stores"
+	"go.mozilla.org/sops/v3/version"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+)
+
+// azureDataKeyEncrypter encrypts a SOPS data key with an Azure Key Vault
+// key, and serializes the key with the encrypted data key. It is
+// implemented by azkv.MasterKey.
+type azureDataKeyEncrypter interface {
+	EncryptIfNeeded(dataKey []byte) error
+	ToMap() map[string]interface{}
+}
+
+// EncryptWithAzureKey encrypts the plaintext data in the given format with a
+// newly generated SOPS data key, which is encrypted with the Azure Key Vault
+// key, and returns the data in the SOPS encrypted file format. The metadata
+// configures which values are encrypted, e.g. with an EncryptedRegex, and
+// must not hold any key group. The Azure Key Vault key is recorded in the
+// SOPS metadata as serialized by its ToMap, including its algorithm, so
+// that the file can be decrypted by the Decryptor.
+// The input and output formats must be YAML or JSON.
+func EncryptWithAzureKey(key *azkv.MasterKey, metadata sops.Metadata, data []byte, inputFormat, outputFormat formats.Format) ([]byte, error) {
+	return encryptWithAzureKey(key, metadata, data, inputFormat, outputFormat)
+}
+
+func encryptWithAzureKey(key azureDataKeyEncrypter, metadata sops.Metadata, data []byte, inputFormat, outputFormat formats.Format) ([]byte, error) {
+	for _, f := range []formats.Format{inputFormat, outputFormat} {
+		if f != formats.Yaml && f != formats.Json {
+			return nil, fmt.Errorf("unsupported format for encryption with an Azure Key Vault key, must be YAML or JSON")
+		}
+	}
+	if len(metadata.KeyGroups) > 0 {
+		return nil, fmt.Errorf("the metadata must not hold any key group")
+	}
+
+	branches, err := common.StoreForFormat(inputFormat).LoadPlainFile(data)
+	if err != nil {
+		return nil, err
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: metadata,
+	}
+
+	// Generate the data key as SOPS does, the Azure Key Vault key is not
+	// handled by its key services.
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, sopsUserErr("could not generate data key", err)
+	}
+	if err := key.EncryptIfNeeded(dataKey); err != nil {
+		return nil, sopsUserErr("could not encrypt data key with Azure Key Vault key", err)
+	}
+
+	cipher := aes.NewCipher()
+	unencryptedMac, err := tree.Encrypt(dataKey, cipher)
+	if err != nil {
+		return nil, sopsUserErr("error encrypting sops tree", err)
+	}
+	tree.Metadata.LastModified = time.Now().UTC()
+	tree.Metadata.Version = version.Version
+	tree.Metadata.MessageAuthenticationCode, err = cipher.Encrypt(unencryptedMac, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, sopsUserErr("cannot encrypt sops data tree", err)
+	}
+
+	m, err := sopsMetadataWithAzureKey(tree.Metadata, key)
+	if err != nil {
+		return nil, err
+	}
+	// The key of the metadata is not an upstream SOPS key, which the stores
+	// would not serialize. Emit the metadata with the encrypted values
+	// instead, as the stores do for their encrypted files.
+	for i := range tree.Branches {
+		tree.Branches[i] = append(tree.Branches[i], sops.TreeItem{Key: "sops", Value: m})
+	}
+	out, err := common.StoreForFormat(outputFormat).EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, sopsUserErr("failed to emit sops encrypted file", err)
+	}
+	return out, nil
+}
+
+// sopsMetadataWithAzureKey returns the SOPS metadata of an encrypted file as
+// serialized by the stores, with the Azure Key Vault key as its only key.
+func sopsMetadataWithAzureKey(metadata sops.Metadata, key azureDataKeyEncrypter) (map[string]interface{}, error) {
+	b, err := json.Marshal(stores.MetadataFromInternal(metadata))
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize sops metadata: %w", err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("failed to serialize sops metadata: %w", err)
+	}
+	for k, v := range m {
+		if v == nil {
+			delete(m, k)
+		}
+	}
+
+	// The fields of ToMap are named after the ones of the upstream SOPS key,
+	// and are renamed to the ones of the stores.
+	azureKey := make(map[string]interface{})
+	for k, v := range key.ToMap() {
+		switch k {
+		case "vaultUrl":
+			k = "vault_url"
+		case "key":
+			k = "name"
+		}
+		azureKey[k] = v
+	}
+	m["azure_kv"] = []interface{}{azureKey}
+	return m, nil
+}
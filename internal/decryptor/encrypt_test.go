@@ -0,0 +1,204 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"go.mozilla.org/sops/v3"
+	sopsage "go.mozilla.org/sops/v3/age"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/keyservice"
+	"google.golang.org/grpc"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	intkeyservice "github.com/fluxcd/kustomize-controller/internal/sops/keyservice"
+)
+
+// fakeAzureDataKeyEncrypter is an azureDataKeyEncrypter which encrypts the
+// data key in memory, with its base64 encoding as ciphertext.
+type fakeAzureDataKeyEncrypter struct {
+	*azkv.MasterKey
+	err      error
+	encrypts int
+}
+
+func (f *fakeAzureDataKeyEncrypter) EncryptIfNeeded(dataKey []byte) error {
+	f.encrypts++
+	if f.err != nil {
+		return f.err
+	}
+	f.SetEncryptedDataKey([]byte(base64.StdEncoding.EncodeToString(dataKey)))
+	return nil
+}
+
+// base64AzureKeyService is a keyservice.KeyServiceClient which decodes the
+// ciphertext of fakeAzureDataKeyEncrypter before decrypting it.
+type base64AzureKeyService struct {
+	keyservice.KeyServiceClient
+}
+
+func (s *base64AzureKeyService) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	if _, ok := req.Key.KeyType.(*keyservice.Key_AzureKeyvaultKey); ok {
+		ciphertext, err := base64.StdEncoding.DecodeString(string(req.Ciphertext))
+		if err != nil {
+			return nil, err
+		}
+		req.Ciphertext = ciphertext
+	}
+	return s.KeyServiceClient.Decrypt(ctx, req, opts...)
+}
+
+func TestEncryptWithAzureKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		inputFormat  formats.Format
+		outputFormat formats.Format
+		data         []byte
+		want         []byte
+		algorithm    string
+	}{
+		{
+			name:         "YAML",
+			inputFormat:  formats.Yaml,
+			outputFormat: formats.Yaml,
+			data:         []byte("key: value\nnested:\n    list:\n        - a\n        - b\n"),
+		},
+		{
+			name:         "YAML with multiple documents",
+			inputFormat:  formats.Yaml,
+			outputFormat: formats.Yaml,
+			data:         []byte("key: value\n---\nother: value\n"),
+		},
+		{
+			name:         "JSON",
+			inputFormat:  formats.Json,
+			outputFormat: formats.Json,
+			data:         []byte("{\n\t\"key\": \"value\",\n\t\"number\": 1\n}"),
+		},
+		{
+			name:         "JSON to YAML",
+			inputFormat:  formats.Json,
+			outputFormat: formats.Yaml,
+			data:         []byte(`{"key": "value"}`),
+			want:         []byte("{\n\t\"key\": \"value\"\n}"),
+		},
+		{
+			name:         "YAML with algorithm",
+			inputFormat:  formats.Yaml,
+			outputFormat: formats.Yaml,
+			data:         []byte("key: value\n"),
+			algorithm:    "RSA-OAEP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			key := &fakeAzureDataKeyEncrypter{
+				MasterKey: azkv.MasterKeyFromURL("https://example.vault.azure.net", "sops", "1234"),
+			}
+			key.Algorithm = tt.algorithm
+
+			encData, err := encryptWithAzureKey(key, sops.Metadata{}, tt.data, tt.inputFormat, tt.outputFormat)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(key.encrypts).To(Equal(1))
+			g.Expect(string(encData)).ToNot(ContainSubstring("value"))
+
+			metadata := sopsMetadata(encData, tt.outputFormat)
+			g.Expect(unsupportedKeyProviders(metadata)).To(BeEmpty())
+			if tt.algorithm != "" {
+				g.Expect(azureKeyAlgorithms(metadata)).To(Equal(map[string]string{key.ToString(): tt.algorithm}))
+			}
+
+			d := &Decryptor{}
+			svc := &recordingAzureKeyService{KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer())}
+			d.localServiceOnce.Do(func() {})
+			d.keyServices = []keyservice.KeyServiceClient{&base64AzureKeyService{KeyServiceClient: svc}}
+
+			out, err := d.SopsDecryptWithFormat(encData, tt.outputFormat, tt.inputFormat)
+			g.Expect(err).ToNot(HaveOccurred())
+			want := tt.want
+			if want == nil {
+				want = tt.data
+			}
+			g.Expect(out).To(Equal(want))
+			g.Expect(svc.algorithms).To(HaveEach(tt.algorithm))
+		})
+	}
+
+	t.Run("encrypts matching values", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := &fakeAzureDataKeyEncrypter{
+			MasterKey: azkv.MasterKeyFromURL("https://example.vault.azure.net", "sops", "1234"),
+		}
+		data := []byte("kind: Secret\nstringData:\n    key: secret\n")
+		encData, err := encryptWithAzureKey(key, sops.Metadata{EncryptedRegex: "^(data|stringData)$"},
+			data, formats.Yaml, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(string(encData)).To(ContainSubstring("kind: Secret"))
+		g.Expect(string(encData)).ToNot(ContainSubstring("key: secret"))
+
+		d := &Decryptor{}
+		svc := &recordingAzureKeyService{KeyServiceClient: keyservice.NewCustomLocalClient(intkeyservice.NewServer())}
+		d.localServiceOnce.Do(func() {})
+		d.keyServices = []keyservice.KeyServiceClient{&base64AzureKeyService{KeyServiceClient: svc}}
+		out, err := d.SopsDecryptWithFormat(encData, formats.Yaml, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(out).To(Equal(data))
+	})
+
+	t.Run("fails to encrypt the data key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := &fakeAzureDataKeyEncrypter{
+			MasterKey: azkv.MasterKeyFromURL("https://example.vault.azure.net", "sops", "1234"),
+			err:       fmt.Errorf("vault unavailable"),
+		}
+		_, err := encryptWithAzureKey(key, sops.Metadata{}, []byte("key: value\n"), formats.Yaml, formats.Yaml)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("vault unavailable"))
+	})
+
+	t.Run("unsupported format", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := &fakeAzureDataKeyEncrypter{
+			MasterKey: azkv.MasterKeyFromURL("https://example.vault.azure.net", "sops", "1234"),
+		}
+		_, err := encryptWithAzureKey(key, sops.Metadata{}, []byte("key=value\n"), formats.Dotenv, formats.Dotenv)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(key.encrypts).To(BeZero())
+	})
+
+	t.Run("metadata with key groups", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := &fakeAzureDataKeyEncrypter{
+			MasterKey: azkv.MasterKeyFromURL("https://example.vault.azure.net", "sops", "1234"),
+		}
+		_, err := encryptWithAzureKey(key, sops.Metadata{
+			KeyGroups: []sops.KeyGroup{{&sopsage.MasterKey{Recipient: "age1"}}},
+		}, []byte("key: value\n"), formats.Yaml, formats.Yaml)
+		g.Expect(err).To(HaveOccurred())
+	})
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/yaml"
+
+	intkeyservice "github.com/fluxcd/kustomize-controller/internal/sops/keyservice"
+)
+
+// KeySource is a master key referenced by the SOPS metadata of the files of
+// a Kustomization.
+type KeySource struct {
+	// Provider is the name of the SOPS metadata field of the key provider,
+	// e.g. "azure_kv", or an empty string for unknown providers.
+	Provider string
+	// Key is the string representation of the master key, e.g. the URL of
+	// an Azure Key Vault key.
+	Key string
+	// Paths are the sorted paths of the files referencing the key, relative
+	// to the root of the Decryptor.
+	Paths []string
+}
+
+// KeySources returns the master keys referenced by the SOPS metadata of the
+// files in the directory at the provided path, sorted by provider and key.
+// Nothing is decrypted, and no key service is contacted.
+//
+// In addition to the SOPS encrypted files, the YAML documents of Secrets
+// with SOPS encrypted data fields are scanned. The files which would not be
+// decrypted, as they are excluded by the Decryption path globs or exceed the
+// maxFileSize, are ignored. Files of which the SOPS metadata can't be parsed
+// result in an error, after all other files have been scanned.
+func (d *Decryptor) KeySources(path string) ([]KeySource, error) {
+	absPath, _, err := securePaths(d.root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	type id struct{ provider, key string }
+	paths := make(map[id]map[string]struct{})
+	var errs []error
+	err = filepath.WalkDir(absPath, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relPath := stripRoot(d.root, p)
+		if ok, err := d.isIncludedPath(relPath); err != nil || !ok {
+			return err
+		}
+		data, err := d.readEncryptedFile(p)
+		if err != nil {
+			return nil
+		}
+		sources, err := keySourcesForFile(relPath, data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to scan '%s' for SOPS key sources: %w", relPath, err))
+		}
+		for _, src := range sources {
+			k := id{src.Provider, src.Key}
+			if paths[k] == nil {
+				paths[k] = make(map[string]struct{})
+			}
+			paths[k][relPath] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]KeySource, 0, len(paths))
+	for k, ps := range paths {
+		src := KeySource{Provider: k.provider, Key: k.key}
+		for p := range ps {
+			src.Paths = append(src.Paths, p)
+		}
+		sort.Strings(src.Paths)
+		result = append(result, src)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Provider != result[j].Provider {
+			return result[i].Provider < result[j].Provider
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result, kerrors.NewAggregate(errs)
+}
+
+// keySourcesForFile returns the master keys referenced by the SOPS metadata
+// of the file data, without the Paths set. The documents of YAML files are
+// scanned separately, as they may have been encrypted with different keys.
+func keySourcesForFile(path string, data []byte) ([]KeySource, error) {
+	format := formatForPath(path)
+	if format == formats.Binary {
+		format = detectFormatFromMarkerBytes(data)
+	}
+	if format == unsupportedFormat {
+		return nil, nil
+	}
+
+	docs := [][]byte{data}
+	if format == formats.Yaml {
+		docs = splitYAMLDocuments(data)
+	}
+	var sources []KeySource
+	for _, doc := range docs {
+		s, err := keySourcesForDocument(doc, format)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s...)
+	}
+	return sources, nil
+}
+
+// keySourcesForDocument returns the master keys referenced by the SOPS
+// metadata of the document, or by the SOPS metadata of the data fields of a
+// Secret which is not SOPS encrypted as a whole.
+func keySourcesForDocument(doc []byte, format formats.Format) ([]KeySource, error) {
+	if !bytes.Contains(doc, sopsFormatToMarkerBytes[format]) {
+		if format != formats.Yaml && format != formats.Json {
+			return nil, nil
+		}
+		return keySourcesForSecretData(doc)
+	}
+	metadata, err := loadMetadata(doc, format)
+	if errors.Is(err, sops.MetadataNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keySourcesForMetadata(metadata), nil
+}
+
+// keySourcesForSecretData returns the master keys referenced by the SOPS
+// metadata of the base64 encoded data fields of the Secret in the document.
+// It returns nil if the document is not a Secret.
+func keySourcesForSecretData(doc []byte) ([]KeySource, error) {
+	var secret corev1.Secret
+	if err := yaml.Unmarshal(doc, &secret); err != nil || secret.Kind != "Secret" {
+		return nil, nil
+	}
+	var sources []KeySource
+	for key, value := range secret.Data {
+		inF, _ := formatsForData(key, value)
+		if inF == unsupportedFormat {
+			continue
+		}
+		metadata, err := loadMetadata(value, inF)
+		if errors.Is(err, sops.MetadataNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Secret field '%s': %w", key, err)
+		}
+		sources = append(sources, keySourcesForMetadata(metadata)...)
+	}
+	return sources, nil
+}
+
+// loadMetadata loads the SOPS metadata of the data in the provided format.
+func loadMetadata(data []byte, format formats.Format) (sops.Metadata, error) {
+	tree, err := common.StoreForFormat(format).LoadEncryptedFile(data)
+	if err != nil {
+		return sops.Metadata{}, err
+	}
+	return tree.Metadata, nil
+}
+
+// keySourcesForMetadata returns the master keys of all key groups of the
+// metadata.
+func keySourcesForMetadata(metadata sops.Metadata) []KeySource {
+	var sources []KeySource
+	for _, group := range metadata.KeyGroups {
+		for _, key := range group {
+			sources = append(sources, KeySource{
+				Provider: intkeyservice.KeyProvider(key),
+				Key:      key.ToString(),
+			})
+		}
+	}
+	return sources
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	extage "filippo.io/age"
+	. "github.com/onsi/gomega"
+	"go.mozilla.org/sops/v3"
+	sopsage "go.mozilla.org/sops/v3/age"
+	sopsazkv "go.mozilla.org/sops/v3/azkv"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/keyservice"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	intkeyservice "github.com/fluxcd/kustomize-controller/internal/sops/keyservice"
+)
+
+// gcpKMSSecret is a SOPS encrypted YAML document of which only the metadata
+// is valid, referencing a GCP KMS key.
+const gcpKMSSecret = `apiVersion: v1
+kind: Secret
+metadata:
+    name: gcp
+data:
+    key: ENC[AES256_GCM,data:Tr7o,iv:1=,tag:1=,type:str]
+sops:
+    gcp_kms:
+        - resource_id: projects/flux/locations/global/keyRings/sops/cryptoKeys/sops
+          created_at: "2023-01-01T00:00:00Z"
+          enc: CiQA
+    lastmodified: "2023-01-01T00:00:00Z"
+    mac: ENC[AES256_GCM,data:Tr7o,iv:1=,tag:1=,type:str]
+    encrypted_regex: ^(data|stringData)$
+    version: 3.7.3
+`
+
+func TestDecryptor_KeySources(t *testing.T) {
+	g := NewWithT(t)
+
+	ageID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	ageKey := &sopsage.MasterKey{Recipient: ageID.Recipient().String()}
+	azureKey := sopsazkv.NewMasterKey("https://example.vault.azure.net", "sops", "1234")
+	otherAzureKey := sopsazkv.NewMasterKey("https://example.vault.azure.net", "other", "5678")
+
+	// The encrypting Decryptor handles the Azure Key Vault keys in memory.
+	enc := &Decryptor{}
+	enc.localServiceOnce.Do(func() {})
+	enc.keyServices = []keyservice.KeyServiceClient{&recordingAzureKeyService{
+		KeyServiceClient: keyservice.NewCustomLocalClient(
+			intkeyservice.NewServer(intkeyservice.WithAgeIdentities{ageID}),
+		),
+	}}
+	encrypt := func(g *WithT, format formats.Format, data string, groups ...sops.KeyGroup) string {
+		out, err := enc.sopsEncryptWithFormat(sops.Metadata{KeyGroups: groups}, []byte(data), format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		return string(out)
+	}
+
+	envSource := encrypt(g, formats.Dotenv, "key=value\n", sops.KeyGroup{otherAzureKey})
+	root := t.TempDir()
+	files := map[string]string{
+		// Documents encrypted with different keys, and a plain document.
+		"apps/secrets.yaml": encrypt(g, formats.Yaml, "key: value\n", sops.KeyGroup{ageKey, azureKey}) +
+			"---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: plain\n" +
+			"---\n" + gcpKMSSecret,
+		// Shamir key groups.
+		"apps/config.json": encrypt(g, formats.Json, `{"key": "value"}`, sops.KeyGroup{ageKey}, sops.KeyGroup{azureKey}),
+		"apps/app.env":     envSource,
+		// A Secret of which a data field is a SOPS encrypted dotenv file.
+		"infra/secret.yaml": "apiVersion: v1\nkind: Secret\nmetadata:\n  name: env\ndata:\n  app.env: " +
+			base64.StdEncoding.EncodeToString([]byte(envSource)) + "\n",
+		"infra/plain.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: plain\n",
+		"excluded/secret.yaml": encrypt(g, formats.Yaml, "key: value\n",
+			sops.KeyGroup{sopsazkv.NewMasterKey("https://example.vault.azure.net", "excluded", "1")}),
+	}
+	for name, data := range files {
+		p := filepath.Join(root, name)
+		g.Expect(os.MkdirAll(filepath.Dir(p), 0o700)).To(Succeed())
+		g.Expect(os.WriteFile(p, []byte(data), 0o600)).To(Succeed())
+	}
+
+	kus := &kustomizev1.Kustomization{
+		Spec: kustomizev1.KustomizationSpec{
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				Exclude:  []string{"excluded/**"},
+			},
+		},
+	}
+	d := NewDecryptor(root, nil, kus, maxEncryptedFileSize, "")
+
+	want := []KeySource{
+		{
+			Provider: "age",
+			Key:      ageKey.ToString(),
+			Paths:    []string{"apps/config.json", "apps/secrets.yaml"},
+		},
+		{
+			Provider: "azure_kv",
+			Key:      "https://example.vault.azure.net/keys/other/5678",
+			Paths:    []string{"apps/app.env", "infra/secret.yaml"},
+		},
+		{
+			Provider: "azure_kv",
+			Key:      "https://example.vault.azure.net/keys/sops/1234",
+			Paths:    []string{"apps/config.json", "apps/secrets.yaml"},
+		},
+		{
+			Provider: "gcp_kms",
+			Key:      "projects/flux/locations/global/keyRings/sops/cryptoKeys/sops",
+			Paths:    []string{"apps/secrets.yaml"},
+		},
+	}
+
+	t.Run("returns the keys of all files", func(t *testing.T) {
+		g := NewWithT(t)
+
+		got, err := d.KeySources("./")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal(want))
+	})
+
+	t.Run("returns the keys of the files in the path", func(t *testing.T) {
+		g := NewWithT(t)
+
+		got, err := d.KeySources("infra")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]KeySource{{
+			Provider: "azure_kv",
+			Key:      "https://example.vault.azure.net/keys/other/5678",
+			Paths:    []string{"infra/secret.yaml"},
+		}}))
+	})
+
+	t.Run("reports malformed metadata after scanning all files", func(t *testing.T) {
+		g := NewWithT(t)
+
+		malformed := filepath.Join(root, "apps", "malformed.yaml")
+		g.Expect(os.WriteFile(malformed, []byte(`key: ENC[AES256_GCM,data:Tr7o,iv:1=,tag:1=,type:str]
+sops:
+    lastmodified: yesterday
+    mac: ENC[AES256_GCM,data:Tr7o,iv:1=,tag:1=,type:str]
+    version: 3.7.3
+`), 0o600)).To(Succeed())
+		t.Cleanup(func() { _ = os.Remove(malformed) })
+
+		got, err := d.KeySources("./")
+		g.Expect(err).To(MatchError(ContainSubstring("failed to scan 'apps/malformed.yaml' for SOPS key sources")))
+		g.Expect(got).To(Equal(want))
+	})
+}
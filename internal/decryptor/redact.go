@@ -0,0 +1,187 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mozilla.org/sops/v3"
+)
+
+const (
+	// redactedPlaceholder replaces the decrypted values in redacted messages.
+	redactedPlaceholder = "[REDACTED]"
+	// minRedactedLength is the minimum length of a decrypted value to be
+	// redacted. Shorter values (e.g. booleans and small numbers) would
+	// otherwise mangle unrelated parts of the messages.
+	minRedactedLength = 4
+)
+
+// Redactor records the plaintext values decrypted by a Decryptor, and
+// scrubs them from the messages of errors before they are surfaced in e.g.
+// events, logs and status conditions.
+// A nil Redactor records nothing and returns messages unmodified.
+type Redactor struct {
+	mu     sync.Mutex
+	values map[string]struct{}
+}
+
+// NewRedactor returns a new Redactor without any recorded values.
+func NewRedactor() *Redactor {
+	return &Redactor{values: make(map[string]struct{})}
+}
+
+// Record adds the given plaintext values to the Redactor. As decrypted values
+// commonly end up base64 encoded in Secret data, both the base64 encoded and
+// (if valid) decoded forms of the values are recorded as well.
+func (r *Redactor) Record(values ...string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		r.add(v)
+		r.add(base64.StdEncoding.EncodeToString([]byte(v)))
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			r.add(string(b))
+		}
+	}
+}
+
+func (r *Redactor) add(v string) {
+	if len(strings.TrimSpace(v)) < minRedactedLength {
+		return
+	}
+	r.values[v] = struct{}{}
+}
+
+// Redact returns s with all recorded values replaced by a placeholder.
+func (r *Redactor) Redact(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	r.mu.Lock()
+	values := make([]string, 0, len(r.values))
+	for v := range r.values {
+		values = append(values, v)
+	}
+	r.mu.Unlock()
+
+	// Replace the longest values first, so that values containing other
+	// values are not left partially exposed.
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	for _, v := range values {
+		s = strings.ReplaceAll(s, v, redactedPlaceholder)
+	}
+	return s
+}
+
+// RedactError returns an error with the message of err redacted, which
+// unwraps to err. It returns err unmodified if it does not contain any of
+// the recorded values.
+func (r *Redactor) RedactError(err error) error {
+	if r == nil || err == nil {
+		return err
+	}
+	msg := err.Error()
+	if redacted := r.Redact(msg); redacted != msg {
+		return &redactedError{msg: redacted, err: err}
+	}
+	return err
+}
+
+// redactedError is an error with a redacted message, which still allows
+// errors.Is and errors.As to inspect the original error.
+type redactedError struct {
+	msg string
+	err error
+}
+
+// Error returns the redacted error message.
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the original error.
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// encryptedLeaves returns the indices of the leaf values in the SOPS tree
+// branches, in walk order, which are encrypted.
+func encryptedLeaves(branches sops.TreeBranches) map[int]struct{} {
+	indices := make(map[int]struct{})
+	var i int
+	for _, branch := range branches {
+		walkLeaves(branch, func(v interface{}) {
+			if s, ok := v.(string); ok && strings.HasPrefix(s, "ENC[") {
+				indices[i] = struct{}{}
+			}
+			i++
+		})
+	}
+	return indices
+}
+
+// recordDecryptedLeaves records the leaf values in the SOPS tree branches
+// with the given indices, as returned by encryptedLeaves before the tree was
+// decrypted.
+func (r *Redactor) recordDecryptedLeaves(branches sops.TreeBranches, indices map[int]struct{}) {
+	if r == nil || len(indices) == 0 {
+		return
+	}
+	var values []string
+	var i int
+	for _, branch := range branches {
+		walkLeaves(branch, func(v interface{}) {
+			if _, ok := indices[i]; ok {
+				values = append(values, fmt.Sprint(v))
+			}
+			i++
+		})
+	}
+	r.Record(values...)
+}
+
+// walkLeaves calls fn for every leaf value in the branch, skipping comments.
+func walkLeaves(v interface{}, fn func(v interface{})) {
+	switch v := v.(type) {
+	case sops.TreeBranch:
+		for _, item := range v {
+			if _, ok := item.Key.(sops.Comment); ok {
+				continue
+			}
+			walkLeaves(item.Value, fn)
+		}
+	case []interface{}:
+		for _, e := range v {
+			if _, ok := e.(sops.Comment); ok {
+				continue
+			}
+			walkLeaves(e, fn)
+		}
+	default:
+		fn(v)
+	}
+}
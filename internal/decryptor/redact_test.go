@@ -0,0 +1,239 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	extage "filippo.io/age"
+	azruntime "github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	. "github.com/onsi/gomega"
+	"go.mozilla.org/sops/v3"
+	sopsage "go.mozilla.org/sops/v3/age"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/kustomize/api/provider"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestRedactor(t *testing.T) {
+	t.Run("redacts recorded values", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r := NewRedactor()
+		r.Record("s3cr3t-value", "ab")
+
+		g.Expect(r.Redact("got 's3cr3t-value' and 'ab'")).To(Equal("got '[REDACTED]' and 'ab'"))
+		g.Expect(r.Redact("encoded: " + base64.StdEncoding.EncodeToString([]byte("s3cr3t-value")))).
+			To(Equal("encoded: [REDACTED]"))
+	})
+
+	t.Run("redacts the decoded form of base64 values", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r := NewRedactor()
+		r.Record(base64.StdEncoding.EncodeToString([]byte("s3cr3t-value")))
+
+		g.Expect(r.Redact("got s3cr3t-value")).To(Equal("got [REDACTED]"))
+	})
+
+	t.Run("redacts the longest values first", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r := NewRedactor()
+		r.Record("secret", "secret-suffix")
+
+		g.Expect(r.Redact("secret-suffix")).To(Equal("[REDACTED]"))
+	})
+
+	t.Run("redacted errors unwrap to the original error", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r := NewRedactor()
+		r.Record("s3cr3t-value")
+
+		req, _ := http.NewRequest(http.MethodPost, "https://example.vault.azure.net/keys/sops/1234/decrypt", nil)
+		orig := azruntime.NewResponseError(&http.Response{
+			Status:     http.StatusText(http.StatusForbidden),
+			StatusCode: http.StatusForbidden,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(`{"error":{"code":"Forbidden"}}`)),
+			Request:    req,
+		})
+		err := r.RedactError(fmt.Errorf("bad value s3cr3t-value: %w", orig))
+		g.Expect(err.Error()).To(HavePrefix("bad value [REDACTED]: "))
+		g.Expect(errors.Is(err, orig)).To(BeTrue())
+		g.Expect(FailureReason(err)).To(Equal(kustomizev1.DecryptionForbiddenReason))
+	})
+
+	t.Run("returns errors without recorded values unmodified", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r := NewRedactor()
+		r.Record("s3cr3t-value")
+
+		err := errors.New("unrelated")
+		g.Expect(r.RedactError(err)).To(BeIdenticalTo(err))
+		g.Expect(r.RedactError(nil)).To(BeNil())
+	})
+
+	t.Run("nil redactor", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var r *Redactor
+		r.Record("s3cr3t-value")
+
+		err := errors.New("s3cr3t-value")
+		g.Expect(r.Redact("s3cr3t-value")).To(Equal("s3cr3t-value"))
+		g.Expect(r.RedactError(err)).To(BeIdenticalTo(err))
+	})
+}
+
+func TestDecryptor_DecryptResource_Redaction(t *testing.T) {
+	resourceFactory := provider.NewDefaultDepProvider().GetResourceFactory()
+
+	kus := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "redact",
+			Namespace: "redact",
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+			},
+		},
+	}
+
+	newDecryptor := func(t *testing.T) (*Decryptor, *Redactor, *extage.X25519Identity) {
+		g := NewWithT(t)
+
+		d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().Build(), kus)
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+		d.ageIdentities = append(d.ageIdentities, ageID)
+
+		r := NewRedactor()
+		d.SetRedactor(r)
+		return d, r, ageID
+	}
+
+	randomValue := func(t *testing.T) string {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		return hex.EncodeToString(b)
+	}
+
+	t.Run("decrypted values do not surface in wrapped errors", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			g := NewWithT(t)
+			d, r, ageID := newDecryptor(t)
+
+			plaintext := randomValue(t)
+			secret := resourceFactory.FromMap(map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata": map[string]interface{}{
+					"name":      "secret",
+					"namespace": "test",
+				},
+				"stringData": map[string]interface{}{
+					"key": plaintext,
+				},
+			})
+			secretData, err := secret.MarshalJSON()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+				EncryptedRegex: "^(data|stringData)$",
+				KeyGroups: []sops.KeyGroup{
+					{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+				},
+			}, secretData, formats.Json, formats.Json)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(string(encData)).ToNot(ContainSubstring(plaintext))
+			g.Expect(secret.UnmarshalJSON(encData)).To(Succeed())
+
+			got, err := d.DecryptResource(secret)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got.String()).To(ContainSubstring(plaintext))
+
+			encoded := base64.StdEncoding.EncodeToString([]byte(plaintext))
+			for _, err := range []error{
+				fmt.Errorf("failed to decode Kubernetes apiVersion, kind and name from: %v", got.String()),
+				fmt.Errorf("apply failed: %w", fmt.Errorf("invalid value %q", plaintext)),
+				fmt.Errorf("rejected data: %s", encoded),
+				fmt.Errorf("prefix%ssuffix", plaintext),
+			} {
+				redacted := r.RedactError(err)
+				g.Expect(redacted.Error()).ToNot(ContainSubstring(plaintext))
+				g.Expect(redacted.Error()).ToNot(ContainSubstring(encoded))
+				g.Expect(redacted.Error()).To(ContainSubstring(redactedPlaceholder))
+			}
+		}
+	})
+
+	t.Run("decrypted values do not surface in emit errors", func(t *testing.T) {
+		g := NewWithT(t)
+		d, r, ageID := newDecryptor(t)
+
+		// Nested values can not be emitted as dotenv, SOPS includes the
+		// offending (decrypted) value in the error.
+		plaintext := randomValue(t)
+		encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&sopsage.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, []byte(fmt.Sprintf("nested:\n  key: %s\n", plaintext)), formats.Yaml, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		secret := resourceFactory.FromMap(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":      "secret",
+				"namespace": "test",
+			},
+			"data": map[string]interface{}{
+				"app.env": base64.StdEncoding.EncodeToString(encData),
+			},
+		})
+
+		_, err = d.DecryptResource(secret)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("cannot use complex value in dotenv file"))
+		g.Expect(err.Error()).ToNot(ContainSubstring(plaintext))
+		g.Expect(r.Redact(plaintext)).To(Equal(redactedPlaceholder))
+	})
+}
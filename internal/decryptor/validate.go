@@ -0,0 +1,171 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/age"
+	"github.com/fluxcd/kustomize-controller/internal/sops/awskms"
+	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	"github.com/fluxcd/kustomize-controller/internal/sops/gcpkms"
+	"github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
+)
+
+// InvalidSecretError is the error of a decryption Secret of which some of
+// the data entries are invalid.
+type InvalidSecretError struct {
+	// Secret is the namespaced name of the decryption Secret.
+	Secret types.NamespacedName
+	// Errs are the errors of the invalid entries, sorted by the name of the
+	// entry.
+	Errs []error
+}
+
+// Error returns the errors of all the invalid entries of the Secret.
+func (e *InvalidSecretError) Error() string {
+	return fmt.Sprintf("invalid %s decryption Secret '%s': %s", DecryptionProviderSOPS, e.Secret,
+		kerrors.NewAggregate(e.Errs).Error())
+}
+
+// ValidateSecret validates the data entries of the SOPS decryption Secret
+// which are imported by ImportKeys: the age identities, the Azure
+// authentication file and CA bundle, the AWS KMS and GCP KMS credentials,
+// and the Hashicorp Vault token, Kubernetes auth method and namespace. The
+// entries are only parsed, no credential is constructed and no key service
+// is contacted. The PGP keys are validated on import by GnuPG.
+// It returns an InvalidSecretError with the errors of all the invalid
+// entries, or nil. The Azure authentication file is validated as for a
+// Decryptor without Azure settings, i.e. without workload identity, and
+// the Vault Kubernetes auth method is rejected.
+func ValidateSecret(secret *corev1.Secret) error {
+	return (&Decryptor{}).validateDecryptionSecret(secret)
+}
+
+// validateDecryptionSecret validates the decryption Secret as ValidateSecret,
+// with the Azure authentication file and Vault Kubernetes auth method
+// validated as they are constructed with the settings of the Decryptor.
+func (d *Decryptor) validateDecryptionSecret(secret *corev1.Secret) error {
+	names := make([]string, 0, len(secret.Data))
+	for name := range secret.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if err := d.validateSecretEntry(name, secret.Data[name]); err != nil {
+			errs = append(errs, fmt.Errorf("'%s': %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return &InvalidSecretError{Secret: client.ObjectKeyFromObject(secret), Errs: errs}
+	}
+	return nil
+}
+
+// validateSecretEntry validates the data entry of a decryption Secret with
+// the given name, as it is imported by ImportKeys. Entries which are not
+// imported are ignored.
+func (d *Decryptor) validateSecretEntry(name string, value []byte) error {
+	if filepath.Ext(name) == DecryptionAgeExt {
+		return age.Identities(value).Validate()
+	}
+	switch name {
+	case DecryptionAzureAuthFile:
+		conf := azkv.AADConfig{}
+		if err := azkv.LoadAADConfigFromBytes(value, &conf); err != nil {
+			return err
+		}
+		conf.NoDefaultCredential = d.azureNoDefaultCredential
+		conf.AllowWorkloadIdentity = d.azureAllowWorkloadIdentity
+		return conf.Validate()
+	case DecryptionAzureCAFile:
+		return azkv.CABundle(value).Validate()
+	case DecryptionAWSKmsFile:
+		creds, err := awskms.LoadCredsProviderFromYaml(value)
+		if err != nil {
+			return err
+		}
+		return creds.Validate()
+	case DecryptionGCPCredsFile:
+		return gcpkms.CredentialJSON(bytes.Trim(value, "\n")).Validate()
+	case DecryptionVaultTokenFileName:
+		return hcvault.VaultToken(strings.TrimSpace(string(value))).Validate()
+	case DecryptionVaultNamespaceFile:
+		return hcvault.VaultNamespace(strings.TrimSpace(string(value))).Validate()
+	case DecryptionVaultKubernetesAuthFile:
+		_, err := d.loadVaultKubernetesAuth(value)
+		return err
+	}
+	return nil
+}
+
+// loadVaultKubernetesAuth loads and validates the Vault Kubernetes auth file,
+// and configures it to log in with the tokens of the service account of the
+// Decryptor. It returns an error if the Vault Kubernetes auth is not allowed
+// with SetVaultKubernetesAuth.
+func (d *Decryptor) loadVaultKubernetesAuth(value []byte) (*hcvault.KubernetesAuth, error) {
+	auth, err := hcvault.LoadKubernetesAuthFromYaml(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.Validate(); err != nil {
+		return nil, err
+	}
+	if d.vaultTokens == nil {
+		return nil, fmt.Errorf("invalid Vault Kubernetes auth: the Kubernetes auth method is not allowed by the controller")
+	}
+	if d.vaultServiceAccount.Name == "" {
+		return nil, fmt.Errorf("invalid Vault Kubernetes auth: the Kustomization has no service account to log in with")
+	}
+	auth.ServiceAccountNamespace = d.vaultServiceAccount.Namespace
+	auth.ServiceAccountName = d.vaultServiceAccount.Name
+	auth.RequestToken = d.vaultTokens
+	return auth, nil
+}
+
+// ValidateKeys validates the decryption Secret referenced by the Decryption
+// of the Kustomization with ValidateSecret, to report the invalid entries of
+// the Secret before ImportKeys, and before the Kustomization is built. It
+// returns an error if the Secret can't be retrieved, or an
+// InvalidSecretError. Without DecryptionProviderSOPS Secret, it returns nil.
+// The Azure authentication file is validated without the defaults of the
+// environment of the controller with SetAzureDisableDefaultCredential, and
+// with workload identity with SetAzureAllowWorkloadIdentity. The Vault
+// Kubernetes auth file is rejected without SetVaultKubernetesAuth.
+func (d *Decryptor) ValidateKeys(ctx context.Context) error {
+	if d.kustomization.Spec.Decryption == nil || d.kustomization.Spec.Decryption.SecretRef == nil ||
+		d.kustomization.Spec.Decryption.Provider != DecryptionProviderSOPS {
+		return nil
+	}
+	secret, err := d.decryptionSecret(ctx)
+	if err != nil {
+		return err
+	}
+	return d.validateDecryptionSecret(secret)
+}
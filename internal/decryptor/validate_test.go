@@ -0,0 +1,274 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestValidateSecret(t *testing.T) {
+	t.Setenv("AZURE_CLIENT_ID", "")
+	t.Setenv("AZURE_TENANT_ID", "")
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+
+	ageIdentity, err := os.ReadFile("testdata/age.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		wantErr []string
+	}{
+		{
+			name: "valid entries",
+			data: map[string][]byte{
+				"identity.agekey":            ageIdentity,
+				DecryptionAzureAuthFile:      []byte("tenantId: some-tenant-id\nclientId: some-client-id\nclientSecret: some-client-secret\n"),
+				DecryptionAWSKmsFile:         []byte("aws_access_key_id: some-id\naws_secret_access_key: some-secret\n"),
+				DecryptionGCPCredsFile:       []byte(`{"type": "service_account"}` + "\n"),
+				DecryptionVaultTokenFileName: []byte("some-token\n"),
+				DecryptionVaultNamespaceFile: []byte("admin/tenant-a\n"),
+				"unrelated.txt":              []byte("ignored"),
+			},
+		},
+		{
+			name: "age recipient",
+			data: map[string][]byte{
+				"identity.agekey": []byte("age1l44xcng8dqj32nlv6d930qvvrny05hglzcv9qpc7kxjc6902ma4qufys29\n"),
+			},
+			wantErr: []string{"'identity.agekey': invalid age identities: line 1 holds an age recipient"},
+		},
+		{
+			name: "age identities with Windows line endings",
+			data: map[string][]byte{
+				"identity.agekey": []byte("# created: 2021-03-31T09:51:59+02:00\r\nAGE-SECRET-KEY-1RH87A5Z54ZGUR9S0AS3R6WHFSEFNPLYMAKF5Z2CEU7R06VRJ0A3Q7242AM\r\n"),
+			},
+			wantErr: []string{"'identity.agekey': invalid age identities: line 1 ends with a carriage return"},
+		},
+		{
+			name: "Azure config without credentials",
+			data: map[string][]byte{
+				DecryptionAzureAuthFile: []byte("tenantId: some-tenant-id\n"),
+			},
+			wantErr: []string{"'" + DecryptionAzureAuthFile + "': "},
+		},
+		{
+			name: "Azure CA bundle without certificate",
+			data: map[string][]byte{
+				DecryptionAzureCAFile: []byte("not a certificate"),
+			},
+			wantErr: []string{"'" + DecryptionAzureCAFile + "': invalid Azure Key Vault CA bundle"},
+		},
+		{
+			name: "Vault Kubernetes auth without role",
+			data: map[string][]byte{
+				DecryptionVaultKubernetesAuthFile: []byte("mountPath: k8s\n"),
+			},
+			wantErr: []string{"'" + DecryptionVaultKubernetesAuthFile + "': invalid Vault Kubernetes auth: 'role' is required"},
+		},
+		{
+			name: "Vault Kubernetes auth",
+			data: map[string][]byte{
+				DecryptionVaultKubernetesAuthFile: []byte("role: sops\n"),
+			},
+			wantErr: []string{"'" + DecryptionVaultKubernetesAuthFile + "': invalid Vault Kubernetes auth: the Kubernetes auth method is not allowed by the controller"},
+		},
+		{
+			name: "Vault namespace with whitespace",
+			data: map[string][]byte{
+				DecryptionVaultNamespaceFile: []byte("admin tenant-a\n"),
+			},
+			wantErr: []string{"'" + DecryptionVaultNamespaceFile + "': invalid Vault namespace: namespace contains whitespace"},
+		},
+		{
+			name: "multiple invalid entries are sorted",
+			data: map[string][]byte{
+				DecryptionVaultTokenFileName: []byte("\n"),
+				DecryptionGCPCredsFile:       []byte("{}"),
+				DecryptionAWSKmsFile:         []byte("aws_access_key_id: some-id\n"),
+			},
+			wantErr: []string{
+				"'" + DecryptionAWSKmsFile + "': invalid AWS credentials",
+				"'" + DecryptionGCPCredsFile + "': invalid GCP credentials JSON: missing 'type' field",
+				"'" + DecryptionVaultTokenFileName + "': invalid Vault token: token is empty",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "tenant"},
+				Data:       tt.data,
+			}
+			err := ValidateSecret(secret)
+			if len(tt.wantErr) == 0 {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+
+			var invalidErr *InvalidSecretError
+			g.Expect(errors.As(err, &invalidErr)).To(BeTrue())
+			g.Expect(invalidErr.Secret.String()).To(Equal("tenant/sops-keys"))
+			g.Expect(invalidErr.Errs).To(HaveLen(len(tt.wantErr)))
+			for i, want := range tt.wantErr {
+				g.Expect(invalidErr.Errs[i].Error()).To(HavePrefix(want))
+			}
+			g.Expect(err.Error()).To(HavePrefix("invalid sops decryption Secret 'tenant/sops-keys': "))
+			g.Expect(FailureReason(err)).To(Equal(kustomizev1.DecryptionSecretInvalidReason))
+		})
+	}
+}
+
+func TestDecryptor_ValidateKeys(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "tenant"},
+		Data: map[string][]byte{
+			DecryptionVaultTokenFileName: []byte("some token"),
+		},
+	}
+	newKustomization := func(decryption *kustomizev1.Decryption) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "decrypt", Namespace: secret.Namespace},
+			Spec:       kustomizev1.KustomizationSpec{Decryption: decryption},
+		}
+	}
+
+	t.Run("invalid Secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := fake.NewClientBuilder().WithObjects(secret.DeepCopy()).Build()
+		d := NewDecryptor("", c, newKustomization(&kustomizev1.Decryption{
+			Provider:  DecryptionProviderSOPS,
+			SecretRef: &meta.LocalObjectReference{Name: secret.Name},
+		}), 0, "")
+		err := d.ValidateKeys(context.TODO())
+		var invalidErr *InvalidSecretError
+		g.Expect(errors.As(err, &invalidErr)).To(BeTrue())
+		g.Expect(err.Error()).To(ContainSubstring("invalid Vault token: token contains whitespace"))
+	})
+
+	t.Run("Azure config without defaults of the environment", func(t *testing.T) {
+		g := NewWithT(t)
+
+		t.Setenv("AZURE_TENANT_ID", "env-tenant-id")
+		t.Setenv("AZURE_CLIENT_ID", "env-client-id")
+		azureSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "sops-azure", Namespace: secret.Namespace},
+			Data: map[string][]byte{
+				DecryptionAzureAuthFile: []byte("clientSecret: some-client-secret\n"),
+			},
+		}
+		c := fake.NewClientBuilder().WithObjects(azureSecret).Build()
+		newDecryptor := func() *Decryptor {
+			return NewDecryptor("", c, newKustomization(&kustomizev1.Decryption{
+				Provider:  DecryptionProviderSOPS,
+				SecretRef: &meta.LocalObjectReference{Name: azureSecret.Name},
+			}), 0, "")
+		}
+		g.Expect(newDecryptor().ValidateKeys(context.TODO())).To(Succeed())
+
+		d := newDecryptor()
+		d.SetAzureDisableDefaultCredential(true)
+		err := d.ValidateKeys(context.TODO())
+		var invalidErr *InvalidSecretError
+		g.Expect(errors.As(err, &invalidErr)).To(BeTrue())
+	})
+
+	t.Run("Azure managed identity without default credential", func(t *testing.T) {
+		g := NewWithT(t)
+
+		azureSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "sops-azure", Namespace: secret.Namespace},
+			Data: map[string][]byte{
+				DecryptionAzureAuthFile: []byte("clientId: some-client-id\n"),
+			},
+		}
+		c := fake.NewClientBuilder().WithObjects(azureSecret).Build()
+		d := NewDecryptor("", c, newKustomization(&kustomizev1.Decryption{
+			Provider:  DecryptionProviderSOPS,
+			SecretRef: &meta.LocalObjectReference{Name: azureSecret.Name},
+		}), 0, "")
+		d.SetAzureDisableDefaultCredential(true)
+		err := d.ValidateKeys(context.TODO())
+		var invalidErr *InvalidSecretError
+		g.Expect(errors.As(err, &invalidErr)).To(BeTrue())
+		g.Expect(err.Error()).To(ContainSubstring("managed identity 'some-client-id' can not be used"))
+	})
+
+	t.Run("Vault Kubernetes auth allowed by the controller", func(t *testing.T) {
+		g := NewWithT(t)
+
+		vaultSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "sops-vault", Namespace: secret.Namespace},
+			Data: map[string][]byte{
+				DecryptionVaultKubernetesAuthFile: []byte("role: sops\n"),
+			},
+		}
+		c := fake.NewClientBuilder().WithObjects(vaultSecret).Build()
+		d := NewDecryptor("", c, newKustomization(&kustomizev1.Decryption{
+			Provider:  DecryptionProviderSOPS,
+			SecretRef: &meta.LocalObjectReference{Name: vaultSecret.Name},
+		}), 0, "")
+		d.SetVaultKubernetesAuth(fakeServiceAccountTokens, types.NamespacedName{Namespace: secret.Namespace, Name: "app"})
+		g.Expect(d.ValidateKeys(context.TODO())).To(Succeed())
+	})
+
+	t.Run("missing Secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := fake.NewClientBuilder().Build()
+		d := NewDecryptor("", c, newKustomization(&kustomizev1.Decryption{
+			Provider:  DecryptionProviderSOPS,
+			SecretRef: &meta.LocalObjectReference{Name: secret.Name},
+		}), 0, "")
+		err := d.ValidateKeys(context.TODO())
+		g.Expect(err).To(HaveOccurred())
+		var invalidErr *InvalidSecretError
+		g.Expect(errors.As(err, &invalidErr)).To(BeFalse())
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	t.Run("without Secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := fake.NewClientBuilder().Build()
+		for _, decryption := range []*kustomizev1.Decryption{
+			nil,
+			{Provider: DecryptionProviderSOPS},
+		} {
+			d := NewDecryptor("", c, newKustomization(decryption), 0, "")
+			g.Expect(d.ValidateKeys(context.TODO())).To(Succeed())
+		}
+	})
+}
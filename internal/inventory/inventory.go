@@ -17,6 +17,10 @@ limitations under the License.
 package inventory
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"sort"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -51,6 +55,72 @@ func AddChangeSet(inv *kustomizev1.ResourceInventory, set *ssa.ChangeSet) error
 	return nil
 }
 
+// Checksums returns the HMAC-SHA256 checksums of the content of the given
+// objects with the key, by the ID of their inventory entry. The checksums are
+// keyed, as they are recorded in the status, and those of Secrets would
+// otherwise allow to confirm a guess of their data.
+func Checksums(key []byte, objects []*unstructured.Unstructured) (map[string]string, error) {
+	checksums := make(map[string]string, len(objects))
+	for _, u := range objects {
+		b, err := json.Marshal(u.Object)
+		if err != nil {
+			// The encoding error may quote the content of the object, e.g.
+			// the plaintext of a decrypted Secret, and is not returned.
+			return nil, fmt.Errorf("failed to compute the checksum of %s", ssa.FmtUnstructured(u))
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(b)
+		checksums[object.UnstructuredToObjMetadata(u).String()] = fmt.Sprintf("%x", mac.Sum(nil))
+	}
+	return checksums, nil
+}
+
+// SetChecksums records the given checksums on the inventory entries with
+// the same ID.
+func SetChecksums(inv *kustomizev1.ResourceInventory, checksums map[string]string) {
+	for i, entry := range inv.Entries {
+		if checksum, ok := checksums[entry.ID]; ok {
+			inv.Entries[i].Checksum = checksum
+		}
+	}
+}
+
+// SplitUnchanged returns the objects of which the checksum differs from the
+// one recorded in the inventory, and a change set with the unchanged
+// objects, which do not need to be applied again.
+func SplitUnchanged(inv *kustomizev1.ResourceInventory,
+	objects []*unstructured.Unstructured,
+	checksums map[string]string) ([]*unstructured.Unstructured, *ssa.ChangeSet) {
+	applied := make(map[kustomizev1.ResourceRef]struct{}, len(inv.Entries))
+	for _, entry := range inv.Entries {
+		if entry.Checksum != "" {
+			applied[entry] = struct{}{}
+		}
+	}
+
+	changed := make([]*unstructured.Unstructured, 0, len(objects))
+	unchanged := ssa.NewChangeSet()
+	for _, u := range objects {
+		objMetadata := object.UnstructuredToObjMetadata(u)
+		ref := kustomizev1.ResourceRef{
+			ID:       objMetadata.String(),
+			Version:  u.GroupVersionKind().Version,
+			Checksum: checksums[objMetadata.String()],
+		}
+		if _, ok := applied[ref]; !ok {
+			changed = append(changed, u)
+			continue
+		}
+		unchanged.Add(ssa.ChangeSetEntry{
+			ObjMetadata:  objMetadata,
+			GroupVersion: ref.Version,
+			Subject:      ssa.FmtUnstructured(u),
+			Action:       ssa.UnchangedAction,
+		})
+	}
+	return changed, unchanged
+}
+
 // List returns the inventory entries as unstructured.Unstructured objects.
 func List(inv *kustomizev1.ResourceInventory) ([]*unstructured.Unstructured, error) {
 	objects := make([]*unstructured.Unstructured, 0)
@@ -80,6 +150,39 @@ func List(inv *kustomizev1.ResourceInventory) ([]*unstructured.Unstructured, err
 	return objects, nil
 }
 
+// MaxManagedObjects is the maximum number of entries listed in
+// the Kustomization status managed objects.
+const MaxManagedObjects = 100
+
+// ManagedObjects returns a readable list of the inventory entries, sorted
+// in apply order and capped to the given limit.
+func ManagedObjects(inv *kustomizev1.ResourceInventory, limit int) (*kustomizev1.ManagedObjectList, error) {
+	objects, err := List(inv)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &kustomizev1.ManagedObjectList{
+		Total: len(objects),
+	}
+	if len(objects) > limit {
+		objects = objects[:limit]
+		list.Truncated = true
+	}
+
+	for _, o := range objects {
+		gvk := o.GroupVersionKind()
+		list.Entries = append(list.Entries, kustomizev1.ManagedObject{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       gvk.Kind,
+			Name:       o.GetName(),
+			Namespace:  o.GetNamespace(),
+		})
+	}
+
+	return list, nil
+}
+
 // ListMetadata returns the inventory entries as object.ObjMetadata objects.
 func ListMetadata(inv *kustomizev1.ResourceInventory) (object.ObjMetadataSet, error) {
 	var metas []object.ObjMetadata
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"sigs.k8s.io/cli-utils/pkg/object"
 
 	"github.com/fluxcd/pkg/ssa"
@@ -64,6 +65,105 @@ func Test_Inventory(t *testing.T) {
 		g.Expect(len(unList)).To(BeIdenticalTo(1))
 		g.Expect(unList[0].GetName()).To(BeIdenticalTo("test2"))
 	})
+
+	t.Run("lists managed objects in inventory", func(t *testing.T) {
+		list, err := ManagedObjects(inv1, MaxManagedObjects)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(list.Total).To(BeIdenticalTo(len(inv1.Entries)))
+		g.Expect(list.Truncated).To(BeFalse())
+		g.Expect(list.Entries).To(HaveLen(len(inv1.Entries)))
+		for _, e := range list.Entries {
+			g.Expect(e.APIVersion).ToNot(BeEmpty())
+			g.Expect(e.Kind).ToNot(BeEmpty())
+			g.Expect(e.Name).ToNot(BeEmpty())
+		}
+
+		truncated, err := ManagedObjects(inv1, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(truncated.Total).To(BeIdenticalTo(len(inv1.Entries)))
+		g.Expect(truncated.Truncated).To(BeTrue())
+		g.Expect(truncated.Entries).To(Equal(list.Entries[:1]))
+	})
+}
+
+func Test_SplitUnchanged(t *testing.T) {
+	g := NewWithT(t)
+
+	data, err := os.ReadFile("testdata/inventory1.yaml")
+	g.Expect(err).ToNot(HaveOccurred())
+	objects, err := ssa.ReadObjects(strings.NewReader(string(data)))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	key := []byte("checksum-key")
+	checksums, err := Checksums(key, objects)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(checksums).To(HaveLen(len(objects)))
+
+	// The checksums depend on the key.
+	otherChecksums, err := Checksums([]byte("other-key"), objects)
+	g.Expect(err).ToNot(HaveOccurred())
+	for id, checksum := range checksums {
+		g.Expect(otherChecksums[id]).ToNot(Equal(checksum))
+	}
+
+	set, err := readManifest("testdata/inventory1.yaml")
+	g.Expect(err).ToNot(HaveOccurred())
+	inv := New()
+	g.Expect(AddChangeSet(inv, set)).To(Succeed())
+
+	t.Run("applies all objects without checksums", func(t *testing.T) {
+		g := NewWithT(t)
+
+		changed, unchanged := SplitUnchanged(inv, objects, checksums)
+		g.Expect(changed).To(HaveLen(len(objects)))
+		g.Expect(unchanged.Entries).To(BeEmpty())
+	})
+
+	SetChecksums(inv, checksums)
+	for _, entry := range inv.Entries {
+		g.Expect(entry.Checksum).To(Equal(checksums[entry.ID]))
+	}
+
+	t.Run("skips unchanged objects", func(t *testing.T) {
+		g := NewWithT(t)
+
+		changed, unchanged := SplitUnchanged(inv, objects, checksums)
+		g.Expect(changed).To(BeEmpty())
+		g.Expect(unchanged.Entries).To(HaveLen(len(objects)))
+		for _, entry := range unchanged.Entries {
+			g.Expect(entry.Action).To(Equal(ssa.UnchangedAction))
+		}
+
+		// The unchanged objects are kept in the inventory.
+		next := New()
+		g.Expect(AddChangeSet(next, unchanged)).To(Succeed())
+		stale, err := Diff(inv, next)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(stale).To(BeEmpty())
+	})
+
+	t.Run("applies changed objects", func(t *testing.T) {
+		g := NewWithT(t)
+
+		modified := make([]*unstructured.Unstructured, 0, len(objects))
+		for _, u := range objects {
+			modified = append(modified, u.DeepCopy())
+		}
+		var target *unstructured.Unstructured
+		for _, u := range modified {
+			if u.GetKind() == "ConfigMap" && u.GetName() == "test1" {
+				target = u
+			}
+		}
+		g.Expect(target).ToNot(BeNil())
+		g.Expect(unstructured.SetNestedField(target.Object, "value2", "data", "key")).To(Succeed())
+
+		modifiedChecksums, err := Checksums(key, modified)
+		g.Expect(err).ToNot(HaveOccurred())
+		changed, unchanged := SplitUnchanged(inv, modified, modifiedChecksums)
+		g.Expect(changed).To(ConsistOf(target))
+		g.Expect(unchanged.Entries).To(HaveLen(len(objects) - 1))
+	})
 }
 
 func readManifest(manifest string) (*ssa.ChangeSet, error) {
@@ -0,0 +1,98 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"context"
+	"sync"
+)
+
+// Limiter bounds the number of concurrent operations sharing the same key,
+// e.g. the reconciliations of the Kustomizations which refer to the same
+// source. Operations with different keys do not limit each other.
+type Limiter struct {
+	limit int
+
+	mu    sync.Mutex
+	slots map[string]*slot
+}
+
+// slot holds the semaphore of a key, and the number of operations holding
+// or waiting for it.
+type slot struct {
+	sem  chan struct{}
+	refs int
+}
+
+// New returns a Limiter which allows up to limit concurrent operations per
+// key. A limit lower than one disables the limiting.
+func New(limit int) *Limiter {
+	return &Limiter{
+		limit: limit,
+		slots: make(map[string]*slot),
+	}
+}
+
+// Acquire blocks until an operation for the given key is allowed to run, or
+// until the context is done. On success, the returned release func must be
+// called once the operation finishes.
+func (l *Limiter) Acquire(ctx context.Context, key string) (func(), error) {
+	if l == nil || l.limit < 1 {
+		return func() {}, nil
+	}
+
+	s := l.ref(key)
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.unref(key)
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-s.sem
+			l.unref(key)
+		})
+	}, nil
+}
+
+func (l *Limiter) ref(key string) *slot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.slots[key]
+	if !ok {
+		s = &slot{sem: make(chan struct{}, l.limit)}
+		l.slots[key] = s
+	}
+	s.refs++
+	return s
+}
+
+func (l *Limiter) unref(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s, ok := l.slots[key]; ok {
+		s.refs--
+		if s.refs == 0 {
+			delete(l.slots, key)
+		}
+	}
+}
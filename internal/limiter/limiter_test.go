@@ -0,0 +1,144 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// runConcurrently runs n operations per key through the limiter, and returns
+// the maximum number of operations observed running at the same time for
+// each key, and the overall maximum. The operations must all acquire the
+// limiter before the deadline of the test context.
+func runConcurrently(t *testing.T, l *Limiter, keys []string, n int) (map[string]int32, int32) {
+	g := NewWithT(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		errs    = make(chan error, len(keys)*n)
+		mu      sync.Mutex
+		total   int32
+		maxAll  int32
+		running = make(map[string]*int32, len(keys))
+		maxKey  = make(map[string]int32, len(keys))
+	)
+	for _, key := range keys {
+		running[key] = new(int32)
+	}
+
+	for _, key := range keys {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+
+				release, err := l.Acquire(ctx, key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer release()
+
+				// Simulate the decryption of the resources of a Kustomization.
+				cur := atomic.AddInt32(running[key], 1)
+				all := atomic.AddInt32(&total, 1)
+				mu.Lock()
+				if cur > maxKey[key] {
+					maxKey[key] = cur
+				}
+				if all > maxAll {
+					maxAll = all
+				}
+				mu.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&total, -1)
+				atomic.AddInt32(running[key], -1)
+			}(key)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	return maxKey, maxAll
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	t.Run("serializes operations sharing a key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := New(1)
+		maxKey, _ := runConcurrently(t, l, []string{"GitRepository/flux-system/repo"}, 5)
+		g.Expect(maxKey["GitRepository/flux-system/repo"]).To(Equal(int32(1)))
+		g.Expect(l.slots).To(BeEmpty())
+	})
+
+	t.Run("bounds operations sharing a key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := New(2)
+		maxKey, _ := runConcurrently(t, l, []string{"GitRepository/flux-system/repo"}, 6)
+		g.Expect(maxKey["GitRepository/flux-system/repo"]).To(Equal(int32(2)))
+	})
+
+	t.Run("does not limit operations with different keys", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := New(1)
+		keys := []string{"GitRepository/flux-system/a", "GitRepository/flux-system/b"}
+		maxKey, maxAll := runConcurrently(t, l, keys, 3)
+		g.Expect(maxKey[keys[0]]).To(Equal(int32(1)))
+		g.Expect(maxKey[keys[1]]).To(Equal(int32(1)))
+		g.Expect(maxAll).To(Equal(int32(2)))
+	})
+
+	t.Run("does not limit operations when disabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := New(0)
+		maxKey, _ := runConcurrently(t, l, []string{"GitRepository/flux-system/repo"}, 3)
+		g.Expect(maxKey["GitRepository/flux-system/repo"]).To(Equal(int32(3)))
+	})
+
+	t.Run("returns when the context is done", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := New(1)
+		release, err := l.Acquire(context.Background(), "key")
+		g.Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = l.Acquire(ctx, "key")
+		g.Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		release()
+		release()
+		g.Expect(l.slots).To(BeEmpty())
+	})
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lru implements the size bounded map with least recently used
+// eviction shared by the caches of the controller.
+package lru
+
+import "container/list"
+
+// Cache maps keys to values, holding at most size entries. When an entry is
+// added to a full Cache, the least recently used entry is evicted. It is not
+// safe for concurrent use, the caches holding a Cache guard it with their own
+// lock, which lets them check and update their other state atomically with
+// it.
+type Cache[K comparable, V any] struct {
+	size    int
+	onEvict func(key K, value V)
+
+	// order holds the entries from the most to the least recently used.
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// New returns a new empty Cache holding at most size entries. A Cache with a
+// size lower than one holds no entries.
+func New[K comparable, V any](size int) *Cache[K, V] {
+	return NewWithEvict[K, V](size, nil)
+}
+
+// NewWithEvict returns a new empty Cache as New, which calls onEvict with the
+// entries it evicts, e.g. to release their resources. It is not called for
+// the entries which are replaced or removed.
+func NewWithEvict[K comparable, V any](size int, onEvict func(key K, value V)) *Cache[K, V] {
+	return &Cache[K, V]{
+		size:    size,
+		onEvict: onEvict,
+		order:   list.New(),
+		entries: make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value of the key, and marks it as the most recently used.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*entry[K, V]).value, true
+}
+
+// Peek returns the value of the key, without marking it as used.
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return e.Value.(*entry[K, V]).value, true
+}
+
+// Add sets the value of the key, and marks it as the most recently used. The
+// least recently used entry is evicted if the Cache is full.
+func (c *Cache[K, V]) Add(key K, value V) {
+	if c.size <= 0 {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*entry[K, V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		evicted := oldest.Value.(*entry[K, V])
+		delete(c.entries, evicted.key)
+		if c.onEvict != nil {
+			c.onEvict(evicted.key, evicted.value)
+		}
+	}
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value})
+}
+
+// Remove removes the entry of the key, and returns its value.
+func (c *Cache[K, V]) Remove(key K) (V, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.Remove(e)
+	delete(c.entries, key)
+	return e.Value.(*entry[K, V]).value, true
+}
+
+// Len returns the number of entries.
+func (c *Cache[K, V]) Len() int {
+	return c.order.Len()
+}
+
+// Keys returns the keys of the entries, from the most to the least recently
+// used.
+func (c *Cache[K, V]) Keys() []K {
+	keys := make([]K, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*entry[K, V]).key)
+	}
+	return keys
+}
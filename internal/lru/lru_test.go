@@ -0,0 +1,98 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestCache(t *testing.T) {
+	t.Run("evicts the least recently used entry", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := New[string, int](2)
+		c.Add("a", 1)
+		c.Add("b", 2)
+		v, ok := c.Get("a")
+		g.Expect(ok).To(BeTrue())
+		g.Expect(v).To(Equal(1))
+
+		c.Add("c", 3)
+		g.Expect(c.Len()).To(Equal(2))
+		g.Expect(c.Keys()).To(Equal([]string{"c", "a"}))
+		_, ok = c.Get("b")
+		g.Expect(ok).To(BeFalse())
+	})
+
+	t.Run("does not mark the peeked entries as used", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := New[string, int](2)
+		c.Add("a", 1)
+		c.Add("b", 2)
+		v, ok := c.Peek("a")
+		g.Expect(ok).To(BeTrue())
+		g.Expect(v).To(Equal(1))
+
+		c.Add("c", 3)
+		g.Expect(c.Keys()).To(Equal([]string{"c", "b"}))
+	})
+
+	t.Run("replaces the value of a key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		evicted := 0
+		c := NewWithEvict[string, int](2, func(string, int) { evicted++ })
+		c.Add("a", 1)
+		c.Add("b", 2)
+		c.Add("a", 3)
+		g.Expect(c.Len()).To(Equal(2))
+		g.Expect(c.Keys()).To(Equal([]string{"a", "b"}))
+		v, _ := c.Get("a")
+		g.Expect(v).To(Equal(3))
+		g.Expect(evicted).To(BeZero())
+	})
+
+	t.Run("calls onEvict with the evicted entries", func(t *testing.T) {
+		g := NewWithT(t)
+
+		evicted := map[string]int{}
+		c := NewWithEvict[string, int](1, func(k string, v int) { evicted[k] = v })
+		c.Add("a", 1)
+		c.Add("b", 2)
+		g.Expect(evicted).To(Equal(map[string]int{"a": 1}))
+
+		// Removed entries are not evicted.
+		v, ok := c.Remove("b")
+		g.Expect(ok).To(BeTrue())
+		g.Expect(v).To(Equal(2))
+		g.Expect(c.Len()).To(BeZero())
+		g.Expect(evicted).To(HaveLen(1))
+	})
+
+	t.Run("zero size cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := New[string, int](0)
+		c.Add("a", 1)
+		_, ok := c.Get("a")
+		g.Expect(ok).To(BeFalse())
+		g.Expect(c.Len()).To(BeZero())
+	})
+}
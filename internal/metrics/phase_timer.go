@@ -0,0 +1,124 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// FetchPhase is the phase in which the source artifact is downloaded
+	// and extracted.
+	FetchPhase = "fetch"
+	// BuildPhase is the phase in which the Kustomize overlay is generated
+	// and built.
+	BuildPhase = "build"
+	// DecryptPhase is the phase in which the decryption keys are imported
+	// and the SOPS encrypted files and resources are decrypted.
+	DecryptPhase = "decrypt"
+	// ApplyPhase is the phase in which the resources are validated and
+	// applied on the cluster.
+	ApplyPhase = "apply"
+	// PrunePhase is the phase in which stale resources are garbage
+	// collected.
+	PrunePhase = "prune"
+	// HealthCheckPhase is the phase in which the health of the applied
+	// resources is assessed.
+	HealthCheckPhase = "healthcheck"
+)
+
+// PhaseTimer measures the time spent in the phases of a reconciliation.
+//
+// Phases can be nested, in which case the time spent in the inner phase is
+// not accounted to the outer phase. For example, a DecryptPhase started while
+// the BuildPhase is running pauses the BuildPhase until it is stopped.
+// As a result, the sum of all phase durations equals the time during which
+// at least one phase was running.
+type PhaseTimer struct {
+	mu        sync.Mutex
+	durations map[string]time.Duration
+	running   []string
+	last      time.Time
+}
+
+// NewPhaseTimer returns a new PhaseTimer without any recorded phases.
+func NewPhaseTimer() *PhaseTimer {
+	return &PhaseTimer{
+		durations: make(map[string]time.Duration),
+	}
+}
+
+// Start starts measuring the given phase, pausing the currently running
+// phase (if any). It returns a function to stop the measurement, which can
+// safely be called multiple times.
+func (t *PhaseTimer) Start(phase string) (stop func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.elapse(time.Now())
+	t.running = append(t.running, phase)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.stop(phase) })
+	}
+}
+
+// Durations returns the accumulated duration per phase.
+func (t *PhaseTimer) Durations() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.elapse(time.Now())
+	result := make(map[string]time.Duration, len(t.durations))
+	for phase, d := range t.durations {
+		result[phase] = d
+	}
+	return result
+}
+
+// Total returns the sum of the accumulated durations of all phases.
+func (t *PhaseTimer) Total() time.Duration {
+	var total time.Duration
+	for _, d := range t.Durations() {
+		total += d
+	}
+	return total
+}
+
+func (t *PhaseTimer) stop(phase string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.elapse(time.Now())
+	for i := len(t.running) - 1; i >= 0; i-- {
+		if t.running[i] == phase {
+			t.running = append(t.running[:i], t.running[i+1:]...)
+			return
+		}
+	}
+}
+
+// elapse accounts the time passed since the last call to the innermost
+// running phase.
+func (t *PhaseTimer) elapse(now time.Time) {
+	if n := len(t.running); n > 0 {
+		t.durations[t.running[n-1]] += now.Sub(t.last)
+	}
+	t.last = now
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPhaseTimer_SumsToTotal(t *testing.T) {
+	g := NewWithT(t)
+
+	timer := NewPhaseTimer()
+	start := time.Now()
+
+	stop := timer.Start(FetchPhase)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	stopBuild := timer.Start(BuildPhase)
+	time.Sleep(10 * time.Millisecond)
+	stopDecrypt := timer.Start(DecryptPhase)
+	time.Sleep(20 * time.Millisecond)
+	stopDecrypt()
+	time.Sleep(10 * time.Millisecond)
+	stopBuild()
+
+	stop = timer.Start(ApplyPhase)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	stop = timer.Start(HealthCheckPhase)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	elapsed := time.Since(start)
+	durations := timer.Durations()
+
+	g.Expect(durations).To(HaveLen(5))
+	g.Expect(durations[FetchPhase]).To(BeNumerically(">=", 20*time.Millisecond))
+	g.Expect(durations[BuildPhase]).To(BeNumerically(">=", 20*time.Millisecond))
+	g.Expect(durations[BuildPhase]).To(BeNumerically("<", 40*time.Millisecond))
+	g.Expect(durations[DecryptPhase]).To(BeNumerically(">=", 20*time.Millisecond))
+
+	// The phases are back to back, so their sum must roughly equal the
+	// wall clock time.
+	g.Expect(timer.Total()).To(BeNumerically("<=", elapsed))
+	g.Expect(timer.Total()).To(BeNumerically("~", elapsed, 5*time.Millisecond))
+}
+
+func TestPhaseTimer_StopIsIdempotent(t *testing.T) {
+	g := NewWithT(t)
+
+	timer := NewPhaseTimer()
+	stop := timer.Start(ApplyPhase)
+	time.Sleep(5 * time.Millisecond)
+	stop()
+	d := timer.Durations()[ApplyPhase]
+
+	time.Sleep(5 * time.Millisecond)
+	stop()
+	g.Expect(timer.Durations()[ApplyPhase]).To(Equal(d))
+}
+
+func TestPhaseTimer_AccumulatesRepeatedPhases(t *testing.T) {
+	g := NewWithT(t)
+
+	timer := NewPhaseTimer()
+	for i := 0; i < 3; i++ {
+		stop := timer.Start(DecryptPhase)
+		time.Sleep(5 * time.Millisecond)
+		stop()
+	}
+	g.Expect(timer.Durations()[DecryptPhase]).To(BeNumerically(">=", 15*time.Millisecond))
+}
+
+func TestRecorder_RecordPhaseDuration(t *testing.T) {
+	g := NewWithT(t)
+
+	r := NewRecorder()
+	ref := corev1.ObjectReference{Kind: "Kustomization", Name: "app", Namespace: "default"}
+	r.RecordPhaseDuration(ref, FetchPhase, time.Second)
+	r.RecordPhaseDuration(ref, DecryptPhase, time.Second)
+
+	g.Expect(testutil.CollectAndCount(r.phaseDurationHistogram)).To(Equal(2))
+}
+
+func TestRecorder_RecordKeyExpiry(t *testing.T) {
+	g := NewWithT(t)
+
+	r := NewRecorder()
+	ref := corev1.ObjectReference{Kind: "Kustomization", Name: "app", Namespace: "default"}
+	other := corev1.ObjectReference{Kind: "Kustomization", Name: "other", Namespace: "default"}
+
+	r.RecordKeyExpiry(ref, 2*time.Hour)
+	r.RecordKeyExpiry(other, time.Hour)
+	g.Expect(testutil.CollectAndCount(r.keyExpiryGauge)).To(Equal(2))
+	g.Expect(testutil.ToFloat64(r.keyExpiryGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace))).To(Equal(7200.0))
+
+	r.RecordKeyExpiry(ref, time.Hour)
+	g.Expect(testutil.CollectAndCount(r.keyExpiryGauge)).To(Equal(2))
+	g.Expect(testutil.ToFloat64(r.keyExpiryGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace))).To(Equal(3600.0))
+
+	r.DeleteKeyExpiry(ref)
+	g.Expect(testutil.CollectAndCount(r.keyExpiryGauge)).To(Equal(1))
+}
+
+func TestRecorder_RecordKeyFailures(t *testing.T) {
+	g := NewWithT(t)
+
+	r := NewRecorder()
+	ref := corev1.ObjectReference{Kind: "Kustomization", Name: "app", Namespace: "default"}
+	other := corev1.ObjectReference{Kind: "Kustomization", Name: "other", Namespace: "default"}
+
+	r.RecordKeyFailures(ref, 2)
+	r.RecordKeyFailures(other, 1)
+	g.Expect(testutil.CollectAndCount(r.keyFailureGauge)).To(Equal(2))
+	g.Expect(testutil.ToFloat64(r.keyFailureGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace))).To(Equal(2.0))
+
+	// A recovery resets the failures.
+	r.RecordKeyFailures(ref, 0)
+	g.Expect(testutil.ToFloat64(r.keyFailureGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace))).To(Equal(0.0))
+
+	r.DeleteKeyFailures(ref)
+	g.Expect(testutil.CollectAndCount(r.keyFailureGauge)).To(Equal(1))
+}
+
+func TestRecorder_RecordDataKeyRotations(t *testing.T) {
+	g := NewWithT(t)
+
+	r := NewRecorder()
+	ref := corev1.ObjectReference{Kind: "Kustomization", Name: "app", Namespace: "default"}
+	other := corev1.ObjectReference{Kind: "Kustomization", Name: "other", Namespace: "default"}
+
+	r.RecordDataKeyRotations(ref, 2)
+	r.RecordDataKeyRotations(other, 1)
+	g.Expect(testutil.CollectAndCount(r.keyRotationGauge)).To(Equal(2))
+	g.Expect(testutil.ToFloat64(r.keyRotationGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace))).To(Equal(2.0))
+
+	r.RecordDataKeyRotations(ref, 0)
+	g.Expect(testutil.ToFloat64(r.keyRotationGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace))).To(Equal(0.0))
+
+	r.DeleteDataKeyRotations(ref)
+	g.Expect(testutil.CollectAndCount(r.keyRotationGauge)).To(Equal(1))
+}
+
+func TestRecorder_RecordAzureVaultBreakerTransition(t *testing.T) {
+	g := NewWithT(t)
+
+	r := NewRecorder()
+	r.RecordAzureVaultBreakerTransition("closed", "open")
+	r.RecordAzureVaultBreakerTransition("closed", "open")
+	g.Expect(testutil.ToFloat64(r.vaultBreakerGauge.WithLabelValues("open"))).To(Equal(2.0))
+
+	r.RecordAzureVaultBreakerTransition("open", "half-open")
+	g.Expect(testutil.ToFloat64(r.vaultBreakerGauge.WithLabelValues("open"))).To(Equal(1.0))
+	g.Expect(testutil.ToFloat64(r.vaultBreakerGauge.WithLabelValues("half-open"))).To(Equal(1.0))
+
+	r.RecordAzureVaultBreakerTransition("half-open", "closed")
+	g.Expect(testutil.ToFloat64(r.vaultBreakerGauge.WithLabelValues("half-open"))).To(Equal(0.0))
+	g.Expect(testutil.CollectAndCount(r.vaultBreakerGauge)).To(Equal(2), "closed breakers are not counted")
+}
+
+func TestRecorder_RecordDecryption(t *testing.T) {
+	g := NewWithT(t)
+
+	r := NewRecorder()
+	r.RecordDecryption("azure_kv", 100*time.Millisecond, nil)
+	r.RecordDecryption("azure_kv", time.Second, errors.New("forbidden"))
+	r.RecordDecryption("age", time.Millisecond, nil)
+
+	g.Expect(testutil.ToFloat64(r.decryptCounter.WithLabelValues("azure_kv", "success"))).To(Equal(1.0))
+	g.Expect(testutil.ToFloat64(r.decryptCounter.WithLabelValues("azure_kv", "failure"))).To(Equal(1.0))
+	g.Expect(testutil.ToFloat64(r.decryptCounter.WithLabelValues("age", "success"))).To(Equal(1.0))
+	g.Expect(testutil.CollectAndCount(r.decryptHistogram)).To(Equal(2))
+}
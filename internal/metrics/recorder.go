@@ -0,0 +1,196 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics contains the Prometheus metrics kustomize-controller
+// exposes in addition to the GitOps Toolkit runtime metrics.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	crtlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// closedBreakerState is the state of a closed circuit breaker of an Azure
+// Key Vault, which is not counted.
+const closedBreakerState = "closed"
+
+// Recorder records the kustomize-controller specific metrics.
+//
+// Use NewRecorder to initialise it with properly configured metric names.
+type Recorder struct {
+	phaseDurationHistogram *prometheus.HistogramVec
+	keyExpiryGauge         *prometheus.GaugeVec
+	keyFailureGauge        *prometheus.GaugeVec
+	keyRotationGauge       *prometheus.GaugeVec
+	vaultBreakerGauge      *prometheus.GaugeVec
+	decryptCounter         *prometheus.CounterVec
+	decryptHistogram       *prometheus.HistogramVec
+}
+
+// NewRecorder returns a new Recorder with all metric names configured.
+func NewRecorder() *Recorder {
+	return &Recorder{
+		phaseDurationHistogram: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "gotk_reconcile_phase_duration_seconds",
+				Help: "The duration in seconds of a phase of a GitOps Toolkit resource reconciliation.",
+				// Use a histogram with 10 count buckets between 10ms - 30min
+				Buckets: prometheus.ExponentialBucketsRange(10e-3, 1800, 10),
+			},
+			[]string{"kind", "name", "namespace", "phase"},
+		),
+		keyExpiryGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gotk_decryption_key_expiry_seconds",
+				Help: "The time in seconds until the earliest expiry of the keys used to decrypt the data of a GitOps Toolkit resource.",
+			},
+			[]string{"kind", "name", "namespace"},
+		),
+		keyFailureGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gotk_decryption_key_failures",
+				Help: "The highest number of consecutive reconciliations of a GitOps Toolkit resource in which the decryption with one of its keys failed.",
+			},
+			[]string{"kind", "name", "namespace"},
+		),
+		keyRotationGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gotk_decryption_data_key_rotations_required",
+				Help: "The number of keys of which the SOPS data key of a file of a GitOps Toolkit resource was encrypted longer ago than the rotation threshold.",
+			},
+			[]string{"kind", "name", "namespace"},
+		),
+		vaultBreakerGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gotk_azure_key_vault_breakers",
+				Help: "The number of Azure Key Vaults of which the circuit breaker of the decryption requests is open or half-open, by state.",
+			},
+			[]string{"state"},
+		),
+		decryptCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gotk_decryption_requests_total",
+				Help: "The number of requests to decrypt a SOPS data key with a key provider, by result.",
+			},
+			[]string{"provider", "result"},
+		),
+		decryptHistogram: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "gotk_decryption_request_duration_seconds",
+				Help: "The duration in seconds of the requests to decrypt a SOPS data key with a key provider.",
+				// Use a histogram with 12 count buckets between 1ms - 60s
+				Buckets: prometheus.ExponentialBucketsRange(1e-3, 60, 12),
+			},
+			[]string{"provider"},
+		),
+	}
+}
+
+// MustMakeRecorder returns a new Recorder with its collectors registered
+// in the controller-runtime metrics registry. It panics if the registration
+// fails.
+func MustMakeRecorder() *Recorder {
+	r := NewRecorder()
+	crtlmetrics.Registry.MustRegister(r.Collectors()...)
+	return r
+}
+
+// Collectors returns a slice of Prometheus collectors, which can be used to
+// register them in a metrics registry.
+func (r *Recorder) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		r.phaseDurationHistogram,
+		r.keyExpiryGauge,
+		r.keyFailureGauge,
+		r.keyRotationGauge,
+		r.vaultBreakerGauge,
+		r.decryptCounter,
+		r.decryptHistogram,
+	}
+}
+
+// RecordPhaseDuration records the duration spent in the given reconciliation
+// phase for the ref.
+func (r *Recorder) RecordPhaseDuration(ref corev1.ObjectReference, phase string, duration time.Duration) {
+	r.phaseDurationHistogram.WithLabelValues(ref.Kind, ref.Name, ref.Namespace, phase).Observe(duration.Seconds())
+}
+
+// RecordKeyExpiry records the time until the earliest expiry of the
+// decryption keys of the ref. The keys are not labeled, as their number is
+// not bounded; they are named by the DecryptionKeyExpiring condition.
+func (r *Recorder) RecordKeyExpiry(ref corev1.ObjectReference, d time.Duration) {
+	r.keyExpiryGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace).Set(d.Seconds())
+}
+
+// DeleteKeyExpiry deletes the recorded expiry of the decryption keys of the
+// ref.
+func (r *Recorder) DeleteKeyExpiry(ref corev1.ObjectReference) {
+	r.keyExpiryGauge.DeleteLabelValues(ref.Kind, ref.Name, ref.Namespace)
+}
+
+// RecordKeyFailures records the highest number of consecutive failures of
+// the decryption with the keys of the ref, of which zero resets the failures
+// once all the keys decrypt successfully. The keys are not labeled, as their
+// number is not bounded.
+func (r *Recorder) RecordKeyFailures(ref corev1.ObjectReference, failures int) {
+	r.keyFailureGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace).Set(float64(failures))
+}
+
+// DeleteKeyFailures deletes the recorded failures of the decryption keys of
+// the ref.
+func (r *Recorder) DeleteKeyFailures(ref corev1.ObjectReference) {
+	r.keyFailureGauge.DeleteLabelValues(ref.Kind, ref.Name, ref.Namespace)
+}
+
+// RecordDataKeyRotations records the number of decryption keys of the ref of
+// which the SOPS data key needs rotation. The keys are not labeled, as their
+// number is not bounded; they are named by the warning event.
+func (r *Recorder) RecordDataKeyRotations(ref corev1.ObjectReference, rotations int) {
+	r.keyRotationGauge.WithLabelValues(ref.Kind, ref.Name, ref.Namespace).Set(float64(rotations))
+}
+
+// DeleteDataKeyRotations deletes the recorded number of decryption keys of
+// the ref of which the SOPS data key needs rotation.
+func (r *Recorder) DeleteDataKeyRotations(ref corev1.ObjectReference) {
+	r.keyRotationGauge.DeleteLabelValues(ref.Kind, ref.Name, ref.Namespace)
+}
+
+// RecordAzureVaultBreakerTransition records the change of state of the
+// circuit breaker of an Azure Key Vault, e.g. from "closed" to "open". The
+// vaults are counted by state, and not recorded individually, as they are
+// configured by the tenants. The closed breakers are not counted.
+func (r *Recorder) RecordAzureVaultBreakerTransition(from, to string) {
+	if from != closedBreakerState {
+		r.vaultBreakerGauge.WithLabelValues(from).Dec()
+	}
+	if to != closedBreakerState {
+		r.vaultBreakerGauge.WithLabelValues(to).Inc()
+	}
+}
+
+// RecordDecryption records the result and duration of a request to decrypt a
+// SOPS data key with the given key provider, e.g. "azure_kv".
+func (r *Recorder) RecordDecryption(provider string, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	r.decryptCounter.WithLabelValues(provider, result).Inc()
+	r.decryptHistogram.WithLabelValues(provider).Observe(duration.Seconds())
+}
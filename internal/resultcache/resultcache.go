@@ -0,0 +1,116 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resultcache
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry is the result of the last successful full reconciliation of a
+// Kustomization.
+type Entry struct {
+	// Revision is the source revision which was applied.
+	Revision string
+	// ConfigDigest is the digest of the configuration the revision was
+	// built with, e.g. the spec of the Kustomization.
+	ConfigDigest string
+	// Objects are the versions of the applied objects by the ID of their
+	// inventory entry, as they were at the end of the reconciliation.
+	Objects map[string]string
+	// Time is when the reconciliation finished.
+	Time time.Time
+	// TTL is the duration for which the entry is reused instead of the TTL
+	// of the cache, if positive.
+	TTL time.Duration
+}
+
+// Cache holds the results of the last successful full reconciliations per
+// key, e.g. the namespaced name of a Kustomization, for up to a TTL.
+type Cache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]Entry
+	now     func() time.Time
+}
+
+// New returns an empty Cache of which the entries expire after the TTL.
+func New(ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		entries: make(map[string]Entry),
+		now:     time.Now,
+	}
+}
+
+// Get returns the entry of the key if it was recorded for the revision and
+// configuration digest, and has not expired. Any other entry of the key is
+// forgotten, so that the next result is recorded from a full reconciliation.
+func (c *Cache) Get(key, revision, configDigest string) (Entry, bool) {
+	if c == nil {
+		return Entry{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+	ttl := c.ttl
+	if e.TTL > 0 {
+		ttl = e.TTL
+	}
+	if e.Revision != revision || e.ConfigDigest != configDigest || c.now().Sub(e.Time) >= ttl {
+		delete(c.entries, key)
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// TTL returns the duration after which the entries expire, unless they have
+// a TTL of their own.
+func (c *Cache) TTL() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.ttl
+}
+
+// Set records the entry of the key, replacing any previous one. The entry
+// expires after its TTL, or the one of the cache, from its Time.
+func (c *Cache) Set(key string, e Entry) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+}
+
+// Delete forgets the entry of the key, e.g. once the reconciliation failed
+// or the object is deleted.
+func (c *Cache) Delete(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resultcache
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestCache_Get(t *testing.T) {
+	now := time.Now()
+	entry := Entry{
+		Revision:     "main@sha1:1234",
+		ConfigDigest: "digest",
+		Objects:      map[string]string{"default_app__ConfigMap": "1"},
+		Time:         now,
+	}
+
+	tests := []struct {
+		name         string
+		revision     string
+		configDigest string
+		elapsed      time.Duration
+		want         bool
+	}{
+		{
+			name:         "unchanged",
+			revision:     entry.Revision,
+			configDigest: entry.ConfigDigest,
+			elapsed:      time.Minute,
+			want:         true,
+		},
+		{
+			name:         "revision changed",
+			revision:     "main@sha1:5678",
+			configDigest: entry.ConfigDigest,
+		},
+		{
+			name:         "configuration changed",
+			revision:     entry.Revision,
+			configDigest: "other",
+		},
+		{
+			name:         "expired",
+			revision:     entry.Revision,
+			configDigest: entry.ConfigDigest,
+			elapsed:      10 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			c := New(10 * time.Minute)
+			c.now = func() time.Time { return now.Add(tt.elapsed) }
+			c.Set("default/app", entry)
+
+			got, ok := c.Get("default/app", tt.revision, tt.configDigest)
+			g.Expect(ok).To(Equal(tt.want))
+			if tt.want {
+				g.Expect(got).To(Equal(entry))
+				return
+			}
+			// A mismatched entry is forgotten.
+			_, ok = c.Get("default/app", entry.Revision, entry.ConfigDigest)
+			g.Expect(ok).To(BeFalse())
+		})
+	}
+}
+
+func TestCache_Get_entryTTL(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+	c := New(10 * time.Minute)
+	c.now = func() time.Time { return now.Add(15 * time.Minute) }
+	c.Set("default/app", Entry{Revision: "v1", Time: now, TTL: 20 * time.Minute})
+	c.Set("default/other", Entry{Revision: "v1", Time: now})
+
+	_, ok := c.Get("default/app", "v1", "")
+	g.Expect(ok).To(BeTrue(), "the TTL of the entry takes precedence")
+	_, ok = c.Get("default/other", "v1", "")
+	g.Expect(ok).To(BeFalse())
+	g.Expect(c.TTL()).To(Equal(10 * time.Minute))
+}
+
+func TestCache_Delete(t *testing.T) {
+	g := NewWithT(t)
+
+	c := New(time.Hour)
+	c.Set("default/app", Entry{Revision: "v1", Time: time.Now()})
+	c.Set("default/other", Entry{Revision: "v1", Time: time.Now()})
+
+	c.Delete("default/app")
+	_, ok := c.Get("default/app", "v1", "")
+	g.Expect(ok).To(BeFalse())
+	_, ok = c.Get("default/other", "v1", "")
+	g.Expect(ok).To(BeTrue())
+}
+
+func TestCache_Nil(t *testing.T) {
+	g := NewWithT(t)
+
+	var c *Cache
+	c.Set("default/app", Entry{Revision: "v1", Time: time.Now()})
+	_, ok := c.Get("default/app", "v1", "")
+	g.Expect(ok).To(BeFalse())
+	c.Delete("default/app")
+}
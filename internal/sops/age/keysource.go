@@ -9,6 +9,7 @@ package age
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -93,6 +94,30 @@ func (i *ParsedIdentities) Import(identity ...string) error {
 	return nil
 }
 
+// Identities contains a set of Bech32-encoded age identities, one per line,
+// as imported by ParsedIdentities.Import. Empty lines and lines starting with
+// "#" are ignored.
+type Identities string
+
+// Validate returns an error if the Identities contain no identity, or a line
+// which can't be parsed as an identity. The lines holding an age recipient
+// (public key) instead of an identity are reported as such, as are the
+// Windows line endings.
+func (i Identities) Validate() error {
+	for n, line := range strings.Split(string(i), "\n") {
+		switch {
+		case strings.HasSuffix(line, "\r"):
+			return fmt.Errorf("invalid age identities: line %d ends with a carriage return, Windows line endings are not supported", n+1)
+		case strings.HasPrefix(strings.TrimSpace(line), "age1"):
+			return fmt.Errorf("invalid age identities: line %d holds an age recipient (public key) instead of an identity (secret key)", n+1)
+		}
+	}
+	if _, err := parseIdentities(string(i)); err != nil {
+		return fmt.Errorf("invalid age identities: %w", err)
+	}
+	return nil
+}
+
 // ApplyToMasterKey configures the ParsedIdentities on the provided key.
 func (i ParsedIdentities) ApplyToMasterKey(key *MasterKey) {
 	key.parsedIdentities = i
@@ -150,6 +175,9 @@ func (key *MasterKey) SetEncryptedDataKey(enc []byte) {
 
 // Decrypt decrypts the EncryptedKey with the (parsed) Identities and returns
 // the result.
+// The identities are attempted in order until one of them succeeds. If none
+// of them match the recipients of the EncryptedKey, the returned error lists
+// the failure of each identity.
 func (key *MasterKey) Decrypt() ([]byte, error) {
 	if len(key.parsedIdentities) == 0 && len(key.Identities) > 0 {
 		parsedIdentities, err := parseIdentities(key.Identities...)
@@ -158,10 +186,39 @@ func (key *MasterKey) Decrypt() ([]byte, error) {
 		}
 		key.parsedIdentities = parsedIdentities
 	}
+	if len(key.parsedIdentities) == 0 {
+		return nil, fmt.Errorf("failed to create reader for decrypting sops data key with age: no identities specified")
+	}
 
-	src := bytes.NewReader([]byte(key.EncryptedKey))
-	ar := armor.NewReader(src)
-	r, err := age.Decrypt(ar, key.parsedIdentities...)
+	// The armor is decoded once, and the binary age file is then tried with
+	// each of the identities.
+	encrypted, err := io.ReadAll(armor.NewReader(bytes.NewReader([]byte(key.EncryptedKey))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reader for decrypting sops data key with age: %w", err)
+	}
+
+	var errs []string
+	for _, identity := range key.parsedIdentities {
+		b, err := decryptWithIdentity(encrypted, identity)
+		if err == nil {
+			return b, nil
+		}
+		// Only a mismatch is specific to the identity, any other error
+		// would equally apply to the remaining identities.
+		var noMatchErr *age.NoIdentityMatchError
+		if !errors.As(err, &noMatchErr) {
+			return nil, err
+		}
+		errs = append(errs, fmt.Sprintf("identity '%s': %s", identityToString(identity), noMatchErr.Error()))
+	}
+	return nil, fmt.Errorf("failed to decrypt sops data key with age, tried %d identities: [%s]",
+		len(errs), strings.Join(errs, ", "))
+}
+
+// decryptWithIdentity decrypts the dearmored age file with the given
+// identity.
+func decryptWithIdentity(encrypted []byte, identity age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(encrypted), identity)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create reader for decrypting sops data key with age: %w", err)
 	}
@@ -201,6 +258,15 @@ func parseRecipient(recipient string) (*age.X25519Recipient, error) {
 	return parsedRecipient, nil
 }
 
+// identityToString returns the public key of the identity if it is an
+// X25519 identity, or its type otherwise. It never returns the private key.
+func identityToString(identity age.Identity) string {
+	if i, ok := identity.(*age.X25519Identity); ok {
+		return i.Recipient().String()
+	}
+	return fmt.Sprintf("%T", identity)
+}
+
 // parseIdentities attempts to parse the string set of encoded age identities.
 // A single identity argument is allowed to be a multiline string containing
 // multiple identities. Empty lines and lines starting with "#" are ignored.
@@ -80,6 +80,56 @@ func TestParsedIdentities_Import(t *testing.T) {
 	g.Expect(i).To(HaveLen(2))
 }
 
+func TestIdentities_Validate(t *testing.T) {
+	tests := []struct {
+		name       string
+		identities Identities
+		wantErr    string
+	}{
+		{
+			name:       "single identity",
+			identities: Identities(mockIdentity),
+		},
+		{
+			name:       "multiple identities with comments",
+			identities: Identities("# created: 2023-01-01\n" + mockUnrelatedIdentity + "\n\n" + mockIdentity + "\n"),
+		},
+		{
+			name:       "no identity",
+			identities: Identities("# no identity\n"),
+			wantErr:    "invalid age identities: no secret keys found",
+		},
+		{
+			name:       "recipient",
+			identities: Identities("# public key\n" + mockRecipient + "\n"),
+			wantErr:    "invalid age identities: line 2 holds an age recipient (public key) instead of an identity (secret key)",
+		},
+		{
+			name:       "Windows line endings",
+			identities: Identities(mockUnrelatedIdentity + "\r\n" + mockIdentity + "\r\n"),
+			wantErr:    "invalid age identities: line 1 ends with a carriage return",
+		},
+		{
+			name:       "malformed identity",
+			identities: Identities(mockIdentity + "\ninvalid"),
+			wantErr:    "invalid age identities: error at line 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := tt.identities.Validate()
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
+
 func TestParsedIdentities_ApplyToMasterKey(t *testing.T) {
 	g := NewWithT(t)
 
@@ -289,6 +339,35 @@ func TestMasterKey_EncryptDecrypt_RoundTrip(t *testing.T) {
 	g.Expect(decryptedData).To(Equal(data))
 }
 
+func TestMasterKey_Decrypt_MultipleIdentities(t *testing.T) {
+	g := NewWithT(t)
+
+	// Only the second identity can decrypt mockEncryptedKey.
+	key, err := MasterKeyFromIdentities(mockUnrelatedIdentity + "\n" + mockIdentity)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(key.parsedIdentities).To(HaveLen(2))
+
+	key.EncryptedKey = mockEncryptedKey
+	data, err := key.Decrypt()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(data).To(Equal([]byte("data")))
+
+	t.Run("aggregates failures", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key, err := MasterKeyFromIdentities(mockUnrelatedIdentity, mockUnrelatedIdentity)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		key.EncryptedKey = mockEncryptedKey
+		data, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("tried 2 identities"))
+		g.Expect(err.Error()).To(ContainSubstring("identity 'age1"))
+		g.Expect(err.Error()).ToNot(ContainSubstring(mockUnrelatedIdentity))
+		g.Expect(data).To(BeNil())
+	})
+}
+
 func TestMasterKey_ToString(t *testing.T) {
 	g := NewWithT(t)
 
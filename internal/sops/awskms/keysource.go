@@ -24,6 +24,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"sigs.k8s.io/yaml"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
 )
 
 const (
@@ -67,6 +69,9 @@ type MasterKey struct {
 	// injected using e.g. an environment variable. The field is not publicly
 	// exposed, nor configurable.
 	epResolver aws.EndpointResolverWithOptions
+	// clients holds the client of the credentialsProvider. When nil, a
+	// client is constructed for every request.
+	clients *clientcache.Scope
 }
 
 // CredsProvider is a wrapper around aws.CredentialsProvider used for authenticating
@@ -87,6 +92,32 @@ func (c CredsProvider) ApplyToMasterKey(key *MasterKey) {
 	key.credentialsProvider = c.credsProvider
 }
 
+// Validate returns an error if the CredsProvider has no credentials provider,
+// or static credentials without an access key ID or secret access key.
+func (c CredsProvider) Validate() error {
+	switch p := c.credsProvider.(type) {
+	case nil:
+		return fmt.Errorf("invalid AWS credentials: no credentials provider")
+	case credentials.StaticCredentialsProvider:
+		if p.Value.AccessKeyID == "" || p.Value.SecretAccessKey == "" {
+			return fmt.Errorf("invalid AWS credentials: '%s' and '%s' are required", "aws_access_key_id", "aws_secret_access_key")
+		}
+	}
+	return nil
+}
+
+// ClientScope is the clientcache.Scope of the decryption Secret of the
+// credentials of a MasterKey, which holds the AWS KMS client of the keys
+// instead of loading the AWS config for every request.
+type ClientScope struct {
+	Scope *clientcache.Scope
+}
+
+// ApplyToMasterKey configures the ClientScope on the provided key.
+func (c ClientScope) ApplyToMasterKey(key *MasterKey) {
+	key.clients = c.Scope
+}
+
 // LoadCredsProviderFromYaml parses the given YAML returns a CredsProvider object
 // which contains the credentials provider used for authenticating towards AWS KMS.
 func LoadCredsProviderFromYaml(b []byte) (*CredsProvider, error) {
@@ -117,11 +148,10 @@ func (key *MasterKey) SetEncryptedDataKey(enc []byte) {
 // Encrypt takes a SOPS data key, encrypts it with KMS and stores the result
 // in the EncryptedKey field.
 func (key *MasterKey) Encrypt(dataKey []byte) error {
-	cfg, err := key.createKMSConfig()
+	client, err := key.kmsClient()
 	if err != nil {
 		return err
 	}
-	client := kms.NewFromConfig(*cfg)
 	input := &kms.EncryptInput{
 		KeyId:             &key.Arn,
 		Plaintext:         dataKey,
@@ -150,11 +180,10 @@ func (key *MasterKey) Decrypt() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error base64-decoding encrypted data key: %s", err)
 	}
-	cfg, err := key.createKMSConfig()
+	client, err := key.kmsClient()
 	if err != nil {
 		return nil, err
 	}
-	client := kms.NewFromConfig(*cfg)
 	input := &kms.DecryptInput{
 		KeyId:             &key.Arn,
 		CiphertextBlob:    k,
@@ -225,14 +254,52 @@ func NewMasterKeyFromArn(arn string, context map[string]string, awsProfile strin
 	return k
 }
 
-// createKMSConfig returns a Config configured with the appropriate credentials.
-func (key MasterKey) createKMSConfig() (*aws.Config, error) {
+// kmsClient returns the AWS KMS client held by the clients Scope of the key,
+// or a new client configured by createKMSConfig. The client of a key which
+// assumes a Role is not held, as the credentials of the role expire.
+func (key MasterKey) kmsClient() (*kms.Client, error) {
+	if key.clients == nil || key.Role != "" {
+		cfg, err := key.createKMSConfig()
+		if err != nil {
+			return nil, err
+		}
+		return kms.NewFromConfig(*cfg), nil
+	}
+	region, err := key.region()
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := fmt.Sprintf("awskms\x00%s\x00%s\x00%t", region, key.AwsProfile, key.credentialsProvider != nil)
+	c, _, err := key.clients.Client(cacheKey, func() (interface{}, error) {
+		cfg, err := key.createKMSConfig()
+		if err != nil {
+			return nil, err
+		}
+		return kms.NewFromConfig(*cfg), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.(*kms.Client), nil
+}
+
+// region returns the region of the Arn, or an error if it is not a valid
+// AWS KMS key ARN.
+func (key MasterKey) region() (string, error) {
 	re := regexp.MustCompile(arnRegex)
 	matches := re.FindStringSubmatch(key.Arn)
 	if matches == nil {
-		return nil, fmt.Errorf("no valid ARN found in '%s'", key.Arn)
+		return "", fmt.Errorf("no valid ARN found in '%s'", key.Arn)
+	}
+	return matches[1], nil
+}
+
+// createKMSConfig returns a Config configured with the appropriate credentials.
+func (key MasterKey) createKMSConfig() (*aws.Config, error) {
+	region, err := key.region()
+	if err != nil {
+		return nil, err
 	}
-	region := matches[1]
 	cfg, err := config.LoadDefaultConfig(context.TODO(), func(lo *config.LoadOptions) error {
 		// Use the credentialsProvider if present, otherwise default to reading credentials
 		// from the environment.
@@ -9,11 +9,16 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 package awskms
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	logger "log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,6 +31,8 @@ import (
 	kmsv1 "github.com/aws/aws-sdk-go/service/kms"
 	. "github.com/onsi/gomega"
 	"github.com/ory/dockertest/v3"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
 )
 
 var (
@@ -301,6 +308,21 @@ aws_session_token: test-token
 	g.Expect(creds.SessionToken).To(Equal("test-token"))
 }
 
+func TestCredsProvider_Validate(t *testing.T) {
+	g := NewWithT(t)
+
+	valid, err := LoadCredsProviderFromYaml([]byte("aws_access_key_id: test-id\naws_secret_access_key: test-secret\n"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(valid.Validate()).To(Succeed())
+
+	missing, err := LoadCredsProviderFromYaml([]byte("aws_access_key_id: test-id\n"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(missing.Validate()).To(MatchError("invalid AWS credentials: 'aws_access_key_id' and 'aws_secret_access_key' are required"))
+
+	g.Expect(CredsProvider{}.Validate()).To(MatchError("invalid AWS credentials: no credentials provider"))
+	g.Expect(NewCredsProvider(&countingCredsProvider{}).Validate()).To(Succeed())
+}
+
 func Test_createKMSConfig(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -404,3 +426,267 @@ func createTestKMSClient(key MasterKey) (*kms.Client, error) {
 
 	return kms.NewFromConfig(*cfg), nil
 }
+
+func TestMasterKey_EncryptDecrypt_MockKMS(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, serverURL string, key *MasterKey)
+		wantAccess string
+	}{
+		{
+			name: "static credentials",
+			setup: func(t *testing.T, _ string, key *MasterKey) {
+				creds, err := LoadCredsProviderFromYaml([]byte(`
+aws_access_key_id: static-id
+aws_secret_access_key: static-secret
+`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				creds.ApplyToMasterKey(key)
+			},
+			wantAccess: "static-id",
+		},
+		{
+			name: "web identity",
+			setup: func(t *testing.T, _ string, _ *MasterKey) {
+				tokenFile := t.TempDir() + "/token"
+				if err := os.WriteFile(tokenFile, []byte("web-identity-token"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::107501996527:role/sops")
+				t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+			},
+			wantAccess: "web-identity-id",
+		},
+		{
+			name: "instance profile",
+			setup: func(t *testing.T, serverURL string, _ *MasterKey) {
+				t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", serverURL)
+			},
+			wantAccess: "instance-profile-id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			// Isolate the test from any AWS configuration in the environment.
+			emptyDir := t.TempDir()
+			for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+				"AWS_PROFILE", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_EC2_METADATA_SERVICE_ENDPOINT"} {
+				t.Setenv(env, "")
+			}
+			t.Setenv("AWS_CONFIG_FILE", emptyDir+"/config")
+			t.Setenv("AWS_SHARED_CREDENTIALS_FILE", emptyDir+"/credentials")
+
+			server := newMockAWSServer()
+			t.Cleanup(server.Close)
+
+			key := NewMasterKeyFromArn(dummyARN, map[string]string{"env": "test"}, "")
+			key.epResolver = staticEPResolver{url: server.URL}
+			tt.setup(t, server.URL, key)
+
+			dataKey := []byte("thisistheway")
+			g.Expect(key.Encrypt(dataKey)).To(Succeed())
+			g.Expect(key.EncryptedKey).ToNot(BeEmpty())
+			g.Expect(server.accessKeyID).To(Equal(tt.wantAccess))
+
+			decryptKey := NewMasterKeyFromArn(dummyARN, map[string]string{"env": "test"}, "")
+			decryptKey.epResolver = key.epResolver
+			decryptKey.credentialsProvider = key.credentialsProvider
+			decryptKey.EncryptedKey = key.EncryptedKey
+
+			got, err := decryptKey.Decrypt()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(dataKey))
+			g.Expect(server.accessKeyID).To(Equal(tt.wantAccess))
+		})
+	}
+}
+
+func TestMasterKey_Decrypt_MockKMS_Error(t *testing.T) {
+	g := NewWithT(t)
+
+	server := newMockAWSServer()
+	t.Cleanup(server.Close)
+
+	key := createTestMasterKey(dummyARN)
+	key.epResolver = staticEPResolver{url: server.URL}
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("not-encrypted-by-mock"))
+
+	_, err := key.Decrypt()
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with AWS KMS"))
+	g.Expect(err.Error()).To(ContainSubstring("InvalidCiphertextException"))
+}
+
+func TestMasterKey_EncryptDecrypt_ClientScope(t *testing.T) {
+	newKey := func(server *mockAWSServer, creds aws.CredentialsProvider, scope *clientcache.Scope) *MasterKey {
+		key := NewMasterKeyFromArn(dummyARN, map[string]string{"env": "test"}, "")
+		key.epResolver = staticEPResolver{url: server.URL}
+		NewCredsProvider(creds).ApplyToMasterKey(key)
+		ClientScope{Scope: scope}.ApplyToMasterKey(key)
+		return key
+	}
+
+	t.Run("reuses the client of the scope", func(t *testing.T) {
+		g := NewWithT(t)
+
+		server := newMockAWSServer()
+		t.Cleanup(server.Close)
+		creds := &countingCredsProvider{}
+		scope := clientcache.New(1).Acquire("default", "sops-keys", "1")
+		t.Cleanup(scope.Release)
+
+		dataKey := []byte("thisistheway")
+		key := newKey(server, creds, scope)
+		g.Expect(key.Encrypt(dataKey)).To(Succeed())
+
+		decryptKey := newKey(server, creds, scope)
+		decryptKey.EncryptedKey = key.EncryptedKey
+		got, err := decryptKey.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal(dataKey))
+
+		// The credentials are retrieved once by the cached client.
+		g.Expect(creds.retrievals).To(Equal(1))
+		g.Expect(server.accessKeyID).To(Equal("counting-id"))
+	})
+
+	t.Run("does not share the client across scopes", func(t *testing.T) {
+		g := NewWithT(t)
+
+		server := newMockAWSServer()
+		t.Cleanup(server.Close)
+		creds := &countingCredsProvider{}
+		cache := clientcache.New(2)
+		for _, name := range []string{"tenant-a", "tenant-b"} {
+			scope := cache.Acquire("default", name, "1")
+			g.Expect(newKey(server, creds, scope).Encrypt([]byte("thisistheway"))).To(Succeed())
+			scope.Release()
+		}
+		g.Expect(creds.retrievals).To(Equal(2))
+	})
+}
+
+// countingCredsProvider is an aws.CredentialsProvider which counts the
+// retrievals of its static credentials.
+type countingCredsProvider struct {
+	retrievals int
+}
+
+func (c *countingCredsProvider) Retrieve(_ context.Context) (aws.Credentials, error) {
+	c.retrievals++
+	return aws.Credentials{AccessKeyID: "counting-id", SecretAccessKey: "counting-secret"}, nil
+}
+
+// staticEPResolver is a resolver that points all AWS services to the given URL.
+type staticEPResolver struct {
+	url string
+}
+
+func (e staticEPResolver) ResolveEndpoint(service, region string, options ...interface{}) (aws.Endpoint, error) {
+	return aws.Endpoint{
+		URL: e.url,
+	}, nil
+}
+
+// mockAWSServer mocks the AWS KMS Encrypt and Decrypt, the AWS STS
+// AssumeRoleWithWebIdentity and the EC2 instance metadata credential APIs.
+// The access key ID used to sign the last KMS request is recorded in
+// accessKeyID.
+type mockAWSServer struct {
+	*httptest.Server
+	accessKeyID string
+}
+
+const mockCiphertextPrefix = "mock-kms:"
+
+func newMockAWSServer() *mockAWSServer {
+	s := &mockAWSServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("imds-token"))
+	})
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/security-credentials/") {
+			_, _ = w.Write([]byte("sops"))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"Code":            "Success",
+			"Type":            "AWS-HMAC",
+			"AccessKeyId":     "instance-profile-id",
+			"SecretAccessKey": "instance-profile-secret",
+			"Token":           "instance-profile-token",
+			"Expiration":      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"LastUpdated":     time.Now().UTC().Format(time.RFC3339),
+		})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			s.recordAccessKeyID(r)
+			var in struct{ Plaintext []byte }
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"KeyId":          dummyARN,
+				"CiphertextBlob": append([]byte(mockCiphertextPrefix), in.Plaintext...),
+			})
+		case "TrentService.Decrypt":
+			s.recordAccessKeyID(r)
+			var in struct{ CiphertextBlob []byte }
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			if !bytes.HasPrefix(in.CiphertextBlob, []byte(mockCiphertextPrefix)) {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{
+					"__type":  "InvalidCiphertextException",
+					"message": "invalid ciphertext",
+				})
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"KeyId":     dummyARN,
+				"Plaintext": bytes.TrimPrefix(in.CiphertextBlob, []byte(mockCiphertextPrefix)),
+			})
+		default:
+			// AWS STS uses the query protocol.
+			if err := r.ParseForm(); err != nil || r.Form.Get("Action") != "AssumeRoleWithWebIdentity" {
+				http.Error(w, "unsupported request", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "text/xml")
+			_, _ = fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>web-identity-id</AccessKeyId>
+      <SecretAccessKey>web-identity-secret</SecretAccessKey>
+      <SessionToken>web-identity-token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// recordAccessKeyID records the access key ID from the credential scope of the
+// AWS Signature Version 4 Authorization header of the request.
+func (s *mockAWSServer) recordAccessKeyID(r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if i := strings.Index(auth, "Credential="); i >= 0 {
+		s.accessKeyID = strings.SplitN(auth[i+len("Credential="):], "/", 2)[0]
+	}
+}
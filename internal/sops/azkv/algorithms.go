@@ -0,0 +1,115 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+)
+
+// AllowedAlgorithms is the allowlist of the Azure Key Vault encryption
+// algorithms a MasterKey encrypts and decrypts the data key with, e.g. to
+// only permit the algorithms approved by a compliance regime. When empty,
+// all the algorithms supported by Azure Key Vault are allowed.
+type AllowedAlgorithms []string
+
+// ParseAllowedAlgorithms returns the AllowedAlgorithms of the given
+// algorithm names, which are matched case-insensitively. It returns an error
+// if any of the names is not an algorithm supported by Azure Key Vault.
+func ParseAllowedAlgorithms(names []string) (AllowedAlgorithms, error) {
+	var allowed AllowedAlgorithms
+	for _, name := range names {
+		a, ok := lookupAlgorithm(name)
+		if !ok {
+			return nil, fmt.Errorf("unsupported Azure Key Vault encryption algorithm '%s'", name)
+		}
+		allowed = append(allowed, string(a))
+	}
+	return allowed, nil
+}
+
+// ApplyToMasterKey configures the AllowedAlgorithms on the provided key.
+func (a AllowedAlgorithms) ApplyToMasterKey(key *MasterKey) {
+	key.allowedAlgorithms = a
+}
+
+// allows returns whether the algorithm is allowed.
+func (a AllowedAlgorithms) allows(algorithm azkeys.JSONWebKeyEncryptionAlgorithm) bool {
+	if len(a) == 0 {
+		return true
+	}
+	for _, allowed := range a {
+		if allowed == string(algorithm) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultAlgorithm is the Azure Key Vault encryption algorithm a MasterKey
+// decrypts the data key with when its Algorithm is empty, e.g. to decrypt
+// the data keys of legacy files encrypted with RSA-OAEP or RSA1_5 which do
+// not record the algorithm in their SOPS metadata. When empty, the data key
+// is decrypted with RSA-OAEP-256.
+type DefaultAlgorithm string
+
+// ParseDefaultAlgorithm returns the DefaultAlgorithm of the given algorithm
+// name, which is matched case-insensitively. It returns an error if the name
+// is not an algorithm supported by Azure Key Vault, or if it is not in the
+// given AllowedAlgorithms. An empty name returns an empty DefaultAlgorithm.
+func ParseDefaultAlgorithm(name string, allowed AllowedAlgorithms) (DefaultAlgorithm, error) {
+	if name == "" {
+		return "", nil
+	}
+	a, ok := lookupAlgorithm(name)
+	if !ok {
+		return "", fmt.Errorf("unsupported Azure Key Vault encryption algorithm '%s'", name)
+	}
+	if !allowed.allows(a) {
+		return "", fmt.Errorf("Azure Key Vault encryption algorithm '%s' is not allowed by the policy: expected one of '%s'",
+			a, strings.Join(allowed, "', '"))
+	}
+	return DefaultAlgorithm(a), nil
+}
+
+// ApplyToMasterKey configures the DefaultAlgorithm on the provided key,
+// unless the key specifies an Algorithm.
+func (a DefaultAlgorithm) ApplyToMasterKey(key *MasterKey) {
+	if key.Algorithm == "" {
+		key.Algorithm = string(a)
+	}
+}
+
+// AlgorithmNotAllowedError is returned when the algorithm the data key of a
+// MasterKey is encrypted with is not in its AllowedAlgorithms.
+type AlgorithmNotAllowedError struct {
+	// Algorithm is the algorithm of the key.
+	Algorithm string
+	// KeyID is the ID of the key, as returned by MasterKey.ToString.
+	KeyID string
+	// Allowed are the allowed algorithms.
+	Allowed AllowedAlgorithms
+}
+
+// Error returns the error message, with the allowed algorithms.
+func (e *AlgorithmNotAllowedError) Error() string {
+	return fmt.Sprintf("Azure Key Vault encryption algorithm '%s' of key '%s' is not allowed by the policy: expected one of '%s'",
+		e.Algorithm, e.KeyID, strings.Join(e.Allowed, "', '"))
+}
+
+// lookupAlgorithm returns the algorithm supported by Azure Key Vault with the
+// given name, matched case-insensitively.
+func lookupAlgorithm(name string) (azkeys.JSONWebKeyEncryptionAlgorithm, bool) {
+	for _, a := range azkeys.PossibleJSONWebKeyEncryptionAlgorithmValues() {
+		if strings.EqualFold(string(a), name) {
+			return a, true
+		}
+	}
+	return "", false
+}
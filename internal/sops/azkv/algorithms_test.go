@@ -0,0 +1,182 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseAllowedAlgorithms(t *testing.T) {
+	g := NewWithT(t)
+
+	allowed, err := ParseAllowedAlgorithms([]string{"rsa-oaep-256", "RSA-OAEP"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(allowed).To(Equal(AllowedAlgorithms{"RSA-OAEP-256", "RSA-OAEP"}))
+
+	allowed, err = ParseAllowedAlgorithms(nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(allowed).To(BeEmpty())
+
+	_, err = ParseAllowedAlgorithms([]string{"RSA-OAEP-256", "ROT13"})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(Equal("unsupported Azure Key Vault encryption algorithm 'ROT13'"))
+}
+
+func TestAllowedAlgorithms_ApplyToMasterKey(t *testing.T) {
+	newKey := func(c *fakeCryptoClient, algorithm string, allowed AllowedAlgorithms) *MasterKey {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		key.Algorithm = algorithm
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		allowed.ApplyToMasterKey(key)
+		return key
+	}
+
+	t.Run("rejects a disallowed algorithm before any request", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, "", AllowedAlgorithms{"RSA-OAEP"})
+
+		err := key.Encrypt([]byte("data-key"))
+		g.Expect(err).To(HaveOccurred())
+		var notAllowedErr *AlgorithmNotAllowedError
+		g.Expect(errors.As(err, &notAllowedErr)).To(BeTrue())
+		g.Expect(notAllowedErr.Algorithm).To(Equal("RSA-OAEP-256"))
+		g.Expect(err.Error()).To(Equal("Azure Key Vault encryption algorithm 'RSA-OAEP-256' of key " +
+			"'https://invalid.vault.azure.net/keys/key-name/v1' is not allowed by the policy: expected one of 'RSA-OAEP'"))
+
+		key.EncryptedKey = "encrypted"
+		_, err = key.Decrypt()
+		g.Expect(errors.As(err, &notAllowedErr)).To(BeTrue())
+		g.Expect(c.encrypts).To(BeZero())
+		g.Expect(c.decrypts).To(BeZero())
+	})
+
+	t.Run("proceeds with an allowed algorithm", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, "RSA-OAEP", AllowedAlgorithms{"RSA-OAEP-256", "RSA-OAEP"})
+
+		dataKey := []byte("data-key")
+		g.Expect(key.Encrypt(dataKey)).To(Succeed())
+		got, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal(dataKey))
+		g.Expect(c.encrypts).To(Equal(1))
+		g.Expect(c.decrypts).To(Equal(1))
+	})
+
+	t.Run("allows all algorithms without allowlist", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, "", nil)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		g.Expect(c.encrypts).To(Equal(1))
+	})
+
+	t.Run("rejects the cached data keys of a disallowed algorithm", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		cache := NewDataKeyCache(10)
+		key := newKey(c, "", nil)
+		token := NewToken(fakeTokenCredential{})
+		token.id = "identity"
+		token.ApplyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		cache.ApplyToMasterKey(key)
+		_, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		_, err = key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c.decrypts).To(Equal(1))
+
+		AllowedAlgorithms{"RSA-OAEP"}.ApplyToMasterKey(key)
+		_, err = key.Decrypt()
+		var notAllowedErr *AlgorithmNotAllowedError
+		g.Expect(errors.As(err, &notAllowedErr)).To(BeTrue())
+	})
+}
+
+func TestParseDefaultAlgorithm(t *testing.T) {
+	g := NewWithT(t)
+
+	algorithm, err := ParseDefaultAlgorithm("rsa-oaep", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(algorithm).To(Equal(DefaultAlgorithm("RSA-OAEP")))
+
+	algorithm, err = ParseDefaultAlgorithm("", AllowedAlgorithms{"RSA-OAEP"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(algorithm).To(BeEmpty())
+
+	algorithm, err = ParseDefaultAlgorithm("RSA1_5", AllowedAlgorithms{"RSA-OAEP", "RSA1_5"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(algorithm).To(Equal(DefaultAlgorithm("RSA1_5")))
+
+	_, err = ParseDefaultAlgorithm("ROT13", nil)
+	g.Expect(err).To(MatchError("unsupported Azure Key Vault encryption algorithm 'ROT13'"))
+
+	_, err = ParseDefaultAlgorithm("RSA1_5", AllowedAlgorithms{"RSA-OAEP-256", "RSA-OAEP"})
+	g.Expect(err).To(MatchError("Azure Key Vault encryption algorithm 'RSA1_5' is not allowed by the policy: " +
+		"expected one of 'RSA-OAEP-256', 'RSA-OAEP'"))
+}
+
+func TestDefaultAlgorithm_ApplyToMasterKey(t *testing.T) {
+	// The data key is encrypted with RSA-OAEP by a legacy tool which does
+	// not record the algorithm in the SOPS metadata.
+	c := newFakeCryptoClient()
+	legacy := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+	legacy.Algorithm = "RSA-OAEP"
+	NewToken(fakeTokenCredential{}).ApplyToMasterKey(legacy)
+	c.applyToMasterKey(legacy)
+	dataKey := []byte("data-key")
+	NewWithT(t).Expect(legacy.Encrypt(dataKey)).To(Succeed())
+
+	newKey := func(algorithm string, defaultAlgorithm DefaultAlgorithm) *MasterKey {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		key.EncryptedKey = legacy.EncryptedKey
+		key.Algorithm = algorithm
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		defaultAlgorithm.ApplyToMasterKey(key)
+		return key
+	}
+
+	t.Run("decrypts with the default algorithm", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey("", "RSA-OAEP")
+		g.Expect(key.Algorithm).To(Equal("RSA-OAEP"))
+		got, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal(dataKey))
+	})
+
+	t.Run("does not override the algorithm of the key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey("RSA-OAEP-256", "RSA-OAEP")
+		g.Expect(key.Algorithm).To(Equal("RSA-OAEP-256"))
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("decrypts with RSA-OAEP-256 without default", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey("", "")
+		g.Expect(key.Algorithm).To(BeEmpty())
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+	})
+}
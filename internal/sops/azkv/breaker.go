@@ -0,0 +1,211 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// BreakerState is the state of the circuit breaker of a vault.
+type BreakerState int
+
+const (
+	// BreakerClosed lets the requests to the vault through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails the requests to the vault without sending them,
+	// until the cooldown since the last failure elapsed.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe request to the vault through,
+	// of which the result closes or opens the breaker again.
+	BreakerHalfOpen
+)
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
+// VaultUnavailableError is returned for the requests to a vault which are
+// not sent because its circuit breaker is open.
+type VaultUnavailableError struct {
+	// VaultURL is the URL of the vault of the request.
+	VaultURL string
+	// Failures is the number of consecutive failures of the vault.
+	Failures int
+	// RetryAfter is the remaining time until the next probe request, or
+	// zero if a probe request is in progress.
+	RetryAfter time.Duration
+}
+
+// Error returns the error message.
+func (e *VaultUnavailableError) Error() string {
+	msg := fmt.Sprintf("Azure Key Vault '%s' is unavailable after %d consecutive failures", e.VaultURL, e.Failures)
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s, next attempt in %s", msg, e.RetryAfter.Round(time.Second))
+	}
+	return msg + ", waiting for the result of a probe request"
+}
+
+// VaultBreaker fails the Decrypt requests to an Azure Key Vault fast after
+// a number of consecutive failures of the vault, for a cooldown during which
+// the requests are not sent. Once the cooldown elapsed, a single request
+// is let through to probe the vault, which closes the breaker on success or
+// opens it for another cooldown on failure. The failures are counted per
+// vault URL, and only the failures which indicate the vault is unavailable
+// are counted: server errors, throttling and network errors. It is safe for
+// concurrent use, and is meant to be shared by all the MasterKeys of the
+// process.
+type VaultBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	observer  func(vaultURL string, from, to BreakerState)
+
+	mu       sync.Mutex
+	circuits map[string]*vaultCircuit
+}
+
+type vaultCircuit struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+// NewVaultBreaker returns a new VaultBreaker which opens after the given
+// number of consecutive failures of a vault, for the given cooldown.
+// A threshold lower than one disables the breaker.
+func NewVaultBreaker(threshold int, cooldown time.Duration) *VaultBreaker {
+	return &VaultBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		circuits:  make(map[string]*vaultCircuit),
+	}
+}
+
+// SetStateObserver configures the function called with the normalized URL
+// of a vault and the previous and new state of its breaker on every change
+// of state, e.g. to record it as a metric. It is called with the lock of the
+// VaultBreaker held, and must therefore not call the VaultBreaker itself.
+// It must be set before the VaultBreaker is used.
+func (b *VaultBreaker) SetStateObserver(fn func(vaultURL string, from, to BreakerState)) {
+	b.observer = fn
+}
+
+// ApplyToMasterKey configures the VaultBreaker on the provided key.
+func (b *VaultBreaker) ApplyToMasterKey(key *MasterKey) {
+	key.breaker = b
+}
+
+// State returns the state of the breaker of the vault at the given URL.
+func (b *VaultBreaker) State(vaultURL string) BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.circuits[vaultID(vaultURL)]; ok {
+		return c.state
+	}
+	return BreakerClosed
+}
+
+// Allow returns whether a request to the vault at the given URL may be sent,
+// with the function recording its result which must be called once the
+// request is done. It returns a VaultUnavailableError if the breaker of the
+// vault is open, or if it is half-open and a probe request is in progress.
+// A nil VaultBreaker allows all the requests.
+func (b *VaultBreaker) Allow(vaultURL string) (func(err error), error) {
+	if b == nil || b.threshold < 1 {
+		return func(error) {}, nil
+	}
+
+	id := vaultID(vaultURL)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[id]
+	if !ok {
+		c = &vaultCircuit{}
+		b.circuits[id] = c
+	}
+	switch c.state {
+	case BreakerOpen:
+		if wait := c.openedAt.Add(b.cooldown).Sub(b.now()); wait > 0 {
+			return nil, &VaultUnavailableError{VaultURL: vaultURL, Failures: c.failures, RetryAfter: wait}
+		}
+		b.setState(id, c, BreakerHalfOpen)
+		var once sync.Once
+		return func(err error) {
+			once.Do(func() { b.record(id, err, true) })
+		}, nil
+	case BreakerHalfOpen:
+		return nil, &VaultUnavailableError{VaultURL: vaultURL, Failures: c.failures}
+	}
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { b.record(id, err, false) })
+	}, nil
+}
+
+// record records the result of a request to the vault, which opens the
+// breaker if it is a failure of the probe request or the threshold of
+// consecutive failures is reached, and closes it otherwise.
+func (b *VaultBreaker) record(id string, err error, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[id]
+	if !isVaultFailure(err) {
+		c.failures = 0
+		b.setState(id, c, BreakerClosed)
+		return
+	}
+	c.failures++
+	if probe || c.failures >= b.threshold {
+		c.openedAt = b.now()
+		b.setState(id, c, BreakerOpen)
+	}
+}
+
+func (b *VaultBreaker) setState(id string, c *vaultCircuit, state BreakerState) {
+	if c.state == state {
+		return
+	}
+	from := c.state
+	c.state = state
+	if b.observer != nil {
+		b.observer(id, from, state)
+	}
+}
+
+// isVaultFailure returns whether the error of a request indicates the vault
+// is unavailable, as opposed to a failure of the request itself, e.g. a
+// missing permission or key, or a cancellation by the caller.
+func isVaultFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
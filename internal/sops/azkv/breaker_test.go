@@ -0,0 +1,199 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestVaultBreaker_Allow(t *testing.T) {
+	const vaultURL = "https://example.vault.azure.net"
+	unavailable := newResponseError(http.StatusServiceUnavailable, "")
+
+	newBreaker := func(threshold int) (*VaultBreaker, *time.Time, *[]BreakerState) {
+		now := time.Now()
+		var states []BreakerState
+		b := NewVaultBreaker(threshold, time.Minute)
+		b.now = func() time.Time { return now }
+		b.SetStateObserver(func(_ string, _, state BreakerState) {
+			states = append(states, state)
+		})
+		return b, &now, &states
+	}
+	fail := func(g *WithT, b *VaultBreaker, url string, err error) {
+		done, allowErr := b.Allow(url)
+		g.Expect(allowErr).ToNot(HaveOccurred())
+		done(err)
+	}
+
+	t.Run("opens after the consecutive failures", func(t *testing.T) {
+		g := NewWithT(t)
+
+		b, _, states := newBreaker(3)
+		fail(g, b, vaultURL, unavailable)
+		fail(g, b, vaultURL, unavailable)
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerClosed))
+		fail(g, b, vaultURL, unavailable)
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerOpen))
+		g.Expect(*states).To(Equal([]BreakerState{BreakerOpen}))
+
+		_, err := b.Allow(vaultURL)
+		var unavailableErr *VaultUnavailableError
+		g.Expect(errors.As(err, &unavailableErr)).To(BeTrue())
+		g.Expect(unavailableErr.Failures).To(Equal(3))
+		g.Expect(unavailableErr.RetryAfter).To(Equal(time.Minute))
+		g.Expect(err.Error()).To(ContainSubstring("is unavailable after 3 consecutive failures, next attempt in 1m0s"))
+
+		// The breaker is per vault, with the normalized URL.
+		_, err = b.Allow("https://EXAMPLE.vault.azure.net/")
+		g.Expect(err).To(HaveOccurred())
+		_, err = b.Allow("https://other.vault.azure.net")
+		g.Expect(err).ToNot(HaveOccurred())
+	})
+
+	t.Run("resets the failures on success", func(t *testing.T) {
+		g := NewWithT(t)
+
+		b, _, _ := newBreaker(2)
+		fail(g, b, vaultURL, unavailable)
+		fail(g, b, vaultURL, nil)
+		fail(g, b, vaultURL, unavailable)
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerClosed))
+	})
+
+	t.Run("does not count the failures of the requests", func(t *testing.T) {
+		g := NewWithT(t)
+
+		b, _, _ := newBreaker(1)
+		fail(g, b, vaultURL, newResponseError(http.StatusForbidden, ""))
+		fail(g, b, vaultURL, newResponseError(http.StatusNotFound, ""))
+		fail(g, b, vaultURL, context.Canceled)
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerClosed))
+
+		fail(g, b, vaultURL, newResponseError(http.StatusTooManyRequests, ""))
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerOpen))
+	})
+
+	t.Run("half-opens after the cooldown", func(t *testing.T) {
+		g := NewWithT(t)
+
+		b, now, states := newBreaker(1)
+		fail(g, b, vaultURL, errors.New("dial tcp: connection refused"))
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerOpen))
+
+		*now = now.Add(time.Minute)
+		probe, err := b.Allow(vaultURL)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerHalfOpen))
+
+		// Only the probe request is let through.
+		_, err = b.Allow(vaultURL)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("waiting for the result of a probe request"))
+
+		probe(nil)
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerClosed))
+		g.Expect(*states).To(Equal([]BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}))
+	})
+
+	t.Run("opens again when the probe fails", func(t *testing.T) {
+		g := NewWithT(t)
+
+		b, now, _ := newBreaker(3)
+		for i := 0; i < 3; i++ {
+			fail(g, b, vaultURL, unavailable)
+		}
+
+		*now = now.Add(2 * time.Minute)
+		fail(g, b, vaultURL, unavailable)
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerOpen))
+
+		*now = now.Add(30 * time.Second)
+		_, err := b.Allow(vaultURL)
+		var unavailableErr *VaultUnavailableError
+		g.Expect(errors.As(err, &unavailableErr)).To(BeTrue())
+		g.Expect(unavailableErr.Failures).To(Equal(4))
+		g.Expect(unavailableErr.RetryAfter).To(Equal(30 * time.Second))
+	})
+
+	t.Run("records the result once", func(t *testing.T) {
+		g := NewWithT(t)
+
+		b, _, _ := newBreaker(2)
+		done, err := b.Allow(vaultURL)
+		g.Expect(err).ToNot(HaveOccurred())
+		done(unavailable)
+		done(unavailable)
+		g.Expect(b.State(vaultURL)).To(Equal(BreakerClosed))
+	})
+
+	t.Run("nil breaker and zero threshold allow all requests", func(t *testing.T) {
+		g := NewWithT(t)
+
+		for _, b := range []*VaultBreaker{nil, NewVaultBreaker(0, time.Minute)} {
+			for i := 0; i < 3; i++ {
+				fail(g, b, vaultURL, unavailable)
+			}
+			g.Expect(b.State(vaultURL)).To(Equal(BreakerClosed))
+		}
+	})
+}
+
+func TestMasterKey_DecryptContext_VaultBreaker(t *testing.T) {
+	g := NewWithT(t)
+
+	fake := newFakeCryptoClient()
+	b := NewVaultBreaker(2, time.Minute)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	newKey := func() *MasterKey {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		b.ApplyToMasterKey(key)
+		fake.applyToMasterKey(key)
+		return key
+	}
+
+	dataKey := []byte("data-key")
+	encrypted := newKey()
+	g.Expect(encrypted.Encrypt(dataKey)).To(Succeed())
+	decrypt := func() ([]byte, error) {
+		key := newKey()
+		key.EncryptedKey = encrypted.EncryptedKey
+		return key.DecryptContext(context.Background())
+	}
+
+	fake.err = newResponseError(http.StatusServiceUnavailable, "")
+	for i := 0; i < 2; i++ {
+		_, err := decrypt()
+		g.Expect(err).To(HaveOccurred())
+	}
+	g.Expect(fake.decrypts).To(Equal(2))
+
+	// The requests fail fast while the breaker is open.
+	_, err := decrypt()
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(ErrorReason(err)).To(Equal(VaultUnavailableReason))
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with Azure Key Vault key"))
+	g.Expect(fake.decrypts).To(Equal(2))
+
+	// The vault is probed once the cooldown elapsed.
+	fake.err = nil
+	now = now.Add(time.Minute)
+	got, err := decrypt()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal(dataKey))
+	g.Expect(fake.decrypts).To(Equal(3))
+	g.Expect(b.State("https://invalid.vault.azure.net")).To(Equal(BreakerClosed))
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// parseClientCertificate parses the certificates and the private key of a
+// client certificate from PEM data, holding the certificates and the key in
+// separate blocks, or from PKCS12 data protected with the password, which may
+// be empty. The PKCS12 data may be base64 encoded, as a binary archive can not
+// be embedded in the text of an Azure authentication file. Contrary to
+// azidentity.ParseCertificates, which only attempts the PEM format without a
+// password, the PEM format is attempted whenever the data contains PEM
+// blocks, ignoring the password, and the PKCS12 format otherwise or if it
+// fails. The returned error names the attempted formats and their errors.
+func parseClientCertificate(data, password []byte) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	var pemErr error
+	if block, _ := pem.Decode(data); block != nil {
+		certs, pk, err := azidentity.ParseCertificates(data, nil)
+		if err == nil {
+			return certs, pk, nil
+		}
+		pemErr = err
+	} else {
+		pemErr = errors.New("no PEM block found")
+	}
+
+	pfxData := data
+	if decoded, ok := decodeBase64(data); ok {
+		pfxData = decoded
+	}
+	blocks, err := pkcs12.ToPEM(pfxData, string(password))
+	if err == nil {
+		var pemData []byte
+		for _, block := range blocks {
+			pemData = append(pemData, pem.EncodeToMemory(block)...)
+		}
+		var certs []*x509.Certificate
+		var pk crypto.PrivateKey
+		if certs, pk, err = azidentity.ParseCertificates(pemData, nil); err == nil {
+			return certs, pk, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("failed to parse client certificate as PEM (%s) or PKCS12 (%s)", pemErr, err)
+}
+
+// decodeBase64 returns the data decoded from the standard base64 encoding,
+// with or without padding, ignoring the line breaks and other whitespace of
+// e.g. the output of `base64`. It returns false if the data is not base64.
+func decodeBase64(data []byte) ([]byte, bool) {
+	encoded := string(bytes.Join(bytes.Fields(data), nil))
+	if encoded == "" {
+		return nil, false
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding} {
+		if decoded, err := enc.DecodeString(encoded); err == nil {
+			return decoded, true
+		}
+	}
+	return nil, false
+}
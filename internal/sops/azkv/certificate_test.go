@@ -0,0 +1,106 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func Test_parseClientCertificate(t *testing.T) {
+	pemData := validTLS(t)
+	pfxData, err := os.ReadFile("testdata/certificate.pfx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		password string
+		wantErr  string
+	}{
+		{
+			name: "PEM certificate with separate key",
+			data: pemData,
+		},
+		{
+			name:     "PEM certificate with password",
+			data:     pemData,
+			password: "unused-password",
+		},
+		{
+			name:     "password-protected PKCS12",
+			data:     pfxData,
+			password: "password",
+		},
+		{
+			name:     "base64 encoded PKCS12",
+			data:     []byte(base64.StdEncoding.EncodeToString(pfxData)),
+			password: "password",
+		},
+		{
+			name:     "base64 encoded PKCS12 with line breaks",
+			data:     wrapLines(base64.StdEncoding.EncodeToString(pfxData), 76),
+			password: "password",
+		},
+		{
+			name:     "base64 encoded PKCS12 with wrong password",
+			data:     []byte(base64.StdEncoding.EncodeToString(pfxData)),
+			password: "wrong-password",
+			wantErr:  "failed to parse client certificate as PEM (no PEM block found) or PKCS12 (pkcs12: decryption password incorrect)",
+		},
+		{
+			name:     "PKCS12 with wrong password",
+			data:     pfxData,
+			password: "wrong-password",
+			wantErr:  "failed to parse client certificate as PEM (no PEM block found) or PKCS12 (pkcs12: decryption password incorrect)",
+		},
+		{
+			name:    "unparseable data",
+			data:    []byte("not a certificate"),
+			wantErr: "failed to parse client certificate as PEM (no PEM block found) or PKCS12 (",
+		},
+		{
+			name:    "PEM without private key",
+			data:    pemData[bytes.Index(pemData, []byte("-----BEGIN CERTIFICATE")):],
+			wantErr: "failed to parse client certificate as PEM (found no private key) or PKCS12 (",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			certs, pk, err := parseClientCertificate(tt.data, []byte(tt.password))
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(HavePrefix(tt.wantErr))
+				g.Expect(certs).To(BeNil())
+				g.Expect(pk).To(BeNil())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(certs).To(HaveLen(1))
+			g.Expect(pk).ToNot(BeNil())
+		})
+	}
+}
+
+// wrapLines returns the string with a line break after every n characters.
+func wrapLines(s string, n int) []byte {
+	var b bytes.Buffer
+	for len(s) > n {
+		b.WriteString(s[:n] + "\n")
+		s = s[n:]
+	}
+	b.WriteString(s + "\n")
+	return b.Bytes()
+}
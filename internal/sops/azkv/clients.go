@@ -0,0 +1,79 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+
+	"github.com/fluxcd/kustomize-controller/internal/lru"
+)
+
+// maxCachedClients is the maximum number of clients a clientCache holds.
+// When it is full, the least recently used client is evicted.
+const maxCachedClients = 100
+
+// clientCache caches the Azure Key Vault clients of a Token per vault URL
+// and client options. The MasterKeys decrypting with the Token share the
+// client of a vault, and with it the authentication challenge and the
+// access token it acquired, instead of repeating both for every SOPS file.
+// It is safe for concurrent use.
+type clientCache struct {
+	mu      sync.Mutex
+	clients *lru.Cache[string, *azkeys.Client]
+}
+
+// newClientCache returns a new empty clientCache.
+func newClientCache() *clientCache {
+	return &clientCache{clients: lru.New[string, *azkeys.Client](maxCachedClients)}
+}
+
+// client returns the client cached for the key, or constructs one with
+// newClient and caches it. The client is constructed without holding the
+// lock, so that the requests for other keys are not held up, and the client
+// cached for the key meanwhile, if any, is returned instead. Errors are not
+// cached. A nil clientCache constructs a new client on every call.
+func (c *clientCache) client(key string, newClient func() (*azkeys.Client, error)) (*azkeys.Client, error) {
+	if c == nil {
+		return newClient()
+	}
+	if client, ok := c.get(key); ok {
+		return client, nil
+	}
+	client, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.clients.Get(key); ok {
+		return cached, nil
+	}
+	c.clients.Add(key, client)
+	return client, nil
+}
+
+// get returns the client cached for the key, if any.
+func (c *clientCache) get(key string) (*azkeys.Client, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clients.Get(key)
+}
+
+// clientCacheKey returns the key of the client of the vault URL in a
+// clientCache, which includes the options of the client of the MasterKey.
+func (key *MasterKey) clientCacheKey(vaultURL string) string {
+	caBundle := sha256.Sum256(key.caBundle)
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%d\x00%s\x00%s", vaultID(vaultURL), key.apiVersion,
+		hex.EncodeToString(caBundle[:]), key.transport.cacheKey(),
+		key.retryPolicy.MaxAttempts, key.retryPolicy.RetryDelay, key.retryPolicy.MaxRetryDelay)
+}
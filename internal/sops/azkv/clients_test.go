@@ -0,0 +1,183 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+	. "github.com/onsi/gomega"
+)
+
+func TestClientCache_client(t *testing.T) {
+	newCache := func() (*clientCache, func() (*azkeys.Client, error), *int) {
+		c := newClientCache()
+		constructed := 0
+		newClient := func() (*azkeys.Client, error) {
+			constructed++
+			return &azkeys.Client{}, nil
+		}
+		return c, newClient, &constructed
+	}
+
+	t.Run("reuses the client of a key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, newClient, constructed := newCache()
+		first, err := c.client("a", newClient)
+		g.Expect(err).ToNot(HaveOccurred())
+		second, err := c.client("a", newClient)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).To(BeIdenticalTo(first))
+		third, err := c.client("b", newClient)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(third).ToNot(BeIdenticalTo(first))
+		g.Expect(*constructed).To(Equal(2))
+	})
+
+	t.Run("does not cache failures", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newClientCache()
+		calls := 0
+		for i := 0; i < 2; i++ {
+			_, err := c.client("a", func() (*azkeys.Client, error) {
+				calls++
+				return nil, errors.New("invalid vault URL")
+			})
+			g.Expect(err).To(MatchError("invalid vault URL"))
+		}
+		g.Expect(calls).To(Equal(2))
+		g.Expect(c.clients.Len()).To(BeZero())
+	})
+
+	t.Run("evicts the least recently used client", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, newClient, constructed := newCache()
+		for i := 0; i < maxCachedClients; i++ {
+			_, err := c.client(fmt.Sprint(i), newClient)
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		_, err := c.client("0", newClient)
+		g.Expect(err).ToNot(HaveOccurred())
+		_, err = c.client(fmt.Sprint(maxCachedClients), newClient)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c.clients.Len()).To(Equal(maxCachedClients))
+		g.Expect(c.clients.Keys()).To(ContainElement("0"))
+		g.Expect(c.clients.Keys()).ToNot(ContainElement("1"))
+		g.Expect(c.clients.Keys()).To(ContainElement(fmt.Sprint(maxCachedClients)))
+		g.Expect(*constructed).To(Equal(maxCachedClients + 1))
+	})
+
+	t.Run("constructs the clients without holding the lock", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newClientCache()
+		held, err := c.client("a", func() (*azkeys.Client, error) {
+			// The client of another key is returned meanwhile.
+			other, err := c.client("b", func() (*azkeys.Client, error) { return &azkeys.Client{}, nil })
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(other).ToNot(BeNil())
+
+			// A client cached for the key meanwhile is returned instead.
+			_, err = c.client("a", func() (*azkeys.Client, error) { return &azkeys.Client{}, nil })
+			return &azkeys.Client{}, err
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		got, err := c.client("a", func() (*azkeys.Client, error) { return nil, errors.New("not cached") })
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(BeIdenticalTo(held))
+		g.Expect(c.clients.Len()).To(Equal(2))
+	})
+
+	t.Run("nil cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var c *clientCache
+		_, newClient, constructed := newCache()
+		first, err := c.client("a", newClient)
+		g.Expect(err).ToNot(HaveOccurred())
+		second, err := c.client("a", newClient)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).ToNot(BeIdenticalTo(first))
+		g.Expect(*constructed).To(Equal(2))
+	})
+}
+
+func TestMasterKey_clientCacheKey(t *testing.T) {
+	g := NewWithT(t)
+
+	newKey := func(vaultURL string, opts ...interface{ ApplyToMasterKey(*MasterKey) }) *MasterKey {
+		key := MasterKeyFromURL(vaultURL, "key-name", "key-version")
+		for _, o := range opts {
+			o.ApplyToMasterKey(key)
+		}
+		return key
+	}
+	cacheKey := func(key *MasterKey) string {
+		return key.clientCacheKey(key.VaultURL)
+	}
+
+	const vaultURL = "https://test.vault.azure.net"
+	base := cacheKey(newKey(vaultURL))
+	g.Expect(cacheKey(newKey(vaultURL))).To(Equal(base))
+	g.Expect(cacheKey(newKey("https://other.vault.azure.net"))).ToNot(Equal(base))
+	g.Expect(cacheKey(newKey(vaultURL, CABundle([]byte("ca"))))).ToNot(Equal(base))
+	g.Expect(cacheKey(newKey(vaultURL, RetryPolicy{MaxAttempts: 1}))).ToNot(Equal(base))
+	g.Expect(cacheKey(newKey(vaultURL, RetryPolicy{RetryDelay: time.Second}))).ToNot(Equal(base))
+	g.Expect(cacheKey(newKey(vaultURL, Transport{MinTLSVersion: tls.VersionTLS13}))).ToNot(Equal(base))
+	g.Expect(cacheKey(newKey(vaultURL, Transport{ProxyURL: &url.URL{Scheme: "http", Host: "proxy:3128"}}))).ToNot(Equal(base))
+}
+
+func TestMasterKey_Decrypt_SharedClient(t *testing.T) {
+	vaultURL, caPEM := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+		writeKeyOperationResult(w, r, "data-key")
+	})
+
+	decrypt := func(g *WithT, token *Token) {
+		key := MasterKeyFromURL(vaultURL, "key-name", "key-version")
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+		token.ApplyToMasterKey(key)
+		CABundle(caPEM).ApplyToMasterKey(key)
+		got, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("data-key")))
+	}
+
+	t.Run("shares the client of a Token", func(t *testing.T) {
+		g := NewWithT(t)
+
+		token := NewToken(fakeTokenCredential{})
+		for i := 0; i < 3; i++ {
+			decrypt(g, token)
+		}
+		g.Expect(token.clients.clients.Len()).To(Equal(1))
+	})
+
+	t.Run("does not share the clients of different Tokens", func(t *testing.T) {
+		g := NewWithT(t)
+
+		first, second := NewToken(fakeTokenCredential{}), NewToken(fakeTokenCredential{})
+		decrypt(g, first)
+		decrypt(g, second)
+		g.Expect(first.clients.clients.Len()).To(Equal(1))
+		g.Expect(second.clients.clients.Len()).To(Equal(1))
+		for _, k := range first.clients.clients.Keys() {
+			c, _ := first.clients.clients.Peek(k)
+			other, _ := second.clients.clients.Peek(k)
+			g.Expect(other).ToNot(BeIdenticalTo(c))
+		}
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// azureCloud is a national cloud of Azure, identified by the host of its
+// authority, with the DNS suffixes of its vaults and managed HSMs.
+type azureCloud struct {
+	// name is the name of the cloud preset of the `cloud` field of an
+	// AADConfig.
+	name          string
+	authorityHost string
+	vaultSuffixes []string
+}
+
+// azureClouds are the national clouds of which the DNS suffixes of the
+// vaults are known. The vault suffix is listed before the managed HSM one.
+var azureClouds = []azureCloud{
+	{
+		name:          "AzurePublic",
+		authorityHost: "login.microsoftonline.com",
+		vaultSuffixes: []string{"vault.azure.net", "managedhsm.azure.net"},
+	},
+	{
+		name:          "AzureChina",
+		authorityHost: "login.chinacloudapi.cn",
+		vaultSuffixes: []string{"vault.azure.cn", "managedhsm.azure.cn"},
+	},
+	{
+		name:          "AzureGovernment",
+		authorityHost: "login.microsoftonline.us",
+		vaultSuffixes: []string{"vault.usgovcloudapi.net", "managedhsm.usgovcloudapi.net"},
+	},
+}
+
+// azureCloudByName returns the cloud with the given preset name, matched
+// case-insensitively.
+func azureCloudByName(name string) (azureCloud, bool) {
+	for _, c := range azureClouds {
+		if strings.EqualFold(c.name, name) {
+			return c, true
+		}
+	}
+	return azureCloud{}, false
+}
+
+// azureCloudNames returns the preset names of the clouds.
+func azureCloudNames() []string {
+	names := make([]string, 0, len(azureClouds))
+	for _, c := range azureClouds {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// authorityHostURL returns the URL of the authority host of the cloud, in the
+// format of cloud.Configuration.ActiveDirectoryAuthorityHost.
+func (c azureCloud) authorityHostURL() string {
+	return "https://" + c.authorityHost + "/"
+}
+
+// azureCloudForAuthorityHost returns the cloud of the authority host, which
+// is either a host or a URL, or false if the cloud is not known, e.g. for
+// Azure Stack.
+func azureCloudForAuthorityHost(authorityHost string) (azureCloud, bool) {
+	host := authorityHost
+	if u, err := url.Parse(authorityHost); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "/"))
+	for _, c := range azureClouds {
+		if c.authorityHost == host {
+			return c, true
+		}
+	}
+	return azureCloud{}, false
+}
+
+// vaultSuffixesForAuthorityHost returns the DNS suffixes of the vaults of
+// the cloud of the authority host, or nil if the cloud is not known, e.g.
+// for Azure Stack.
+func vaultSuffixesForAuthorityHost(authorityHost string) []string {
+	c, _ := azureCloudForAuthorityHost(authorityHost)
+	return c.vaultSuffixes
+}
+
+// hasDNSSuffix returns whether the host is a subdomain of the suffix.
+func hasDNSSuffix(host, suffix string) bool {
+	return strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(suffix))
+}
+
+// vaultURLForSuffixes returns the vault URL if its host has one of the
+// expected DNS suffixes. Otherwise, it returns an error, or the URL with the
+// known suffix of another cloud replaced by the corresponding expected one
+// if rewrite is true. Any URL is returned as is without expected suffixes.
+func vaultURLForSuffixes(vaultURL string, expected []string, rewrite bool) (string, error) {
+	if len(expected) == 0 {
+		return vaultURL, nil
+	}
+	u, err := url.Parse(vaultURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid Azure Key Vault URL '%s'", vaultURL)
+	}
+	host := u.Hostname()
+	for _, s := range expected {
+		if hasDNSSuffix(host, s) {
+			return vaultURL, nil
+		}
+	}
+
+	mismatchErr := fmt.Errorf("Azure Key Vault URL '%s' does not match the cloud of the configured authority host: "+
+		"expected a host with the DNS suffix '%s'", vaultURL, strings.Join(expected, "' or '"))
+	if !rewrite {
+		return "", mismatchErr
+	}
+	for _, c := range azureClouds {
+		for i, s := range c.vaultSuffixes {
+			if !hasDNSSuffix(host, s) {
+				continue
+			}
+			suffix := expected[len(expected)-1]
+			if i < len(expected) {
+				suffix = expected[i]
+			}
+			port := u.Port()
+			u.Host = host[:len(host)-len(s)] + suffix
+			if port != "" {
+				u.Host += ":" + port
+			}
+			return u.String(), nil
+		}
+	}
+	return "", mismatchErr
+}
+
+// managedHSMLabel is the DNS label which follows the name of a Managed HSM in
+// its host, in any cloud, e.g. "<name>.managedhsm.azure.net".
+const managedHSMLabel = "managedhsm"
+
+// isManagedHSMHost returns whether the host is the one of an Azure Key Vault
+// Managed HSM.
+func isManagedHSMHost(host string) bool {
+	labels := strings.Split(strings.ToLower(host), ".")
+	return len(labels) > 2 && labels[0] != "" && labels[1] == managedHSMLabel
+}
@@ -0,0 +1,321 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestAADConfig_GetVaultDNSSuffixes(t *testing.T) {
+	tests := []struct {
+		name string
+		conf AADConfig
+		want []string
+	}{
+		{
+			name: "no validation by default",
+		},
+		{
+			name: "Azure Public Cloud",
+			conf: AADConfig{AuthorityHost: "https://login.microsoftonline.com/"},
+			want: []string{"vault.azure.net", "managedhsm.azure.net"},
+		},
+		{
+			name: "Azure China",
+			conf: AADConfig{AuthorityHost: "https://login.chinacloudapi.cn/"},
+			want: []string{"vault.azure.cn", "managedhsm.azure.cn"},
+		},
+		{
+			name: "Azure Government",
+			conf: AADConfig{AuthorityHost: "https://login.microsoftonline.us/"},
+			want: []string{"vault.usgovcloudapi.net", "managedhsm.usgovcloudapi.net"},
+		},
+		{
+			name: "unknown cloud",
+			conf: AADConfig{AuthorityHost: "https://login.example.com/"},
+		},
+		{
+			name: "override",
+			conf: AADConfig{AuthorityHost: "https://login.example.com/", VaultDNSSuffix: ".vault.example.com"},
+			want: []string{"vault.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(tt.conf.GetVaultDNSSuffixes()).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestAADConfig_withCloud(t *testing.T) {
+	tests := []struct {
+		name         string
+		conf         AADConfig
+		wantHost     string
+		wantSuffixes []string
+		wantErr      string
+	}{
+		{
+			name: "no cloud",
+		},
+		{
+			name:         "Azure Public",
+			conf:         AADConfig{Cloud: "AzurePublic"},
+			wantHost:     "https://login.microsoftonline.com/",
+			wantSuffixes: []string{"vault.azure.net", "managedhsm.azure.net"},
+		},
+		{
+			name:         "Azure China",
+			conf:         AADConfig{Cloud: "AzureChina"},
+			wantHost:     "https://login.chinacloudapi.cn/",
+			wantSuffixes: []string{"vault.azure.cn", "managedhsm.azure.cn"},
+		},
+		{
+			name:         "Azure Government matched case-insensitively",
+			conf:         AADConfig{Cloud: "azuregovernment"},
+			wantHost:     "https://login.microsoftonline.us/",
+			wantSuffixes: []string{"vault.usgovcloudapi.net", "managedhsm.usgovcloudapi.net"},
+		},
+		{
+			name:         "authority host of the cloud",
+			conf:         AADConfig{Cloud: "AzureChina", AuthorityHost: "https://login.chinacloudapi.cn"},
+			wantHost:     "https://login.chinacloudapi.cn",
+			wantSuffixes: []string{"vault.azure.cn", "managedhsm.azure.cn"},
+		},
+		{
+			name:    "authority host of another cloud",
+			conf:    AADConfig{Cloud: "AzureChina", AuthorityHost: "https://login.microsoftonline.com/"},
+			wantErr: "authority host 'https://login.microsoftonline.com/' is not the one of the 'cloud' 'AzureChina': expected 'https://login.chinacloudapi.cn/'",
+		},
+		{
+			name: "fallback authority host of another cloud",
+			conf: AADConfig{
+				Cloud:                  "AzureGovernment",
+				AuthorityHost:          "https://login.microsoftonline.us/",
+				FallbackAuthorityHosts: []string{"https://login.example.com/"},
+			},
+			wantErr: "authority host 'https://login.example.com/' is not the one of the 'cloud' 'AzureGovernment'",
+		},
+		{
+			name:    "unknown cloud",
+			conf:    AADConfig{Cloud: "AzureStack"},
+			wantErr: "unknown 'cloud' 'AzureStack': expected one of 'AzurePublic', 'AzureChina', 'AzureGovernment'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := tt.conf.withCloud()
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got.AuthorityHost).To(Equal(tt.wantHost))
+			g.Expect(got.GetVaultDNSSuffixes()).To(Equal(tt.wantSuffixes))
+		})
+	}
+}
+
+func Test_vaultURLForSuffixes(t *testing.T) {
+	china := vaultSuffixesForAuthorityHost("https://login.chinacloudapi.cn/")
+
+	tests := []struct {
+		name     string
+		vaultURL string
+		expected []string
+		rewrite  bool
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "matching cloud",
+			vaultURL: "https://example.vault.azure.cn",
+			expected: china,
+			want:     "https://example.vault.azure.cn",
+		},
+		{
+			name:     "matching managed HSM",
+			vaultURL: "https://example.managedhsm.azure.cn/",
+			expected: china,
+			want:     "https://example.managedhsm.azure.cn/",
+		},
+		{
+			name:     "matching case-insensitively",
+			vaultURL: "https://Example.Vault.Azure.CN",
+			expected: china,
+			want:     "https://Example.Vault.Azure.CN",
+		},
+		{
+			name:     "no expected suffixes",
+			vaultURL: "https://example.vault.azure.net",
+			want:     "https://example.vault.azure.net",
+		},
+		{
+			name:     "mismatched cloud",
+			vaultURL: "https://example.vault.azure.net",
+			expected: china,
+			wantErr: "Azure Key Vault URL 'https://example.vault.azure.net' does not match the cloud of the configured authority host: " +
+				"expected a host with the DNS suffix 'vault.azure.cn' or 'managedhsm.azure.cn'",
+		},
+		{
+			name:     "suffix without subdomain",
+			vaultURL: "https://examplevault.azure.cn",
+			expected: china,
+			wantErr:  "does not match the cloud of the configured authority host",
+		},
+		{
+			name:     "rewrites mismatched cloud",
+			vaultURL: "https://example.vault.azure.net",
+			expected: china,
+			rewrite:  true,
+			want:     "https://example.vault.azure.cn",
+		},
+		{
+			name:     "rewrites mismatched managed HSM with port",
+			vaultURL: "https://example.managedhsm.usgovcloudapi.net:443/",
+			expected: china,
+			rewrite:  true,
+			want:     "https://example.managedhsm.azure.cn:443/",
+		},
+		{
+			name:     "rewrites to override",
+			vaultURL: "https://example.managedhsm.azure.net",
+			expected: []string{"vault.example.com"},
+			rewrite:  true,
+			want:     "https://example.vault.example.com",
+		},
+		{
+			name:     "does not rewrite unknown suffix",
+			vaultURL: "https://example.vault.example.com",
+			expected: china,
+			rewrite:  true,
+			wantErr:  "does not match the cloud of the configured authority host",
+		},
+		{
+			name:     "invalid URL",
+			vaultURL: "example",
+			expected: china,
+			wantErr:  "invalid Azure Key Vault URL 'example'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := vaultURLForSuffixes(tt.vaultURL, tt.expected, tt.rewrite)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestMasterKey_VaultDNSSuffix(t *testing.T) {
+	newKey := func(g *WithT, c *fakeCryptoClient, vaultURL string, conf AADConfig) *MasterKey {
+		key := MasterKeyFromURL(vaultURL, "key-name", "v1")
+		token, err := TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		token.ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		return key
+	}
+	chinaConf := AADConfig{
+		TenantID:      "tenant",
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		AuthorityHost: "https://login.chinacloudapi.cn/",
+	}
+
+	t.Run("matching cloud", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(g, c, "https://example.vault.azure.cn/", chinaConf)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		g.Expect(c.encrypts).To(Equal(1))
+		g.Expect(c.vaultURLs).To(Equal([]string{"https://example.vault.azure.cn"}))
+	})
+
+	t.Run("without configured cloud", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// The vault URLs are not validated against the Azure Public Cloud
+		// default, e.g. for Azure Stack.
+		c := newFakeCryptoClient()
+		key := newKey(g, c, "https://example.vault.local.azurestack.external", AADConfig{
+			TenantID:     "tenant",
+			ClientID:     "client",
+			ClientSecret: "secret",
+		})
+		RewriteVaultDNSSuffix(true).ApplyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		g.Expect(c.vaultURLs).To(Equal([]string{"https://example.vault.local.azurestack.external"}))
+	})
+
+	t.Run("mismatched cloud", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(g, c, "https://example.vault.azure.net", chinaConf)
+		err := key.Encrypt([]byte("data-key"))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("Azure Key Vault URL 'https://example.vault.azure.net' does not match the cloud"))
+		g.Expect(c.encrypts).To(BeZero())
+
+		key.EncryptedKey = "encrypted"
+		_, err = key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("does not match the cloud"))
+		g.Expect(c.decrypts).To(BeZero())
+	})
+
+	t.Run("rewrites mismatched cloud", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(g, c, "https://example.vault.azure.net", chinaConf)
+		RewriteVaultDNSSuffix(true).ApplyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		g.Expect(c.encrypts).To(Equal(1))
+		g.Expect(c.vaultURLs).To(Equal([]string{"https://example.vault.azure.cn"}))
+		// The key keeps its vault URL, as recorded in the SOPS metadata.
+		g.Expect(key.VaultURL).To(Equal("https://example.vault.azure.net"))
+	})
+
+	t.Run("per-config override", func(t *testing.T) {
+		g := NewWithT(t)
+
+		conf := chinaConf
+		conf.VaultDNSSuffix = "vault.example.com"
+		c := newFakeCryptoClient()
+		key := newKey(g, c, "https://example.vault.example.com", conf)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+
+		key = newKey(g, c, "https://example.vault.azure.cn", conf)
+		g.Expect(key.Encrypt([]byte("data-key"))).ToNot(Succeed())
+	})
+
+	t.Run("token of an unknown cloud", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := MasterKeyFromURL("https://example.vault.example.com", "key-name", "v1")
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+	})
+}
@@ -7,11 +7,27 @@
 package azkv
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"sigs.k8s.io/yaml"
+
+	"github.com/fluxcd/kustomize-controller/internal/lru"
 )
 
 // LoadAADConfigFromBytes attempts to load the given bytes into the given AADConfig.
@@ -32,13 +48,75 @@ func LoadAADConfigFromBytes(b []byte, s *AADConfig) error {
 // required for Active Directory authentication.
 type AADConfig struct {
 	AZConfig
-	TenantID                   string `json:"tenantId,omitempty"`
-	ClientID                   string `json:"clientId,omitempty"`
+	TenantID string `json:"tenantId,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	// ManagedIdentityResourceID is the resource ID of a user-assigned
+	// managed identity, as an alternative to its ClientID.
+	ManagedIdentityResourceID string `json:"managedIdentityResourceId,omitempty"`
+	// WorkloadIdentity authenticates as the TenantID and ClientID with the
+	// federated service account token of the controller Pod, as injected by
+	// the Azure workload identity webhook.
+	WorkloadIdentity           bool   `json:"workloadIdentity,omitempty"`
 	ClientSecret               string `json:"clientSecret,omitempty"`
 	ClientCertificate          string `json:"clientCertificate,omitempty"`
 	ClientCertificatePassword  string `json:"clientCertificatePassword,omitempty"`
 	ClientCertificateSendChain bool   `json:"clientCertificateSendChain,omitempty"`
 	AuthorityHost              string `json:"authorityHost,omitempty"`
+	// FallbackAuthorityHosts are tried in order when no token can be
+	// acquired through the AuthorityHost. They are set from the entries
+	// after the first of an `authorityHost` list.
+	FallbackAuthorityHosts []string `json:"-"`
+	// Cloud is the name of the national cloud of the credentials, one of
+	// "AzurePublic", "AzureChina" or "AzureGovernment". It sets the
+	// AuthorityHost of the cloud when none is configured, and the DNS
+	// suffixes of its vaults.
+	Cloud string `json:"cloud,omitempty"`
+	// VaultDNSSuffix overrides the DNS suffix of the vaults of the cloud of
+	// the AuthorityHost, which the vault URLs of the keys must match.
+	VaultDNSSuffix string `json:"vaultDNSSuffix,omitempty"`
+	// NoDefaultCredential disables the ambient credentials of the
+	// controller, i.e. its managed identities, its workload identity and the
+	// defaults of its environment, as configured for a TokenCache which does
+	// not fall back to the default credential of the controller. It can not
+	// be set in an Azure authentication file.
+	NoDefaultCredential bool `json:"-"`
+	// AllowWorkloadIdentity allows the WorkloadIdentity of the controller, as
+	// configured for a TokenCache. It can not be set in an Azure
+	// authentication file.
+	AllowWorkloadIdentity bool `json:"-"`
+}
+
+// UnmarshalJSON unmarshals the AADConfig, accepting a prioritized list of
+// hosts for the `authorityHost` field, of which the first is set as the
+// AuthorityHost and the others as the FallbackAuthorityHosts.
+func (s *AADConfig) UnmarshalJSON(b []byte) error {
+	type config AADConfig
+	aux := struct {
+		*config
+		AuthorityHost json.RawMessage `json:"authorityHost,omitempty"`
+	}{config: (*config)(s)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if len(aux.AuthorityHost) == 0 || string(aux.AuthorityHost) == "null" {
+		return nil
+	}
+
+	var hosts []string
+	if err := json.Unmarshal(aux.AuthorityHost, &hosts); err != nil {
+		var host string
+		if err := json.Unmarshal(aux.AuthorityHost, &host); err != nil {
+			return fmt.Errorf("invalid authorityHost: must be a string or a list of strings")
+		}
+		hosts = []string{host}
+	}
+	if len(hosts) > 0 {
+		s.AuthorityHost, s.FallbackAuthorityHosts = hosts[0], hosts[1:]
+		if len(s.FallbackAuthorityHosts) == 0 {
+			s.FallbackAuthorityHosts = nil
+		}
+	}
+	return nil
 }
 
 // AZConfig contains the Service Principal fields as generated by `az`.
@@ -49,6 +127,82 @@ type AZConfig struct {
 	Password string `json:"password,omitempty"`
 }
 
+// redactedValue replaces the values of the secret fields of the AADConfig
+// and AZConfig when they are formatted.
+const redactedValue = "<redacted>"
+
+// redact returns the quoted value, or redactedValue if the value is set.
+func redact(value string) string {
+	if value == "" {
+		return `""`
+	}
+	return redactedValue
+}
+
+// String returns the AZConfig with the Password redacted, which is safe to
+// log.
+func (s AZConfig) String() string {
+	return fmt.Sprintf("AZConfig{AppID: %q, Tenant: %q, Password: %s}", s.AppID, s.Tenant, redact(s.Password))
+}
+
+// GoString returns the AZConfig as String, for the %#v verb.
+func (s AZConfig) GoString() string {
+	return s.String()
+}
+
+// String returns the AADConfig with the ClientSecret, ClientCertificate,
+// ClientCertificatePassword and AZConfig Password redacted, which is safe to
+// log.
+func (s AADConfig) String() string {
+	return fmt.Sprintf("AADConfig{TenantID: %q, ClientID: %q, ManagedIdentityResourceID: %q, WorkloadIdentity: %t, "+
+		"ClientSecret: %s, ClientCertificate: %s, ClientCertificatePassword: %s, ClientCertificateSendChain: %t, AuthorityHost: %q, "+
+		"FallbackAuthorityHosts: %q, Cloud: %q, VaultDNSSuffix: %q, AZConfig: %s}",
+		s.TenantID, s.ClientID, s.ManagedIdentityResourceID, s.WorkloadIdentity, redact(s.ClientSecret), redact(s.ClientCertificate),
+		redact(s.ClientCertificatePassword), s.ClientCertificateSendChain, s.AuthorityHost,
+		s.FallbackAuthorityHosts, s.Cloud, s.VaultDNSSuffix, s.AZConfig.String())
+}
+
+// GoString returns the AADConfig as String, for the %#v verb.
+func (s AADConfig) GoString() string {
+	return s.String()
+}
+
+const (
+	// tenantIDEnvVar and clientIDEnvVar are the environment variables of
+	// the tenant and client IDs of the identity of the Pod, as injected e.g.
+	// by the Azure workload identity webhook on AKS.
+	tenantIDEnvVar = "AZURE_TENANT_ID"
+	clientIDEnvVar = "AZURE_CLIENT_ID"
+
+	// federatedTokenFileEnvVar and authorityHostEnvVar are the environment
+	// variables of the federated service account token file of the Pod and
+	// of the authority host to exchange it with, as injected by the Azure
+	// workload identity webhook on AKS.
+	federatedTokenFileEnvVar = "AZURE_FEDERATED_TOKEN_FILE"
+	authorityHostEnvVar      = "AZURE_AUTHORITY_HOST"
+)
+
+// withEnvDefaults returns the AADConfig with its empty TenantID set from the
+// AZURE_TENANT_ID environment variable, and its empty ClientID set from the
+// AZURE_CLIENT_ID environment variable for a Service Principal with a
+// client secret or certificate. The ClientID of the controller is never the
+// default of a managed identity or workload identity, and nothing defaults
+// to the environment with NoDefaultCredential. The fields set in the
+// AADConfig always take precedence.
+func (s AADConfig) withEnvDefaults() AADConfig {
+	if s.NoDefaultCredential {
+		return s
+	}
+	if s.TenantID == "" {
+		s.TenantID = os.Getenv(tenantIDEnvVar)
+	}
+	if s.ClientID == "" && s.TenantID != "" && !s.WorkloadIdentity && s.ManagedIdentityResourceID == "" &&
+		(s.ClientSecret != "" || s.ClientCertificate != "") {
+		s.ClientID = os.Getenv(clientIDEnvVar)
+	}
+	return s
+}
+
 // TokenFromAADConfig attempts to construct a Token using the AADConfig values.
 // It detects credentials in the following order:
 //
@@ -60,36 +214,124 @@ type AZConfig struct {
 //   - azidentity.ClientSecretCredential when AZConfig fields are found.
 //   - azidentity.ManagedIdentityCredential for a User ID, when a `clientId`
 //     field but no `tenantId` is found.
+//   - azidentity.ManagedIdentityCredential for a Resource ID, when a
+//     `managedIdentityResourceId` field is found. It can not be combined
+//     with a `clientId` field.
+//   - azidentity.WorkloadIdentityCredential when the `workloadIdentity`
+//     field is true, for the `tenantId` and `clientId` fields. The
+//     federated token file and the authority host are the ones of the
+//     AZURE_FEDERATED_TOKEN_FILE and AZURE_AUTHORITY_HOST environment
+//     variables of the controller Pod, and can not be configured otherwise.
+//     It requires AllowWorkloadIdentity, without NoDefaultCredential.
+//
+// With NoDefaultCredential, none of the ambient credentials of the controller
+// is used: the managed identities and the workload identity are rejected, and
+// no field defaults to the environment of the controller.
+//
+// The `tenantId` field which is not set defaults to the AZURE_TENANT_ID
+// environment variable, if set, and so does the `clientId` field to the
+// AZURE_CLIENT_ID environment variable for a Service Principal with a
+// `clientSecret` or `clientCertificate`. No field defaults to the
+// environment when NoDefaultCredential is set.
+//
+// The `cloud` field selects the authority host of a national cloud when no
+// `authorityHost` is set. Otherwise, all the authority hosts must be the one
+// of the cloud.
+//
+// When FallbackAuthorityHosts are configured, a credential is constructed
+// for each authority host, and tried in order until one acquires a token.
 //
 // If no set of credentials is found or the azcore.TokenCredential can not be
 // created, an error is returned.
-func TokenFromAADConfig(c AADConfig) (_ *Token, err error) {
-	var token azcore.TokenCredential
+func TokenFromAADConfig(c AADConfig) (*Token, error) {
+	return tokenFromAADConfig(c, nil)
+}
+
+// tokenFromAADConfig constructs a Token as documented in TokenFromAADConfig,
+// probing the IMDS with the IMDSProbe before constructing a managed identity
+// credential.
+func tokenFromAADConfig(c AADConfig, probe *IMDSProbe) (*Token, error) {
+	c = c.withEnvDefaults()
+	if c.ClientID != "" && c.ManagedIdentityResourceID != "" {
+		return nil, fmt.Errorf("invalid data: only one of '%s' or '%s' can be set", "clientId", "managedIdentityResourceId")
+	}
+	if c.WorkloadIdentity {
+		var err error
+		if c, err = c.withWorkloadIdentity(); err != nil {
+			return nil, err
+		}
+	}
+	c, err := c.withCloud()
+	if err != nil {
+		return nil, err
+	}
+	clouds := c.GetCloudConfigs()
+	credentials := make([]azcore.TokenCredential, 0, len(clouds))
+	for _, cloudConfig := range clouds {
+		token, usesCloud, err := credentialFromAADConfig(c, cloudConfig, probe)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, token)
+		if !usesCloud {
+			break
+		}
+	}
+	token := NewToken(credentials[0])
+	if len(credentials) > 1 {
+		token = NewToken(&authorityHostsCredential{
+			hosts:       c.AuthorityHosts(),
+			credentials: credentials,
+		})
+	}
+	token.vaultSuffixes = c.GetVaultDNSSuffixes()
+	token.id = c.cacheKey()
+	return token, nil
+}
+
+// credentialFromAADConfig constructs the azcore.TokenCredential of the
+// AADConfig as documented in TokenFromAADConfig, for the given cloud
+// configuration. It returns whether the credential uses the cloud
+// configuration, which is not the case for a managed identity. The IMDS is
+// probed with the IMDSProbe, if not nil, before constructing a managed
+// identity credential.
+func credentialFromAADConfig(c AADConfig, cloudConfig cloud.Configuration, probe *IMDSProbe) (token azcore.TokenCredential, usesCloud bool, err error) {
+	if c.WorkloadIdentity {
+		if token, err = azidentity.NewWorkloadIdentityCredential(c.TenantID, c.ClientID, os.Getenv(federatedTokenFileEnvVar),
+			&azidentity.WorkloadIdentityCredentialOptions{
+				ClientOptions: azcore.ClientOptions{
+					Cloud: cloudConfig,
+				},
+			}); err != nil {
+			return nil, false, err
+		}
+		return token, true, nil
+	}
 	if c.TenantID != "" && c.ClientID != "" {
 		if c.ClientSecret != "" {
 			if token, err = azidentity.NewClientSecretCredential(c.TenantID, c.ClientID, c.ClientSecret, &azidentity.ClientSecretCredentialOptions{
 				ClientOptions: azcore.ClientOptions{
-					Cloud: c.GetCloudConfig(),
+					Cloud: cloudConfig,
 				},
 			}); err != nil {
 				return
 			}
-			return NewToken(token), nil
+			return token, true, nil
 		}
 		if c.ClientCertificate != "" {
-			certs, pk, err := azidentity.ParseCertificates([]byte(c.ClientCertificate), []byte(c.ClientCertificatePassword))
+			certs, pk, err := parseClientCertificate([]byte(c.ClientCertificate), []byte(c.ClientCertificatePassword))
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
 			if token, err = azidentity.NewClientCertificateCredential(c.TenantID, c.ClientID, certs, pk, &azidentity.ClientCertificateCredentialOptions{
 				SendCertificateChain: c.ClientCertificateSendChain,
 				ClientOptions: azcore.ClientOptions{
-					Cloud: c.GetCloudConfig(),
+					Cloud: cloudConfig,
 				},
 			}); err != nil {
-				return nil, err
+				return nil, false, err
 			}
-			return NewToken(token), nil
+			return token, true, nil
 		}
 	}
 
@@ -97,33 +339,564 @@ func TokenFromAADConfig(c AADConfig) (_ *Token, err error) {
 	case c.Tenant != "" && c.AppID != "" && c.Password != "":
 		if token, err = azidentity.NewClientSecretCredential(c.Tenant, c.AppID, c.Password, &azidentity.ClientSecretCredentialOptions{
 			ClientOptions: azcore.ClientOptions{
-				Cloud: c.GetCloudConfig(),
+				Cloud: cloudConfig,
 			},
 		}); err != nil {
 			return
 		}
-		return NewToken(token), nil
+		return token, true, nil
 	case c.ClientID != "":
+		if c.NoDefaultCredential {
+			return nil, false, errManagedIdentityDisabled(c.ClientID)
+		}
+		if err = probe.Probe(context.Background()); err != nil {
+			return nil, false, fmt.Errorf("failed to configure managed identity '%s': %w", c.ClientID, err)
+		}
 		if token, err = azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
 			ID: azidentity.ClientID(c.ClientID),
 		}); err != nil {
 			return
 		}
-		return NewToken(token), nil
+		return token, false, nil
+	case c.ManagedIdentityResourceID != "":
+		if c.NoDefaultCredential {
+			return nil, false, errManagedIdentityDisabled(c.ManagedIdentityResourceID)
+		}
+		if err = probe.Probe(context.Background()); err != nil {
+			return nil, false, fmt.Errorf("failed to configure managed identity '%s': %w", c.ManagedIdentityResourceID, err)
+		}
+		if token, err = azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ID: azidentity.ResourceID(c.ManagedIdentityResourceID),
+		}); err != nil {
+			return
+		}
+		return token, false, nil
+	default:
+		return nil, false, errNoCredentials()
+	}
+}
+
+// errManagedIdentityDisabled returns the error of an AADConfig of a managed
+// identity with NoDefaultCredential, as the managed identities are the ones
+// assigned to the controller Pod or its node.
+func errManagedIdentityDisabled(id string) error {
+	return fmt.Errorf("invalid data: managed identity '%s' can not be used, the default credential of the controller is disabled", id)
+}
+
+// errNoCredentials returns the error of an AADConfig without any set of
+// credentials.
+func errNoCredentials() error {
+	return fmt.Errorf("invalid data: requires a '%s' or '%s' field, a combination of '%s', '%s' and '%s', or '%s', '%s' and '%s'",
+		"clientId", "managedIdentityResourceId", "tenantId", "clientId", "clientSecret", "tenantId", "clientId", "clientCertificate")
+}
+
+// Validate returns an error if the AADConfig does not configure one of the
+// sets of credentials detected by TokenFromAADConfig, or if the credentials
+// are invalid, e.g. a client certificate which can't be parsed. The
+// credentials are not constructed, and no request is sent to the authority
+// hosts or the IMDS.
+func (s AADConfig) Validate() error {
+	c := s.withEnvDefaults()
+	if c.ClientID != "" && c.ManagedIdentityResourceID != "" {
+		return fmt.Errorf("invalid data: only one of '%s' or '%s' can be set", "clientId", "managedIdentityResourceId")
+	}
+	if c.WorkloadIdentity {
+		var err error
+		if c, err = c.withWorkloadIdentity(); err != nil {
+			return err
+		}
+	}
+	c, err := c.withCloud()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.WorkloadIdentity:
+		return nil
+	case c.TenantID != "" && c.ClientID != "" && c.ClientSecret != "":
+		return nil
+	case c.TenantID != "" && c.ClientID != "" && c.ClientCertificate != "":
+		_, _, err := parseClientCertificate([]byte(c.ClientCertificate), []byte(c.ClientCertificatePassword))
+		return err
+	case c.Tenant != "" && c.AppID != "" && c.Password != "":
+		return nil
+	case c.ClientID != "":
+		if c.NoDefaultCredential {
+			return errManagedIdentityDisabled(c.ClientID)
+		}
+		return nil
+	case c.ManagedIdentityResourceID != "":
+		if c.NoDefaultCredential {
+			return errManagedIdentityDisabled(c.ManagedIdentityResourceID)
+		}
+		return nil
 	default:
-		return nil, fmt.Errorf("invalid data: requires a '%s' field, a combination of '%s', '%s' and '%s', or '%s', '%s' and '%s'",
-			"clientId", "tenantId", "clientId", "clientSecret", "tenantId", "clientId", "clientCertificate")
+		return errNoCredentials()
+	}
+}
+
+// withWorkloadIdentity returns the AADConfig of a workload identity with the
+// AuthorityHost of the AZURE_AUTHORITY_HOST environment variable, or an error
+// if it is not valid. The federated token of the controller Pod is never sent
+// to an authority host configured in the AADConfig, nor read from any other
+// file than the one of the AZURE_FEDERATED_TOKEN_FILE environment variable.
+// The workload identity must be allowed with AllowWorkloadIdentity, and is
+// never allowed with NoDefaultCredential.
+func (s AADConfig) withWorkloadIdentity() (AADConfig, error) {
+	switch {
+	case s.NoDefaultCredential:
+		return s, fmt.Errorf("invalid data: '%s' can not be used, the default credential of the controller is disabled", "workloadIdentity")
+	case !s.AllowWorkloadIdentity:
+		return s, fmt.Errorf("invalid data: '%s' is not allowed by the controller", "workloadIdentity")
+	case s.TenantID == "" || s.ClientID == "":
+		return s, fmt.Errorf("invalid data: '%s' requires the '%s' and '%s' fields", "workloadIdentity", "tenantId", "clientId")
+	case s.ClientSecret != "" || s.ClientCertificate != "" || s.ManagedIdentityResourceID != "" || s.Password != "":
+		return s, fmt.Errorf("invalid data: '%s' can not be combined with other credentials", "workloadIdentity")
+	case len(s.AuthorityHosts()) > 0:
+		return s, fmt.Errorf("invalid data: '%s' can not be combined with '%s', the %s environment variable is used",
+			"workloadIdentity", "authorityHost", authorityHostEnvVar)
+	case os.Getenv(federatedTokenFileEnvVar) == "":
+		return s, fmt.Errorf("invalid data: '%s' requires the %s environment variable of the controller, "+
+			"as injected by the Azure workload identity webhook", "workloadIdentity", federatedTokenFileEnvVar)
+	}
+	s.AuthorityHost = os.Getenv(authorityHostEnvVar)
+	return s, nil
+}
+
+// withCloud returns the AADConfig with the AuthorityHost of the Cloud if
+// none is set. It returns an error if the Cloud is not known, or if any of
+// the AuthorityHosts is not the one of the Cloud.
+func (s AADConfig) withCloud() (AADConfig, error) {
+	if s.Cloud == "" {
+		return s, nil
+	}
+	c, ok := azureCloudByName(s.Cloud)
+	if !ok {
+		return s, fmt.Errorf("invalid data: unknown '%s' '%s': expected one of '%s'",
+			"cloud", s.Cloud, strings.Join(azureCloudNames(), "', '"))
+	}
+	hosts := s.AuthorityHosts()
+	if len(hosts) == 0 {
+		s.AuthorityHost = c.authorityHostURL()
+		return s, nil
+	}
+	for _, h := range hosts {
+		if hc, ok := azureCloudForAuthorityHost(h); !ok || hc.name != c.name {
+			return s, fmt.Errorf("invalid data: authority host '%s' is not the one of the '%s' '%s': expected '%s'",
+				h, "cloud", c.name, c.authorityHostURL())
+		}
+	}
+	return s, nil
+}
+
+// authorityHostsCredential is an azcore.TokenCredential trying the
+// credentials of a prioritized list of authority hosts in order, until one
+// acquires a token. The last successful credential is tried first on the
+// next request. It is safe for concurrent use.
+type authorityHostsCredential struct {
+	hosts       []string
+	credentials []azcore.TokenCredential
+
+	mu      sync.Mutex
+	current int
+}
+
+// GetToken returns the token acquired by the first credential which succeeds,
+// or an error aggregating the errors of all the authority hosts.
+func (c *authorityHostsCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.mu.Lock()
+	start := c.current
+	c.mu.Unlock()
+
+	var errs []error
+	for i := range c.credentials {
+		n := (start + i) % len(c.credentials)
+		token, err := c.credentials[n].GetToken(ctx, opts)
+		if err == nil {
+			c.mu.Lock()
+			c.current = n
+			c.mu.Unlock()
+			return token, nil
+		}
+		errs = append(errs, fmt.Errorf("authority host '%s': %w", c.hosts[n], err))
 	}
+	return azcore.AccessToken{}, fmt.Errorf("failed to acquire a token from any authority host: %w",
+		kerrors.NewAggregate(errs))
+}
+
+// TokenCache shares the Tokens constructed from identical AADConfigs, e.g.
+// across the MasterKeys of the files decrypted by all the reconciliations, so
+// that the credential acquires its access tokens once for all of them. The
+// entries expire once their TTL elapsed, and when the cache is full, the
+// least recently used entry is evicted. It is safe for concurrent use.
+type TokenCache struct {
+	size int
+	// ttl is the maximum age of the entries. When zero, the entries do
+	// not expire.
+	ttl time.Duration
+	// now returns the current time. Defaults to time.Now.
+	now func() time.Time
+	// imdsProbe probes the IMDS before constructing the managed identity
+	// credentials. When nil, the IMDS is not probed.
+	imdsProbe *IMDSProbe
+	// noDefaultCredential sets the NoDefaultCredential of all the
+	// AADConfigs.
+	noDefaultCredential bool
+	// allowWorkloadIdentity sets the AllowWorkloadIdentity of all the
+	// AADConfigs.
+	allowWorkloadIdentity bool
+
+	mu     sync.Mutex
+	tokens *lru.Cache[string, *configEntry]
+}
+
+// NewTokenCache returns a new empty TokenCache holding at most size
+// entries. A zero size TokenCache constructs a new Token on every call.
+func NewTokenCache(size int) *TokenCache {
+	return &TokenCache{
+		size:   size,
+		now:    time.Now,
+		tokens: lru.New[string, *configEntry](size),
+	}
+}
+
+// SetTTL configures the maximum age of the shared Tokens, after which they
+// are constructed again. A TTL of zero disables the expiry.
+func (c *TokenCache) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// ProbeIMDS configures the TokenCache to probe the IMDS with the given
+// IMDSProbe before constructing a managed identity credential, to fail early
+// with a clear error when it is unreachable. It must be called before the
+// TokenCache is used.
+func (c *TokenCache) ProbeIMDS(probe *IMDSProbe) {
+	c.imdsProbe = probe
+}
+
+// SetDisableDefaultCredential configures the TokenCache to construct the
+// Tokens of all the AADConfigs with NoDefaultCredential, for a controller
+// which does not fall back to its default credential. It must be called
+// before the TokenCache is used.
+func (c *TokenCache) SetDisableDefaultCredential(disable bool) {
+	c.noDefaultCredential = disable
+}
+
+// SetAllowWorkloadIdentity configures the TokenCache to construct the Tokens
+// of all the AADConfigs with AllowWorkloadIdentity, for a controller which
+// allows the tenants to authenticate with its workload identity. It must be
+// called before the TokenCache is used.
+func (c *TokenCache) SetAllowWorkloadIdentity(allow bool) {
+	c.allowWorkloadIdentity = allow
+}
+
+// TokenFromAADConfig returns the Token constructed by TokenFromAADConfig
+// from an identical AADConfig earlier, or constructs and caches a new one.
+// The Token is constructed without holding the lock, as it may probe the
+// IMDS, and the Token cached for the AADConfig meanwhile, if any, is
+// returned instead. A nil TokenCache constructs a new Token on every call.
+// Errors are not cached.
+func (c *TokenCache) TokenFromAADConfig(conf AADConfig) (*Token, error) {
+	if c == nil {
+		return TokenFromAADConfig(conf)
+	}
+	if c.noDefaultCredential {
+		conf.NoDefaultCredential = true
+	}
+	if c.allowWorkloadIdentity {
+		conf.AllowWorkloadIdentity = true
+	}
+	if c.size <= 0 {
+		return tokenFromAADConfig(conf, c.imdsProbe)
+	}
+
+	key := conf.cacheKey()
+	if t, ok := c.get(key); ok {
+		return t, nil
+	}
+	t, err := tokenFromAADConfig(conf, c.imdsProbe)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.tokens.Get(key); ok && c.freshLocked(e) {
+		return e.token, nil
+	}
+	c.tokens.Add(key, &configEntry{token: t, created: c.now()})
+	return t, nil
+}
+
+// get returns the Token cached for the key, if it is younger than the TTL.
+func (c *TokenCache) get(key string) (*Token, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.tokens.Get(key)
+	if !ok || !c.freshLocked(e) {
+		return nil, false
+	}
+	return e.token, true
+}
+
+// freshLocked returns whether the entry is younger than the TTL. The caller
+// must hold the lock.
+func (c *TokenCache) freshLocked(e *configEntry) bool {
+	return c.ttl <= 0 || c.now().Sub(e.created) < c.ttl
+}
+
+// ConfigCache caches the Tokens constructed from the AADConfigs parsed from
+// Azure authentication files across reconciliations, which saves parsing the
+// files and constructing the credentials on every reconciliation. The entries
+// are identified by the source of the file (e.g. the namespaced name of a
+// Secret) and invalidated when its version (e.g. the resourceVersion of the
+// Secret) changes, or once their TTL elapsed. When the cache is full, the
+// least recently used entry is evicted. It also caches the Token of the
+// default credential of the controller. It is safe for concurrent use.
+type ConfigCache struct {
+	size int
+	// ttl is the maximum age of the entries. When zero, the entries do
+	// not expire.
+	ttl time.Duration
+	// load parses the Azure authentication file, and is replaced in tests.
+	load func(b []byte, s *AADConfig) error
+	// now returns the current time. Defaults to time.Now.
+	now func() time.Time
+	// newDefaultCredential constructs the default credential, and is
+	// replaced in tests.
+	newDefaultCredential func() (azcore.TokenCredential, error)
+
+	mu      sync.Mutex
+	entries *lru.Cache[string, *configEntry]
+	// defaultEntry holds the Token of the default credential, if any.
+	defaultEntry *configEntry
+}
+
+type configEntry struct {
+	version string
+	token   *Token
+	created time.Time
+}
+
+// NewConfigCache returns a new empty ConfigCache holding at most size
+// entries.
+func NewConfigCache(size int) *ConfigCache {
+	return &ConfigCache{
+		size:                 size,
+		load:                 LoadAADConfigFromBytes,
+		now:                  time.Now,
+		newDefaultCredential: getDefaultAzureCredential,
+		entries:              lru.New[string, *configEntry](size),
+	}
+}
+
+// SetTTL configures the maximum age of the cached Tokens, after which they
+// are constructed again, e.g. to pick up the changes of the environment of
+// the default credential. A TTL of zero disables the expiry.
+func (c *ConfigCache) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// DefaultToken returns the Token of the default credential of the
+// controller, which authenticates the requests when no Azure authentication
+// file is configured. The Token is constructed once and shared until its TTL
+// elapsed, for its credential to acquire the access tokens once for all the
+// reconciliations. The credential is constructed without holding the lock,
+// and the Token cached meanwhile, if any, is returned instead. A nil or zero
+// size ConfigCache returns a nil Token, with which the default credential is
+// constructed for every request.
+func (c *ConfigCache) DefaultToken() (*Token, error) {
+	if c == nil || c.size <= 0 {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	if e := c.defaultEntry; e != nil && c.freshLocked(e) {
+		c.mu.Unlock()
+		return e.token, nil
+	}
+	c.mu.Unlock()
+
+	creds, err := c.newDefaultCredential()
+	if err != nil {
+		return nil, err
+	}
+	token := NewToken(creds)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.defaultEntry; e != nil && c.freshLocked(e) {
+		return e.token, nil
+	}
+	c.defaultEntry = &configEntry{token: token, created: c.now()}
+	return token, nil
+}
+
+// freshLocked returns whether the entry is younger than the TTL. The caller
+// must hold the lock.
+func (c *ConfigCache) freshLocked(e *configEntry) bool {
+	return c.ttl <= 0 || c.now().Sub(e.created) < c.ttl
+}
+
+// TokenFromAuthFile returns the Token for the Azure authentication file b,
+// read from the source identified by key at the given version. The Token
+// cached for the same key and version is reused until its TTL elapsed,
+// otherwise the file is parsed with LoadAADConfigFromBytes and the Token
+// constructed with tokens.TokenFromAADConfig is cached. Without a version,
+// or for a nil or zero size ConfigCache, the file is parsed on every call.
+// The file is parsed and the Token constructed without holding the lock, and
+// the Token cached for the key and version meanwhile, if any, is returned
+// instead. Errors are not cached.
+func (c *ConfigCache) TokenFromAuthFile(key, version string, b []byte, tokens *TokenCache) (*Token, error) {
+	load := LoadAADConfigFromBytes
+	if c != nil {
+		load = c.load
+	}
+	if c == nil || c.size <= 0 || version == "" {
+		conf := AADConfig{}
+		if err := load(b, &conf); err != nil {
+			return nil, err
+		}
+		return tokens.TokenFromAADConfig(conf)
+	}
+
+	if token, ok := c.get(key, version); ok {
+		return token, nil
+	}
+	conf := AADConfig{}
+	if err := load(b, &conf); err != nil {
+		return nil, err
+	}
+	token, err := tokens.TokenFromAADConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries.Get(key); ok && e.version == version && c.freshLocked(e) {
+		return e.token, nil
+	}
+	c.entries.Add(key, &configEntry{version: version, token: token, created: c.now()})
+	return token, nil
+}
+
+// get returns the Token cached for the key at the version, if it is younger
+// than the TTL.
+func (c *ConfigCache) get(key, version string) (*Token, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries.Get(key)
+	if !ok || e.version != version || !c.freshLocked(e) {
+		return nil, false
+	}
+	return e.token, true
+}
+
+// TokenFromAuthFilePath returns the Token for the Azure authentication file
+// at the given path, e.g. in a projected volume, as TokenFromAuthFile. The
+// file is identified by its path, and its version by its modification time
+// and size, which change when the volume is updated. It returns an error if
+// the file does not exist or can't be read.
+func (c *ConfigCache) TokenFromAuthFilePath(path string, tokens *TokenCache) (*Token, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("Azure authentication file '%s' does not exist", path)
+		}
+		return nil, fmt.Errorf("failed to stat Azure authentication file '%s': %w", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("failed to read Azure authentication file '%s': not a regular file", path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Azure authentication file '%s': %w", path, err)
+	}
+	version := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+	return c.TokenFromAuthFile("file:"+path, version, b, tokens)
+}
+
+// cacheKey returns the key identifying the credential of the AADConfig in a
+// TokenCache. The secret fields are only included as a digest, to tell
+// configurations apart without holding on to the secrets.
+func (s AADConfig) cacheKey() string {
+	h := sha256.New()
+	for _, v := range []string{s.ClientSecret, s.ClientCertificate, s.ClientCertificatePassword, s.Password} {
+		// Prefix the length of the values to avoid ambiguous concatenations.
+		h.Write([]byte(strconv.Itoa(len(v)) + ":" + v))
+	}
+	return strings.Join([]string{
+		s.TenantID,
+		s.ClientID,
+		s.ManagedIdentityResourceID,
+		strconv.FormatBool(s.WorkloadIdentity),
+		s.Tenant,
+		s.AppID,
+		strings.Join(s.AuthorityHosts(), ","),
+		s.Cloud,
+		s.VaultDNSSuffix,
+		strconv.FormatBool(s.ClientCertificateSendChain),
+		strconv.FormatBool(s.NoDefaultCredential),
+		strconv.FormatBool(s.AllowWorkloadIdentity),
+		hex.EncodeToString(h.Sum(nil)),
+	}, "\x00")
 }
 
 // GetCloudConfig returns a cloud.Configuration with the AuthorityHost, or the
 // Azure Public Cloud default.
 func (s AADConfig) GetCloudConfig() cloud.Configuration {
 	if s.AuthorityHost != "" {
-		return cloud.Configuration{
-			ActiveDirectoryAuthorityHost: s.AuthorityHost,
-			Services:                     map[cloud.ServiceName]cloud.ServiceConfiguration{},
-		}
+		return cloudConfigForHost(s.AuthorityHost)
 	}
 	return cloud.AzurePublic
 }
+
+// AuthorityHosts returns the AuthorityHost followed by the
+// FallbackAuthorityHosts, leaving out the empty ones.
+func (s AADConfig) AuthorityHosts() []string {
+	var hosts []string
+	for _, h := range append([]string{s.AuthorityHost}, s.FallbackAuthorityHosts...) {
+		if h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// GetCloudConfigs returns a cloud.Configuration for each of the
+// AuthorityHosts in order, or the Azure Public Cloud default.
+func (s AADConfig) GetCloudConfigs() []cloud.Configuration {
+	hosts := s.AuthorityHosts()
+	if len(hosts) == 0 {
+		return []cloud.Configuration{cloud.AzurePublic}
+	}
+	configs := make([]cloud.Configuration, 0, len(hosts))
+	for _, h := range hosts {
+		configs = append(configs, cloudConfigForHost(h))
+	}
+	return configs
+}
+
+// GetVaultDNSSuffixes returns the VaultDNSSuffix, or the DNS suffixes of the
+// vaults and managed HSMs of the cloud of the AuthorityHost. It returns nil
+// for an authority host of an unknown cloud, and without AuthorityHost, as
+// the vault URLs are not validated against the Azure Public Cloud default.
+func (s AADConfig) GetVaultDNSSuffixes() []string {
+	if s.VaultDNSSuffix != "" {
+		return []string{strings.TrimPrefix(s.VaultDNSSuffix, ".")}
+	}
+	if s.AuthorityHost == "" {
+		return nil
+	}
+	return vaultSuffixesForAuthorityHost(s.AuthorityHost)
+}
+
+// cloudConfigForHost returns a cloud.Configuration with the authority host.
+func cloudConfigForHost(host string) cloud.Configuration {
+	return cloud.Configuration{
+		ActiveDirectoryAuthorityHost: host,
+		Services:                     map[cloud.ServiceName]cloud.ServiceConfiguration{},
+	}
+}
@@ -8,15 +8,25 @@ package azkv
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	. "github.com/onsi/gomega"
 )
@@ -50,6 +60,19 @@ clientCertificate: "some-client-certificate"`),
 				ClientCertificate: "some-client-certificate",
 			},
 		},
+		{
+			name: "cloud preset",
+			b: []byte(`tenantId: "some-tenant-id"
+clientId: "some-client-id"
+clientSecret: "some-client-secret"
+cloud: "AzureChina"`),
+			want: AADConfig{
+				TenantID:     "some-tenant-id",
+				ClientID:     "some-client-id",
+				ClientSecret: "some-client-secret",
+				Cloud:        "AzureChina",
+			},
+		},
 		{
 			name: "Managed Identity with Client ID",
 			b:    []byte(`clientId: "some-client-id"`),
@@ -57,6 +80,13 @@ clientCertificate: "some-client-certificate"`),
 				ClientID: "some-client-id",
 			},
 		},
+		{
+			name: "Managed Identity with Resource ID",
+			b:    []byte(`managedIdentityResourceId: "some-resource-id"`),
+			want: AADConfig{
+				ManagedIdentityResourceID: "some-resource-id",
+			},
+		},
 		{
 			name: "Service Principal with Secret from az CLI",
 			b:    []byte(`{"appId": "some-app-id", "tenant": "some-tenant", "password": "some-password"}`),
@@ -75,6 +105,26 @@ clientCertificate: "some-client-certificate"`),
 				AuthorityHost: "https://example.com",
 			},
 		},
+		{
+			name: "Authority host list",
+			b:    []byte("authorityHost:\n- https://primary.example.com\n- https://secondary.example.com\n"),
+			want: AADConfig{
+				AuthorityHost:          "https://primary.example.com",
+				FallbackAuthorityHosts: []string{"https://secondary.example.com"},
+			},
+		},
+		{
+			name: "Authority host list with a single host",
+			b:    []byte(`{"authorityHost": ["https://example.com"]}`),
+			want: AADConfig{
+				AuthorityHost: "https://example.com",
+			},
+		},
+		{
+			name:    "invalid authority host",
+			b:       []byte(`{"authorityHost": {"host": "https://example.com"}}`),
+			wantErr: true,
+		},
 		{
 			name:    "invalid",
 			b:       []byte("some string"),
@@ -100,6 +150,10 @@ clientCertificate: "some-client-certificate"`),
 
 func TestTokenFromAADConfig(t *testing.T) {
 	tlsMock := validTLS(t)
+	pfxMock, err := os.ReadFile("testdata/certificate.pfx")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	tests := []struct {
 		name    string
@@ -125,6 +179,36 @@ func TestTokenFromAADConfig(t *testing.T) {
 			},
 			want: &azidentity.ClientCertificateCredential{},
 		},
+		{
+			name: "Service Principal with PKCS12 Certificate sending the chain",
+			config: AADConfig{
+				TenantID:                   "some-tenant-id",
+				ClientID:                   "some-client-id",
+				ClientCertificate:          string(pfxMock),
+				ClientCertificatePassword:  "password",
+				ClientCertificateSendChain: true,
+			},
+			want: &azidentity.ClientCertificateCredential{},
+		},
+		{
+			name: "Service Principal with base64 encoded PKCS12 Certificate",
+			config: AADConfig{
+				TenantID:                  "some-tenant-id",
+				ClientID:                  "some-client-id",
+				ClientCertificate:         base64.StdEncoding.EncodeToString(pfxMock),
+				ClientCertificatePassword: "password",
+			},
+			want: &azidentity.ClientCertificateCredential{},
+		},
+		{
+			name: "Service Principal with unparseable Certificate",
+			config: AADConfig{
+				TenantID:          "some-tenant-id",
+				ClientID:          "some-client-id",
+				ClientCertificate: "invalid",
+			},
+			wantErr: true,
+		},
 		{
 			name: "Service Principal with az CLI format",
 			config: AADConfig{
@@ -143,6 +227,41 @@ func TestTokenFromAADConfig(t *testing.T) {
 			},
 			want: &azidentity.ManagedIdentityCredential{},
 		},
+		{
+			name: "Managed Identity with Resource ID",
+			config: AADConfig{
+				ManagedIdentityResourceID: "/subscriptions/some-subscription/resourceGroups/some-group/providers/Microsoft.ManagedIdentity/userAssignedIdentities/some-identity",
+			},
+			want: &azidentity.ManagedIdentityCredential{},
+		},
+		{
+			name: "Managed Identity with both Client ID and Resource ID",
+			config: AADConfig{
+				ClientID:                  "some-client-id",
+				ManagedIdentityResourceID: "some-resource-id",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Service Principal with fallback authority hosts",
+			config: AADConfig{
+				TenantID:               "some-tenant-id",
+				ClientID:               "some-client-id",
+				ClientSecret:           "some-client-secret",
+				AuthorityHost:          "https://primary.example.com",
+				FallbackAuthorityHosts: []string{"https://secondary.example.com"},
+			},
+			want: &authorityHostsCredential{},
+		},
+		{
+			name: "Managed Identity ignores fallback authority hosts",
+			config: AADConfig{
+				ClientID:               "some-client-id",
+				AuthorityHost:          "https://primary.example.com",
+				FallbackAuthorityHosts: []string{"https://secondary.example.com"},
+			},
+			want: &azidentity.ManagedIdentityCredential{},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -151,7 +270,7 @@ func TestTokenFromAADConfig(t *testing.T) {
 			got, err := TokenFromAADConfig(tt.config)
 			if tt.wantErr {
 				g.Expect(err).To(HaveOccurred())
-				g.Expect(got.token).To(BeNil())
+				g.Expect(got).To(BeNil())
 				return
 			}
 
@@ -162,6 +281,515 @@ func TestTokenFromAADConfig(t *testing.T) {
 	}
 }
 
+func TestAADConfig_Validate(t *testing.T) {
+	t.Setenv(tenantIDEnvVar, "")
+	t.Setenv(clientIDEnvVar, "")
+	t.Setenv(federatedTokenFileEnvVar, "")
+
+	tests := []struct {
+		name    string
+		config  AADConfig
+		wantErr string
+	}{
+		{
+			name: "Service Principal with Secret",
+			config: AADConfig{
+				TenantID:     "some-tenant-id",
+				ClientID:     "some-client-id",
+				ClientSecret: "some-client-secret",
+			},
+		},
+		{
+			name: "Service Principal with Certificate",
+			config: AADConfig{
+				TenantID:          "some-tenant-id",
+				ClientID:          "some-client-id",
+				ClientCertificate: string(validTLS(t)),
+			},
+		},
+		{
+			name: "Service Principal with unparseable Certificate",
+			config: AADConfig{
+				TenantID:          "some-tenant-id",
+				ClientID:          "some-client-id",
+				ClientCertificate: "invalid",
+			},
+			wantErr: "failed to parse",
+		},
+		{
+			name: "Service Principal with az CLI format",
+			config: AADConfig{
+				AZConfig: AZConfig{
+					AppID:    "some-app-id",
+					Tenant:   "some-tenant",
+					Password: "some-password",
+				},
+			},
+		},
+		{
+			name: "Managed Identity with Client ID",
+			config: AADConfig{
+				ClientID: "some-client-id",
+			},
+		},
+		{
+			name: "Managed Identity with Resource ID",
+			config: AADConfig{
+				ManagedIdentityResourceID: "some-resource-id",
+			},
+		},
+		{
+			name: "Managed Identity with both Client ID and Resource ID",
+			config: AADConfig{
+				ClientID:                  "some-client-id",
+				ManagedIdentityResourceID: "some-resource-id",
+			},
+			wantErr: "only one of 'clientId' or 'managedIdentityResourceId' can be set",
+		},
+		{
+			name: "Managed Identity without default credential",
+			config: AADConfig{
+				ClientID:            "some-client-id",
+				NoDefaultCredential: true,
+			},
+			wantErr: "managed identity 'some-client-id' can not be used, the default credential of the controller is disabled",
+		},
+		{
+			name: "Managed Identity with Resource ID without default credential",
+			config: AADConfig{
+				ManagedIdentityResourceID: "some-resource-id",
+				NoDefaultCredential:       true,
+			},
+			wantErr: "managed identity 'some-resource-id' can not be used, the default credential of the controller is disabled",
+		},
+		{
+			name: "Service Principal without default credential",
+			config: AADConfig{
+				TenantID:            "some-tenant-id",
+				ClientID:            "some-client-id",
+				ClientSecret:        "some-client-secret",
+				NoDefaultCredential: true,
+			},
+		},
+		{
+			name: "Workload Identity without the federated token file",
+			config: AADConfig{
+				TenantID:              "some-tenant-id",
+				ClientID:              "some-client-id",
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+			},
+			wantErr: "'workloadIdentity' requires the AZURE_FEDERATED_TOKEN_FILE environment variable",
+		},
+		{
+			name: "unknown cloud",
+			config: AADConfig{
+				ClientID: "some-client-id",
+				Cloud:    "AzureMoon",
+			},
+			wantErr: "unknown 'cloud' 'AzureMoon'",
+		},
+		{
+			name: "Service Principal without credentials",
+			config: AADConfig{
+				TenantID: "some-tenant-id",
+			},
+			wantErr: "invalid data: requires a 'clientId' or 'managedIdentityResourceId' field",
+		},
+		{
+			name:    "empty",
+			wantErr: "invalid data: requires a 'clientId' or 'managedIdentityResourceId' field",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := tt.config.Validate()
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
+
+func TestTokenFromAADConfig_EnvDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		config  AADConfig
+		want    azcore.TokenCredential
+		wantErr bool
+	}{
+		{
+			name: "Service Principal with tenant and client ID from env",
+			env: map[string]string{
+				tenantIDEnvVar: "env-tenant-id",
+				clientIDEnvVar: "env-client-id",
+			},
+			config: AADConfig{
+				ClientSecret: "some-client-secret",
+			},
+			want: &azidentity.ClientSecretCredential{},
+		},
+		{
+			name: "Service Principal with client ID from env",
+			env: map[string]string{
+				clientIDEnvVar: "env-client-id",
+			},
+			config: AADConfig{
+				TenantID:     "some-tenant-id",
+				ClientSecret: "some-client-secret",
+			},
+			want: &azidentity.ClientSecretCredential{},
+		},
+		{
+			name: "Managed Identity without client ID from env",
+			env: map[string]string{
+				clientIDEnvVar: "env-client-id",
+			},
+			config:  AADConfig{},
+			wantErr: true,
+		},
+		{
+			name: "Service Principal without tenant ID",
+			env: map[string]string{
+				clientIDEnvVar: "env-client-id",
+			},
+			config: AADConfig{
+				ClientSecret: "some-client-secret",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Managed Identity with Resource ID ignores client ID from env",
+			env: map[string]string{
+				clientIDEnvVar: "env-client-id",
+			},
+			config: AADConfig{
+				ManagedIdentityResourceID: "some-resource-id",
+			},
+			want: &azidentity.ManagedIdentityCredential{},
+		},
+		{
+			name: "Managed Identity without default credential",
+			config: AADConfig{
+				ClientID:            "some-client-id",
+				NoDefaultCredential: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Managed Identity with Resource ID without default credential",
+			config: AADConfig{
+				ManagedIdentityResourceID: "some-resource-id",
+				NoDefaultCredential:       true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Service Principal without defaults from env",
+			env: map[string]string{
+				tenantIDEnvVar: "env-tenant-id",
+				clientIDEnvVar: "env-client-id",
+			},
+			config: AADConfig{
+				ClientSecret:        "some-client-secret",
+				NoDefaultCredential: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid without env",
+			config: AADConfig{
+				ClientSecret: "some-client-secret",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			t.Setenv(tenantIDEnvVar, tt.env[tenantIDEnvVar])
+			t.Setenv(clientIDEnvVar, tt.env[clientIDEnvVar])
+
+			got, err := TokenFromAADConfig(tt.config)
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(got).To(BeNil())
+				return
+			}
+
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got.token).ToNot(BeNil())
+			g.Expect(got.token).To(BeAssignableToTypeOf(tt.want))
+		})
+	}
+}
+
+func TestTokenFromAADConfig_Cloud(t *testing.T) {
+	g := NewWithT(t)
+
+	got, err := TokenFromAADConfig(AADConfig{
+		TenantID:     "some-tenant-id",
+		ClientID:     "some-client-id",
+		ClientSecret: "some-client-secret",
+		Cloud:        "AzureGovernment",
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got.token).To(BeAssignableToTypeOf(&azidentity.ClientSecretCredential{}))
+	g.Expect(got.vaultSuffixes).To(Equal([]string{"vault.usgovcloudapi.net", "managedhsm.usgovcloudapi.net"}))
+
+	_, err = TokenFromAADConfig(AADConfig{
+		TenantID:      "some-tenant-id",
+		ClientID:      "some-client-id",
+		ClientSecret:  "some-client-secret",
+		AuthorityHost: "https://login.microsoftonline.com/",
+		Cloud:         "AzureChina",
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("is not the one of the 'cloud' 'AzureChina'"))
+}
+
+func TestTokenFromAADConfig_WorkloadIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+	if err := os.WriteFile(tokenFile, []byte("federated-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		config       AADConfig
+		wantSuffixes []string
+		wantErr      string
+	}{
+		{
+			name: "Workload Identity",
+			env: map[string]string{
+				federatedTokenFileEnvVar: tokenFile,
+			},
+			config: AADConfig{
+				TenantID:              "some-tenant-id",
+				ClientID:              "some-client-id",
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+			},
+		},
+		{
+			name: "Workload Identity with tenant ID and authority host from env",
+			env: map[string]string{
+				tenantIDEnvVar:           "env-tenant-id",
+				clientIDEnvVar:           "env-client-id",
+				federatedTokenFileEnvVar: tokenFile,
+				authorityHostEnvVar:      "https://login.chinacloudapi.cn/",
+			},
+			config: AADConfig{
+				ClientID:              "some-client-id",
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+			},
+			wantSuffixes: []string{"vault.azure.cn", "managedhsm.azure.cn"},
+		},
+		{
+			name: "Workload Identity without client ID from env",
+			env: map[string]string{
+				tenantIDEnvVar:           "env-tenant-id",
+				clientIDEnvVar:           "env-client-id",
+				federatedTokenFileEnvVar: tokenFile,
+			},
+			config: AADConfig{
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+			},
+			wantErr: "'workloadIdentity' requires the 'tenantId' and 'clientId' fields",
+		},
+		{
+			name: "Workload Identity without federated token file",
+			config: AADConfig{
+				TenantID:              "some-tenant-id",
+				ClientID:              "some-client-id",
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+			},
+			wantErr: "requires the AZURE_FEDERATED_TOKEN_FILE environment variable",
+		},
+		{
+			name: "Workload Identity without client ID",
+			env: map[string]string{
+				federatedTokenFileEnvVar: tokenFile,
+			},
+			config: AADConfig{
+				TenantID:              "some-tenant-id",
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+			},
+			wantErr: "'workloadIdentity' requires the 'tenantId' and 'clientId' fields",
+		},
+		{
+			name: "Workload Identity with client secret",
+			env: map[string]string{
+				federatedTokenFileEnvVar: tokenFile,
+			},
+			config: AADConfig{
+				TenantID:              "some-tenant-id",
+				ClientID:              "some-client-id",
+				ClientSecret:          "some-client-secret",
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+			},
+			wantErr: "'workloadIdentity' can not be combined with other credentials",
+		},
+		{
+			name: "Workload Identity with authority host",
+			env: map[string]string{
+				federatedTokenFileEnvVar: tokenFile,
+			},
+			config: AADConfig{
+				TenantID:              "some-tenant-id",
+				ClientID:              "some-client-id",
+				AuthorityHost:         "https://login.example.com",
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+			},
+			wantErr: "'workloadIdentity' can not be combined with 'authorityHost'",
+		},
+		{
+			name: "Workload Identity not allowed",
+			env: map[string]string{
+				federatedTokenFileEnvVar: tokenFile,
+			},
+			config: AADConfig{
+				TenantID:         "some-tenant-id",
+				ClientID:         "some-client-id",
+				WorkloadIdentity: true,
+			},
+			wantErr: "'workloadIdentity' is not allowed by the controller",
+		},
+		{
+			name: "Workload Identity without default credential",
+			env: map[string]string{
+				federatedTokenFileEnvVar: tokenFile,
+			},
+			config: AADConfig{
+				TenantID:              "some-tenant-id",
+				ClientID:              "some-client-id",
+				WorkloadIdentity:      true,
+				AllowWorkloadIdentity: true,
+				NoDefaultCredential:   true,
+			},
+			wantErr: "'workloadIdentity' can not be used, the default credential of the controller is disabled",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			for _, k := range []string{tenantIDEnvVar, clientIDEnvVar, federatedTokenFileEnvVar, authorityHostEnvVar} {
+				t.Setenv(k, tt.env[k])
+			}
+
+			got, err := TokenFromAADConfig(tt.config)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				g.Expect(got).To(BeNil())
+				return
+			}
+
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got.token).To(BeAssignableToTypeOf(&azidentity.WorkloadIdentityCredential{}))
+			g.Expect(got.vaultSuffixes).To(Equal(tt.wantSuffixes))
+		})
+	}
+}
+
+func TestAADConfig_withEnvDefaults(t *testing.T) {
+	g := NewWithT(t)
+
+	t.Setenv(tenantIDEnvVar, "env-tenant-id")
+	t.Setenv(clientIDEnvVar, "env-client-id")
+
+	g.Expect(AADConfig{}.withEnvDefaults()).To(Equal(AADConfig{
+		TenantID: "env-tenant-id",
+	}))
+	g.Expect(AADConfig{
+		ClientSecret: "some-client-secret",
+	}.withEnvDefaults()).To(Equal(AADConfig{
+		TenantID:     "env-tenant-id",
+		ClientID:     "env-client-id",
+		ClientSecret: "some-client-secret",
+	}))
+	g.Expect(AADConfig{
+		WorkloadIdentity: true,
+	}.withEnvDefaults()).To(Equal(AADConfig{
+		TenantID:         "env-tenant-id",
+		WorkloadIdentity: true,
+	}))
+	g.Expect(AADConfig{
+		ClientSecret:        "some-client-secret",
+		NoDefaultCredential: true,
+	}.withEnvDefaults()).To(Equal(AADConfig{
+		ClientSecret:        "some-client-secret",
+		NoDefaultCredential: true,
+	}))
+	g.Expect(AADConfig{
+		TenantID: "some-tenant-id",
+		ClientID: "some-client-id",
+	}.withEnvDefaults()).To(Equal(AADConfig{
+		TenantID: "some-tenant-id",
+		ClientID: "some-client-id",
+	}))
+	g.Expect(AADConfig{
+		ManagedIdentityResourceID: "some-resource-id",
+	}.withEnvDefaults()).To(Equal(AADConfig{
+		TenantID:                  "env-tenant-id",
+		ManagedIdentityResourceID: "some-resource-id",
+	}))
+}
+
+func TestAADConfig_String(t *testing.T) {
+	g := NewWithT(t)
+
+	tlsMock := validTLS(t)
+	conf := AADConfig{
+		AZConfig: AZConfig{
+			AppID:    "some-app-id",
+			Tenant:   "some-tenant",
+			Password: "some-password",
+		},
+		TenantID:                  "some-tenant-id",
+		ClientID:                  "some-client-id",
+		ClientSecret:              "some-client-secret",
+		ClientCertificate:         string(tlsMock),
+		ClientCertificatePassword: "some-certificate-password",
+		AuthorityHost:             "https://primary.example.com",
+		FallbackAuthorityHosts:    []string{"https://secondary.example.com"},
+	}
+	secrets := []string{"some-password", "some-client-secret", "some-certificate-password", string(tlsMock), "PRIVATE KEY"}
+
+	for _, format := range []string{"%s", "%v", "%+v", "%#v"} {
+		for _, v := range []interface{}{conf, &conf, conf.AZConfig, &conf.AZConfig} {
+			out := fmt.Sprintf(format, v)
+			for _, secret := range secrets {
+				g.Expect(out).ToNot(ContainSubstring(secret), "format %s of %T", format, v)
+			}
+			g.Expect(out).To(ContainSubstring(redactedValue))
+		}
+	}
+
+	g.Expect(conf.String()).To(Equal(`AADConfig{TenantID: "some-tenant-id", ClientID: "some-client-id", ManagedIdentityResourceID: "", ` +
+		`WorkloadIdentity: false, ClientSecret: <redacted>, ClientCertificate: <redacted>, ClientCertificatePassword: <redacted>, ` +
+		`ClientCertificateSendChain: false, AuthorityHost: "https://primary.example.com", ` +
+		`FallbackAuthorityHosts: ["https://secondary.example.com"], Cloud: "", VaultDNSSuffix: "", ` +
+		`AZConfig: AZConfig{AppID: "some-app-id", Tenant: "some-tenant", Password: <redacted>}}`))
+	g.Expect(AADConfig{ClientID: "some-client-id"}.String()).To(ContainSubstring(`ClientSecret: "", ClientCertificate: ""`))
+}
+
 func TestAADConfig_GetCloudConfig(t *testing.T) {
 	g := NewWithT(t)
 
@@ -172,6 +800,621 @@ func TestAADConfig_GetCloudConfig(t *testing.T) {
 	}))
 }
 
+func TestAADConfig_GetCloudConfigs(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect((AADConfig{}).GetCloudConfigs()).To(Equal([]cloud.Configuration{cloud.AzurePublic}))
+	g.Expect((AADConfig{
+		AuthorityHost:          "https://primary.example.com",
+		FallbackAuthorityHosts: []string{"", "https://secondary.example.com"},
+	}).GetCloudConfigs()).To(Equal([]cloud.Configuration{
+		{
+			ActiveDirectoryAuthorityHost: "https://primary.example.com",
+			Services:                     map[cloud.ServiceName]cloud.ServiceConfiguration{},
+		},
+		{
+			ActiveDirectoryAuthorityHost: "https://secondary.example.com",
+			Services:                     map[cloud.ServiceName]cloud.ServiceConfiguration{},
+		},
+	}))
+}
+
+// hostCredential is an azcore.TokenCredential returning a token, or err if
+// set, and counting the requests.
+type hostCredential struct {
+	token    string
+	err      error
+	requests int
+}
+
+func (c *hostCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.requests++
+	if c.err != nil {
+		return azcore.AccessToken{}, c.err
+	}
+	return azcore.AccessToken{Token: c.token}, nil
+}
+
+func TestAuthorityHostsCredential_GetToken(t *testing.T) {
+	t.Run("falls back to the next host", func(t *testing.T) {
+		g := NewWithT(t)
+
+		primary := &hostCredential{err: errors.New("tenant not found")}
+		secondary := &hostCredential{token: "secondary"}
+		c := &authorityHostsCredential{
+			hosts:       []string{"https://primary.example.com", "https://secondary.example.com"},
+			credentials: []azcore.TokenCredential{primary, secondary},
+		}
+
+		token, err := c.GetToken(context.Background(), policy.TokenRequestOptions{})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(token.Token).To(Equal("secondary"))
+
+		// The usable host is tried first on the next request.
+		token, err = c.GetToken(context.Background(), policy.TokenRequestOptions{})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(token.Token).To(Equal("secondary"))
+		g.Expect(primary.requests).To(Equal(1))
+		g.Expect(secondary.requests).To(Equal(2))
+	})
+
+	t.Run("aggregates the errors of all hosts", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := &authorityHostsCredential{
+			hosts: []string{"https://primary.example.com", "https://secondary.example.com"},
+			credentials: []azcore.TokenCredential{
+				&hostCredential{err: errors.New("tenant not found")},
+				&hostCredential{err: errors.New("invalid client secret")},
+			},
+		}
+
+		_, err := c.GetToken(context.Background(), policy.TokenRequestOptions{})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("failed to acquire a token from any authority host"))
+		g.Expect(err.Error()).To(ContainSubstring("authority host 'https://primary.example.com': tenant not found"))
+		g.Expect(err.Error()).To(ContainSubstring("authority host 'https://secondary.example.com': invalid client secret"))
+	})
+
+	t.Run("uses the hosts of the config", func(t *testing.T) {
+		g := NewWithT(t)
+
+		token, err := TokenFromAADConfig(AADConfig{
+			TenantID:               "some-tenant-id",
+			ClientID:               "some-client-id",
+			ClientSecret:           "some-client-secret",
+			AuthorityHost:          "https://primary.example.com",
+			FallbackAuthorityHosts: []string{"https://secondary.example.com"},
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(token.token).To(BeAssignableToTypeOf(&authorityHostsCredential{}))
+
+		c := token.token.(*authorityHostsCredential)
+		g.Expect(c.hosts).To(Equal([]string{"https://primary.example.com", "https://secondary.example.com"}))
+		g.Expect(c.credentials).To(HaveLen(2))
+		for _, cred := range c.credentials {
+			g.Expect(cred).To(BeAssignableToTypeOf(&azidentity.ClientSecretCredential{}))
+		}
+	})
+}
+
+func TestTokenCache_TokenFromAADConfig(t *testing.T) {
+	conf := AADConfig{
+		TenantID:     "tenant",
+		ClientID:     "client",
+		ClientSecret: "secret",
+	}
+
+	t.Run("shares the credential of identical configs", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := NewTokenCache(10)
+		first, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		second, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).To(BeIdenticalTo(first))
+
+		key1, key2 := MasterKeyFromURL("https://a.vault.azure.net", "key1", "1"),
+			MasterKeyFromURL("https://a.vault.azure.net", "key2", "1")
+		first.ApplyToMasterKey(key1)
+		second.ApplyToMasterKey(key2)
+		g.Expect(key1.token).ToNot(BeNil())
+		g.Expect(key2.token).To(BeIdenticalTo(key1.token))
+	})
+
+	t.Run("does not share the credential of different configs", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := NewTokenCache(10)
+		first, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		for _, other := range []AADConfig{
+			{TenantID: "tenant", ClientID: "client", ClientSecret: "other"},
+			{TenantID: "other", ClientID: "client", ClientSecret: "secret"},
+			{TenantID: "tenant", ClientID: "client", ClientSecret: "secret", AuthorityHost: "https://example.com"},
+			{TenantID: "tenant", ClientID: "client", ClientSecret: "secret", AuthorityHost: "https://example.com",
+				FallbackAuthorityHosts: []string{"https://fallback.example.com"}},
+		} {
+			got, err := c.TokenFromAADConfig(other)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).ToNot(BeIdenticalTo(first))
+			g.Expect(got.token).ToNot(BeIdenticalTo(first.token))
+		}
+	})
+
+	t.Run("disables the defaults of the environment", func(t *testing.T) {
+		g := NewWithT(t)
+
+		t.Setenv(tenantIDEnvVar, "env-tenant-id")
+		t.Setenv(clientIDEnvVar, "env-client-id")
+
+		c := NewTokenCache(10)
+		_, err := c.TokenFromAADConfig(AADConfig{ClientSecret: "secret"})
+		g.Expect(err).ToNot(HaveOccurred())
+
+		c = NewTokenCache(10)
+		c.SetDisableDefaultCredential(true)
+		_, err = c.TokenFromAADConfig(AADConfig{ClientSecret: "secret"})
+		g.Expect(err).To(HaveOccurred())
+		got, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got.id).To(Equal(AADConfig{TenantID: "tenant", ClientID: "client", ClientSecret: "secret",
+			NoDefaultCredential: true}.cacheKey()))
+	})
+
+	t.Run("allows the workload identity", func(t *testing.T) {
+		g := NewWithT(t)
+
+		tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+		g.Expect(os.WriteFile(tokenFile, []byte("federated-token"), 0o600)).To(Succeed())
+		t.Setenv(federatedTokenFileEnvVar, tokenFile)
+		wi := AADConfig{TenantID: "tenant", ClientID: "client", WorkloadIdentity: true}
+
+		c := NewTokenCache(10)
+		_, err := c.TokenFromAADConfig(wi)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("'workloadIdentity' is not allowed by the controller"))
+
+		c = NewTokenCache(10)
+		c.SetAllowWorkloadIdentity(true)
+		got, err := c.TokenFromAADConfig(wi)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got.token).To(BeAssignableToTypeOf(&azidentity.WorkloadIdentityCredential{}))
+	})
+
+	t.Run("does not cache failures", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := NewTokenCache(10)
+		_, err := c.TokenFromAADConfig(AADConfig{})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(c.tokens.Len()).To(BeZero())
+	})
+
+	t.Run("does not hold the lock while probing the IMDS", func(t *testing.T) {
+		g := NewWithT(t)
+
+		probing, release := make(chan struct{}), make(chan struct{})
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(probing)
+			<-release
+		}))
+		defer s.Close()
+		defer close(release)
+
+		c := NewTokenCache(10)
+		c.ProbeIMDS(NewIMDSProbe(time.Minute))
+		c.imdsProbe.endpoint = s.URL
+		go func() {
+			_, _ = c.TokenFromAADConfig(AADConfig{ClientID: "managed-identity"})
+		}()
+		<-probing
+
+		done := make(chan error)
+		go func() {
+			_, err := c.TokenFromAADConfig(conf)
+			done <- err
+		}()
+		g.Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+	})
+
+	t.Run("evicts the least recently used config", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := NewTokenCache(2)
+		first, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		other := AADConfig{TenantID: "other", ClientID: "client", ClientSecret: "secret"}
+		_, err = c.TokenFromAADConfig(other)
+		g.Expect(err).ToNot(HaveOccurred())
+		got, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(BeIdenticalTo(first))
+
+		_, err = c.TokenFromAADConfig(AADConfig{TenantID: "third", ClientID: "client", ClientSecret: "secret"})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c.tokens.Len()).To(Equal(2))
+		g.Expect(c.tokens.Keys()).To(ContainElement(conf.cacheKey()))
+		g.Expect(c.tokens.Keys()).ToNot(ContainElement(other.cacheKey()))
+	})
+
+	t.Run("constructs the credential again once the TTL elapsed", func(t *testing.T) {
+		g := NewWithT(t)
+
+		now := time.Now()
+		c := NewTokenCache(10)
+		c.SetTTL(time.Minute)
+		c.now = func() time.Time { return now }
+		first, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		now = now.Add(30 * time.Second)
+		got, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(BeIdenticalTo(first))
+
+		now = now.Add(time.Minute)
+		got, err = c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).ToNot(BeIdenticalTo(first))
+	})
+
+	t.Run("zero size cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := NewTokenCache(0)
+		first, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		second, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).ToNot(BeIdenticalTo(first))
+	})
+
+	t.Run("nil cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var c *TokenCache
+		first, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		second, err := c.TokenFromAADConfig(conf)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).ToNot(BeIdenticalTo(first))
+	})
+}
+
+func TestConfigCache_TokenFromAuthFile(t *testing.T) {
+	authFile := []byte(`tenantId: "tenant"
+clientId: "client"
+clientSecret: "secret"
+`)
+
+	newCache := func(size int) (*ConfigCache, *int) {
+		c := NewConfigCache(size)
+		loads := 0
+		c.load = func(b []byte, s *AADConfig) error {
+			loads++
+			return LoadAADConfigFromBytes(b, s)
+		}
+		return c, &loads
+	}
+
+	t.Run("reuses the token of an unchanged source", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, loads := newCache(10)
+		first, err := c.TokenFromAuthFile("ns/sops", "1", authFile, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		second, err := c.TokenFromAuthFile("ns/sops", "1", authFile, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).To(BeIdenticalTo(first))
+		g.Expect(*loads).To(Equal(1))
+	})
+
+	t.Run("parses the file of a changed source", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, loads := newCache(10)
+		first, err := c.TokenFromAuthFile("ns/sops", "1", authFile, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		second, err := c.TokenFromAuthFile("ns/sops", "2", authFile, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).ToNot(BeIdenticalTo(first))
+		g.Expect(*loads).To(Equal(2))
+
+		// The previous version is no longer cached.
+		_, err = c.TokenFromAuthFile("ns/sops", "1", authFile, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(*loads).To(Equal(3))
+	})
+
+	t.Run("parses the file without a version", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, loads := newCache(10)
+		for i := 0; i < 2; i++ {
+			_, err := c.TokenFromAuthFile("ns/sops", "", authFile, NewTokenCache(10))
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(*loads).To(Equal(2))
+		g.Expect(c.entries.Len()).To(BeZero())
+	})
+
+	t.Run("evicts the least recently used entry", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, loads := newCache(2)
+		for _, key := range []string{"ns/a", "ns/b", "ns/a", "ns/c"} {
+			_, err := c.TokenFromAuthFile(key, "1", authFile, NewTokenCache(10))
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(*loads).To(Equal(3))
+		g.Expect(c.entries.Len()).To(Equal(2))
+		g.Expect(c.entries.Keys()).To(ConsistOf("ns/a", "ns/c"))
+	})
+
+	t.Run("does not cache failures", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, loads := newCache(10)
+		for i := 0; i < 2; i++ {
+			_, err := c.TokenFromAuthFile("ns/sops", "1", []byte(`tenantId: "tenant"`), NewTokenCache(10))
+			g.Expect(err).To(HaveOccurred())
+		}
+		g.Expect(*loads).To(Equal(2))
+		g.Expect(c.entries.Len()).To(BeZero())
+	})
+
+	t.Run("does not hold the lock while constructing the token", func(t *testing.T) {
+		g := NewWithT(t)
+
+		loading, release := make(chan struct{}), make(chan struct{})
+		c := NewConfigCache(10)
+		c.load = func(b []byte, s *AADConfig) error {
+			if string(b) == "slow" {
+				close(loading)
+				<-release
+			}
+			return LoadAADConfigFromBytes(authFile, s)
+		}
+		defer close(release)
+		go func() {
+			_, _ = c.TokenFromAuthFile("ns/slow", "1", []byte("slow"), NewTokenCache(10))
+		}()
+		<-loading
+
+		done := make(chan error)
+		go func() {
+			_, err := c.TokenFromAuthFile("ns/sops", "1", authFile, NewTokenCache(10))
+			done <- err
+		}()
+		g.Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+	})
+
+	t.Run("nil cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var c *ConfigCache
+		first, err := c.TokenFromAuthFile("ns/sops", "1", authFile, nil)
+		g.Expect(err).ToNot(HaveOccurred())
+		second, err := c.TokenFromAuthFile("ns/sops", "1", authFile, nil)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).ToNot(BeIdenticalTo(first))
+	})
+
+	t.Run("parses the file again once the TTL elapsed", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, loads := newCache(10)
+		now := time.Now()
+		c.now = func() time.Time { return now }
+		c.SetTTL(time.Hour)
+
+		first, err := c.TokenFromAuthFile("ns/sops", "1", authFile, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		now = now.Add(59 * time.Minute)
+		second, err := c.TokenFromAuthFile("ns/sops", "1", authFile, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).To(BeIdenticalTo(first))
+		g.Expect(*loads).To(Equal(1))
+
+		now = now.Add(time.Minute)
+		third, err := c.TokenFromAuthFile("ns/sops", "1", authFile, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(third).ToNot(BeIdenticalTo(first))
+		g.Expect(*loads).To(Equal(2))
+	})
+}
+
+func TestConfigCache_DefaultToken(t *testing.T) {
+	newCache := func(size int) (*ConfigCache, *int) {
+		c := NewConfigCache(size)
+		creds := 0
+		c.newDefaultCredential = func() (azcore.TokenCredential, error) {
+			creds++
+			return fakeTokenCredential{}, nil
+		}
+		return c, &creds
+	}
+
+	t.Run("shares the token of the default credential", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, creds := newCache(10)
+		first, err := c.DefaultToken()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(first).ToNot(BeNil())
+		g.Expect(first.token).To(Equal(fakeTokenCredential{}))
+		second, err := c.DefaultToken()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).To(BeIdenticalTo(first))
+		g.Expect(*creds).To(Equal(1))
+	})
+
+	t.Run("constructs the credential again once the TTL elapsed", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, creds := newCache(10)
+		now := time.Now()
+		c.now = func() time.Time { return now }
+		c.SetTTL(time.Hour)
+
+		first, err := c.DefaultToken()
+		g.Expect(err).ToNot(HaveOccurred())
+		now = now.Add(time.Hour)
+		second, err := c.DefaultToken()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).ToNot(BeIdenticalTo(first))
+		g.Expect(*creds).To(Equal(2))
+	})
+
+	t.Run("does not cache failures", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := NewConfigCache(10)
+		calls := 0
+		c.newDefaultCredential = func() (azcore.TokenCredential, error) {
+			calls++
+			return nil, errors.New("no credential")
+		}
+		for i := 0; i < 2; i++ {
+			_, err := c.DefaultToken()
+			g.Expect(err).To(MatchError("no credential"))
+		}
+		g.Expect(calls).To(Equal(2))
+	})
+
+	t.Run("nil or zero size cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var c *ConfigCache
+		token, err := c.DefaultToken()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(token).To(BeNil())
+
+		c, creds := newCache(0)
+		token, err = c.DefaultToken()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(token).To(BeNil())
+		g.Expect(*creds).To(BeZero())
+	})
+}
+
+func TestConfigCache_TokenFromAuthFilePath(t *testing.T) {
+	authFile := []byte(`tenantId: "tenant"
+clientId: "client"
+clientSecret: "secret"
+`)
+
+	t.Run("loads a valid file", func(t *testing.T) {
+		g := NewWithT(t)
+
+		path := filepath.Join(t.TempDir(), "azure-kv.yaml")
+		g.Expect(os.WriteFile(path, authFile, 0o600)).To(Succeed())
+
+		c := NewConfigCache(10)
+		first, err := c.TokenFromAuthFilePath(path, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(first.token).To(BeAssignableToTypeOf(&azidentity.ClientSecretCredential{}))
+
+		second, err := c.TokenFromAuthFilePath(path, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(second).To(BeIdenticalTo(first))
+
+		// A changed file is loaded again.
+		g.Expect(os.WriteFile(path, append(authFile, []byte("authorityHost: https://example.com\n")...), 0o600)).To(Succeed())
+		third, err := c.TokenFromAuthFilePath(path, NewTokenCache(10))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(third).ToNot(BeIdenticalTo(first))
+	})
+
+	t.Run("loads a UTF-16 encoded file without cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		path := filepath.Join(t.TempDir(), "azure-kv.yaml")
+		utf16 := []byte{0xFF, 0xFE}
+		for _, b := range authFile {
+			utf16 = append(utf16, b, 0x00)
+		}
+		g.Expect(os.WriteFile(path, utf16, 0o600)).To(Succeed())
+
+		var c *ConfigCache
+		token, err := c.TokenFromAuthFilePath(path, nil)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(token.token).To(BeAssignableToTypeOf(&azidentity.ClientSecretCredential{}))
+	})
+
+	t.Run("fails on a missing file", func(t *testing.T) {
+		g := NewWithT(t)
+
+		path := filepath.Join(t.TempDir(), "missing.yaml")
+		_, err := NewConfigCache(10).TokenFromAuthFilePath(path, NewTokenCache(10))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(Equal(fmt.Sprintf("Azure authentication file '%s' does not exist", path)))
+	})
+
+	t.Run("fails on an unreadable file", func(t *testing.T) {
+		g := NewWithT(t)
+
+		path := t.TempDir()
+		_, err := NewConfigCache(10).TokenFromAuthFilePath(path, NewTokenCache(10))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(Equal(fmt.Sprintf("failed to read Azure authentication file '%s': not a regular file", path)))
+	})
+
+	t.Run("fails on an invalid file", func(t *testing.T) {
+		g := NewWithT(t)
+
+		path := filepath.Join(t.TempDir(), "azure-kv.yaml")
+		g.Expect(os.WriteFile(path, []byte("tenantId: [invalid"), 0o600)).To(Succeed())
+		_, err := NewConfigCache(10).TokenFromAuthFilePath(path, NewTokenCache(10))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("failed to unmarshal Azure authentication file"))
+	})
+}
+
+func TestAADConfig_cacheKey(t *testing.T) {
+	g := NewWithT(t)
+
+	conf := AADConfig{
+		AZConfig:                  AZConfig{Password: "az-password"},
+		TenantID:                  "tenant",
+		ClientID:                  "client",
+		ClientSecret:              "client-secret",
+		ClientCertificate:         "client-certificate",
+		ClientCertificatePassword: "certificate-password",
+	}
+	key := conf.cacheKey()
+	for _, secret := range []string{conf.Password, conf.ClientSecret, conf.ClientCertificate, conf.ClientCertificatePassword} {
+		g.Expect(key).ToNot(ContainSubstring(secret))
+	}
+	g.Expect(key).To(Equal(conf.cacheKey()))
+
+	// The credentials of another vault DNS suffix are not shared.
+	withSuffix := conf
+	withSuffix.VaultDNSSuffix = "vault.azure.cn"
+	g.Expect(withSuffix.cacheKey()).ToNot(Equal(key))
+
+	// The credentials of another cloud are not shared.
+	withCloud := conf
+	withCloud.Cloud = "AzureChina"
+	g.Expect(withCloud.cacheKey()).ToNot(Equal(key))
+
+	// The credentials of a workload identity are not shared with the
+	// managed identity of the same client ID.
+	g.Expect((AADConfig{TenantID: "tenant", ClientID: "client", WorkloadIdentity: true}).cacheKey()).
+		ToNot(Equal((AADConfig{TenantID: "tenant", ClientID: "client"}).cacheKey()))
+
+	// The credentials of different managed identities are not shared.
+	g.Expect((AADConfig{ManagedIdentityResourceID: "identity"}).cacheKey()).
+		ToNot(Equal((AADConfig{ManagedIdentityResourceID: "other"}).cacheKey()))
+
+	// The secret values are not ambiguous when concatenated.
+	g.Expect((AADConfig{ClientSecret: "ab", ClientCertificate: "c"}).cacheKey()).
+		ToNot(Equal((AADConfig{ClientSecret: "a", ClientCertificate: "bc"}).cacheKey()))
+}
+
 func validTLS(t *testing.T) []byte {
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -0,0 +1,123 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fluxcd/kustomize-controller/internal/lru"
+)
+
+// DataKeyCache caches the data keys decrypted with Azure Key Vault keys,
+// content-addressed by the digest of their ciphertext, the ID and algorithm
+// of the key, and the identity of the credential of the Token which decrypted
+// them. Identical ciphertexts, e.g. of the same SOPS file referenced by
+// multiple Kustomizations, are thereby decrypted once with the same
+// credential, while a changed ciphertext is decrypted again. A data key is
+// never returned for another credential than the one which decrypted it, so
+// that it is not disclosed to the holders of other credentials. The keys
+// of Tokens which are not constructed from an AADConfig are not cached. As
+// the cached data keys are returned without a request to the vault, the
+// entries expire once their TTL elapsed, after which a revoked permission of
+// the credential on the key takes effect. When the cache is full, the least
+// recently used entry is evicted. It is safe for concurrent use, and is meant
+// to be shared by all the MasterKeys of the process.
+type DataKeyCache struct {
+	size int
+	// ttl is the maximum age of the entries. When zero, the entries do
+	// not expire.
+	ttl time.Duration
+	// now returns the current time. Defaults to time.Now.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries *lru.Cache[string, dataKeyEntry]
+}
+
+type dataKeyEntry struct {
+	dataKey []byte
+	created time.Time
+}
+
+// NewDataKeyCache returns a new empty DataKeyCache holding at most size
+// data keys.
+func NewDataKeyCache(size int) *DataKeyCache {
+	return &DataKeyCache{
+		size:    size,
+		now:     time.Now,
+		entries: lru.New[string, dataKeyEntry](size),
+	}
+}
+
+// SetTTL configures the maximum age of the cached data keys, after which
+// they are decrypted again with the vault. A TTL of zero disables the expiry.
+func (c *DataKeyCache) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// ApplyToMasterKey configures the DataKeyCache on the provided key.
+func (c *DataKeyCache) ApplyToMasterKey(key *MasterKey) {
+	key.dataKeys = c
+}
+
+// get returns a copy of the data key cached for the encrypted key of the
+// MasterKey, if any and its TTL has not elapsed.
+func (c *DataKeyCache) get(key *MasterKey, algorithm string) ([]byte, bool) {
+	if c == nil || c.size <= 0 {
+		return nil, false
+	}
+	id, ok := dataKeyID(key, algorithm)
+	if !ok {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries.Get(id)
+	if !ok {
+		return nil, false
+	}
+	if c.ttl > 0 && c.now().Sub(e.created) >= c.ttl {
+		c.entries.Remove(id)
+		return nil, false
+	}
+	return append([]byte(nil), e.dataKey...), true
+}
+
+// put caches a copy of the data key decrypted from the encrypted key of the
+// MasterKey.
+func (c *DataKeyCache) put(key *MasterKey, algorithm string, dataKey []byte) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	id, ok := dataKeyID(key, algorithm)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Add(id, dataKeyEntry{dataKey: append([]byte(nil), dataKey...), created: c.now()})
+}
+
+// dataKeyID returns the ID of the entry of the encrypted key of the MasterKey
+// in a DataKeyCache, or false if its data key can not be cached because the
+// identity of its credential is unknown.
+func dataKeyID(key *MasterKey, algorithm string) (string, bool) {
+	if key.tokenID == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(key.EncryptedKey))
+	return strings.Join([]string{
+		hex.EncodeToString(sum[:]),
+		key.ToString(),
+		algorithm,
+		key.tokenID,
+	}, "\x00"), true
+}
@@ -0,0 +1,191 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestDataKeyCache(t *testing.T) {
+	// newKey returns a MasterKey as constructed from the SOPS metadata of a
+	// Kustomization, with the given encrypted key and token identity.
+	newKey := func(c *fakeCryptoClient, cache *DataKeyCache, encryptedKey, tokenID string) *MasterKey {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		key.EncryptedKey = encryptedKey
+		token := NewToken(fakeTokenCredential{})
+		token.id = tokenID
+		token.ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		cache.ApplyToMasterKey(key)
+		return key
+	}
+	// encrypt returns the data key encrypted with the fake.
+	encrypt := func(g *WithT, c *fakeCryptoClient, dataKey string) string {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte(dataKey))).To(Succeed())
+		return key.EncryptedKey
+	}
+
+	t.Run("decrypts identical ciphertexts once", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		cache := NewDataKeyCache(10)
+		encryptedKey := encrypt(g, c, "data-key")
+
+		for _, obj := range []string{"first", "second"} {
+			got, err := newKey(c, cache, encryptedKey, "tenant").Decrypt()
+			g.Expect(err).ToNot(HaveOccurred(), obj)
+			g.Expect(got).To(Equal([]byte("data-key")), obj)
+		}
+		g.Expect(c.decrypts).To(Equal(1))
+	})
+
+	t.Run("decrypts a changed ciphertext again", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		cache := NewDataKeyCache(10)
+
+		got, err := newKey(c, cache, encrypt(g, c, "old-data-key"), "tenant").Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("old-data-key")))
+
+		got, err = newKey(c, cache, encrypt(g, c, "new-data-key"), "tenant").Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("new-data-key")))
+		g.Expect(c.decrypts).To(Equal(2))
+	})
+
+	t.Run("does not share data keys across credentials", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		cache := NewDataKeyCache(10)
+		encryptedKey := encrypt(g, c, "data-key")
+
+		for _, tokenID := range []string{"tenant", "other-tenant", "", ""} {
+			_, err := newKey(c, cache, encryptedKey, tokenID).Decrypt()
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(c.decrypts).To(Equal(4))
+	})
+
+	t.Run("does not cache failures", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		cache := NewDataKeyCache(10)
+		encryptedKey := encrypt(g, c, "data-key")
+
+		c.err = errors.New("service unavailable")
+		_, err := newKey(c, cache, encryptedKey, "tenant").Decrypt()
+		g.Expect(err).To(HaveOccurred())
+
+		c.err = nil
+		got, err := newKey(c, cache, encryptedKey, "tenant").Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("data-key")))
+		g.Expect(c.decrypts).To(Equal(2))
+	})
+
+	t.Run("is not affected by zeroing the returned data key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		cache := NewDataKeyCache(10)
+		encryptedKey := encrypt(g, c, "data-key")
+
+		for i := 0; i < 2; i++ {
+			err := newKey(c, cache, encryptedKey, "tenant").WithDecryptedDataKey(context.Background(), func(dataKey []byte) error {
+				g.Expect(dataKey).To(Equal([]byte("data-key")))
+				return nil
+			})
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(c.decrypts).To(Equal(1))
+	})
+
+	t.Run("evicts the least recently used data key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		cache := NewDataKeyCache(2)
+		first, second, third := encrypt(g, c, "first"), encrypt(g, c, "second"), encrypt(g, c, "third")
+
+		for _, encryptedKey := range []string{first, second, first, third} {
+			_, err := newKey(c, cache, encryptedKey, "tenant").Decrypt()
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(c.decrypts).To(Equal(3))
+
+		// The second key was evicted for the third, the first was used
+		// more recently.
+		_, err := newKey(c, cache, first, "tenant").Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c.decrypts).To(Equal(3))
+		_, err = newKey(c, cache, second, "tenant").Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c.decrypts).To(Equal(4))
+	})
+
+	t.Run("decrypts again once the TTL elapsed", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		cache := NewDataKeyCache(10)
+		cache.SetTTL(time.Minute)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+		encryptedKey := encrypt(g, c, "data-key")
+
+		for _, elapsed := range []time.Duration{0, 30 * time.Second, time.Minute} {
+			now = now.Add(elapsed)
+			got, err := newKey(c, cache, encryptedKey, "tenant").Decrypt()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+		}
+		g.Expect(c.decrypts).To(Equal(2))
+	})
+
+	t.Run("nil cache decrypts every time", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		encryptedKey := encrypt(g, c, "data-key")
+
+		for i := 0; i < 2; i++ {
+			_, err := newKey(c, nil, encryptedKey, "tenant").Decrypt()
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(c.decrypts).To(Equal(2))
+	})
+}
+
+func TestTokenFromAADConfig_identity(t *testing.T) {
+	g := NewWithT(t)
+
+	conf := AADConfig{TenantID: "tenant", ClientID: "client", ClientSecret: "secret"}
+	token, err := TokenFromAADConfig(conf)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token.id).ToNot(BeEmpty())
+
+	other, err := TokenFromAADConfig(AADConfig{TenantID: "tenant", ClientID: "client", ClientSecret: "other"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(other.id).ToNot(Equal(token.id))
+
+	key := &MasterKey{}
+	token.ApplyToMasterKey(key)
+	g.Expect(key.tokenID).To(Equal(token.id))
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+)
+
+// KeyDeletedError is returned when the Azure Key Vault key of a decryption
+// is deleted, but can be recovered from the deleted keys of the soft-delete
+// enabled vault until it is purged.
+type KeyDeletedError struct {
+	// VaultURL is the URL of the vault of the key.
+	VaultURL string
+	// Name is the name of the key.
+	Name string
+	// ScheduledPurgeDate is the date at which the key is purged, if known.
+	ScheduledPurgeDate *time.Time
+	// Recovering is true if the recovery of the key was requested.
+	Recovering bool
+	// Err is the error of the decryption.
+	Err error
+}
+
+// Error returns the error message, with the command to recover the key.
+func (e *KeyDeletedError) Error() string {
+	if e.Recovering {
+		return fmt.Sprintf("key '%s' is deleted and being recovered, the decryption is retried once the recovery completed: %s",
+			e.Name, e.Err)
+	}
+	msg := fmt.Sprintf("key '%s' is deleted, but can be recovered from the deleted keys of the vault", e.Name)
+	if e.ScheduledPurgeDate != nil {
+		msg += fmt.Sprintf(" until it is purged at %s", e.ScheduledPurgeDate.UTC().Format(time.RFC3339))
+	}
+	nameFlag := "--vault-name"
+	if u, err := url.Parse(e.VaultURL); err == nil && isManagedHSMHost(u.Hostname()) {
+		nameFlag = "--hsm-name"
+	}
+	return fmt.Sprintf("%s: recover the key, e.g. with 'az keyvault key recover %s %s --name %s': %s",
+		msg, nameFlag, vaultName(e.VaultURL), e.Name, e.Err)
+}
+
+// Unwrap returns the error of the decryption.
+func (e *KeyDeletedError) Unwrap() error {
+	return e.Err
+}
+
+// vaultName returns the name of the vault of the URL, which is the first
+// label of its host.
+func vaultName(vaultURL string) string {
+	host := vaultURL
+	if u, err := url.Parse(vaultURL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	name, _, _ := strings.Cut(host, ".")
+	return name
+}
+
+// RecoverDeletedKey configures whether a MasterKey recovers its Azure Key
+// Vault key when the decryption fails because the key is deleted but
+// recoverable, instead of only failing with a KeyDeletedError.
+type RecoverDeletedKey bool
+
+// ApplyToMasterKey configures the recovery of the deleted key on the provided
+// key.
+func (r RecoverDeletedKey) ApplyToMasterKey(key *MasterKey) {
+	key.recoverDeleted = bool(r)
+}
+
+// deletedKeyError returns a KeyDeletedError wrapping the decryption error if
+// the key was not found because it is deleted but recoverable, or the error
+// as is otherwise. If the deleted keys of the vault can't be read, e.g.
+// because the credential is not authorized to, the error is returned as is
+// unless Azure Key Vault reported the key as deleted.
+func (key *MasterKey) deletedKeyError(ctx context.Context, c cryptoClient, err error) error {
+	reason := ErrorReason(err)
+	if reason != KeyNotFoundReason && reason != KeyDeletedReason {
+		return err
+	}
+
+	ctx, requestID := withClientRequestID(ctx)
+	resp, getErr := c.GetDeletedKey(ctx, key.Name, nil)
+	key.logRequest("getDeletedKey", key.ToString(), requestID, getErr)
+	if getErr != nil && reason != KeyDeletedReason {
+		return err
+	}
+	return &KeyDeletedError{
+		VaultURL:           key.VaultURL,
+		Name:               key.Name,
+		ScheduledPurgeDate: resp.ScheduledPurgeDate,
+		Err:                err,
+	}
+}
+
+// recoverAndDecrypt recovers the deleted key, and retries the decryption once
+// the recovery was accepted. The recovery completes asynchronously, if the
+// key is still not found, the KeyDeletedError is returned as Recovering.
+func (key *MasterKey) recoverAndDecrypt(ctx context.Context, c cryptoClient, deletedErr *KeyDeletedError,
+	parameters azkeys.KeyOperationsParameters) (azkeys.DecryptResponse, error) {
+	recoverCtx, requestID := withClientRequestID(ctx)
+	_, err := c.RecoverDeletedKey(recoverCtx, key.Name, nil)
+	key.logRequest("recoverDeletedKey", key.ToString(), requestID, err)
+	if err != nil {
+		return azkeys.DecryptResponse{}, fmt.Errorf("failed to recover deleted key '%s': %w", key.Name, err)
+	}
+
+	decryptCtx, requestID := withClientRequestID(ctx)
+	resp, err := c.Decrypt(decryptCtx, key.Name, requestVersion(key.Version), parameters, nil)
+	key.logRequest("decrypt", key.ToString(), requestID, err)
+	if err != nil {
+		if reason := ErrorReason(err); reason == KeyNotFoundReason || reason == KeyDeletedReason {
+			recovering := *deletedErr
+			recovering.Recovering = true
+			recovering.Err = err
+			return azkeys.DecryptResponse{}, &recovering
+		}
+		return azkeys.DecryptResponse{}, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestKeyDeletedError_Error(t *testing.T) {
+	g := NewWithT(t)
+
+	purgeDate := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	err := &KeyDeletedError{
+		VaultURL:           "https://myvault.vault.azure.net",
+		Name:               "key-name",
+		ScheduledPurgeDate: &purgeDate,
+		Err:                errors.New("not found"),
+	}
+	g.Expect(err.Error()).To(Equal("key 'key-name' is deleted, but can be recovered from the deleted keys of the vault " +
+		"until it is purged at 2023-07-01T12:00:00Z: recover the key, e.g. with " +
+		"'az keyvault key recover --vault-name myvault --name key-name': not found"))
+
+	err.ScheduledPurgeDate = nil
+	g.Expect(err.Error()).ToNot(ContainSubstring("purged"))
+
+	hsmErr := &KeyDeletedError{VaultURL: "https://myhsm.managedhsm.azure.net", Name: "key-name", Err: errors.New("not found")}
+	g.Expect(hsmErr.Error()).To(ContainSubstring("'az keyvault key recover --hsm-name myhsm --name key-name'"))
+
+	err.Recovering = true
+	g.Expect(err.Error()).To(Equal("key 'key-name' is deleted and being recovered, " +
+		"the decryption is retried once the recovery completed: not found"))
+}
+
+func TestMasterKey_Decrypt_DeletedKey(t *testing.T) {
+	purgeDate := time.Now().Add(90 * 24 * time.Hour).UTC()
+
+	// newDeletedKey returns a key holding an encrypted data key, of which
+	// the Azure Key Vault key is then deleted.
+	newDeletedKey := func(g *WithT, c *fakeCryptoClient) *MasterKey {
+		key := MasterKeyFromURL("https://myvault.vault.azure.net", "key-name", "v1")
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		c.deleted = map[string]time.Time{"key-name": purgeDate}
+		return key
+	}
+
+	t.Run("fails with the recovery command", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newDeletedKey(g, c)
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(KeyDeletedReason))
+		var deletedErr *KeyDeletedError
+		g.Expect(errors.As(err, &deletedErr)).To(BeTrue())
+		g.Expect(deletedErr.Recovering).To(BeFalse())
+		g.Expect(*deletedErr.ScheduledPurgeDate).To(Equal(purgeDate))
+		g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with Azure Key Vault key"))
+		g.Expect(err.Error()).To(ContainSubstring("'az keyvault key recover --vault-name myvault --name key-name'"))
+		g.Expect(c.recovers).To(BeZero())
+	})
+
+	t.Run("keeps the error of a key which was never deleted", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newDeletedKey(g, c)
+		c.deleted = nil
+		c.err = newResponseError(http.StatusNotFound, `{"error":{"code":"KeyNotFound"}}`)
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(KeyNotFoundReason))
+		var deletedErr *KeyDeletedError
+		g.Expect(errors.As(err, &deletedErr)).To(BeFalse())
+	})
+
+	t.Run("recovers the key and decrypts", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		c.recoverInstantly = true
+		key := newDeletedKey(g, c)
+		RecoverDeletedKey(true).ApplyToMasterKey(key)
+		got, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("data-key")))
+		g.Expect(c.recovers).To(Equal(1))
+	})
+
+	t.Run("reports the pending recovery", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newDeletedKey(g, c)
+		RecoverDeletedKey(true).ApplyToMasterKey(key)
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(KeyDeletedReason))
+		var deletedErr *KeyDeletedError
+		g.Expect(errors.As(err, &deletedErr)).To(BeTrue())
+		g.Expect(deletedErr.Recovering).To(BeTrue())
+		g.Expect(err.Error()).To(ContainSubstring("is deleted and being recovered"))
+		g.Expect(c.recovers).To(Equal(1))
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+const (
+	// ForbiddenReason indicates the credential is not authorized to use the
+	// key, e.g. because of missing RBAC role assignments or access policies.
+	ForbiddenReason = "Forbidden"
+	// KeyNotFoundReason indicates the key or key version does not exist.
+	KeyNotFoundReason = "KeyNotFound"
+	// KeyDisabledReason indicates the key is disabled.
+	KeyDisabledReason = "KeyDisabled"
+	// KeyDeletedReason indicates the key is deleted, but can be recovered
+	// from the deleted keys of the soft-delete enabled vault.
+	KeyDeletedReason = "KeyDeleted"
+	// ThrottledReason indicates the request was rejected because of the
+	// Azure Key Vault service limits.
+	ThrottledReason = "Throttled"
+	// VaultUnavailableReason indicates the request was not sent because the
+	// circuit breaker of the vault is open after repeated failures.
+	VaultUnavailableReason = "VaultUnavailable"
+)
+
+// ErrDefaultCredentialDisabled is returned by the requests of a MasterKey
+// without a Token when the default credential of the controller is disabled
+// with DisableDefaultCredential.
+var ErrDefaultCredentialDisabled = errors.New("no Azure credentials configured: " +
+	"the default credential of the controller is disabled, the decryption Secret must contain a 'sops.azure-kv' entry")
+
+// deletedButRecoverableCode is the Azure Key Vault error code of the
+// operations on the name of a key which is deleted but recoverable.
+const deletedButRecoverableCode = "ObjectIsDeletedButRecoverable"
+
+// ErrorReason returns the reason of an Azure Key Vault failure if the given
+// error wraps an azcore.ResponseError with a known error code or status,
+// or an empty string otherwise.
+func ErrorReason(err error) string {
+	var deletedErr *KeyDeletedError
+	if errors.As(err, &deletedErr) {
+		return KeyDeletedReason
+	}
+
+	var unavailableErr *VaultUnavailableError
+	if errors.As(err, &unavailableErr) {
+		return VaultUnavailableReason
+	}
+
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return ""
+	}
+
+	if respErr.ErrorCode == deletedButRecoverableCode || innerErrorCode(respErr) == deletedButRecoverableCode {
+		return KeyDeletedReason
+	}
+
+	// Azure Key Vault reports operations on disabled keys as forbidden,
+	// with the actual cause in the inner error code.
+	if respErr.ErrorCode == KeyDisabledReason || innerErrorCode(respErr) == KeyDisabledReason {
+		return KeyDisabledReason
+	}
+
+	switch respErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ForbiddenReason
+	case http.StatusNotFound:
+		return KeyNotFoundReason
+	case http.StatusTooManyRequests:
+		return ThrottledReason
+	}
+	return ""
+}
+
+// managedHSMCryptoUserRole is the local RBAC role of an Azure Key Vault
+// Managed HSM which permits the encrypt and decrypt operations of its keys.
+const managedHSMCryptoUserRole = "Managed HSM Crypto User"
+
+// ManagedHSMForbiddenError is returned when a request to an Azure Key Vault
+// Managed HSM is forbidden. Unlike a vault, a Managed HSM does not authorize
+// the requests with Azure RBAC role assignments or access policies, but with
+// the local RBAC role assignments of the HSM itself.
+type ManagedHSMForbiddenError struct {
+	// HSMURL is the URL of the Managed HSM.
+	HSMURL string
+	// Name is the name of the key.
+	Name string
+	// Err is the error of the request.
+	Err error
+}
+
+// Error returns the error message, with the command to assign the local role
+// permitting the operations on the key.
+func (e *ManagedHSMForbiddenError) Error() string {
+	return fmt.Sprintf("Managed HSM '%s' authorizes the requests with its local RBAC role assignments: "+
+		"assign the '%s' role for the key, e.g. with 'az keyvault role assignment create --hsm-name %s "+
+		"--role \"%s\" --scope /keys/%s --assignee <principal-id>': %s",
+		vaultName(e.HSMURL), managedHSMCryptoUserRole, vaultName(e.HSMURL), managedHSMCryptoUserRole, e.Name, e.Err)
+}
+
+// Unwrap returns the error of the request.
+func (e *ManagedHSMForbiddenError) Unwrap() error {
+	return e.Err
+}
+
+// innerErrorCode returns the inner error code from the body of the
+// azcore.ResponseError, if any.
+func innerErrorCode(respErr *azcore.ResponseError) string {
+	if respErr.RawResponse == nil {
+		return ""
+	}
+	body, err := runtime.Payload(respErr.RawResponse)
+	if err != nil {
+		return ""
+	}
+	var payload struct {
+		Error struct {
+			InnerError struct {
+				Code string `json:"code"`
+			} `json:"innererror"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	return payload.Error.InnerError.Code
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	. "github.com/onsi/gomega"
+)
+
+func newResponseError(status int, body string) error {
+	req, _ := http.NewRequest(http.MethodPost, "https://myvault.vault.azure.net/keys/key-name/key-version/decrypt", nil)
+	return runtime.NewResponseError(&http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	})
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "forbidden",
+			err:  newResponseError(http.StatusForbidden, `{"error":{"code":"Forbidden","message":"The user does not have decrypt permission"}}`),
+			want: ForbiddenReason,
+		},
+		{
+			name: "unauthorized",
+			err:  newResponseError(http.StatusUnauthorized, `{"error":{"code":"Unauthorized","message":"AKV10000: Request is missing a Bearer or PoP token."}}`),
+			want: ForbiddenReason,
+		},
+		{
+			name: "key not found",
+			err:  newResponseError(http.StatusNotFound, `{"error":{"code":"KeyNotFound","message":"A key with (name/id) key-name was not found"}}`),
+			want: KeyNotFoundReason,
+		},
+		{
+			name: "key disabled",
+			err:  newResponseError(http.StatusForbidden, `{"error":{"code":"Forbidden","message":"Operation decrypt is not allowed on a disabled key.","innererror":{"code":"KeyDisabled"}}}`),
+			want: KeyDisabledReason,
+		},
+		{
+			name: "key deleted but recoverable",
+			err:  newResponseError(http.StatusConflict, `{"error":{"code":"ObjectIsDeletedButRecoverable","message":"Key key-name is currently in a deleted but recoverable state"}}`),
+			want: KeyDeletedReason,
+		},
+		{
+			name: "deleted key error",
+			err: fmt.Errorf("failed to decrypt sops data key: %w", &KeyDeletedError{
+				Name: "key-name",
+				Err:  newResponseError(http.StatusNotFound, `{"error":{"code":"KeyNotFound"}}`),
+			}),
+			want: KeyDeletedReason,
+		},
+		{
+			name: "throttled",
+			err:  newResponseError(http.StatusTooManyRequests, `{"error":{"code":"Throttled","message":"Request was not processed because too many requests were received."}}`),
+			want: ThrottledReason,
+		},
+		{
+			name: "vault unavailable",
+			err:  fmt.Errorf("failed to decrypt sops data key: %w", &VaultUnavailableError{VaultURL: "https://myvault.vault.azure.net", Failures: 3}),
+			want: VaultUnavailableReason,
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("failed to decrypt sops data key: %w", newResponseError(http.StatusNotFound, "")),
+			want: KeyNotFoundReason,
+		},
+		{
+			name: "unknown status",
+			err:  newResponseError(http.StatusInternalServerError, ""),
+			want: "",
+		},
+		{
+			name: "not a response error",
+			err:  errors.New("failed to get Azure token credential"),
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			g.Expect(ErrorReason(tt.err)).To(Equal(tt.want))
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fluxcd/kustomize-controller/internal/lru"
+)
+
+// Expiry returns the expiry date of the key version in Azure Key Vault, or
+// nil if the key does not expire. Getting the key requires the 'get'
+// permission on the key, in addition to the permission to decrypt.
+func (key *MasterKey) Expiry(ctx context.Context) (*time.Time, error) {
+	creds, err := key.getTokenCredential()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Azure token credential to get key: %w", err)
+	}
+	c, err := key.cryptoClient(creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct Azure Key Vault crypto client to get key: %w", err)
+	}
+	resp, err := c.GetKey(ctx, key.Name, requestVersion(key.Version), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Azure Key Vault key '%s': %w", key.ToString(), err)
+	}
+	if resp.Attributes == nil {
+		return nil, nil
+	}
+	return resp.Attributes.Expires, nil
+}
+
+// ExpiryCache caches the expiry dates of the keys, as returned by
+// MasterKey.Expiry, for a fixed duration. Failures are cached as well, to
+// not get the key on every call when the permission to do so is missing.
+// The entries are scoped to the credential of the key, for the dates and
+// failures to never be shared with the keys of another credential, and the
+// keys of which the identity of the credential is unknown are not cached.
+// When the cache is full, the entry fetched first is evicted. It is safe for
+// concurrent use.
+type ExpiryCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu sync.Mutex
+	// entries are ordered by their fetch, as they are peeked without
+	// marking them as used.
+	entries *lru.Cache[string, expiryEntry]
+}
+
+type expiryEntry struct {
+	expires   *time.Time
+	err       error
+	fetchedAt time.Time
+}
+
+// NewExpiryCache returns a new empty ExpiryCache holding at most size
+// entries, which caches the expiry dates for the given duration.
+func NewExpiryCache(size int, ttl time.Duration) *ExpiryCache {
+	return &ExpiryCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: lru.New[string, expiryEntry](size),
+	}
+}
+
+// Expiry returns the cached expiry date of the key, or gets and caches it
+// with MasterKey.Expiry if it is not cached or the cached date is outdated.
+// A nil or zero size ExpiryCache gets the expiry date on every call.
+func (c *ExpiryCache) Expiry(ctx context.Context, key *MasterKey) (*time.Time, error) {
+	id, ok := expiryID(key)
+	if c == nil || c.size <= 0 || !ok {
+		return key.Expiry(ctx)
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries.Peek(id)
+	c.mu.Unlock()
+	if ok && c.now().Sub(e.fetchedAt) < c.ttl {
+		return e.expires, e.err
+	}
+
+	expires, err := key.Expiry(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Add(id, expiryEntry{expires: expires, err: err, fetchedAt: c.now()})
+	return expires, err
+}
+
+// expiryID returns the ID of the entry of the key in an ExpiryCache, or
+// false if the identity of its credential is unknown. The keys without a
+// Token share the default credential of the controller.
+func expiryID(key *MasterKey) (string, bool) {
+	if key.token != nil && key.tokenID == "" {
+		return "", false
+	}
+	return key.ToString() + "\x00" + key.tokenID, true
+}
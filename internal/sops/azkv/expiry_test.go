@@ -0,0 +1,187 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func newFakeExpiryKey(c *fakeCryptoClient) *MasterKey {
+	key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+	token := NewToken(fakeTokenCredential{})
+	token.id = "fake-credential"
+	token.ApplyToMasterKey(key)
+	c.applyToMasterKey(key)
+	return key
+}
+
+func TestMasterKey_Expiry(t *testing.T) {
+	t.Run("expiring key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		expires := time.Now().Add(72 * time.Hour).UTC()
+		c := newFakeCryptoClient()
+		c.expires = &expires
+
+		got, err := newFakeExpiryKey(c).Expiry(context.Background())
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).ToNot(BeNil())
+		g.Expect(*got).To(Equal(expires))
+	})
+
+	t.Run("key without expiry", func(t *testing.T) {
+		g := NewWithT(t)
+
+		got, err := newFakeExpiryKey(newFakeCryptoClient()).Expiry(context.Background())
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(BeNil())
+	})
+
+	t.Run("get key error", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		c.err = newResponseError(http.StatusForbidden, `{"error":{"code":"Forbidden","message":"The user does not have get permission"}}`)
+
+		_, err := newFakeExpiryKey(c).Expiry(context.Background())
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(HavePrefix("failed to get Azure Key Vault key 'https://invalid.vault.azure.net/keys/key-name/v1': "))
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+	})
+}
+
+func TestExpiryCache_Expiry(t *testing.T) {
+	t.Run("caches the expiry for the ttl", func(t *testing.T) {
+		g := NewWithT(t)
+
+		now := time.Now()
+		expires := now.Add(time.Hour)
+		c := newFakeCryptoClient()
+		c.expires = &expires
+		key := newFakeExpiryKey(c)
+
+		cache := NewExpiryCache(10, 10*time.Minute)
+		cache.now = func() time.Time { return now }
+
+		for i := 0; i < 3; i++ {
+			got, err := cache.Expiry(context.Background(), key)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(*got).To(Equal(expires))
+		}
+		g.Expect(c.getKeys).To(Equal(1))
+
+		// The cached expiry is outdated.
+		now = now.Add(10 * time.Minute)
+		_, err := cache.Expiry(context.Background(), key)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c.getKeys).To(Equal(2))
+	})
+
+	t.Run("caches keys without expiry and errors", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := NewExpiryCache(10, 10*time.Minute)
+
+		c := newFakeCryptoClient()
+		key := newFakeExpiryKey(c)
+		for i := 0; i < 2; i++ {
+			got, err := cache.Expiry(context.Background(), key)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(BeNil())
+		}
+		g.Expect(c.getKeys).To(Equal(1))
+
+		failing := newFakeCryptoClient()
+		failing.err = newResponseError(http.StatusForbidden, `{"error":{"code":"Forbidden"}}`)
+		failingKey := newFakeExpiryKey(failing)
+		failingKey.Name = "other-key"
+		for i := 0; i < 2; i++ {
+			_, err := cache.Expiry(context.Background(), failingKey)
+			g.Expect(err).To(HaveOccurred())
+		}
+		g.Expect(failing.getKeys).To(Equal(1))
+	})
+
+	t.Run("scopes the entries to the credential", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := NewExpiryCache(10, 10*time.Minute)
+
+		failing := newFakeCryptoClient()
+		failing.err = newResponseError(http.StatusForbidden, `{"error":{"code":"Forbidden"}}`)
+		_, err := cache.Expiry(context.Background(), newFakeExpiryKey(failing))
+		g.Expect(err).To(HaveOccurred())
+
+		// The same key with another credential does not get the failure of
+		// the first one.
+		c := newFakeCryptoClient()
+		key := newFakeExpiryKey(c)
+		key.tokenID = "other-credential"
+		_, err = cache.Expiry(context.Background(), key)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c.getKeys).To(Equal(1))
+	})
+
+	t.Run("does not cache the keys of unknown credentials", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := NewExpiryCache(10, 10*time.Minute)
+
+		c := newFakeCryptoClient()
+		key := newFakeExpiryKey(c)
+		key.tokenID = ""
+		for i := 0; i < 2; i++ {
+			_, err := cache.Expiry(context.Background(), key)
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(c.getKeys).To(Equal(2))
+		g.Expect(cache.entries.Len()).To(BeZero())
+	})
+
+	t.Run("evicts the entry fetched first", func(t *testing.T) {
+		g := NewWithT(t)
+
+		now := time.Now()
+		cache := NewExpiryCache(2, 10*time.Minute)
+		cache.now = func() time.Time { return now }
+
+		c := newFakeCryptoClient()
+		for _, name := range []string{"key-1", "key-2", "key-3"} {
+			key := newFakeExpiryKey(c)
+			key.Name = name
+			_, err := cache.Expiry(context.Background(), key)
+			g.Expect(err).ToNot(HaveOccurred())
+			now = now.Add(time.Second)
+		}
+		g.Expect(cache.entries.Len()).To(Equal(2))
+
+		key := newFakeExpiryKey(c)
+		key.Name = "key-1"
+		_, err := cache.Expiry(context.Background(), key)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c.getKeys).To(Equal(4))
+	})
+
+	t.Run("nil cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newFakeExpiryKey(c)
+
+		var cache *ExpiryCache
+		for i := 0; i < 2; i++ {
+			_, err := cache.Expiry(context.Background(), key)
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(c.getKeys).To(Equal(2))
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// imdsTokenEndpoint is the endpoint of the Azure Instance Metadata
+	// Service from which managed identities acquire their tokens.
+	imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// DefaultIMDSProbeTimeout is the default duration within which the
+	// Azure Instance Metadata Service must respond to an IMDSProbe.
+	DefaultIMDSProbeTimeout = 2 * time.Second
+)
+
+// managedIdentityEndpointEnvVars are the environment variables configuring
+// a managed identity endpoint other than the Azure Instance Metadata
+// Service, e.g. on App Service, Cloud Shell or Azure Arc.
+var managedIdentityEndpointEnvVars = []string{"IDENTITY_ENDPOINT", "MSI_ENDPOINT"}
+
+// IMDSProbe verifies that the Azure Instance Metadata Service (IMDS) is
+// reachable before a managed identity credential is constructed. On nodes
+// where the IMDS endpoint is blocked, the token requests of the credential
+// otherwise only fail on the first decryption, after their retries, with an
+// opaque error.
+type IMDSProbe struct {
+	endpoint string
+	timeout  time.Duration
+	client   *http.Client
+}
+
+// NewIMDSProbe returns a new IMDSProbe which requires the IMDS to respond
+// within the given timeout, or within DefaultIMDSProbeTimeout if zero.
+func NewIMDSProbe(timeout time.Duration) *IMDSProbe {
+	if timeout <= 0 {
+		timeout = DefaultIMDSProbeTimeout
+	}
+	return &IMDSProbe{
+		endpoint: imdsTokenEndpoint,
+		timeout:  timeout,
+		// The IMDS is a link-local endpoint, which must not be reached
+		// through a proxy.
+		client: &http.Client{Transport: &http.Transport{Proxy: nil}},
+	}
+}
+
+// Probe returns an error if the IMDS does not respond within the timeout.
+// Any response, including an error status, means the IMDS is reachable.
+// The probe is skipped for a nil IMDSProbe, and when the environment
+// configures a managed identity endpoint other than the IMDS.
+func (p *IMDSProbe) Probe(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	for _, env := range managedIdentityEndpointEnvVars {
+		if v, ok := os.LookupEnv(env); ok && v != "" {
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("IMDS unreachable: the Azure Instance Metadata Service at '%s' did not respond within %s, "+
+			"managed identities can not acquire tokens: %w", p.endpoint, p.timeout, err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
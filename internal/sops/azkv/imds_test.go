@@ -0,0 +1,132 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// newTestIMDSProbe returns an IMDSProbe of the given endpoint.
+func newTestIMDSProbe(endpoint string) *IMDSProbe {
+	p := NewIMDSProbe(500 * time.Millisecond)
+	p.endpoint = endpoint
+	return p
+}
+
+// unreachableEndpoint returns the URL of a closed server.
+func unreachableEndpoint() string {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	return s.URL
+}
+
+func TestNewIMDSProbe(t *testing.T) {
+	g := NewWithT(t)
+
+	p := NewIMDSProbe(0)
+	g.Expect(p.endpoint).To(Equal(imdsTokenEndpoint))
+	g.Expect(p.timeout).To(Equal(DefaultIMDSProbeTimeout))
+}
+
+func TestIMDSProbe_Probe(t *testing.T) {
+	t.Run("reachable", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// Any response, including an error status, means the IMDS is
+		// reachable.
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer s.Close()
+
+		g.Expect(newTestIMDSProbe(s.URL).Probe(context.Background())).To(Succeed())
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		g := NewWithT(t)
+
+		err := newTestIMDSProbe(unreachableEndpoint()).Probe(context.Background())
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("IMDS unreachable"))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		g := NewWithT(t)
+
+		done := make(chan struct{})
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-done
+		}))
+		defer s.Close()
+		defer close(done)
+
+		err := newTestIMDSProbe(s.URL).Probe(context.Background())
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("did not respond within 500ms"))
+	})
+
+	t.Run("nil probe", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var p *IMDSProbe
+		g.Expect(p.Probe(context.Background())).To(Succeed())
+	})
+
+	t.Run("other managed identity endpoint", func(t *testing.T) {
+		g := NewWithT(t)
+
+		t.Setenv("IDENTITY_ENDPOINT", "http://localhost:40342/metadata/identity/oauth2/token")
+		g.Expect(newTestIMDSProbe(unreachableEndpoint()).Probe(context.Background())).To(Succeed())
+	})
+}
+
+func TestTokenCache_ProbeIMDS(t *testing.T) {
+	t.Run("fails managed identity when unreachable", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := NewTokenCache(10)
+		c.ProbeIMDS(newTestIMDSProbe(unreachableEndpoint()))
+		_, err := c.TokenFromAADConfig(AADConfig{ClientID: "client"})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("failed to configure managed identity 'client'"))
+		g.Expect(err.Error()).To(ContainSubstring("IMDS unreachable"))
+		g.Expect(c.tokens.Len()).To(BeZero())
+	})
+
+	t.Run("constructs managed identity when reachable", func(t *testing.T) {
+		g := NewWithT(t)
+
+		s := httptest.NewServer(http.NotFoundHandler())
+		defer s.Close()
+
+		c := NewTokenCache(10)
+		c.ProbeIMDS(newTestIMDSProbe(s.URL))
+		got, err := c.TokenFromAADConfig(AADConfig{ClientID: "client"})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).ToNot(BeNil())
+	})
+
+	t.Run("does not probe service principals", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := NewTokenCache(10)
+		c.ProbeIMDS(newTestIMDSProbe(unreachableEndpoint()))
+		got, err := c.TokenFromAADConfig(AADConfig{
+			TenantID:     "tenant",
+			ClientID:     "client",
+			ClientSecret: "secret",
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).ToNot(BeNil())
+	})
+}
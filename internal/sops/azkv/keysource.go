@@ -9,21 +9,31 @@ package azkv
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf16"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
 	"github.com/dimchansky/utfbom"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/keymap"
 )
 
 var (
@@ -31,6 +41,14 @@ var (
 	azkvTTL = time.Hour * 24 * 30 * 6
 )
 
+// defaultAlgorithm is the algorithm the data key is encrypted with when the
+// MasterKey does not specify one.
+const defaultAlgorithm = azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP256
+
+// clientRequestIDHeader is the header of the correlation ID of a request,
+// recorded in the Azure Key Vault audit logs as the clientRequestId.
+const clientRequestIDHeader = "x-ms-client-request-id"
+
 // MasterKey is an Azure Key Vault Key used to Encrypt and Decrypt SOPS'
 // data key.
 //
@@ -44,7 +62,74 @@ type MasterKey struct {
 	EncryptedKey string
 	CreationDate time.Time
 
-	token azcore.TokenCredential
+	// Algorithm is the Azure Key Vault algorithm the data key is encrypted
+	// with, e.g. as recorded in the SOPS metadata of a file. Defaults to
+	// defaultAlgorithm when empty.
+	Algorithm string
+
+	token      azcore.TokenCredential
+	caBundle   []byte
+	transport  Transport
+	apiVersion string
+	logger     logr.Logger
+	limiter    *VaultLimiter
+	breaker    *VaultBreaker
+
+	// retryPolicy configures the retries of the throttled and otherwise
+	// transiently failed requests of the client.
+	retryPolicy RetryPolicy
+
+	// vaultSuffixes are the DNS suffixes of the vaults of the cloud of the
+	// token, which the VaultURL must match when set. rewriteVaultSuffix
+	// rewrites the suffix of another cloud to the one of the token instead.
+	vaultSuffixes      []string
+	rewriteVaultSuffix bool
+
+	// recoverDeleted recovers the key when the decryption fails because
+	// the key is deleted but recoverable.
+	recoverDeleted bool
+
+	// noDefaultCredential fails the requests without a token, instead of
+	// authenticating with the default credential.
+	noDefaultCredential bool
+
+	// resolveLatestVersion resolves an empty or LatestVersion Version to
+	// the current version of the key when encrypting.
+	resolveLatestVersion bool
+
+	// allowedAlgorithms are the algorithms the data key can be encrypted
+	// and decrypted with. When empty, all the algorithms are allowed.
+	allowedAlgorithms AllowedAlgorithms
+
+	// tokenID identifies the credential of the token, if known, for the
+	// dataKeys to only return the data keys it decrypted itself.
+	tokenID  string
+	dataKeys *DataKeyCache
+
+	// clients caches the clients of the token per vault. When nil, a
+	// client is constructed for every request.
+	clients *clientCache
+
+	// newCryptoClient constructs the client used to encrypt and decrypt
+	// the data key for the vault URL. Defaults to newClient.
+	newCryptoClient func(vaultURL string, creds azcore.TokenCredential) (cryptoClient, error)
+
+	// encryptMu guards the updates of EncryptedKey by EncryptIfNeeded
+	// and Rotate.
+	encryptMu sync.Mutex
+}
+
+// cryptoClient is the subset of the Azure Key Vault client used to encrypt
+// and decrypt the SOPS data key, to get the attributes of the key, and to
+// recover it once deleted.
+type cryptoClient interface {
+	GetKey(ctx context.Context, name string, version string, options *azkeys.GetKeyOptions) (azkeys.GetKeyResponse, error)
+	Encrypt(ctx context.Context, name string, version string, parameters azkeys.KeyOperationsParameters,
+		options *azkeys.EncryptOptions) (azkeys.EncryptResponse, error)
+	Decrypt(ctx context.Context, name string, version string, parameters azkeys.KeyOperationsParameters,
+		options *azkeys.DecryptOptions) (azkeys.DecryptResponse, error)
+	GetDeletedKey(ctx context.Context, name string, options *azkeys.GetDeletedKeyOptions) (azkeys.GetDeletedKeyResponse, error)
+	RecoverDeletedKey(ctx context.Context, name string, options *azkeys.RecoverDeletedKeyOptions) (azkeys.RecoverDeletedKeyResponse, error)
 }
 
 // MasterKeyFromURL creates a new MasterKey from a Vault URL, key name, and key
@@ -63,42 +148,152 @@ func MasterKeyFromURL(url, name, version string) *MasterKey {
 // Vault.
 type Token struct {
 	token azcore.TokenCredential
+	// vaultSuffixes are the DNS suffixes of the vaults of the cloud the
+	// token is acquired for, if known.
+	vaultSuffixes []string
+	// id identifies the credential of the token, if known, e.g. by the
+	// AADConfig it is constructed from.
+	id string
+	// clients are the Azure Key Vault clients authenticating with the
+	// token, shared by the MasterKeys it is applied to.
+	clients *clientCache
 }
 
 // NewToken creates a new Token with the provided azcore.TokenCredential.
 func NewToken(token azcore.TokenCredential) *Token {
-	return &Token{token: token}
+	return &Token{token: token, clients: newClientCache()}
 }
 
 // ApplyToMasterKey configures the Token on the provided key.
 func (t Token) ApplyToMasterKey(key *MasterKey) {
 	key.token = t.token
+	key.vaultSuffixes = t.vaultSuffixes
+	key.tokenID = t.id
+	key.clients = t.clients
+}
+
+// CABundle is a PEM encoded bundle of CA certificates, trusted in addition to
+// the system roots when connecting to Azure Key Vault.
+type CABundle []byte
+
+// Validate returns an error if the CABundle contains no PEM encoded
+// certificate.
+func (c CABundle) Validate() error {
+	if !x509.NewCertPool().AppendCertsFromPEM(c) {
+		return fmt.Errorf("invalid Azure Key Vault CA bundle: no PEM encoded certificates found")
+	}
+	return nil
+}
+
+// ApplyToMasterKey configures the CABundle on the provided key.
+func (c CABundle) ApplyToMasterKey(key *MasterKey) {
+	key.caBundle = c
+}
+
+// APIVersion is the Azure Key Vault data-plane API version requested by the
+// client of a MasterKey, instead of the default version of the SDK.
+type APIVersion string
+
+// ApplyToMasterKey configures the APIVersion on the provided key.
+func (v APIVersion) ApplyToMasterKey(key *MasterKey) {
+	key.apiVersion = string(v)
+}
+
+// RewriteVaultDNSSuffix configures whether a vault URL with the DNS suffix
+// of another cloud than the one of the Token of the key is rewritten to the
+// suffix of the cloud of the Token, instead of failing the request.
+type RewriteVaultDNSSuffix bool
+
+// ApplyToMasterKey configures the rewrite of the vault URL on the provided key.
+func (r RewriteVaultDNSSuffix) ApplyToMasterKey(key *MasterKey) {
+	key.rewriteVaultSuffix = bool(r)
+}
+
+// DisableDefaultCredential configures whether a MasterKey without a Token
+// fails its requests with ErrDefaultCredentialDisabled, instead of
+// authenticating with the default credential of the controller, e.g. for the
+// tenants of a cluster to not use the ambient credentials of the controller.
+type DisableDefaultCredential bool
+
+// ApplyToMasterKey configures the use of the default credential on the
+// provided key.
+func (d DisableDefaultCredential) ApplyToMasterKey(key *MasterKey) {
+	key.noDefaultCredential = bool(d)
+}
+
+// Logger is the logr.Logger with which a MasterKey logs the client request
+// ID of the requests to Azure Key Vault.
+type Logger logr.Logger
+
+// ApplyToMasterKey configures the Logger on the provided key.
+func (l Logger) ApplyToMasterKey(key *MasterKey) {
+	key.logger = logr.Logger(l)
 }
 
 // Encrypt takes a SOPS data key, encrypts it with Azure Key Vault, and stores
 // the result in the EncryptedKey field.
 func (key *MasterKey) Encrypt(dataKey []byte) error {
+	return key.EncryptContext(context.Background(), dataKey)
+}
+
+// EncryptContext encrypts the SOPS data key as Encrypt, with the given
+// context for the request to Azure Key Vault. The context also bounds the
+// wait for a request slot of the VaultLimiter of the key.
+// When the key resolves the latest version, the Version is updated to the
+// version the data key is encrypted with. Otherwise, a LatestVersion
+// Version is updated to an empty one.
+func (key *MasterKey) EncryptContext(ctx context.Context, dataKey []byte) error {
+	encryptedKey, version, err := key.encrypt(ctx, key.Version, dataKey)
+	if err != nil {
+		return err
+	}
+	key.SetEncryptedDataKey([]byte(encryptedKey))
+	key.Version = version
+	return nil
+}
+
+// encrypt encrypts the SOPS data key with the given version of the Azure Key
+// Vault key, and returns the result and the version it is encrypted with,
+// which differs from the given one if it is resolved by resolveVersion.
+func (key *MasterKey) encrypt(ctx context.Context, version string, dataKey []byte) (string, string, error) {
+	if err := key.Validate(); err != nil {
+		return "", "", fmt.Errorf("failed to encrypt sops data key with Azure Key Vault key '%s': %w", key.keyID(version), err)
+	}
+	algorithm, err := key.algorithm()
+	if err != nil {
+		return "", "", err
+	}
 	creds, err := key.getTokenCredential()
 	if err != nil {
-		return fmt.Errorf("failed to get Azure token credential to encrypt: %w", err)
+		return "", "", fmt.Errorf("failed to get Azure token credential to encrypt: %w", err)
 	}
-	c, err := azkeys.NewClient(key.VaultURL, creds, nil)
+	c, err := key.cryptoClient(creds)
 	if err != nil {
-		return fmt.Errorf("failed to construct Azure Key Vault crypto client to encrypt data: %w", err)
+		return "", "", fmt.Errorf("failed to construct Azure Key Vault crypto client to encrypt data: %w", err)
+	}
+	release, err := key.limiter.Acquire(ctx, key.VaultURL)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encrypt sops data key with Azure Key Vault key '%s': %w", key.keyID(version), err)
+	}
+	defer release()
+	if version, err = key.resolveVersion(ctx, c, version); err != nil {
+		return "", "", err
 	}
-	resp, err := c.Encrypt(context.Background(), key.Name, key.Version, azkeys.KeyOperationsParameters{
-		Algorithm: to.Ptr(azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP256),
+	keyID := key.keyID(version)
+	ctx, requestID := withClientRequestID(ctx)
+	resp, err := c.Encrypt(ctx, key.Name, version, azkeys.KeyOperationsParameters{
+		Algorithm: to.Ptr(algorithm),
 		Value:     dataKey,
 	}, nil)
+	key.logRequest("encrypt", keyID, requestID, err)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt sops data key with Azure Key Vault key '%s': %w", key.ToString(), err)
+		err = key.managedHSMError(err)
+		return "", "", fmt.Errorf("failed to encrypt sops data key with Azure Key Vault key '%s': %w", keyID, err)
 	}
 	// This is for compatibility between the SOPS upstream which uses
 	// a much older Azure SDK, and our implementation which is up-to-date
 	// with the latest.
-	encodedEncryptedKey := base64.RawURLEncoding.EncodeToString(resp.Result)
-	key.SetEncryptedDataKey([]byte(encodedEncryptedKey))
-	return nil
+	return base64.RawURLEncoding.EncodeToString(resp.Result), version, nil
 }
 
 // EncryptedDataKey returns the encrypted data key this master key holds.
@@ -112,8 +307,11 @@ func (key *MasterKey) SetEncryptedDataKey(enc []byte) {
 }
 
 // EncryptIfNeeded encrypts the provided SOPS data key, if it has not been
-// encrypted yet.
+// encrypted yet. It is safe for concurrent use, the data key is encrypted
+// only once and the result is shared by all callers.
 func (key *MasterKey) EncryptIfNeeded(dataKey []byte) error {
+	key.encryptMu.Lock()
+	defer key.encryptMu.Unlock()
 	if key.EncryptedKey == "" {
 		return key.Encrypt(dataKey)
 	}
@@ -123,11 +321,41 @@ func (key *MasterKey) EncryptIfNeeded(dataKey []byte) error {
 // Decrypt decrypts the EncryptedKey field with Azure Key Vault and returns
 // the result.
 func (key *MasterKey) Decrypt() ([]byte, error) {
+	return key.DecryptContext(context.Background())
+}
+
+// DecryptContext decrypts the EncryptedKey field as Decrypt, with the given
+// context for the request to Azure Key Vault. The context also bounds the
+// wait for a request slot of the VaultLimiter of the key.
+// The request is not sent while the VaultBreaker of the key is open for the
+// vault.
+func (key *MasterKey) DecryptContext(ctx context.Context) ([]byte, error) {
+	return key.decrypt(ctx)
+}
+
+func (key *MasterKey) decrypt(ctx context.Context) ([]byte, error) {
+	// A malformed SOPS file may lack the encrypted data key, for which Azure
+	// Key Vault would return a confusing error.
+	if key.EncryptedKey == "" {
+		return nil, fmt.Errorf("no encrypted data key present for key '%s'", key.ToString())
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops data key with Azure Key Vault key '%s': %w", key.ToString(), err)
+	}
+	algorithm, err := key.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	// Identical ciphertexts decrypted with the same credential before,
+	// e.g. for other Kustomizations, are not sent to Azure Key Vault again.
+	if dataKey, ok := key.dataKeys.get(key, string(algorithm)); ok {
+		return dataKey, nil
+	}
 	creds, err := key.getTokenCredential()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Azure token credential to decrypt: %w", err)
 	}
-	c, err := azkeys.NewClient(key.VaultURL, creds, nil)
+	c, err := key.cryptoClient(creds)
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct Azure Key Vault crypto client to decrypt data: %w", err)
 	}
@@ -138,37 +366,235 @@ func (key *MasterKey) Decrypt() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to base64 decode Azure Key Vault encrypted key: %w", err)
 	}
-	resp, err := c.Decrypt(context.Background(), key.Name, key.Version, azkeys.KeyOperationsParameters{
-		Algorithm: to.Ptr(azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP256),
+	release, err := key.limiter.Acquire(ctx, key.VaultURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops data key with Azure Key Vault key '%s': %w", key.ToString(), err)
+	}
+	defer release()
+	done, err := key.breaker.Allow(key.VaultURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops data key with Azure Key Vault key '%s': %w", key.ToString(), err)
+	}
+	parameters := azkeys.KeyOperationsParameters{
+		Algorithm: to.Ptr(algorithm),
 		Value:     rawEncryptedKey,
-	}, nil)
+	}
+	decryptCtx, requestID := withClientRequestID(ctx)
+	resp, err := c.Decrypt(decryptCtx, key.Name, requestVersion(key.Version), parameters, nil)
+	done(err)
+	key.logRequest("decrypt", key.ToString(), requestID, err)
+	if err != nil {
+		// Tell a deleted key apart from one that never existed, and
+		// recover it if enabled.
+		err = key.deletedKeyError(ctx, c, err)
+		var deletedErr *KeyDeletedError
+		if errors.As(err, &deletedErr) && key.recoverDeleted {
+			resp, err = key.recoverAndDecrypt(ctx, c, deletedErr, parameters)
+		}
+		err = key.managedHSMError(err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt sops data key with Azure Key Vault key '%s': %w", key.ToString(), err)
 	}
+	key.dataKeys.put(key, string(algorithm), resp.Result)
 	return resp.Result, nil
 }
 
+// WithDecryptedDataKey decrypts the EncryptedKey field with Azure Key Vault
+// and calls fn with the result, which is zeroed once fn returns to shorten
+// the time the plaintext data key is kept in memory. fn must therefore not
+// retain the data key, and has to copy it if it is needed afterwards. The
+// error of fn is returned as is.
+func (key *MasterKey) WithDecryptedDataKey(ctx context.Context, fn func(dataKey []byte) error) error {
+	dataKey, err := key.decrypt(ctx)
+	if err != nil {
+		return err
+	}
+	defer zero(dataKey)
+	return fn(dataKey)
+}
+
+// Rotate re-encrypts the SOPS data key held by the key with the given
+// version of the Azure Key Vault key, without changing the data key itself.
+// When the key resolves the latest version, an empty or LatestVersion
+// version rotates to the current version of the key.
+// On success, EncryptedKey, Version and CreationDate are updated at once.
+// On failure, the key is left unmodified.
+func (key *MasterKey) Rotate(ctx context.Context, newVersion string) error {
+	key.encryptMu.Lock()
+	defer key.encryptMu.Unlock()
+
+	var encryptedKey, version string
+	err := key.WithDecryptedDataKey(ctx, func(dataKey []byte) (err error) {
+		encryptedKey, version, err = key.encrypt(ctx, newVersion, dataKey)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rotate Azure Key Vault key '%s': %w", key.ToString(), err)
+	}
+	key.EncryptedKey = encryptedKey
+	key.Version = version
+	key.CreationDate = time.Now().UTC()
+	return nil
+}
+
 // NeedsRotation returns whether the data key needs to be rotated or not.
 func (key *MasterKey) NeedsRotation() bool {
 	return time.Since(key.CreationDate) > (azkvTTL)
 }
 
-// ToString converts the key to a string representation.
+// algorithm returns the algorithm the data key is encrypted with, or an
+// error if the Algorithm of the key is not supported by Azure Key Vault. It
+// returns an AlgorithmNotAllowedError if the algorithm is not in the
+// allowedAlgorithms of the key.
+func (key *MasterKey) algorithm() (azkeys.JSONWebKeyEncryptionAlgorithm, error) {
+	algorithm, err := key.supportedAlgorithm()
+	if err != nil {
+		return "", err
+	}
+	if !key.allowedAlgorithms.allows(algorithm) {
+		return "", &AlgorithmNotAllowedError{
+			Algorithm: string(algorithm),
+			KeyID:     key.ToString(),
+			Allowed:   key.allowedAlgorithms,
+		}
+	}
+	return algorithm, nil
+}
+
+// supportedAlgorithm returns the algorithm the data key is encrypted with,
+// or an error if the Algorithm of the key is not supported by Azure Key
+// Vault.
+func (key *MasterKey) supportedAlgorithm() (azkeys.JSONWebKeyEncryptionAlgorithm, error) {
+	if key.Algorithm == "" {
+		return defaultAlgorithm, nil
+	}
+	for _, a := range azkeys.PossibleJSONWebKeyEncryptionAlgorithmValues() {
+		if string(a) == key.Algorithm {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported Azure Key Vault encryption algorithm '%s' for key '%s'", key.Algorithm, key.ToString())
+}
+
+// ToString converts the key to a string representation, i.e. the ID of the
+// key version in the vault or Managed HSM.
 func (key *MasterKey) ToString() string {
-	return fmt.Sprintf("%s/keys/%s/%s", key.VaultURL, key.Name, key.Version)
+	return key.keyID(key.Version)
+}
+
+// keyID returns the ID of the given version of the key, without any trailing
+// slash of the VaultURL.
+func (key *MasterKey) keyID(version string) string {
+	return fmt.Sprintf("%s/keys/%s/%s", strings.TrimSuffix(key.VaultURL, "/"), key.Name, version)
+}
+
+// IsManagedHSM returns whether the VaultURL is the one of an Azure Key Vault
+// Managed HSM, i.e. "https://<name>.managedhsm.<suffix>", instead of a vault.
+func (key *MasterKey) IsManagedHSM() bool {
+	u, err := url.Parse(key.VaultURL)
+	return err == nil && isManagedHSMHost(u.Hostname())
+}
+
+// managedHSMError returns a ManagedHSMForbiddenError wrapping the error if
+// the request to the Managed HSM of the key is forbidden, or the error as is
+// otherwise.
+func (key *MasterKey) managedHSMError(err error) error {
+	if err == nil || !key.IsManagedHSM() || ErrorReason(err) != ForbiddenReason {
+		return err
+	}
+	return &ManagedHSMForbiddenError{
+		HSMURL: strings.TrimSuffix(key.VaultURL, "/"),
+		Name:   key.Name,
+		Err:    err,
+	}
+}
+
+// Validate returns an error if the VaultURL is not the URL of a vault or
+// Managed HSM, i.e. an absolute URL without path, query or fragment, or if
+// the Name of the key is empty. Managed HSMs are only served over HTTPS.
+func (key *MasterKey) Validate() error {
+	u, err := url.Parse(key.VaultURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid Azure Key Vault URL '%s': expected an absolute URL", key.VaultURL)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid Azure Key Vault URL '%s': expected a URL without path, query or fragment", key.VaultURL)
+	}
+	if isManagedHSMHost(u.Hostname()) && u.Scheme != "https" {
+		return fmt.Errorf("invalid Azure Key Vault Managed HSM URL '%s': expected the 'https' scheme", key.VaultURL)
+	}
+	if key.Name == "" {
+		return fmt.Errorf("invalid Azure Key Vault key for URL '%s': missing key name", key.VaultURL)
+	}
+	return nil
 }
 
 // ToMap converts the MasterKey to a map for serialization purposes.
-func (key MasterKey) ToMap() map[string]interface{} {
+func (key *MasterKey) ToMap() map[string]interface{} {
 	out := make(map[string]interface{})
 	out["vaultUrl"] = key.VaultURL
 	out["key"] = key.Name
 	out["version"] = key.Version
 	out["created_at"] = key.CreationDate.UTC().Format(time.RFC3339)
 	out["enc"] = key.EncryptedKey
+	if key.Algorithm != "" {
+		out["algorithm"] = key.Algorithm
+	}
 	return out
 }
 
+// MasterKeyFromMap parses a MasterKey from a map as produced by ToMap. It
+// returns an error if any of the vaultUrl, key, version or created_at fields
+// is missing, or if created_at is not an RFC3339 timestamp.
+func MasterKeyFromMap(m map[string]interface{}) (*MasterKey, error) {
+	key := &MasterKey{}
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{
+		{"vaultUrl", &key.VaultURL},
+		{"key", &key.Name},
+		{"version", &key.Version},
+	} {
+		v, err := keymap.String(m, f.name)
+		if err != nil {
+			return nil, err
+		}
+		if v == "" {
+			return nil, fmt.Errorf("missing required field '%s'", f.name)
+		}
+		*f.value = v
+	}
+
+	createdAt, err := keymap.String(m, "created_at")
+	if err != nil {
+		return nil, err
+	}
+	if createdAt == "" {
+		return nil, fmt.Errorf("missing required field 'created_at'")
+	}
+	key.CreationDate, err = time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse field 'created_at': %w", err)
+	}
+
+	if key.EncryptedKey, err = keymap.String(m, "enc"); err != nil {
+		return nil, err
+	}
+	if key.Algorithm, err = keymap.String(m, "algorithm"); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// zero overwrites the bytes of b with zeroes.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 func decode(b []byte) ([]byte, error) {
 	reader, enc := utfbom.Skip(bytes.NewReader(b))
 	switch enc {
@@ -190,10 +616,97 @@ func decode(b []byte) ([]byte, error) {
 	return ioutil.ReadAll(reader)
 }
 
+// withClientRequestID returns a copy of the context with a generated client
+// request ID, sent by the Azure Key Vault client in the
+// clientRequestIDHeader, and the ID.
+func withClientRequestID(ctx context.Context) (context.Context, string) {
+	requestID := uuid.NewString()
+	return runtime.WithHTTPHeader(ctx, http.Header{clientRequestIDHeader: []string{requestID}}), requestID
+}
+
+// logRequest logs the client request ID of the operation on the key with the
+// keyID, to correlate it with the Azure Key Vault audit logs. Failed requests
+// are logged with their error, successful ones at debug level.
+func (key *MasterKey) logRequest(operation, keyID, requestID string, err error) {
+	if key.logger.GetSink() == nil {
+		return
+	}
+	log := key.logger.WithValues("operation", operation, "key", keyID, "clientRequestID", requestID)
+	if err != nil {
+		log.Info("Azure Key Vault request failed", "error", err.Error())
+		return
+	}
+	log.V(1).Info("Azure Key Vault request succeeded")
+}
+
+// cryptoClient returns the cryptoClient constructed by the newCryptoClient
+// func of the key, or by newClient if it is not set. It returns an error if
+// the VaultURL does not match the cloud of the token of the key. The client
+// is constructed for the URL without trailing slash, as the key operations of
+// both vaults and Managed HSMs are served under its "/keys" path. The client is
+// shared with the other keys of the Token of the key for the same vault.
+func (key *MasterKey) cryptoClient(creds azcore.TokenCredential) (cryptoClient, error) {
+	vaultURL, err := vaultURLForSuffixes(strings.TrimSuffix(key.VaultURL, "/"), key.vaultSuffixes, key.rewriteVaultSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if key.newCryptoClient != nil {
+		return key.newCryptoClient(vaultURL, creds)
+	}
+	c, err := key.clients.client(key.clientCacheKey(vaultURL), func() (*azkeys.Client, error) {
+		return key.newClient(vaultURL, creds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newClient returns an Azure Key Vault client for the vault URL, authenticating
+// with the provided credential. When the key has a CA bundle, the certificates
+// are added to the system roots trusted by the client transport, which uses
+// the proxy and minimum TLS version of the Transport of the key. When the key
+// has an API version, it is requested instead of the default of the SDK.
+// The requests are retried according to the retry policy of the key.
+func (key *MasterKey) newClient(vaultURL string, creds azcore.TokenCredential) (*azkeys.Client, error) {
+	opts := &azkeys.ClientOptions{}
+	opts.Retry = key.retryPolicy.options()
+	if len(key.caBundle) > 0 || !key.transport.isZero() {
+		httpClient, err := key.transport.newHTTPClient(key.caBundle)
+		if err != nil {
+			return nil, err
+		}
+		opts.Transport = httpClient
+	}
+	if key.apiVersion != "" {
+		// The azkeys client does not support azcore.ClientOptions.APIVersion,
+		// the version is therefore overridden by a policy.
+		opts.PerCallPolicies = append(opts.PerCallPolicies, apiVersionPolicy(key.apiVersion))
+	}
+	return azkeys.NewClient(vaultURL, creds, opts)
+}
+
+// apiVersionPolicy is a policy.Policy which sets the "api-version" query
+// parameter of the requests to the given version.
+type apiVersionPolicy string
+
+// Do sets the API version of the request, replacing the default version.
+func (v apiVersionPolicy) Do(req *policy.Request) (*http.Response, error) {
+	q := req.Raw().URL.Query()
+	q.Set("api-version", string(v))
+	req.Raw().URL.RawQuery = q.Encode()
+	return req.Next()
+}
+
 // getTokenCredential returns the tokenCredential of the MasterKey, or
-// azidentity.NewDefaultAzureCredential.
+// azidentity.NewDefaultAzureCredential. It returns
+// ErrDefaultCredentialDisabled if the MasterKey has no tokenCredential and
+// the default credential is disabled.
 func (key *MasterKey) getTokenCredential() (azcore.TokenCredential, error) {
 	if key.token == nil {
+		if key.noDefaultCredential {
+			return nil, ErrDefaultCredentialDisabled
+		}
 		return getDefaultAzureCredential()
 	}
 	return key.token, nil
@@ -7,9 +7,38 @@
 package azkv
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
 	. "github.com/onsi/gomega"
 )
 
@@ -26,6 +55,354 @@ func TestToken_ApplyToMasterKey(t *testing.T) {
 	g.Expect(key.token).To(Equal(token.token))
 }
 
+func TestCABundle_ApplyToMasterKey(t *testing.T) {
+	g := NewWithT(t)
+
+	caPEM, _ := newTestCA(t)
+
+	key := &MasterKey{}
+	CABundle(caPEM).ApplyToMasterKey(key)
+	g.Expect(key.caBundle).To(Equal(caPEM))
+}
+
+func TestCABundle_Validate(t *testing.T) {
+	g := NewWithT(t)
+
+	caPEM, _ := newTestCA(t)
+	g.Expect(CABundle(caPEM).Validate()).To(Succeed())
+	g.Expect(CABundle("not a certificate").Validate()).To(MatchError("invalid Azure Key Vault CA bundle: no PEM encoded certificates found"))
+}
+
+func TestMasterKey_Decrypt_CABundle(t *testing.T) {
+	caPEM, serverCert := newTestCA(t)
+
+	// The server rejects every request, a Forbidden response therefore
+	// confirms the TLS handshake succeeded.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":{"code":"Forbidden","message":"denied"}}`))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	newKey := func() *MasterKey {
+		key := MasterKeyFromURL(server.URL, "key-name", "key-version")
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("data"))
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		return key
+	}
+
+	t.Run("with CA bundle", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey()
+		CABundle(caPEM).ApplyToMasterKey(key)
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+	})
+
+	t.Run("invalid CA bundle", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey()
+		CABundle("invalid").ApplyToMasterKey(key)
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("no PEM encoded certificates found"))
+	})
+
+	t.Run("system roots reject the CA", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c, err := Transport{}.newHTTPClient(caPEM)
+		g.Expect(err).ToNot(HaveOccurred())
+		resp, err := c.Get(server.URL)
+		g.Expect(err).ToNot(HaveOccurred())
+		_ = resp.Body.Close()
+
+		_, err = http.DefaultClient.Get(server.URL)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("certificate signed by unknown authority"))
+	})
+}
+
+func TestAPIVersion_ApplyToMasterKey(t *testing.T) {
+	g := NewWithT(t)
+
+	key := &MasterKey{}
+	APIVersion("7.2").ApplyToMasterKey(key)
+	g.Expect(key.apiVersion).To(Equal("7.2"))
+}
+
+func TestMasterKey_Decrypt_APIVersion(t *testing.T) {
+	caPEM, serverCert := newTestCA(t)
+
+	var (
+		mu          sync.Mutex
+		apiVersions []string
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		apiVersions = append(apiVersions, r.URL.Query().Get("api-version"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":{"code":"Forbidden","message":"denied"}}`))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name       string
+		apiVersion string
+		want       string
+	}{
+		{
+			name: "SDK default",
+			want: "7.3",
+		},
+		{
+			name:       "configured version",
+			apiVersion: "7.2",
+			want:       "7.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			mu.Lock()
+			apiVersions = nil
+			mu.Unlock()
+
+			key := MasterKeyFromURL(server.URL, "key-name", "key-version")
+			key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("data"))
+			NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+			CABundle(caPEM).ApplyToMasterKey(key)
+			if tt.apiVersion != "" {
+				APIVersion(tt.apiVersion).ApplyToMasterKey(key)
+			}
+
+			_, err := key.Decrypt()
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+
+			mu.Lock()
+			defer mu.Unlock()
+			g.Expect(apiVersions).ToNot(BeEmpty())
+			for _, v := range apiVersions {
+				g.Expect(v).To(Equal(tt.want))
+			}
+		})
+	}
+}
+
+func TestDisableDefaultCredential_ApplyToMasterKey(t *testing.T) {
+	g := NewWithT(t)
+
+	key := &MasterKey{}
+	DisableDefaultCredential(true).ApplyToMasterKey(key)
+	g.Expect(key.noDefaultCredential).To(BeTrue())
+}
+
+func TestMasterKey_DisableDefaultCredential(t *testing.T) {
+	t.Run("fails without token", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		c.applyToMasterKey(key)
+		DisableDefaultCredential(true).ApplyToMasterKey(key)
+
+		err := key.Encrypt([]byte("data-key"))
+		g.Expect(errors.Is(err, ErrDefaultCredentialDisabled)).To(BeTrue())
+		key.EncryptedKey = "encrypted"
+		_, err = key.Decrypt()
+		g.Expect(errors.Is(err, ErrDefaultCredentialDisabled)).To(BeTrue())
+		g.Expect(c.encrypts).To(BeZero())
+		g.Expect(c.decrypts).To(BeZero())
+	})
+
+	t.Run("uses the token", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		DisableDefaultCredential(true).ApplyToMasterKey(key)
+
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		g.Expect(c.encrypts).To(Equal(1))
+	})
+}
+
+func TestLogger_ApplyToMasterKey(t *testing.T) {
+	g := NewWithT(t)
+
+	key := &MasterKey{}
+	Logger(logr.Discard()).ApplyToMasterKey(key)
+	g.Expect(key.logger).To(Equal(logr.Discard()))
+}
+
+func TestMasterKey_ClientRequestID(t *testing.T) {
+	caPEM, serverCert := newTestCA(t)
+
+	var (
+		mu         sync.Mutex
+		requestIDs []string
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requestIDs = append(requestIDs, r.Header.Get(clientRequestIDHeader))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":{"code":"Forbidden","message":"denied"}}`))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name      string
+		operation string
+		call      func(key *MasterKey) error
+	}{
+		{
+			name:      "decrypt",
+			operation: "decrypt",
+			call: func(key *MasterKey) error {
+				_, err := key.Decrypt()
+				return err
+			},
+		},
+		{
+			name:      "encrypt",
+			operation: "encrypt",
+			call: func(key *MasterKey) error {
+				return key.Encrypt([]byte("data"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			mu.Lock()
+			requestIDs = nil
+			mu.Unlock()
+
+			var logs []string
+			logger := funcr.New(func(_, args string) {
+				logs = append(logs, args)
+			}, funcr.Options{})
+
+			key := MasterKeyFromURL(server.URL, "key-name", "key-version")
+			key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("data"))
+			NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+			CABundle(caPEM).ApplyToMasterKey(key)
+			Logger(logger).ApplyToMasterKey(key)
+
+			g.Expect(tt.call(key)).ToNot(Succeed())
+
+			mu.Lock()
+			defer mu.Unlock()
+			g.Expect(requestIDs).ToNot(BeEmpty())
+			requestID := requestIDs[0]
+			g.Expect(requestID).ToNot(BeEmpty())
+			for _, id := range requestIDs {
+				g.Expect(id).To(Equal(requestID))
+			}
+
+			g.Expect(logs).To(HaveLen(1))
+			g.Expect(logs[0]).To(ContainSubstring(fmt.Sprintf(`"operation"="%s"`, tt.operation)))
+			g.Expect(logs[0]).To(ContainSubstring(fmt.Sprintf(`"key"="%s/keys/key-name/key-version"`, server.URL)))
+			g.Expect(logs[0]).To(ContainSubstring(fmt.Sprintf(`"clientRequestID"="%s"`, requestID)))
+		})
+	}
+
+	t.Run("generates an ID per request", func(t *testing.T) {
+		g := NewWithT(t)
+
+		mu.Lock()
+		requestIDs = nil
+		mu.Unlock()
+
+		key := MasterKeyFromURL(server.URL, "key-name", "key-version")
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("data"))
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		CABundle(caPEM).ApplyToMasterKey(key)
+
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		_, err = key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+
+		mu.Lock()
+		defer mu.Unlock()
+		g.Expect(requestIDs).To(HaveLen(2))
+		g.Expect(requestIDs[0]).ToNot(Equal(requestIDs[1]))
+	})
+}
+
+// fakeTokenCredential is an azcore.TokenCredential returning a static token.
+type fakeTokenCredential struct{}
+
+func (fakeTokenCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// newTestCA returns the PEM encoded certificate of a self-signed CA, and a
+// certificate for 127.0.0.1 signed by the CA.
+func newTestCA(t *testing.T) ([]byte, tls.Certificate) {
+	t.Helper()
+	g := NewWithT(t)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	g.Expect(err).ToNot(HaveOccurred())
+	caCert, err := x509.ParseCertificate(caDER)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caKey)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return caPEM, tls.Certificate{
+		Certificate: [][]byte{serverDER},
+		PrivateKey:  serverKey,
+	}
+}
+
 func TestMasterKey_EncryptedDataKey(t *testing.T) {
 	g := NewWithT(t)
 
@@ -42,6 +419,539 @@ func TestMasterKey_SetEncryptedDataKey(t *testing.T) {
 	g.Expect(key.EncryptedKey).To(BeEquivalentTo(encryptedKey))
 }
 
+func TestMasterKey_EncryptIfNeeded_Concurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	var encrypts int32
+	url, caPEM := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/encrypt") {
+			atomic.AddInt32(&encrypts, 1)
+		}
+		// Widen the window for concurrent callers to race.
+		time.Sleep(10 * time.Millisecond)
+		writeKeyOperationResult(w, r, "encrypted")
+	})
+
+	key := MasterKeyFromURL(url, "key-name", "key-version")
+	NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+	CABundle(caPEM).ApplyToMasterKey(key)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- key.EncryptIfNeeded([]byte("data"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	g.Expect(atomic.LoadInt32(&encrypts)).To(Equal(int32(1)))
+	g.Expect(key.EncryptedKey).To(Equal(base64.RawURLEncoding.EncodeToString([]byte("encrypted"))))
+}
+
+func TestMasterKey_Rotate(t *testing.T) {
+	// The vault decrypts "encrypted-<version>" to the data key, and encrypts
+	// the data key with a version to "encrypted-<version>", unless the
+	// version is "forbidden".
+	url, caPEM := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if len(parts) != 4 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		version, operation := parts[2], parts[3]
+		if version == "forbidden" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":{"code":"Forbidden","message":"denied"}}`))
+			return
+		}
+		switch operation {
+		case "decrypt":
+			writeKeyOperationResult(w, r, "data-key")
+		case "encrypt":
+			writeKeyOperationResult(w, r, "encrypted-"+version)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	newKey := func() *MasterKey {
+		key := MasterKeyFromURL(url, "key-name", "old-version")
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted-old-version"))
+		key.CreationDate = time.Now().Add(-azkvTTL).UTC()
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		CABundle(caPEM).ApplyToMasterKey(key)
+		return key
+	}
+
+	t.Run("re-encrypts the data key with the new version", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey()
+		g.Expect(key.NeedsRotation()).To(BeTrue())
+
+		g.Expect(key.Rotate(context.Background(), "new-version")).To(Succeed())
+		g.Expect(key.Version).To(Equal("new-version"))
+		g.Expect(key.EncryptedKey).To(Equal(base64.RawURLEncoding.EncodeToString([]byte("encrypted-new-version"))))
+		g.Expect(key.NeedsRotation()).To(BeFalse())
+
+		dataKey, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(dataKey).To(BeEquivalentTo("data-key"))
+	})
+
+	t.Run("leaves the key unmodified on encrypt failure", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey()
+		encryptedKey, creationDate := key.EncryptedKey, key.CreationDate
+
+		err := key.Rotate(context.Background(), "forbidden")
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+		g.Expect(key.Version).To(Equal("old-version"))
+		g.Expect(key.EncryptedKey).To(Equal(encryptedKey))
+		g.Expect(key.CreationDate).To(Equal(creationDate))
+	})
+
+	t.Run("leaves the key unmodified on decrypt failure", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey()
+		key.Version = "forbidden"
+		encryptedKey, creationDate := key.EncryptedKey, key.CreationDate
+
+		err := key.Rotate(context.Background(), "new-version")
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(key.Version).To(Equal("forbidden"))
+		g.Expect(key.EncryptedKey).To(Equal(encryptedKey))
+		g.Expect(key.CreationDate).To(Equal(creationDate))
+	})
+}
+
+// newTestKeyVault starts a TLS server answering the authentication challenge
+// of the Azure Key Vault client, and calling handler with the authenticated
+// requests. It returns the URL of the server and the PEM encoded CA to trust.
+func newTestKeyVault(t *testing.T, handler http.HandlerFunc) (string, []byte) {
+	t.Helper()
+
+	caPEM, serverCert := newTestCA(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The challenge resource must be a parent domain of the vault host.
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer authorization="https://login.microsoftonline.com/tenant", resource="https://%s"`,
+				strings.TrimPrefix(r.Host, "127.")))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.URL, caPEM
+}
+
+// writeKeyOperationResult writes an Azure Key Vault key operation result with
+// the given value.
+func writeKeyOperationResult(w http.ResponseWriter, r *http.Request, value string) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"kid":"https://%s%s","value":"%s"}`,
+		r.Host, r.URL.Path, base64.RawURLEncoding.EncodeToString([]byte(value)))
+}
+
+// fakeCryptoClient is a cryptoClient which encrypts and decrypts in memory
+// with RSA-OAEP-256, using a different RSA key per key name and version.
+type fakeCryptoClient struct {
+	// err is returned by all operations when set.
+	err error
+	// expires is the expiry date of all the keys, if set.
+	expires *time.Time
+	// latestVersion is the current version of all the keys, returned by
+	// GetKey for an empty version, if set.
+	latestVersion string
+
+	// deleted are the names of the keys which are deleted but recoverable,
+	// with their scheduled purge date. A recovered key is only removed
+	// from deleted on recovery if recoverInstantly is set.
+	deleted          map[string]time.Time
+	recoverInstantly bool
+
+	mu       sync.Mutex
+	keys     map[string]*rsa.PrivateKey
+	encrypts int
+	decrypts int
+	getKeys  int
+	recovers int
+
+	// vaultURLs are the vault URLs the client was constructed for.
+	vaultURLs []string
+}
+
+func newFakeCryptoClient() *fakeCryptoClient {
+	return &fakeCryptoClient{keys: make(map[string]*rsa.PrivateKey)}
+}
+
+// applyToMasterKey configures the key to use the fake client.
+func (c *fakeCryptoClient) applyToMasterKey(key *MasterKey) {
+	key.newCryptoClient = func(vaultURL string, _ azcore.TokenCredential) (cryptoClient, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.vaultURLs = append(c.vaultURLs, vaultURL)
+		return c, nil
+	}
+}
+
+func (c *fakeCryptoClient) key(name, version string) (*rsa.PrivateKey, error) {
+	id := name + "/" + version
+	if k, ok := c.keys[id]; ok {
+		return k, nil
+	}
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	c.keys[id] = k
+	return k, nil
+}
+
+func (c *fakeCryptoClient) Encrypt(_ context.Context, name string, version string, parameters azkeys.KeyOperationsParameters,
+	_ *azkeys.EncryptOptions) (azkeys.EncryptResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.encrypts++
+	newHash, err := c.checkOperation(parameters)
+	if err != nil {
+		return azkeys.EncryptResponse{}, err
+	}
+	k, err := c.key(name, version)
+	if err != nil {
+		return azkeys.EncryptResponse{}, err
+	}
+	out, err := rsa.EncryptOAEP(newHash(), rand.Reader, &k.PublicKey, parameters.Value, nil)
+	if err != nil {
+		return azkeys.EncryptResponse{}, err
+	}
+	return azkeys.EncryptResponse{KeyOperationResult: azkeys.KeyOperationResult{Result: out}}, nil
+}
+
+func (c *fakeCryptoClient) Decrypt(_ context.Context, name string, version string, parameters azkeys.KeyOperationsParameters,
+	_ *azkeys.DecryptOptions) (azkeys.DecryptResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.decrypts++
+	if _, ok := c.deleted[name]; ok {
+		return azkeys.DecryptResponse{}, newResponseError(http.StatusNotFound,
+			`{"error":{"code":"KeyNotFound","message":"A key with (name/id) `+name+` was not found in this key vault."}}`)
+	}
+	newHash, err := c.checkOperation(parameters)
+	if err != nil {
+		return azkeys.DecryptResponse{}, err
+	}
+	k, err := c.key(name, version)
+	if err != nil {
+		return azkeys.DecryptResponse{}, err
+	}
+	out, err := rsa.DecryptOAEP(newHash(), rand.Reader, k, parameters.Value, nil)
+	if err != nil {
+		return azkeys.DecryptResponse{}, err
+	}
+	return azkeys.DecryptResponse{KeyOperationResult: azkeys.KeyOperationResult{Result: out}}, nil
+}
+
+func (c *fakeCryptoClient) GetKey(_ context.Context, name string, version string, _ *azkeys.GetKeyOptions) (azkeys.GetKeyResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.getKeys++
+	if c.err != nil {
+		return azkeys.GetKeyResponse{}, c.err
+	}
+	if version == "" {
+		version = c.latestVersion
+	}
+	kid := azkeys.ID(fmt.Sprintf("https://invalid.vault.azure.net/keys/%s/%s", name, version))
+	return azkeys.GetKeyResponse{KeyBundle: azkeys.KeyBundle{
+		Key:        &azkeys.JSONWebKey{KID: &kid},
+		Attributes: &azkeys.KeyAttributes{Expires: c.expires},
+	}}, nil
+}
+
+func (c *fakeCryptoClient) GetDeletedKey(_ context.Context, name string, _ *azkeys.GetDeletedKeyOptions) (azkeys.GetDeletedKeyResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purgeDate, ok := c.deleted[name]
+	if !ok {
+		return azkeys.GetDeletedKeyResponse{}, newResponseError(http.StatusNotFound,
+			`{"error":{"code":"KeyNotFound","message":"Deleted Key not found: `+name+`"}}`)
+	}
+	return azkeys.GetDeletedKeyResponse{DeletedKeyBundle: azkeys.DeletedKeyBundle{
+		ScheduledPurgeDate: &purgeDate,
+	}}, nil
+}
+
+func (c *fakeCryptoClient) RecoverDeletedKey(_ context.Context, name string, _ *azkeys.RecoverDeletedKeyOptions) (azkeys.RecoverDeletedKeyResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recovers++
+	if c.err != nil {
+		return azkeys.RecoverDeletedKeyResponse{}, c.err
+	}
+	if _, ok := c.deleted[name]; !ok {
+		return azkeys.RecoverDeletedKeyResponse{}, newResponseError(http.StatusNotFound,
+			`{"error":{"code":"KeyNotFound","message":"Deleted Key not found: `+name+`"}}`)
+	}
+	if c.recoverInstantly {
+		delete(c.deleted, name)
+	}
+	return azkeys.RecoverDeletedKeyResponse{}, nil
+}
+
+// checkOperation returns the hash function of the RSA-OAEP algorithm of the
+// operation, or an error for other algorithms.
+func (c *fakeCryptoClient) checkOperation(parameters azkeys.KeyOperationsParameters) (func() hash.Hash, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if parameters.Algorithm == nil {
+		return nil, fmt.Errorf("missing algorithm")
+	}
+	switch *parameters.Algorithm {
+	case azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP256:
+		return sha256.New, nil
+	case azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP:
+		return sha1.New, nil
+	}
+	return nil, fmt.Errorf("unexpected algorithm %v", *parameters.Algorithm)
+}
+
+func TestMasterKey_FakeCryptoClient(t *testing.T) {
+	newKey := func(c *fakeCryptoClient, version string) *MasterKey {
+		// The vault does not exist, all operations are handled by the fake.
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", version)
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		return key
+	}
+
+	t.Run("round-trips the data key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, "v1")
+		dataKey := []byte("data-key")
+
+		g.Expect(key.Encrypt(dataKey)).To(Succeed())
+		g.Expect(key.EncryptedKey).ToNot(BeEmpty())
+		g.Expect(key.EncryptedKey).ToNot(ContainSubstring(string(dataKey)))
+
+		// Decrypt from the serialized form of the key.
+		m := key.ToMap()
+		m["vaultUrl"], m["key"], m["version"] = key.VaultURL, key.Name, key.Version
+		decodedKey, err := MasterKeyFromMap(m)
+		g.Expect(err).ToNot(HaveOccurred())
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(decodedKey)
+		c.applyToMasterKey(decodedKey)
+
+		got, err := decodedKey.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal(dataKey))
+		g.Expect(c.encrypts).To(Equal(1))
+		g.Expect(c.decrypts).To(Equal(1))
+	})
+
+	t.Run("fails to decrypt with another key version", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, "v1")
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+
+		key.Version = "v2"
+		_, err := key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(HavePrefix("failed to decrypt sops data key with Azure Key Vault key 'https://invalid.vault.azure.net/keys/key-name/v2': "))
+	})
+
+	t.Run("rotates the data key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, "v1")
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		oldEncryptedKey := key.EncryptedKey
+
+		g.Expect(key.Rotate(context.Background(), "v2")).To(Succeed())
+		g.Expect(key.Version).To(Equal("v2"))
+		g.Expect(key.EncryptedKey).ToNot(Equal(oldEncryptedKey))
+
+		got, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(BeEquivalentTo("data-key"))
+	})
+
+	t.Run("surfaces the reason of service errors", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		c.err = newResponseError(http.StatusForbidden, `{"error":{"code":"Forbidden","message":"The user does not have encrypt permission"}}`)
+		key := newKey(c, "v1")
+
+		err := key.Encrypt([]byte("data-key"))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+		g.Expect(key.EncryptedKey).To(BeEmpty())
+
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+		_, err = key.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+	})
+
+	t.Run("fails to construct the client", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		key.newCryptoClient = func(string, azcore.TokenCredential) (cryptoClient, error) {
+			return nil, fmt.Errorf("no client")
+		}
+
+		err := key.Encrypt([]byte("data-key"))
+		g.Expect(err).To(MatchError("failed to construct Azure Key Vault crypto client to encrypt data: no client"))
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+		_, err = key.Decrypt()
+		g.Expect(err).To(MatchError("failed to construct Azure Key Vault crypto client to decrypt data: no client"))
+	})
+}
+
+func TestMasterKey_Decrypt_EmptyEncryptedKey(t *testing.T) {
+	g := NewWithT(t)
+
+	c := newFakeCryptoClient()
+	key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+	NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+	c.applyToMasterKey(key)
+
+	_, err := key.Decrypt()
+	g.Expect(err).To(MatchError("no encrypted data key present for key 'https://invalid.vault.azure.net/keys/key-name/v1'"))
+
+	err = key.Rotate(context.Background(), "v2")
+	g.Expect(err).To(MatchError(ContainSubstring("no encrypted data key present for key")))
+	g.Expect(key.Version).To(Equal("v1"))
+
+	// The service is not called.
+	g.Expect(c.decrypts).To(BeZero())
+	g.Expect(c.encrypts).To(BeZero())
+}
+
+func TestMasterKey_WithDecryptedDataKey(t *testing.T) {
+	c := newFakeCryptoClient()
+	newKey := func() *MasterKey {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		return key
+	}
+	dataKey := []byte("data-key")
+
+	t.Run("zeroes the data key after the callback", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey()
+		g.Expect(key.Encrypt(dataKey)).To(Succeed())
+
+		var got []byte
+		err := key.WithDecryptedDataKey(context.Background(), func(b []byte) error {
+			g.Expect(b).To(Equal(dataKey))
+			got = b
+			return nil
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal(make([]byte, len(dataKey))))
+	})
+
+	t.Run("zeroes the data key on callback error", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey()
+		g.Expect(key.Encrypt(dataKey)).To(Succeed())
+
+		fnErr := errors.New("callback failed")
+		var got []byte
+		err := key.WithDecryptedDataKey(context.Background(), func(b []byte) error {
+			got = b
+			return fnErr
+		})
+		g.Expect(err).To(Equal(fnErr))
+		g.Expect(got).To(Equal(make([]byte, len(dataKey))))
+	})
+
+	t.Run("does not call the callback on decryption error", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey()
+		var called bool
+		err := key.WithDecryptedDataKey(context.Background(), func([]byte) error {
+			called = true
+			return nil
+		})
+		g.Expect(err).To(MatchError(ContainSubstring("no encrypted data key present for key")))
+		g.Expect(called).To(BeFalse())
+	})
+}
+
+func TestMasterKey_Algorithm(t *testing.T) {
+	newKey := func(c *fakeCryptoClient, algorithm string) *MasterKey {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		key.Algorithm = algorithm
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		return key
+	}
+	dataKey := []byte("data-key")
+
+	t.Run("decrypts with the algorithm of the key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, string(azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP))
+		g.Expect(key.Encrypt(dataKey)).To(Succeed())
+
+		got, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal(dataKey))
+
+		// The data key can't be decrypted with the default algorithm.
+		other := newKey(c, "")
+		other.EncryptedKey = key.EncryptedKey
+		_, err = other.Decrypt()
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("fails on an unsupported algorithm", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, "ROT13")
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("data"))
+
+		_, err := key.Decrypt()
+		g.Expect(err).To(MatchError("unsupported Azure Key Vault encryption algorithm 'ROT13' for key 'https://invalid.vault.azure.net/keys/key-name/v1'"))
+		g.Expect(key.Encrypt(dataKey)).ToNot(Succeed())
+		g.Expect(c.decrypts).To(BeZero())
+		g.Expect(c.encrypts).To(BeZero())
+	})
+}
+
 func TestMasterKey_NeedsRotation(t *testing.T) {
 	g := NewWithT(t)
 
@@ -57,6 +967,159 @@ func TestMasterKey_ToString(t *testing.T) {
 
 	key := MasterKeyFromURL("https://myvault.vault.azure.net", "key-name", "key-version")
 	g.Expect(key.ToString()).To(Equal("https://myvault.vault.azure.net/keys/key-name/key-version"))
+
+	key = MasterKeyFromURL("https://myhsm.managedhsm.azure.net/", "key-name", "key-version")
+	g.Expect(key.ToString()).To(Equal("https://myhsm.managedhsm.azure.net/keys/key-name/key-version"))
+}
+
+func TestMasterKey_Validate(t *testing.T) {
+	tests := []struct {
+		name       string
+		vaultURL   string
+		keyName    string
+		managedHSM bool
+		wantErr    string
+	}{
+		{
+			name:     "vault",
+			vaultURL: "https://myvault.vault.azure.net",
+			keyName:  "key-name",
+		},
+		{
+			name:       "managed HSM",
+			vaultURL:   "https://myhsm.managedhsm.azure.net",
+			keyName:    "key-name",
+			managedHSM: true,
+		},
+		{
+			name:       "managed HSM with trailing slash",
+			vaultURL:   "https://myhsm.managedhsm.usgovcloudapi.net/",
+			keyName:    "key-name",
+			managedHSM: true,
+		},
+		{
+			name:     "relative URL",
+			vaultURL: "myvault.vault.azure.net",
+			keyName:  "key-name",
+			wantErr:  "expected an absolute URL",
+		},
+		{
+			name:       "managed HSM key path",
+			vaultURL:   "https://myhsm.managedhsm.azure.net/keys/key-name",
+			keyName:    "key-name",
+			managedHSM: true,
+			wantErr:    "expected a URL without path, query or fragment",
+		},
+		{
+			name:       "managed HSM without HTTPS",
+			vaultURL:   "http://myhsm.managedhsm.azure.net",
+			keyName:    "key-name",
+			managedHSM: true,
+			wantErr:    "expected the 'https' scheme",
+		},
+		{
+			name:     "missing key name",
+			vaultURL: "https://myvault.vault.azure.net",
+			wantErr:  "missing key name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			key := MasterKeyFromURL(tt.vaultURL, tt.keyName, "key-version")
+			g.Expect(key.IsManagedHSM()).To(Equal(tt.managedHSM))
+			err := key.Validate()
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
+
+func TestMasterKey_ManagedHSM(t *testing.T) {
+	const hsmURL = "https://myhsm.managedhsm.azure.net/"
+
+	t.Run("constructs a client for the managed HSM", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := MasterKeyFromURL(hsmURL, "key-name", "key-version")
+		c, err := key.cryptoClient(fakeTokenCredential{})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(c).To(BeAssignableToTypeOf(&azkeys.Client{}))
+	})
+
+	t.Run("round-trips the data key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := MasterKeyFromURL(hsmURL, "key-name", "key-version")
+		token, err := TokenFromAADConfig(AADConfig{
+			TenantID:      "tenant",
+			ClientID:      "client",
+			ClientSecret:  "secret",
+			AuthorityHost: "https://login.microsoftonline.com/",
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		token.ApplyToMasterKey(key)
+		c := newFakeCryptoClient()
+		c.applyToMasterKey(key)
+
+		dataKey := []byte("data-key")
+		g.Expect(key.Encrypt(dataKey)).To(Succeed())
+		got, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal(dataKey))
+		g.Expect(c.encrypts).To(Equal(1))
+		g.Expect(c.decrypts).To(Equal(1))
+	})
+
+	t.Run("fails with an invalid URL", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := MasterKeyFromURL("http://myhsm.managedhsm.azure.net", "key-name", "key-version")
+		c := newFakeCryptoClient()
+		c.applyToMasterKey(key)
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+
+		err := key.Encrypt([]byte("data-key"))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("invalid Azure Key Vault Managed HSM URL"))
+		g.Expect(c.encrypts).To(BeZero())
+	})
+
+	t.Run("hints at the local RBAC of a forbidden request", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		c.err = newResponseError(http.StatusForbidden, `{"error":{"code":"Forbidden","message":"Operation not allowed"}}`)
+		key := MasterKeyFromURL(hsmURL, "key-name", "key-version")
+		c.applyToMasterKey(key)
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+
+		err := key.Encrypt([]byte("data-key"))
+		var hsmErr *ManagedHSMForbiddenError
+		g.Expect(errors.As(err, &hsmErr)).To(BeTrue())
+		g.Expect(hsmErr.HSMURL).To(Equal("https://myhsm.managedhsm.azure.net"))
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+		g.Expect(err.Error()).To(ContainSubstring("'az keyvault role assignment create --hsm-name myhsm " +
+			"--role \"Managed HSM Crypto User\" --scope /keys/key-name --assignee <principal-id>'"))
+
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+		_, err = key.Decrypt()
+		g.Expect(errors.As(err, &hsmErr)).To(BeTrue())
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+
+		// The requests to a vault are not authorized by local roles.
+		vaultKey := MasterKeyFromURL("https://myvault.vault.azure.net", "key-name", "key-version")
+		c.applyToMasterKey(vaultKey)
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(vaultKey)
+		err = vaultKey.Encrypt([]byte("data-key"))
+		g.Expect(errors.As(err, &hsmErr)).To(BeFalse())
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+	})
 }
 
 func TestMasterKey_ToMap(t *testing.T) {
@@ -72,3 +1135,85 @@ func TestMasterKey_ToMap(t *testing.T) {
 		"enc":        key.EncryptedKey,
 	}))
 }
+
+func TestMasterKeyFromMap(t *testing.T) {
+	g := NewWithT(t)
+
+	key := MasterKeyFromURL("https://myvault.vault.azure.net", "key-name", "key-version")
+	// ToMap serializes the creation date with a precision of seconds.
+	key.CreationDate = key.CreationDate.Truncate(time.Second)
+	key.EncryptedKey = "data"
+	key.Algorithm = "RSA-OAEP"
+
+	got, err := MasterKeyFromMap(key.ToMap())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal(key))
+	g.Expect(got.CreationDate.Equal(key.CreationDate)).To(BeTrue())
+	g.Expect(got.ToMap()).To(Equal(key.ToMap()))
+}
+
+func TestMasterKeyFromMap_Errors(t *testing.T) {
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"vaultUrl":   "https://myvault.vault.azure.net",
+			"key":        "key-name",
+			"version":    "key-version",
+			"created_at": "2022-01-01T00:00:00Z",
+			"enc":        "data",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(m map[string]interface{})
+		wantErr string
+	}{
+		{
+			name:    "missing vaultUrl",
+			mutate:  func(m map[string]interface{}) { delete(m, "vaultUrl") },
+			wantErr: "missing required field 'vaultUrl'",
+		},
+		{
+			name:    "empty key",
+			mutate:  func(m map[string]interface{}) { m["key"] = "" },
+			wantErr: "missing required field 'key'",
+		},
+		{
+			name:    "missing version",
+			mutate:  func(m map[string]interface{}) { delete(m, "version") },
+			wantErr: "missing required field 'version'",
+		},
+		{
+			name:    "missing created_at",
+			mutate:  func(m map[string]interface{}) { delete(m, "created_at") },
+			wantErr: "missing required field 'created_at'",
+		},
+		{
+			name:    "invalid created_at",
+			mutate:  func(m map[string]interface{}) { m["created_at"] = "yesterday" },
+			wantErr: "failed to parse field 'created_at'",
+		},
+		{
+			name:    "non-string enc",
+			mutate:  func(m map[string]interface{}) { m["enc"] = 42 },
+			wantErr: "field 'enc' must be a string, got int",
+		},
+		{
+			name:    "non-string algorithm",
+			mutate:  func(m map[string]interface{}) { m["algorithm"] = true },
+			wantErr: "field 'algorithm' must be a string, got bool",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			m := valid()
+			tt.mutate(m)
+			got, err := MasterKeyFromMap(m)
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+			g.Expect(got).To(BeNil())
+		})
+	}
+}
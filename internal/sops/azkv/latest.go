@@ -0,0 +1,75 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// LatestVersion is the Version of a MasterKey which, like an empty Version,
+// refers to the current version of the Azure Key Vault key. It is not a
+// version of the Key Vault API, and is sent to it as an empty version.
+const LatestVersion = "latest"
+
+// ResolveLatestVersion configures whether a MasterKey with an empty or
+// LatestVersion Version resolves the current version of the Azure Key Vault
+// key when encrypting, and records it as the Version of the key. This keeps
+// the data keys re-encrypted after a rotation of the key in Key Vault from
+// pinning the previous version. Resolving the version requires the 'get'
+// permission on the key, in addition to the permission to encrypt.
+type ResolveLatestVersion bool
+
+// ApplyToMasterKey configures the resolution of the latest version on the
+// provided key.
+func (r ResolveLatestVersion) ApplyToMasterKey(key *MasterKey) {
+	key.resolveLatestVersion = bool(r)
+}
+
+// isLatestVersion returns whether the version refers to the current version
+// of the key.
+func isLatestVersion(version string) bool {
+	return version == "" || strings.EqualFold(version, LatestVersion)
+}
+
+// requestVersion returns the version of the key sent to the Key Vault API,
+// which is empty for a version referring to the current version of the key.
+func requestVersion(version string) string {
+	if isLatestVersion(version) {
+		return ""
+	}
+	return version
+}
+
+// resolveVersion returns the current version of the key from the Key Vault
+// keys API, if the key resolves the latest version and the given version
+// refers to it. Otherwise, the given version is returned as requestVersion.
+func (key *MasterKey) resolveVersion(ctx context.Context, c cryptoClient, version string) (string, error) {
+	if !isLatestVersion(version) {
+		return version, nil
+	}
+	if !key.resolveLatestVersion {
+		return "", nil
+	}
+	keyID := key.keyID(LatestVersion)
+	ctx, requestID := withClientRequestID(ctx)
+	resp, err := c.GetKey(ctx, key.Name, "", nil)
+	key.logRequest("get", keyID, requestID, err)
+	if err != nil {
+		err = key.managedHSMError(err)
+		return "", fmt.Errorf("failed to resolve the latest version of Azure Key Vault key '%s': %w", keyID, err)
+	}
+	var resolved string
+	if resp.Key != nil && resp.Key.KID != nil {
+		resolved = resp.Key.KID.Version()
+	}
+	if resolved == "" {
+		return "", fmt.Errorf("failed to resolve the latest version of Azure Key Vault key '%s': the key ID has no version", keyID)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestResolveLatestVersion_ApplyToMasterKey(t *testing.T) {
+	g := NewWithT(t)
+
+	key := &MasterKey{}
+	ResolveLatestVersion(true).ApplyToMasterKey(key)
+	g.Expect(key.resolveLatestVersion).To(BeTrue())
+}
+
+func TestMasterKey_Encrypt_ResolveLatestVersion(t *testing.T) {
+	newKey := func(c *fakeCryptoClient, version string, resolve bool) *MasterKey {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", version)
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		ResolveLatestVersion(resolve).ApplyToMasterKey(key)
+		c.applyToMasterKey(key)
+		return key
+	}
+
+	for _, version := range []string{"", LatestVersion, "Latest"} {
+		t.Run("resolves version '"+version+"'", func(t *testing.T) {
+			g := NewWithT(t)
+
+			c := newFakeCryptoClient()
+			c.latestVersion = "v2"
+			key := newKey(c, version, true)
+
+			g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+			g.Expect(key.Version).To(Equal("v2"))
+			g.Expect(c.getKeys).To(Equal(1))
+
+			got, err := key.Decrypt()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+		})
+	}
+
+	t.Run("keeps a fixed version", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		c.latestVersion = "v2"
+		key := newKey(c, "v1", true)
+
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		g.Expect(key.Version).To(Equal("v1"))
+		g.Expect(c.getKeys).To(BeZero())
+	})
+
+	t.Run("does not resolve by default", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		c.latestVersion = "v2"
+		key := newKey(c, "", false)
+
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		g.Expect(key.Version).To(BeEmpty())
+		g.Expect(c.getKeys).To(BeZero())
+	})
+
+	t.Run("sends the latest version as an empty version", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		key := newKey(c, LatestVersion, false)
+
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		g.Expect(key.Version).To(BeEmpty())
+		g.Expect(c.keys).To(HaveLen(1))
+		g.Expect(c.keys).To(HaveKey("key-name/"))
+
+		// A key recorded with the latest version decrypts with the current
+		// version as well.
+		recorded := newKey(c, LatestVersion, false)
+		recorded.EncryptedKey = key.EncryptedKey
+		got, err := recorded.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("data-key")))
+		g.Expect(c.keys).To(HaveLen(1))
+	})
+
+	t.Run("fails without the version of the key ID", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := newKey(newFakeCryptoClient(), LatestVersion, true)
+
+		err := key.Encrypt([]byte("data-key"))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(Equal("failed to resolve the latest version of Azure Key Vault key " +
+			"'https://invalid.vault.azure.net/keys/key-name/latest': the key ID has no version"))
+		g.Expect(key.Version).To(Equal(LatestVersion))
+		g.Expect(key.EncryptedKey).To(BeEmpty())
+	})
+
+	t.Run("fails without the permission to get the key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		c := newFakeCryptoClient()
+		c.err = newResponseError(http.StatusForbidden, `{"error":{"code":"Forbidden","message":"The user does not have get permission"}}`)
+		key := newKey(c, "", true)
+
+		err := key.Encrypt([]byte("data-key"))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(HavePrefix("failed to resolve the latest version of Azure Key Vault key 'https://invalid.vault.azure.net/keys/key-name/latest': "))
+		g.Expect(ErrorReason(err)).To(Equal(ForbiddenReason))
+		g.Expect(c.encrypts).To(BeZero())
+	})
+}
+
+func TestMasterKey_Rotate_ResolveLatestVersion(t *testing.T) {
+	g := NewWithT(t)
+
+	c := newFakeCryptoClient()
+	key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+	NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+	ResolveLatestVersion(true).ApplyToMasterKey(key)
+	c.applyToMasterKey(key)
+	g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+
+	c.latestVersion = "v2"
+	g.Expect(key.Rotate(context.Background(), LatestVersion)).To(Succeed())
+	g.Expect(key.Version).To(Equal("v2"))
+
+	got, err := key.Decrypt()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// VaultLimiter bounds the number of concurrent Encrypt and Decrypt requests
+// to each Azure Key Vault, to stay within the transaction quotas of the
+// vaults when decrypting for many Kustomizations in parallel. The requests
+// are limited per vault URL, the requests to different vaults do not affect
+// each other. It is safe for concurrent use, and is meant to be shared by
+// all the MasterKeys of the process.
+type VaultLimiter struct {
+	limit int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// NewVaultLimiter returns a new VaultLimiter which allows the given number
+// of concurrent requests per vault. A limit lower than one disables the
+// limit.
+func NewVaultLimiter(limit int) *VaultLimiter {
+	return &VaultLimiter{
+		limit: limit,
+		slots: make(map[string]chan struct{}),
+	}
+}
+
+// ApplyToMasterKey configures the VaultLimiter on the provided key.
+func (l *VaultLimiter) ApplyToMasterKey(key *MasterKey) {
+	key.limiter = l
+}
+
+// Acquire waits for a request slot of the vault at the given URL, and
+// returns the function releasing it once the request is done. It returns an
+// error without a slot when the context is done before a slot is available.
+// A nil VaultLimiter does not limit the requests.
+func (l *VaultLimiter) Acquire(ctx context.Context, vaultURL string) (func(), error) {
+	if l == nil || l.limit < 1 {
+		return func() {}, nil
+	}
+
+	slots := l.vaultSlots(vaultURL)
+	select {
+	case slots <- struct{}{}:
+		var once sync.Once
+		return func() {
+			once.Do(func() { <-slots })
+		}, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to wait for a request slot of Azure Key Vault '%s': %w", vaultURL, ctx.Err())
+	}
+}
+
+// vaultSlots returns the semaphore of the vault at the given URL, creating
+// it on the first request. The URL is normalized, as SOPS files may refer to
+// the same vault with a different case or trailing slash.
+func (l *VaultLimiter) vaultSlots(vaultURL string) chan struct{} {
+	id := vaultID(vaultURL)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots, ok := l.slots[id]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[id] = slots
+	}
+	return slots
+}
+
+// vaultID returns the normalized vault URL identifying the vault.
+func vaultID(vaultURL string) string {
+	return strings.TrimSuffix(strings.ToLower(vaultURL), "/")
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+	. "github.com/onsi/gomega"
+)
+
+// concurrencyRecorder records the maximum number of concurrent calls to run.
+type concurrencyRecorder struct {
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (r *concurrencyRecorder) run(d time.Duration) {
+	r.mu.Lock()
+	r.inFlight++
+	if r.inFlight > r.max {
+		r.max = r.inFlight
+	}
+	r.mu.Unlock()
+
+	time.Sleep(d)
+
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+}
+
+func (r *concurrencyRecorder) maxInFlight() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.max
+}
+
+// slowCryptoClient is a fakeCryptoClient of which the Decrypt calls take
+// some time, and are recorded by a concurrencyRecorder.
+type slowCryptoClient struct {
+	*fakeCryptoClient
+	recorder *concurrencyRecorder
+}
+
+func (c *slowCryptoClient) Decrypt(ctx context.Context, name string, version string, parameters azkeys.KeyOperationsParameters,
+	options *azkeys.DecryptOptions) (azkeys.DecryptResponse, error) {
+	c.recorder.run(20 * time.Millisecond)
+	return c.fakeCryptoClient.Decrypt(ctx, name, version, parameters, options)
+}
+
+func TestVaultLimiter_Acquire(t *testing.T) {
+	const vaultURL = "https://example.vault.azure.net"
+
+	t.Run("limits the concurrent requests to a vault", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := NewVaultLimiter(2)
+		recorder := &concurrencyRecorder{}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := l.Acquire(context.Background(), vaultURL)
+				g.Expect(err).ToNot(HaveOccurred())
+				defer release()
+				recorder.run(10 * time.Millisecond)
+			}()
+		}
+		wg.Wait()
+		g.Expect(recorder.maxInFlight()).To(Equal(2))
+	})
+
+	t.Run("does not limit the requests to other vaults", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := NewVaultLimiter(1)
+		release, err := l.Acquire(context.Background(), vaultURL)
+		g.Expect(err).ToNot(HaveOccurred())
+		defer release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		otherRelease, err := l.Acquire(ctx, "https://other.vault.azure.net")
+		g.Expect(err).ToNot(HaveOccurred())
+		otherRelease()
+	})
+
+	t.Run("limits the requests to the same vault with another URL case", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := NewVaultLimiter(1)
+		release, err := l.Acquire(context.Background(), vaultURL+"/")
+		g.Expect(err).ToNot(HaveOccurred())
+		defer release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = l.Acquire(ctx, "https://EXAMPLE.vault.azure.net")
+		g.Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+
+	t.Run("stops waiting when the context is done", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := NewVaultLimiter(1)
+		release, err := l.Acquire(context.Background(), vaultURL)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = l.Acquire(ctx, vaultURL)
+		g.Expect(err).To(MatchError(context.Canceled))
+		g.Expect(err.Error()).To(ContainSubstring(vaultURL))
+
+		// The cancelled request did not take the slot.
+		release()
+		ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		release, err = l.Acquire(ctx, vaultURL)
+		g.Expect(err).ToNot(HaveOccurred())
+		release()
+	})
+
+	t.Run("releases a slot once", func(t *testing.T) {
+		g := NewWithT(t)
+
+		l := NewVaultLimiter(1)
+		release, err := l.Acquire(context.Background(), vaultURL)
+		g.Expect(err).ToNot(HaveOccurred())
+		release()
+		release()
+
+		_, err = l.Acquire(context.Background(), vaultURL)
+		g.Expect(err).ToNot(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = l.Acquire(ctx, vaultURL)
+		g.Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+
+	t.Run("nil limiter and zero limit do not limit", func(t *testing.T) {
+		g := NewWithT(t)
+
+		for _, l := range []*VaultLimiter{nil, NewVaultLimiter(0)} {
+			for i := 0; i < 3; i++ {
+				_, err := l.Acquire(context.Background(), vaultURL)
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+		}
+	})
+}
+
+func TestMasterKey_DecryptContext_VaultLimiter(t *testing.T) {
+	fake := newFakeCryptoClient()
+	recorder := &concurrencyRecorder{}
+	c := &slowCryptoClient{fakeCryptoClient: fake, recorder: recorder}
+	l := NewVaultLimiter(1)
+
+	newKey := func() *MasterKey {
+		key := MasterKeyFromURL("https://invalid.vault.azure.net", "key-name", "v1")
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		l.ApplyToMasterKey(key)
+		key.newCryptoClient = func(string, azcore.TokenCredential) (cryptoClient, error) {
+			return c, nil
+		}
+		return key
+	}
+
+	t.Run("serializes the requests to the vault", func(t *testing.T) {
+		g := NewWithT(t)
+
+		dataKey := []byte("data-key")
+		encrypted := newKey()
+		g.Expect(encrypted.Encrypt(dataKey)).To(Succeed())
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				key := newKey()
+				key.EncryptedKey = encrypted.EncryptedKey
+				got, err := key.DecryptContext(context.Background())
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(got).To(Equal(dataKey))
+			}()
+		}
+		wg.Wait()
+		g.Expect(recorder.maxInFlight()).To(Equal(1))
+		g.Expect(fake.decrypts).To(Equal(5))
+	})
+
+	t.Run("fails when the context is done while waiting", func(t *testing.T) {
+		g := NewWithT(t)
+
+		release, err := l.Acquire(context.Background(), "https://invalid.vault.azure.net")
+		g.Expect(err).ToNot(HaveOccurred())
+		defer release()
+
+		key := newKey()
+		key.EncryptedKey = "ZW5jcnlwdGVk"
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = key.DecryptContext(ctx)
+		g.Expect(err).To(MatchError(context.DeadlineExceeded))
+		g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with Azure Key Vault key"))
+	})
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// RetryPolicy configures the retries of the Encrypt and Decrypt requests to
+// Azure Key Vault which fail with a transient error, most notably the 429
+// Too Many Requests responses of a vault throttling the requests. The delay
+// before a retry grows exponentially from RetryDelay up to MaxRetryDelay,
+// unless the response has a Retry-After header. The retries stop once the
+// context of the request is done. The zero value uses the defaults of the
+// Azure SDK.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a request, including
+	// the first one. One disables the retries, zero uses the default of the
+	// Azure SDK of four attempts.
+	MaxAttempts int
+	// RetryDelay is the delay before the first retry. Zero uses the default
+	// of the Azure SDK.
+	RetryDelay time.Duration
+	// MaxRetryDelay is the maximum delay before a retry. Zero uses the
+	// default of the Azure SDK.
+	MaxRetryDelay time.Duration
+}
+
+// Validate returns an error if any of the values of the RetryPolicy is
+// negative, or if the RetryDelay exceeds the MaxRetryDelay.
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.MaxAttempts < 0:
+		return fmt.Errorf("invalid maximum attempts %d: must not be negative", p.MaxAttempts)
+	case p.RetryDelay < 0:
+		return fmt.Errorf("invalid retry delay %s: must not be negative", p.RetryDelay)
+	case p.MaxRetryDelay < 0:
+		return fmt.Errorf("invalid maximum retry delay %s: must not be negative", p.MaxRetryDelay)
+	case p.RetryDelay > 0 && p.MaxRetryDelay > 0 && p.RetryDelay > p.MaxRetryDelay:
+		return fmt.Errorf("invalid retry delay %s: must not exceed the maximum retry delay %s", p.RetryDelay, p.MaxRetryDelay)
+	}
+	return nil
+}
+
+// ApplyToMasterKey configures the RetryPolicy on the provided key.
+func (p RetryPolicy) ApplyToMasterKey(key *MasterKey) {
+	key.retryPolicy = p
+}
+
+// options returns the policy.RetryOptions of the Azure Key Vault client.
+func (p RetryPolicy) options() policy.RetryOptions {
+	var o policy.RetryOptions
+	switch {
+	case p.MaxAttempts == 1:
+		// A negative value disables the retries, zero is the default.
+		o.MaxRetries = -1
+	case p.MaxAttempts > 1:
+		o.MaxRetries = int32(p.MaxAttempts - 1)
+	}
+	o.RetryDelay = p.RetryDelay
+	o.MaxRetryDelay = p.MaxRetryDelay
+	return o
+}
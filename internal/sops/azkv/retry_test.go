@@ -0,0 +1,125 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	. "github.com/onsi/gomega"
+)
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		wantErr string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:   "valid policy",
+			policy: RetryPolicy{MaxAttempts: 5, RetryDelay: time.Second, MaxRetryDelay: time.Minute},
+		},
+		{
+			name:    "negative attempts",
+			policy:  RetryPolicy{MaxAttempts: -1},
+			wantErr: "invalid maximum attempts -1: must not be negative",
+		},
+		{
+			name:    "negative delay",
+			policy:  RetryPolicy{RetryDelay: -time.Second},
+			wantErr: "invalid retry delay -1s: must not be negative",
+		},
+		{
+			name:    "delay exceeds maximum delay",
+			policy:  RetryPolicy{RetryDelay: time.Minute, MaxRetryDelay: time.Second},
+			wantErr: "invalid retry delay 1m0s: must not exceed the maximum retry delay 1s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := tt.policy.Validate()
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
+
+func TestRetryPolicy_options(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(RetryPolicy{}.options()).To(Equal(policy.RetryOptions{}))
+	g.Expect(RetryPolicy{MaxAttempts: 1}.options()).To(Equal(policy.RetryOptions{MaxRetries: -1}))
+	g.Expect(RetryPolicy{MaxAttempts: 5, RetryDelay: time.Second, MaxRetryDelay: time.Minute}.options()).
+		To(Equal(policy.RetryOptions{MaxRetries: 4, RetryDelay: time.Second, MaxRetryDelay: time.Minute}))
+}
+
+func TestMasterKey_Decrypt_RetryPolicy(t *testing.T) {
+	// The vault throttles the given number of requests before it returns
+	// the decrypted data key.
+	var requests, throttled int32
+	vaultURL, caPEM := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&throttled) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":{"code":"Throttled","message":"too many requests"}}`))
+			return
+		}
+		writeKeyOperationResult(w, r, "data-key")
+	})
+
+	decrypt := func(throttle int32, p RetryPolicy) ([]byte, int32, error) {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&throttled, throttle)
+
+		key := MasterKeyFromURL(vaultURL, "key-name", "key-version")
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		CABundle(caPEM).ApplyToMasterKey(key)
+		p.ApplyToMasterKey(key)
+		got, err := key.Decrypt()
+		return got, atomic.LoadInt32(&requests), err
+	}
+
+	t.Run("retries the throttled requests", func(t *testing.T) {
+		g := NewWithT(t)
+
+		got, n, err := decrypt(2, RetryPolicy{MaxAttempts: 3, RetryDelay: time.Millisecond, MaxRetryDelay: 5 * time.Millisecond})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("data-key")))
+		g.Expect(n).To(Equal(int32(3)))
+	})
+
+	t.Run("fails once the attempts are exhausted", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, n, err := decrypt(3, RetryPolicy{MaxAttempts: 3, RetryDelay: time.Millisecond, MaxRetryDelay: 5 * time.Millisecond})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(ThrottledReason))
+		g.Expect(n).To(Equal(int32(3)))
+	})
+
+	t.Run("does not retry with a single attempt", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, n, err := decrypt(1, RetryPolicy{MaxAttempts: 1})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(ErrorReason(err)).To(Equal(ThrottledReason))
+		g.Expect(n).To(Equal(int32(1)))
+	})
+}
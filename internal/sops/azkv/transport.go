@@ -0,0 +1,103 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Transport configures the HTTP transport of the Azure Key Vault clients of
+// a MasterKey, e.g. to reach the vaults through the proxy of a corporate
+// network. The zero value uses the transport of the Azure SDK, which reads
+// the proxy from the HTTPS_PROXY and NO_PROXY environment variables and
+// requires TLS 1.2.
+type Transport struct {
+	// ProxyURL is the URL of the proxy of the requests. When nil, the proxy
+	// is read from the HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL *url.URL
+	// MinTLSVersion is the minimum TLS version of the connections, e.g.
+	// tls.VersionTLS13. When zero, TLS 1.2 is required.
+	MinTLSVersion uint16
+}
+
+// ParseTransport returns the Transport of the given proxy URL and minimum
+// TLS version, either "1.2" or "1.3". Empty values use the defaults of the
+// Transport.
+func ParseTransport(proxyURL, minTLSVersion string) (Transport, error) {
+	var t Transport
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return Transport{}, fmt.Errorf("invalid proxy URL '%s': %w", proxyURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return Transport{}, fmt.Errorf("invalid proxy URL '%s': must be an absolute http or https URL", proxyURL)
+		}
+		t.ProxyURL = u
+	}
+	switch minTLSVersion {
+	case "":
+	case "1.2":
+		t.MinTLSVersion = tls.VersionTLS12
+	case "1.3":
+		t.MinTLSVersion = tls.VersionTLS13
+	default:
+		return Transport{}, fmt.Errorf("invalid minimum TLS version '%s': must be one of '1.2', '1.3'", minTLSVersion)
+	}
+	return t, nil
+}
+
+// ApplyToMasterKey configures the Transport on the provided key.
+func (t Transport) ApplyToMasterKey(key *MasterKey) {
+	key.transport = t
+}
+
+// isZero returns whether the Transport uses the defaults.
+func (t Transport) isZero() bool {
+	return t.ProxyURL == nil && t.MinTLSVersion == 0
+}
+
+// cacheKey returns the key of the Transport in the clientCache keys.
+func (t Transport) cacheKey() string {
+	proxy := ""
+	if t.ProxyURL != nil {
+		proxy = t.ProxyURL.String()
+	}
+	return fmt.Sprintf("%s\x00%d", proxy, t.MinTLSVersion)
+}
+
+// newHTTPClient returns an HTTP client with the proxy and minimum TLS version
+// of the Transport, trusting the certificates of the PEM encoded CA bundle,
+// if any, in addition to the system roots.
+func (t Transport) newHTTPClient(caBundle []byte) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if t.MinTLSVersion != 0 {
+		tlsConfig.MinVersion = t.MinTLSVersion
+	}
+	if len(caBundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("failed to append CA bundle: no PEM encoded certificates found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if t.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(t.ProxyURL)
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package azkv
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseTransport(t *testing.T) {
+	tests := []struct {
+		name          string
+		proxyURL      string
+		minTLSVersion string
+		want          Transport
+		wantErr       string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:          "proxy and TLS 1.3",
+			proxyURL:      "http://proxy.example.com:3128",
+			minTLSVersion: "1.3",
+			want: Transport{
+				ProxyURL:      &url.URL{Scheme: "http", Host: "proxy.example.com:3128"},
+				MinTLSVersion: tls.VersionTLS13,
+			},
+		},
+		{
+			name:          "TLS 1.2",
+			minTLSVersion: "1.2",
+			want:          Transport{MinTLSVersion: tls.VersionTLS12},
+		},
+		{
+			name:     "relative proxy URL",
+			proxyURL: "proxy.example.com:3128",
+			wantErr:  "invalid proxy URL 'proxy.example.com:3128'",
+		},
+		{
+			name:     "unsupported proxy scheme",
+			proxyURL: "socks5://proxy.example.com:1080",
+			wantErr:  "invalid proxy URL 'socks5://proxy.example.com:1080': must be an absolute http or https URL",
+		},
+		{
+			name:          "unsupported TLS version",
+			minTLSVersion: "1.1",
+			wantErr:       "invalid minimum TLS version '1.1': must be one of '1.2', '1.3'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := ParseTransport(tt.proxyURL, tt.minTLSVersion)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestTransport_ApplyToMasterKey(t *testing.T) {
+	g := NewWithT(t)
+
+	transport := Transport{MinTLSVersion: tls.VersionTLS13}
+	key := &MasterKey{}
+	transport.ApplyToMasterKey(key)
+	g.Expect(key.transport).To(Equal(transport))
+}
+
+func TestTransport_newHTTPClient(t *testing.T) {
+	g := NewWithT(t)
+
+	proxyURL := &url.URL{Scheme: "http", Host: "proxy.example.com:3128"}
+	c, err := Transport{ProxyURL: proxyURL, MinTLSVersion: tls.VersionTLS13}.newHTTPClient(nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	transport := c.Transport.(*http.Transport)
+	g.Expect(transport.TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+	g.Expect(transport.TLSClientConfig.RootCAs).To(BeNil())
+	req := httptest.NewRequest(http.MethodPost, "https://test.vault.azure.net/keys/key-name/1234/decrypt", nil)
+	g.Expect(transport.Proxy(req)).To(Equal(proxyURL))
+
+	c, err = Transport{}.newHTTPClient(nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Transport.(*http.Transport).TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+}
+
+func TestMasterKey_Decrypt_Transport(t *testing.T) {
+	vaultURL, caPEM := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+		writeKeyOperationResult(w, r, "data-key")
+	})
+
+	// The proxy tunnels the CONNECT requests to the vault.
+	var connects int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&connects, 1)
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = dst.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(dst, conn)
+			_ = dst.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(conn, dst)
+			_ = conn.Close()
+		}()
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	NewWithT(t).Expect(err).ToNot(HaveOccurred())
+
+	newKey := func(transport Transport) *MasterKey {
+		key := MasterKeyFromURL(vaultURL, "key-name", "key-version")
+		key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+		NewToken(fakeTokenCredential{}).ApplyToMasterKey(key)
+		CABundle(caPEM).ApplyToMasterKey(key)
+		transport.ApplyToMasterKey(key)
+		return key
+	}
+
+	t.Run("connects through the proxy", func(t *testing.T) {
+		g := NewWithT(t)
+
+		atomic.StoreInt32(&connects, 0)
+		got, err := newKey(Transport{ProxyURL: proxyURL}).Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("data-key")))
+		g.Expect(atomic.LoadInt32(&connects)).ToNot(BeZero())
+	})
+
+	t.Run("connects directly without proxy", func(t *testing.T) {
+		g := NewWithT(t)
+
+		atomic.StoreInt32(&connects, 0)
+		got, err := newKey(Transport{}).Decrypt()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).To(Equal([]byte("data-key")))
+		g.Expect(atomic.LoadInt32(&connects)).To(BeZero())
+	})
+}
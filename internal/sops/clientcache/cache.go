@@ -0,0 +1,202 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package clientcache caches the clients of the cloud KMS key providers
+// constructed with the credentials of the decryption Secrets across
+// reconciliations, isolated per Secret.
+package clientcache
+
+import (
+	"io"
+	"sync"
+
+	"github.com/fluxcd/kustomize-controller/internal/lru"
+)
+
+// Cache caches the clients of the KMS key providers per decryption Secret.
+// The clients constructed with the credentials of a Secret are held by the
+// Scope of the Secret, identified by its namespace and name, and are only
+// shared with the reconciliations which decrypt with the same generation of
+// the same Secret (e.g. its resourceVersion). A Scope is never shared across
+// Secrets, even when their credentials are identical. When the generation
+// of a Secret changes, or when the cache is full and the Scope is the least
+// recently used one, the Scope is discarded and its clients are closed once
+// they are released by all the reconciliations using them. It is safe for
+// concurrent use.
+type Cache struct {
+	size int
+
+	mu     sync.Mutex
+	scopes *lru.Cache[scopeKey, *scopeEntry]
+}
+
+type scopeKey struct {
+	namespace string
+	name      string
+}
+
+type scopeEntry struct {
+	generation string
+	scope      *Scope
+}
+
+// New returns a new empty Cache holding the Scopes of at most size Secrets.
+func New(size int) *Cache {
+	return &Cache{
+		size: size,
+		scopes: lru.NewWithEvict(size, func(_ scopeKey, e *scopeEntry) {
+			e.scope.discard()
+		}),
+	}
+}
+
+// Acquire returns the Scope of the clients of the Secret with the namespace
+// and name at the given generation, which must be released with
+// Scope.Release once the clients are no longer used. The Scope of a previous
+// generation of the Secret is discarded. Without generation, or for a nil or
+// zero size Cache, a new Scope is returned which is not shared, and of which
+// the clients are closed on release.
+func (c *Cache) Acquire(namespace, name, generation string) *Scope {
+	if c == nil || c.size <= 0 || generation == "" {
+		s := newScope()
+		s.acquire()
+		s.discard()
+		return s
+	}
+
+	key := scopeKey{namespace: namespace, name: name}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.scopes.Get(key); ok {
+		if e.generation == generation {
+			e.scope.acquire()
+			return e.scope
+		}
+		e.scope.discard()
+		c.scopes.Remove(key)
+	}
+	s := newScope()
+	s.acquire()
+	c.scopes.Add(key, &scopeEntry{generation: generation, scope: s})
+	return s
+}
+
+// Len returns the number of Scopes held by the Cache.
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scopes.Len()
+}
+
+// Scope holds the clients of the KMS key providers constructed with the
+// credentials of a single generation of a decryption Secret. It is safe for
+// concurrent use.
+type Scope struct {
+	mu      sync.Mutex
+	clients map[string]interface{}
+	// users is the number of Acquire calls which are not released yet.
+	users int
+	// discarded is set once the Scope is removed from the Cache, after
+	// which its clients are closed when users drops to zero.
+	discarded bool
+	closed    bool
+}
+
+func newScope() *Scope {
+	return &Scope{clients: make(map[string]interface{})}
+}
+
+// Client returns the client of the Scope for the key, or constructs one with
+// newClient and holds it. The key identifies the client within the Scope,
+// e.g. by the provider and endpoint, and has to include a digest of any
+// credential which is not the one of the Secret. Errors are not held. A nil
+// Scope, or a closed one, constructs a new client on every call, which the
+// caller has to close.
+// The client is constructed without holding the lock, as newClient may
+// send requests, e.g. to log in. When another client was held for the key
+// meanwhile, the constructed one is closed and the held one is returned.
+// It returns whether the client is held by the Scope, in which case the
+// caller must not close it.
+func (s *Scope) Client(key string, newClient func() (interface{}, error)) (client interface{}, held bool, err error) {
+	if s == nil {
+		client, err = newClient()
+		return client, false, err
+	}
+	if c, ok := s.get(key); ok {
+		return c, true, nil
+	}
+	client, err = newClient()
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return client, false, nil
+	}
+	if c, ok := s.clients[key]; ok {
+		if closer, ok := client.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		return c, true, nil
+	}
+	s.clients[key] = client
+	return client, true, nil
+}
+
+// get returns the client held by the Scope for the key.
+func (s *Scope) get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[key]
+	return c, ok
+}
+
+// Release releases the Scope acquired with Cache.Acquire. The clients of a
+// discarded Scope are closed once it is released by all its users.
+func (s *Scope) Release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users > 0 {
+		s.users--
+	}
+	s.closeIfUnusedLocked()
+}
+
+func (s *Scope) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users++
+}
+
+func (s *Scope) discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discarded = true
+	s.closeIfUnusedLocked()
+}
+
+// closeIfUnusedLocked closes the clients implementing io.Closer of a
+// discarded Scope without users. The caller must hold the lock.
+func (s *Scope) closeIfUnusedLocked() {
+	if !s.discarded || s.users > 0 || s.closed {
+		return
+	}
+	s.closed = true
+	for _, c := range s.clients {
+		if closer, ok := c.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+	s.clients = nil
+}
@@ -0,0 +1,232 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package clientcache
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// fakeClient is a client which records whether it was closed.
+type fakeClient struct {
+	closed int
+}
+
+func (c *fakeClient) Close() error {
+	c.closed++
+	return nil
+}
+
+func newFakeClient(clients *[]*fakeClient) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		c := &fakeClient{}
+		*clients = append(*clients, c)
+		return c, nil
+	}
+}
+
+func TestCache_Acquire(t *testing.T) {
+	t.Run("shares the scope of a generation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		c := New(2)
+		s1 := c.Acquire("tenant-a", "sops-keys", "1")
+		c1, held, err := s1.Client("kms", newFakeClient(&clients))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(held).To(BeTrue())
+		s1.Release()
+
+		s2 := c.Acquire("tenant-a", "sops-keys", "1")
+		g.Expect(s2).To(BeIdenticalTo(s1))
+		c2, held, err := s2.Client("kms", newFakeClient(&clients))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(held).To(BeTrue())
+		g.Expect(c2).To(BeIdenticalTo(c1))
+		s2.Release()
+
+		g.Expect(clients).To(HaveLen(1))
+		g.Expect(clients[0].closed).To(BeZero())
+		g.Expect(c.Len()).To(Equal(1))
+	})
+
+	t.Run("isolates the scopes of the Secrets", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		c := New(3)
+		for _, s := range []*Scope{
+			c.Acquire("tenant-a", "sops-keys", "1"),
+			c.Acquire("tenant-b", "sops-keys", "1"),
+			c.Acquire("tenant-a", "other-keys", "1"),
+		} {
+			_, _, err := s.Client("kms", newFakeClient(&clients))
+			g.Expect(err).ToNot(HaveOccurred())
+			s.Release()
+		}
+		g.Expect(clients).To(HaveLen(3))
+		g.Expect(c.Len()).To(Equal(3))
+	})
+
+	t.Run("discards the scope of a previous generation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		c := New(2)
+		s1 := c.Acquire("tenant-a", "sops-keys", "1")
+		_, _, err := s1.Client("kms", newFakeClient(&clients))
+		g.Expect(err).ToNot(HaveOccurred())
+
+		s2 := c.Acquire("tenant-a", "sops-keys", "2")
+		g.Expect(s2).ToNot(BeIdenticalTo(s1))
+		_, _, err = s2.Client("kms", newFakeClient(&clients))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(clients).To(HaveLen(2))
+		g.Expect(c.Len()).To(Equal(1))
+
+		// The client is closed once the previous generation is released.
+		g.Expect(clients[0].closed).To(BeZero())
+		s1.Release()
+		g.Expect(clients[0].closed).To(Equal(1))
+		s2.Release()
+		g.Expect(clients[1].closed).To(BeZero())
+	})
+
+	t.Run("evicts the least recently used scope", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		c := New(2)
+		for _, name := range []string{"a", "b", "a", "c"} {
+			s := c.Acquire("default", name, "1")
+			_, _, err := s.Client("kms", newFakeClient(&clients))
+			g.Expect(err).ToNot(HaveOccurred())
+			s.Release()
+		}
+		g.Expect(clients).To(HaveLen(3))
+		g.Expect(c.Len()).To(Equal(2))
+		// The scope of "b" is evicted, "a" was used more recently.
+		g.Expect(clients[0].closed).To(BeZero())
+		g.Expect(clients[1].closed).To(Equal(1))
+		g.Expect(clients[2].closed).To(BeZero())
+	})
+
+	t.Run("does not share without generation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		c := New(2)
+		s1 := c.Acquire("tenant-a", "sops-keys", "")
+		s2 := c.Acquire("tenant-a", "sops-keys", "")
+		g.Expect(s2).ToNot(BeIdenticalTo(s1))
+		_, held, err := s1.Client("kms", newFakeClient(&clients))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(held).To(BeTrue())
+		g.Expect(c.Len()).To(BeZero())
+
+		s1.Release()
+		g.Expect(clients[0].closed).To(Equal(1))
+		s2.Release()
+	})
+
+	t.Run("does not share for a nil or zero size cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		for _, c := range []*Cache{nil, New(0)} {
+			s1 := c.Acquire("tenant-a", "sops-keys", "1")
+			s2 := c.Acquire("tenant-a", "sops-keys", "1")
+			g.Expect(s2).ToNot(BeIdenticalTo(s1))
+			g.Expect(c.Len()).To(BeZero())
+			s1.Release()
+			s2.Release()
+		}
+	})
+}
+
+func TestScope_Client(t *testing.T) {
+	t.Run("does not hold errors", func(t *testing.T) {
+		g := NewWithT(t)
+
+		s := New(1).Acquire("default", "sops-keys", "1")
+		defer s.Release()
+		_, _, err := s.Client("kms", func() (interface{}, error) {
+			return nil, errors.New("invalid credentials")
+		})
+		g.Expect(err).To(MatchError("invalid credentials"))
+
+		var clients []*fakeClient
+		_, held, err := s.Client("kms", newFakeClient(&clients))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(held).To(BeTrue())
+		g.Expect(clients).To(HaveLen(1))
+	})
+
+	t.Run("does not hold the clients of a closed scope", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		s := New(0).Acquire("default", "sops-keys", "1")
+		s.Release()
+		_, held, err := s.Client("kms", newFakeClient(&clients))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(held).To(BeFalse())
+	})
+
+	t.Run("constructs the clients without holding the lock", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		s := New(1).Acquire("default", "sops-keys", "1")
+		defer s.Release()
+		var inner interface{}
+		outer, held, err := s.Client("kms", func() (interface{}, error) {
+			// A client constructed meanwhile for the same key is held
+			// instead of the one of this call.
+			var err error
+			inner, _, err = s.Client("kms", newFakeClient(&clients))
+			if err != nil {
+				return nil, err
+			}
+			return newFakeClient(&clients)()
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(held).To(BeTrue())
+		g.Expect(outer).To(BeIdenticalTo(inner))
+		g.Expect(clients).To(HaveLen(2))
+		g.Expect(clients[0].closed).To(BeZero())
+		g.Expect(clients[1].closed).To(Equal(1))
+	})
+
+	t.Run("does not hold the clients of a scope closed while constructing them", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		c := New(1)
+		s := c.Acquire("default", "sops-keys", "1")
+		_, held, err := s.Client("kms", func() (interface{}, error) {
+			s.discard()
+			s.Release()
+			return newFakeClient(&clients)()
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(held).To(BeFalse())
+		g.Expect(clients[0].closed).To(BeZero(), "the caller closes the client")
+	})
+
+	t.Run("does not hold the clients of a nil scope", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var clients []*fakeClient
+		var s *Scope
+		_, held, err := s.Client("kms", newFakeClient(&clients))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(held).To(BeFalse())
+		s.Release()
+	})
+}
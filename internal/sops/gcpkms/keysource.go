@@ -8,7 +8,10 @@ package gcpkms
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"time"
@@ -17,6 +20,9 @@ import (
 	"google.golang.org/api/option"
 	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
 	"google.golang.org/grpc"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
+	"github.com/fluxcd/kustomize-controller/internal/sops/keymap"
 )
 
 var (
@@ -33,6 +39,33 @@ func (c CredentialJSON) ApplyToMasterKey(key *MasterKey) {
 	key.credentialJSON = c
 }
 
+// Validate returns an error if the CredentialJSON is not a JSON object with
+// the type of the credentials, e.g. "service_account".
+func (c CredentialJSON) Validate() error {
+	var creds struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(c, &creds); err != nil {
+		return fmt.Errorf("invalid GCP credentials JSON: %w", err)
+	}
+	if creds.Type == "" {
+		return fmt.Errorf("invalid GCP credentials JSON: missing 'type' field")
+	}
+	return nil
+}
+
+// ClientScope is the clientcache.Scope of the decryption Secret of the
+// credentials of a MasterKey, which holds the GCP KMS client of the keys
+// instead of constructing and closing one for every request.
+type ClientScope struct {
+	Scope *clientcache.Scope
+}
+
+// ApplyToMasterKey configures the ClientScope on the provided key.
+func (c ClientScope) ApplyToMasterKey(key *MasterKey) {
+	key.clients = c.Scope
+}
+
 // MasterKey is a GCP KMS key used to encrypt and decrypt the SOPS
 // data key.
 // Adapted from https://github.com/mozilla/sops/blob/v3.7.2/gcpkms/keysource.go
@@ -55,6 +88,9 @@ type MasterKey struct {
 	// Mostly useful for testing at present, to wire the client to a mock
 	// server.
 	grpcConn *grpc.ClientConn
+	// clients holds the client of the credentialJSON. When nil, a client
+	// is constructed for every request.
+	clients *clientcache.Scope
 }
 
 // MasterKeyFromResourceID creates a new MasterKey with the provided resource
@@ -69,11 +105,11 @@ func MasterKeyFromResourceID(resourceID string) *MasterKey {
 // Encrypt takes a SOPS data key, encrypts it with GCP KMS, and stores the
 // result in the EncryptedKey field.
 func (key *MasterKey) Encrypt(datakey []byte) error {
-	cloudkmsService, err := key.newKMSClient()
+	cloudkmsService, release, err := key.kmsClient()
 	if err != nil {
 		return err
 	}
-	defer cloudkmsService.Close()
+	defer release()
 
 	req := &kmspb.EncryptRequest{
 		Name:      key.ResourceID,
@@ -110,11 +146,11 @@ func (key *MasterKey) EncryptIfNeeded(dataKey []byte) error {
 // Decrypt decrypts the EncryptedKey field with GCP KMS and returns
 // the result.
 func (key *MasterKey) Decrypt() ([]byte, error) {
-	service, err := key.newKMSClient()
+	service, release, err := key.kmsClient()
 	if err != nil {
 		return nil, err
 	}
-	defer service.Close()
+	defer release()
 
 	decodedCipher, err := base64.StdEncoding.DecodeString(string(key.EncryptedDataKey()))
 	if err != nil {
@@ -152,15 +188,86 @@ func (key MasterKey) ToMap() map[string]interface{} {
 	return out
 }
 
+// MasterKeyFromMap creates a new MasterKey from the map representation
+// produced by ToMap. It returns an error if a required field is missing, or
+// if a field is of an unexpected type.
+func MasterKeyFromMap(m map[string]interface{}) (*MasterKey, error) {
+	key := &MasterKey{}
+	var err error
+	if key.ResourceID, err = keymap.String(m, "resource_id"); err != nil {
+		return nil, err
+	}
+	if key.ResourceID == "" {
+		return nil, fmt.Errorf("missing required field 'resource_id'")
+	}
+
+	createdAt, err := keymap.String(m, "created_at")
+	if err != nil {
+		return nil, err
+	}
+	if createdAt == "" {
+		return nil, fmt.Errorf("missing required field 'created_at'")
+	}
+	key.CreationDate, err = time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse field 'created_at': %w", err)
+	}
+
+	if key.EncryptedKey, err = keymap.String(m, "enc"); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// kmsClient returns the GCP KMS client of the credentialJSON held by the
+// clients Scope of the key, or a new client constructed by newKMSClient. The
+// returned func closes the client if it is not held by the Scope.
+func (key *MasterKey) kmsClient() (*kms.KeyManagementClient, func(), error) {
+	if key.clients == nil || key.grpcConn != nil {
+		c, err := key.newKMSClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, func() { _ = c.Close() }, nil
+	}
+	if err := key.validateResourceID(); err != nil {
+		return nil, nil, err
+	}
+	creds := sha256.Sum256(key.credentialJSON)
+	c, held, err := key.clients.Client("gcpkms\x00"+hex.EncodeToString(creds[:]), func() (interface{}, error) {
+		return key.newKMSClient()
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	client := c.(*kms.KeyManagementClient)
+	if held {
+		return client, func() {}, nil
+	}
+	return client, func() { _ = client.Close() }, nil
+}
+
+// validateResourceID returns an error if the ResourceID is not the one of a
+// GCP KMS crypto key.
+func (key *MasterKey) validateResourceID() error {
+	re := regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+	if !re.MatchString(key.ResourceID) {
+		return fmt.Errorf("no valid resourceId found in %q", key.ResourceID)
+	}
+	return nil
+}
+
 // newKMSClient returns a GCP KMS client configured with the credentialJSON
 // and/or grpcConn, falling back to environmental defaults.
+// Without a credentialJSON, the client authenticates using Application
+// Default Credentials, which includes GKE Workload Identity and workload
+// identity federation credential configuration files referenced by
+// GOOGLE_APPLICATION_CREDENTIALS.
 // It returns an error if the ResourceID is invalid, or if the client setup
 // fails.
 func (key *MasterKey) newKMSClient() (*kms.KeyManagementClient, error) {
-	re := regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
-	matches := re.FindStringSubmatch(key.ResourceID)
-	if matches == nil {
-		return nil, fmt.Errorf("no valid resourceId found in %q", key.ResourceID)
+	if err := key.validateResourceID(); err != nil {
+		return nil, err
 	}
 
 	var opts []option.ClientOption
@@ -17,6 +17,8 @@ import (
 	. "github.com/onsi/gomega"
 	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
 	"google.golang.org/grpc"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
 )
 
 var (
@@ -71,6 +73,74 @@ func TestMasterKey_ToMap(t *testing.T) {
 	}))
 }
 
+func TestMasterKeyFromMap(t *testing.T) {
+	g := NewWithT(t)
+
+	key := MasterKeyFromResourceID(testResourceID)
+	// ToMap serializes the creation date with a precision of seconds.
+	key.CreationDate = key.CreationDate.Truncate(time.Second)
+	key.EncryptedKey = "data"
+
+	got, err := MasterKeyFromMap(key.ToMap())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal(key))
+	g.Expect(got.ToMap()).To(Equal(key.ToMap()))
+}
+
+func TestMasterKeyFromMap_Errors(t *testing.T) {
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"resource_id": testResourceID,
+			"created_at":  "2022-01-01T00:00:00Z",
+			"enc":         "data",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(m map[string]interface{})
+		wantErr string
+	}{
+		{
+			name:    "missing resource_id",
+			mutate:  func(m map[string]interface{}) { delete(m, "resource_id") },
+			wantErr: "missing required field 'resource_id'",
+		},
+		{
+			name:    "non-string resource_id",
+			mutate:  func(m map[string]interface{}) { m["resource_id"] = true },
+			wantErr: "field 'resource_id' must be a string, got bool",
+		},
+		{
+			name:    "missing created_at",
+			mutate:  func(m map[string]interface{}) { delete(m, "created_at") },
+			wantErr: "missing required field 'created_at'",
+		},
+		{
+			name:    "invalid created_at",
+			mutate:  func(m map[string]interface{}) { m["created_at"] = "yesterday" },
+			wantErr: "failed to parse field 'created_at'",
+		},
+		{
+			name:    "non-string enc",
+			mutate:  func(m map[string]interface{}) { m["enc"] = 42 },
+			wantErr: "field 'enc' must be a string, got int",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			m := valid()
+			tt.mutate(m)
+			got, err := MasterKeyFromMap(m)
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+			g.Expect(got).To(BeNil())
+		})
+	}
+}
+
 func TestMasterKey_createCloudKMSService(t *testing.T) {
 	g := NewWithT(t)
 
@@ -106,6 +176,56 @@ func TestMasterKey_createCloudKMSService(t *testing.T) {
 	}
 }
 
+func TestCredentialJSON_Validate(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(CredentialJSON(`{"type": "service_account", "project_id": "<project-id>"}`).Validate()).To(Succeed())
+
+	err := CredentialJSON(`type: service_account`).Validate()
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(HavePrefix("invalid GCP credentials JSON: "))
+
+	g.Expect(CredentialJSON(`{"project_id": "<project-id>"}`).Validate()).To(MatchError("invalid GCP credentials JSON: missing 'type' field"))
+}
+
+func TestMasterKey_kmsClient(t *testing.T) {
+	g := NewWithT(t)
+
+	credentialJSON := []byte(`{ "client_id": "<client-id>.apps.googleusercontent.com",
+		"client_secret": "<secret>",
+		"type": "authorized_user"}`)
+	scope := clientcache.New(1).Acquire("default", "sops-keys", "1")
+	newKey := func(credentialJSON []byte, scope *clientcache.Scope) *MasterKey {
+		key := MasterKeyFromResourceID(testResourceID)
+		CredentialJSON(credentialJSON).ApplyToMasterKey(key)
+		ClientScope{Scope: scope}.ApplyToMasterKey(key)
+		return key
+	}
+
+	c1, release, err := newKey(credentialJSON, scope).kmsClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	release()
+	c2, release, err := newKey(credentialJSON, scope).kmsClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	release()
+	g.Expect(c2).To(BeIdenticalTo(c1))
+
+	other, release, err := newKey(append(credentialJSON, ' '), scope).kmsClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	release()
+	g.Expect(other).ToNot(BeIdenticalTo(c1))
+
+	unscoped, release, err := newKey(credentialJSON, nil).kmsClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	release()
+	g.Expect(unscoped).ToNot(BeIdenticalTo(c1))
+
+	_, _, err = MasterKeyFromResourceID("/projects").kmsClient()
+	g.Expect(err).To(MatchError(ContainSubstring("no valid resourceId")))
+
+	scope.Release()
+}
+
 func TestMasterKey_Decrypt(t *testing.T) {
 	g := NewWithT(t)
 
@@ -142,6 +262,42 @@ func TestMasterKey_Encrypt(t *testing.T) {
 	g.Expect(key.EncryptedDataKey()).To(BeEquivalentTo(base64.StdEncoding.EncodeToString([]byte(encryptedData))))
 }
 
+func TestMasterKey_EncryptDecrypt_RoundTrip(t *testing.T) {
+	g := NewWithT(t)
+
+	dataKey := []byte("data key")
+
+	mockKeyManagement.err = nil
+	mockKeyManagement.reqs = nil
+	mockKeyManagement.resps = append(mockKeyManagement.resps[:0], &kmspb.EncryptResponse{
+		Ciphertext: []byte(encryptedData),
+	})
+
+	encryptKey := MasterKeyFromResourceID(testResourceID)
+	encryptKey.grpcConn = newGRPCServer("0")
+	g.Expect(encryptKey.Encrypt(dataKey)).To(Succeed())
+	g.Expect(mockKeyManagement.reqs).To(HaveLen(1))
+	encReq := mockKeyManagement.reqs[0].(*kmspb.EncryptRequest)
+	g.Expect(encReq.Name).To(Equal(testResourceID))
+	g.Expect(encReq.Plaintext).To(Equal(dataKey))
+
+	mockKeyManagement.reqs = nil
+	mockKeyManagement.resps = append(mockKeyManagement.resps[:0], &kmspb.DecryptResponse{
+		Plaintext: dataKey,
+	})
+
+	decryptKey, err := MasterKeyFromMap(encryptKey.ToMap())
+	g.Expect(err).ToNot(HaveOccurred())
+	decryptKey.grpcConn = newGRPCServer("0")
+	got, err := decryptKey.Decrypt()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal(dataKey))
+	g.Expect(mockKeyManagement.reqs).To(HaveLen(1))
+	decReq := mockKeyManagement.reqs[0].(*kmspb.DecryptRequest)
+	g.Expect(decReq.Name).To(Equal(testResourceID))
+	g.Expect(decReq.Ciphertext).To(Equal([]byte(encryptedData)))
+}
+
 var (
 	mockKeyManagement mockKeyManagementServer
 )
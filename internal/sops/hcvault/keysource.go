@@ -8,12 +8,17 @@
 package hcvault
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/api"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
 )
 
 var (
@@ -29,6 +34,54 @@ func (t VaultToken) ApplyToMasterKey(key *MasterKey) {
 	key.vaultToken = string(t)
 }
 
+// Validate returns an error if the token is empty, or contains whitespace.
+func (t VaultToken) Validate() error {
+	if t == "" {
+		return fmt.Errorf("invalid Vault token: token is empty")
+	}
+	if strings.ContainsAny(string(t), " \t\r\n") {
+		return fmt.Errorf("invalid Vault token: token contains whitespace")
+	}
+	return nil
+}
+
+// VaultNamespace is the Vault Enterprise namespace of the Transit backend
+// of the keys, e.g. "admin/tenant-a".
+type VaultNamespace string
+
+// ApplyToMasterKey configures the namespace on the provided key.
+func (n VaultNamespace) ApplyToMasterKey(key *MasterKey) {
+	key.namespace = strings.Trim(string(n), "/")
+}
+
+// Validate returns an error if the namespace is empty, contains whitespace,
+// or is not a clean relative path.
+func (n VaultNamespace) Validate() error {
+	ns := strings.Trim(string(n), "/")
+	if ns == "" {
+		return fmt.Errorf("invalid Vault namespace: namespace is empty")
+	}
+	if strings.ContainsAny(ns, " \t\r\n") {
+		return fmt.Errorf("invalid Vault namespace: namespace contains whitespace")
+	}
+	if !isCleanRelativePath(ns) {
+		return fmt.Errorf("invalid Vault namespace: namespace must be a clean relative path")
+	}
+	return nil
+}
+
+// ClientScope is the clientcache.Scope of the decryption Secret of the token
+// of a MasterKey, which holds the Vault client of the keys instead of
+// constructing one for every request.
+type ClientScope struct {
+	Scope *clientcache.Scope
+}
+
+// ApplyToMasterKey configures the ClientScope on the provided key.
+func (c ClientScope) ApplyToMasterKey(key *MasterKey) {
+	key.clients = c.Scope
+}
+
 // MasterKey is a Vault Transit backend path used to Encrypt and Decrypt
 // SOPS' data key.
 //
@@ -44,6 +97,17 @@ type MasterKey struct {
 	CreationDate time.Time
 
 	vaultToken string
+	// kubernetesAuth logs in to the VaultAddress with the Kubernetes auth
+	// method when no vaultToken is configured.
+	kubernetesAuth *KubernetesAuth
+	// namespace is the Vault Enterprise namespace of the requests, including
+	// the login of the kubernetesAuth. When empty, the VAULT_NAMESPACE
+	// environment variable is used, if set.
+	namespace string
+	// clients holds the client of the VaultAddress, namespace and vaultToken,
+	// or kubernetesAuth. When nil, a client is constructed for every
+	// request.
+	clients *clientcache.Scope
 }
 
 // MasterKeyFromAddress creates a new MasterKey from a Vault address, Transit
@@ -61,7 +125,7 @@ func MasterKeyFromAddress(address, enginePath, keyName string) *MasterKey {
 // Encrypt takes a SOPS data key, encrypts it with Vault Transit, and stores
 // the result in the EncryptedKey field.
 func (key *MasterKey) Encrypt(dataKey []byte) error {
-	client, err := vaultClient(key.VaultAddress, key.vaultToken)
+	client, err := key.vaultClient()
 	if err != nil {
 		return err
 	}
@@ -100,7 +164,7 @@ func (key *MasterKey) SetEncryptedDataKey(enc []byte) {
 
 // Decrypt decrypts the EncryptedKey field with Vault Transit and returns the result.
 func (key *MasterKey) Decrypt() ([]byte, error) {
-	client, err := vaultClient(key.VaultAddress, key.vaultToken)
+	client, err := key.vaultClient()
 	if err != nil {
 		return nil, err
 	}
@@ -203,15 +267,65 @@ func dataKeyFromSecret(secret *api.Secret) ([]byte, error) {
 	return dataKey, nil
 }
 
-// vaultClient returns a new Vault client, configured with the given address
-// and token.
-func vaultClient(address, token string) (*api.Client, error) {
+// vaultClient returns the Vault client of the VaultAddress, namespace and
+// vaultToken held by the clients Scope of the key, or a new client. Without
+// vaultToken, the client logs in with the kubernetesAuth of the key, if any.
+func (key *MasterKey) vaultClient() (*api.Client, error) {
+	if key.vaultToken == "" && key.kubernetesAuth != nil {
+		return key.kubernetesAuthClient()
+	}
+	if key.clients == nil {
+		return vaultClient(key.VaultAddress, key.namespace, key.vaultToken)
+	}
+	token := sha256.Sum256([]byte(key.vaultToken))
+	c, _, err := key.clients.Client("hcvault\x00"+key.VaultAddress+"\x00"+key.namespace+"\x00"+hex.EncodeToString(token[:]), func() (interface{}, error) {
+		return vaultClient(key.VaultAddress, key.namespace, key.vaultToken)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.(*api.Client), nil
+}
+
+// kubernetesAuthClient returns the Vault client of the VaultAddress logged
+// in with the kubernetesAuth of the key. The client held by the clients Scope
+// of the key, per service account, logs in again once its token expires,
+// instead of for every request.
+func (key *MasterKey) kubernetesAuthClient() (*api.Client, error) {
+	auth := *key.kubernetesAuth
+	if key.clients == nil {
+		c, err := newKubernetesAuthClient(key.VaultAddress, key.namespace, auth)
+		if err != nil {
+			return nil, err
+		}
+		return c.Client()
+	}
+	clientKey := "hcvault-kubernetes\x00" + key.VaultAddress + "\x00" + key.namespace + "\x00" + auth.loginPath() + "\x00" + auth.Role +
+		"\x00" + auth.serviceAccountKey()
+	c, _, err := key.clients.Client(clientKey, func() (interface{}, error) {
+		return newKubernetesAuthClient(key.VaultAddress, key.namespace, auth)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.(*kubernetesAuthClient).Client()
+}
+
+// vaultClient returns a new Vault client, configured with the given address,
+// namespace and token. Without namespace or token, the ones of the
+// VAULT_NAMESPACE and VAULT_TOKEN environment variables are used, if set.
+func vaultClient(address, namespace, token string) (*api.Client, error) {
 	cfg := api.DefaultConfig()
 	cfg.Address = address
 	client, err := api.NewClient(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create Vault client: %w", err)
 	}
-	client.SetToken(token)
+	if namespace != "" {
+		client.SetNamespace(namespace)
+	}
+	if token != "" {
+		client.SetToken(token)
+	}
 	return client, nil
 }
@@ -18,6 +18,8 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/ory/dockertest/v3"
 	"go.mozilla.org/sops/v3/hcvault"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
 )
 
 var (
@@ -108,7 +110,7 @@ func TestMasterKey_Encrypt(t *testing.T) {
 	g.Expect(key.Encrypt(dataKey)).To(Succeed())
 	g.Expect(key.EncryptedKey).ToNot(BeEmpty())
 
-	client, err := vaultClient(key.VaultAddress, key.vaultToken)
+	client, err := vaultClient(key.VaultAddress, key.namespace, key.vaultToken)
 	g.Expect(err).ToNot(HaveOccurred())
 
 	payload := decryptPayload(key.EncryptedKey)
@@ -176,7 +178,7 @@ func TestMasterKey_Decrypt(t *testing.T) {
 	(VaultToken(testVaultToken)).ApplyToMasterKey(key)
 	g.Expect(createVaultKey(key)).To(Succeed())
 
-	client, err := vaultClient(key.VaultAddress, key.vaultToken)
+	client, err := vaultClient(key.VaultAddress, key.namespace, key.vaultToken)
 	g.Expect(err).ToNot(HaveOccurred())
 
 	dataKey := []byte("the heart of a shrimp is located in its head")
@@ -276,6 +278,82 @@ func TestMasterKey_ToMap(t *testing.T) {
 	}))
 }
 
+func TestVaultToken_Validate(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(VaultToken("hvs.some-token").Validate()).To(Succeed())
+	g.Expect(VaultToken("").Validate()).To(MatchError("invalid Vault token: token is empty"))
+	g.Expect(VaultToken("some token").Validate()).To(MatchError("invalid Vault token: token contains whitespace"))
+	g.Expect(VaultToken("some-token\nother-token").Validate()).To(MatchError("invalid Vault token: token contains whitespace"))
+}
+
+func TestMasterKey_vaultClient(t *testing.T) {
+	g := NewWithT(t)
+
+	scope := clientcache.New(1).Acquire("default", "sops-keys", "1")
+	t.Cleanup(scope.Release)
+	newKey := func(token string, scope *clientcache.Scope) *MasterKey {
+		key := MasterKeyFromAddress("https://example.com", "engine", "key-name")
+		VaultToken(token).ApplyToMasterKey(key)
+		ClientScope{Scope: scope}.ApplyToMasterKey(key)
+		return key
+	}
+
+	c1, err := newKey("token", scope).vaultClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	c2, err := newKey("token", scope).vaultClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c2).To(BeIdenticalTo(c1))
+
+	other, err := newKey("other-token", scope).vaultClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(other).ToNot(BeIdenticalTo(c1))
+	g.Expect(other.Token()).To(Equal("other-token"))
+
+	unscoped, err := newKey("token", nil).vaultClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(unscoped).ToNot(BeIdenticalTo(c1))
+}
+
+func TestVaultNamespace_Validate(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(VaultNamespace("admin").Validate()).To(Succeed())
+	g.Expect(VaultNamespace("admin/tenant-a/").Validate()).To(Succeed())
+	g.Expect(VaultNamespace("").Validate()).To(MatchError("invalid Vault namespace: namespace is empty"))
+	g.Expect(VaultNamespace("/").Validate()).To(MatchError("invalid Vault namespace: namespace is empty"))
+	g.Expect(VaultNamespace("admin tenant-a").Validate()).To(MatchError("invalid Vault namespace: namespace contains whitespace"))
+	g.Expect(VaultNamespace("admin/../root").Validate()).To(MatchError("invalid Vault namespace: namespace must be a clean relative path"))
+}
+
+func TestMasterKey_vaultClient_Namespace(t *testing.T) {
+	g := NewWithT(t)
+
+	t.Setenv("VAULT_NAMESPACE", "environment")
+	scope := clientcache.New(1).Acquire("default", "sops-keys", "1")
+	t.Cleanup(scope.Release)
+	newKey := func(namespace string) *MasterKey {
+		key := MasterKeyFromAddress("https://example.com", "engine", "key-name")
+		VaultToken("token").ApplyToMasterKey(key)
+		VaultNamespace(namespace).ApplyToMasterKey(key)
+		ClientScope{Scope: scope}.ApplyToMasterKey(key)
+		return key
+	}
+
+	tenantA, err := newKey("admin/tenant-a/").vaultClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tenantA.Namespace()).To(Equal("admin/tenant-a"))
+
+	tenantB, err := newKey("admin/tenant-b").vaultClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tenantB).ToNot(BeIdenticalTo(tenantA))
+	g.Expect(tenantB.Namespace()).To(Equal("admin/tenant-b"))
+
+	environment, err := newKey("").vaultClient()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(environment.Namespace()).To(Equal("environment"))
+}
+
 func Test_encryptedKeyFromSecret(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -337,7 +415,7 @@ func Test_dataKeyFromSecret(t *testing.T) {
 
 // enableVaultTransit enables the Vault Transit backend on the given enginePath.
 func enableVaultTransit(address, token, enginePath string) error {
-	client, err := vaultClient(address, token)
+	client, err := vaultClient(address, "", token)
 	if err != nil {
 		return fmt.Errorf("cannot create Vault client: %w", err)
 	}
@@ -354,7 +432,7 @@ func enableVaultTransit(address, token, enginePath string) error {
 // createVaultKey creates a new RSA-4096 Vault key using the data from the
 // provided MasterKey.
 func createVaultKey(key *MasterKey) error {
-	client, err := vaultClient(key.VaultAddress, key.vaultToken)
+	client, err := vaultClient(key.VaultAddress, key.namespace, key.vaultToken)
 	if err != nil {
 		return fmt.Errorf("cannot create Vault client: %w", err)
 	}
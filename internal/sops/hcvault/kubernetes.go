@@ -0,0 +1,216 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package hcvault
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultKubernetesAuthMountPath is the mount path of the Kubernetes auth
+	// method when none is configured.
+	DefaultKubernetesAuthMountPath = "kubernetes"
+
+	// KubernetesAuthAudience is the audience of the service account tokens
+	// logged in with to the Kubernetes auth method, which the Vault roles
+	// have to be configured with.
+	KubernetesAuthAudience = "vault"
+
+	// kubernetesAuthRenewMargin is the margin before the expiry of the token
+	// of a Kubernetes auth login after which the client logs in again.
+	kubernetesAuthRenewMargin = 30 * time.Second
+
+	// kubernetesAuthTokenTimeout is the timeout of the request of a service
+	// account token to log in with.
+	kubernetesAuthTokenTimeout = 30 * time.Second
+)
+
+// ServiceAccountTokenRequester requests a token of the service account with
+// the namespace and name for the audience, e.g. with the TokenRequest API.
+type ServiceAccountTokenRequester func(ctx context.Context, namespace, name, audience string) (string, error)
+
+// KubernetesAuth configures the authentication towards a Vault server with
+// the Kubernetes auth method, by logging in as the Role with a token of the
+// ServiceAccount requested for the KubernetesAuthAudience. The Vault token of
+// the login is held in memory only, and obtained again once it expires.
+type KubernetesAuth struct {
+	// Role is the name of the Vault role to log in as.
+	Role string `json:"role"`
+	// MountPath is the path the Kubernetes auth method is mounted at,
+	// defaults to DefaultKubernetesAuthMountPath.
+	MountPath string `json:"mountPath,omitempty"`
+
+	// ServiceAccountNamespace and ServiceAccountName are the service account
+	// logged in with. They can not be set in a Vault Kubernetes auth file,
+	// and are set by the controller to the service account of the
+	// Kustomization.
+	ServiceAccountNamespace string `json:"-"`
+	ServiceAccountName      string `json:"-"`
+	// RequestToken requests the tokens of the service account. It can not
+	// be set in a Vault Kubernetes auth file.
+	RequestToken ServiceAccountTokenRequester `json:"-"`
+}
+
+// LoadKubernetesAuthFromYaml parses the given YAML and returns the
+// KubernetesAuth it configures.
+func LoadKubernetesAuthFromYaml(b []byte) (*KubernetesAuth, error) {
+	auth := &KubernetesAuth{}
+	if err := yaml.UnmarshalStrict(b, auth); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal Vault Kubernetes auth file: %w", err)
+	}
+	return auth, nil
+}
+
+// ApplyToMasterKey configures the KubernetesAuth on the provided key. The
+// token configured with VaultToken takes precedence.
+func (a *KubernetesAuth) ApplyToMasterKey(key *MasterKey) {
+	key.kubernetesAuth = a
+}
+
+// Validate returns an error if the KubernetesAuth has no Role, or if the
+// MountPath is not a relative path without '..' elements.
+func (a *KubernetesAuth) Validate() error {
+	if a.Role == "" {
+		return fmt.Errorf("invalid Vault Kubernetes auth: '%s' is required", "role")
+	}
+	if mount := strings.Trim(a.MountPath, "/"); mount != "" && !isCleanRelativePath(mount) {
+		return fmt.Errorf("invalid Vault Kubernetes auth: '%s' must be a clean relative path", "mountPath")
+	}
+	return nil
+}
+
+// isCleanRelativePath returns whether p is a relative path without '.' or
+// '..' elements.
+func isCleanRelativePath(p string) bool {
+	return path.Clean(p) == p && p != "." && p != ".." && !strings.HasPrefix(p, "../") && !path.IsAbs(p)
+}
+
+// loginPath returns the path of the login requests of the KubernetesAuth.
+func (a *KubernetesAuth) loginPath() string {
+	mount := strings.Trim(a.MountPath, "/")
+	if mount == "" {
+		mount = DefaultKubernetesAuthMountPath
+	}
+	return path.Join("auth", mount, "login")
+}
+
+// serviceAccountKey returns the namespaced name of the service account of
+// the KubernetesAuth.
+func (a *KubernetesAuth) serviceAccountKey() string {
+	return a.ServiceAccountNamespace + "/" + a.ServiceAccountName
+}
+
+// serviceAccountToken requests a token of the service account of the
+// KubernetesAuth for the KubernetesAuthAudience.
+func (a *KubernetesAuth) serviceAccountToken() (string, error) {
+	if a.RequestToken == nil || a.ServiceAccountName == "" {
+		return "", fmt.Errorf("no service account to log in with")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesAuthTokenTimeout)
+	defer cancel()
+	token, err := a.RequestToken(ctx, a.ServiceAccountNamespace, a.ServiceAccountName, KubernetesAuthAudience)
+	if err != nil {
+		return "", fmt.Errorf("cannot request token of service account '%s': %w", a.serviceAccountKey(), err)
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// kubernetesAuthClient is a Vault client of which the token is obtained by
+// logging in with a KubernetesAuth, and renewed by logging in again before it
+// expires. It is safe for concurrent use.
+type kubernetesAuthClient struct {
+	auth   KubernetesAuth
+	client *api.Client
+
+	mu sync.Mutex
+	// expiresAt is the time after which the client logs in again. It is
+	// zero for a token without expiry.
+	expiresAt time.Time
+}
+
+// newKubernetesAuthClient returns a kubernetesAuthClient for the given
+// address and namespace, which logs in on first use.
+func newKubernetesAuthClient(address, namespace string, auth KubernetesAuth) (*kubernetesAuthClient, error) {
+	client, err := vaultClient(address, namespace, "")
+	if err != nil {
+		return nil, err
+	}
+	// The token of the VAULT_TOKEN environment variable is never used.
+	client.ClearToken()
+	return &kubernetesAuthClient{auth: auth, client: client}, nil
+}
+
+// Client returns the Vault client with the token of a login which is not
+// about to expire, logging in if required.
+func (c *kubernetesAuthClient) Client() (*api.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client.Token() != "" && (c.expiresAt.IsZero() || time.Now().Before(c.expiresAt)) {
+		return c.client, nil
+	}
+	if err := c.loginLocked(); err != nil {
+		return nil, err
+	}
+	return c.client, nil
+}
+
+// loginLocked logs in with a token of the service account of the auth, and
+// configures the client with the Vault token of the login. The caller must
+// hold the lock.
+func (c *kubernetesAuthClient) loginLocked() error {
+	loginPath := c.auth.loginPath()
+	jwt, err := c.auth.serviceAccountToken()
+	if err != nil {
+		return fmt.Errorf("failed to log in to Vault Kubernetes auth '%s': %w", loginPath, err)
+	}
+
+	// The login request is sent with a clone of the client, as concurrent
+	// requests may still use the token of the previous login, and it must
+	// not be sent along.
+	login, err := c.client.Clone()
+	if err != nil {
+		return fmt.Errorf("cannot create Vault client: %w", err)
+	}
+	login.ClearToken()
+	if ns := c.client.Namespace(); ns != "" {
+		login.SetNamespace(ns)
+	}
+	secret, err := login.Logical().Write(loginPath, map[string]interface{}{
+		"role": c.auth.Role,
+		"jwt":  jwt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log in to Vault Kubernetes auth '%s' as role '%s': %w", loginPath, c.auth.Role, err)
+	}
+	token, err := secret.TokenID()
+	if err != nil || token == "" {
+		return fmt.Errorf("failed to log in to Vault Kubernetes auth '%s' as role '%s': no token in response", loginPath, c.auth.Role)
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return fmt.Errorf("failed to log in to Vault Kubernetes auth '%s' as role '%s': %w", loginPath, c.auth.Role, err)
+	}
+
+	c.client.SetToken(token)
+	c.expiresAt = time.Time{}
+	if ttl > 0 {
+		margin := kubernetesAuthRenewMargin
+		if margin > ttl/2 {
+			margin = ttl / 2
+		}
+		c.expiresAt = time.Now().Add(ttl - margin)
+	}
+	return nil
+}
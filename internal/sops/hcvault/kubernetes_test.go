@@ -0,0 +1,292 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package hcvault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
+)
+
+// fakeKubernetesAuthVault is a Vault server of which the Kubernetes auth
+// method at the mount path logs in the service account token for the role,
+// and of which the Transit engine requires the token of the last login.
+type fakeKubernetesAuthVault struct {
+	mountPath string
+	role      string
+	jwt       string
+	ttl       int
+
+	mu     sync.Mutex
+	logins int
+	// loginTokens are the Vault tokens sent along the login requests.
+	loginTokens []string
+	// transitTokens are the Vault tokens sent along the Transit requests.
+	transitTokens []string
+	// namespaces are the Vault namespaces sent along all the requests.
+	namespaces []string
+}
+
+func (f *fakeKubernetesAuthVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.namespaces = append(f.namespaces, r.Header.Get("X-Vault-Namespace"))
+	switch r.URL.Path {
+	case "/v1/auth/" + f.mountPath + "/login":
+		f.loginTokens = append(f.loginTokens, r.Header.Get("X-Vault-Token"))
+		var req struct {
+			Role string `json:"role"`
+			JWT  string `json:"jwt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role != f.role || req.JWT != f.jwt {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		f.logins++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   fmt.Sprintf("login-%d", f.logins),
+				"lease_duration": f.ttl,
+				"renewable":      true,
+			},
+		})
+	case "/v1/" + testEnginePath + "/encrypt/sops":
+		token := r.Header.Get("X-Vault-Token")
+		f.transitTokens = append(f.transitTokens, token)
+		if token != fmt.Sprintf("login-%d", f.logins) {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"ciphertext": "vault:v1:encrypted"},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fakeTokenRequester is a ServiceAccountTokenRequester which returns the
+// token for any service account, and records the requests.
+type fakeTokenRequester struct {
+	token string
+
+	mu sync.Mutex
+	// requests are the requested tokens, as 'namespace/name:audience'.
+	requests []string
+}
+
+func (r *fakeTokenRequester) RequestToken(_ context.Context, namespace, name, audience string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, namespace+"/"+name+":"+audience)
+	if r.token == "" {
+		return "", errors.New("service account not found")
+	}
+	return r.token + "\n", nil
+}
+
+// withServiceAccount configures the auth to log in as the service account
+// with the tokens of the requester.
+func withServiceAccount(auth KubernetesAuth, namespace, name string, requester *fakeTokenRequester) *KubernetesAuth {
+	auth.ServiceAccountNamespace = namespace
+	auth.ServiceAccountName = name
+	auth.RequestToken = requester.RequestToken
+	return &auth
+}
+
+func TestLoadKubernetesAuthFromYaml(t *testing.T) {
+	g := NewWithT(t)
+
+	auth, err := LoadKubernetesAuthFromYaml([]byte("role: sops\nmountPath: k8s/cluster-a\n"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).To(Equal(&KubernetesAuth{Role: "sops", MountPath: "k8s/cluster-a"}))
+
+	_, err = LoadKubernetesAuthFromYaml([]byte("role: sops\nmount_path: k8s\n"))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to unmarshal Vault Kubernetes auth file"))
+}
+
+func TestKubernetesAuth_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    KubernetesAuth
+		wantErr string
+	}{
+		{name: "role", auth: KubernetesAuth{Role: "sops"}},
+		{name: "role and mount path", auth: KubernetesAuth{Role: "sops", MountPath: "/k8s/cluster-a/"}},
+		{name: "without role", auth: KubernetesAuth{MountPath: "kubernetes"}, wantErr: "'role' is required"},
+		{name: "mount path with parent", auth: KubernetesAuth{Role: "sops", MountPath: "../sys"}, wantErr: "'mountPath' must be a clean relative path"},
+		{name: "unclean mount path", auth: KubernetesAuth{Role: "sops", MountPath: "k8s/../sys"}, wantErr: "'mountPath' must be a clean relative path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := tt.auth.Validate()
+			if tt.wantErr == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+		})
+	}
+}
+
+func TestKubernetesAuth_loginPath(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect((&KubernetesAuth{Role: "sops"}).loginPath()).To(Equal("auth/kubernetes/login"))
+	g.Expect((&KubernetesAuth{Role: "sops", MountPath: "/k8s/cluster-a/"}).loginPath()).To(Equal("auth/k8s/cluster-a/login"))
+}
+
+func TestMasterKey_Encrypt_KubernetesAuth(t *testing.T) {
+	t.Setenv("VAULT_TOKEN", "environment-token")
+
+	t.Run("logs in with the service account token", func(t *testing.T) {
+		g := NewWithT(t)
+
+		tokens := &fakeTokenRequester{token: "service-account-jwt"}
+		vault := &fakeKubernetesAuthVault{mountPath: "k8s", role: "sops", jwt: "service-account-jwt", ttl: 3600}
+		server := httptest.NewServer(vault)
+		defer server.Close()
+
+		key := MasterKeyFromAddress(server.URL, testEnginePath, "sops")
+		withServiceAccount(KubernetesAuth{Role: "sops", MountPath: "k8s"}, "tenant-a", "app", tokens).ApplyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data key"))).To(Succeed())
+		g.Expect(key.EncryptedKey).To(Equal("vault:v1:encrypted"))
+		g.Expect(tokens.requests).To(Equal([]string{"tenant-a/app:" + KubernetesAuthAudience}))
+		g.Expect(vault.logins).To(Equal(1))
+		g.Expect(vault.loginTokens).To(Equal([]string{""}))
+		g.Expect(vault.transitTokens).To(Equal([]string{"login-1"}))
+	})
+
+	t.Run("logs in to the namespace", func(t *testing.T) {
+		g := NewWithT(t)
+
+		tokens := &fakeTokenRequester{token: "service-account-jwt"}
+		vault := &fakeKubernetesAuthVault{mountPath: "kubernetes", role: "sops", jwt: "service-account-jwt"}
+		server := httptest.NewServer(vault)
+		defer server.Close()
+
+		key := MasterKeyFromAddress(server.URL, testEnginePath, "sops")
+		withServiceAccount(KubernetesAuth{Role: "sops"}, "tenant-a", "app", tokens).ApplyToMasterKey(key)
+		VaultNamespace("admin/tenant-a").ApplyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data key"))).To(Succeed())
+		g.Expect(vault.namespaces).To(Equal([]string{"admin/tenant-a", "admin/tenant-a"}))
+	})
+
+	t.Run("token takes precedence", func(t *testing.T) {
+		g := NewWithT(t)
+
+		tokens := &fakeTokenRequester{token: "service-account-jwt"}
+		vault := &fakeKubernetesAuthVault{mountPath: "kubernetes", role: "sops", jwt: "service-account-jwt"}
+		server := httptest.NewServer(vault)
+		defer server.Close()
+
+		key := MasterKeyFromAddress(server.URL, testEnginePath, "sops")
+		VaultToken("static-token").ApplyToMasterKey(key)
+		withServiceAccount(KubernetesAuth{Role: "sops"}, "tenant-a", "app", tokens).ApplyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data key"))).ToNot(Succeed())
+		g.Expect(tokens.requests).To(BeEmpty())
+		g.Expect(vault.logins).To(BeZero())
+		g.Expect(vault.transitTokens).To(Equal([]string{"static-token"}))
+	})
+
+	t.Run("login failure", func(t *testing.T) {
+		g := NewWithT(t)
+
+		tokens := &fakeTokenRequester{token: "other-jwt"}
+		vault := &fakeKubernetesAuthVault{mountPath: "kubernetes", role: "sops", jwt: "service-account-jwt"}
+		server := httptest.NewServer(vault)
+		defer server.Close()
+
+		key := MasterKeyFromAddress(server.URL, testEnginePath, "sops")
+		withServiceAccount(KubernetesAuth{Role: "sops"}, "tenant-a", "app", tokens).ApplyToMasterKey(key)
+		err := key.Encrypt([]byte("data key"))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("failed to log in to Vault Kubernetes auth 'auth/kubernetes/login' as role 'sops'"))
+		g.Expect(vault.transitTokens).To(BeEmpty())
+	})
+
+	t.Run("token request failure", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := MasterKeyFromAddress("http://127.0.0.1:0", testEnginePath, "sops")
+		withServiceAccount(KubernetesAuth{Role: "sops"}, "tenant-a", "app", &fakeTokenRequester{}).ApplyToMasterKey(key)
+		err := key.Encrypt([]byte("data key"))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("cannot request token of service account 'tenant-a/app': service account not found"))
+	})
+
+	t.Run("without service account", func(t *testing.T) {
+		g := NewWithT(t)
+
+		key := MasterKeyFromAddress("http://127.0.0.1:0", testEnginePath, "sops")
+		(&KubernetesAuth{Role: "sops"}).ApplyToMasterKey(key)
+		err := key.Encrypt([]byte("data key"))
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("no service account to log in with"))
+	})
+}
+
+func TestMasterKey_kubernetesAuthClient(t *testing.T) {
+	g := NewWithT(t)
+
+	tokens := &fakeTokenRequester{token: "service-account-jwt"}
+	vault := &fakeKubernetesAuthVault{mountPath: "kubernetes", role: "sops", jwt: "service-account-jwt", ttl: 3600}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	scope := clientcache.New(1).Acquire("default", "sops-keys", "1")
+	defer scope.Release()
+	newKey := func(serviceAccount string) *MasterKey {
+		key := MasterKeyFromAddress(server.URL, testEnginePath, "sops")
+		withServiceAccount(KubernetesAuth{Role: "sops"}, "default", serviceAccount, tokens).ApplyToMasterKey(key)
+		ClientScope{Scope: scope}.ApplyToMasterKey(key)
+		return key
+	}
+
+	g.Expect(newKey("app").Encrypt([]byte("data key"))).To(Succeed())
+	g.Expect(newKey("app").Encrypt([]byte("data key"))).To(Succeed())
+	g.Expect(vault.logins).To(Equal(1), "held client reuses the token of the login")
+
+	// Once the token is about to expire, the held client logs in again.
+	c, held, err := scope.Client("hcvault-kubernetes\x00"+server.URL+"\x00\x00auth/kubernetes/login\x00sops\x00default/app", func() (interface{}, error) {
+		return nil, fmt.Errorf("not held")
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(held).To(BeTrue())
+	authClient := c.(*kubernetesAuthClient)
+	g.Expect(authClient.expiresAt).To(BeTemporally("~", time.Now().Add(time.Hour-kubernetesAuthRenewMargin), time.Minute))
+	authClient.expiresAt = time.Now().Add(-time.Second)
+
+	g.Expect(newKey("app").Encrypt([]byte("data key"))).To(Succeed())
+	g.Expect(vault.logins).To(Equal(2))
+	g.Expect(vault.transitTokens).To(Equal([]string{"login-1", "login-1", "login-2"}))
+	g.Expect(vault.loginTokens).To(Equal([]string{"", ""}), "login is not sent with the previous token")
+
+	// Another service account does not share the client.
+	g.Expect(newKey("other").Encrypt([]byte("data key"))).To(Succeed())
+	g.Expect(vault.logins).To(Equal(3))
+	g.Expect(tokens.requests).To(Equal([]string{
+		"default/app:" + KubernetesAuthAudience,
+		"default/app:" + KubernetesAuthAudience,
+		"default/other:" + KubernetesAuthAudience,
+	}))
+}
@@ -0,0 +1,26 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package keymap reads the fields of the map representation of the SOPS
+// master keys, as produced by their ToMap methods.
+package keymap
+
+import "fmt"
+
+// String returns the string value of the given field in the map, or an empty
+// string if the field is not set. It returns an error if the field is set to
+// a value of another type.
+func String(m map[string]interface{}, field string) (string, error) {
+	v, ok := m[field]
+	if !ok || v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field '%s' must be a string, got %T", field, v)
+	}
+	return s, nil
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package keymap
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestString(t *testing.T) {
+	g := NewWithT(t)
+
+	m := map[string]interface{}{
+		"enc":        "encrypted",
+		"created_at": nil,
+		"version":    1,
+	}
+
+	v, err := String(m, "enc")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v).To(Equal("encrypted"))
+
+	v, err = String(m, "created_at")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v).To(BeEmpty())
+
+	v, err = String(m, "missing")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v).To(BeEmpty())
+
+	_, err = String(m, "version")
+	g.Expect(err).To(MatchError("field 'version' must be a string, got int"))
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2023 The Flux authors
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package keyservice
+
+import (
+	"fmt"
+
+	"go.mozilla.org/sops/v3/keyservice"
+	"golang.org/x/net/context"
+)
+
+// azureAlgorithmsKey is the context key of the Azure Key Vault algorithms.
+type azureAlgorithmsKey struct{}
+
+// ContextWithAzureAlgorithms returns a copy of the context with the
+// algorithms the data key is encrypted with by the Azure Key Vault keys, by
+// key ID (as returned by azkv.MasterKey.ToString), e.g. as recorded in the
+// SOPS metadata of the file being decrypted. As the SOPS key service
+// requests do not carry the algorithm, the Server reads it from the context
+// of the requests instead.
+func ContextWithAzureAlgorithms(ctx context.Context, algorithms map[string]string) context.Context {
+	return context.WithValue(ctx, azureAlgorithmsKey{}, algorithms)
+}
+
+// AzureAlgorithmFromContext returns the algorithm of the Azure Key Vault key
+// configured on the context with ContextWithAzureAlgorithms, or an empty
+// string if there is none.
+func AzureAlgorithmFromContext(ctx context.Context, key *keyservice.AzureKeyVaultKey) string {
+	algorithms, _ := ctx.Value(azureAlgorithmsKey{}).(map[string]string)
+	return algorithms[fmt.Sprintf("%s/keys/%s/%s", key.VaultUrl, key.Name, key.Version)]
+}
@@ -8,7 +8,12 @@ package keyservice
 
 import (
 	"go.mozilla.org/sops/v3/age"
+	"go.mozilla.org/sops/v3/azkv"
+	"go.mozilla.org/sops/v3/gcpkms"
+	"go.mozilla.org/sops/v3/hcvault"
 	"go.mozilla.org/sops/v3/keys"
+	"go.mozilla.org/sops/v3/keyservice"
+	"go.mozilla.org/sops/v3/kms"
 	"go.mozilla.org/sops/v3/pgp"
 )
 
@@ -21,3 +26,49 @@ func IsOfflineMethod(mk keys.MasterKey) bool {
 		return false
 	}
 }
+
+// KeyProvider returns the name of the SOPS metadata field of the provider of
+// the master key, e.g. "azure_kv", or an empty string for unknown providers.
+func KeyProvider(mk keys.MasterKey) string {
+	switch mk.(type) {
+	case *age.MasterKey:
+		return "age"
+	case *azkv.MasterKey:
+		return "azure_kv"
+	case *gcpkms.MasterKey:
+		return "gcp_kms"
+	case *hcvault.MasterKey:
+		return "hc_vault"
+	case *kms.MasterKey:
+		return "kms"
+	case *pgp.MasterKey:
+		return "pgp"
+	default:
+		return ""
+	}
+}
+
+// KeyTypeProvider returns the name of the SOPS metadata field of the provider
+// of the key of a key service request, e.g. "azure_kv", or an empty string
+// for unknown providers.
+func KeyTypeProvider(key *keyservice.Key) string {
+	if key == nil {
+		return ""
+	}
+	switch key.KeyType.(type) {
+	case *keyservice.Key_AgeKey:
+		return "age"
+	case *keyservice.Key_AzureKeyvaultKey:
+		return "azure_kv"
+	case *keyservice.Key_GcpKmsKey:
+		return "gcp_kms"
+	case *keyservice.Key_VaultKey:
+		return "hc_vault"
+	case *keyservice.Key_KmsKey:
+		return "kms"
+	case *keyservice.Key_PgpKey:
+		return "pgp"
+	default:
+		return ""
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/fluxcd/kustomize-controller/internal/sops/age"
 	"github.com/fluxcd/kustomize-controller/internal/sops/awskms"
 	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
 	"github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
 	"github.com/fluxcd/kustomize-controller/internal/sops/pgp"
 )
@@ -40,6 +41,26 @@ func (o WithVaultToken) ApplyToServer(s *Server) {
 	s.vaultToken = hcvault.VaultToken(o)
 }
 
+// WithVaultNamespace configures the Hashicorp Vault Enterprise namespace on
+// the Server.
+type WithVaultNamespace string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithVaultNamespace) ApplyToServer(s *Server) {
+	s.vaultNamespace = hcvault.VaultNamespace(o)
+}
+
+// WithVaultKubernetesAuth configures the Hashicorp Vault Kubernetes auth
+// method on the Server, used when no Vault token is configured.
+type WithVaultKubernetesAuth struct {
+	Auth *hcvault.KubernetesAuth
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithVaultKubernetesAuth) ApplyToServer(s *Server) {
+	s.vaultKubernetesAuth = o.Auth
+}
+
 // WithAgeIdentities configures the parsed age identities on the Server.
 type WithAgeIdentities []extage.Identity
 
@@ -77,6 +98,160 @@ func (o WithAzureToken) ApplyToServer(s *Server) {
 	s.azureToken = o.Token
 }
 
+// WithAzureCABundle configures the PEM encoded CA bundle trusted when
+// connecting to Azure Key Vault on the Server.
+type WithAzureCABundle []byte
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureCABundle) ApplyToServer(s *Server) {
+	s.azureCABundle = azkv.CABundle(o)
+}
+
+// WithAzureTransport configures the proxy and minimum TLS version of the
+// connections to Azure Key Vault on the Server.
+type WithAzureTransport azkv.Transport
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureTransport) ApplyToServer(s *Server) {
+	s.azureTransport = azkv.Transport(o)
+}
+
+// WithAzureAPIVersion configures the Azure Key Vault data-plane API version
+// requested by the Server.
+type WithAzureAPIVersion string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureAPIVersion) ApplyToServer(s *Server) {
+	s.azureAPIVersion = azkv.APIVersion(o)
+}
+
+// WithAzureLogger configures the logger of the client request IDs of the
+// Azure Key Vault requests on the Server.
+type WithAzureLogger struct {
+	Logger azkv.Logger
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureLogger) ApplyToServer(s *Server) {
+	s.azureLogger = &o.Logger
+}
+
+// WithAzureLimiter configures the limiter of the concurrent Azure Key Vault
+// requests per vault on the Server.
+type WithAzureLimiter struct {
+	Limiter *azkv.VaultLimiter
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureLimiter) ApplyToServer(s *Server) {
+	s.azureLimiter = o.Limiter
+}
+
+// WithAzureBreaker configures the circuit breaker of the Azure Key Vault
+// Decrypt requests per vault on the Server.
+type WithAzureBreaker struct {
+	Breaker *azkv.VaultBreaker
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureBreaker) ApplyToServer(s *Server) {
+	s.azureBreaker = o.Breaker
+}
+
+// WithAzureRetryPolicy configures the retries of the throttled and otherwise
+// transiently failed Azure Key Vault requests on the Server.
+type WithAzureRetryPolicy azkv.RetryPolicy
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureRetryPolicy) ApplyToServer(s *Server) {
+	s.azureRetryPolicy = azkv.RetryPolicy(o)
+}
+
+// WithAzureRewriteVaultDNSSuffix configures the Server to rewrite the DNS
+// suffix of the vault URLs of another cloud than the one of the Azure token
+// to the suffix of the cloud of the token, instead of failing the requests.
+type WithAzureRewriteVaultDNSSuffix bool
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureRewriteVaultDNSSuffix) ApplyToServer(s *Server) {
+	s.azureRewriteVaultSuffix = azkv.RewriteVaultDNSSuffix(o)
+}
+
+// WithAzureRecoverDeletedKeys configures the Server to recover the Azure Key
+// Vault keys which are deleted but recoverable when decrypting with them,
+// instead of only failing the requests.
+type WithAzureRecoverDeletedKeys bool
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureRecoverDeletedKeys) ApplyToServer(s *Server) {
+	s.azureRecoverDeleted = azkv.RecoverDeletedKey(o)
+}
+
+// WithAzureResolveLatestVersion configures the Server to resolve the current
+// version of the Azure Key Vault keys of the Encrypt operations without a
+// version, or with azkv.LatestVersion, instead of encrypting with the
+// current version unresolved. It requires the 'get' permission on the keys.
+type WithAzureResolveLatestVersion bool
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureResolveLatestVersion) ApplyToServer(s *Server) {
+	s.azureResolveLatest = azkv.ResolveLatestVersion(o)
+}
+
+// WithAzureDisableDefaultCredential configures the Server to fail the
+// Encrypt and Decrypt operations of Azure Key Vault requests when no
+// WithAzureToken is configured, instead of authenticating with the default
+// credential of the controller.
+type WithAzureDisableDefaultCredential bool
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureDisableDefaultCredential) ApplyToServer(s *Server) {
+	s.azureNoDefaultCredential = azkv.DisableDefaultCredential(o)
+}
+
+// WithAzureDataKeyCache configures the cache of the data keys decrypted by
+// the Decrypt operations of Azure Key Vault requests on the Server.
+type WithAzureDataKeyCache struct {
+	Cache *azkv.DataKeyCache
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureDataKeyCache) ApplyToServer(s *Server) {
+	s.azureDataKeys = o.Cache
+}
+
+// WithAzureAllowedAlgorithms configures the Server to fail the Encrypt and
+// Decrypt operations of Azure Key Vault requests with an algorithm which is
+// not allowed, before sending them.
+type WithAzureAllowedAlgorithms azkv.AllowedAlgorithms
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureAllowedAlgorithms) ApplyToServer(s *Server) {
+	s.azureAllowedAlgorithms = azkv.AllowedAlgorithms(o)
+}
+
+// WithAzureDefaultAlgorithm configures the Server to decrypt the data keys
+// of Azure Key Vault requests with the given algorithm when the SOPS
+// metadata of the file does not record one.
+type WithAzureDefaultAlgorithm azkv.DefaultAlgorithm
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureDefaultAlgorithm) ApplyToServer(s *Server) {
+	s.azureDefaultAlgorithm = azkv.DefaultAlgorithm(o)
+}
+
+// WithClientScope configures the Scope of the decryption Secret holding the
+// AWS KMS, GCP KMS and Hashicorp Vault clients of the Encrypt and Decrypt
+// operations on the Server.
+type WithClientScope struct {
+	Scope *clientcache.Scope
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithClientScope) ApplyToServer(s *Server) {
+	s.clients = o.Scope
+}
+
 // WithDefaultServer configures the fallback default server on the Server.
 type WithDefaultServer struct {
 	Server keyservice.KeyServiceServer
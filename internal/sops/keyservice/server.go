@@ -15,6 +15,7 @@ import (
 	"github.com/fluxcd/kustomize-controller/internal/sops/age"
 	"github.com/fluxcd/kustomize-controller/internal/sops/awskms"
 	"github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	"github.com/fluxcd/kustomize-controller/internal/sops/clientcache"
 	"github.com/fluxcd/kustomize-controller/internal/sops/gcpkms"
 	"github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
 	"github.com/fluxcd/kustomize-controller/internal/sops/pgp"
@@ -39,14 +40,94 @@ type Server struct {
 
 	// vaultToken is the token used for Encrypt and Decrypt operations of
 	// Hashicorp Vault requests.
-	// When empty, the request will be handled by defaultServer.
+	// When empty, and without vaultKubernetesAuth or vaultNamespace, the
+	// request will be handled by defaultServer.
 	vaultToken hcvault.VaultToken
 
+	// vaultNamespace is the Vault Enterprise namespace of Encrypt and
+	// Decrypt operations of Hashicorp Vault requests. When empty, the
+	// VAULT_NAMESPACE environment variable is used, if set.
+	vaultNamespace hcvault.VaultNamespace
+
+	// vaultKubernetesAuth is the Kubernetes auth method logged in with for
+	// Encrypt and Decrypt operations of Hashicorp Vault requests when no
+	// vaultToken is configured.
+	vaultKubernetesAuth *hcvault.KubernetesAuth
+
 	// azureToken is the credential token used for Encrypt and Decrypt
 	// operations of Azure Key Vault requests.
 	// When nil, the request will be handled by defaultServer.
 	azureToken *azkv.Token
 
+	// azureCABundle is the PEM encoded CA bundle trusted in addition to the
+	// system roots for Encrypt and Decrypt operations of Azure Key Vault
+	// requests.
+	azureCABundle azkv.CABundle
+
+	// azureTransport configures the proxy and minimum TLS version of the
+	// connections of Encrypt and Decrypt operations of Azure Key Vault
+	// requests.
+	azureTransport azkv.Transport
+
+	// azureAPIVersion is the Azure Key Vault API version requested for
+	// Encrypt and Decrypt operations of Azure Key Vault requests. When
+	// empty, the default version of the SDK is used.
+	azureAPIVersion azkv.APIVersion
+
+	// azureLogger is the logger of the client request IDs of the Encrypt
+	// and Decrypt operations of Azure Key Vault requests. When nil, the
+	// request IDs are not logged.
+	azureLogger *azkv.Logger
+
+	// azureLimiter bounds the concurrent Encrypt and Decrypt operations of
+	// Azure Key Vault requests per vault. When nil, the operations are not
+	// limited.
+	azureLimiter *azkv.VaultLimiter
+
+	// azureBreaker fails the Decrypt operations of Azure Key Vault requests
+	// fast for the vaults which failed repeatedly. When nil, the operations
+	// are always sent.
+	azureBreaker *azkv.VaultBreaker
+
+	// azureRetryPolicy configures the retries of the throttled and otherwise
+	// transiently failed Azure Key Vault requests. The zero value uses the
+	// defaults of the Azure SDK.
+	azureRetryPolicy azkv.RetryPolicy
+
+	// azureRewriteVaultSuffix rewrites the DNS suffix of the vault URLs of
+	// another cloud than the one of the azureToken, instead of failing the
+	// Encrypt and Decrypt operations of Azure Key Vault requests.
+	azureRewriteVaultSuffix azkv.RewriteVaultDNSSuffix
+
+	// azureRecoverDeleted recovers the deleted but recoverable keys of the
+	// Decrypt operations of Azure Key Vault requests, instead of only
+	// failing the operations.
+	azureRecoverDeleted azkv.RecoverDeletedKey
+
+	// azureResolveLatest resolves the current version of the keys of the
+	// Encrypt operations of Azure Key Vault requests without a version.
+	azureResolveLatest azkv.ResolveLatestVersion
+
+	// azureNoDefaultCredential fails the Encrypt and Decrypt operations of
+	// Azure Key Vault requests without azureToken, instead of authenticating
+	// with the default credential.
+	azureNoDefaultCredential azkv.DisableDefaultCredential
+
+	// azureDataKeys caches the data keys decrypted by the Decrypt operations
+	// of Azure Key Vault requests, to not send identical requests again.
+	// When nil, the data keys are not cached.
+	azureDataKeys *azkv.DataKeyCache
+
+	// azureAllowedAlgorithms are the algorithms allowed for the Encrypt and
+	// Decrypt operations of Azure Key Vault requests. When empty, all the
+	// algorithms are allowed.
+	azureAllowedAlgorithms azkv.AllowedAlgorithms
+
+	// azureDefaultAlgorithm is the algorithm of the Decrypt operations of
+	// Azure Key Vault requests of which the SOPS metadata does not record
+	// one. When empty, RSA-OAEP-256 is used.
+	azureDefaultAlgorithm azkv.DefaultAlgorithm
+
 	// awsCredsProvider is the Credentials object used for Encrypt and Decrypt
 	// operations of AWS KMS requests.
 	// When nil, the request will be handled by defaultServer.
@@ -57,6 +138,12 @@ type Server struct {
 	// environmental runtime settings will be used.
 	gcpCredsJSON gcpkms.CredentialJSON
 
+	// clients holds the AWS KMS, GCP KMS and Hashicorp Vault clients of
+	// the credentials of the decryption Secret, across the Servers of the
+	// reconciliations decrypting with the same Secret. When nil, a client
+	// is constructed for every request.
+	clients *clientcache.Scope
+
 	// defaultServer is the fallback server, used to handle any request that
 	// is not eligible to be handled by this Server.
 	defaultServer keyservice.KeyServiceServer
@@ -101,7 +188,7 @@ func (ks Server) Encrypt(ctx context.Context, req *keyservice.EncryptRequest) (*
 			Ciphertext: ciphertext,
 		}, nil
 	case *keyservice.Key_VaultKey:
-		if ks.vaultToken != "" {
+		if ks.handlesHCVault() {
 			ciphertext, err := ks.encryptWithHCVault(k.VaultKey, req.Plaintext)
 			if err != nil {
 				return nil, err
@@ -119,7 +206,7 @@ func (ks Server) Encrypt(ctx context.Context, req *keyservice.EncryptRequest) (*
 			Ciphertext: cipherText,
 		}, nil
 	case *keyservice.Key_AzureKeyvaultKey:
-		ciphertext, err := ks.encryptWithAzureKeyVault(k.AzureKeyvaultKey, req.Plaintext)
+		ciphertext, err := ks.encryptWithAzureKeyVault(ctx, k.AzureKeyvaultKey, req.Plaintext)
 		if err != nil {
 			return nil, err
 		}
@@ -163,7 +250,7 @@ func (ks Server) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*
 			Plaintext: plaintext,
 		}, nil
 	case *keyservice.Key_VaultKey:
-		if ks.vaultToken != "" {
+		if ks.handlesHCVault() {
 			plaintext, err := ks.decryptWithHCVault(k.VaultKey, req.Ciphertext)
 			if err != nil {
 				return nil, err
@@ -181,7 +268,7 @@ func (ks Server) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*
 			Plaintext: plaintext,
 		}, nil
 	case *keyservice.Key_AzureKeyvaultKey:
-		plaintext, err := ks.decryptWithAzureKeyVault(k.AzureKeyvaultKey, req.Ciphertext)
+		plaintext, err := ks.decryptWithAzureKeyVault(ctx, k.AzureKeyvaultKey, req.Ciphertext)
 		if err != nil {
 			return nil, err
 		}
@@ -249,6 +336,13 @@ func (ks *Server) decryptWithAge(key *keyservice.AgeKey, ciphertext []byte) ([]b
 	return plaintext, err
 }
 
+// handlesHCVault returns whether the Hashicorp Vault requests are handled by
+// the Server, instead of the defaultServer: when a token, Kubernetes auth
+// method or namespace is configured.
+func (ks *Server) handlesHCVault() bool {
+	return ks.vaultToken != "" || ks.vaultKubernetesAuth != nil || ks.vaultNamespace != ""
+}
+
 func (ks *Server) encryptWithHCVault(key *keyservice.VaultKey, plaintext []byte) ([]byte, error) {
 	vaultKey := hcvault.MasterKey{
 		VaultAddress: key.VaultAddress,
@@ -256,6 +350,11 @@ func (ks *Server) encryptWithHCVault(key *keyservice.VaultKey, plaintext []byte)
 		KeyName:      key.KeyName,
 	}
 	ks.vaultToken.ApplyToMasterKey(&vaultKey)
+	ks.vaultNamespace.ApplyToMasterKey(&vaultKey)
+	if ks.vaultKubernetesAuth != nil {
+		ks.vaultKubernetesAuth.ApplyToMasterKey(&vaultKey)
+	}
+	hcvault.ClientScope{Scope: ks.clients}.ApplyToMasterKey(&vaultKey)
 	if err := vaultKey.Encrypt(plaintext); err != nil {
 		return nil, err
 	}
@@ -270,6 +369,11 @@ func (ks *Server) decryptWithHCVault(key *keyservice.VaultKey, ciphertext []byte
 	}
 	vaultKey.EncryptedKey = string(ciphertext)
 	ks.vaultToken.ApplyToMasterKey(&vaultKey)
+	ks.vaultNamespace.ApplyToMasterKey(&vaultKey)
+	if ks.vaultKubernetesAuth != nil {
+		ks.vaultKubernetesAuth.ApplyToMasterKey(&vaultKey)
+	}
+	hcvault.ClientScope{Scope: ks.clients}.ApplyToMasterKey(&vaultKey)
 	plaintext, err := vaultKey.Decrypt()
 	return plaintext, err
 }
@@ -287,6 +391,7 @@ func (ks *Server) encryptWithAWSKMS(key *keyservice.KmsKey, plaintext []byte) ([
 	if ks.awsCredsProvider != nil {
 		ks.awsCredsProvider.ApplyToMasterKey(&awsKey)
 	}
+	awskms.ClientScope{Scope: ks.clients}.ApplyToMasterKey(&awsKey)
 	if err := awsKey.Encrypt(plaintext); err != nil {
 		return nil, err
 	}
@@ -308,10 +413,11 @@ func (ks *Server) decryptWithAWSKMS(key *keyservice.KmsKey, cipherText []byte) (
 	if ks.awsCredsProvider != nil {
 		ks.awsCredsProvider.ApplyToMasterKey(&awsKey)
 	}
+	awskms.ClientScope{Scope: ks.clients}.ApplyToMasterKey(&awsKey)
 	return awsKey.Decrypt()
 }
 
-func (ks *Server) encryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, plaintext []byte) ([]byte, error) {
+func (ks *Server) encryptWithAzureKeyVault(ctx context.Context, key *keyservice.AzureKeyVaultKey, plaintext []byte) ([]byte, error) {
 	azureKey := azkv.MasterKey{
 		VaultURL: key.VaultUrl,
 		Name:     key.Name,
@@ -320,13 +426,31 @@ func (ks *Server) encryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, pla
 	if ks.azureToken != nil {
 		ks.azureToken.ApplyToMasterKey(&azureKey)
 	}
-	if err := azureKey.Encrypt(plaintext); err != nil {
+	if len(ks.azureCABundle) > 0 {
+		ks.azureCABundle.ApplyToMasterKey(&azureKey)
+	}
+	ks.azureTransport.ApplyToMasterKey(&azureKey)
+	if ks.azureAPIVersion != "" {
+		ks.azureAPIVersion.ApplyToMasterKey(&azureKey)
+	}
+	if ks.azureLogger != nil {
+		ks.azureLogger.ApplyToMasterKey(&azureKey)
+	}
+	if ks.azureLimiter != nil {
+		ks.azureLimiter.ApplyToMasterKey(&azureKey)
+	}
+	ks.azureRetryPolicy.ApplyToMasterKey(&azureKey)
+	ks.azureRewriteVaultSuffix.ApplyToMasterKey(&azureKey)
+	ks.azureAllowedAlgorithms.ApplyToMasterKey(&azureKey)
+	ks.azureNoDefaultCredential.ApplyToMasterKey(&azureKey)
+	ks.azureResolveLatest.ApplyToMasterKey(&azureKey)
+	if err := azureKey.EncryptContext(ctx, plaintext); err != nil {
 		return nil, err
 	}
 	return []byte(azureKey.EncryptedKey), nil
 }
 
-func (ks *Server) decryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, ciphertext []byte) ([]byte, error) {
+func (ks *Server) decryptWithAzureKeyVault(ctx context.Context, key *keyservice.AzureKeyVaultKey, ciphertext []byte) ([]byte, error) {
 	azureKey := azkv.MasterKey{
 		VaultURL: key.VaultUrl,
 		Name:     key.Name,
@@ -335,9 +459,44 @@ func (ks *Server) decryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, cip
 	if ks.azureToken != nil {
 		ks.azureToken.ApplyToMasterKey(&azureKey)
 	}
+	if len(ks.azureCABundle) > 0 {
+		ks.azureCABundle.ApplyToMasterKey(&azureKey)
+	}
+	ks.azureTransport.ApplyToMasterKey(&azureKey)
+	if ks.azureAPIVersion != "" {
+		ks.azureAPIVersion.ApplyToMasterKey(&azureKey)
+	}
+	if ks.azureLogger != nil {
+		ks.azureLogger.ApplyToMasterKey(&azureKey)
+	}
+	if ks.azureLimiter != nil {
+		ks.azureLimiter.ApplyToMasterKey(&azureKey)
+	}
+	if ks.azureBreaker != nil {
+		ks.azureBreaker.ApplyToMasterKey(&azureKey)
+	}
+	ks.azureRetryPolicy.ApplyToMasterKey(&azureKey)
+	ks.azureRewriteVaultSuffix.ApplyToMasterKey(&azureKey)
+	ks.azureRecoverDeleted.ApplyToMasterKey(&azureKey)
+	ks.azureAllowedAlgorithms.ApplyToMasterKey(&azureKey)
+	ks.azureNoDefaultCredential.ApplyToMasterKey(&azureKey)
+	if ks.azureDataKeys != nil {
+		ks.azureDataKeys.ApplyToMasterKey(&azureKey)
+	}
+	azureKey.Algorithm = AzureAlgorithmFromContext(ctx, key)
+	ks.azureDefaultAlgorithm.ApplyToMasterKey(&azureKey)
 	azureKey.EncryptedKey = string(ciphertext)
-	plaintext, err := azureKey.Decrypt()
-	return plaintext, err
+	// The data key is copied to the response for SOPS, the one decrypted by
+	// Azure Key Vault is zeroed once copied.
+	var plaintext []byte
+	err := azureKey.WithDecryptedDataKey(ctx, func(dataKey []byte) error {
+		plaintext = append([]byte(nil), dataKey...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plaintext, nil
 }
 
 func (ks *Server) encryptWithGCPKMS(key *keyservice.GcpKmsKey, plaintext []byte) ([]byte, error) {
@@ -345,6 +504,7 @@ func (ks *Server) encryptWithGCPKMS(key *keyservice.GcpKmsKey, plaintext []byte)
 		ResourceID: key.ResourceId,
 	}
 	ks.gcpCredsJSON.ApplyToMasterKey(&gcpKey)
+	gcpkms.ClientScope{Scope: ks.clients}.ApplyToMasterKey(&gcpKey)
 	if err := gcpKey.Encrypt(plaintext); err != nil {
 		return nil, err
 	}
@@ -356,6 +516,7 @@ func (ks *Server) decryptWithGCPKMS(key *keyservice.GcpKmsKey, ciphertext []byte
 		ResourceID: key.ResourceId,
 	}
 	ks.gcpCredsJSON.ApplyToMasterKey(&gcpKey)
+	gcpkms.ClientScope{Scope: ks.clients}.ApplyToMasterKey(&gcpKey)
 	gcpKey.EncryptedKey = string(ciphertext)
 	plaintext, err := gcpKey.Decrypt()
 	return plaintext, err
@@ -8,6 +8,8 @@ package keyservice
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 
@@ -110,6 +112,56 @@ func TestServer_EncryptDecrypt_HCVault(t *testing.T) {
 	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key from Vault transit backend"))
 }
 
+func TestServer_EncryptDecrypt_HCVault_KubernetesAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	fallback := NewMockKeyServer()
+	s := NewServer(WithVaultKubernetesAuth{Auth: &hcvault.KubernetesAuth{Role: "sops"}}, WithDefaultServer{Server: fallback})
+	key := KeyFromMasterKey(hcvault.MasterKeyFromAddress("https://example.com", "engine-path", "key-name"))
+	_, err := s.Encrypt(context.TODO(), &keyservice.EncryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to log in to Vault Kubernetes auth 'auth/kubernetes/login'"))
+
+	_, err = s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to log in to Vault Kubernetes auth 'auth/kubernetes/login'"))
+	g.Expect(fallback.encryptReqs).To(BeEmpty())
+	g.Expect(fallback.decryptReqs).To(BeEmpty())
+}
+
+func TestServer_EncryptDecrypt_HCVault_Namespace(t *testing.T) {
+	g := NewWithT(t)
+
+	var namespaces []string
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespaces = append(namespaces, r.Header.Get("X-Vault-Namespace"))
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+	}))
+	defer vault.Close()
+
+	fallback := NewMockKeyServer()
+	s := NewServer(WithVaultNamespace("admin/tenant-a"), WithDefaultServer{Server: fallback})
+	key := KeyFromMasterKey(hcvault.MasterKeyFromAddress(vault.URL, "engine-path", "key-name"))
+	_, err := s.Encrypt(context.TODO(), &keyservice.EncryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to encrypt sops data key to Vault transit backend"))
+
+	_, err = s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key from Vault transit backend"))
+	g.Expect(namespaces).To(Equal([]string{"admin/tenant-a", "admin/tenant-a"}))
+	g.Expect(fallback.encryptReqs).To(BeEmpty())
+	g.Expect(fallback.decryptReqs).To(BeEmpty())
+}
+
 func TestServer_EncryptDecrypt_HCVault_Fallback(t *testing.T) {
 	g := NewWithT(t)
 
@@ -174,11 +226,17 @@ func TestServer_EncryptDecrypt_azkv(t *testing.T) {
 	g.Expect(err.Error()).To(ContainSubstring("failed to encrypt sops data key with Azure Key Vault"))
 
 	_, err = s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
-		Key: &key,
+		Key:        &key,
+		Ciphertext: []byte("ciphertext"),
 	})
 	g.Expect(err).To(HaveOccurred())
 	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with Azure Key Vault"))
 
+	_, err = s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("no encrypted data key present for key"))
 }
 
 func TestServer_EncryptDecrypt_gcpkms(t *testing.T) {
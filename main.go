@@ -49,6 +49,7 @@ import (
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
 	"github.com/fluxcd/kustomize-controller/internal/controllers"
 	"github.com/fluxcd/kustomize-controller/internal/features"
+	intmetrics "github.com/fluxcd/kustomize-controller/internal/metrics"
 	"github.com/fluxcd/kustomize-controller/internal/statusreaders"
 	// +kubebuilder:scaffold:imports
 )
@@ -75,7 +76,24 @@ func main() {
 		eventsAddr            string
 		healthAddr            string
 		concurrent            int
+		concurrentPerSource   int
 		requeueDependency     time.Duration
+		sourceDebounce        time.Duration
+		azureKeyExpiryWindow  time.Duration
+		azureAuthCacheSize    int
+		azureAuthCacheTTL     time.Duration
+		kmsClientCacheSize    int
+		azureMaxRequests      int
+		azureBreakerThreshold int
+		azureBreakerCooldown  time.Duration
+		azureMaxAttempts      int
+		azureRetryDelay       time.Duration
+		azureMaxRetryDelay    time.Duration
+		azureProxyURL         string
+		azureMinTLSVersion    string
+		azureDataKeyCacheSize int
+		azureDataKeyCacheTTL  time.Duration
+		minIntervals          map[string]string
 		clientOptions         runtimeClient.Options
 		kubeConfigOpts        runtimeClient.KubeConfigOptions
 		logOptions            logger.Options
@@ -85,19 +103,123 @@ func main() {
 		aclOptions            acl.Options
 		noRemoteBases         bool
 		httpRetry             int
+		maxArtifactSize       int
+		maxManifests          int
 		defaultServiceAccount string
+		defaultDecryption     string
 		featureGates          feathelper.FeatureGates
+
+		allowCrossNamespaceImpersonation bool
+		allowUnsupportedSOPSKeyProviders bool
+		failOnUnmatchedPatches           bool
+		allowBuildDumps                  bool
+		allowSubstitutionPreviews        bool
+		azureSkipIMDSProbe               bool
+		azureRewriteVaultSuffix          bool
+		azureRecoverDeletedKeys          bool
+		azureResolveLatestVersion        bool
+		azureDisableDefaultCredential    bool
+		azureAllowWorkloadIdentity       bool
+		vaultAllowKubernetesAuth         bool
+		warnDataKeyRotation              bool
+		azureAuthFileDir                 string
+		azureAllowedAlgorithms           []string
+		azureDefaultAlgorithm            string
+		reconcileCacheTTL                time.Duration
+		reconcileTimeout                 time.Duration
+		allowedBuildPlugins              []string
+		postApplyWebhookAllowedHosts     []string
 	)
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&eventsAddr, "events-addr", "", "The address of the events receiver.")
 	flag.StringVar(&healthAddr, "health-addr", ":9440", "The address the health endpoint binds to.")
 	flag.IntVar(&concurrent, "concurrent", 4, "The number of concurrent kustomize reconciles.")
+	flag.IntVar(&concurrentPerSource, "concurrent-per-source", 0,
+		"The number of concurrent reconciles of the Kustomizations referring to the same source. Defaults to 0 (no limit).")
 	flag.DurationVar(&requeueDependency, "requeue-dependency", 30*time.Second, "The interval at which failing dependencies are reevaluated.")
+	flag.DurationVar(&sourceDebounce, "source-debounce-interval", 0,
+		"The interval during which the revision changes of a source are merged into a single reconciliation of the latest revision. Defaults to 0 (no delay).")
 	flag.BoolVar(&noRemoteBases, "no-remote-bases", false,
 		"Disallow remote bases usage in Kustomize overlays. When this flag is enabled, all resources must refer to local files included in the source artifact.")
 	flag.IntVar(&httpRetry, "http-retry", 9, "The maximum number of retries when failing to fetch artifacts over HTTP.")
+	flag.IntVar(&maxArtifactSize, "max-artifact-size", 0,
+		"The maximum total size in bytes of the files extracted from an artifact, and the maximum size in bytes of each file decrypted during the build. Defaults to 0 (no limit).")
+	flag.IntVar(&maxManifests, "max-manifests", 0,
+		"The maximum number of objects produced by the build of a Kustomization. Defaults to 0 (no limit).")
 	flag.StringVar(&defaultServiceAccount, "default-service-account", "", "Default service account used for impersonation.")
+	flag.StringVar(&defaultDecryption, "default-decryption-secret", "",
+		"The name of the Secret with the SOPS decryption keys used by the Kustomizations of its namespace which do not define spec.decryption.")
+	flag.BoolVar(&allowCrossNamespaceImpersonation, "allow-cross-namespace-impersonation", false,
+		"Allow Kustomizations to impersonate service accounts from other namespaces with spec.serviceAccountNamespace.")
+	flag.BoolVar(&allowUnsupportedSOPSKeyProviders, "allow-unsupported-sops-key-providers", false,
+		"Log a warning instead of failing the reconciliation when a SOPS file references key providers which are not supported by the controller.")
+	flag.BoolVar(&failOnUnmatchedPatches, "fail-on-unmatched-patches", false,
+		"Fail the reconciliation when the target of a patch in spec.patches does not match any of the objects built from a Kustomization.")
+	flag.BoolVar(&allowBuildDumps, "allow-build-dumps", false,
+		"Allow Kustomizations to dump their build result to a ConfigMap with the kustomize.toolkit.fluxcd.io/dump-build annotation.")
+	flag.BoolVar(&allowSubstitutionPreviews, "allow-substitution-previews", false,
+		"Allow Kustomizations to preview their post build variable substitution in a ConfigMap with the kustomize.toolkit.fluxcd.io/preview-substitution annotation.")
+	flag.DurationVar(&azureKeyExpiryWindow, "azure-key-expiry-window", 0,
+		"The window before the expiry of the Azure Key Vault keys used for decryption in which the DecryptionKeyExpiring condition is set. Defaults to 0 (no expiry checks).")
+	flag.IntVar(&azureAuthCacheSize, "azure-auth-cache-size", 100,
+		"The maximum number of decryption Secrets of which the Azure credentials are reused across reconciliations while the Secret is unchanged, and of distinct Azure credentials shared across Secrets. Set to 0 to disable the cache.")
+	flag.DurationVar(&azureAuthCacheTTL, "azure-auth-cache-ttl", time.Hour,
+		"The maximum duration for which the cached Azure credentials of the decryption Secrets and of the controller are reused, after which they are constructed again. Set to 0 to reuse them until the Secret changes.")
+	flag.IntVar(&kmsClientCacheSize, "kms-client-cache-size", 100,
+		"The maximum number of decryption Secrets of which the AWS KMS, GCP KMS and Hashicorp Vault clients are reused across reconciliations while the Secret is unchanged. Set to 0 to disable the cache.")
+	flag.IntVar(&azureMaxRequests, "azure-kv-max-concurrent-requests", 0,
+		"The maximum number of concurrent encrypt and decrypt requests to an Azure Key Vault, shared by all reconciliations. Defaults to 0 (no limit).")
+	flag.IntVar(&azureBreakerThreshold, "azure-kv-breaker-failure-threshold", 0,
+		"The number of consecutive failures of an Azure Key Vault after which its decrypt requests are failed without being sent for the breaker cooldown. Defaults to 0 (no circuit breaker).")
+	flag.DurationVar(&azureBreakerCooldown, "azure-kv-breaker-cooldown", 30*time.Second,
+		"The duration for which the decrypt requests to an Azure Key Vault are failed once its circuit breaker opened, after which a single request probes the vault.")
+	flag.IntVar(&azureMaxAttempts, "azure-kv-max-attempts", 0,
+		"The maximum number of attempts of an encrypt or decrypt request to an Azure Key Vault which is throttled or fails transiently, including the first one. Set to 1 to disable the retries. Defaults to 0 (the default of the Azure SDK).")
+	flag.DurationVar(&azureRetryDelay, "azure-kv-retry-delay", 0,
+		"The delay before the first retry of an Azure Key Vault request, which grows exponentially with every retry unless the vault returns a Retry-After header. Defaults to 0 (the default of the Azure SDK).")
+	flag.DurationVar(&azureMaxRetryDelay, "azure-kv-max-retry-delay", 0,
+		"The maximum delay before a retry of an Azure Key Vault request. Defaults to 0 (the default of the Azure SDK).")
+	flag.StringVar(&azureProxyURL, "azure-kv-proxy-url", "",
+		"The URL of the proxy of the requests to Azure Key Vault, e.g. 'http://proxy.example.com:3128'. Defaults to empty (the proxy of the HTTPS_PROXY and NO_PROXY environment variables).")
+	flag.StringVar(&azureMinTLSVersion, "azure-kv-min-tls-version", "",
+		"The minimum TLS version of the connections to Azure Key Vault, either '1.2' or '1.3'. Defaults to '1.2'.")
+	flag.IntVar(&azureDataKeyCacheSize, "azure-kv-data-key-cache-size", 0,
+		"The maximum number of SOPS data keys decrypted with Azure Key Vault keys which are cached, to decrypt identical SOPS files with the same credentials once across reconciliations and Kustomizations. Defaults to 0 (no cache).")
+	flag.DurationVar(&azureDataKeyCacheTTL, "azure-kv-data-key-cache-ttl", 10*time.Minute,
+		"The maximum duration for which the cached SOPS data keys decrypted with Azure Key Vault keys are reused, after which they are decrypted with the vault again, for a permission revoked on a key to take effect. Must be positive when the data keys are cached.")
+	flag.StringSliceVar(&azureAllowedAlgorithms, "azure-kv-allowed-algorithms", nil,
+		"The Azure Key Vault encryption algorithms the SOPS data keys can be decrypted with, e.g. 'RSA-OAEP-256'. The decryption with any other algorithm fails before the request is sent. Defaults to none (all algorithms are allowed).")
+	flag.StringVar(&azureDefaultAlgorithm, "azure-kv-default-algorithm", "",
+		"The Azure Key Vault encryption algorithm the SOPS data keys are decrypted with when the SOPS metadata of the file does not record one, e.g. 'RSA-OAEP' for legacy files. Defaults to 'RSA-OAEP-256'.")
+	flag.BoolVar(&azureSkipIMDSProbe, "azure-skip-imds-probe", false,
+		"Skip the probe of the Azure Instance Metadata Service before constructing a managed identity credential from a decryption Secret.")
+	flag.BoolVar(&azureRewriteVaultSuffix, "azure-kv-rewrite-vault-suffix", false,
+		"Rewrite the DNS suffix of the Azure Key Vault URLs of SOPS files to the one of the cloud of the decryption credentials, instead of failing the decryption when they do not match.")
+	flag.DurationVar(&reconcileCacheTTL, "reconcile-cache-ttl", 0,
+		"The duration for which the reconciliations of an unchanged source revision and Kustomization only check the applied objects for changes, instead of building and applying the revision again, rounded up to a whole number of the interval of each Kustomization. Defaults to 0 (every reconciliation is a full one).")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 0,
+		"The maximum duration of a reconciliation, of which the remaining budget bounds the requests to the key services of the SOPS decryption. Defaults to 0 (no deadline).")
+	flag.BoolVar(&azureRecoverDeletedKeys, "azure-kv-recover-deleted-keys", false,
+		"Recover the Azure Key Vault keys of SOPS files which are deleted but recoverable from the soft-deleted keys of their vault, instead of failing the decryption.")
+	flag.BoolVar(&azureResolveLatestVersion, "azure-kv-resolve-latest-version", false,
+		"Resolve the current version of the Azure Key Vault keys without a version, or with the 'latest' version, when encrypting with them. Requires the 'get' permission on the keys.")
+	flag.BoolVar(&azureDisableDefaultCredential, "azure-disable-default-credential", false,
+		"Fail the decryption with Azure Key Vault keys when the decryption Secret of a Kustomization contains no Azure credentials, instead of authenticating with the environment, workload identity or managed identity of the controller. Rejects the managed identities and workload identity configured by the decryption Secrets.")
+	flag.BoolVar(&azureAllowWorkloadIdentity, "azure-allow-workload-identity", false,
+		"Allow the Azure authentication files of the decryption Secrets to set 'workloadIdentity', which authenticates with the federated service account token of the controller. Can not be combined with --azure-disable-default-credential.")
+	flag.BoolVar(&vaultAllowKubernetesAuth, "vault-allow-kubernetes-auth", false,
+		"Allow the decryption Secrets to log in to the HashiCorp Vault Kubernetes auth method with 'sops.vault-kubernetes-auth', with a token of the service account of the Kustomization requested for the 'vault' audience.")
+	flag.BoolVar(&warnDataKeyRotation, "warn-data-key-rotation", false,
+		"Emit a warning event and record a metric for the decryption keys of which the SOPS data key of a decrypted file was encrypted longer ago than the rotation threshold of the key provider, e.g. six months for Azure Key Vault.")
+	flag.StringVar(&azureAuthFileDir, "azure-auth-file-dir", "",
+		"The directory of the Azure authentication files mounted in the controller Pod, e.g. from projected volumes, which the Kustomizations can reference with .spec.decryption.azureAuthFile. Defaults to empty (no file can be referenced).")
+	flag.StringToStringVar(&minIntervals, "min-interval-per-source-kind", nil,
+		"The minimum interval at which the Kustomizations are reconciled by the kind of their source, e.g. 'GitRepository=10m,OCIRepository=1m'. A shorter spec.interval is raised to it.")
+	flag.StringSliceVar(&allowedBuildPlugins, "allowed-build-plugins", nil,
+		"The types of non-builtin Kustomize plugins which Kustomizations are allowed to enable with spec.buildOptions.plugins, 'Exec' and/or 'Container'. Defaults to none.")
+	flag.StringSliceVar(&postApplyWebhookAllowedHosts, "post-apply-webhook-allowed-hosts", nil,
+		"The hosts of the URLs which Kustomizations are allowed to call with spec.postApplyWebhook, e.g. 'policy.policy-system.svc'. Defaults to none (post-apply webhooks are disabled).")
 
 	clientOptions.BindFlags(flag.CommandLine)
 	logOptions.BindFlags(flag.CommandLine)
@@ -122,6 +244,17 @@ func main() {
 		watchNamespace = os.Getenv("RUNTIME_NAMESPACE")
 	}
 
+	minIntervalPerSourceKind, err := parseMinIntervals(minIntervals)
+	if err != nil {
+		setupLog.Error(err, "unable to parse the minimum intervals per source kind")
+		os.Exit(1)
+	}
+
+	if err := checkBuildPlugins(allowedBuildPlugins); err != nil {
+		setupLog.Error(err, "unable to parse the allowed build plugins")
+		os.Exit(1)
+	}
+
 	watchSelector, err := runtimeCtrl.GetWatchSelector(watchOptions)
 	if err != nil {
 		setupLog.Error(err, "unable to configure watch label selector for manager")
@@ -194,17 +327,60 @@ func main() {
 		DefaultServiceAccount: defaultServiceAccount,
 		Client:                mgr.GetClient(),
 		Metrics:               metricsH,
+		ExtendedMetrics:       intmetrics.MustMakeRecorder(),
 		EventRecorder:         eventRecorder,
 		NoCrossNamespaceRefs:  aclOptions.NoCrossNamespaceRefs,
 		NoRemoteBases:         noRemoteBases,
 		KubeConfigOpts:        kubeConfigOpts,
 		PollingOpts:           pollingOpts,
 		StatusPoller:          polling.NewStatusPoller(mgr.GetClient(), mgr.GetRESTMapper(), pollingOpts),
+
+		AllowCrossNamespaceImpersonation: allowCrossNamespaceImpersonation,
+		AllowUnsupportedSOPSKeyProviders: allowUnsupportedSOPSKeyProviders,
+		FailOnUnmatchedPatches:           failOnUnmatchedPatches,
+		AllowBuildDumps:                  allowBuildDumps,
+		AllowSubstitutionPreviews:        allowSubstitutionPreviews,
+		AllowedBuildPlugins:              allowedBuildPlugins,
+		AzureKeyExpiryWindow:             azureKeyExpiryWindow,
+		WarnDataKeyRotation:              warnDataKeyRotation,
+		DefaultDecryptionSecret:          defaultDecryption,
 	}).SetupWithManager(mgr, controllers.KustomizationReconcilerOptions{
 		MaxConcurrentReconciles:   concurrent,
 		DependencyRequeueInterval: requeueDependency,
 		HTTPRetry:                 httpRetry,
 		RateLimiter:               runtimeCtrl.GetRateLimiter(rateLimiterOptions),
+
+		MaxConcurrentReconcilesPerSource: concurrentPerSource,
+		MaxArtifactSize:                  maxArtifactSize,
+		MaxManifests:                     maxManifests,
+		SourceDebounceInterval:           sourceDebounce,
+		AzureAuthCacheSize:               azureAuthCacheSize,
+		AzureAuthCacheTTL:                azureAuthCacheTTL,
+		KMSClientCacheSize:               kmsClientCacheSize,
+		AzureMaxConcurrentRequests:       azureMaxRequests,
+		AzureBreakerFailureThreshold:     azureBreakerThreshold,
+		AzureBreakerCooldown:             azureBreakerCooldown,
+		AzureMaxAttempts:                 azureMaxAttempts,
+		AzureRetryDelay:                  azureRetryDelay,
+		AzureMaxRetryDelay:               azureMaxRetryDelay,
+		AzureProxyURL:                    azureProxyURL,
+		AzureMinTLSVersion:               azureMinTLSVersion,
+		AzureSkipIMDSProbe:               azureSkipIMDSProbe,
+		AzureRewriteVaultDNSSuffix:       azureRewriteVaultSuffix,
+		AzureRecoverDeletedKeys:          azureRecoverDeletedKeys,
+		AzureResolveLatestVersion:        azureResolveLatestVersion,
+		AzureDisableDefaultCredential:    azureDisableDefaultCredential,
+		AzureAllowWorkloadIdentity:       azureAllowWorkloadIdentity,
+		VaultAllowKubernetesAuth:         vaultAllowKubernetesAuth,
+		AzureDataKeyCacheSize:            azureDataKeyCacheSize,
+		AzureDataKeyCacheTTL:             azureDataKeyCacheTTL,
+		AzureAllowedAlgorithms:           azureAllowedAlgorithms,
+		AzureDefaultAlgorithm:            azureDefaultAlgorithm,
+		AzureAuthFileDir:                 azureAuthFileDir,
+		MinIntervalPerSourceKind:         minIntervalPerSourceKind,
+		ReconcileCacheTTL:                reconcileCacheTTL,
+		ReconcileTimeout:                 reconcileTimeout,
+		PostApplyWebhookAllowedHosts:     postApplyWebhookAllowedHosts,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", controllerName)
 		os.Exit(1)
@@ -217,3 +393,35 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// parseMinIntervals parses the minimum intervals per source kind, and checks
+// that the kinds are supported as sources of Kustomizations.
+func parseMinIntervals(values map[string]string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration, len(values))
+	for kind, value := range values {
+		switch kind {
+		case sourcev1.GitRepositoryKind, sourcev1b2.OCIRepositoryKind, sourcev1b2.BucketKind:
+		default:
+			return nil, fmt.Errorf("unsupported source kind '%s'", kind)
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval for source kind '%s': %w", kind, err)
+		}
+		intervals[kind] = interval
+	}
+	return intervals, nil
+}
+
+// checkBuildPlugins returns an error if any of the build plugin types is not
+// supported.
+func checkBuildPlugins(types []string) error {
+	for _, t := range types {
+		switch t {
+		case kustomizev1.ExecBuildPlugin, kustomizev1.ContainerBuildPlugin:
+		default:
+			return fmt.Errorf("unsupported build plugin type '%s'", t)
+		}
+	}
+	return nil
+}